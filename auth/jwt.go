@@ -0,0 +1,319 @@
+// Package auth implements the verification of the tokens presented by the
+// clients of the proxy: the JSON Web Tokens signed with a shared key, e.g. the
+// tokens issued by the proxy itself, and the ID tokens of the OpenID Connect
+// providers, verified with the keys advertised by their discovery document.
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when validating the time claims.
+const jwtLeeway = time.Minute
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims are the claims of a JSON Web Token.
+type Claims map[string]interface{}
+
+// String returns a string claim.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that can be either a string or an array of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Lookup returns a string or array claim given its dotted path, e.g.
+// `realm_access.roles`. Claim names containing dots (e.g. `kubernetes.io`)
+// are supported.
+func (c Claims) Lookup(path string) []string {
+	if _, ok := c[path]; ok {
+		return c.Strings(path)
+	}
+
+	for i := range path {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := c[path[:i]].(map[string]interface{}); ok {
+			if values := Claims(nested).Lookup(path[i+1:]); values != nil {
+				return values
+			}
+		}
+	}
+
+	return nil
+}
+
+// Time returns a NumericDate claim.
+func (c Claims) Time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// validateTimes checks the `exp` and `nbf` claims. `exp` is required.
+func (c Claims) validateTimes(now time.Time) error {
+	exp, ok := c.Time("exp")
+	if !ok {
+		return errors.New("token has no expiration time")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// HasAudience returns true when the `aud` claim contains audience.
+func (c Claims) HasAudience(audience string) bool {
+	for _, aud := range c.Strings("aud") {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWT decodes a token without verifying its signature.
+func parseJWT(token string) (header jwtHeader, claims Claims, signingInput string, signature []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, "", nil, errors.New("malformed token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return header, nil, "", nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return header, nil, "", nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	return header, claims, parts[0] + "." + parts[1], signature, nil
+}
+
+// UnverifiedClaims returns the claims of a token without verifying it.
+func UnverifiedClaims(token string) (Claims, error) {
+	_, claims, _, _, err := parseJWT(token)
+	return claims, err
+}
+
+// UnverifiedIssuer returns the `iss` claim of a token without verifying it, so
+// that a token can be sent to the right verifier.
+func UnverifiedIssuer(token string) string {
+	claims, err := UnverifiedClaims(token)
+	if err != nil {
+		return ""
+	}
+	return claims.String("iss")
+}
+
+// SignHS256 returns a token signed with a shared key.
+func SignHS256(claims interface{}, key []byte) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyHS256 verifies the signature and the time claims of a token signed with
+// a shared key.
+func VerifyHS256(token string, key []byte, now time.Time) (Claims, error) {
+	header, claims, signingInput, signature, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unexpected signing algorithm: %s", header.Alg)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	if err := claims.validateTimes(now); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// jsonWebKey is a public key from a JWKS document.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// publicKey returns the RSA or ECDSA public key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// verifySignature verifies an asymmetric JWT signature.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signingInput))
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signingInput))
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512([]byte(signingInput))
+		digest = sum[:]
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %s does not match an EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported public key")
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyHS256(t *testing.T) {
+	now := time.Now()
+	token, _ := SignHS256(map[string]interface{}{"iss": "some-issuer", "exp": now.Add(time.Minute).Unix()}, []byte("secret"))
+
+	if _, err := VerifyHS256(token, []byte("secret"), now); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := VerifyHS256(token, []byte("other secret"), now); err == nil {
+		t.Fatal("expected an invalid signature")
+	}
+	if _, err := VerifyHS256(token, []byte("secret"), now.Add(time.Hour)); err == nil {
+		t.Fatal("expected an expired token")
+	}
+	if issuer := UnverifiedIssuer(token); issuer != "some-issuer" {
+		t.Fatalf("expected: some-issuer, got: %s", issuer)
+	}
+}
+
+func TestClaimsLookup(t *testing.T) {
+	claims := Claims{
+		"groups":        []interface{}{"a", "b"},
+		"realm_access":  map[string]interface{}{"roles": []interface{}{"admin"}},
+		"kubernetes.io": map[string]interface{}{"namespace": "team-a"},
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "groups", expected: "a,b"},
+		{path: "realm_access.roles", expected: "admin"},
+		{path: "kubernetes.io.namespace", expected: "team-a"},
+		{path: "unknown.claim", expected: ""},
+	} {
+		if values := strings.Join(claims.Lookup(tc.path), ","); values != tc.expected {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expected, values)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often the keys of a provider are fetched when
+// a token is signed with an unknown key.
+const jwksRefreshInterval = time.Minute
+
+// Verifier verifies the ID tokens issued by an OpenID Connect provider,
+// using the keys advertised by its discovery document.
+type Verifier struct {
+	issuer     string
+	audience   string
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewVerifier returns a verifier of the ID tokens of issuer, issued for
+// audience.
+func NewVerifier(issuer, audience string) *Verifier {
+	return &Verifier{
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		audience:   audience,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+		keys:       map[string]crypto.PublicKey{},
+	}
+}
+
+// Issuer returns the issuer of the tokens accepted by the verifier.
+func (v *Verifier) Issuer() string {
+	return v.issuer
+}
+
+// Verify verifies the signature and the standard claims of a token.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	header, claims, signingInput, signature, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(claims.String("iss"), "/") != v.issuer {
+		return nil, fmt.Errorf("unexpected issuer: %s", claims.String("iss"))
+	}
+	// The audience is required, otherwise the tokens issued to any client of
+	// the issuer would be accepted.
+	if v.audience == "" {
+		return nil, fmt.Errorf("no audience configured for the issuer %s", v.issuer)
+	}
+	if !claims.HasAudience(v.audience) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims.Strings("aud"))
+	}
+	if err := claims.validateTimes(v.now()); err != nil {
+		return nil, err
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, signingInput, signature); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	if v.now().Sub(v.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+
+	keys, err := v.fetchKeys(ctx)
+	v.fetchedAt = v.now()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key: %q", kid)
+}
+
+// lookup returns a known key. The lock must be held.
+func (v *Verifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := v.keys[kid]; ok {
+		return key, true
+	}
+	// Providers with a single key don't always set a key ID in the tokens.
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (v *Verifier) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int
+	provider := httptest.NewServer(nil)
+	defer provider.Close()
+	provider.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":"%s","jwks_uri":"%s/jwks"}`, provider.URL, provider.URL)
+		case "/jwks":
+			fetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "some-key",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	sign := func(kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid})
+		payload, _ := json.Marshal(claims)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	verifier := NewVerifier(provider.URL+"/", "some-audience")
+	for _, tc := range []struct {
+		name    string
+		token   string
+		invalid bool
+	}{
+		{name: "valid", token: sign("some-key", map[string]interface{}{"iss": provider.URL, "aud": "some-audience", "sub": "some-user", "exp": exp})},
+		{name: "audience", token: sign("some-key", map[string]interface{}{"iss": provider.URL, "aud": "other-audience", "exp": exp}), invalid: true},
+		{name: "issuer", token: sign("some-key", map[string]interface{}{"iss": "https://other.example.com", "aud": "some-audience", "exp": exp}), invalid: true},
+		{name: "expired", token: sign("some-key", map[string]interface{}{"iss": provider.URL, "aud": "some-audience", "exp": time.Now().Add(-time.Hour).Unix()}), invalid: true},
+		{name: "key", token: sign("other-key", map[string]interface{}{"iss": provider.URL, "aud": "some-audience", "exp": exp}), invalid: true},
+	} {
+		claims, err := verifier.Verify(context.Background(), tc.token)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil || claims.String("sub") != "some-user" {
+			t.Errorf("%s: expected the claims, got: %v (%v)", tc.name, claims, err)
+		}
+	}
+
+	// The keys are not fetched again for the unknown keys right away.
+	if fetches != 1 {
+		t.Fatalf("expected: 1, got: %d", fetches)
+	}
+}
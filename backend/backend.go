@@ -0,0 +1,186 @@
+// Package backend defines the interface implemented by the registries the
+// container proxy can expose through the Docker Registry HTTP API V2.
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a backend when a repository, a tag or a
+	// version does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNotSupported is returned by a backend when an optional operation is
+	// not supported, e.g. by the backend it wraps.
+	ErrNotSupported = errors.New("not supported")
+)
+
+// Reasons of the credentials errors.
+const (
+	// ReasonBadCredentials means that the credentials are invalid or expired.
+	ReasonBadCredentials = "bad_credentials"
+	// ReasonMissingScope means that the credentials lack a permission.
+	ReasonMissingScope = "missing_scope"
+	// ReasonSSORequired means that the credentials must be authorized for
+	// single sign-on by an organization.
+	ReasonSSORequired = "sso_required"
+)
+
+// CredentialsError is returned by a backend when its credentials cannot be
+// used, with an actionable message for the operators.
+type CredentialsError struct {
+	Reason  string
+	Message string
+	Err     error
+}
+
+func (e *CredentialsError) Error() string {
+	return e.Message
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// Repository identifies a repository made available by a backend.
+type Repository struct {
+	Owner string
+	Name  string
+}
+
+// RegistryBackend describes the registry operations needed by the container
+// proxy. Custom backends can be compiled in by implementing this interface.
+type RegistryBackend interface {
+	// ListRepositories returns the repositories available in the registry. A
+	// backend aggregating several sources returns the repositories it could
+	// list along with the error of a failed source, so that the callers can
+	// serve a previous listing or the partial one.
+	ListRepositories(ctx context.Context) ([]Repository, error)
+
+	// ListTags returns the tags of a repository.
+	ListTags(ctx context.Context, owner, name string) ([]string, error)
+
+	// ResolveTag returns the digest a tag points to.
+	ResolveTag(ctx context.Context, owner, name, tag string) (string, error)
+
+	// DeleteVersion deletes the version referenced by either a tag or a
+	// digest.
+	DeleteVersion(ctx context.Context, owner, name, reference string) error
+}
+
+// OwnerRepositoryLister is implemented by the backends able to list the
+// repositories of a single owner without listing all the repositories.
+type OwnerRepositoryLister interface {
+	// ListOwnerRepositories returns the repositories of an owner.
+	ListOwnerRepositories(ctx context.Context, owner string) ([]Repository, error)
+}
+
+// FilterOwner returns the repositories of an owner, whose name is compared
+// case-insensitively.
+func FilterOwner(repositories []Repository, owner string) []Repository {
+	var filtered []Repository
+	for _, repository := range repositories {
+		if strings.EqualFold(repository.Owner, owner) {
+			filtered = append(filtered, repository)
+		}
+	}
+	return filtered
+}
+
+// ListOwnerRepositories returns the repositories of an owner, with
+// OwnerRepositoryLister when the backend implements it. The repositories
+// partially listed are returned along with the error.
+func ListOwnerRepositories(ctx context.Context, b RegistryBackend, owner string) ([]Repository, error) {
+	if lister, ok := b.(OwnerRepositoryLister); ok {
+		return lister.ListOwnerRepositories(ctx, owner)
+	}
+	repositories, err := b.ListRepositories(ctx)
+	return FilterOwner(repositories, owner), err
+}
+
+// Owner is an owner of repositories aggregated by a backend, e.g. a GitHub
+// user or organization.
+type Owner struct {
+	// Name is the name of the owner, empty for the authenticated user of the
+	// backend.
+	Name string
+	// Packages is the number of repositories of the owner.
+	Packages int
+	// RefreshedAt is when the repositories of the owner were last listed, zero
+	// when they never were.
+	RefreshedAt time.Time
+}
+
+// OwnerLister is implemented by the backends able to describe the owners
+// whose repositories they aggregate.
+type OwnerLister interface {
+	// ListOwners returns the owners aggregated by the backend.
+	ListOwners(ctx context.Context) ([]Owner, error)
+}
+
+// Version is a version of a repository, i.e. a manifest and its tags.
+type Version struct {
+	Digest string
+	Tags   []string
+	// CreatedAt is when the version was pushed, zero when it is unknown.
+	CreatedAt time.Time
+}
+
+// VersionFinder is implemented by the backends able to find the version that
+// DeleteVersion would delete, which is used to preview the deletions (dry
+// runs).
+type VersionFinder interface {
+	// FindVersion returns the version referenced by either a tag or a digest.
+	FindVersion(ctx context.Context, owner, name, reference string) (Version, error)
+}
+
+// VersionLister is implemented by the backends able to list the versions of a
+// repository, which is used to resolve the virtual tags.
+type VersionLister interface {
+	// ListVersions returns the versions of a repository.
+	ListVersions(ctx context.Context, owner, name string) ([]Version, error)
+}
+
+// Source is the source code repository of a repository, e.g. the GitHub
+// repository an image is built from.
+type Source struct {
+	URL         string
+	Description string
+	// License is the SPDX identifier of the license, e.g. "MIT".
+	License string
+}
+
+// SourceFinder is implemented by the backends able to link a repository to
+// its source code repository.
+type SourceFinder interface {
+	// FindSource returns the source code repository of a repository, or
+	// ErrNotFound when it is not linked to one.
+	FindSource(ctx context.Context, owner, name string) (Source, error)
+}
+
+// The formats of the READMEs returned by a ReadmeFinder.
+const (
+	ReadmeFormatMarkdown = "markdown"
+	ReadmeFormatHTML     = "html"
+)
+
+// Invalidator is implemented by the backends keeping the repositories and
+// tags they list, e.g. to serve them during an outage, so that the changes of
+// a repository are listed right away, e.g. when a version is published.
+type Invalidator interface {
+	// Invalidate lists the tags of a repository and the repositories again,
+	// instead of the ones kept by the backend.
+	Invalidate(owner, name string)
+}
+
+// ReadmeFinder is implemented by the backends able to return the README of the
+// source code repository of a repository, e.g. to describe it in a web UI.
+type ReadmeFinder interface {
+	// FindReadme returns the README of the source code repository of a
+	// repository, as Markdown or rendered to HTML, or ErrNotFound when there
+	// is none.
+	FindReadme(ctx context.Context, owner, name, format string) (string, error)
+}
@@ -0,0 +1,93 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	gh "github.com/google/go-github/v50/github"
+)
+
+// call is a GitHub API call in progress, shared by the concurrent callers.
+type call struct {
+	done     chan struct{}
+	value    interface{}
+	response *gh.Response
+	err      error
+}
+
+// coalescingClient is a Client sending a single GitHub API call for the
+// concurrent calls with the same arguments, e.g. when a burst of `tags/list`
+// requests for a repository arrives at once. The results are shared by the
+// callers and must not be modified.
+type coalescingClient struct {
+	Client
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newCoalescingClient(client Client) *coalescingClient {
+	return &coalescingClient{Client: client, calls: map[string]*call{}}
+}
+
+// do calls fn, unless a call with the same key is in progress, in which case
+// its result is returned instead. The context of the first caller is used.
+func (c *coalescingClient) do(ctx context.Context, key string, fn func() (interface{}, *gh.Response, error)) (interface{}, *gh.Response, error) {
+	c.mu.Lock()
+	if inflight, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-inflight.done:
+			return inflight.value, inflight.response, inflight.err
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	current := &call{done: make(chan struct{})}
+	c.calls[key] = current
+	c.mu.Unlock()
+
+	current.value, current.response, current.err = fn()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(current.done)
+
+	return current.value, current.response, current.err
+}
+
+func listOptionsKey(opts *gh.PackageListOptions) string {
+	if opts == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%d", opts.GetPackageType(), opts.GetVisibility(), opts.GetState(), opts.Page, opts.PerPage)
+}
+
+func (c *coalescingClient) ListPackages(ctx context.Context, user string, opts *gh.PackageListOptions) ([]*gh.Package, *gh.Response, error) {
+	key := fmt.Sprintf("ListPackages|%s|%s", user, listOptionsKey(opts))
+	value, res, err := c.do(ctx, key, func() (interface{}, *gh.Response, error) {
+		return c.Client.ListPackages(ctx, user, opts)
+	})
+	packages, _ := value.([]*gh.Package)
+	return packages, res, err
+}
+
+func (c *coalescingClient) PackageGetAllVersions(ctx context.Context, user, packageType, packageName string, opts *gh.PackageListOptions) ([]*gh.PackageVersion, *gh.Response, error) {
+	key := fmt.Sprintf("PackageGetAllVersions|%s|%s|%s|%s", user, packageType, packageName, listOptionsKey(opts))
+	value, res, err := c.do(ctx, key, func() (interface{}, *gh.Response, error) {
+		return c.Client.PackageGetAllVersions(ctx, user, packageType, packageName, opts)
+	})
+	versions, _ := value.([]*gh.PackageVersion)
+	return versions, res, err
+}
+
+func (c *coalescingClient) GetPackage(ctx context.Context, user, packageType, packageName string) (*gh.Package, *gh.Response, error) {
+	key := fmt.Sprintf("GetPackage|%s|%s|%s", user, packageType, packageName)
+	value, res, err := c.do(ctx, key, func() (interface{}, *gh.Response, error) {
+		return c.Client.GetPackage(ctx, user, packageType, packageName)
+	})
+	pack, _ := value.(*gh.Package)
+	return pack, res, err
+}
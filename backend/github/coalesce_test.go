@@ -0,0 +1,58 @@
+package github
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gh "github.com/google/go-github/v50/github"
+)
+
+// blockingClientMock counts the calls, which return once released.
+type blockingClientMock struct {
+	clientMock
+	calls   int32
+	release chan struct{}
+}
+
+func (c *blockingClientMock) PackageGetAllVersions(ctx context.Context, user, packageType, packageName string, opts *gh.PackageListOptions) ([]*gh.PackageVersion, *gh.Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	<-c.release
+	return c.clientMock.PackageGetAllVersions(ctx, user, packageType, packageName, opts)
+}
+
+func TestCoalescedCalls(t *testing.T) {
+	client := &blockingClientMock{clientMock: clientMock{PackageVersions: someVersions()}, release: make(chan struct{})}
+	b := New(client, nil)
+
+	var wg sync.WaitGroup
+	results := make([][]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = b.ListTags(context.Background(), "some-owner", "some-package")
+		}(i)
+	}
+	// Let the calls start.
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Fatalf("expected: 1, got: %d", calls)
+	}
+	for i, tags := range results {
+		if len(tags) != 3 {
+			t.Fatalf("call %d: expected: 3 tags, got: %v", i, tags)
+		}
+	}
+
+	// Other packages are not coalesced with each other.
+	b.ListTags(context.Background(), "some-owner", "other-package")
+	if calls := atomic.LoadInt32(&client.calls); calls != 2 {
+		t.Fatalf("expected: 2, got: %d", calls)
+	}
+}
@@ -0,0 +1,118 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gh "github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+const (
+	// scopesHeader lists the scopes of a (classic) personal access token.
+	// Fine-grained tokens and GitHub App tokens don't have scopes.
+	scopesHeader = "X-OAuth-Scopes"
+	// ssoHeader is set when a token must be authorized for SSO by an
+	// organization, e.g. `required; url=https://github.com/orgs/...`.
+	ssoHeader = "X-GitHub-SSO"
+)
+
+// packagesScopes are the scopes granting read access to the packages.
+var packagesScopes = []string{"read:packages", "write:packages", "delete:packages"}
+
+// hasPackagesScope returns true when the scopes header of a response grants
+// access to the packages, or when the token does not use scopes.
+func hasPackagesScope(header http.Header) bool {
+	if _, ok := header[http.CanonicalHeaderKey(scopesHeader)]; !ok {
+		return true
+	}
+
+	for _, scope := range strings.Split(header.Get(scopesHeader), ",") {
+		for _, packagesScope := range packagesScopes {
+			if strings.TrimSpace(scope) == packagesScope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ssoURL returns the URL to authorize a token for SSO, if any.
+func ssoURL(header http.Header) string {
+	value := header.Get(ssoHeader)
+	if !strings.HasPrefix(value, "required") {
+		return ""
+	}
+	if _, url, ok := strings.Cut(value, "url="); ok {
+		return strings.TrimSpace(url)
+	}
+	return "(no URL provided)"
+}
+
+// credentialsError returns a backend.CredentialsError when a GitHub API error
+// is caused by the token, or nil otherwise.
+func credentialsError(err error) error {
+	var errResponse *gh.ErrorResponse
+	if !errors.As(err, &errResponse) || errResponse.Response == nil {
+		return nil
+	}
+
+	header := errResponse.Response.Header
+	switch errResponse.Response.StatusCode {
+	case http.StatusUnauthorized:
+		return &backend.CredentialsError{
+			Reason:  backend.ReasonBadCredentials,
+			Message: "the GitHub token is invalid or expired, check GITHUB_TOKEN",
+			Err:     err,
+		}
+	case http.StatusForbidden, http.StatusNotFound:
+		if url := ssoURL(header); url != "" {
+			return &backend.CredentialsError{
+				Reason:  backend.ReasonSSORequired,
+				Message: fmt.Sprintf("the GitHub token must be authorized for SSO by the organization: %s", url),
+				Err:     err,
+			}
+		}
+		if !hasPackagesScope(header) {
+			return &backend.CredentialsError{
+				Reason:  backend.ReasonMissingScope,
+				Message: fmt.Sprintf("the GitHub token is missing the read:packages scope (scopes: %q)", header.Get(scopesHeader)),
+				Err:     err,
+			}
+		}
+	}
+
+	return nil
+}
+
+// withCredentialsError replaces err with a credentials error when the token is
+// the cause of the error.
+func withCredentialsError(err error) error {
+	if credErr := credentialsError(err); credErr != nil {
+		return credErr
+	}
+	return err
+}
+
+// CheckCredentials verifies that the token can be used to list the packages.
+func (b *Backend) CheckCredentials(ctx context.Context) error {
+	opts := &gh.PackageListOptions{
+		PackageType: gh.String(b.packageTypes[0]),
+		ListOptions: gh.ListOptions{PerPage: 1},
+	}
+	_, res, err := b.client.ListPackages(ctx, "", opts)
+	if err != nil {
+		return fmt.Errorf("ListPackages: %w", withCredentialsError(err))
+	}
+	if res != nil && res.Response != nil && !hasPackagesScope(res.Header) {
+		return &backend.CredentialsError{
+			Reason:  backend.ReasonMissingScope,
+			Message: fmt.Sprintf("the GitHub token is missing the read:packages scope (scopes: %q)", res.Header.Get(scopesHeader)),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	gh "github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+func errorResponse(statusCode int, header http.Header) error {
+	return &gh.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Header:     header,
+			Request:    &http.Request{Method: "GET"},
+		},
+		Message: http.StatusText(statusCode),
+	}
+}
+
+func TestCredentialsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		err            error
+		expectedReason string
+	}{
+		{
+			name:           "bad credentials",
+			err:            errorResponse(http.StatusUnauthorized, http.Header{}),
+			expectedReason: backend.ReasonBadCredentials,
+		},
+		{
+			name:           "sso required",
+			err:            errorResponse(http.StatusForbidden, http.Header{"X-Github-Sso": {"required; url=https://github.com/orgs/some-org/sso?authorization_request=123"}}),
+			expectedReason: backend.ReasonSSORequired,
+		},
+		{
+			name:           "missing scope",
+			err:            errorResponse(http.StatusForbidden, http.Header{"X-Oauth-Scopes": {"repo, read:org"}}),
+			expectedReason: backend.ReasonMissingScope,
+		},
+		{
+			name: "forbidden with packages scope",
+			err:  errorResponse(http.StatusForbidden, http.Header{"X-Oauth-Scopes": {"repo, write:packages"}}),
+		},
+		{
+			name: "other error",
+			err:  errors.New("some error"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(&clientMock{Err: tc.err}, nil).ListRepositories(context.Background())
+
+			var credErr *backend.CredentialsError
+			if !errors.As(err, &credErr) {
+				if tc.expectedReason != "" {
+					t.Fatalf("expected a credentials error, got: %v", err)
+				}
+				return
+			}
+			if credErr.Reason != tc.expectedReason {
+				t.Fatalf("expected: %s, got: %s", tc.expectedReason, credErr.Reason)
+			}
+		})
+	}
+}
+
+func TestCredentialsErrorsForVersions(t *testing.T) {
+	client := &clientMock{Err: errorResponse(http.StatusNotFound, http.Header{"X-Github-Sso": {"required; url=https://github.com/orgs/some-org/sso"}})}
+
+	_, err := New(client, nil).ListTags(context.Background(), "some-org", "some-package")
+	var credErr *backend.CredentialsError
+	if !errors.As(err, &credErr) || credErr.Reason != backend.ReasonSSORequired {
+		t.Fatalf("expected an SSO error, got: %v", err)
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		header        http.Header
+		expectedError bool
+	}{
+		{name: "classic token with scope", header: http.Header{"X-Oauth-Scopes": {"read:packages"}}},
+		{name: "classic token without scope", header: http.Header{"X-Oauth-Scopes": {"repo"}}, expectedError: true},
+		{name: "fine-grained token", header: http.Header{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &clientMock{Response: &gh.Response{Response: &http.Response{StatusCode: 200, Header: tc.header}}}
+
+			err := New(client, nil).CheckCredentials(context.Background())
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+// Package github implements a registry backend for the GitHub Container
+// Registry, using the GitHub REST API.
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+const (
+	defaultPackageType = "container"
+
+	// versionsPerPage is the number of versions listed per request, the
+	// maximum allowed by GitHub.
+	versionsPerPage = 100
+	// maxVersionPages limits the requests listing the versions of a package.
+	maxVersionPages = 50
+	// packagesPerPage is the number of packages listed per request, the
+	// maximum allowed by GitHub.
+	packagesPerPage = 100
+	// maxPackagePages limits the requests listing the packages of a user.
+	maxPackagePages = 50
+)
+
+// Client describes a (partial) GitHub REST API client.
+type Client interface {
+	ListPackages(ctx context.Context, user string, opts *gh.PackageListOptions) ([]*gh.Package, *gh.Response, error)
+
+	GetPackage(ctx context.Context, user, packageType, packageName string) (*gh.Package, *gh.Response, error)
+
+	PackageGetAllVersions(ctx context.Context, user, packageType, packageName string, opts *gh.PackageListOptions) ([]*gh.PackageVersion, *gh.Response, error)
+
+	PackageDeleteVersion(ctx context.Context, user, packageType, packageName string, packageVersionID int64) (*gh.Response, error)
+}
+
+// ReadmeClient describes the (partial) GitHub REST API client fetching and
+// rendering the READMEs of the repositories.
+type ReadmeClient interface {
+	GetReadme(ctx context.Context, owner, repo string, opts *gh.RepositoryContentGetOptions) (*gh.RepositoryContent, *gh.Response, error)
+
+	Markdown(ctx context.Context, text string, opts *gh.MarkdownOptions) (string, *gh.Response, error)
+}
+
+type readmeClient struct {
+	*gh.Client
+}
+
+func (c readmeClient) GetReadme(ctx context.Context, owner, repo string, opts *gh.RepositoryContentGetOptions) (*gh.RepositoryContent, *gh.Response, error) {
+	return c.Repositories.GetReadme(ctx, owner, repo, opts)
+}
+
+// NewReadmeClient returns the ReadmeClient of a GitHub REST API client.
+func NewReadmeClient(client *gh.Client) ReadmeClient {
+	return readmeClient{Client: client}
+}
+
+// Backend is a registry backend listing the packages of a set of GitHub users.
+type Backend struct {
+	client       Client
+	users        []string
+	packageTypes []string
+	visibility   string
+	topics       []string
+	readmes      ReadmeClient
+
+	mu sync.Mutex
+	// refreshes are the last successful listings of the packages, by user.
+	refreshes map[string]refresh
+}
+
+// refresh is a successful listing of the packages of a user.
+type refresh struct {
+	packages int
+	at       time.Time
+}
+
+// Option configures a GitHub backend.
+type Option func(b *Backend)
+
+// WithPackageTypes configures the GitHub package types listed by the backend,
+// e.g. "container" and "docker". Only container packages are listed by
+// default. Helm charts and other OCI artifacts hosted on GHCR are container
+// packages.
+func WithPackageTypes(packageTypes ...string) Option {
+	return func(b *Backend) {
+		if len(packageTypes) > 0 {
+			b.packageTypes = packageTypes
+		}
+	}
+}
+
+// WithVisibility restricts the repositories listed by the backend to the
+// packages with the given visibility ("public", "private" or "internal"). All
+// the packages are listed when visibility is empty or "all".
+func WithVisibility(visibility string) Option {
+	return func(b *Backend) {
+		if visibility == "all" {
+			visibility = ""
+		}
+		b.visibility = visibility
+	}
+}
+
+// WithTopics restricts the repositories listed by the backend to the packages
+// whose source repository has at least one of the given topics, e.g.
+// "published", so that teams control what the proxy exposes from GitHub. The
+// packages that are not linked to a repository are not listed.
+func WithTopics(topics ...string) Option {
+	return func(b *Backend) {
+		b.topics = nil
+		for _, topic := range topics {
+			if topic = strings.ToLower(strings.TrimSpace(topic)); topic != "" {
+				b.topics = append(b.topics, topic)
+			}
+		}
+	}
+}
+
+// WithReadmes configures the client fetching the READMEs of the source
+// repositories of the packages, which are not available otherwise.
+func WithReadmes(client ReadmeClient) Option {
+	return func(b *Backend) {
+		b.readmes = client
+	}
+}
+
+// hasTopic returns whether the source repository of a package has one of the
+// configured topics, always true when no topics are configured.
+func (b *Backend) hasTopic(pack *gh.Package) bool {
+	if len(b.topics) == 0 {
+		return true
+	}
+	if pack.Repository == nil {
+		return false
+	}
+	for _, topic := range pack.Repository.Topics {
+		for _, expected := range b.topics {
+			if strings.EqualFold(topic, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// New returns a GitHub backend. An empty user refers to the authenticated
+// user.
+func New(client Client, users []string, opts ...Option) *Backend {
+	if len(users) == 0 {
+		users = []string{""}
+	}
+
+	// Concurrent identical calls are sent once.
+	b := &Backend{
+		client:       newCoalescingClient(client),
+		users:        users,
+		packageTypes: []string{defaultPackageType},
+		refreshes:    map[string]refresh{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// ListRepositories returns the packages of all the configured users, without
+// duplicates.
+func (b *Backend) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	return b.listRepositories(ctx, b.users)
+}
+
+// ListOwnerRepositories returns the packages of an owner. Only the packages of
+// the owner are fetched when it is one of the configured users, all the
+// packages are fetched and filtered otherwise, e.g. for the organizations
+// visible to the authenticated user.
+func (b *Backend) ListOwnerRepositories(ctx context.Context, owner string) ([]backend.Repository, error) {
+	users := b.users
+	for _, user := range b.users {
+		if user != "" && strings.EqualFold(user, owner) {
+			users = []string{user}
+			break
+		}
+	}
+
+	// The packages are filtered in both cases, in case the packages of other
+	// owners are returned (e.g. with recorded API responses).
+	repositories, err := b.listRepositories(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	return backend.FilterOwner(repositories, owner), nil
+}
+
+// ListOwners returns the configured users, with the number of packages listed
+// for each of them and when they were last listed. The packages are listed
+// first when a user has never been listed.
+func (b *Backend) ListOwners(ctx context.Context) ([]backend.Owner, error) {
+	b.mu.Lock()
+	listed := len(b.refreshes) == len(b.users)
+	b.mu.Unlock()
+	if !listed {
+		if _, err := b.ListRepositories(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	owners := []backend.Owner{}
+	for _, user := range b.users {
+		refresh := b.refreshes[user]
+		owners = append(owners, backend.Owner{
+			Name:        user,
+			Packages:    refresh.packages,
+			RefreshedAt: refresh.at,
+		})
+	}
+	return owners, nil
+}
+
+func (b *Backend) recordRefresh(user string, packages int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refreshes[user] = refresh{packages: packages, at: time.Now()}
+}
+
+// listRepositories returns the packages of users, without duplicates.
+func (b *Backend) listRepositories(ctx context.Context, users []string) ([]backend.Repository, error) {
+	var successes int = 0
+	var repositories []backend.Repository
+	var errs []error
+	for _, user := range users {
+		var newPackages int = 0
+		var userPackages int = 0
+		var failed bool = false
+		var packages []*gh.Package
+		for _, packageType := range b.packageTypes {
+			// Fetch the list of packages the current user has access to.
+			opts := &gh.PackageListOptions{PackageType: gh.String(packageType)}
+			if b.visibility != "" {
+				opts.Visibility = gh.String(b.visibility)
+			}
+			typePackages, err := b.allPackages(ctx, user, opts)
+			if err != nil {
+				err = withCredentialsError(err)
+				log.Printf("WARN ListPackages for \"%s\" (%s) error: %s", user, packageType, err)
+				errs = append(errs, fmt.Errorf("ListPackages: %w", err))
+				failed = true
+				continue
+			}
+			successes++
+			packages = append(packages, typePackages...)
+		}
+
+		for _, pack := range packages {
+			if pack.Name == nil || pack.Owner == nil || pack.Owner.Login == nil {
+				continue
+			}
+			// Filter the packages too, in case the visibility parameter is ignored
+			// (e.g. with recorded API responses).
+			if b.visibility != "" && pack.Visibility != nil && *pack.Visibility != b.visibility {
+				continue
+			}
+			if !b.hasTopic(pack) {
+				continue
+			}
+			repository := backend.Repository{Owner: *pack.Owner.Login, Name: *pack.Name}
+			userPackages++
+
+			var found bool = false
+			for _, r := range repositories {
+				if r == repository {
+					found = true
+					break
+				}
+			}
+			if !found {
+				repositories = append(repositories, repository)
+				newPackages++
+			}
+		}
+		log.Printf("ListPackages for \"%s\" found %d _new_ packages", user, newPackages)
+		if !failed {
+			b.recordRefresh(user, userPackages)
+		}
+	}
+
+	if successes == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return repositories, nil
+}
+
+// ListTags returns the tags of all the versions of a container package.
+func (b *Backend) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	versions, err := b.versions(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for _, version := range versions {
+		tags = append(tags, versionTags(version.PackageVersion)...)
+	}
+
+	return tags, nil
+}
+
+// ResolveTag returns the digest of the version having the given tag.
+func (b *Backend) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	version, err := b.findVersion(ctx, owner, name, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return version.GetName(), nil
+}
+
+// DeleteVersion deletes the version of a container package referenced by a
+// tag or a digest.
+func (b *Backend) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	version, err := b.findVersion(ctx, owner, name, reference)
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.client.PackageDeleteVersion(ctx, owner, version.packageType, name, version.GetID()); err != nil {
+		return fmt.Errorf("PackageDeleteVersion: %w", withCredentialsError(err))
+	}
+
+	return nil
+}
+
+// FindVersion returns the version referenced by either a tag or a digest,
+// without deleting it.
+func (b *Backend) FindVersion(ctx context.Context, owner, name, reference string) (backend.Version, error) {
+	version, err := b.findVersion(ctx, owner, name, reference)
+	if err != nil {
+		return backend.Version{}, err
+	}
+
+	return toVersion(version.PackageVersion), nil
+}
+
+// ListVersions returns the versions of a container package, with their
+// creation dates.
+func (b *Backend) ListVersions(ctx context.Context, owner, name string) ([]backend.Version, error) {
+	versions, err := b.versions(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []backend.Version{}
+	for _, version := range versions {
+		result = append(result, toVersion(version.PackageVersion))
+	}
+
+	return result, nil
+}
+
+// sourceRepository returns the GitHub repository linked to a package, trying
+// each of the configured package types until one is found.
+func (b *Backend) sourceRepository(ctx context.Context, owner, name string) (*gh.Repository, error) {
+	for _, packageType := range b.packageTypes {
+		pack, _, err := b.client.GetPackage(ctx, owner, packageType, name)
+		if err != nil {
+			if credErr := credentialsError(err); credErr != nil {
+				return nil, fmt.Errorf("GetPackage: %w", credErr)
+			}
+			var errResponse *gh.ErrorResponse
+			if !errors.As(err, &errResponse) || errResponse.Response == nil || errResponse.Response.StatusCode != http.StatusNotFound {
+				return nil, fmt.Errorf("GetPackage: %w", err)
+			}
+			continue
+		}
+		if pack == nil || pack.Repository == nil || pack.Repository.GetHTMLURL() == "" {
+			return nil, backend.ErrNotFound
+		}
+
+		return pack.Repository, nil
+	}
+
+	return nil, backend.ErrNotFound
+}
+
+// FindSource returns the GitHub repository linked to a package.
+func (b *Backend) FindSource(ctx context.Context, owner, name string) (backend.Source, error) {
+	repository, err := b.sourceRepository(ctx, owner, name)
+	if err != nil {
+		return backend.Source{}, err
+	}
+
+	return backend.Source{
+		URL:         repository.GetHTMLURL(),
+		Description: repository.GetDescription(),
+		License:     repository.GetLicense().GetSPDXID(),
+	}, nil
+}
+
+// FindReadme returns the README of the GitHub repository linked to a package,
+// rendered to HTML by GitHub with the "html" format.
+func (b *Backend) FindReadme(ctx context.Context, owner, name, format string) (string, error) {
+	if b.readmes == nil {
+		return "", backend.ErrNotSupported
+	}
+	repository, err := b.sourceRepository(ctx, owner, name)
+	if err != nil {
+		return "", err
+	}
+	repoOwner, repoName := repository.GetOwner().GetLogin(), repository.GetName()
+	if repoOwner == "" {
+		// The minimal repositories of the packages may not have an owner.
+		repoOwner = owner
+	}
+
+	content, _, err := b.readmes.GetReadme(ctx, repoOwner, repoName, nil)
+	if err != nil {
+		var errResponse *gh.ErrorResponse
+		if errors.As(err, &errResponse) && errResponse.Response != nil && errResponse.Response.StatusCode == http.StatusNotFound {
+			return "", backend.ErrNotFound
+		}
+		return "", fmt.Errorf("GetReadme: %w", withCredentialsError(err))
+	}
+	readme, err := content.GetContent()
+	if err != nil {
+		return "", fmt.Errorf("GetReadme: %w", err)
+	}
+	if format != backend.ReadmeFormatHTML {
+		return readme, nil
+	}
+
+	html, _, err := b.readmes.Markdown(ctx, readme, &gh.MarkdownOptions{Mode: "gfm", Context: repoOwner + "/" + repoName})
+	if err != nil {
+		return "", fmt.Errorf("Markdown: %w", withCredentialsError(err))
+	}
+	return html, nil
+}
+
+func toVersion(version *gh.PackageVersion) backend.Version {
+	return backend.Version{
+		Digest:    version.GetName(),
+		Tags:      versionTags(version),
+		CreatedAt: version.GetCreatedAt().Time,
+	}
+}
+
+// packageVersion is a package version along with the type of its package.
+type packageVersion struct {
+	*gh.PackageVersion
+	packageType string
+}
+
+// versions returns the versions of a package, trying each of the configured
+// package types until one is found.
+func (b *Backend) versions(ctx context.Context, owner, name string) ([]packageVersion, error) {
+	var err error
+	for _, packageType := range b.packageTypes {
+		var versions []*gh.PackageVersion
+		versions, err = b.allVersions(ctx, owner, packageType, name)
+		if err == nil {
+			var result []packageVersion
+			for _, version := range versions {
+				result = append(result, packageVersion{PackageVersion: version, packageType: packageType})
+			}
+			return result, nil
+		}
+
+		if credErr := credentialsError(err); credErr != nil {
+			return nil, fmt.Errorf("PackageGetAllVersions: %w", credErr)
+		}
+		var errResponse *gh.ErrorResponse
+		if !errors.As(err, &errResponse) || errResponse.Response == nil || errResponse.Response.StatusCode != http.StatusNotFound {
+			return nil, fmt.Errorf("PackageGetAllVersions: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("PackageGetAllVersions: %w", backend.ErrNotFound)
+}
+
+// allPackages returns the packages of a user, listed page by page since
+// GitHub only returns 30 packages by default.
+func (b *Backend) allPackages(ctx context.Context, user string, opts *gh.PackageListOptions) ([]*gh.Package, error) {
+	var packages []*gh.Package
+	opts.PerPage = packagesPerPage
+	for page := 0; page < maxPackagePages; page++ {
+		pagePackages, res, err := b.client.ListPackages(ctx, user, opts)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, pagePackages...)
+		if res == nil || res.NextPage == 0 {
+			return packages, nil
+		}
+		opts.Page = res.NextPage
+	}
+	log.Printf("WARN ListPackages for \"%s\": only the first %d packages are listed", user, len(packages))
+	return packages, nil
+}
+
+// allVersions returns the versions of a package, listed page by page since
+// GitHub only returns 30 versions by default.
+func (b *Backend) allVersions(ctx context.Context, owner, packageType, name string) ([]*gh.PackageVersion, error) {
+	var versions []*gh.PackageVersion
+	opts := &gh.PackageListOptions{ListOptions: gh.ListOptions{PerPage: versionsPerPage}}
+	for page := 0; page < maxVersionPages; page++ {
+		pageVersions, res, err := b.client.PackageGetAllVersions(ctx, owner, packageType, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, pageVersions...)
+		if res == nil || res.NextPage == 0 {
+			return versions, nil
+		}
+		opts.Page = res.NextPage
+	}
+	log.Printf("WARN PackageGetAllVersions for %s/%s: only the %d most recent versions are listed", owner, name, len(versions))
+	return versions, nil
+}
+
+// findVersion returns the version whose digest (GitHub uses the digest as
+// version name) or one of its tags matches the reference.
+func (b *Backend) findVersion(ctx context.Context, owner, name, reference string) (packageVersion, error) {
+	versions, err := b.versions(ctx, owner, name)
+	if err != nil {
+		return packageVersion{}, err
+	}
+
+	for _, version := range versions {
+		if version.GetName() == reference {
+			return version, nil
+		}
+		for _, tag := range versionTags(version.PackageVersion) {
+			if tag == reference {
+				return version, nil
+			}
+		}
+	}
+
+	return packageVersion{}, backend.ErrNotFound
+}
+
+func versionTags(version *gh.PackageVersion) []string {
+	if version.Metadata == nil || version.Metadata.Container == nil {
+		return nil
+	}
+
+	return version.Metadata.Container.Tags
+}
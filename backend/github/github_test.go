@@ -0,0 +1,523 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gh "github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+type clientMock struct {
+	PackagesByType   map[string][]*gh.Package
+	Packages         []*gh.Package
+	PackageVersions  []*gh.PackageVersion
+	DeletedVersionID int64
+	ListedUsers      []string
+	Response         *gh.Response
+	Err              error
+	// VersionsPerPage paginates the versions when it is set.
+	VersionsPerPage int
+	// PackagesPerPage paginates the packages when it is set.
+	PackagesPerPage int
+}
+
+func (c *clientMock) ListPackages(ctx context.Context, user string, opts *gh.PackageListOptions) ([]*gh.Package, *gh.Response, error) {
+	c.ListedUsers = append(c.ListedUsers, user)
+	if c.PackagesByType != nil {
+		return c.PackagesByType[opts.GetPackageType()], c.Response, c.Err
+	}
+	if c.PackagesPerPage == 0 || c.Err != nil {
+		return c.Packages, c.Response, c.Err
+	}
+	start := 0
+	if opts.Page > 1 {
+		start = (opts.Page - 1) * c.PackagesPerPage
+	}
+	end := start + c.PackagesPerPage
+	res := &gh.Response{}
+	if end < len(c.Packages) {
+		res.NextPage = end/c.PackagesPerPage + 1
+	} else {
+		end = len(c.Packages)
+	}
+	return c.Packages[start:end], res, nil
+}
+
+func (c *clientMock) GetPackage(ctx context.Context, user, packageType, packageName string) (*gh.Package, *gh.Response, error) {
+	if c.Err != nil {
+		return nil, c.Response, c.Err
+	}
+	for _, pack := range c.Packages {
+		if pack.GetName() == packageName {
+			return pack, c.Response, nil
+		}
+	}
+	return nil, nil, &gh.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+}
+
+func (c *clientMock) PackageGetAllVersions(ctx context.Context, user, packageType, packageName string, opts *gh.PackageListOptions) ([]*gh.PackageVersion, *gh.Response, error) {
+	if c.VersionsPerPage == 0 || c.Err != nil {
+		return c.PackageVersions, nil, c.Err
+	}
+	start := 0
+	if opts != nil && opts.Page > 1 {
+		start = (opts.Page - 1) * c.VersionsPerPage
+	}
+	end := start + c.VersionsPerPage
+	res := &gh.Response{}
+	if end < len(c.PackageVersions) {
+		res.NextPage = end/c.VersionsPerPage + 1
+	} else {
+		end = len(c.PackageVersions)
+	}
+	return c.PackageVersions[start:end], res, nil
+}
+
+func (c *clientMock) PackageDeleteVersion(ctx context.Context, user, packageType, packageName string, packageVersionID int64) (*gh.Response, error) {
+	c.DeletedVersionID = packageVersionID
+	return nil, c.Err
+}
+
+func someVersions() []*gh.PackageVersion {
+	return []*gh.PackageVersion{
+		{
+			ID:   gh.Int64(1),
+			Name: gh.String("sha256:1111"),
+			Metadata: &gh.PackageMetadata{
+				Container: &gh.PackageContainerMetadata{Tags: []string{"v1"}},
+			},
+		},
+		{
+			ID:   gh.Int64(2),
+			Name: gh.String("sha256:2222"),
+			Metadata: &gh.PackageMetadata{
+				Container: &gh.PackageContainerMetadata{Tags: []string{"v2", "latest"}},
+			},
+		},
+	}
+}
+
+func TestListRepositoriesWithMultipleUsers(t *testing.T) {
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{Name: gh.String("some-package"), Owner: &gh.User{Login: gh.String("some-user")}},
+		},
+	}
+
+	repositories, err := New(client, []string{"", "some-user"}).ListRepositories(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(repositories) != 1 {
+		t.Fatalf("expected: 1 repository, got: %v", repositories)
+	}
+}
+
+func TestListRepositoriesPaginated(t *testing.T) {
+	var packages []*gh.Package
+	for i := 0; i < 5; i++ {
+		packages = append(packages, &gh.Package{Name: gh.String(fmt.Sprintf("package-%d", i)), Owner: &gh.User{Login: gh.String("some-user")}})
+	}
+
+	repositories, err := New(&clientMock{Packages: packages, PackagesPerPage: 2}, nil).ListRepositories(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(repositories) != len(packages) || repositories[4].Name != "package-4" {
+		t.Fatalf("expected all the packages, got: %v", repositories)
+	}
+}
+
+func TestListOwnerRepositories(t *testing.T) {
+	for _, tc := range []struct {
+		users               []string
+		owner               string
+		expectedListedUsers []string
+	}{
+		// Only the packages of a configured user are listed.
+		{users: []string{"", "some-org"}, owner: "Some-Org", expectedListedUsers: []string{"some-org"}},
+		// The packages of the other owners are filtered.
+		{users: []string{"", "some-org"}, owner: "other-org", expectedListedUsers: []string{"", "some-org"}},
+	} {
+		client := &clientMock{
+			Packages: []*gh.Package{
+				{Name: gh.String("some-package"), Owner: &gh.User{Login: gh.String("some-org")}},
+				{Name: gh.String("other-package"), Owner: &gh.User{Login: gh.String("other-org")}},
+			},
+		}
+
+		repositories, err := New(client, tc.users).ListOwnerRepositories(context.Background(), tc.owner)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if len(repositories) != 1 || !strings.EqualFold(repositories[0].Owner, tc.owner) {
+			t.Fatalf("expected the repository of %s, got: %v", tc.owner, repositories)
+		}
+		if !reflect.DeepEqual(client.ListedUsers, tc.expectedListedUsers) {
+			t.Fatalf("expected: %v, got: %v", tc.expectedListedUsers, client.ListedUsers)
+		}
+	}
+}
+
+func TestListOwners(t *testing.T) {
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{Name: gh.String("some-package"), Owner: &gh.User{Login: gh.String("some-org")}},
+			{Name: gh.String("other-package"), Owner: &gh.User{Login: gh.String("some-org")}},
+		},
+	}
+	b := New(client, []string{"", "some-org"})
+
+	// The owners are listed on the first call.
+	owners, err := b.ListOwners(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(owners) != 2 || owners[0].Name != "" || owners[1].Name != "some-org" {
+		t.Fatalf("unexpected owners: %v", owners)
+	}
+	for _, owner := range owners {
+		if owner.Packages != 2 || owner.RefreshedAt.IsZero() {
+			t.Fatalf("unexpected owner: %+v", owner)
+		}
+	}
+	if len(client.ListedUsers) != 2 {
+		t.Fatalf("expected 2 listings, got: %v", client.ListedUsers)
+	}
+
+	if _, err := b.ListOwners(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(client.ListedUsers) != 2 {
+		t.Fatalf("expected no new listing, got: %v", client.ListedUsers)
+	}
+}
+
+func TestListRepositoriesWithPackageTypes(t *testing.T) {
+	owner := &gh.User{Login: gh.String("some-user")}
+	client := &clientMock{
+		PackagesByType: map[string][]*gh.Package{
+			"container": {{Name: gh.String("some-image"), Owner: owner}},
+			"docker":    {{Name: gh.String("some-legacy-image"), Owner: owner}},
+			"npm":       {{Name: gh.String("some-npm-package"), Owner: owner}},
+		},
+	}
+
+	for _, tc := range []struct {
+		opts                 []Option
+		expectedRepositories []backend.Repository
+	}{
+		{
+			expectedRepositories: []backend.Repository{{Owner: "some-user", Name: "some-image"}},
+		},
+		{
+			opts: []Option{WithPackageTypes("container", "docker")},
+			expectedRepositories: []backend.Repository{
+				{Owner: "some-user", Name: "some-image"},
+				{Owner: "some-user", Name: "some-legacy-image"},
+			},
+		},
+	} {
+		repositories, err := New(client, nil, tc.opts...).ListRepositories(context.Background())
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if !reflect.DeepEqual(repositories, tc.expectedRepositories) {
+			t.Fatalf("expected: %v, got: %v", tc.expectedRepositories, repositories)
+		}
+	}
+}
+
+func TestListRepositoriesWithVisibility(t *testing.T) {
+	owner := &gh.User{Login: gh.String("some-user")}
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{Name: gh.String("public-image"), Owner: owner, Visibility: gh.String("public")},
+			{Name: gh.String("private-image"), Owner: owner, Visibility: gh.String("private")},
+		},
+	}
+
+	for _, tc := range []struct {
+		visibility           string
+		expectedRepositories []backend.Repository
+	}{
+		{
+			visibility: "all",
+			expectedRepositories: []backend.Repository{
+				{Owner: "some-user", Name: "public-image"},
+				{Owner: "some-user", Name: "private-image"},
+			},
+		},
+		{
+			visibility:           "public",
+			expectedRepositories: []backend.Repository{{Owner: "some-user", Name: "public-image"}},
+		},
+		{
+			visibility:           "private",
+			expectedRepositories: []backend.Repository{{Owner: "some-user", Name: "private-image"}},
+		},
+	} {
+		repositories, err := New(client, nil, WithVisibility(tc.visibility)).ListRepositories(context.Background())
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if !reflect.DeepEqual(repositories, tc.expectedRepositories) {
+			t.Fatalf("expected: %v, got: %v", tc.expectedRepositories, repositories)
+		}
+	}
+}
+
+func TestListRepositoriesWithTopics(t *testing.T) {
+	owner := &gh.User{Login: gh.String("some-user")}
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{Name: gh.String("published-image"), Owner: owner, Repository: &gh.Repository{Topics: []string{"docker", "published"}}},
+			{Name: gh.String("internal-image"), Owner: owner, Repository: &gh.Repository{Topics: []string{"docker"}}},
+			{Name: gh.String("unlinked-image"), Owner: owner},
+		},
+	}
+
+	for _, tc := range []struct {
+		topics               []string
+		expectedRepositories []backend.Repository
+	}{
+		{
+			topics: nil,
+			expectedRepositories: []backend.Repository{
+				{Owner: "some-user", Name: "published-image"},
+				{Owner: "some-user", Name: "internal-image"},
+				{Owner: "some-user", Name: "unlinked-image"},
+			},
+		},
+		{
+			topics:               []string{" Published "},
+			expectedRepositories: []backend.Repository{{Owner: "some-user", Name: "published-image"}},
+		},
+		{
+			topics: []string{"published", "docker"},
+			expectedRepositories: []backend.Repository{
+				{Owner: "some-user", Name: "published-image"},
+				{Owner: "some-user", Name: "internal-image"},
+			},
+		},
+	} {
+		repositories, err := New(client, nil, WithTopics(tc.topics...)).ListRepositories(context.Background())
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if !reflect.DeepEqual(repositories, tc.expectedRepositories) {
+			t.Fatalf("expected: %v, got: %v", tc.expectedRepositories, repositories)
+		}
+	}
+}
+
+func TestListRepositoriesReturnsAllErrors(t *testing.T) {
+	client := &clientMock{Err: fmt.Errorf("an error")}
+
+	_, err := New(client, []string{"a", "b"}).ListRepositories(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if errs := err.(interface{ Unwrap() []error }).Unwrap(); len(errs) != 2 {
+		t.Fatalf("expected: 2 errors, got: %v", errs)
+	}
+}
+
+func TestResolveTag(t *testing.T) {
+	b := New(&clientMock{PackageVersions: someVersions()}, nil)
+
+	for _, tc := range []struct {
+		tag            string
+		expectedDigest string
+		expectedErr    error
+	}{
+		{tag: "v1", expectedDigest: "sha256:1111"},
+		{tag: "latest", expectedDigest: "sha256:2222"},
+		{tag: "unknown", expectedErr: backend.ErrNotFound},
+	} {
+		digest, err := b.ResolveTag(context.Background(), "some-owner", "some-package", tc.tag)
+		if !errors.Is(err, tc.expectedErr) {
+			t.Fatalf("expected: %v, got: %v", tc.expectedErr, err)
+		}
+		if digest != tc.expectedDigest {
+			t.Fatalf("expected: %s, got: %s", tc.expectedDigest, digest)
+		}
+	}
+}
+
+func TestDeleteVersion(t *testing.T) {
+	for _, tc := range []struct {
+		reference  string
+		expectedID int64
+	}{
+		{reference: "v1", expectedID: 1},
+		{reference: "sha256:2222", expectedID: 2},
+	} {
+		client := &clientMock{PackageVersions: someVersions()}
+
+		if err := New(client, nil).DeleteVersion(context.Background(), "some-owner", "some-package", tc.reference); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if client.DeletedVersionID != tc.expectedID {
+			t.Fatalf("expected: %d, got: %d", tc.expectedID, client.DeletedVersionID)
+		}
+	}
+}
+
+func TestFindVersion(t *testing.T) {
+	client := &clientMock{PackageVersions: someVersions()}
+	b := New(client, nil)
+
+	version, err := b.FindVersion(context.Background(), "some-owner", "some-package", "latest")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := backend.Version{Digest: "sha256:2222", Tags: []string{"v2", "latest"}}
+	if !reflect.DeepEqual(version, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, version)
+	}
+	if client.DeletedVersionID != 0 {
+		t.Fatalf("expected no deletion, got: %d", client.DeletedVersionID)
+	}
+
+	if _, err := b.FindVersion(context.Background(), "some-owner", "some-package", "unknown"); !errors.Is(err, backend.ErrNotFound) {
+		t.Fatalf("expected: %v, got: %v", backend.ErrNotFound, err)
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	versions := someVersions()
+	createdAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions[1].CreatedAt = &gh.Timestamp{Time: createdAt}
+	b := New(&clientMock{PackageVersions: versions}, nil)
+
+	result, err := b.ListVersions(context.Background(), "some-owner", "some-package")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := []backend.Version{
+		{Digest: "sha256:1111", Tags: []string{"v1"}},
+		{Digest: "sha256:2222", Tags: []string{"v2", "latest"}, CreatedAt: createdAt},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, result)
+	}
+}
+
+func TestListVersionsPaginated(t *testing.T) {
+	var versions []*gh.PackageVersion
+	for i := 0; i < 5; i++ {
+		versions = append(versions, &gh.PackageVersion{ID: gh.Int64(int64(i)), Name: gh.String(fmt.Sprintf("sha256:%d", i))})
+	}
+	b := New(&clientMock{PackageVersions: versions, VersionsPerPage: 2}, nil)
+
+	result, err := b.ListVersions(context.Background(), "some-owner", "some-package")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(result) != len(versions) || result[4].Digest != "sha256:4" {
+		t.Fatalf("expected all the versions, got: %v", result)
+	}
+	if _, err := b.FindVersion(context.Background(), "some-owner", "some-package", "sha256:4"); err != nil {
+		t.Fatalf("expected the version of the last page, got: %s", err)
+	}
+}
+
+func TestFindSource(t *testing.T) {
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{
+				Name: gh.String("some-image"),
+				Repository: &gh.Repository{
+					HTMLURL:     gh.String("https://github.com/some-user/some-repo"),
+					Description: gh.String("Some description"),
+					License:     &gh.License{SPDXID: gh.String("MIT")},
+				},
+			},
+			{Name: gh.String("unlinked-image")},
+		},
+	}
+	b := New(client, nil)
+
+	source, err := b.FindSource(context.Background(), "some-user", "some-image")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := backend.Source{URL: "https://github.com/some-user/some-repo", Description: "Some description", License: "MIT"}
+	if source != expected {
+		t.Fatalf("expected: %v, got: %v", expected, source)
+	}
+
+	for _, name := range []string{"unlinked-image", "unknown-image"} {
+		if _, err := b.FindSource(context.Background(), "some-user", name); !errors.Is(err, backend.ErrNotFound) {
+			t.Fatalf("expected not found error for %s, got: %v", name, err)
+		}
+	}
+}
+
+type readmeClientMock struct {
+	Content *gh.RepositoryContent
+	Err     error
+	Owner   string
+	Repo    string
+}
+
+func (c *readmeClientMock) GetReadme(ctx context.Context, owner, repo string, opts *gh.RepositoryContentGetOptions) (*gh.RepositoryContent, *gh.Response, error) {
+	c.Owner, c.Repo = owner, repo
+	return c.Content, nil, c.Err
+}
+
+func (c *readmeClientMock) Markdown(ctx context.Context, text string, opts *gh.MarkdownOptions) (string, *gh.Response, error) {
+	return "<p>" + text + "</p>", nil, nil
+}
+
+func TestFindReadme(t *testing.T) {
+	client := &clientMock{
+		Packages: []*gh.Package{
+			{
+				Name: gh.String("some-image"),
+				Repository: &gh.Repository{
+					Name:    gh.String("some-repo"),
+					Owner:   &gh.User{Login: gh.String("some-org")},
+					HTMLURL: gh.String("https://github.com/some-org/some-repo"),
+				},
+			},
+		},
+	}
+	readmes := &readmeClientMock{Content: &gh.RepositoryContent{Content: gh.String("Hello")}}
+	b := New(client, nil, WithReadmes(readmes))
+
+	for _, tc := range []struct {
+		format         string
+		expectedReadme string
+	}{
+		{format: backend.ReadmeFormatMarkdown, expectedReadme: "Hello"},
+		{format: backend.ReadmeFormatHTML, expectedReadme: "<p>Hello</p>"},
+	} {
+		readme, err := b.FindReadme(context.Background(), "some-user", "some-image", tc.format)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if readme != tc.expectedReadme {
+			t.Fatalf("expected: %q, got: %q", tc.expectedReadme, readme)
+		}
+		if readmes.Owner != "some-org" || readmes.Repo != "some-repo" {
+			t.Fatalf("expected README of some-org/some-repo, got: %s/%s", readmes.Owner, readmes.Repo)
+		}
+	}
+
+	readmes.Err = &gh.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	if _, err := b.FindReadme(context.Background(), "some-user", "some-image", backend.ReadmeFormatMarkdown); !errors.Is(err, backend.ErrNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	if _, err := New(client, nil).FindReadme(context.Background(), "some-user", "some-image", backend.ReadmeFormatMarkdown); !errors.Is(err, backend.ErrNotSupported) {
+		t.Fatalf("expected not supported error, got: %v", err)
+	}
+}
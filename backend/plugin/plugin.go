@@ -0,0 +1,461 @@
+// Package plugin allows registry backends, authenticators and authorization
+// policies to run in external processes, in the spirit of hashicorp/go-plugin.
+// The proxy starts the plugin executable, which must call Serve() or
+// ServePlugins() with its implementations, and then talks to it over net/rpc
+// on a local TCP connection.
+//
+// The handshake is a single line written by the plugin on its standard output:
+//
+//	<protocol version>|tcp|<address>|<comma-separated capabilities>
+//
+// Each connection starts with the secret that the proxy passes to the plugin
+// in its environment, so that the other local processes cannot call the
+// plugin. The plugin exits when its standard input is closed, i.e. when the
+// proxy exits, even abruptly.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+const (
+	// ProtocolVersion is incremented when the RPC interface changes.
+	ProtocolVersion = "2"
+
+	magicCookieKey   = "CONTAINER_REGISTRY_PROXY_PLUGIN"
+	magicCookieValue = "d2a6bd6e-7d59-4a54-a1c4-08e2b4a5e0a5"
+	secretKey        = "CONTAINER_REGISTRY_PROXY_PLUGIN_SECRET"
+	secretSize       = 32
+
+	errNotFoundMessage = "plugin: not found"
+
+	handshakeTimeout = 10 * time.Second
+)
+
+// The capabilities of a plugin.
+const (
+	CapabilityBackend       = "backend"
+	CapabilityAuthenticator = "auth"
+	CapabilityPolicy        = "policy"
+)
+
+// Identity is a client authenticated by an auth plugin.
+type Identity struct {
+	Subject string
+	Groups  []string
+}
+
+// AuthRequest is the request of a client to authenticate.
+type AuthRequest struct {
+	Method     string
+	Path       string
+	Header     http.Header
+	RemoteAddr string
+}
+
+// Authenticator is implemented by the auth plugins.
+type Authenticator interface {
+	// Authenticate returns the identity of the client, or nil when the request
+	// does not contain credentials handled by the plugin. An error is
+	// returned when the credentials are invalid.
+	Authenticate(ctx context.Context, req AuthRequest) (*Identity, error)
+}
+
+// Policy is implemented by the authorization policy plugins.
+type Policy interface {
+	// Authorize returns true when the identity can perform an action (`pull`,
+	// `push` or `delete`) on a repository.
+	Authorize(ctx context.Context, identity Identity, name, action string) (bool, error)
+}
+
+// Plugins are the implementations served by a plugin executable, any of
+// which can be nil.
+type Plugins struct {
+	Backend       backend.RegistryBackend
+	Authenticator Authenticator
+	Policy        Policy
+}
+
+// Args is the set of arguments shared by the backend RPC methods.
+type Args struct {
+	Owner     string
+	Name      string
+	Reference string
+	// Deadline is the deadline of the call in the proxy, if any.
+	Deadline time.Time
+}
+
+// AuthArgs are the arguments of the authenticator RPC method.
+type AuthArgs struct {
+	Request  AuthRequest
+	Deadline time.Time
+}
+
+// AuthReply is the reply of the authenticator RPC method.
+type AuthReply struct {
+	Identity *Identity
+}
+
+// PolicyArgs are the arguments of the policy RPC method.
+type PolicyArgs struct {
+	Identity Identity
+	Name     string
+	Action   string
+	Deadline time.Time
+}
+
+// callContext returns the context of a call, with the deadline of the call in
+// the proxy.
+func callContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// server exposes a backend over net/rpc.
+type server struct {
+	impl backend.RegistryBackend
+}
+
+func (s *server) ListRepositories(args Args, reply *[]backend.Repository) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	repositories, err := s.impl.ListRepositories(ctx)
+	*reply = repositories
+	return encodeError(err)
+}
+
+func (s *server) ListTags(args Args, reply *[]string) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	tags, err := s.impl.ListTags(ctx, args.Owner, args.Name)
+	*reply = tags
+	return encodeError(err)
+}
+
+func (s *server) ResolveTag(args Args, reply *string) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	digest, err := s.impl.ResolveTag(ctx, args.Owner, args.Name, args.Reference)
+	*reply = digest
+	return encodeError(err)
+}
+
+func (s *server) DeleteVersion(args Args, reply *bool) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	return encodeError(s.impl.DeleteVersion(ctx, args.Owner, args.Name, args.Reference))
+}
+
+// authServer exposes an authenticator over net/rpc.
+type authServer struct {
+	impl Authenticator
+}
+
+func (s *authServer) Authenticate(args AuthArgs, reply *AuthReply) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	identity, err := s.impl.Authenticate(ctx, args.Request)
+	reply.Identity = identity
+	return err
+}
+
+// policyServer exposes a policy over net/rpc.
+type policyServer struct {
+	impl Policy
+}
+
+func (s *policyServer) Authorize(args PolicyArgs, reply *bool) error {
+	ctx, cancel := callContext(args.Deadline)
+	defer cancel()
+	allowed, err := s.impl.Authorize(ctx, args.Identity, args.Name, args.Action)
+	*reply = allowed
+	return err
+}
+
+// encodeError preserves backend.ErrNotFound, which would otherwise be lost
+// when the error is serialized.
+func encodeError(err error) error {
+	if errors.Is(err, backend.ErrNotFound) {
+		return errors.New(errNotFoundMessage)
+	}
+	return err
+}
+
+// Serve is called by a plugin executable to expose its backend. It blocks
+// until the proxy terminates the plugin.
+func Serve(impl backend.RegistryBackend) {
+	ServePlugins(Plugins{Backend: impl})
+}
+
+// ServePlugins is called by a plugin executable to expose its backend,
+// authenticator and policy. It blocks until the proxy terminates the plugin.
+func ServePlugins(plugins Plugins) {
+	if os.Getenv(magicCookieKey) != magicCookieValue {
+		fmt.Fprintln(os.Stderr, "This binary is a plugin of the container registry proxy, it is not meant to be executed directly.")
+		os.Exit(1)
+	}
+	secret := os.Getenv(secretKey)
+	if len(secret) != 2*secretSize {
+		log.Fatal("plugin: missing secret")
+	}
+	os.Unsetenv(secretKey)
+
+	rpcServer := rpc.NewServer()
+	var capabilities []string
+	for _, service := range []struct {
+		capability, name string
+		receiver         interface{}
+		ok               bool
+	}{
+		{CapabilityBackend, "Plugin", &server{impl: plugins.Backend}, plugins.Backend != nil},
+		{CapabilityAuthenticator, "Auth", &authServer{impl: plugins.Authenticator}, plugins.Authenticator != nil},
+		{CapabilityPolicy, "Policy", &policyServer{impl: plugins.Policy}, plugins.Policy != nil},
+	} {
+		if !service.ok {
+			continue
+		}
+		if err := rpcServer.RegisterName(service.name, service.receiver); err != nil {
+			log.Fatal(err)
+		}
+		capabilities = append(capabilities, service.capability)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The proxy keeps the standard input open until it exits.
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	fmt.Printf("%s|tcp|%s|%s\n", ProtocolVersion, listener.Addr(), strings.Join(capabilities, ","))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if !checkSecret(conn, secret) {
+				conn.Close()
+				return
+			}
+			rpcServer.ServeConn(conn)
+		}()
+	}
+}
+
+// checkSecret reads the secret that starts a connection.
+func checkSecret(conn net.Conn, secret string) bool {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	received := make([]byte, len(secret)+1)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Time{})
+	return subtle.ConstantTimeCompare(received, []byte(secret+"\n")) == 1
+}
+
+// Backend is a plugin process, implementing a registry backend, an
+// authenticator or a policy depending on its capabilities.
+type Backend struct {
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	addr         string
+	client       *rpc.Client
+	capabilities map[string]bool
+}
+
+// Open starts the plugin executable at path and connects to it.
+func Open(path string, args ...string) (*Backend, error) {
+	random := make([]byte, secretSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	secret := hex.EncodeToString(random)
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", magicCookieKey, magicCookieValue), fmt.Sprintf("%s=%s", secretKey, secret))
+	cmd.Stderr = os.Stderr
+
+	// The plugin exits when the proxy exits, which closes the standard input.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	addr, capabilities, err := readHandshake(stdout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	// Keep draining the standard output so that the plugin never blocks on a
+	// write.
+	go io.Copy(io.Discard, stdout)
+
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err == nil {
+		_, err = io.WriteString(conn, secret+"\n")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+
+	b := &Backend{cmd: cmd, stdin: stdin, addr: addr, client: rpc.NewClient(conn), capabilities: map[string]bool{}}
+	for _, capability := range capabilities {
+		b.capabilities[capability] = true
+	}
+	return b, nil
+}
+
+// Supports returns true when the plugin has a capability, e.g.
+// CapabilityBackend.
+func (b *Backend) Supports(capability string) bool {
+	return b.capabilities[capability]
+}
+
+func readHandshake(r io.Reader) (string, []string, error) {
+	lines := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil {
+			errs <- fmt.Errorf("failed to read handshake: %w", err)
+			return
+		}
+		lines <- strings.TrimSpace(line)
+	}()
+
+	var line string
+	select {
+	case line = <-lines:
+	case err := <-errs:
+		return "", nil, err
+	case <-time.After(handshakeTimeout):
+		return "", nil, errors.New("timeout waiting for handshake")
+	}
+
+	parts := strings.Split(line, "|")
+	if len(parts) > 0 && parts[0] != ProtocolVersion {
+		return "", nil, fmt.Errorf("unsupported protocol version %s (expected %s)", parts[0], ProtocolVersion)
+	}
+	if len(parts) != 4 || parts[1] != "tcp" {
+		return "", nil, fmt.Errorf("invalid handshake: %q", line)
+	}
+
+	var capabilities []string
+	if parts[3] != "" {
+		capabilities = strings.Split(parts[3], ",")
+	}
+	return parts[2], capabilities, nil
+}
+
+// Close terminates the plugin process.
+func (b *Backend) Close() error {
+	b.client.Close()
+	b.stdin.Close()
+	if err := b.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	b.cmd.Wait()
+	return nil
+}
+
+func (b *Backend) call(ctx context.Context, method string, args Args, reply interface{}) error {
+	args.Deadline, _ = ctx.Deadline()
+	return b.callService(ctx, "Plugin", method, args, reply)
+}
+
+func (b *Backend) callService(ctx context.Context, service, method string, args interface{}, reply interface{}) error {
+	call := b.client.Go(service+"."+method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+	}
+
+	if call.Error != nil {
+		if call.Error.Error() == errNotFoundMessage {
+			return backend.ErrNotFound
+		}
+		return fmt.Errorf("%s: %w", method, call.Error)
+	}
+
+	return nil
+}
+
+// ListRepositories implements backend.RegistryBackend.
+func (b *Backend) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	var repositories []backend.Repository
+	err := b.call(ctx, "ListRepositories", Args{}, &repositories)
+	return repositories, err
+}
+
+// ListTags implements backend.RegistryBackend.
+func (b *Backend) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	var tags []string
+	err := b.call(ctx, "ListTags", Args{Owner: owner, Name: name}, &tags)
+	return tags, err
+}
+
+// ResolveTag implements backend.RegistryBackend.
+func (b *Backend) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	var digest string
+	err := b.call(ctx, "ResolveTag", Args{Owner: owner, Name: name, Reference: tag}, &digest)
+	return digest, err
+}
+
+// DeleteVersion implements backend.RegistryBackend.
+func (b *Backend) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	var ok bool
+	return b.call(ctx, "DeleteVersion", Args{Owner: owner, Name: name, Reference: reference}, &ok)
+}
+
+// Authenticate asks an auth plugin for the identity of a client.
+func (b *Backend) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	var reply AuthReply
+	deadline, _ := ctx.Deadline()
+	err := b.callService(ctx, "Auth", "Authenticate", AuthArgs{Request: req, Deadline: deadline}, &reply)
+	return reply.Identity, err
+}
+
+// Authorize asks a policy plugin whether an identity can perform an action on
+// a repository.
+func (b *Backend) Authorize(ctx context.Context, identity Identity, name, action string) (bool, error) {
+	var allowed bool
+	deadline, _ := ctx.Deadline()
+	err := b.callService(ctx, "Policy", "Authorize", PolicyArgs{Identity: identity, Name: name, Action: action, Deadline: deadline}, &allowed)
+	return allowed, err
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+type staticBackend struct{}
+
+func (b *staticBackend) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	return []backend.Repository{{Owner: "some-owner", Name: "some-package"}}, nil
+}
+
+func (b *staticBackend) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	return []string{owner + "-tag", name + "-tag"}, nil
+}
+
+func (b *staticBackend) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	// The deadline of the proxy is passed to the plugin.
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.UTC().Format(time.RFC3339), nil
+	}
+	return "", backend.ErrNotFound
+}
+
+func (b *staticBackend) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	return errors.New("an error")
+}
+
+type staticAuthenticator struct{}
+
+func (a *staticAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	switch req.Header.Get("Authorization") {
+	case "":
+		return nil, nil
+	case "Bearer good":
+		return &Identity{Subject: "some-user", Groups: []string{"some-group"}}, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+type staticPolicy struct{}
+
+func (p *staticPolicy) Authorize(ctx context.Context, identity Identity, name, action string) (bool, error) {
+	return identity.Subject == "some-user" && action == "pull", nil
+}
+
+// TestMain turns the test binary into a plugin when it is started by Open().
+func TestMain(m *testing.M) {
+	if os.Getenv(magicCookieKey) == magicCookieValue {
+		ServePlugins(Plugins{Backend: &staticBackend{}, Authenticator: &staticAuthenticator{}, Policy: &staticPolicy{}})
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestPlugin(t *testing.T) {
+	b, err := Open(os.Args[0])
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+
+	repositories, err := b.ListRepositories(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expectedRepositories := []backend.Repository{{Owner: "some-owner", Name: "some-package"}}
+	if !reflect.DeepEqual(repositories, expectedRepositories) {
+		t.Fatalf("expected: %v, got: %v", expectedRepositories, repositories)
+	}
+
+	tags, err := b.ListTags(ctx, "a", "b")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"a-tag", "b-tag"}) {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+
+	if _, err := b.ResolveTag(ctx, "a", "b", "c"); !errors.Is(err, backend.ErrNotFound) {
+		t.Fatalf("expected: %v, got: %v", backend.ErrNotFound, err)
+	}
+
+	if err := b.DeleteVersion(ctx, "a", "b", "c"); err == nil || err.Error() != "DeleteVersion: an error" {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	deadlineCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if actual, err := b.ResolveTag(deadlineCtx, "a", "b", "c"); err != nil || actual != deadline.Format(time.RFC3339) {
+		t.Fatalf("expected the deadline, got: %s (%v)", actual, err)
+	}
+
+	for _, capability := range []string{CapabilityBackend, CapabilityAuthenticator, CapabilityPolicy} {
+		if !b.Supports(capability) {
+			t.Fatalf("expected the %s capability", capability)
+		}
+	}
+	identity, err := b.Authenticate(ctx, AuthRequest{Header: http.Header{"Authorization": {"Bearer good"}}})
+	if err != nil || identity == nil || identity.Subject != "some-user" {
+		t.Fatalf("unexpected identity: %v (%v)", identity, err)
+	}
+	if identity, err := b.Authenticate(ctx, AuthRequest{}); err != nil || identity != nil {
+		t.Fatalf("expected no identity, got: %v (%v)", identity, err)
+	}
+	if _, err := b.Authenticate(ctx, AuthRequest{Header: http.Header{"Authorization": {"Bearer bad"}}}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if allowed, err := b.Authorize(ctx, *identity, "a/b", "pull"); err != nil || !allowed {
+		t.Fatalf("expected the pull to be allowed, got: %t (%v)", allowed, err)
+	}
+	if allowed, err := b.Authorize(ctx, *identity, "a/b", "push"); err != nil || allowed {
+		t.Fatalf("expected the push to be denied, got: %t (%v)", allowed, err)
+	}
+
+	// The connections without the secret are rejected.
+	conn, err := net.Dial("tcp", b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var denied []backend.Repository
+	if err := client.Call("Plugin.ListRepositories", Args{}, &denied); err == nil {
+		t.Fatal("expected the call without secret to fail")
+	}
+}
+
+func TestReadHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		line        string
+		expectedErr bool
+	}{
+		{line: "2|tcp|127.0.0.1:1234|backend,auth\n"},
+		{line: "2|tcp|127.0.0.1:1234|\n"},
+		{line: "1|tcp|127.0.0.1:1234\n", expectedErr: true},
+		{line: "2|unix|/tmp/socket|backend\n", expectedErr: true},
+		{line: "garbage", expectedErr: true},
+	} {
+		r, w, _ := os.Pipe()
+		w.WriteString(tc.line)
+		w.Close()
+
+		_, _, err := readHandshake(r)
+		if (err != nil) != tc.expectedErr {
+			t.Fatalf("%q: unexpected error: %v", tc.line, err)
+		}
+	}
+}
+
+func TestPluginExitsWithProxy(t *testing.T) {
+	b, err := Open(os.Args[0])
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// The standard input of the plugin is closed when the proxy exits.
+	b.stdin.Close()
+	exited := make(chan error, 1)
+	go func() { exited <- b.cmd.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		b.cmd.Process.Kill()
+		t.Fatal("expected the plugin to exit")
+	}
+}
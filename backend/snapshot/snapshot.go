@@ -0,0 +1,368 @@
+// Package snapshot implements a registry backend persisting the repositories
+// and tags returned by another backend to disk. The snapshot is served while
+// the other backend is unavailable, e.g. during a GitHub outage, including
+// right after a restart.
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// refreshTimeout is the maximum duration of a background refresh.
+const refreshTimeout = time.Minute
+
+// snapshot is the content of the snapshot file.
+type snapshot struct {
+	Repositories []backend.Repository `json:"repositories"`
+	// Tags are the tags of the repositories, by `owner/name`.
+	Tags      map[string][]string `json:"tags"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// Backend serves the last known repositories and tags when the next backend
+// fails. Until a list has been fetched from the next backend once, the
+// snapshot is served immediately and the list is refreshed in the background.
+type Backend struct {
+	next backend.RegistryBackend
+	path string
+
+	mu       sync.Mutex
+	snapshot snapshot
+	// fresh are the lists fetched from the next backend since the start, or
+	// invalidated, which are only served from the snapshot when it fails.
+	fresh      map[string]bool
+	refreshing map[string]bool
+}
+
+// New returns a backend persisting the lists of next in the file at path. The
+// previous snapshot is loaded from the file if it exists.
+func New(next backend.RegistryBackend, path string) (*Backend, error) {
+	b := &Backend{
+		next:       next,
+		path:       path,
+		snapshot:   snapshot{Tags: map[string][]string{}},
+		fresh:      map[string]bool{},
+		refreshing: map[string]bool{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	if b.snapshot.Tags == nil {
+		b.snapshot.Tags = map[string][]string{}
+	}
+	log.Printf("loaded the snapshot of %d repositories from %s (%s)", len(b.snapshot.Repositories), path, b.snapshot.UpdatedAt.Format(time.RFC3339))
+
+	return b, nil
+}
+
+const repositoriesKey = "_catalog"
+
+func tagsKey(owner, name string) string {
+	return owner + "/" + name
+}
+
+// stale returns the snapshot of a list, if it is not fresh yet.
+func (b *Backend) stale(key string) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fresh[key] {
+		return nil, false
+	}
+	return b.lookup(key)
+}
+
+// fallback returns the snapshot of a list, if any.
+func (b *Backend) fallback(key string) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lookup(key)
+}
+
+// lookup returns the snapshot of a list. The lock must be held.
+func (b *Backend) lookup(key string) (interface{}, bool) {
+	if key == repositoriesKey {
+		return b.snapshot.Repositories, b.snapshot.Repositories != nil
+	}
+	tags, ok := b.snapshot.Tags[key]
+	return tags, ok
+}
+
+// store saves a list fetched from the next backend.
+func (b *Backend) store(key string, value interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fresh[key] = true
+	if key == repositoriesKey {
+		repositories := value.([]backend.Repository)
+		if reflect.DeepEqual(repositories, b.snapshot.Repositories) {
+			return
+		}
+		b.snapshot.Repositories = repositories
+	} else {
+		tags := value.([]string)
+		if current, ok := b.snapshot.Tags[key]; ok && reflect.DeepEqual(tags, current) {
+			return
+		}
+		b.snapshot.Tags[key] = tags
+	}
+	b.snapshot.UpdatedAt = time.Now().UTC()
+
+	if err := b.save(); err != nil {
+		log.Printf("WARN snapshot not saved: %s", err)
+	}
+}
+
+// forget removes a list that no longer exists.
+func (b *Backend) forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fresh[key] = true
+	if _, ok := b.snapshot.Tags[key]; !ok {
+		return
+	}
+	delete(b.snapshot.Tags, key)
+	if err := b.save(); err != nil {
+		log.Printf("WARN snapshot not saved: %s", err)
+	}
+}
+
+// Invalidate fetches the tags of a repository and the repositories from the
+// next backend from now on, instead of serving their snapshot until they are
+// refreshed, e.g. when a version of the repository is published.
+func (b *Backend) Invalidate(owner, name string) {
+	b.mu.Lock()
+	b.fresh[repositoriesKey] = true
+	b.fresh[tagsKey(owner, name)] = true
+	for key := range b.snapshot.Tags {
+		if strings.EqualFold(key, tagsKey(owner, name)) {
+			b.fresh[key] = true
+		}
+	}
+	b.mu.Unlock()
+
+	if invalidator, ok := b.next.(backend.Invalidator); ok {
+		invalidator.Invalidate(owner, name)
+	}
+}
+
+// save writes the snapshot atomically. The lock must be held.
+func (b *Backend) save() error {
+	data, err := json.Marshal(b.snapshot)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(b.path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), b.path)
+}
+
+// refresh fetches a list from the next backend in the background, unless it
+// is already refreshed.
+func (b *Backend) refresh(key string, fetch func(ctx context.Context) error) {
+	b.mu.Lock()
+	if b.refreshing[key] {
+		b.mu.Unlock()
+		return
+	}
+	b.refreshing[key] = true
+	b.mu.Unlock()
+
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.refreshing, key)
+			b.mu.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		if err := fetch(ctx); err != nil {
+			log.Printf("WARN snapshot refresh of %s failed: %s", key, err)
+		}
+	}()
+}
+
+func (b *Backend) fetchRepositories(ctx context.Context) ([]backend.Repository, error) {
+	repositories, err := b.next.ListRepositories(ctx)
+	if err != nil {
+		// A partial listing is not recorded in the snapshot.
+		return repositories, err
+	}
+	b.store(repositoriesKey, append([]backend.Repository{}, repositories...))
+	return repositories, nil
+}
+
+func (b *Backend) fetchTags(ctx context.Context, owner, name string) ([]string, error) {
+	tags, err := b.next.ListTags(ctx, owner, name)
+	if errors.Is(err, backend.ErrNotFound) {
+		b.forget(tagsKey(owner, name))
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.store(tagsKey(owner, name), append([]string{}, tags...))
+	return tags, nil
+}
+
+// ListRepositories returns the repositories of the next backend, or the
+// snapshot when it fails, even with a partial listing. Without snapshot, the
+// partial listing is returned along with the error.
+func (b *Backend) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	if value, ok := b.stale(repositoriesKey); ok {
+		b.refresh(repositoriesKey, func(ctx context.Context) error {
+			_, err := b.fetchRepositories(ctx)
+			return err
+		})
+		return append([]backend.Repository{}, value.([]backend.Repository)...), nil
+	}
+
+	repositories, err := b.fetchRepositories(ctx)
+	if err != nil {
+		if value, ok := b.fallback(repositoriesKey); ok {
+			log.Printf("WARN ListRepositories failed, serving the snapshot: %s", err)
+			return append([]backend.Repository{}, value.([]backend.Repository)...), nil
+		}
+		return repositories, err
+	}
+
+	return repositories, nil
+}
+
+// ListTags returns the tags of a repository of the next backend, or the
+// snapshot when it fails.
+func (b *Backend) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	key := tagsKey(owner, name)
+	if value, ok := b.stale(key); ok {
+		b.refresh(key, func(ctx context.Context) error {
+			_, err := b.fetchTags(ctx, owner, name)
+			return err
+		})
+		return append([]string{}, value.([]string)...), nil
+	}
+
+	tags, err := b.fetchTags(ctx, owner, name)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		if value, ok := b.fallback(key); ok {
+			log.Printf("WARN ListTags %s failed, serving the snapshot: %s", key, err)
+			return append([]string{}, value.([]string)...), nil
+		}
+	}
+
+	return tags, err
+}
+
+// ListOwnerRepositories returns the repositories of an owner listed by the
+// next backend, or the ones of the catalog snapshot when it fails.
+func (b *Backend) ListOwnerRepositories(ctx context.Context, owner string) ([]backend.Repository, error) {
+	if lister, ok := b.next.(backend.OwnerRepositoryLister); ok {
+		repositories, err := lister.ListOwnerRepositories(ctx, owner)
+		if err == nil {
+			return repositories, nil
+		}
+		log.Printf("WARN ListOwnerRepositories %s failed, serving the snapshot: %s", owner, err)
+	}
+
+	repositories, err := b.ListRepositories(ctx)
+	return backend.FilterOwner(repositories, owner), err
+}
+
+// ListOwners is not served from the snapshot.
+func (b *Backend) ListOwners(ctx context.Context) ([]backend.Owner, error) {
+	lister, ok := b.next.(backend.OwnerLister)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return lister.ListOwners(ctx)
+}
+
+// ResolveTag is not served from the snapshot.
+func (b *Backend) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	return b.next.ResolveTag(ctx, owner, name, tag)
+}
+
+// FindVersion is not served from the snapshot.
+func (b *Backend) FindVersion(ctx context.Context, owner, name, reference string) (backend.Version, error) {
+	finder, ok := b.next.(backend.VersionFinder)
+	if !ok {
+		return backend.Version{}, backend.ErrNotSupported
+	}
+	return finder.FindVersion(ctx, owner, name, reference)
+}
+
+// ListVersions is not served from the snapshot.
+func (b *Backend) ListVersions(ctx context.Context, owner, name string) ([]backend.Version, error) {
+	lister, ok := b.next.(backend.VersionLister)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return lister.ListVersions(ctx, owner, name)
+}
+
+// FindSource is not served from the snapshot.
+func (b *Backend) FindSource(ctx context.Context, owner, name string) (backend.Source, error) {
+	finder, ok := b.next.(backend.SourceFinder)
+	if !ok {
+		return backend.Source{}, backend.ErrNotSupported
+	}
+	return finder.FindSource(ctx, owner, name)
+}
+
+// FindReadme is not served from the snapshot.
+func (b *Backend) FindReadme(ctx context.Context, owner, name, format string) (string, error) {
+	finder, ok := b.next.(backend.ReadmeFinder)
+	if !ok {
+		return "", backend.ErrNotSupported
+	}
+	return finder.FindReadme(ctx, owner, name, format)
+}
+
+// DeleteVersion deletes a version with the next backend. The tags of the
+// repository are then fetched from the next backend on the next call.
+func (b *Backend) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	if err := b.next.DeleteVersion(ctx, owner, name, reference); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fresh[tagsKey(owner, name)] = true
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+type backendMock struct {
+	mu           sync.Mutex
+	Repositories []backend.Repository
+	Tags         map[string][]string
+	Err          error
+}
+
+func (b *backendMock) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Repositories, b.Err
+}
+
+func (b *backendMock) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	tags, ok := b.Tags[owner+"/"+name]
+	if !ok {
+		return nil, backend.ErrNotFound
+	}
+	return tags, nil
+}
+
+func (b *backendMock) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	return "", b.Err
+}
+
+func (b *backendMock) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	return b.Err
+}
+
+func (b *backendMock) set(repositories []backend.Repository, tags map[string][]string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Repositories, b.Tags, b.Err = repositories, tags, err
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	repositories := []backend.Repository{{Owner: "some-owner", Name: "some-package"}}
+	tags := map[string][]string{"some-owner/some-package": {"v1", "latest"}}
+	outage := errors.New("outage")
+
+	next := &backendMock{Repositories: repositories, Tags: tags}
+	b, err := New(next, path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	b.ListRepositories(ctx)
+	b.ListTags(ctx, "some-owner", "some-package")
+
+	// The snapshot is served when the next backend fails, even with a partial
+	// listing.
+	partial := []backend.Repository{{Owner: "other-owner", Name: "static-package"}}
+	next.set(partial, nil, outage)
+	if actual, err := b.ListRepositories(ctx); err != nil || !reflect.DeepEqual(actual, repositories) {
+		t.Fatalf("expected: %v, got: %v (%v)", repositories, actual, err)
+	}
+	next.set(nil, nil, outage)
+	if actual, err := b.ListTags(ctx, "some-owner", "some-package"); err != nil || !reflect.DeepEqual(actual, tags["some-owner/some-package"]) {
+		t.Fatalf("expected: %v, got: %v (%v)", tags["some-owner/some-package"], actual, err)
+	}
+	if _, err := b.ListTags(ctx, "some-owner", "other-package"); !errors.Is(err, outage) {
+		t.Fatalf("expected: %s, got: %v", outage, err)
+	}
+
+	// After a restart, the snapshot is served right away, and refreshed in the
+	// background.
+	b, err = New(next, path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if actual, err := b.ListRepositories(ctx); err != nil || !reflect.DeepEqual(actual, repositories) {
+		t.Fatalf("expected: %v, got: %v (%v)", repositories, actual, err)
+	}
+
+	updated := []backend.Repository{{Owner: "some-owner", Name: "some-package"}, {Owner: "some-owner", Name: "new-package"}}
+	next.set(updated, tags, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual, _ := b.ListRepositories(ctx)
+		if reflect.DeepEqual(actual, updated) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected: %v, got: %v", updated, actual)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Repositories that no longer exist are removed from the snapshot.
+	next.set(updated, map[string][]string{}, nil)
+	for {
+		if _, err := b.ListTags(ctx, "some-owner", "some-package"); errors.Is(err, backend.ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the repository to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	next.set(nil, nil, outage)
+	if _, err := b.ListTags(ctx, "some-owner", "some-package"); !errors.Is(err, outage) {
+		t.Fatalf("expected: %s, got: %v", outage, err)
+	}
+}
+
+func TestSnapshotInvalidate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	os.WriteFile(path, []byte(`{"repositories": [{"Owner": "Some-Owner", "Name": "some-package"}], "tags": {"Some-Owner/some-package": ["v1"]}}`), 0o644)
+	next := &backendMock{
+		Repositories: []backend.Repository{{Owner: "Some-Owner", Name: "some-package"}, {Owner: "Some-Owner", Name: "new-package"}},
+		Tags:         map[string][]string{"Some-Owner/some-package": {"v1", "v2"}},
+	}
+	b, err := New(next, path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// The lists of a repository and the catalog are not served from the
+	// snapshot once invalidated, e.g. by a webhook with a lowercase owner.
+	b.Invalidate("some-owner", "some-package")
+	if actual, err := b.ListTags(ctx, "Some-Owner", "some-package"); err != nil || !reflect.DeepEqual(actual, []string{"v1", "v2"}) {
+		t.Fatalf("expected: %v, got: %v (%v)", []string{"v1", "v2"}, actual, err)
+	}
+	if actual, err := b.ListRepositories(ctx); err != nil || !reflect.DeepEqual(actual, next.Repositories) {
+		t.Fatalf("expected: %v, got: %v (%v)", next.Repositories, actual, err)
+	}
+
+	// The snapshot is still served when the next backend fails.
+	next.set(nil, nil, errors.New("outage"))
+	if actual, err := b.ListTags(ctx, "Some-Owner", "some-package"); err != nil || !reflect.DeepEqual(actual, []string{"v1", "v2"}) {
+		t.Fatalf("expected: %v, got: %v (%v)", []string{"v1", "v2"}, actual, err)
+	}
+}
+
+func TestSnapshotPartialListing(t *testing.T) {
+	ctx := context.Background()
+	partial := []backend.Repository{{Owner: "other-owner", Name: "static-package"}}
+	outage := errors.New("outage")
+	b, err := New(&backendMock{Repositories: partial, Err: outage}, filepath.Join(t.TempDir(), "snapshot.json"))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// Without snapshot, the partial listing is returned along with the error.
+	if actual, err := b.ListRepositories(ctx); !errors.Is(err, outage) || !reflect.DeepEqual(actual, partial) {
+		t.Fatalf("expected: %v and %s, got: %v (%v)", partial, outage, actual, err)
+	}
+	if actual, err := b.ListRepositories(ctx); !errors.Is(err, outage) || !reflect.DeepEqual(actual, partial) {
+		t.Fatalf("expected the partial listing not to be recorded, got: %v (%v)", actual, err)
+	}
+}
+
+func TestInvalidSnapshot(t *testing.T) {
+	if _, err := New(&backendMock{}, t.TempDir()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,297 @@
+// Package static implements a registry backend listing the repositories and
+// tags of a file, e.g. a Kubernetes ConfigMap, for the environments where the
+// GitHub API cannot be reached. The images are still pulled from the upstream
+// registry by the proxy.
+package static
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// Catalog is the content of the catalog file, in JSON:
+//
+//	{"repositories": [{"owner": "some-owner", "name": "some-package", "tags": ["1.0", "latest"]}]}
+//
+// or in YAML when its extension is `.yaml` or `.yml`:
+//
+//	repositories:
+//	  - owner: some-owner
+//	    name: some-package
+//	    tags: ["1.0", latest]
+type Catalog struct {
+	Repositories []Repository `json:"repositories"`
+}
+
+// Repository is a repository of the catalog file. Its tags are optional.
+type Repository struct {
+	Owner string   `json:"owner"`
+	Name  string   `json:"name"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+func (c Catalog) validate() error {
+	seen := map[string]bool{}
+	for _, repository := range c.Repositories {
+		if repository.Owner == "" || repository.Name == "" {
+			return fmt.Errorf("repository without owner or name: %+v", repository)
+		}
+		key := strings.ToLower(repository.Owner + "/" + repository.Name)
+		if seen[key] {
+			return fmt.Errorf("duplicate repository: %s/%s", repository.Owner, repository.Name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// Backend serves the repositories and tags of a catalog file. The file is
+// loaded again when it changes, without restarting the proxy.
+type Backend struct {
+	path string
+	// next is the backend whose repositories are merged with the ones of the
+	// catalog file, if any.
+	next backend.RegistryBackend
+
+	mu      sync.Mutex
+	catalog Catalog
+	modTime time.Time
+	size    int64
+}
+
+// Option configures a static backend.
+type Option func(b *Backend)
+
+// WithNext merges the repositories of the catalog file with the ones of
+// another backend, e.g. to list the packages of the accounts that the GitHub
+// token can pull but cannot enumerate. The operations other than the listings
+// are handled by the other backend.
+func WithNext(next backend.RegistryBackend) Option {
+	return func(b *Backend) {
+		b.next = next
+	}
+}
+
+// New returns a backend serving the catalog file at path, which must exist
+// and be valid.
+func New(path string, opts ...Option) (*Backend, error) {
+	b := &Backend{path: path}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := b.reload(); err != nil {
+		return nil, err
+	}
+	log.Printf("loaded the catalog of %d repositories from %s", len(b.catalog.Repositories), path)
+	return b, nil
+}
+
+// reload loads the catalog file if it changed since it was last loaded. The
+// lock must be held.
+func (b *Backend) reload() error {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(b.modTime) && info.Size() == b.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	if ext := strings.ToLower(filepath.Ext(b.path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return fmt.Errorf("invalid catalog %s: %w", b.path, err)
+		}
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return fmt.Errorf("invalid catalog %s: %w", b.path, err)
+	}
+	if err := catalog.validate(); err != nil {
+		return fmt.Errorf("invalid catalog %s: %w", b.path, err)
+	}
+	b.catalog, b.modTime, b.size = catalog, info.ModTime(), info.Size()
+	return nil
+}
+
+// current returns the catalog, loaded again if the file changed. The previous
+// catalog is served when the file cannot be loaded, e.g. while it is written.
+func (b *Backend) current() Catalog {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.modTime
+	if err := b.reload(); err != nil {
+		log.Printf("WARN catalog not reloaded, serving the previous one: %s", err)
+	} else if !b.modTime.Equal(previous) {
+		log.Printf("reloaded the catalog of %d repositories from %s", len(b.catalog.Repositories), b.path)
+	}
+	return b.catalog
+}
+
+func (b *Backend) find(owner, name string) (Repository, bool) {
+	for _, repository := range b.current().Repositories {
+		if strings.EqualFold(repository.Owner, owner) && strings.EqualFold(repository.Name, name) {
+			return repository, true
+		}
+	}
+	return Repository{}, false
+}
+
+// ListRepositories returns the repositories of the catalog file, after the
+// ones of the next backend. When the next backend fails, the catalog file is
+// returned along with its error, e.g. for a snapshot backend to serve its
+// previous listing instead.
+func (b *Backend) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	repositories := []backend.Repository{}
+	var err error
+	if b.next != nil {
+		var listed []backend.Repository
+		listed, err = b.next.ListRepositories(ctx)
+		repositories = append(repositories, listed...)
+	}
+	return merge(repositories, b.current().Repositories), err
+}
+
+// ListOwnerRepositories returns the repositories of an owner, along with the
+// error of the next backend like ListRepositories.
+func (b *Backend) ListOwnerRepositories(ctx context.Context, owner string) ([]backend.Repository, error) {
+	repositories := []backend.Repository{}
+	var err error
+	if b.next != nil {
+		var listed []backend.Repository
+		listed, err = backend.ListOwnerRepositories(ctx, b.next, owner)
+		repositories = append(repositories, listed...)
+	}
+	return backend.FilterOwner(merge(repositories, b.current().Repositories), owner), err
+}
+
+// merge appends the repositories of the catalog file that are not listed yet.
+func merge(repositories []backend.Repository, static []Repository) []backend.Repository {
+	listed := map[string]bool{}
+	for _, repository := range repositories {
+		listed[strings.ToLower(repository.Owner+"/"+repository.Name)] = true
+	}
+	for _, repository := range static {
+		if !listed[strings.ToLower(repository.Owner+"/"+repository.Name)] {
+			repositories = append(repositories, backend.Repository{Owner: repository.Owner, Name: repository.Name})
+		}
+	}
+	return repositories
+}
+
+// ListTags returns the tags of a repository listed by the catalog file, or
+// the ones of the next backend when the file does not list them. The tags of
+// a repository of the catalog file are empty when none can be listed.
+func (b *Backend) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	repository, ok := b.find(owner, name)
+	if ok && len(repository.Tags) > 0 {
+		return append([]string{}, repository.Tags...), nil
+	}
+	if b.next == nil {
+		if !ok {
+			return nil, backend.ErrNotFound
+		}
+		return []string{}, nil
+	}
+
+	tags, err := b.next.ListTags(ctx, owner, name)
+	if err != nil && ok {
+		if !errors.Is(err, backend.ErrNotFound) {
+			log.Printf("WARN ListTags %s/%s failed, serving the catalog file: %s", owner, name, err)
+		}
+		return []string{}, nil
+	}
+	return tags, err
+}
+
+// ResolveTag resolves a tag with the next backend, the catalog file having no
+// digests.
+func (b *Backend) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	if b.next == nil {
+		if _, ok := b.find(owner, name); !ok {
+			return "", backend.ErrNotFound
+		}
+		return "", backend.ErrNotSupported
+	}
+	return b.next.ResolveTag(ctx, owner, name, tag)
+}
+
+// DeleteVersion deletes a version with the next backend, the catalog file
+// being read-only.
+func (b *Backend) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	if b.next == nil {
+		return backend.ErrNotSupported
+	}
+	return b.next.DeleteVersion(ctx, owner, name, reference)
+}
+
+// Invalidate invalidates the lists of the next backend, the catalog file
+// being loaded again when it changes.
+func (b *Backend) Invalidate(owner, name string) {
+	if invalidator, ok := b.next.(backend.Invalidator); ok {
+		invalidator.Invalidate(owner, name)
+	}
+}
+
+// ListOwners is not served from the catalog file.
+func (b *Backend) ListOwners(ctx context.Context) ([]backend.Owner, error) {
+	lister, ok := b.next.(backend.OwnerLister)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	return lister.ListOwners(ctx)
+}
+
+// FindVersion is not served from the catalog file.
+func (b *Backend) FindVersion(ctx context.Context, owner, name, reference string) (backend.Version, error) {
+	finder, ok := b.next.(backend.VersionFinder)
+	if !ok {
+		return backend.Version{}, backend.ErrNotSupported
+	}
+	return finder.FindVersion(ctx, owner, name, reference)
+}
+
+// ListVersions is not served from the catalog file, nor for the repositories
+// whose tags are listed by the file.
+func (b *Backend) ListVersions(ctx context.Context, owner, name string) ([]backend.Version, error) {
+	lister, ok := b.next.(backend.VersionLister)
+	if !ok {
+		return nil, backend.ErrNotSupported
+	}
+	if repository, ok := b.find(owner, name); ok && len(repository.Tags) > 0 {
+		return nil, backend.ErrNotSupported
+	}
+	return lister.ListVersions(ctx, owner, name)
+}
+
+// FindSource is not served from the catalog file.
+func (b *Backend) FindSource(ctx context.Context, owner, name string) (backend.Source, error) {
+	finder, ok := b.next.(backend.SourceFinder)
+	if !ok {
+		return backend.Source{}, backend.ErrNotSupported
+	}
+	return finder.FindSource(ctx, owner, name)
+}
+
+// FindReadme is not served from the catalog file.
+func (b *Backend) FindReadme(ctx context.Context, owner, name, format string) (string, error) {
+	finder, ok := b.next.(backend.ReadmeFinder)
+	if !ok {
+		return "", backend.ErrNotSupported
+	}
+	return finder.FindReadme(ctx, owner, name, format)
+}
@@ -0,0 +1,172 @@
+package static
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+type backendMock struct {
+	Repositories []backend.Repository
+	Tags         map[string][]string
+	Err          error
+}
+
+func (b *backendMock) ListRepositories(ctx context.Context) ([]backend.Repository, error) {
+	return b.Repositories, b.Err
+}
+
+func (b *backendMock) ListTags(ctx context.Context, owner, name string) ([]string, error) {
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	tags, ok := b.Tags[owner+"/"+name]
+	if !ok {
+		return nil, backend.ErrNotFound
+	}
+	return tags, nil
+}
+
+func (b *backendMock) ResolveTag(ctx context.Context, owner, name, tag string) (string, error) {
+	return "sha256:1234", b.Err
+}
+
+func (b *backendMock) DeleteVersion(ctx context.Context, owner, name, reference string) error {
+	return b.Err
+}
+
+func TestStatic(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`{"repositories": [{"owner": "some-owner", "name": "some-package", "tags": ["1.0", "latest"]}, {"owner": "some-owner", "name": "other-package"}]}`), 0o644)
+
+	b, err := New(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := []backend.Repository{{Owner: "some-owner", Name: "some-package"}, {Owner: "some-owner", Name: "other-package"}}
+	if actual, err := b.ListRepositories(ctx); err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected: %v, got: %v (%v)", expected, actual, err)
+	}
+	if actual, err := b.ListTags(ctx, "Some-Owner", "some-package"); err != nil || !reflect.DeepEqual(actual, []string{"1.0", "latest"}) {
+		t.Fatalf("unexpected tags: %v (%v)", actual, err)
+	}
+	if actual, err := b.ListTags(ctx, "some-owner", "other-package"); err != nil || len(actual) != 0 {
+		t.Fatalf("expected no tags, got: %v (%v)", actual, err)
+	}
+	if _, err := b.ListTags(ctx, "some-owner", "unknown-package"); !errors.Is(err, backend.ErrNotFound) {
+		t.Fatalf("expected: %s, got: %v", backend.ErrNotFound, err)
+	}
+	if err := b.DeleteVersion(ctx, "some-owner", "some-package", "1.0"); !errors.Is(err, backend.ErrNotSupported) {
+		t.Fatalf("expected: %s, got: %v", backend.ErrNotSupported, err)
+	}
+
+	// The changes of the file are loaded, and an invalid file is ignored.
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(path, []byte(`{"repositories": [{"owner": "some-owner", "name": "new-package", "tags": ["2.0"]}]}`), 0o644)
+	os.Chtimes(path, later, later)
+	if actual, err := b.ListTags(ctx, "some-owner", "new-package"); err != nil || !reflect.DeepEqual(actual, []string{"2.0"}) {
+		t.Fatalf("expected the new catalog, got: %v (%v)", actual, err)
+	}
+	os.WriteFile(path, []byte(`{"repositories": [`), 0o644)
+	os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute))
+	if actual, err := b.ListTags(ctx, "some-owner", "new-package"); err != nil || !reflect.DeepEqual(actual, []string{"2.0"}) {
+		t.Fatalf("expected the previous catalog, got: %v (%v)", actual, err)
+	}
+}
+
+func TestStaticYAML(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "catalog.yaml")
+	os.WriteFile(path, []byte("repositories:\n  - owner: some-owner\n    name: some-package\n    tags: [1.0, latest]\n"), 0o644)
+
+	b, err := New(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if actual, err := b.ListTags(ctx, "some-owner", "some-package"); err != nil || !reflect.DeepEqual(actual, []string{"1.0", "latest"}) {
+		t.Fatalf("unexpected tags: %v (%v)", actual, err)
+	}
+}
+
+func TestStaticInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"syntax.json":    `{"repositories": `,
+		"owner.json":     `{"repositories": [{"name": "some-package"}]}`,
+		"duplicate.json": `{"repositories": [{"owner": "some-owner", "name": "some-package"}, {"owner": "Some-Owner", "name": "some-package"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := New(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := New(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestStaticMerge(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`{"repositories": [{"owner": "Some-Owner", "name": "some-package"}, {"owner": "other-owner", "name": "private-package"}, {"owner": "other-owner", "name": "pinned-package", "tags": ["1.0"]}]}`), 0o644)
+	next := &backendMock{
+		Repositories: []backend.Repository{{Owner: "some-owner", Name: "some-package"}},
+		Tags: map[string][]string{
+			"some-owner/some-package":     {"v1"},
+			"other-owner/private-package": {"v2", "latest"},
+		},
+	}
+
+	b, err := New(path, WithNext(next))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := []backend.Repository{{Owner: "some-owner", Name: "some-package"}, {Owner: "other-owner", Name: "private-package"}, {Owner: "other-owner", Name: "pinned-package"}}
+	if actual, err := b.ListRepositories(ctx); err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected: %v, got: %v (%v)", expected, actual, err)
+	}
+	if actual, err := b.ListOwnerRepositories(ctx, "other-owner"); err != nil || !reflect.DeepEqual(actual, expected[1:]) {
+		t.Fatalf("expected: %v, got: %v (%v)", expected[1:], actual, err)
+	}
+	for _, tc := range []struct {
+		name     string
+		expected []string
+	}{
+		{name: "private-package", expected: []string{"v2", "latest"}},
+		{name: "pinned-package", expected: []string{"1.0"}},
+	} {
+		if actual, err := b.ListTags(ctx, "other-owner", tc.name); err != nil || !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected: %v, got: %v (%v)", tc.name, tc.expected, actual, err)
+		}
+	}
+	if digest, err := b.ResolveTag(ctx, "other-owner", "private-package", "v2"); err != nil || digest != "sha256:1234" {
+		t.Fatalf("expected the digest of the next backend, got: %s (%v)", digest, err)
+	}
+	if _, err := b.ListVersions(ctx, "other-owner", "pinned-package"); !errors.Is(err, backend.ErrNotSupported) {
+		t.Fatalf("expected: %s, got: %v", backend.ErrNotSupported, err)
+	}
+
+	// The catalog file is returned along with the error when the next backend
+	// fails.
+	next.Err = errors.New("outage")
+	if actual, err := b.ListRepositories(ctx); !errors.Is(err, next.Err) || len(actual) != 3 {
+		t.Fatalf("expected the catalog file and %s, got: %v (%v)", next.Err, actual, err)
+	}
+	if actual, err := b.ListOwnerRepositories(ctx, "other-owner"); !errors.Is(err, next.Err) || !reflect.DeepEqual(actual, expected[1:]) {
+		t.Fatalf("expected: %v and %s, got: %v (%v)", expected[1:], next.Err, actual, err)
+	}
+	if actual, err := b.ListTags(ctx, "other-owner", "private-package"); err != nil || len(actual) != 0 {
+		t.Fatalf("expected no tags, got: %v (%v)", actual, err)
+	}
+	if _, err := b.ListTags(ctx, "other-owner", "unknown-package"); !errors.Is(err, next.Err) {
+		t.Fatalf("expected: %s, got: %v", next.Err, err)
+	}
+}
@@ -0,0 +1,406 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlToJSON converts a catalog file written in YAML to JSON. Only the subset
+// of YAML needed by the catalog is supported: the block mappings and
+// sequences, the flow mappings and sequences (e.g. `tags: [1.0, latest]`), the
+// plain and quoted scalars and the comments. The anchors, the tags, the block
+// scalars and the flow collections written on several lines are rejected,
+// unless the whole file is JSON. The scalars are strings, so that a tag like
+// `1.0` is not read as a number.
+func yamlToJSON(data []byte) ([]byte, error) {
+	// JSON is valid YAML, e.g. a file converted from JSON.
+	if json.Valid(data) {
+		return data, nil
+	}
+
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return []byte("null"), nil
+	}
+
+	p := &yamlParser{lines: lines}
+	value, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected content: %q", p.lines[p.pos].text)
+	}
+	return json.Marshal(value)
+}
+
+// yamlLine is a line of a YAML document, without its indentation and comment.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlLines returns the non-empty lines of a YAML document.
+func yamlLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		text := stripYAMLComment(raw)
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in the indentation", i+1)
+		}
+		trimmed = strings.TrimRight(trimmed, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if trimmed == "---" || strings.HasPrefix(trimmed, "--- ") {
+			if len(lines) > 0 {
+				return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+			}
+			if trimmed = strings.TrimSpace(trimmed[3:]); trimmed == "" {
+				continue
+			}
+		}
+		if trimmed == "..." || strings.HasPrefix(trimmed, "%") {
+			return nil, fmt.Errorf("line %d: directives are not supported", i+1)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(strings.TrimLeft(text, " ")), text: trimmed})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes the comment of a line, a `#` starting a comment at
+// the beginning of the line or after a space, outside of the quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	number := 0
+	if p.pos < len(p.lines) {
+		number = p.lines[p.pos].number
+	} else if len(p.lines) > 0 {
+		number = p.lines[len(p.lines)-1].number
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{number}, args...)...)
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block parses the block mapping or sequence starting at the current line.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLSequenceItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(p.lines[p.pos].text); !ok {
+		// A document or an item made of a single scalar.
+		value, err := p.scalar(p.lines[p.pos].text)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		return value, nil
+	}
+	return p.mapping(indent)
+}
+
+// nested parses the value of a key or of an item continued on the next lines,
+// which is null when there are none.
+func (p *yamlParser) nested(indent int, sequenceAllowed bool) (interface{}, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	switch {
+	case next.indent > indent:
+		return p.block(next.indent)
+	case next.indent == indent && sequenceAllowed && isYAMLSequenceItem(next.text):
+		// The items of a sequence can be aligned with the key of the mapping.
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			item, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+
+		// The content of the item is parsed as a block indented at its
+		// column, e.g. the first key of a mapping.
+		p.lines[p.pos] = yamlLine{number: line.number, indent: line.indent + len(line.text) - len(rest), text: rest}
+		item, err := p.block(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if isYAMLSequenceItem(line.text) {
+			return values, nil
+		}
+		rawKey, rawValue, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected a key: %q", line.text)
+		}
+		key, err := p.scalar(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, p.errorf("invalid key: %q", rawKey)
+		}
+		if _, ok := values[name]; ok {
+			return nil, p.errorf("duplicate key: %q", name)
+		}
+
+		var value interface{}
+		if rawValue != "" {
+			value, err = p.scalar(rawValue)
+			p.pos++
+		} else {
+			p.pos++
+			value, err = p.nested(indent, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return values, nil
+}
+
+// splitYAMLKey splits a `key: value` line at the first colon followed by a
+// space (or ending the line) outside of the quotes and the flow collections.
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ':' && depth == 0 && (i+1 == len(text) || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// scalar parses a value written on a single line: a scalar or a flow
+// collection.
+func (p *yamlParser) scalar(text string) (interface{}, error) {
+	s := &yamlFlow{text: text}
+	value, err := s.value(false)
+	if err != nil {
+		return nil, p.errorf("%s", err)
+	}
+	s.skipSpaces()
+	if s.pos < len(s.text) {
+		return nil, p.errorf("unexpected content: %q", s.text[s.pos:])
+	}
+	return value, nil
+}
+
+// yamlFlow scans the values written on a single line.
+type yamlFlow struct {
+	text string
+	pos  int
+}
+
+func (s *yamlFlow) skipSpaces() {
+	for s.pos < len(s.text) && (s.text[s.pos] == ' ' || s.text[s.pos] == '\t') {
+		s.pos++
+	}
+}
+
+// value scans a value, inFlow being true inside a flow collection, where the
+// plain scalars end at the indicators of the collections.
+func (s *yamlFlow) value(inFlow bool) (interface{}, error) {
+	s.skipSpaces()
+	if s.pos >= len(s.text) {
+		return nil, nil
+	}
+	switch c := s.text[s.pos]; c {
+	case '[':
+		return s.sequence()
+	case '{':
+		return s.mapping()
+	case '"', '\'':
+		return s.quoted(c)
+	case '&', '*', '!', '|', '>', '@', '`':
+		return nil, fmt.Errorf("unsupported YAML syntax: %q", s.text[s.pos:])
+	}
+
+	start := s.pos
+	for s.pos < len(s.text) {
+		c := s.text[s.pos]
+		if inFlow && (c == ',' || c == ']' || c == '}' || (c == ':' && (s.pos+1 == len(s.text) || s.text[s.pos+1] == ' '))) {
+			break
+		}
+		s.pos++
+	}
+	plain := strings.TrimSpace(s.text[start:s.pos])
+	switch plain {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	}
+	return plain, nil
+}
+
+func (s *yamlFlow) quoted(quote byte) (string, error) {
+	start := s.pos
+	for s.pos++; s.pos < len(s.text); s.pos++ {
+		switch c := s.text[s.pos]; {
+		case quote == '"' && c == '\\':
+			s.pos++
+		case c == quote && quote == '\'' && s.pos+1 < len(s.text) && s.text[s.pos+1] == '\'':
+			// A single quote is escaped by doubling it.
+			s.pos++
+		case c == quote:
+			s.pos++
+			raw := s.text[start:s.pos]
+			if quote == '\'' {
+				return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", fmt.Errorf("invalid string: %s", raw)
+			}
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("unterminated string: %s", s.text[start:])
+}
+
+func (s *yamlFlow) sequence() ([]interface{}, error) {
+	items := []interface{}{}
+	s.pos++
+	for {
+		s.skipSpaces()
+		if s.pos < len(s.text) && s.text[s.pos] == ']' {
+			s.pos++
+			return items, nil
+		}
+		item, err := s.value(true)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if err := s.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *yamlFlow) mapping() (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	s.pos++
+	for {
+		s.skipSpaces()
+		if s.pos < len(s.text) && s.text[s.pos] == '}' {
+			s.pos++
+			return values, nil
+		}
+		key, err := s.value(true)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid key in %q", s.text)
+		}
+		s.skipSpaces()
+		if s.pos >= len(s.text) || s.text[s.pos] != ':' {
+			return nil, fmt.Errorf("expected a colon after %q", name)
+		}
+		s.pos++
+		value, err := s.value(true)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[name]; ok {
+			return nil, fmt.Errorf("duplicate key: %q", name)
+		}
+		values[name] = value
+		if err := s.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator scans the comma between the items of a flow collection, or its
+// end, which is left to be scanned.
+func (s *yamlFlow) separator(end byte) error {
+	s.skipSpaces()
+	switch {
+	case s.pos >= len(s.text):
+		return fmt.Errorf("unterminated collection: %q", s.text)
+	case s.text[s.pos] == ',':
+		s.pos++
+		return nil
+	case s.text[s.pos] == end:
+		return nil
+	}
+	return fmt.Errorf("unexpected content: %q", s.text[s.pos:])
+}
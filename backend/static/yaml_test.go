@@ -0,0 +1,79 @@
+package static
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	for _, tc := range []struct {
+		yaml     string
+		expected string
+	}{
+		{
+			yaml: `
+# The catalog of the cluster.
+repositories:
+  - owner: some-owner # an organization
+    name: some-package
+    tags:
+      - "1.0"
+      - latest
+  - {owner: some-owner, name: 'other-package', tags: [1.0, "v2 # not a comment"]}
+  -
+    owner: some-owner
+    name: empty-package
+    tags: []
+`,
+			expected: `{"repositories": [
+				{"owner": "some-owner", "name": "some-package", "tags": ["1.0", "latest"]},
+				{"owner": "some-owner", "name": "other-package", "tags": ["1.0", "v2 # not a comment"]},
+				{"owner": "some-owner", "name": "empty-package", "tags": []}
+			]}`,
+		},
+		{
+			// The items of a sequence can be aligned with their key.
+			yaml:     "---\nrepositories:\n- owner: some-owner\n  name: \"some\\u002dpackage\"\n  tags: ~\n",
+			expected: `{"repositories": [{"owner": "some-owner", "name": "some-package", "tags": null}]}`,
+		},
+		{
+			yaml:     `{"repositories": [{"owner": "some-owner", "name": "some-package"}]}`,
+			expected: `{"repositories": [{"owner": "some-owner", "name": "some-package"}]}`,
+		},
+		{
+			yaml:     "",
+			expected: "null",
+		},
+	} {
+		actual, err := yamlToJSON([]byte(tc.yaml))
+		if err != nil {
+			t.Errorf("%q: expected no error, got: %s", tc.yaml, err)
+			continue
+		}
+		var actualValue, expectedValue interface{}
+		json.Unmarshal(actual, &actualValue)
+		json.Unmarshal([]byte(tc.expected), &expectedValue)
+		if !reflect.DeepEqual(actualValue, expectedValue) {
+			t.Errorf("%q: expected: %s, got: %s", tc.yaml, tc.expected, actual)
+		}
+	}
+}
+
+func TestYAMLToJSONInvalid(t *testing.T) {
+	for _, yaml := range []string{
+		"repositories:\n  - owner: some-owner\n     name: some-package\n",
+		"repositories:\n\t- owner: some-owner\n",
+		"owner: some-owner\nowner: other-owner\n",
+		"repositories: [{owner: some-owner}\n",
+		"repositories: *packages\n",
+		"name: |\n  some-package\n",
+		"name: 'some-package\n",
+		"owner: some-owner\n---\nowner: other-owner\n",
+		"owner: some-owner\njust a scalar\n",
+	} {
+		if actual, err := yamlToJSON([]byte(yaml)); err == nil {
+			t.Errorf("%q: expected an error, got: %s", yaml, actual)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staleTempFileAge is the age of the temporary files of the cache removed by
+// the garbage collection, which are the leftovers of interrupted downloads
+// since the downloads in progress write to them continuously.
+const staleTempFileAge = time.Hour
+
+// quarantineRetention is how long the corrupted blobs quarantined by the
+// scrubber are kept.
+const quarantineRetention = 7 * 24 * time.Hour
+
+// Blob is a blob of the cache.
+type Blob struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	CachedAt time.Time `json:"cached_at"`
+
+	path string
+}
+
+// List returns the cached blobs, oldest first, without the blobs of the
+// sub-caches.
+func (c *Cache) List() ([]Blob, error) {
+	blobs := []Blob{}
+	err := filepath.WalkDir(filepath.Join(c.dir, "sha256"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		digest := "sha256:" + entry.Name()
+		if entry.IsDir() || !IsCacheableDigest(digest) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		blobs = append(blobs, Blob{Digest: digest, Size: info.Size(), CachedAt: info.ModTime().UTC(), path: path})
+		return nil
+	})
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].CachedAt.Before(blobs[j].CachedAt) })
+	return blobs, err
+}
+
+// Remove removes a blob from the cache.
+func (c *Cache) Remove(digest string) error {
+	if !IsCacheableDigest(digest) {
+		return os.ErrNotExist
+	}
+	return os.Remove(c.Path(digest))
+}
+
+// GC removes the temporary files of the interrupted downloads, the expired
+// quarantined blobs, the blobs cached for longer than maxAge, and then the
+// oldest blobs until the cache is smaller than maxSize. A zero maxAge or
+// maxSize disables the corresponding removal. It returns the number of blobs
+// removed and their size.
+func (c *Cache) GC(maxAge time.Duration, maxSize int64) (int, int64, error) {
+	filepath.WalkDir(filepath.Join(c.dir, "sha256"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleTempFileAge {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if entries, err := os.ReadDir(filepath.Join(c.dir, "quarantine")); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > quarantineRetention {
+				os.Remove(filepath.Join(c.dir, "quarantine", entry.Name()))
+			}
+		}
+	}
+
+	blobs, err := c.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, blob := range blobs {
+		size += blob.Size
+	}
+
+	removed, freed := 0, int64(0)
+	for _, blob := range blobs {
+		expired := maxAge > 0 && time.Since(blob.CachedAt) > maxAge
+		tooLarge := maxSize > 0 && size > maxSize
+		if !expired && !tooLarge {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil {
+			return removed, freed, err
+		}
+		size -= blob.Size
+		removed++
+		freed += blob.Size
+	}
+	return removed, freed, nil
+}
+
+// Verify hashes a cached blob again and compares it with its digest.
+func (c *Cache) Verify(digest string) error {
+	f, _, err := c.Open(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("%w: expected %s, got %s", ErrInvalidDigest, digest, actual)
+	}
+	return nil
+}
+
+// Quarantine moves a blob out of the cache, to the quarantine directory where
+// it can be inspected. The quarantined blobs are removed by the garbage
+// collection after a week.
+func (c *Cache) Quarantine(digest string) (string, error) {
+	dir := filepath.Join(c.dir, "quarantine")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d", strings.TrimPrefix(digest, "sha256:"), time.Now().Unix()))
+	return path, os.Rename(c.Path(digest), path)
+}
@@ -0,0 +1,262 @@
+// Package cache implements the blob cache of the proxy: the blobs stored on
+// disk by digest, verified before being cached, the fetches in progress shared
+// by the requests for the same blob, the garbage collection and the scrubbing
+// of the cached blobs, and the eviction of the oldest blobs when the disk is
+// below its free space watermark. Only sha256 digests are supported.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidDigest is returned when a blob does not match its digest.
+var ErrInvalidDigest = errors.New("digest mismatch")
+
+// Cache stores the blobs on disk, by digest.
+type Cache struct {
+	dir     string
+	flights *flights
+	// MinFree is the free space left on the disk, if any. It must be set
+	// before the cache is used, and is inherited by the sub-caches.
+	MinFree *DiskWatermark
+}
+
+// New returns a cache storing the blobs in dir.
+func New(dir string) *Cache {
+	return &Cache{dir: dir, flights: &flights{flights: map[string]*Flight{}}}
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Sub returns a cache isolated in a sub-directory, e.g. for a virtual
+// registry. The name must be a valid directory name (see IsValidDir).
+func (c *Cache) Sub(name string) *Cache {
+	if !IsValidDir(name) {
+		panic(fmt.Sprintf("invalid blob cache directory: %q", name))
+	}
+	return &Cache{dir: filepath.Join(c.dir, name), flights: c.flights, MinFree: c.MinFree}
+}
+
+// IsValidDir returns whether a name can be used as a sub-directory of the
+// cache, i.e. it cannot escape the directory of the cache.
+func IsValidDir(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// IsCacheableDigest returns true for the sha256 digests.
+func IsCacheableDigest(digest string) bool {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hexDigest)
+	return err == nil
+}
+
+// Path returns the path of a cached blob, whose digest must be cacheable.
+func (c *Cache) Path(digest string) string {
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	return filepath.Join(c.dir, "sha256", hexDigest[:2], hexDigest)
+}
+
+// Open returns a cached blob.
+func (c *Cache) Open(digest string) (*os.File, os.FileInfo, error) {
+	if !IsCacheableDigest(digest) {
+		return nil, nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(c.Path(digest))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+// Has returns true when a blob is cached.
+func (c *Cache) Has(digest string) bool {
+	if !IsCacheableDigest(digest) {
+		return false
+	}
+	_, err := os.Stat(c.Path(digest))
+	return err == nil
+}
+
+// Create returns a writer adding a blob of size bytes (-1 when unknown) to the
+// cache once committed. The writer is attached to the fetch in progress of the
+// blob, if any.
+func (c *Cache) Create(digest string, size int64) (*Writer, error) {
+	if !IsCacheableDigest(digest) {
+		return nil, fmt.Errorf("unsupported digest: %s", digest)
+	}
+	if c.UnderPressure(size) {
+		return nil, ErrDiskPressure
+	}
+
+	path := c.Path(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{file: f, path: path, digest: digest, hash: sha256.New()}
+	if flight := c.flight(digest); flight != nil && flight.start(f.Name(), size) {
+		writer.flight = flight
+	}
+
+	return writer, nil
+}
+
+// Add adds the blob read from r to the cache, e.g. a blob produced by the
+// proxy, and returns its digest and size.
+func (c *Cache) Add(r io.Reader) (string, int64, error) {
+	if c.UnderPressure(-1) {
+		return "", 0, ErrDiskPressure
+	}
+	dir := filepath.Join(c.dir, "sha256")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", 0, err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	path := c.Path(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	return digest, size, os.Rename(f.Name(), path)
+}
+
+// RecordDerived records that a blob added to the cache is derived from a blob
+// of the upstream registry, e.g. a transcoded layer, so that the clients
+// allowed to read the source can read it.
+func (c *Cache) RecordDerived(derived, source string) error {
+	dir := filepath.Join(c.dir, "derived")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, strings.TrimPrefix(derived, "sha256:")), []byte(source), 0o644)
+}
+
+// DerivedSource returns the blob of the upstream registry a blob is derived
+// from.
+func (c *Cache) DerivedSource(digest string) (string, bool) {
+	if !IsCacheableDigest(digest) {
+		return "", false
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, "derived", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil || !IsCacheableDigest(string(data)) {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Writer writes a blob to a temporary file, which is moved to the cache when
+// its digest is verified.
+type Writer struct {
+	file   *os.File
+	path   string
+	digest string
+	hash   hash.Hash
+	flight *Flight
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	w.hash.Write(b)
+	n, err := w.file.Write(b)
+	if w.flight != nil {
+		w.flight.progress(int64(n))
+	}
+	return n, err
+}
+
+// WriteChunk writes n bytes of a blob at offset off, e.g. when the blob is
+// fetched in parallel byte ranges. The chunks are hashed when read with Chunk.
+func (w *Writer) WriteChunk(r io.Reader, off, n int64) error {
+	written, err := io.Copy(io.NewOffsetWriter(w.file, off), io.LimitReader(r, n))
+	if err != nil {
+		return err
+	}
+	if written != n {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Chunk returns a reader of n bytes written at offset off with WriteChunk. The
+// chunks must be read in order for the digest to be verified.
+func (w *Writer) Chunk(off, n int64) io.Reader {
+	return &chunkReader{Reader: io.TeeReader(io.NewSectionReader(w.file, off, n), w.hash), flight: w.flight}
+}
+
+// chunkReader reports the progress of the chunks read in order.
+type chunkReader struct {
+	io.Reader
+	flight *Flight
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if r.flight != nil {
+		r.flight.progress(int64(n))
+	}
+	return n, err
+}
+
+// Commit verifies the digest of the blob and adds it to the cache.
+func (w *Writer) Commit() error {
+	if err := w.file.Close(); err != nil {
+		w.Abort()
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(w.hash.Sum(nil)); actual != w.digest {
+		w.Abort()
+		return fmt.Errorf("%w: expected %s, got %s", ErrInvalidDigest, w.digest, actual)
+	}
+
+	if w.flight != nil {
+		return w.flight.commit(w.file.Name(), w.path)
+	}
+	return os.Rename(w.file.Name(), w.path)
+}
+
+// Abort discards the blob.
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	if w.flight != nil {
+		w.flight.finish("")
+	}
+}
@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fmt"
+)
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestCache(t *testing.T) {
+	content := []byte("some blob")
+	digest := digestOf(content)
+	cache := New(t.TempDir())
+
+	// Blobs not matching their digest are not cached.
+	w, err := cache.Create(digest, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("some blub"))
+	if err := w.Commit(); !errors.Is(err, ErrInvalidDigest) {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidDigest, err)
+	}
+	if cache.Has(digest) {
+		t.Fatal("expected the blob not to be cached")
+	}
+
+	w, err = cache.Create(digest, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	f, info, err := cache.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := io.ReadAll(f); !bytes.Equal(data, content) || info.Size() != int64(len(content)) {
+		t.Fatalf("expected: %s, got: %s", content, data)
+	}
+	if err := cache.Verify(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sub-caches are isolated.
+	if cache.Sub("virtual").Has(digest) {
+		t.Fatal("expected the blob not to be in the sub-cache")
+	}
+}
+
+func TestFlight(t *testing.T) {
+	content := []byte("some blob")
+	digest := digestOf(content)
+	cache := New(t.TempDir())
+
+	flight, leader := cache.StartFlight(digest)
+	if !leader {
+		t.Fatal("expected the leader")
+	}
+	if _, leader := cache.Sub("virtual").StartFlight(digest); !leader {
+		t.Fatal("expected the sub-cache to have its own flights")
+	}
+	if other, leader := cache.StartFlight(digest); leader || other != flight {
+		t.Fatal("expected the flight in progress")
+	}
+
+	w, err := cache.Create(digest, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content[:4])
+	f, size := flight.Open(context.Background())
+	if f == nil || size != int64(len(content)) {
+		t.Fatalf("expected the file of the flight, got: %d", size)
+	}
+	defer f.Close()
+	if written, done, _ := flight.Wait(context.Background(), 0); written != 4 || done {
+		t.Fatalf("expected 4 bytes written, got: %d (done: %t)", written, done)
+	}
+
+	w.Write(content[4:])
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cache.EndFlight(digest, flight)
+	if written, done, cached := flight.Wait(context.Background(), int64(len(content))); written != int64(len(content)) || !done || !cached {
+		t.Fatalf("expected the blob to be cached, got: %d (done: %t, cached: %t)", written, done, cached)
+	}
+	if _, leader := cache.StartFlight(digest); !leader {
+		t.Fatal("expected the flight to be ended")
+	}
+}
+
+func TestIsCacheableDigest(t *testing.T) {
+	for _, tc := range []struct {
+		digest   string
+		expected bool
+	}{
+		{digest: "sha256:" + strings.Repeat("a", 64), expected: true},
+		{digest: "sha256:" + strings.Repeat("g", 64), expected: false},
+		{digest: "sha256:../../etc/passwd", expected: false},
+		{digest: "sha512:" + strings.Repeat("a", 128), expected: false},
+	} {
+		if IsCacheableDigest(tc.digest) != tc.expected {
+			t.Fatalf("%s: expected: %t", tc.digest, tc.expected)
+		}
+	}
+}
+
+func TestIsValidDir(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"team-a":                   true,
+		"hub.internal.example.com": true,
+		"":                         false,
+		".":                        false,
+		"..":                       false,
+		"../team-a":                false,
+		`..\team-a`:                false,
+	} {
+		if IsValidDir(name) != expected {
+			t.Fatalf("%q: expected: %t", name, expected)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	content := []byte("some blob")
+	digest := digestOf(content)
+	dir := t.TempDir()
+	cache := New(dir)
+	os.MkdirAll(filepath.Dir(cache.Path(digest)), 0o755)
+	os.WriteFile(cache.Path(digest), []byte("some blub"), 0o644)
+
+	if err := cache.Verify(digest); !errors.Is(err, ErrInvalidDigest) {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidDigest, err)
+	}
+	path, err := cache.Quarantine(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Has(digest) || filepath.Dir(path) != filepath.Join(dir, "quarantine") {
+		t.Fatalf("expected the blob to be quarantined, got: %s", path)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	digest := digestOf([]byte("some blob"))
+	cache := New(t.TempDir())
+
+	if cache.InRepository(digest, "some-owner/a") {
+		t.Fatal("expected no repository")
+	}
+	for i := 0; i < 2; i++ {
+		if err := cache.RecordRepository(digest, "some-owner/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cache.InRepository(digest, "some-owner/a") || cache.InRepository(digest, "some-owner/b") || cache.InRepository(digest, "some-owner") {
+		t.Fatal("expected the blob to only belong to some-owner/a")
+	}
+
+	// The oldest repositories are dropped.
+	for i := 0; i < maxRecordedRepositories; i++ {
+		if err := cache.RecordRepository(digest, fmt.Sprintf("some-owner/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.InRepository(digest, "some-owner/a") || !cache.InRepository(digest, fmt.Sprintf("some-owner/%d", maxRecordedRepositories-1)) {
+		t.Fatal("expected the oldest repositories to be dropped")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cache
+
+import "errors"
+
+// DiskUsage is not supported on this platform.
+func DiskUsage(path string) (used, total uint64, err error) {
+	return 0, 0, errors.New("disk usage not supported")
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package cache
+
+import "syscall"
+
+// DiskUsage returns the used and total bytes of the file system of a path.
+func DiskUsage(path string) (used, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	total = uint64(stat.Blocks) * uint64(stat.Bsize)
+	available := uint64(stat.Bavail) * uint64(stat.Bsize)
+	return total - available, total, nil
+}
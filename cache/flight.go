@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// Flight is the fetch of a blob in progress. The requests for the same blob
+// wait for it and stream the blob from the temporary file of the cache while
+// it is written, instead of fetching it again from the upstream registry.
+type Flight struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// file is the temporary file of the blob, set when the fetch starts.
+	file string
+	// size is the size of the blob, or -1 when it is unknown.
+	size int64
+	// written is the number of bytes available from the start of file.
+	written int64
+	done    bool
+	// path is the path of the blob in the cache once committed.
+	path string
+}
+
+func newFlight() *Flight {
+	flight := &Flight{size: -1}
+	flight.cond = sync.NewCond(&flight.mu)
+	return flight
+}
+
+// start returns false when the fetch already started, i.e. when another
+// writer is attached to the flight.
+func (f *Flight) start(file string, size int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != "" || f.done {
+		return false
+	}
+	f.file = file
+	f.size = size
+	f.cond.Broadcast()
+	return true
+}
+
+func (f *Flight) progress(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written += n
+	f.cond.Broadcast()
+}
+
+// commit moves the temporary file to the cache and ends the flight. The file
+// is renamed under the lock so that the waiting requests open either file.
+func (f *Flight) commit(file, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.Rename(file, path)
+	f.done = true
+	if err == nil {
+		f.path = path
+	}
+	f.cond.Broadcast()
+	return err
+}
+
+// finish ends the flight. path is empty when the blob was not cached.
+func (f *Flight) finish(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	f.done = true
+	f.path = path
+	f.cond.Broadcast()
+}
+
+// Wake wakes up the waits of Open and Wait, e.g. when ctx is done.
+func (f *Flight) Wake() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// Open waits for the fetch to start and opens its file, and returns the size
+// of the blob (-1 when unknown). It returns nil when the fetch failed before
+// writing anything or when ctx is done, in which case the wait must be woken
+// up with Wake.
+func (f *Flight) Open(ctx context.Context) (*os.File, int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.file == "" && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+
+	file := f.file
+	if f.done {
+		// The temporary file no longer exists.
+		file = f.path
+	}
+	if file == "" || ctx.Err() != nil {
+		return nil, 0
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, 0
+	}
+	return fd, f.size
+}
+
+// Wait waits for more than offset bytes to be written, for the fetch to end or
+// for ctx to be done, like Open. It returns the bytes written, whether the
+// fetch ended, and whether the blob was cached.
+func (f *Flight) Wait(ctx context.Context, offset int64) (written int64, done, cached bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.written <= offset && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	return f.written, f.done, f.path != ""
+}
+
+// WaitDone waits for the fetch to end.
+func (f *Flight) WaitDone() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for !f.done {
+		f.cond.Wait()
+	}
+}
+
+// flights are the fetches in progress, by path in the cache. They are shared
+// by the sub-caches.
+type flights struct {
+	mu      sync.Mutex
+	flights map[string]*Flight
+}
+
+// StartFlight returns the fetch in progress of a blob, and whether the caller
+// is the leader who must fetch it and then call EndFlight.
+func (c *Cache) StartFlight(digest string) (*Flight, bool) {
+	path := c.Path(digest)
+
+	c.flights.mu.Lock()
+	defer c.flights.mu.Unlock()
+
+	if flight, ok := c.flights.flights[path]; ok {
+		return flight, false
+	}
+	flight := newFlight()
+	c.flights.flights[path] = flight
+	return flight, true
+}
+
+// EndFlight ends a fetch, which failed unless the blob was committed.
+func (c *Cache) EndFlight(digest string, flight *Flight) {
+	path := c.Path(digest)
+
+	c.flights.mu.Lock()
+	defer c.flights.mu.Unlock()
+
+	flight.finish("")
+	if c.flights.flights[path] == flight {
+		delete(c.flights.flights, path)
+	}
+}
+
+// flight returns the fetch in progress of a blob, if any.
+func (c *Cache) flight(digest string) *Flight {
+	c.flights.mu.Lock()
+	defer c.flights.mu.Unlock()
+	return c.flights.flights[c.Path(digest)]
+}
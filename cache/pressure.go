@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrDiskPressure is returned when a blob is not cached because the disk of
+// the cache is (or would be) below its free space watermark.
+var ErrDiskPressure = errors.New("not enough free space for the blob cache")
+
+// DiskWatermark is the minimum free space of the disk of the cache, in bytes
+// or as a percentage of the disk.
+type DiskWatermark struct {
+	Bytes   uint64
+	Percent float64
+}
+
+// bytes returns the watermark of a disk of total bytes.
+func (m *DiskWatermark) bytes(total uint64) uint64 {
+	if m.Percent > 0 {
+		return uint64(m.Percent / 100 * float64(total))
+	}
+	return m.Bytes
+}
+
+// freeSpace returns the free bytes of the disk of the cache and its watermark.
+func (c *Cache) freeSpace() (free, watermark uint64, err error) {
+	used, total, err := DiskUsage(c.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	return total - used, c.MinFree.bytes(total), nil
+}
+
+// UnderPressure returns whether adding size more bytes (-1 when unknown) would
+// leave less free space on the disk than the watermark. The cache is not under
+// pressure when the free space is unknown.
+func (c *Cache) UnderPressure(size int64) bool {
+	if c.MinFree == nil {
+		return false
+	}
+	free, watermark, err := c.freeSpace()
+	if err != nil {
+		return false
+	}
+	if size > 0 {
+		watermark += uint64(size)
+	}
+	return free < watermark
+}
+
+// evict removes the quarantined blobs and then the oldest cached blobs, of the
+// sub-caches too, until need bytes are freed. It returns the number of blobs
+// removed and the bytes freed.
+func (c *Cache) evict(need uint64) (int, uint64) {
+	var blobs []Blob
+	if entries, err := os.ReadDir(filepath.Join(c.dir, "quarantine")); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				blobs = append(blobs, Blob{Size: info.Size(), path: filepath.Join(c.dir, "quarantine", entry.Name())})
+			}
+		}
+	}
+	var cached []Blob
+	if list, err := c.List(); err == nil {
+		cached = append(cached, list...)
+	}
+	if entries, err := os.ReadDir(c.dir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() || entry.Name() == "sha256" || entry.Name() == "quarantine" || !IsValidDir(entry.Name()) {
+				continue
+			}
+			if list, err := c.Sub(entry.Name()).List(); err == nil {
+				cached = append(cached, list...)
+			}
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].CachedAt.Before(cached[j].CachedAt) })
+	blobs = append(blobs, cached...)
+
+	removed, freed := 0, uint64(0)
+	for _, blob := range blobs {
+		if freed >= need {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil {
+			continue
+		}
+		removed++
+		freed += uint64(blob.Size)
+	}
+	return removed, freed
+}
+
+// CheckDiskPressure evicts blobs when the free space of the disk is below the
+// watermark. It returns the number of blobs evicted, the bytes freed, and
+// whether the disk is still below the watermark.
+func (c *Cache) CheckDiskPressure() (removed int, freed uint64, pressure bool) {
+	if c.MinFree == nil {
+		return 0, 0, false
+	}
+	free, watermark, err := c.freeSpace()
+	if err != nil || free >= watermark {
+		return 0, 0, false
+	}
+	// Free 10% more than the watermark so as not to evict again at the next
+	// check.
+	need := watermark - free + watermark/10
+	removed, freed = c.evict(need)
+	return removed, freed, freed < watermark-free
+}
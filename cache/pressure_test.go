@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskWatermark(t *testing.T) {
+	if (&DiskWatermark{Percent: 10}).bytes(1000) != 100 {
+		t.Fatal("expected 10% of the disk")
+	}
+	if (&DiskWatermark{Bytes: 10}).bytes(1000) != 10 {
+		t.Fatal("expected 10 bytes")
+	}
+}
+
+func TestDiskPressure(t *testing.T) {
+	content := []byte("some blob")
+	digest := digestOf(content)
+	dir := t.TempDir()
+	if _, _, err := DiskUsage(dir); err != nil {
+		t.Skip(err)
+	}
+
+	cache := New(dir)
+	cache.MinFree = &DiskWatermark{Percent: 99.999}
+	if _, err := cache.Create(digest, int64(len(content))); !errors.Is(err, ErrDiskPressure) {
+		t.Fatalf("expected: %v, got: %v", ErrDiskPressure, err)
+	}
+	if _, _, err := cache.Add(bytes.NewReader(content)); !errors.Is(err, ErrDiskPressure) {
+		t.Fatalf("expected: %v, got: %v", ErrDiskPressure, err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	dir := t.TempDir()
+	cache := New(dir)
+
+	var digests []string
+	for i, c := range []*Cache{cache, cache.Sub("virtual"), cache} {
+		content := []byte{byte('a' + i)}
+		digest := digestOf(content)
+		w, err := c.Create(digest, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		cachedAt := time.Now().Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(c.Path(digest), cachedAt, cachedAt)
+		digests = append(digests, digest)
+	}
+	os.MkdirAll(filepath.Join(dir, "quarantine"), 0o755)
+	os.WriteFile(filepath.Join(dir, "quarantine", "some-blob"), []byte("x"), 0o644)
+
+	// The quarantined blob is evicted first, then the oldest blobs.
+	if removed, freed := cache.evict(3); removed != 3 || freed != 3 {
+		t.Fatalf("expected 3 blobs evicted, got: %d (%d bytes)", removed, freed)
+	}
+	if cache.Has(digests[0]) || cache.Sub("virtual").Has(digests[1]) || !cache.Has(digests[2]) {
+		t.Fatal("expected the oldest blobs to be evicted")
+	}
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxRecordedRepositories limits the number of repositories recorded for a
+// blob, the oldest ones being dropped, since they are recorded with the
+// credentials of the clients when the proxy does not authenticate them.
+const maxRecordedRepositories = 1000
+
+// repositoriesPath returns the path of the file listing the repositories of a
+// cached blob.
+func (c *Cache) repositoriesPath(digest string) string {
+	return filepath.Join(c.dir, "repositories", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// RecordRepository records that a blob belongs to a repository, e.g. once the
+// upstream registry served it for the repository. The cache is keyed by
+// digest, so a blob cached for a repository must not be served for another
+// one the client cannot read.
+func (c *Cache) RecordRepository(digest, repository string) error {
+	if !IsCacheableDigest(digest) || c.InRepository(digest, repository) {
+		return nil
+	}
+	dir := filepath.Join(c.dir, "repositories")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(c.repositoriesPath(digest)); err == nil {
+		if names := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(names) >= maxRecordedRepositories {
+			kept := strings.Join(names[len(names)-maxRecordedRepositories/2:], "\n") + "\n"
+			if err := os.WriteFile(c.repositoriesPath(digest), []byte(kept), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	f, err := os.OpenFile(c.repositoriesPath(digest), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(repository + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// InRepository returns whether a blob was recorded for a repository.
+func (c *Cache) InRepository(digest, repository string) bool {
+	if !IsCacheableDigest(digest) {
+		return false
+	}
+	data, err := os.ReadFile(c.repositoriesPath(digest))
+	if err != nil {
+		return false
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name == repository {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,388 @@
+// Package fakeghcr implements a fake of the GitHub Container Registry for the
+// tests of the proxy and of its backends: a GitHub REST API server listing the
+// container packages and their versions, and a registry serving their images
+// with the Docker Registry HTTP API V2. The images are added with AddImage and
+// kept in memory.
+package fakeghcr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/v50/github"
+)
+
+// The media types of the images added with AddImage.
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// Descriptor is an OCI content descriptor.
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Manifest is an OCI image manifest.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Digest returns the sha256 digest of some content.
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+type packageVersion struct {
+	id        int64
+	digest    string
+	tags      []string
+	createdAt time.Time
+}
+
+type containerPackage struct {
+	id         int64
+	owner      string
+	name       string
+	visibility string
+	versions   []*packageVersion
+}
+
+// Server is a fake GHCR.
+type Server struct {
+	// API is the GitHub REST API server.
+	API *httptest.Server
+	// Registry is the registry server, i.e. the upstream registry of the
+	// proxy.
+	Registry *httptest.Server
+
+	mu        sync.Mutex
+	nextID    int64
+	packages  map[string]*containerPackage
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	requests  []string
+}
+
+// New starts a fake GHCR, which must be closed with Close.
+func New() *Server {
+	s := &Server{
+		packages:  map[string]*containerPackage{},
+		manifests: map[string][]byte{},
+		blobs:     map[string][]byte{},
+	}
+	s.API = httptest.NewServer(http.HandlerFunc(s.serveAPI))
+	s.Registry = httptest.NewServer(http.HandlerFunc(s.serveRegistry))
+	return s
+}
+
+// Close stops the servers.
+func (s *Server) Close() {
+	s.API.Close()
+	s.Registry.Close()
+}
+
+// GitHubClient returns a GitHub REST API client of the API server.
+func (s *Server) GitHubClient() *gh.Client {
+	client := gh.NewClient(s.API.Client())
+	client.BaseURL, _ = url.Parse(s.API.URL + "/")
+	return client
+}
+
+// AddImage adds an image to the package owner/name, with a layer for each
+// content and the given tags, which are removed from the other versions of the
+// package. The package is created, with a private visibility, if needed. It
+// returns the digest of the manifest of the image.
+func (s *Server) AddImage(owner, name string, tags []string, layers ...[]byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	diffIDs := []string{}
+	manifest := Manifest{SchemaVersion: 2, MediaType: MediaTypeManifest, Layers: []Descriptor{}}
+	for _, layer := range layers {
+		digest := Digest(layer)
+		s.blobs[digest] = layer
+		diffIDs = append(diffIDs, digest)
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeLayer, Digest: digest, Size: int64(len(layer))})
+	}
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	s.blobs[Digest(config)] = config
+	manifest.Config = Descriptor{MediaType: MediaTypeConfig, Digest: Digest(config), Size: int64(len(config))}
+
+	body, _ := json.Marshal(manifest)
+	digest := Digest(body)
+	s.manifests[digest] = body
+
+	pack, ok := s.packages[owner+"/"+name]
+	if !ok {
+		s.nextID++
+		pack = &containerPackage{id: s.nextID, owner: owner, name: name, visibility: "private"}
+		s.packages[owner+"/"+name] = pack
+	}
+	for _, version := range pack.versions {
+		version.tags = removeTags(version.tags, tags)
+	}
+	s.nextID++
+	pack.versions = append([]*packageVersion{{
+		id:        s.nextID,
+		digest:    digest,
+		tags:      append([]string{}, tags...),
+		createdAt: time.Now().UTC().Truncate(time.Second),
+	}}, pack.versions...)
+
+	return digest
+}
+
+// SetVisibility changes the visibility of a package (public, private or
+// internal).
+func (s *Server) SetVisibility(owner, name, visibility string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pack, ok := s.packages[owner+"/"+name]; ok {
+		pack.visibility = visibility
+	}
+}
+
+// Requests returns the requests received by the registry, e.g.
+// `GET /v2/owner/name/blobs/sha256:...`.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func removeTags(tags, removed []string) []string {
+	kept := []string{}
+	for _, tag := range tags {
+		found := false
+		for _, r := range removed {
+			found = found || tag == r
+		}
+		if !found {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) githubPackage(pack *containerPackage) *gh.Package {
+	return &gh.Package{
+		ID:           gh.Int64(pack.id),
+		Name:         gh.String(pack.name),
+		PackageType:  gh.String("container"),
+		Owner:        &gh.User{Login: gh.String(pack.owner)},
+		Visibility:   gh.String(pack.visibility),
+		VersionCount: gh.Int64(int64(len(pack.versions))),
+	}
+}
+
+// serveAPI implements the package endpoints of the GitHub REST API used by
+// the GitHub backend, for the authenticated user (`/user/packages`, listing
+// all the packages) and for the users (`/users/{user}/packages`).
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var owner string
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, "/user/packages"):
+		path = strings.TrimPrefix(path, "/user/packages")
+	case strings.HasPrefix(path, "/users/"):
+		owner, path, _ = strings.Cut(strings.TrimPrefix(path, "/users/"), "/")
+		if !strings.HasPrefix(path, "packages") {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+			return
+		}
+		path = strings.TrimPrefix(path, "packages")
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+		return
+	}
+
+	// e.g. ["", "container", "app", "versions", "123"]
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i], _ = url.PathUnescape(segments[i])
+	}
+
+	if len(segments) == 1 && r.Method == "GET" {
+		packages := []*gh.Package{}
+		for _, pack := range s.packages {
+			if owner != "" && pack.owner != owner {
+				continue
+			}
+			if packageType := r.URL.Query().Get("package_type"); packageType != "" && packageType != "container" {
+				continue
+			}
+			if visibility := r.URL.Query().Get("visibility"); visibility != "" && visibility != pack.visibility {
+				continue
+			}
+			packages = append(packages, s.githubPackage(pack))
+		}
+		sort.Slice(packages, func(i, j int) bool { return packages[i].GetID() < packages[j].GetID() })
+		writeJSON(w, http.StatusOK, packages)
+		return
+	}
+
+	if len(segments) < 3 || segments[1] != "container" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Package not found."})
+		return
+	}
+	var pack *containerPackage
+	for _, p := range s.packages {
+		if p.name == segments[2] && (owner == "" || p.owner == owner) {
+			pack = p
+			break
+		}
+	}
+	if pack == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Package not found."})
+		return
+	}
+
+	switch {
+	case len(segments) == 3 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, s.githubPackage(pack))
+
+	case len(segments) == 4 && segments[3] == "versions" && r.Method == "GET":
+		versions := []*gh.PackageVersion{}
+		for _, version := range pack.versions {
+			versions = append(versions, &gh.PackageVersion{
+				ID:        gh.Int64(version.id),
+				Name:      gh.String(version.digest),
+				CreatedAt: &gh.Timestamp{Time: version.createdAt},
+				UpdatedAt: &gh.Timestamp{Time: version.createdAt},
+				Metadata: &gh.PackageMetadata{
+					PackageType: gh.String("container"),
+					Container:   &gh.PackageContainerMetadata{Tags: version.tags},
+				},
+			})
+		}
+		writeJSON(w, http.StatusOK, versions)
+
+	case len(segments) == 5 && segments[3] == "versions" && r.Method == "DELETE":
+		id, _ := strconv.ParseInt(segments[4], 10, 64)
+		for i, version := range pack.versions {
+			if version.id == id {
+				pack.versions = append(pack.versions[:i], pack.versions[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Package version not found."})
+
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	}
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// serveRegistry implements the pull endpoints of the Docker Registry HTTP API
+// V2.
+func (s *Server) serveRegistry(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	for _, kind := range []string{"manifests", "blobs", "tags"} {
+		name, reference, ok := strings.Cut(path, "/"+kind+"/")
+		if !ok {
+			continue
+		}
+		pack, ok := s.packages[name]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+
+		switch kind {
+		case "manifests":
+			digest := reference
+			for _, version := range pack.versions {
+				for _, tag := range version.tags {
+					if tag == reference {
+						digest = version.digest
+					}
+				}
+			}
+			body, ok := s.manifests[digest]
+			if !ok {
+				writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+				return
+			}
+			w.Header().Set("Content-Type", MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if r.Method == "GET" {
+				w.Write(body)
+			}
+
+		case "blobs":
+			blob, ok := s.blobs[reference]
+			if !ok {
+				writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Docker-Content-Digest", reference)
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			if r.Method == "GET" {
+				w.Write(blob)
+			}
+
+		case "tags":
+			tags := []string{}
+			for _, version := range pack.versions {
+				tags = append(tags, version.tags...)
+			}
+			sort.Strings(tags)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "tags": tags})
+		}
+		return
+	}
+
+	writeRegistryError(w, http.StatusNotFound, "UNSUPPORTED", fmt.Sprintf("unsupported path: %s", r.URL.Path))
+}
@@ -0,0 +1,95 @@
+package fakeghcr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Image is an image pulled from a registry.
+type Image struct {
+	Digest   string
+	Manifest Manifest
+	Config   []byte
+	Layers   [][]byte
+}
+
+// Pull pulls an image from a registry like a container runtime: it fetches its
+// manifest, then its config and its layers, and verifies their digests. Only
+// the single-platform OCI and Docker image manifests are supported.
+//
+// The pulls are not made with go-containerregistry, which is not a dependency
+// of the module: Pull sends the requests of a container runtime pulling these
+// manifests, and can be replaced with it in the tests of a module using it.
+func Pull(ctx context.Context, client *http.Client, registryURL, name, reference string) (*Image, error) {
+	baseURL := strings.TrimSuffix(registryURL, "/") + "/v2/" + name
+
+	manifest, digest, err := fetch(ctx, client, baseURL+"/manifests/"+reference, "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return nil, err
+	}
+	if digest != "" && digest != Digest(manifest) {
+		return nil, fmt.Errorf("manifest %s:%s: digest mismatch: expected %s, got %s", name, reference, digest, Digest(manifest))
+	}
+	if strings.HasPrefix(reference, "sha256:") && reference != Digest(manifest) {
+		return nil, fmt.Errorf("manifest %s@%s: digest mismatch: got %s", name, reference, Digest(manifest))
+	}
+
+	image := &Image{Digest: Digest(manifest)}
+	if err := json.Unmarshal(manifest, &image.Manifest); err != nil {
+		return nil, fmt.Errorf("manifest %s:%s: %w", name, reference, err)
+	}
+	if image.Manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest %s:%s: not an image manifest", name, reference)
+	}
+
+	fetchBlob := func(descriptor Descriptor) ([]byte, error) {
+		blob, _, err := fetch(ctx, client, baseURL+"/blobs/"+descriptor.Digest, "")
+		if err != nil {
+			return nil, err
+		}
+		if Digest(blob) != descriptor.Digest || int64(len(blob)) != descriptor.Size {
+			return nil, fmt.Errorf("blob %s: digest or size mismatch", descriptor.Digest)
+		}
+		return blob, nil
+	}
+	if image.Config, err = fetchBlob(image.Manifest.Config); err != nil {
+		return nil, err
+	}
+	for _, layer := range image.Manifest.Layers {
+		blob, err := fetchBlob(layer)
+		if err != nil {
+			return nil, err
+		}
+		image.Layers = append(image.Layers, blob)
+	}
+	return image, nil
+}
+
+// fetch returns the body of a registry response and its digest.
+func fetch(ctx context.Context, client *http.Client, u, accept string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s: %s: %s", req.URL.Path, res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, res.Header.Get("Docker-Content-Digest"), nil
+}
@@ -0,0 +1,344 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// minCompactionSize is the size of the journal above which it is compacted,
+// unless the snapshot is larger.
+const minCompactionSize = 1 << 20
+
+// The operations of the journal.
+const (
+	opRepository      = "repository"
+	opAuditEvent      = "audit_event"
+	opJobRun          = "job_run"
+	opUsage           = "usage"
+	opAPIKey          = "api_key"
+	opCatalogPins     = "catalog_pins"
+	opFavorites       = "favorites"
+	opCatalogSnapshot = "catalog_snapshot"
+)
+
+// journalEntry is a change of the database appended to the journal. The
+// records (e.g. a repository) are written whole, null when deleted, and the
+// events (e.g. an audit event) are appended to their list.
+type journalEntry struct {
+	Sequence int64  `json:"seq"`
+	Op       string `json:"op"`
+	// Key is the name of the record: the repository, the ID of the API key,
+	// the user of the favorites or the month of the usage.
+	Key string `json:"key,omitempty"`
+	// Namespace is the namespace of the usage.
+	Namespace string          `json:"namespace,omitempty"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// usageKey identifies the usage of a namespace during a month.
+type usageKey struct {
+	month     string
+	namespace string
+}
+
+// journalPath returns the path of the journal of the database at path.
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// apply applies an entry of the journal to the database.
+func (db *database) apply(entry journalEntry) error {
+	switch entry.Op {
+	case opRepository:
+		var repository *Repository
+		if err := json.Unmarshal(entry.Value, &repository); err != nil {
+			return err
+		}
+		if repository == nil {
+			delete(db.Repositories, entry.Key)
+		} else {
+			db.Repositories[entry.Key] = repository
+		}
+	case opAuditEvent:
+		var event AuditEvent
+		if err := json.Unmarshal(entry.Value, &event); err != nil {
+			return err
+		}
+		db.appendAuditEvent(event)
+	case opJobRun:
+		var run JobRun
+		if err := json.Unmarshal(entry.Value, &run); err != nil {
+			return err
+		}
+		db.appendJobRun(run)
+	case opUsage:
+		var usage Usage
+		if err := json.Unmarshal(entry.Value, &usage); err != nil {
+			return err
+		}
+		db.usageMonth(entry.Key)[entry.Namespace] = &usage
+	case opAPIKey:
+		var key *APIKey
+		if err := json.Unmarshal(entry.Value, &key); err != nil {
+			return err
+		}
+		if key == nil {
+			delete(db.APIKeys, entry.Key)
+		} else {
+			db.APIKeys[entry.Key] = key
+		}
+	case opCatalogPins:
+		var pins []string
+		if err := json.Unmarshal(entry.Value, &pins); err != nil {
+			return err
+		}
+		db.CatalogPins = append([]string{}, pins...)
+	case opFavorites:
+		var favorites []string
+		if err := json.Unmarshal(entry.Value, &favorites); err != nil {
+			return err
+		}
+		if len(favorites) == 0 {
+			delete(db.Favorites, entry.Key)
+		} else {
+			db.Favorites[entry.Key] = favorites
+		}
+	case opCatalogSnapshot:
+		var snapshot CatalogSnapshot
+		if err := json.Unmarshal(entry.Value, &snapshot); err != nil {
+			return err
+		}
+		db.appendCatalogSnapshot(snapshot)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+	db.Sequence = entry.Sequence
+	return nil
+}
+
+// replay applies the entries of the journal newer than the snapshot, and
+// returns the size of the journal without its last entry when it was torn by
+// a crash.
+func (s *Store) replay() (int64, error) {
+	f, err := os.Open(journalPath(s.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(data) > 0 {
+				log.Printf("WARN metadata journal %s: ignoring the torn entry at line %d", journalPath(s.path), line)
+			}
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return 0, fmt.Errorf("invalid metadata journal %s at line %d: %w", journalPath(s.path), line, err)
+		}
+		// The entries older than the snapshot are left by a compaction
+		// interrupted before the journal was truncated.
+		if entry.Sequence > s.db.Sequence {
+			if err := s.db.apply(entry); err != nil {
+				return 0, fmt.Errorf("invalid metadata journal %s at line %d: %w", journalPath(s.path), line, err)
+			}
+		}
+		size += int64(len(data))
+	}
+}
+
+// openJournal opens the journal for appending, truncated at size.
+func (s *Store) openJournal(size int64) error {
+	f, err := os.OpenFile(journalPath(s.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	s.journal = f
+	s.journalSize = size
+	return nil
+}
+
+// record queues an entry of the journal, written by the next sync. The lock
+// must be held.
+func (s *Store) record(entry journalEntry, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.db.Sequence++
+	entry.Sequence = s.db.Sequence
+	entry.Value = data
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, append(line, '\n'))
+	return nil
+}
+
+// recordChanges queues the records changed since the last flush. The lock
+// must be held.
+func (s *Store) recordChanges() error {
+	for name := range s.changedRepositories {
+		if err := s.recordRepository(name); err != nil {
+			return err
+		}
+	}
+	for id := range s.changedAPIKeys {
+		if err := s.record(journalEntry{Op: opAPIKey, Key: id}, s.db.APIKeys[id]); err != nil {
+			return err
+		}
+		delete(s.changedAPIKeys, id)
+	}
+	for key := range s.changedUsage {
+		if usage, ok := s.db.Usage[key.month][key.namespace]; ok {
+			if err := s.record(journalEntry{Op: opUsage, Key: key.month, Namespace: key.namespace}, usage); err != nil {
+				return err
+			}
+		}
+		delete(s.changedUsage, key)
+	}
+	return nil
+}
+
+// recordRepository queues a repository. The lock must be held.
+func (s *Store) recordRepository(name string) error {
+	if err := s.record(journalEntry{Op: opRepository, Key: name}, s.db.Repositories[name]); err != nil {
+		return err
+	}
+	delete(s.changedRepositories, name)
+	return nil
+}
+
+// sync appends the queued entries to the journal and waits for them to be on
+// disk. The journal is written without holding the lock of the database, the
+// entries queued meanwhile being written by the next sync.
+func (s *Store) sync() error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	data := bytes.Join(pending, nil)
+	_, err := s.journal.Write(data)
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		// The entries are written again by the next sync, without the
+		// part written by this one.
+		s.journal.Truncate(s.journalSize)
+		s.mu.Lock()
+		s.pending = append(pending, s.pending...)
+		s.mu.Unlock()
+		return err
+	}
+	s.journalSize += int64(len(data))
+	return nil
+}
+
+// compact writes a snapshot of the database and truncates the journal when it
+// is larger than the snapshot and than minCompactionSize, or always when force
+// is true.
+func (s *Store) compact(force bool) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	if !force && (s.journalSize <= minCompactionSize || s.journalSize <= s.snapshotSize) {
+		return nil
+	}
+
+	// The snapshot includes the queued entries and the changed records.
+	s.mu.Lock()
+	data, err := json.Marshal(s.db)
+	if err == nil {
+		s.pending = nil
+		s.changedRepositories = map[string]bool{}
+		s.changedAPIKeys = map[string]bool{}
+		s.changedUsage = map[usageKey]bool{}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(s.path, data); err != nil {
+		return err
+	}
+	s.snapshotSize = int64(len(data))
+
+	// A crash before the truncation leaves the entries already in the
+	// snapshot, skipped by their sequence number.
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		return err
+	}
+	s.journalSize = 0
+	return nil
+}
+
+// writeFile writes a file atomically and durably.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".metadata-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// The rename is durable once the directory is synced.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,980 @@
+// Package metadata implements the persistent metadata database of the proxy:
+// the repositories, tags and digests seen by the proxy, the history of the
+// tags, their pull statistics, the scan results and provenance verifications,
+// the audit events, the history of the background jobs, the usage of the
+// namespaces, the API keys and the snapshots of the catalog. The database is
+// loaded in memory from a JSON snapshot, whose schema is upgraded with
+// migrations when the proxy starts, and from a journal of the later changes.
+// The changes are appended to the journal, and synced to disk, periodically
+// or right away for the administrative ones, and the journal is compacted
+// into a new snapshot when it grows larger than the snapshot.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAuditEvents is the number of audit events kept in the database, the
+	// oldest ones are dropped.
+	maxAuditEvents = 10000
+	// maxJobRuns is the number of runs kept in the database for each job.
+	maxJobRuns = 100
+	// maxUsageMonths is the number of months of usage kept in the database.
+	maxUsageMonths = 12
+	// maxTagHistory is the number of changes kept in the history of each tag.
+	maxTagHistory = 100
+	// maxCatalogSnapshots is the number of snapshots kept in the database for
+	// each catalog.
+	maxCatalogSnapshots = 200
+)
+
+// Repository is a repository seen by the proxy.
+type Repository struct {
+	Name string `json:"name"`
+	// Tags are the digests of the tags.
+	Tags    map[string]string  `json:"tags"`
+	Digests map[string]*Digest `json:"digests"`
+	// Pins are the digests of the immutable tags when they were first seen.
+	Pins map[string]string `json:"pins,omitempty"`
+	// History are the changes of the tags, oldest first, by tag.
+	History map[string][]TagChange `json:"history,omitempty"`
+
+	Pulls        int64     `json:"pulls"`
+	LastPulledAt time.Time `json:"last_pulled_at,omitempty"`
+}
+
+// TagChange is a change of the digest of a tag observed by the proxy.
+type TagChange struct {
+	// Digest is empty when the tag was deleted.
+	Digest     string    `json:"digest,omitempty"`
+	ObservedAt time.Time `json:"observed_at"`
+	// Source is how the change was observed: `pull`, `push`, `webhook` or
+	// `delete`.
+	Source string `json:"source"`
+}
+
+// Digest is a manifest of a repository.
+type Digest struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+
+	FirstSeenAt  time.Time `json:"first_seen_at"`
+	Pulls        int64     `json:"pulls"`
+	LastPulledAt time.Time `json:"last_pulled_at,omitempty"`
+
+	Scan       *ScanResult       `json:"scan,omitempty"`
+	Provenance *ProvenanceResult `json:"provenance,omitempty"`
+}
+
+// ScanResult is the result of the vulnerability scan of a digest.
+type ScanResult struct {
+	Scanner   string    `json:"scanner"`
+	Status    string    `json:"status"`
+	ScannedAt time.Time `json:"scanned_at"`
+	// Findings are the number of findings by severity.
+	Findings map[string]int `json:"findings,omitempty"`
+}
+
+// ProvenanceResult is the result of the verification of the provenance
+// attestations of a digest.
+type ProvenanceResult struct {
+	// Status is `verified`, `failed` or `missing` (no attestation).
+	Status     string    `json:"status"`
+	VerifiedAt time.Time `json:"verified_at"`
+	// Builder and SourceRepository are the builder identity and the source
+	// repository of the attestation satisfying the policy.
+	Builder          string `json:"builder,omitempty"`
+	SourceRepository string `json:"source_repository,omitempty"`
+	// Signed is true when the signature of the attestation was verified.
+	Signed bool `json:"signed,omitempty"`
+	// Index is the digest of the verified index whose result is inherited
+	// by the manifests of its platforms.
+	Index string `json:"index,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditEvent is an administrative action.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target"`
+	Details string    `json:"details,omitempty"`
+}
+
+// JobRun is a run of a background job.
+type JobRun struct {
+	Job        string    `json:"job"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+	// Outcomes are the results of the job by target, e.g. by image, either
+	// "ok" or an error message.
+	Outcomes map[string]string `json:"outcomes,omitempty"`
+}
+
+// Usage is the usage of a namespace during a month.
+type Usage struct {
+	// Bytes is the number of bytes served.
+	Bytes int64 `json:"bytes"`
+	// Pulls is the number of manifests pulled.
+	Pulls int64 `json:"pulls"`
+}
+
+// APIKey is a key authenticating a machine client. Only the hash of the key
+// is stored.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex-encoded SHA-256 of the key.
+	Hash string `json:"hash"`
+	// Scopes are the repositories and actions granted to the key, e.g.
+	// `my-org/*:pull`.
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests allowed per minute, unlimited when
+	// zero.
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// CatalogSnapshot is the content of a catalog at a time.
+type CatalogSnapshot struct {
+	// Catalog is the prefix of the virtual registry of the catalog, empty for
+	// the main one.
+	Catalog string    `json:"catalog,omitempty"`
+	Time    time.Time `json:"time"`
+	// Tags are the sorted tags of the repositories, by repository.
+	Tags map[string][]string `json:"tags"`
+}
+
+// Pull describes a manifest pulled through the proxy.
+type Pull struct {
+	Repository string
+	// Tag is empty when the manifest is pulled by digest.
+	Tag       string
+	Digest    string
+	MediaType string
+	Size      int64
+	Time      time.Time
+}
+
+// database is the content of the database file.
+type database struct {
+	Version      int                    `json:"version"`
+	Repositories map[string]*Repository `json:"repositories"`
+	AuditEvents  []AuditEvent           `json:"audit_events"`
+	JobRuns      []JobRun               `json:"job_runs"`
+	// Usage is the usage of the namespaces by month (`2006-01`).
+	Usage map[string]map[string]*Usage `json:"usage"`
+	// APIKeys are the API keys by ID.
+	APIKeys map[string]*APIKey `json:"api_keys"`
+	// CatalogPins are the repositories listed first in the catalog, in order.
+	CatalogPins []string `json:"catalog_pins"`
+	// Favorites are the favorite repositories by user.
+	Favorites map[string][]string `json:"favorites"`
+	// CatalogSnapshots are the snapshots of the catalog, oldest first.
+	CatalogSnapshots []CatalogSnapshot `json:"catalog_snapshots"`
+	// Sequence is the sequence number of the last entry of the journal
+	// applied to the database.
+	Sequence int64 `json:"sequence,omitempty"`
+}
+
+// migrations upgrade the database, migrations[i] upgrading it from version i
+// to version i+1.
+var migrations = []func(db *database) error{
+	// 0 -> 1: initial schema.
+	func(db *database) error {
+		db.Repositories = map[string]*Repository{}
+		db.AuditEvents = []AuditEvent{}
+		return nil
+	},
+	// 1 -> 2: job runs.
+	func(db *database) error {
+		db.JobRuns = []JobRun{}
+		return nil
+	},
+	// 2 -> 3: pins of the immutable tags.
+	func(db *database) error {
+		for _, repository := range db.Repositories {
+			repository.Pins = map[string]string{}
+		}
+		return nil
+	},
+	// 3 -> 4: usage of the namespaces.
+	func(db *database) error {
+		db.Usage = map[string]map[string]*Usage{}
+		return nil
+	},
+	// 4 -> 5: API keys.
+	func(db *database) error {
+		db.APIKeys = map[string]*APIKey{}
+		return nil
+	},
+	// 5 -> 6: catalog pins and favorites.
+	func(db *database) error {
+		db.CatalogPins = []string{}
+		db.Favorites = map[string][]string{}
+		return nil
+	},
+	// 6 -> 7: catalog snapshots.
+	func(db *database) error {
+		db.CatalogSnapshots = []CatalogSnapshot{}
+		return nil
+	},
+	// 7 -> 8: history of the tags, starting with their current digests.
+	func(db *database) error {
+		for _, repository := range db.Repositories {
+			repository.History = map[string][]TagChange{}
+			for tag, digest := range repository.Tags {
+				observedAt := repository.LastPulledAt
+				if d, ok := repository.Digests[digest]; ok {
+					observedAt = d.FirstSeenAt
+				}
+				repository.History[tag] = []TagChange{{Digest: digest, ObservedAt: observedAt, Source: "pull"}}
+			}
+		}
+		return nil
+	},
+}
+
+// SchemaVersion is the version of the database schema.
+var SchemaVersion = len(migrations)
+
+// Store is the metadata database. It is safe for concurrent use.
+type Store struct {
+	path         string
+	snapshotSize int64
+
+	// journalMu serializes the writes of the journal and the compactions.
+	journalMu   sync.Mutex
+	journal     *os.File
+	journalSize int64
+
+	mu sync.Mutex
+	db database
+	// pending are the entries of the journal not written yet.
+	pending [][]byte
+	// The records changed since the last flush.
+	changedRepositories map[string]bool
+	changedAPIKeys      map[string]bool
+	changedUsage        map[usageKey]bool
+}
+
+// Open loads the database at path, creating it if needed, and runs the
+// pending migrations.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:                path,
+		changedRepositories: map[string]bool{},
+		changedAPIKeys:      map[string]bool{},
+		changedUsage:        map[usageKey]bool{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.db); err != nil {
+			return nil, fmt.Errorf("invalid metadata database %s: %w", path, err)
+		}
+		s.snapshotSize = int64(len(data))
+	}
+
+	if s.db.Version > SchemaVersion {
+		return nil, fmt.Errorf("metadata database %s: unsupported version %d (latest: %d)", path, s.db.Version, SchemaVersion)
+	}
+	migrated := s.db.Version < SchemaVersion
+	for version := s.db.Version; version < SchemaVersion; version++ {
+		if err := migrations[version](&s.db); err != nil {
+			return nil, fmt.Errorf("metadata database %s: migration to version %d: %w", path, version+1, err)
+		}
+		s.db.Version = version + 1
+	}
+
+	// The journal is written after the migrations, by the compaction
+	// following them.
+	size, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.openJournal(size); err != nil {
+		return nil, err
+	}
+	if migrated {
+		if err := s.compact(true); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Flush writes the pending changes to the journal, and compacts it when it
+// grew larger than the snapshot.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	err := s.recordChanges()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+	return s.compact(false)
+}
+
+// Run flushes the pending changes periodically until ctx is done, and then
+// one last time.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.Printf("WARN metadata database not saved: %s", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("WARN metadata database not saved: %s", err)
+			}
+		}
+	}
+}
+
+// repository returns a repository, creating it if needed. The lock must be
+// held.
+func (s *Store) repository(name string) *Repository {
+	repository, ok := s.db.Repositories[name]
+	if !ok {
+		repository = &Repository{Name: name, Tags: map[string]string{}, Digests: map[string]*Digest{}, Pins: map[string]string{}, History: map[string][]TagChange{}}
+		s.db.Repositories[name] = repository
+	}
+	return repository
+}
+
+// digest returns a digest of a repository, creating it if needed. The lock
+// must be held.
+func (s *Store) digest(repository *Repository, digest string, now time.Time) *Digest {
+	d, ok := repository.Digests[digest]
+	if !ok {
+		d = &Digest{Digest: digest, FirstSeenAt: now}
+		repository.Digests[digest] = d
+	}
+	return d
+}
+
+// RecordPull records a manifest pulled through the proxy.
+func (s *Store) RecordPull(pull Pull) {
+	if pull.Time.IsZero() {
+		pull.Time = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repository := s.repository(pull.Repository)
+	repository.Pulls++
+	repository.LastPulledAt = pull.Time
+	if pull.Tag != "" && pull.Digest != "" {
+		s.observeTag(repository, pull.Tag, TagChange{Digest: pull.Digest, ObservedAt: pull.Time, Source: "pull"})
+	}
+	if pull.Digest != "" {
+		d := s.digest(repository, pull.Digest, pull.Time)
+		d.Pulls++
+		d.LastPulledAt = pull.Time
+		if pull.MediaType != "" {
+			d.MediaType = pull.MediaType
+		}
+		if pull.Size > 0 {
+			d.Size = pull.Size
+		}
+	}
+	s.changedRepositories[pull.Repository] = true
+}
+
+// observeTag records the digest of a tag, and its change in the history of the
+// tag. The lock must be held.
+func (s *Store) observeTag(repository *Repository, tag string, change TagChange) {
+	if change.Digest == "" {
+		delete(repository.Tags, tag)
+	} else {
+		repository.Tags[tag] = change.Digest
+	}
+
+	if repository.History == nil {
+		repository.History = map[string][]TagChange{}
+	}
+	history := repository.History[tag]
+	if n := len(history); (n == 0 && change.Digest == "") || (n > 0 && history[n-1].Digest == change.Digest) {
+		return
+	}
+	history = append(history, change)
+	if extra := len(history) - maxTagHistory; extra > 0 {
+		history = append([]TagChange{}, history[extra:]...)
+	}
+	repository.History[tag] = history
+}
+
+// RecordTag records the digest of a tag observed outside of the pulls, e.g.
+// by a push.
+func (s *Store) RecordTag(name, tag string, change TagChange) {
+	if change.ObservedAt.IsZero() {
+		change.ObservedAt = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observeTag(s.repository(name), tag, change)
+	s.changedRepositories[name] = true
+}
+
+// TagHistory returns the changes of a tag, newest first.
+func (s *Store) TagHistory(name, tag string) []TagChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repository, ok := s.db.Repositories[name]
+	if !ok {
+		return nil
+	}
+	history := repository.History[tag]
+	changes := make([]TagChange, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		changes = append(changes, history[i])
+	}
+	return changes
+}
+
+// PinTag records the digest of an immutable tag, unless the tag is already
+// pinned, and returns the pinned digest. The pin is written to disk right
+// away.
+func (s *Store) PinTag(name, tag, digest string) (string, error) {
+	s.mu.Lock()
+	repository := s.repository(name)
+	if pinned, ok := repository.Pins[tag]; ok {
+		s.mu.Unlock()
+		return pinned, nil
+	}
+	if repository.Pins == nil {
+		repository.Pins = map[string]string{}
+	}
+	repository.Pins[tag] = digest
+	err := s.recordRepository(name)
+	s.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return digest, s.sync()
+}
+
+// RecordScan records the scan result of a digest.
+func (s *Store) RecordScan(name, digest string, result ScanResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.ScannedAt.IsZero() {
+		result.ScannedAt = time.Now().UTC()
+	}
+	s.digest(s.repository(name), digest, result.ScannedAt).Scan = &result
+	s.changedRepositories[name] = true
+}
+
+// RecordProvenance records the provenance verification of a digest.
+func (s *Store) RecordProvenance(name, digest string, result ProvenanceResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.VerifiedAt.IsZero() {
+		result.VerifiedAt = time.Now().UTC()
+	}
+	s.digest(s.repository(name), digest, result.VerifiedAt).Provenance = &result
+	s.changedRepositories[name] = true
+}
+
+// DeleteTag removes a tag, or the digest and its tags when reference is a
+// digest, e.g. after a deletion.
+func (s *Store) DeleteTag(name, reference string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repository, ok := s.db.Repositories[name]
+	if !ok {
+		return
+	}
+	deleted := TagChange{ObservedAt: time.Now().UTC(), Source: "delete"}
+	if _, ok := repository.Digests[reference]; ok {
+		delete(repository.Digests, reference)
+		for tag, digest := range repository.Tags {
+			if digest == reference {
+				s.observeTag(repository, tag, deleted)
+			}
+		}
+	} else {
+		s.observeTag(repository, reference, deleted)
+	}
+	s.changedRepositories[name] = true
+}
+
+// Audit records an audit event, which is written to disk right away.
+func (s *Store) Audit(event AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	s.db.appendAuditEvent(event)
+	err := s.record(journalEntry{Op: opAuditEvent}, event)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// appendAuditEvent appends an audit event, dropping the oldest ones.
+func (db *database) appendAuditEvent(event AuditEvent) {
+	db.AuditEvents = append(db.AuditEvents, event)
+	if extra := len(db.AuditEvents) - maxAuditEvents; extra > 0 {
+		db.AuditEvents = append([]AuditEvent{}, db.AuditEvents[extra:]...)
+	}
+}
+
+// AuditEvents returns the most recent audit events, newest first.
+func (s *Store) AuditEvents(limit int) []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []AuditEvent
+	for i := len(s.db.AuditEvents) - 1; i >= 0 && (limit <= 0 || len(events) < limit); i-- {
+		events = append(events, s.db.AuditEvents[i])
+	}
+	return events
+}
+
+// RecordJobRun records a run of a background job, which is written to disk
+// right away.
+func (s *Store) RecordJobRun(run JobRun) error {
+	s.mu.Lock()
+	s.db.appendJobRun(run)
+	err := s.record(journalEntry{Op: opJobRun}, run)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// appendJobRun appends a run of a job, dropping the oldest runs of the job.
+func (db *database) appendJobRun(run JobRun) {
+	db.JobRuns = append(db.JobRuns, run)
+
+	count := 0
+	for _, r := range db.JobRuns {
+		if r.Job == run.Job {
+			count++
+		}
+	}
+	if count > maxJobRuns {
+		runs := make([]JobRun, 0, len(db.JobRuns)-1)
+		for _, r := range db.JobRuns {
+			if r.Job == run.Job && count > maxJobRuns {
+				count--
+				continue
+			}
+			runs = append(runs, r)
+		}
+		db.JobRuns = runs
+	}
+}
+
+// JobRuns returns the most recent runs of a job, or of all the jobs when job
+// is empty, newest first.
+func (s *Store) JobRuns(job string, limit int) []JobRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var runs []JobRun
+	for i := len(s.db.JobRuns) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		if job == "" || s.db.JobRuns[i].Job == job {
+			runs = append(runs, s.db.JobRuns[i])
+		}
+	}
+	return runs
+}
+
+// RecordUsage adds bytes served and pulls to the usage of a namespace during
+// a month (`2006-01`), and returns the updated usage. Only the last months are
+// kept.
+func (s *Store) RecordUsage(month, namespace string, bytes, pulls int64) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces := s.db.usageMonth(month)
+	usage, ok := namespaces[namespace]
+	if !ok {
+		usage = &Usage{}
+		namespaces[namespace] = usage
+	}
+	usage.Bytes += bytes
+	usage.Pulls += pulls
+	s.changedUsage[usageKey{month: month, namespace: namespace}] = true
+
+	return *usage
+}
+
+// usageMonth returns the usage of the namespaces during a month, creating it
+// if needed and dropping the oldest months.
+func (db *database) usageMonth(month string) map[string]*Usage {
+	namespaces, ok := db.Usage[month]
+	if !ok {
+		namespaces = map[string]*Usage{}
+		db.Usage[month] = namespaces
+
+		var months []string
+		for m := range db.Usage {
+			months = append(months, m)
+		}
+		sort.Strings(months)
+		for len(months) > maxUsageMonths {
+			delete(db.Usage, months[0])
+			months = months[1:]
+		}
+	}
+	return namespaces
+}
+
+// Usage returns the usage of the namespaces during a month.
+func (s *Store) Usage(month string) map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := map[string]Usage{}
+	for namespace, u := range s.db.Usage[month] {
+		usage[namespace] = *u
+	}
+	return usage
+}
+
+// copyRepository returns a deep copy of a repository. The lock must be held.
+func copyRepository(repository *Repository) Repository {
+	c := *repository
+	c.Tags = map[string]string{}
+	for tag, digest := range repository.Tags {
+		c.Tags[tag] = digest
+	}
+	c.Pins = map[string]string{}
+	for tag, digest := range repository.Pins {
+		c.Pins[tag] = digest
+	}
+	c.History = map[string][]TagChange{}
+	for tag, history := range repository.History {
+		c.History[tag] = append([]TagChange{}, history...)
+	}
+	c.Digests = map[string]*Digest{}
+	for key, digest := range repository.Digests {
+		d := *digest
+		if digest.Scan != nil {
+			scan := *digest.Scan
+			d.Scan = &scan
+		}
+		if digest.Provenance != nil {
+			provenance := *digest.Provenance
+			d.Provenance = &provenance
+		}
+		c.Digests[key] = &d
+	}
+	return c
+}
+
+// Repository returns a copy of a repository.
+func (s *Store) Repository(name string) (Repository, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repository, ok := s.db.Repositories[name]
+	if !ok {
+		return Repository{}, false
+	}
+	return copyRepository(repository), true
+}
+
+// Repositories returns a copy of all the repositories, sorted by name.
+func (s *Store) Repositories() []Repository {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var repositories []Repository
+	for _, repository := range s.db.Repositories {
+		repositories = append(repositories, copyRepository(repository))
+	}
+	sort.Slice(repositories, func(i, j int) bool {
+		return repositories[i].Name < repositories[j].Name
+	})
+	return repositories
+}
+
+// CreateAPIKey records a new API key, which is written to disk right away.
+func (s *Store) CreateAPIKey(key APIKey) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	if _, ok := s.db.APIKeys[key.ID]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("duplicate API key %s", key.ID)
+	}
+	s.db.APIKeys[key.ID] = &key
+	err := s.record(journalEntry{Op: opAPIKey, Key: key.ID}, key)
+	delete(s.changedAPIKeys, key.ID)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync()
+}
+
+// APIKeys returns the API keys, oldest first.
+func (s *Store) APIKeys() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []APIKey{}
+	for _, key := range s.db.APIKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// APIKey returns an API key by ID.
+func (s *Store) APIKey(id string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.db.APIKeys[id]
+	if !ok {
+		return APIKey{}, false
+	}
+	return copyAPIKey(key), true
+}
+
+// APIKeyByHash returns the API key having a hash.
+func (s *Store) APIKeyByHash(hash string) (APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.db.APIKeys {
+		if key.Hash == hash {
+			return copyAPIKey(key), true
+		}
+	}
+	return APIKey{}, false
+}
+
+// TouchAPIKey records the last use of an API key.
+func (s *Store) TouchAPIKey(id string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.db.APIKeys[id]; ok {
+		key.LastUsedAt = t
+		s.changedAPIKeys[id] = true
+	}
+}
+
+// RevokeAPIKey deletes an API key, which is written to disk right away. It
+// returns false when the key does not exist.
+func (s *Store) RevokeAPIKey(id string) (bool, error) {
+	s.mu.Lock()
+	if _, ok := s.db.APIKeys[id]; !ok {
+		s.mu.Unlock()
+		return false, nil
+	}
+	delete(s.db.APIKeys, id)
+	err := s.record(journalEntry{Op: opAPIKey, Key: id}, nil)
+	delete(s.changedAPIKeys, id)
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, s.sync()
+}
+
+// copyAPIKey returns a copy of an API key. The lock must be held.
+func copyAPIKey(key *APIKey) APIKey {
+	c := *key
+	c.Scopes = append([]string{}, key.Scopes...)
+	return c
+}
+
+// setMember adds a name to (or removes it from) a list, returning the updated
+// list and whether it changed.
+func setMember(names []string, name string, member bool) ([]string, bool) {
+	for i, n := range names {
+		if n != name {
+			continue
+		}
+		if member {
+			return names, false
+		}
+		return append(names[:i:i], names[i+1:]...), true
+	}
+	if !member {
+		return names, false
+	}
+	return append(names, name), true
+}
+
+// CatalogPins returns the repositories pinned to the top of the catalog, in
+// the order they were pinned.
+func (s *Store) CatalogPins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.db.CatalogPins...)
+}
+
+// SetCatalogPin pins a repository to the top of the catalog, or unpins it,
+// which is written to disk right away. It returns false when nothing changed.
+func (s *Store) SetCatalogPin(name string, pinned bool) (bool, error) {
+	s.mu.Lock()
+	var changed bool
+	s.db.CatalogPins, changed = setMember(s.db.CatalogPins, name, pinned)
+	if !changed {
+		s.mu.Unlock()
+		return false, nil
+	}
+	err := s.record(journalEntry{Op: opCatalogPins}, s.db.CatalogPins)
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, s.sync()
+}
+
+// Favorites returns the favorite repositories of a user, in the order they
+// were added.
+func (s *Store) Favorites(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.db.Favorites[user]...)
+}
+
+// SetFavorite adds a repository to the favorites of a user, or removes it,
+// which is written to disk right away. It returns false when nothing changed.
+func (s *Store) SetFavorite(user, name string, favorite bool) (bool, error) {
+	s.mu.Lock()
+	favorites, changed := setMember(s.db.Favorites[user], name, favorite)
+	if !changed {
+		s.mu.Unlock()
+		return false, nil
+	}
+	if len(favorites) == 0 {
+		delete(s.db.Favorites, user)
+	} else {
+		s.db.Favorites[user] = favorites
+	}
+	err := s.record(journalEntry{Op: opFavorites, Key: user}, favorites)
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, s.sync()
+}
+
+// RecordCatalogSnapshot records a snapshot of a catalog, unless it is the
+// same as the last one, which is written to disk right away. It returns false
+// when nothing changed.
+func (s *Store) RecordCatalogSnapshot(snapshot CatalogSnapshot) (bool, error) {
+	tags := make(map[string][]string, len(snapshot.Tags))
+	for name, list := range snapshot.Tags {
+		tags[name] = append([]string{}, list...)
+		sort.Strings(tags[name])
+	}
+	snapshot.Tags = tags
+
+	s.mu.Lock()
+	if last, ok := s.catalogSnapshot(snapshot.Catalog, time.Time{}); ok && reflect.DeepEqual(last.Tags, snapshot.Tags) {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.db.appendCatalogSnapshot(snapshot)
+	err := s.record(journalEntry{Op: opCatalogSnapshot}, snapshot)
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, s.sync()
+}
+
+// appendCatalogSnapshot appends a snapshot of a catalog, dropping the oldest
+// snapshots of the catalog.
+func (db *database) appendCatalogSnapshot(snapshot CatalogSnapshot) {
+	db.CatalogSnapshots = append(db.CatalogSnapshots, snapshot)
+
+	count := 0
+	for _, c := range db.CatalogSnapshots {
+		if c.Catalog == snapshot.Catalog {
+			count++
+		}
+	}
+	if count > maxCatalogSnapshots {
+		snapshots := make([]CatalogSnapshot, 0, len(db.CatalogSnapshots)-1)
+		for _, c := range db.CatalogSnapshots {
+			if c.Catalog == snapshot.Catalog && count > maxCatalogSnapshots {
+				count--
+				continue
+			}
+			snapshots = append(snapshots, c)
+		}
+		db.CatalogSnapshots = snapshots
+	}
+}
+
+// CatalogSnapshotAt returns the last snapshot of a catalog taken at or before
+// t, i.e. the content of the catalog at t, or the last snapshot when t is
+// zero. It returns false when there is no such snapshot.
+func (s *Store) CatalogSnapshotAt(catalog string, t time.Time) (CatalogSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.catalogSnapshot(catalog, t)
+}
+
+// catalogSnapshot is CatalogSnapshotAt. The lock must be held.
+func (s *Store) catalogSnapshot(catalog string, t time.Time) (CatalogSnapshot, bool) {
+	for i := len(s.db.CatalogSnapshots) - 1; i >= 0; i-- {
+		snapshot := s.db.CatalogSnapshots[i]
+		if snapshot.Catalog == catalog && (t.IsZero() || !snapshot.Time.After(t)) {
+			return snapshot, true
+		}
+	}
+	return CatalogSnapshot{}, false
+}
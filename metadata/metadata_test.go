@@ -0,0 +1,486 @@
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenCreatesTheDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+
+	if _, err := Open(path); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the database to be created, got: %s", err)
+	}
+	expected := `{"version":8,"repositories":{},"audit_events":[],"job_runs":[],"usage":{},"api_keys":{},"catalog_pins":[],"favorites":{},"catalog_snapshots":[]}`
+	if string(data) != expected {
+		t.Fatalf("expected: %s, got: %s", expected, data)
+	}
+}
+
+func TestOpenMigratesTheDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`{"version":1,"repositories":{"some-owner/some-package":{"name":"some-owner/some-package","pulls":3}},"audit_events":[]}`), 0o644)
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if repository, _ := store.Repository("some-owner/some-package"); repository.Pulls != 3 {
+		t.Fatalf("expected: %d, got: %d", 3, repository.Pulls)
+	}
+	if err := store.RecordJobRun(JobRun{Job: "prefetch"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+}
+
+func TestOpenRejectsNewerVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`{"version":99}`), 0o644)
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRecordPull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.RecordPull(Pull{Repository: "some-owner/some-package", Tag: "latest", Digest: "sha256:1234", Size: 42})
+	store.RecordPull(Pull{Repository: "some-owner/some-package", Digest: "sha256:1234"})
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pulls are persisted.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, ok := store.Repository("some-owner/some-package")
+	if !ok {
+		t.Fatal("expected the repository to be recorded")
+	}
+	if repository.Pulls != 2 {
+		t.Fatalf("expected: %d, got: %d", 2, repository.Pulls)
+	}
+	if repository.Tags["latest"] != "sha256:1234" {
+		t.Fatalf("expected: %s, got: %s", "sha256:1234", repository.Tags["latest"])
+	}
+	digest := repository.Digests["sha256:1234"]
+	if digest == nil || digest.Pulls != 2 || digest.Size != 42 {
+		t.Fatalf("unexpected digest: %+v", digest)
+	}
+
+	store.DeleteTag("some-owner/some-package", "sha256:1234")
+	repository, _ = store.Repository("some-owner/some-package")
+	if len(repository.Tags) != 0 || len(repository.Digests) != 0 {
+		t.Fatalf("expected the digest and its tags to be removed, got: %+v", repository)
+	}
+}
+
+func TestRecordScan(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.RecordScan("some-owner/some-package", "sha256:1234", ScanResult{
+		Scanner:  "trivy",
+		Status:   "vulnerable",
+		Findings: map[string]int{"CRITICAL": 1},
+	})
+
+	repository, _ := store.Repository("some-owner/some-package")
+	scan := repository.Digests["sha256:1234"].Scan
+	if scan == nil || scan.Findings["CRITICAL"] != 1 || scan.ScannedAt.IsZero() {
+		t.Fatalf("unexpected scan result: %+v", scan)
+	}
+
+	store.RecordProvenance("some-owner/some-package", "sha256:1234", ProvenanceResult{Status: "verified", Builder: "https://github.com/actions/runner/github-hosted"})
+	repository, _ = store.Repository("some-owner/some-package")
+	if provenance := repository.Digests["sha256:1234"].Provenance; provenance == nil || provenance.Status != "verified" || provenance.VerifiedAt.IsZero() || repository.Digests["sha256:1234"].Scan == nil {
+		t.Fatalf("unexpected provenance result: %+v", provenance)
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{"prefetch", "delete", "prefetch"} {
+		if err := store.Audit(AuditEvent{Actor: "oidc:alice", Action: action}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The audit events are written right away.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := store.AuditEvents(2)
+	if len(events) != 2 {
+		t.Fatalf("expected: %d, got: %d", 2, len(events))
+	}
+	if events[0].Action != "prefetch" || events[1].Action != "delete" {
+		t.Fatalf("expected the newest events first, got: %+v", events)
+	}
+}
+
+func TestJobRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.RecordJobRun(JobRun{Job: "other", Error: "failed"})
+	for i := 0; i < maxJobRuns+5; i++ {
+		if err := store.RecordJobRun(JobRun{Job: "prefetch", Outcomes: map[string]string{"image": fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := store.JobRuns("prefetch", 0)
+	if len(runs) != maxJobRuns {
+		t.Fatalf("expected: %d, got: %d", maxJobRuns, len(runs))
+	}
+	if expected := fmt.Sprint(maxJobRuns + 4); runs[0].Outcomes["image"] != expected {
+		t.Fatalf("expected: %s, got: %s", expected, runs[0].Outcomes["image"])
+	}
+	// The runs of the other jobs are kept.
+	if runs := store.JobRuns("other", 0); len(runs) != 1 || runs[0].Error != "failed" {
+		t.Fatalf("unexpected runs: %+v", runs)
+	}
+	if runs := store.JobRuns("", 3); len(runs) != 3 {
+		t.Fatalf("expected: %d, got: %d", 3, len(runs))
+	}
+}
+
+func TestPinTag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned, err := store.PinTag("some-owner/some-package", "v1", "sha256:1111"); err != nil || pinned != "sha256:1111" {
+		t.Fatalf("expected: %s, got: %s (%v)", "sha256:1111", pinned, err)
+	}
+
+	// The pins are persisted and never repointed.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, err := store.PinTag("some-owner/some-package", "v1", "sha256:2222"); err != nil || pinned != "sha256:1111" {
+		t.Fatalf("expected: %s, got: %s (%v)", "sha256:1111", pinned, err)
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.RecordUsage("2022-01", "team-a", 100, 1)
+	if usage := store.RecordUsage("2022-01", "team-a", 50, 0); usage != (Usage{Bytes: 150, Pulls: 1}) {
+		t.Fatalf("expected: %v, got: %v", Usage{Bytes: 150, Pulls: 1}, usage)
+	}
+	for month := 2; month <= 12; month++ {
+		store.RecordUsage(fmt.Sprintf("2022-%02d", month), "team-a", 1, 1)
+	}
+	store.RecordUsage("2023-01", "team-a", 1, 1)
+
+	if usage := store.Usage("2022-01"); len(usage) != 0 {
+		t.Fatalf("expected the oldest month to be pruned, got: %v", usage)
+	}
+	if usage := store.Usage("2023-01"); usage["team-a"] != (Usage{Bytes: 1, Pulls: 1}) {
+		t.Fatalf("expected: %v, got: %v", Usage{Bytes: 1, Pulls: 1}, usage["team-a"])
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := APIKey{ID: "1234", Name: "ci", Hash: "abcd", Scopes: []string{"my-org/*:pull"}}
+	if err := store.CreateAPIKey(key); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := store.CreateAPIKey(key); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// The keys are written to disk right away.
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := reopened.APIKeyByHash("abcd")
+	if !ok || found.ID != "1234" || found.Name != "ci" {
+		t.Fatalf("expected key 1234, got: %v", found)
+	}
+	if keys := reopened.APIKeys(); len(keys) != 1 {
+		t.Fatalf("expected: 1 key, got: %v", keys)
+	}
+
+	if revoked, err := reopened.RevokeAPIKey("1234"); !revoked || err != nil {
+		t.Fatalf("expected the key to be revoked, got: %t, %v", revoked, err)
+	}
+	if revoked, _ := reopened.RevokeAPIKey("1234"); revoked {
+		t.Fatal("expected the key to be already revoked")
+	}
+	if _, ok := reopened.APIKey("1234"); ok {
+		t.Fatal("expected no key")
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"some-owner/a", "some-owner/b", "some-owner/a"} {
+		if _, err := store.SetFavorite("user:alice", name, true); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+	if changed, _ := store.SetFavorite("user:alice", "some-owner/a", false); !changed {
+		t.Fatal("expected the favorite to be removed")
+	}
+	if changed, _ := store.SetFavorite("user:alice", "some-owner/c", false); changed {
+		t.Fatal("expected nothing to change")
+	}
+	if _, err := store.SetCatalogPin("some-owner/c", true); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// The changes are written right away.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if favorites := store.Favorites("user:alice"); fmt.Sprint(favorites) != "[some-owner/b]" {
+		t.Fatalf("expected: [some-owner/b], got: %v", favorites)
+	}
+	if favorites := store.Favorites("user:bob"); len(favorites) != 0 {
+		t.Fatalf("expected no favorites, got: %v", favorites)
+	}
+	if pins := store.CatalogPins(); fmt.Sprint(pins) != "[some-owner/c]" {
+		t.Fatalf("expected: [some-owner/c], got: %v", pins)
+	}
+}
+
+func TestCatalogSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.CatalogSnapshotAt("", time.Time{}); ok {
+		t.Fatal("expected no snapshot")
+	}
+
+	t1 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tags := range []map[string][]string{
+		{"some-owner/a": {"2.0", "1.0"}},
+		{"some-owner/a": {"1.0", "2.0"}},
+		{"some-owner/a": {"1.0", "2.0", "3.0"}},
+	} {
+		// The snapshots of the virtual registries are separate.
+		if _, err := store.RecordCatalogSnapshot(CatalogSnapshot{Catalog: "mirror", Time: t1, Tags: map[string][]string{"mirror/some-owner/b": {"1.0"}}}); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if _, err := store.RecordCatalogSnapshot(CatalogSnapshot{Time: t1.Add(time.Duration(i) * time.Hour), Tags: tags}); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+
+	// The snapshots are written right away, and the unchanged ones are
+	// skipped.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.CatalogSnapshotAt("", t1.Add(-time.Minute)); ok {
+		t.Fatal("expected no snapshot before the first one")
+	}
+	if snapshot, ok := store.CatalogSnapshotAt("", t1.Add(90*time.Minute)); !ok || !snapshot.Time.Equal(t1) || fmt.Sprint(snapshot.Tags) != "map[some-owner/a:[1.0 2.0]]" {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+	if snapshot, ok := store.CatalogSnapshotAt("", time.Time{}); !ok || !snapshot.Time.Equal(t1.Add(2*time.Hour)) {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+	if snapshot, ok := store.CatalogSnapshotAt("mirror", time.Time{}); !ok || !snapshot.Time.Equal(t1) {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+}
+
+func TestTagHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	os.WriteFile(path, []byte(`{"version":7,"repositories":{"some-owner/some-package":{"name":"some-owner/some-package","tags":{"latest":"sha256:1111"},"digests":{"sha256:1111":{"digest":"sha256:1111","first_seen_at":"2023-01-01T00:00:00Z"}}}}}`), 0o644)
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1 := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	store.RecordPull(Pull{Repository: "some-owner/some-package", Tag: "latest", Digest: "sha256:1111", Time: t1})
+	store.RecordTag("some-owner/some-package", "latest", TagChange{Digest: "sha256:2222", ObservedAt: t1.Add(time.Hour), Source: "push"})
+	store.RecordPull(Pull{Repository: "some-owner/some-package", Tag: "latest", Digest: "sha256:2222", Time: t1.Add(2 * time.Hour)})
+	store.DeleteTag("some-owner/some-package", "sha256:2222")
+
+	// The migration seeds the history with the current digests, and only the
+	// changes are recorded.
+	history := store.TagHistory("some-owner/some-package", "latest")
+	var changes []string
+	for _, change := range history {
+		changes = append(changes, change.Source+":"+change.Digest)
+	}
+	if fmt.Sprint(changes) != "[delete: push:sha256:2222 pull:sha256:1111]" {
+		t.Fatalf("unexpected history: %v", changes)
+	}
+	if !history[2].ObservedAt.Equal(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)) || !history[1].ObservedAt.Equal(t1.Add(time.Hour)) {
+		t.Fatalf("unexpected history: %v", history)
+	}
+	if repository, _ := store.Repository("some-owner/some-package"); len(repository.Tags) != 0 {
+		t.Fatalf("expected no tags, got: %v", repository.Tags)
+	}
+	if history := store.TagHistory("some-owner/other", "latest"); len(history) != 0 {
+		t.Fatalf("expected no history, got: %v", history)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.RecordPull(Pull{Repository: "some-owner/some-package", Tag: "latest", Digest: "sha256:1234"})
+	store.RecordUsage("2023-01", "some-owner", 42, 1)
+	if err := store.Audit(AuditEvent{Actor: "oidc:alice", Action: "prefetch"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes are appended to the journal, the snapshot is unchanged.
+	if data, _ := os.ReadFile(path); string(data) != string(snapshot) {
+		t.Fatalf("expected the snapshot to be unchanged, got: %s", data)
+	}
+
+	// A torn entry, e.g. after a crash, is ignored.
+	f, err := os.OpenFile(journalPath(path), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":99,"op":"audit_ev`)
+	f.Close()
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repository, ok := store.Repository("some-owner/some-package"); !ok || repository.Pulls != 1 {
+		t.Fatalf("expected the pull to be replayed, got: %+v", repository)
+	}
+	if usage := store.Usage("2023-01")["some-owner"]; usage.Bytes != 42 {
+		t.Fatalf("expected the usage to be replayed, got: %+v", usage)
+	}
+	if events := store.AuditEvents(0); len(events) != 1 {
+		t.Fatalf("expected: %d, got: %d", 1, len(events))
+	}
+
+	// The torn entry is truncated before appending.
+	if err := store.Audit(AuditEvent{Actor: "oidc:alice", Action: "delete"}); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := store.AuditEvents(0); len(events) != 2 || events[0].Action != "delete" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	// A corrupted entry is an error.
+	os.WriteFile(journalPath(path), []byte("not json\n"), 0o644)
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Audit(AuditEvent{Actor: "oidc:alice", Action: "prefetch"}); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := os.ReadFile(journalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The journal is compacted when it is larger than the snapshot.
+	for i := 0; i < 5000; i++ {
+		store.RecordPull(Pull{Repository: fmt.Sprintf("some-owner/package-%d", i), Digest: "sha256:1234"})
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(journalPath(path)); err != nil || info.Size() != 0 {
+		t.Fatalf("expected the journal to be truncated, got: %v, %v", info, err)
+	}
+
+	// The entries already in the snapshot are skipped, e.g. after a crash
+	// before the truncation of the journal.
+	os.WriteFile(journalPath(path), journal, 0o644)
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := store.AuditEvents(0); len(events) != 1 {
+		t.Fatalf("expected: %d, got: %d", 1, len(events))
+	}
+	if repositories := store.Repositories(); len(repositories) != 5000 {
+		t.Fatalf("expected: %d, got: %d", 5000, len(repositories))
+	}
+}
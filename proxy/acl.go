@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ACLRule grants actions on the repositories matching a pattern to a principal.
+type ACLRule struct {
+	// Principal is a group name, `user:<subject>` or `*` for any authenticated
+	// client.
+	Principal string
+	// Pattern is a glob pattern (see path.Match) matched against repository
+	// names, e.g. `owner/*`.
+	Pattern string
+	Actions []string
+}
+
+// ParseACL parses a semicolon-separated list of `principal=pattern:actions`
+// rules, e.g. `platform=*:pull,push,delete;developers=owner/*:pull`.
+func ParseACL(value string) ([]ACLRule, error) {
+	var rules []ACLRule
+	for _, rawRule := range strings.Split(value, ";") {
+		rawRule = strings.TrimSpace(rawRule)
+		if rawRule == "" {
+			continue
+		}
+
+		principal, rest, ok := strings.Cut(rawRule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid ACL rule: %q", rawRule)
+		}
+		pattern, actions, ok := strings.Cut(rest, ":")
+		if !ok || principal == "" || pattern == "" || actions == "" {
+			return nil, fmt.Errorf("invalid ACL rule: %q", rawRule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid ACL rule: %q: %w", rawRule, err)
+		}
+
+		rules = append(rules, ACLRule{
+			Principal: strings.TrimSpace(principal),
+			Pattern:   strings.TrimSpace(pattern),
+			Actions:   strings.Split(actions, ","),
+		})
+	}
+
+	return rules, nil
+}
+
+// appliesTo returns true when the rule applies to the identity.
+func (r ACLRule) appliesTo(identity *Identity) bool {
+	if r.Principal == "*" {
+		return true
+	}
+	if subject, ok := strings.CutPrefix(r.Principal, "user:"); ok {
+		return subject == identity.Subject
+	}
+	for _, group := range identity.Groups {
+		if group == r.Principal {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true when the rule grants the action on the repository.
+func (r ACLRule) allows(name, action string) bool {
+	if matched, _ := path.Match(r.Pattern, name); !matched {
+		return false
+	}
+	for _, a := range r.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// WithACL restricts the repositories and the actions of the authenticated
+// clients to the ones granted by the rules. Everything is denied when no rule
+// applies.
+func WithACL(rules []ACLRule) Option {
+	return func(p *containerProxy) {
+		for _, rule := range rules {
+			for _, action := range rule.Actions {
+				p.adminGranted = p.adminGranted || action == actionAdmin || action == "*"
+			}
+		}
+		p.authorize = func(identity *Identity, name, action string) bool {
+			if identity == nil {
+				return false
+			}
+			for _, rule := range rules {
+				if rule.appliesTo(identity) && rule.allows(name, action) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// WithAnonymousRead allows the clients without credentials to pull from the
+// repositories matching the glob patterns, e.g. `public-org/*`, and to list
+// them in the catalog. All the other operations still require
+// authentication.
+func WithAnonymousRead(patterns ...string) Option {
+	return func(p *containerProxy) {
+		p.anonymousRead = append(p.anonymousRead, patterns...)
+	}
+}
+
+// anonymousCanPull returns true when anonymous clients can pull from the
+// repository.
+func (p *containerProxy) anonymousCanPull(name string) bool {
+	for _, pattern := range p.anonymousRead {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/auth"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseACL(t *testing.T) {
+	rules, err := ParseACL("platform=*:pull,push,delete; developers=some-owner/*:pull;user:alice=some-owner/app:push")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected: 3, got: %d", len(rules))
+	}
+	if rules[1].Principal != "developers" || rules[1].Pattern != "some-owner/*" || len(rules[1].Actions) != 1 {
+		t.Fatalf("unexpected rule: %v", rules[1])
+	}
+
+	for _, value := range []string{"developers", "developers=*", "=*:pull", "developers=[:pull"} {
+		if _, err := ParseACL(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rules, _ := ParseACL("developers=some-owner/*:pull;user:alice=some-owner/app:push")
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "realm_access.roles")),
+		WithACL(rules),
+	)
+
+	developer := provider.Sign(t, map[string]interface{}{
+		"sub":          "bob",
+		"realm_access": map[string]interface{}{"roles": []string{"developers"}},
+	})
+	alice := provider.Sign(t, map[string]interface{}{"sub": "alice"})
+
+	for _, tc := range []struct {
+		token              string
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{token: developer, method: "GET", path: "/v2/some-owner/app/manifests/latest", expectedStatusCode: 200},
+		{token: developer, method: "PUT", path: "/v2/some-owner/app/manifests/latest", expectedStatusCode: 403},
+		{token: developer, method: "GET", path: "/v2/other-owner/app/manifests/latest", expectedStatusCode: 403},
+		{token: alice, method: "GET", path: "/v2/some-owner/app/manifests/latest", expectedStatusCode: 403},
+		{token: alice, method: "PUT", path: "/v2/some-owner/app/manifests/latest", expectedStatusCode: 200},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	// Tokens only grant the actions allowed by the rules.
+	_, token := requestToken(t, proxy.Handler, developer, "repository:some-owner/app:pull,push")
+	claims, _ := auth.UnverifiedClaims(token)
+	access := claims["access"].([]interface{})
+	if len(access) != 1 {
+		t.Fatalf("unexpected access: %v", access)
+	}
+	actions := access[0].(map[string]interface{})["actions"].([]interface{})
+	if len(actions) != 1 || actions[0] != "pull" {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rules, _ := ParseACL("platform=*:admin;developers=some-owner/*:pull")
+	management, _ := ParseCIDRs("10.0.0.0/8")
+	oidc := WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "realm_access.roles"))
+	newProxy := func(opts ...Option) http.Handler {
+		return NewProxy("127.0.0.1:10000", ghbackend.New(&githubClientMock{}, nil), upstream.URL, opts...).Handler
+	}
+
+	platform := provider.Sign(t, map[string]interface{}{
+		"sub":          "alice",
+		"realm_access": map[string]interface{}{"roles": []string{"platform"}},
+	})
+	developer := provider.Sign(t, map[string]interface{}{
+		"sub":          "bob",
+		"realm_access": map[string]interface{}{"roles": []string{"developers"}},
+	})
+
+	for _, tc := range []struct {
+		name               string
+		handler            http.Handler
+		token              string
+		remoteAddr         string
+		expectedStatusCode int
+	}{
+		// The admin endpoints would be open to everyone.
+		{name: "no auth", handler: newProxy(), expectedStatusCode: 404},
+		{name: "auth without ACL", handler: newProxy(oidc), token: developer, expectedStatusCode: 404},
+		{name: "ACL without auth", handler: newProxy(WithACL(rules)), expectedStatusCode: 404},
+		{name: "admin grant", handler: newProxy(oidc, WithACL(rules)), token: platform, expectedStatusCode: 200},
+		{name: "no admin grant", handler: newProxy(oidc, WithACL(rules)), token: developer, expectedStatusCode: 403},
+		{name: "allowed network", handler: newProxy(WithIPFilter(routeFamilyAdmin, management, nil)), remoteAddr: "10.1.2.3:1234", expectedStatusCode: 200},
+		{name: "other network", handler: newProxy(WithIPFilter(routeFamilyAdmin, management, nil)), remoteAddr: "192.168.1.1:1234", expectedStatusCode: 403},
+	} {
+		req := httptest.NewRequest("GET", "/admin/jobs", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		if tc.remoteAddr != "" {
+			req.RemoteAddr = tc.remoteAddr
+		}
+		res := httptest.NewRecorder()
+		tc.handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d (%s)", tc.name, tc.expectedStatusCode, res.Code, res.Body.String())
+		}
+	}
+}
+
+func TestAnonymousRead(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("app"), Owner: &github.User{Login: github.String("public")}},
+			{Name: github.String("app"), Owner: &github.User{Login: github.String("private")}},
+		},
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(client, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		WithAnonymousRead("public/*"),
+	)
+	idToken := provider.Sign(t, nil)
+
+	for _, tc := range []struct {
+		token              string
+		method             string
+		path               string
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{method: "GET", path: "/v2/", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/public/app/manifests/latest", expectedStatusCode: 200},
+		{method: "HEAD", path: "/v2/public/app/manifests/latest", expectedStatusCode: 200},
+		{method: "GET", path: "/v2/public/app/tags/list", expectedStatusCode: 200},
+		{method: "PUT", path: "/v2/public/app/manifests/latest", expectedStatusCode: 401},
+		{method: "DELETE", path: "/v2/public/app/manifests/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/private/app/manifests/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/_catalog", expectedStatusCode: 200, expectedContent: `{"repositories":["public/app"]}`},
+		{token: idToken, method: "PUT", path: "/v2/public/app/manifests/latest", expectedStatusCode: 200},
+		{token: idToken, method: "GET", path: "/v2/_catalog", expectedStatusCode: 200, expectedContent: `{"repositories":["public/app","private/app"]}`},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if body, _ := io.ReadAll(res.Body); tc.expectedContent != "" && strings.TrimSpace(string(body)) != tc.expectedContent {
+			t.Fatalf("%s %s: expected: %s, got: %s", tc.method, tc.path, tc.expectedContent, body)
+		}
+	}
+
+	// Anonymous clients get tokens for the public repositories only.
+	req, _ := http.NewRequest("GET", "/token?scope=repository:public/app:pull,push&scope=repository:private/app:pull", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(res.Body).Decode(&body)
+	claims, _ := auth.UnverifiedClaims(body.Token)
+	access, _ := json.Marshal(claims["access"])
+	if expected := `[{"actions":["pull"],"name":"public/app","type":"repository"}]`; string(access) != expected {
+		t.Fatalf("expected: %s, got: %s", expected, access)
+	}
+}
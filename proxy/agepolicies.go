@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// minImageCreated is the creation time below which the creation time of an
+// image config is ignored, e.g. the Unix epoch set by the reproducible builds.
+var minImageCreated = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var staleImagePullsTotal = newCounterVec(
+	"stale_image_pulls_total",
+	"Number of manifests pulled older than the maximum age of their age policy, by action (warn, block).",
+	"action",
+)
+
+// AgePolicy warns about or blocks the pulls of the images older than a
+// maximum age, to push the teams off the stale base images.
+type AgePolicy struct {
+	// Repositories are the patterns of the repositories of the policy, e.g.
+	// `base-images/*`.
+	Repositories []string `json:"repositories"`
+	// MaxAge is the maximum age of the images, e.g. `720h` or `180d`.
+	MaxAge string `json:"max_age"`
+	// Action is taken on the stale images: `warn` (default) or `block`.
+	Action string `json:"action,omitempty"`
+
+	maxAge time.Duration
+}
+
+// parseAge parses a positive duration, which can also be a number of days,
+// e.g. `180d`.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age: %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age: %q", value)
+	}
+	return d, nil
+}
+
+func (policy AgePolicy) validate() error {
+	if len(policy.Repositories) == 0 {
+		return fmt.Errorf("invalid age policy: no repositories")
+	}
+	for _, pattern := range policy.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid age policy: invalid pattern %q", pattern)
+		}
+	}
+	if _, err := parseAge(policy.MaxAge); err != nil {
+		return fmt.Errorf("invalid age policy: %w", err)
+	}
+	switch policy.Action {
+	case "", labelPolicyWarn, labelPolicyBlock:
+	default:
+		return fmt.Errorf("invalid age policy: invalid action %q", policy.Action)
+	}
+	return nil
+}
+
+func (policy AgePolicy) action() string {
+	if policy.Action == "" {
+		return labelPolicyWarn
+	}
+	return policy.Action
+}
+
+// agePolicies are the age policies of a proxy, with the creation times of the
+// digests checked.
+type agePolicies struct {
+	policies []AgePolicy
+
+	mu      sync.Mutex
+	created map[string]time.Time
+}
+
+// WithAgePolicies checks the age of the images pulled from the repositories
+// of the policies, the first matching policy applying.
+func WithAgePolicies(policies ...AgePolicy) Option {
+	return func(p *containerProxy) {
+		p.agePolicies = &agePolicies{created: map[string]time.Time{}}
+		for _, policy := range policies {
+			if err := policy.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			policy.maxAge, _ = parseAge(policy.MaxAge)
+			p.agePolicies.policies = append(p.agePolicies.policies, policy)
+		}
+	}
+}
+
+// policy returns the policy of a repository.
+func (a *agePolicies) policy(name string) (AgePolicy, bool) {
+	for _, policy := range a.policies {
+		for _, pattern := range policy.Repositories {
+			if matched, _ := path.Match(pattern, name); matched {
+				return policy, true
+			}
+		}
+	}
+	return AgePolicy{}, false
+}
+
+// imageCreated returns when an image was created, read from its config or
+// from the backend (e.g. when the package version was pushed to GitHub) when
+// the config has no meaningful creation time. The time is zero when it is
+// unknown or when the manifest is not an image manifest.
+func (p *containerProxy) imageCreated(ctx context.Context, name, digest, contentType string, body []byte) (time.Time, error) {
+	key := name + "@" + digest
+	p.agePolicies.mu.Lock()
+	created, ok := p.agePolicies.created[key]
+	p.agePolicies.mu.Unlock()
+	if ok {
+		return created, nil
+	}
+
+	config, err := p.fetchImageConfig(ctx, name, contentType, body)
+	if err != nil || config == nil {
+		return time.Time{}, err
+	}
+	created = config.Created
+	if created.Before(minImageCreated) {
+		created = time.Time{}
+		owner, repository, _ := strings.Cut(name, "/")
+		if finder, ok := p.backend.(backend.VersionFinder); ok {
+			if version, err := finder.FindVersion(ctx, owner, repository, digest); err == nil {
+				created = version.CreatedAt
+			}
+		}
+	}
+
+	p.agePolicies.mu.Lock()
+	defer p.agePolicies.mu.Unlock()
+	if len(p.agePolicies.created) >= maxCheckedLabels {
+		p.agePolicies.created = map[string]time.Time{}
+	}
+	p.agePolicies.created[key] = created
+	return created, nil
+}
+
+// checkImageAge is a middleware checking the age of the images pulled from
+// the repositories having an age policy. The stale images are logged with a
+// `Warning` header, or rejected with the block action.
+func (p *containerProxy) checkImageAge(next http.Handler) http.Handler {
+	match := func(r *http.Request) bool {
+		name, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			return false
+		}
+		_, ok = p.agePolicies.policy(name)
+		return ok
+	}
+	return ResponseHook(match, func(r *http.Request, res *HookResponse) error {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		name, _, _, _ := splitRegistryPath(r.URL.Path)
+		policy, _ := p.agePolicies.policy(name)
+		digest, _ := responseDigest(r.Method, res.Header, res.Body)
+
+		created, err := p.imageCreated(r.Context(), name, digest, res.Header.Get("Content-Type"), res.Body)
+		if err != nil {
+			if policy.action() == labelPolicyBlock {
+				return fmt.Errorf("cannot check the age of %s@%s: %w", name, digest, err)
+			}
+			log.Printf("WARN age of %s@%s not checked: %s", name, digest, err)
+			return nil
+		}
+		if created.IsZero() || time.Since(created) <= policy.maxAge {
+			return nil
+		}
+
+		staleImagePullsTotal.Inc(policy.action())
+		message := fmt.Sprintf("%s@%s was created on %s, more than %s ago: please use a more recent image", name, digest, created.UTC().Format("2006-01-02"), policy.MaxAge)
+		log.Printf("WARN %s", message)
+		if policy.action() == labelPolicyWarn {
+			res.Header.Add("Warning", `299 - `+strconv.Quote(message))
+			return nil
+		}
+		body, _ := json.Marshal(makeError(ERROR_DENIED, message))
+		res.StatusCode = http.StatusForbidden
+		res.Header.Set("Content-Type", "application/json")
+		res.Header.Del("Docker-Content-Digest")
+		res.Body = body
+		return nil
+	})(next)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseAge(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"180d": 180 * 24 * time.Hour,
+		"720h": 720 * time.Hour,
+		"0d":   0,
+		"-1h":  0,
+		"old":  0,
+	} {
+		age, err := parseAge(value)
+		if age != expected || (err != nil) != (expected == 0) {
+			t.Errorf("%s: unexpected age: %s (%v)", value, age, err)
+		}
+	}
+}
+
+func TestCheckImageAge(t *testing.T) {
+	configs := map[string]string{
+		"old":          `{"created":"2020-01-01T00:00:00Z"}`,
+		"recent":       fmt.Sprintf(`{"created":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339)),
+		"reproducible": `{"created":"1970-01-01T00:00:00Z"}`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, config := range configs {
+			switch r.URL.Path {
+			case "/v2/some-owner/" + name + "/manifests/latest":
+				w.Header().Set("Content-Type", mediaTypeOCIManifest)
+				w.Header().Set("Docker-Content-Digest", "sha256:"+name)
+				fmt.Fprintf(w, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:config-%s"},"layers":[]}`, name)
+				return
+			case "/v2/some-owner/" + name + "/blobs/sha256:config-" + name:
+				fmt.Fprint(w, config)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	// The config of the reproducible image has no creation time, the GitHub
+	// package version is used instead.
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			{Name: github.String("sha256:reproducible"), CreatedAt: &github.Timestamp{Time: time.Now().Add(-400 * 24 * time.Hour)}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		action  string
+		status  int
+		warning bool
+	}{
+		{name: "old", action: labelPolicyBlock, status: http.StatusForbidden},
+		{name: "old", status: http.StatusOK, warning: true},
+		{name: "recent", action: labelPolicyBlock, status: http.StatusOK},
+		{name: "reproducible", action: labelPolicyBlock, status: http.StatusForbidden},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), upstream.URL, WithAgePolicies(
+			AgePolicy{Repositories: []string{"some-owner/*"}, MaxAge: "365d", Action: tc.action},
+		))
+
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/v2/some-owner/"+tc.name+"/manifests/latest", nil))
+		if res.Code != tc.status {
+			t.Fatalf("%s %q: expected status %d, got: %d", tc.name, tc.action, tc.status, res.Code)
+		}
+		if warning := res.Header().Get("Warning") != ""; warning != tc.warning {
+			t.Fatalf("%s %q: unexpected Warning header: %q", tc.name, tc.action, res.Header().Get("Warning"))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// alertRule is a Prometheus alerting rule of the `alert-rules` command.
+type alertRule struct {
+	alert       string
+	expr        string
+	duration    string
+	severity    string
+	summary     string
+	description string
+}
+
+// newAlertRules returns the alerting rules of the metrics exposed on /metrics.
+// Like the dashboard, the expressions use the names of the registered metrics
+// so that the rules follow them.
+func newAlertRules() []alertRule {
+	return []alertRule{
+		{
+			alert:       "ContainerRegistryProxyGitHubRateLimitLow",
+			expr:        fmt.Sprintf(`%s / %s < %g`, githubRateLimitRemaining.name, githubRateLimit.name, githubRateLimitWarning),
+			duration:    "5m",
+			severity:    "warning",
+			summary:     "The GitHub API rate limit is nearly exhausted.",
+			description: "{{ $value | humanizePercentage }} of the GitHub API rate limit ({{ $labels.resource }}) is left on {{ $labels.instance }}.",
+		},
+		{
+			alert:       "ContainerRegistryProxyGitHubRateLimitExhausted",
+			expr:        fmt.Sprintf(`%s == 0`, githubRateLimitRemaining.name),
+			duration:    "1m",
+			severity:    "critical",
+			summary:     "The GitHub API rate limit is exhausted.",
+			description: "The GitHub API rate limit ({{ $labels.resource }}) is exhausted on {{ $labels.instance }}: the tags lists, the catalog and the manifests of the GitHub backend fail until it is reset.",
+		},
+		{
+			alert:       "ContainerRegistryProxyUpstreamErrors",
+			expr:        fmt.Sprintf(`sum by (host) (rate(%[1]s{result="error"}[5m])) / sum by (host) (rate(%[1]s{result!="canceled"}[5m])) > 0.05`, upstreamRequestsTotal.name),
+			duration:    "10m",
+			severity:    "critical",
+			summary:     "An upstream returns server errors.",
+			description: "{{ $value | humanizePercentage }} of the requests sent to {{ $labels.host }} fail with a 5xx status or a network error.",
+		},
+		{
+			alert:       "ContainerRegistryProxyUpstreamDown",
+			expr:        fmt.Sprintf(`%s == 0`, upstreamUp.name),
+			duration:    "5m",
+			severity:    "critical",
+			summary:     "An upstream fails its health checks.",
+			description: "The health checks of {{ $labels.upstream }} fail on {{ $labels.instance }}.",
+		},
+		{
+			alert:       "ContainerRegistryProxyErrors",
+			expr:        fmt.Sprintf(`sum by (route) (rate(%[1]s{status="5xx"}[5m])) / sum by (route) (rate(%[1]s[5m])) > 0.05`, requestsTotal.name),
+			duration:    "10m",
+			severity:    "critical",
+			summary:     "The proxy returns server errors.",
+			description: "{{ $value | humanizePercentage }} of the {{ $labels.route }} requests fail with a 5xx status.",
+		},
+		{
+			// A spike is three times the miss rate of the previous hour, ignoring
+			// the low traffic.
+			alert:       "ContainerRegistryProxyCacheMissSpike",
+			expr:        fmt.Sprintf(`sum by (namespace) (rate(%[1]s{result="miss"}[10m])) > 3 * sum by (namespace) (rate(%[1]s{result="miss"}[1h] offset 10m)) and sum by (namespace) (rate(%[1]s{result="miss"}[10m])) > 1`, blobCacheRequestsTotal.name),
+			duration:    "15m",
+			severity:    "warning",
+			summary:     "The blob cache misses spiked.",
+			description: "The blob cache misses of the {{ $labels.namespace }} namespace went up to {{ $value | humanize }} per second, e.g. after a cache eviction or a mass deployment of new images.",
+		},
+	}
+}
+
+// WriteAlertRules writes the Prometheus rule file of the alerting rules, or a
+// PrometheusRule resource of the Prometheus Operator.
+func WriteAlertRules(w io.Writer, prometheusRule bool) error {
+	var b strings.Builder
+	b.WriteString("groups:\n")
+	b.WriteString("  - name: container-registry-proxy\n")
+	b.WriteString("    rules:\n")
+	for _, rule := range newAlertRules() {
+		// The strings are double-quoted, the escapes of Go being valid in
+		// YAML.
+		fmt.Fprintf(&b, "      - alert: %s\n", rule.alert)
+		fmt.Fprintf(&b, "        expr: %s\n", strconv.Quote(rule.expr))
+		fmt.Fprintf(&b, "        for: %s\n", rule.duration)
+		b.WriteString("        labels:\n")
+		fmt.Fprintf(&b, "          severity: %s\n", rule.severity)
+		b.WriteString("        annotations:\n")
+		fmt.Fprintf(&b, "          summary: %s\n", strconv.Quote(rule.summary))
+		fmt.Fprintf(&b, "          description: %s\n", strconv.Quote(rule.description))
+	}
+
+	out := b.String()
+	if prometheusRule {
+		out = "apiVersion: monitoring.coreos.com/v1\nkind: PrometheusRule\nmetadata:\n  name: container-registry-proxy\nspec:\n" +
+			"  " + strings.ReplaceAll(strings.TrimSuffix(out, "\n"), "\n", "\n  ") + "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+func runAlertRulesCommand(args []string) error {
+	flags := flag.NewFlagSet("alert-rules", flag.ExitOnError)
+	prometheusRule := flags.Bool("prometheus-rule", false, "print a PrometheusRule resource of the Prometheus Operator")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: container-registry-proxy alert-rules [-prometheus-rule]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return WriteAlertRules(os.Stdout, *prometheusRule)
+}
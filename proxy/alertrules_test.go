@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAlertRules(t *testing.T) {
+	var b strings.Builder
+	for _, m := range allMetrics {
+		m.write(&b)
+	}
+	registered := map[string]bool{}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			registered[fields[2]] = true
+		}
+	}
+
+	var out bytes.Buffer
+	if err := WriteAlertRules(&out, false); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if !strings.HasPrefix(out.String(), "groups:\n  - name: container-registry-proxy\n    rules:\n") {
+		t.Fatalf("unexpected rules: %s", out.String())
+	}
+
+	// The expressions only use the metrics exposed by the proxy.
+	name := regexp.MustCompile(metricsNamespace + `_[a-z_]+`)
+	alerts := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "      - alert: ") {
+			alerts++
+		}
+		value, ok := strings.CutPrefix(line, "        expr: ")
+		if !ok {
+			continue
+		}
+		expr, err := strconv.Unquote(value)
+		if err != nil {
+			t.Fatalf("expected a quoted expression, got: %s", value)
+		}
+		for _, metric := range name.FindAllString(expr, -1) {
+			if !registered[metric] {
+				t.Fatalf("unknown metric %s in %s", metric, expr)
+			}
+		}
+	}
+	if alerts != len(newAlertRules()) {
+		t.Fatalf("expected %d alerts, got: %d", len(newAlertRules()), alerts)
+	}
+
+	out.Reset()
+	if err := WriteAlertRules(&out, true); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if !strings.Contains(out.String(), "kind: PrometheusRule\n") || !strings.Contains(out.String(), "\nspec:\n  groups:\n    - name: container-registry-proxy\n") {
+		t.Fatalf("unexpected resource: %s", out.String())
+	}
+	if strings.Contains(out.String(), "\n  \n") || !strings.HasSuffix(out.String(), "\"\n") {
+		t.Fatalf("unexpected indentation: %q", out.String())
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// alertCheckInterval is the interval between the checks of the alert
+	// conditions.
+	alertCheckInterval = time.Minute
+
+	defaultAlertTokenExpiry      = 7 * 24 * time.Hour
+	defaultAlertDiskUsage        = 0.9
+	defaultAlertUpstreamFailures = 5
+)
+
+// EmailAlerts sends emails when operational thresholds are crossed, and when
+// they are back to normal, for the deployments without Alertmanager.
+type EmailAlerts struct {
+	// Addr is the `host:port` of the SMTP server. The connection is upgraded
+	// with STARTTLS when the server supports it.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+
+	// TokenExpiry alerts when the GitHub token expires in less than this
+	// duration.
+	TokenExpiry time.Duration
+	// DiskUsage alerts when the file system of the blob cache is used above
+	// this ratio.
+	DiskUsage float64
+	// UpstreamFailures alerts when the health checks of an upstream failed
+	// this number of times in a row.
+	UpstreamFailures int
+	// TokenExpiration returns the expiration of the GitHub token, zero when
+	// it does not expire.
+	TokenExpiration func() time.Time
+
+	// send sends an email, smtp.SendMail by default.
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+	mu sync.Mutex
+	// firing are the messages of the firing alerts, by alert.
+	firing map[string]string
+}
+
+// WithEmailAlerts checks the alert conditions of the proxy periodically and
+// emails the changes.
+func WithEmailAlerts(alerts *EmailAlerts) Option {
+	return func(p *containerProxy) {
+		p.alerts = alerts
+	}
+}
+
+// run checks the alerts until ctx is canceled.
+func (a *EmailAlerts) run(ctx context.Context, p *containerProxy) {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		a.check(p)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// conditions returns the messages of the alerts whose condition is met.
+func (a *EmailAlerts) conditions(p *containerProxy) map[string]string {
+	alerts := map[string]string{}
+
+	if a.TokenExpiration != nil {
+		if expiration := a.TokenExpiration(); !expiration.IsZero() && time.Until(expiration) < a.TokenExpiry {
+			alerts["token-expiry"] = fmt.Sprintf("The GitHub token expires at %s.", expiration.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if p.blobCache != nil {
+		used, total, err := cache.DiskUsage(p.blobCache.Dir())
+		if err == nil && total > 0 && float64(used) > a.DiskUsage*float64(total) {
+			alerts["cache-disk"] = fmt.Sprintf("The disk of the blob cache (%s) is %.0f%% full.", p.blobCache.Dir(), 100*float64(used)/float64(total))
+		}
+	}
+
+	if p.health != nil {
+		for _, probe := range p.health.probes {
+			probe.mu.Lock()
+			health := probe.health
+			probe.mu.Unlock()
+			if health.ConsecutiveFailures >= a.UpstreamFailures {
+				alerts["upstream-down:"+health.Name] = fmt.Sprintf("The upstream %s (%s) failed %d health checks in a row: %s", health.Name, health.Target, health.ConsecutiveFailures, health.LastError)
+			}
+		}
+	}
+
+	return alerts
+}
+
+// check emails the alerts starting to fire and the resolved ones.
+func (a *EmailAlerts) check(p *containerProxy) {
+	alerts := a.conditions(p)
+
+	a.mu.Lock()
+	previous := a.firing
+	a.firing = alerts
+	a.mu.Unlock()
+
+	var names []string
+	for name := range alerts {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := alerts[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		status, message := "FIRING", alerts[name]
+		if message == "" {
+			status, message = "RESOLVED", previous[name]
+		}
+		log.Printf("alert %s %s: %s", name, status, message)
+		if err := a.email(fmt.Sprintf("[%s] %s on %s", status, name, instanceID()), message); err != nil {
+			log.Printf("WARN alert %s not sent: %s", name, err)
+		}
+	}
+}
+
+// email sends an email to the recipients.
+func (a *EmailAlerts) email(subject, body string) error {
+	var auth smtp.Auth
+	if a.Username != "" {
+		host, _, _ := net.SplitHostPort(a.Addr)
+		auth = smtp.PlainAuth("", a.Username, a.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: container-registry-proxy %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		a.From, strings.Join(a.To, ", "), subject, time.Now().Format(time.RFC1123Z), body)
+
+	send := a.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(a.Addr, auth, a.From, a.To, []byte(msg))
+}
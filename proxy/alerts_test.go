@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestEmailAlerts(t *testing.T) {
+	var emails []string
+	expiration := time.Now().Add(48 * time.Hour)
+	alerts := &EmailAlerts{
+		Addr:             "smtp.example.com:587",
+		From:             "proxy@example.com",
+		To:               []string{"ops@example.com"},
+		TokenExpiry:      defaultAlertTokenExpiry,
+		DiskUsage:        0,
+		UpstreamFailures: 2,
+		TokenExpiration:  func() time.Time { return expiration },
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			emails = append(emails, string(msg))
+			return nil
+		},
+	}
+	probe := &healthProbe{health: upstreamHealth{Name: "ghcr.io", Target: "https://ghcr.io/v2/", ConsecutiveFailures: 1}}
+	p := &containerProxy{blobCache: cache.New(t.TempDir()), health: &healthChecker{probes: []*healthProbe{probe}}}
+
+	alerts.check(p)
+	if len(emails) != 2 || !strings.Contains(emails[0], "Subject: container-registry-proxy [FIRING] cache-disk") || !strings.Contains(emails[1], "[FIRING] token-expiry") {
+		t.Fatalf("unexpected emails: %v", emails)
+	}
+
+	// The firing alerts are not sent again.
+	probe.health.ConsecutiveFailures = 2
+	alerts.check(p)
+	if len(emails) != 3 || !strings.Contains(emails[2], "[FIRING] upstream-down:ghcr.io") {
+		t.Fatalf("unexpected emails: %v", emails[2:])
+	}
+
+	expiration = time.Now().Add(30 * 24 * time.Hour)
+	probe.health.ConsecutiveFailures = 0
+	alerts.check(p)
+	if len(emails) != 5 || !strings.Contains(emails[3], "[RESOLVED] token-expiry") || !strings.Contains(emails[4], "[RESOLVED] upstream-down:ghcr.io") {
+		t.Fatalf("unexpected emails: %v", emails[3:])
+	}
+}
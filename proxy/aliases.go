@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// validateAliases checks the names of repository aliases, which map short
+// names to the names of the upstream repositories.
+func validateAliases(aliases map[string]string) error {
+	for alias, target := range aliases {
+		for _, name := range []string{alias, target} {
+			if !repositoryNamePattern.MatchString(name) {
+				return fmt.Errorf("invalid alias %s: invalid repository name %q", alias, name)
+			}
+		}
+		if _, ok := aliases[target]; ok {
+			return fmt.Errorf("invalid alias %s: %s is an alias too", alias, target)
+		}
+	}
+	return nil
+}
+
+// WithRepositoryAliases maps short names to repositories, e.g. `nginx` to
+// `my-org/base-nginx`, so that the clients can pull memorable names. The
+// aliases are listed in the catalog along with their repositories.
+func WithRepositoryAliases(aliases map[string]string) Option {
+	return func(p *containerProxy) {
+		if p.aliases == nil {
+			p.aliases = map[string]string{}
+		}
+		for alias, target := range aliases {
+			p.aliases[alias] = target
+		}
+	}
+}
+
+// resolveAlias returns the repository of a name, which is the name itself
+// when it is not an alias.
+func (p *containerProxy) resolveAlias(name string) string {
+	if target, ok := p.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// catalogAliases returns the aliases of the repositories of a catalog.
+func (p *containerProxy) catalogAliases(repositories []string) []string {
+	listed := map[string]bool{}
+	for _, name := range repositories {
+		listed[name] = true
+	}
+
+	var aliases []string
+	for alias, target := range p.aliases {
+		if listed[target] {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// rewriteAliases is a middleware replacing the aliases with the names of
+// their repositories in the registry requests, before they are authorized.
+func (p *containerProxy) rewriteAliases(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := repositoryFromPath(r.URL.Path)
+		target := p.resolveAlias(name)
+		if !ok || target == name {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.URL.Path = "/v2/" + target + strings.TrimPrefix(r.URL.Path, "/v2/"+name)
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestRepositoryAliases(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("base-nginx"), Owner: &github.User{Login: github.String("my-org")}},
+		},
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(client, nil),
+		upstream.URL,
+		WithRepositoryAliases(map[string]string{
+			"nginx":       "my-org/base-nginx",
+			"tools/redis": "my-org/redis",
+		}),
+	)
+
+	for _, tc := range []struct {
+		path         string
+		expectedPath string
+	}{
+		{path: "/v2/nginx/manifests/latest", expectedPath: "/v2/my-org/base-nginx/manifests/latest"},
+		{path: "/v2/nginx/blobs/sha256:1234", expectedPath: "/v2/my-org/base-nginx/blobs/sha256:1234"},
+		{path: "/v2/tools/redis/manifests/7", expectedPath: "/v2/my-org/redis/manifests/7"},
+		{path: "/v2/nginx-other/manifests/latest", expectedPath: "/v2/nginx-other/manifests/latest"},
+		{path: "/v2/my-org/base-nginx/manifests/latest", expectedPath: "/v2/my-org/base-nginx/manifests/latest"},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if upstreamPath != tc.expectedPath {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedPath, upstreamPath)
+		}
+	}
+
+	// The aliases of the listed repositories are in the catalog.
+	req, _ := http.NewRequest("GET", "/v2/_catalog", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	expected := `{"repositories":["my-org/base-nginx","nginx"]}`
+	if content := strings.TrimSpace(res.Body.String()); content != expected {
+		t.Fatalf("expected: %s, got: %s", expected, content)
+	}
+}
+
+func TestRepositoryAliasesAuthorization(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rules, err := ParseACL("*=my-org/base-nginx:pull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		WithACL(rules),
+		WithRepositoryAliases(map[string]string{"nginx": "my-org/base-nginx", "secret": "my-org/secret"}),
+	)
+
+	for _, tc := range []struct {
+		name               string
+		expectedStatusCode int
+	}{
+		{name: "nginx", expectedStatusCode: 200},
+		// An alias does not grant access to its repository.
+		{name: "secret", expectedStatusCode: 401},
+	} {
+		_, token := requestToken(t, proxy.Handler, provider.Sign(t, nil), "repository:"+tc.name+":pull")
+
+		req, _ := http.NewRequest("GET", "/v2/"+tc.name+"/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.name, tc.expectedStatusCode, res.Code)
+		}
+	}
+}
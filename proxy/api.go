@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// repositoryMetadata is the extended metadata of a repository returned by the
+// proxy API.
+type repositoryMetadata struct {
+	Name         string             `json:"name"`
+	ArtifactType string             `json:"artifactType"`
+	Tags         []string           `json:"tags"`
+	Deprecation  *deprecationStatus `json:"deprecation,omitempty"`
+	Source       *sourceRepository  `json:"source,omitempty"`
+}
+
+// sourceRepository is the source code repository of a repository, e.g. the
+// GitHub repository linked to a package.
+type sourceRepository struct {
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+	License     string `json:"license,omitempty"`
+}
+
+// RepositoryMetadata returns the extended metadata of a repository.
+func (p *containerProxy) RepositoryMetadata(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RepositoryMetadata Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	owner := chi.URLParam(r, "owner")
+	name := chi.URLParam(r, "name")
+
+	tags, err := p.backend.ListTags(r.Context(), owner, name)
+	if err != nil {
+		if errors.Is(err, backend.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_NAME_UNKNOWN, "repository name not known to registry"))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+		return
+	}
+
+	metadata := repositoryMetadata{
+		Name:         fmt.Sprintf("%s/%s", owner, name),
+		ArtifactType: artifactTypeUnknown,
+		Tags:         append([]string{}, tags...),
+	}
+	metadata.ArtifactType, err = detectArtifactType(r.Context(), p.registryClient, metadata.Name, tags)
+	if err != nil {
+		log.Printf("WARN artifact type detection for %s: %s", metadata.Name, err)
+	}
+	metadata.Deprecation = p.deprecationStatus(p.prefixedName(metadata.Name), tags)
+	if finder, ok := p.backend.(backend.SourceFinder); ok {
+		source, err := finder.FindSource(r.Context(), owner, name)
+		switch {
+		case err == nil:
+			metadata.Source = &sourceRepository{URL: source.URL, Description: source.Description, License: source.License}
+		case !errors.Is(err, backend.ErrNotFound) && !errors.Is(err, backend.ErrNotSupported):
+			log.Printf("WARN source repository of %s: %s", metadata.Name, err)
+		}
+	}
+
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// latestTagResponse is the tag of the latest version matching a constraint.
+type latestTagResponse struct {
+	Name    string `json:"name"`
+	Tag     string `json:"tag"`
+	Version string `json:"version"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// LatestTag returns the tag of the latest version of a repository matching the
+// semver constraint of the `constraint` query parameter, e.g. `^1.2`, so that
+// automation does not have to fetch and parse the full list of tags.
+func (p *containerProxy) LatestTag(w http.ResponseWriter, r *http.Request) {
+	log.Printf("LatestTag Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	owner := chi.URLParam(r, "owner")
+	name := chi.URLParam(r, "name")
+	rawConstraint := r.URL.Query().Get("constraint")
+
+	constraint, err := parseSemConstraint(rawConstraint)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNSUPPORTED, err.Error()))
+		return
+	}
+
+	tags, err := p.backend.ListTags(r.Context(), owner, name)
+	if err != nil {
+		if errors.Is(err, backend.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_NAME_UNKNOWN, "repository name not known to registry"))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(errorCode(ERROR_UNKNOWN, err), err.Error()))
+		return
+	}
+
+	tag, version, ok := latestTag(tags, constraint, r.URL.Query().Get("prerelease") == "true")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(makeError(ERROR_MANIFEST_UNKNOWN, fmt.Sprintf("no tag matches %q", rawConstraint)))
+		return
+	}
+
+	latest := latestTagResponse{
+		Name:    fmt.Sprintf("%s/%s", owner, name),
+		Tag:     tag,
+		Version: version.String(),
+	}
+	// The digest lets the clients pin the version, it is omitted when the
+	// upstream registry cannot be reached.
+	if latest.Digest, err = p.registryClient.ManifestDigest(r.Context(), latest.Name, tag); err != nil {
+		log.Printf("WARN digest of %s:%s: %s", latest.Name, tag, err)
+	}
+
+	json.NewEncoder(w).Encode(latest)
+}
+
+// ownerResponse is an owner aggregated by the proxy.
+type ownerResponse struct {
+	// Name is empty for the owner of the GitHub token.
+	Name              string     `json:"name"`
+	AuthenticatedUser bool       `json:"authenticated_user,omitempty"`
+	Packages          int        `json:"packages"`
+	RefreshedAt       *time.Time `json:"refreshed_at,omitempty"`
+}
+
+// Owners returns the GitHub users and organizations whose packages are listed
+// by the proxy, with their number of packages and when they were last listed.
+func (p *containerProxy) Owners(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Owners Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	lister, ok := p.backend.(backend.OwnerLister)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNSUPPORTED, "the backend does not list its owners"))
+		return
+	}
+	owners, err := lister.ListOwners(r.Context())
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, backend.ErrNotSupported) {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(makeErrors(ERROR_UNKNOWN, err))
+		return
+	}
+
+	response := struct {
+		Owners []ownerResponse `json:"owners"`
+	}{
+		Owners: []ownerResponse{},
+	}
+	for _, owner := range owners {
+		o := ownerResponse{Name: owner.Name, AuthenticatedUser: owner.Name == "", Packages: owner.Packages}
+		if !owner.RefreshedAt.IsZero() {
+			refreshedAt := owner.RefreshedAt.UTC()
+			o.RefreshedAt = &refreshedAt
+		}
+		response.Owners = append(response.Owners, o)
+	}
+	writeRegistryJSON(w, r, "application/json", response)
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+const (
+	methodAPIKey = "apikey"
+
+	// apiKeyPrefix identifies the API keys among the credentials, e.g. to skip
+	// the other authenticators.
+	apiKeyPrefix = "crp_"
+
+	// maxAPIKeyRequestSize limits the size of the API key creation requests.
+	maxAPIKeyRequestSize = 64 * 1024
+)
+
+var apiKeyActions = map[string]bool{
+	actionPull:   true,
+	actionPush:   true,
+	actionDelete: true,
+	actionAdmin:  true,
+	"*":          true,
+}
+
+// parseAPIKeyScope parses a scope of an API key, i.e. a glob pattern and
+// actions like in the ACL rules, e.g. `my-org/*:pull,push`.
+func parseAPIKeyScope(scope string) (ACLRule, error) {
+	pattern, rawActions, ok := strings.Cut(scope, ":")
+	if !ok || pattern == "" || rawActions == "" {
+		return ACLRule{}, fmt.Errorf("invalid scope: %q", scope)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return ACLRule{}, fmt.Errorf("invalid scope: %q: %w", scope, err)
+	}
+	actions := strings.Split(rawActions, ",")
+	for _, action := range actions {
+		if !apiKeyActions[action] {
+			return ACLRule{}, fmt.Errorf("invalid scope: %q: unknown action %q", scope, action)
+		}
+	}
+	return ACLRule{Principal: "*", Pattern: pattern, Actions: actions}, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a random ID and key.
+func newAPIKey() (string, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	for _, b := range [][]byte{id, secret} {
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+	}
+	return hex.EncodeToString(id), apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// apiKeyAuthenticator authenticates the clients sending an API key, e.g. with
+// `docker login -u <anything> -p crp_...`.
+type apiKeyAuthenticator struct {
+	store *metadata.Store
+}
+
+// Authenticate returns an identity whose subject is the ID of the key, only
+// allowed to perform the actions of its scopes.
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, nil
+	}
+
+	key, ok := a.store.APIKeyByHash(hashAPIKey(token))
+	if !ok {
+		return nil, errors.New("unknown or revoked API key")
+	}
+
+	identity := &Identity{Subject: key.ID, Method: methodAPIKey}
+	for _, scope := range key.Scopes {
+		if rule, err := parseAPIKeyScope(scope); err == nil {
+			identity.scopes = append(identity.scopes, rule)
+		}
+	}
+	return identity, nil
+}
+
+// apiKeyLimiters are the rate limiters of the API keys.
+type apiKeyLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// get returns the limiter of a key, allowing limit requests per minute.
+func (l *apiKeyLimiters) get(key metadata.APIKey) *rateLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.limiters[key.ID]
+	if !ok || limiter.burst != float64(key.RateLimit) {
+		limit := float64(key.RateLimit)
+		limiter = &rateLimiter{rate: limit / 60, burst: limit, tokens: limit, now: time.Now, sleep: sleepContext}
+		l.limiters[key.ID] = limiter
+	}
+	return limiter
+}
+
+// WithAPIKeys enables the authentication of the clients with API keys, which
+// are managed with the `/admin/apikeys` endpoints and stored in the metadata
+// database.
+func WithAPIKeys() Option {
+	return func(p *containerProxy) {
+		p.apiKeys = &apiKeyLimiters{limiters: map[string]*rateLimiter{}}
+	}
+}
+
+// limitAPIKeys is a middleware enforcing the rate limits of the API keys, for
+// the requests sent with a key or a token minted for a key. The requests of
+// the revoked keys are denied.
+func (p *containerProxy) limitAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := IdentityFromContext(r.Context())
+		if identity == nil || identity.Method != methodAPIKey {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := p.metadata.APIKey(identity.Subject)
+		if !ok {
+			Veto(w, http.StatusUnauthorized, ERROR_UNAUTHORIZED, "API key revoked")
+			return
+		}
+		if key.RateLimit > 0 {
+			if delay, ok := p.apiKeys.get(key).allow(1); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+				Veto(w, http.StatusTooManyRequests, ERROR_TOO_MANY_REQUESTS, fmt.Sprintf("rate limit of API key %s exceeded", key.Name))
+				return
+			}
+		}
+		p.metadata.TouchAPIKey(key.ID, time.Now().UTC())
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	RateLimit int      `json:"rate_limit"`
+}
+
+func (req apiKeyRequest) validate() error {
+	if req.Name == "" || len(req.Scopes) == 0 {
+		return errors.New("an API key needs a name and scopes")
+	}
+	if req.RateLimit < 0 {
+		return fmt.Errorf("invalid rate limit: %d", req.RateLimit)
+	}
+	for _, scope := range req.Scopes {
+		if _, err := parseAPIKeyScope(scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAPIKeyRequest parses the API key to create with `--create-api-key`,
+// i.e. a name and semicolon-separated scopes, e.g. `ci=my-org/*:pull;my-org/app:push`.
+func parseAPIKeyRequest(value string) (apiKeyRequest, error) {
+	name, rawScopes, _ := strings.Cut(value, "=")
+	req := apiKeyRequest{Name: strings.TrimSpace(name)}
+	for _, scope := range strings.Split(rawScopes, ";") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			req.Scopes = append(req.Scopes, scope)
+		}
+	}
+	return req, req.validate()
+}
+
+// createAPIKey creates an API key in the metadata database, returning the key
+// itself.
+func createAPIKey(store *metadata.Store, req apiKeyRequest, createdBy string) (apiKeyStatus, error) {
+	id, secret, err := newAPIKey()
+	if err != nil {
+		return apiKeyStatus{}, err
+	}
+	key := metadata.APIKey{
+		ID:        id,
+		Name:      req.Name,
+		Hash:      hashAPIKey(secret),
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: createdBy,
+	}
+	if err := store.CreateAPIKey(key); err != nil {
+		return apiKeyStatus{}, err
+	}
+
+	status := newAPIKeyStatus(key)
+	status.Key = secret
+	return status, nil
+}
+
+// apiKeyStatus is an API key returned by the admin API. The key itself is only
+// returned when it is created.
+type apiKeyStatus struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func newAPIKeyStatus(key metadata.APIKey) apiKeyStatus {
+	status := apiKeyStatus{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		RateLimit: key.RateLimit,
+		CreatedAt: key.CreatedAt,
+		CreatedBy: key.CreatedBy,
+	}
+	if !key.LastUsedAt.IsZero() {
+		status.LastUsedAt = &key.LastUsedAt
+	}
+	return status
+}
+
+// APIKeys returns the API keys, without the keys themselves.
+func (p *containerProxy) APIKeys(w http.ResponseWriter, r *http.Request) {
+	log.Printf("APIKeys Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	response := struct {
+		Keys []apiKeyStatus `json:"keys"`
+	}{
+		Keys: []apiKeyStatus{},
+	}
+	for _, key := range p.metadata.APIKeys() {
+		response.Keys = append(response.Keys, newAPIKeyStatus(key))
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateAPIKey creates an API key, which is returned once.
+func (p *containerProxy) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CreateAPIKey Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	var body apiKeyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIKeyRequestSize)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid request: %s", err)))
+		return
+	}
+	if err := body.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+		return
+	}
+
+	createdBy := ""
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		createdBy = identity.Method + ":" + identity.Subject
+	}
+	status, err := createAPIKey(p.metadata, body, createdBy)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+		return
+	}
+	p.audit(r, "apikey-create", status.ID, fmt.Sprintf("%s %s", body.Name, strings.Join(body.Scopes, ",")))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(status)
+}
+
+// RevokeAPIKey deletes an API key.
+func (p *containerProxy) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RevokeAPIKey Request %s -> %s", r.Method, r.URL)
+
+	id := chi.URLParam(r, "id")
+	revoked, err := p.metadata.RevokeAPIKey(id)
+	if err != nil {
+		Veto(w, http.StatusInternalServerError, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	if !revoked {
+		Veto(w, http.StatusNotFound, ERROR_UNKNOWN, fmt.Sprintf("unknown API key %s", id))
+		return
+	}
+	p.audit(r, "apikey-revoke", id, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
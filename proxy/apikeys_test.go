@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestAPIKeys(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := createAPIKey(store, apiKeyRequest{Name: "admin", Scopes: []string{"apikeys:admin", "apikeys/*:admin"}}, "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithMetadataStore(store), WithAPIKeys(), withTestAdmin())
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.SetBasicAuth("ci", key)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("POST", "/admin/apikeys", admin.Key, `{"name":"ci","scopes":["my-org/*:pull"],"rate_limit":3}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected: %d, got: %d (%s)", http.StatusCreated, res.Code, res.Body.String())
+	}
+	var ci apiKeyStatus
+	json.NewDecoder(res.Body).Decode(&ci)
+	if !strings.HasPrefix(ci.Key, apiKeyPrefix) || ci.CreatedBy != "apikey:"+admin.ID {
+		t.Fatalf("unexpected key: %+v", ci)
+	}
+
+	for _, tc := range []struct {
+		method             string
+		path               string
+		key                string
+		expectedStatusCode int
+	}{
+		{method: "GET", path: "/v2/my-org/app/manifests/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/my-org/app/manifests/latest", key: "crp_unknown", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/my-org/app/manifests/latest", key: ci.Key, expectedStatusCode: 200},
+		{method: "PUT", path: "/v2/my-org/app/manifests/latest", key: ci.Key, expectedStatusCode: 403},
+		{method: "GET", path: "/v2/other-org/app/manifests/latest", key: ci.Key, expectedStatusCode: 403},
+		{method: "GET", path: "/admin/apikeys", key: ci.Key, expectedStatusCode: 403},
+		{method: "GET", path: "/v2/my-org/app/blobs/sha256:1234", key: ci.Key, expectedStatusCode: 200},
+		{method: "GET", path: "/v2/my-org/app/blobs/sha256:5678", key: ci.Key, expectedStatusCode: 200},
+		// The rate limit is 3 requests per minute.
+		{method: "GET", path: "/v2/my-org/app/blobs/sha256:1234", key: ci.Key, expectedStatusCode: 429},
+	} {
+		res := send(tc.method, tc.path, tc.key, "")
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d (%s)", tc.method, tc.path, tc.expectedStatusCode, res.Code, res.Body.String())
+		}
+	}
+
+	res = send("GET", "/admin/apikeys", admin.Key, "")
+	if res.Code != http.StatusOK || strings.Contains(res.Body.String(), ci.Key) || strings.Contains(res.Body.String(), `"hash"`) {
+		t.Fatalf("expected the keys without secrets, got: %d %s", res.Code, res.Body.String())
+	}
+
+	if res := send("DELETE", "/admin/apikeys/"+ci.ID, admin.Key, ""); res.Code != http.StatusNoContent {
+		t.Fatalf("expected: %d, got: %d", http.StatusNoContent, res.Code)
+	}
+	if res := send("DELETE", "/admin/apikeys/"+ci.ID, admin.Key, ""); res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+	if res := send("GET", "/v2/my-org/app/manifests/latest", ci.Key, ""); res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	events := store.AuditEvents(0)
+	if len(events) != 2 || events[0].Action != "apikey-revoke" || events[1].Action != "apikey-create" {
+		t.Fatalf("unexpected audit events: %v", events)
+	}
+}
+
+func TestParseAPIKeyRequest(t *testing.T) {
+	for _, tc := range []struct {
+		value          string
+		expectedScopes []string
+		expectedError  bool
+	}{
+		{value: "ci=my-org/*:pull; my-org/app:pull,push", expectedScopes: []string{"my-org/*:pull", "my-org/app:pull,push"}},
+		{value: "ci", expectedError: true},
+		{value: "ci=my-org/*", expectedError: true},
+		{value: "ci=my-org/*:fly", expectedError: true},
+		{value: "=my-org/*:pull", expectedError: true},
+	} {
+		req, err := parseAPIKeyRequest(tc.value)
+		if (err != nil) != tc.expectedError {
+			t.Fatalf("%s: expected error: %t, got: %v", tc.value, tc.expectedError, err)
+		}
+		if !tc.expectedError && strings.Join(req.Scopes, " ") != strings.Join(tc.expectedScopes, " ") {
+			t.Fatalf("expected: %v, got: %v", tc.expectedScopes, req.Scopes)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	artifactTypeContainerImage = "container-image"
+	artifactTypeHelmChart      = "helm-chart"
+	artifactTypeCosign         = "cosign-signatures"
+	artifactTypeOCIArtifact    = "oci-artifact"
+	artifactTypeUnknown        = "unknown"
+
+	mediaTypeHelmConfig           = "application/vnd.cncf.helm.config.v1+json"
+	mediaTypeCosignSimpleSigning  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	mediaTypeDockerContainerImage = "application/vnd.docker.container.image.v1+json"
+	mediaTypeOCIImageConfig       = "application/vnd.oci.image.config.v1+json"
+)
+
+// artifactTypeFromManifest returns the type of artifact described by a
+// manifest, using the media types of its config and layers.
+func artifactTypeFromManifest(body []byte) string {
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return artifactTypeUnknown
+	}
+
+	// Multi-platform images.
+	if len(m.Manifests) > 0 && m.ArtifactType == "" {
+		return artifactTypeContainerImage
+	}
+
+	for _, layer := range m.Layers {
+		if layer.MediaType == mediaTypeCosignSimpleSigning {
+			return artifactTypeCosign
+		}
+	}
+
+	if m.Config == nil {
+		return artifactTypeUnknown
+	}
+
+	switch m.Config.MediaType {
+	case mediaTypeHelmConfig:
+		return artifactTypeHelmChart
+	case mediaTypeDockerContainerImage, mediaTypeOCIImageConfig:
+		if m.ArtifactType == "" {
+			return artifactTypeContainerImage
+		}
+	}
+
+	return artifactTypeOCIArtifact
+}
+
+// detectArtifactType returns the artifact type of a repository given its tags,
+// by inspecting the manifest of one of these tags.
+func detectArtifactType(ctx context.Context, client *registryClient, name string, tags []string) (string, error) {
+	if len(tags) == 0 {
+		return artifactTypeUnknown, nil
+	}
+
+	// Repositories containing only signatures use tags like
+	// `sha256-<digest>.sig`.
+	signaturesOnly := true
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "sha256-") || !strings.HasSuffix(tag, ".sig") {
+			signaturesOnly = false
+			break
+		}
+	}
+	if signaturesOnly {
+		return artifactTypeCosign, nil
+	}
+
+	tag := tags[0]
+	for _, t := range tags {
+		if t == "latest" {
+			tag = t
+			break
+		}
+	}
+
+	body, _, _, err := client.GetManifest(ctx, name, tag)
+	if err != nil {
+		return artifactTypeUnknown, err
+	}
+
+	return artifactTypeFromManifest(body), nil
+}
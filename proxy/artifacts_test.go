@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestArtifactTypeFromManifest(t *testing.T) {
+	for _, tc := range []struct {
+		body                 string
+		expectedArtifactType string
+	}{
+		{body: imageManifest, expectedArtifactType: artifactTypeContainerImage},
+		{body: helmChartManifest, expectedArtifactType: artifactTypeHelmChart},
+		{body: attestationManifest, expectedArtifactType: artifactTypeContainerImage},
+		{body: buildkitCacheManifest, expectedArtifactType: artifactTypeOCIArtifact},
+		{body: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"digest":"sha256:1234"}]}`, expectedArtifactType: artifactTypeContainerImage},
+		{body: `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"},"layers":[{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json"}]}`, expectedArtifactType: artifactTypeCosign},
+		{body: `{"schemaVersion":2,"artifactType":"application/vnd.example+type","config":{"mediaType":"application/vnd.oci.empty.v1+json"}}`, expectedArtifactType: artifactTypeOCIArtifact},
+		{body: `{}`, expectedArtifactType: artifactTypeUnknown},
+	} {
+		if artifactType := artifactTypeFromManifest([]byte(tc.body)); artifactType != tc.expectedArtifactType {
+			t.Fatalf("expected: %s, got: %s for %s", tc.expectedArtifactType, artifactType, tc.body)
+		}
+	}
+}
+
+func TestRepositoryMetadata(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/some-owner/some-chart/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, helmChartManifest)
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		client             githubClientMock
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{
+							Container: &github.PackageContainerMetadata{Tags: []string{"1.0.0", "latest"}},
+						},
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-chart","artifactType":"helm-chart","tags":["1.0.0","latest"]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{
+							Container: &github.PackageContainerMetadata{Tags: []string{"sha256-1234.sig"}},
+						},
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-chart","artifactType":"cosign-signatures","tags":["sha256-1234.sig"]}`,
+		},
+		{
+			client:             githubClientMock{},
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-chart","artifactType":"unknown","tags":[]}`,
+		},
+		{
+			client: githubClientMock{
+				Packages: []*github.Package{
+					{
+						Name: github.String("some-chart"),
+						Repository: &github.Repository{
+							HTMLURL:     github.String("https://github.com/some-owner/charts"),
+							Description: github.String("Some charts"),
+							License:     &github.License{SPDXID: github.String("Apache-2.0")},
+						},
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-chart","artifactType":"unknown","tags":[],"source":{"url":"https://github.com/some-owner/charts","description":"Some charts","license":"Apache-2.0"}}`,
+		},
+		{
+			client:             githubClientMock{Err: fmt.Errorf("an error")},
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"UNKNOWN","message":"PackageGetAllVersions: an error","detail":""}]}`,
+		},
+	} {
+		proxy := NewProxy(
+			"127.0.0.1:10000",
+			ghbackend.New(&tc.client, nil),
+			upstream.URL,
+		)
+
+		req, _ := http.NewRequest("GET", "/api/repos/some-owner/some-chart", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("expected: %s, got: %s", tc.expectedContent, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+)
+
+const (
+	actionPull   = "pull"
+	actionPush   = "push"
+	actionDelete = "delete"
+	// actionAdmin is the action of the admin endpoints, e.g. `/admin/prefetch`.
+	actionAdmin = "admin"
+
+	methodAnonymous = "anonymous"
+)
+
+// anonymousIdentity is the identity of the clients without credentials when
+// anonymous reads are enabled.
+var anonymousIdentity = &Identity{Subject: "anonymous", Method: methodAnonymous}
+
+// Identity is an authenticated client.
+type Identity struct {
+	// Subject identifies the client, e.g. the `sub` claim of a token.
+	Subject string `json:"subject"`
+	// Method is the authentication method, e.g. "oidc".
+	Method string `json:"method"`
+	// Groups are used to authorize the client.
+	Groups []string `json:"groups,omitempty"`
+	// Access is set when the client presented a token minted by the proxy, in
+	// which case the client is only allowed to perform these actions.
+	Access []AccessEntry `json:"access,omitempty"`
+	// Claims are the claims of the token presented by the client, if any.
+	Claims auth.Claims `json:"-"`
+
+	// scopes are the rules of an API key, which replace the ACL.
+	scopes []ACLRule
+}
+
+// Authenticator identifies the clients sending a request.
+type Authenticator interface {
+	// Authenticate returns the identity of the client, or nil when the request
+	// does not contain credentials handled by this authenticator. An error is
+	// returned when the credentials are invalid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of the authenticated client.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// credentialsToken returns the bearer token sent by a client, or the password
+// of its basic credentials since `docker login` only supports the latter.
+func credentialsToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// AccessEntry is a scope granted in a token, using the format of the Docker
+// Registry token authentication specification.
+type AccessEntry struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// parseScope parses a scope like `repository:owner/name:pull,push`.
+func parseScope(scope string) (AccessEntry, error) {
+	parts := strings.Split(scope, ":")
+	if len(parts) < 3 {
+		return AccessEntry{}, fmt.Errorf("invalid scope: %q", scope)
+	}
+
+	// Repository names can contain a registry host with a port.
+	return AccessEntry{
+		Type:    parts[0],
+		Name:    strings.Join(parts[1:len(parts)-1], ":"),
+		Actions: strings.Split(parts[len(parts)-1], ","),
+	}, nil
+}
+
+// allows returns true when the entries grant the action on the resource.
+func allows(entries []AccessEntry, resourceType, name, action string) bool {
+	for _, entry := range entries {
+		if entry.Type != resourceType || entry.Name != name {
+			continue
+		}
+		for _, a := range entry.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiredAccess returns the resource and the action needed to perform a
+// registry request, or false when the request does not need authorization.
+func requiredAccess(r *http.Request) (resourceType, name, action string, ok bool) {
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		return "", "", "", false
+	}
+	if r.URL.Path == "/v2/_catalog" || r.URL.Path == "/api/owners" || strings.HasPrefix(r.URL.Path, "/api/owners/") {
+		return "registry", "catalog", "*", true
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return "admin", strings.TrimPrefix(r.URL.Path, "/admin/"), actionAdmin, true
+	}
+
+	if r.URL.Path == "/api/import" {
+		return "repository", r.URL.Query().Get("repository"), actionPush, true
+	}
+	// All the routes of a repository under `/api/repos/<owner>/<name>`, e.g.
+	// its metadata, its README, its latest tag, the exports and deltas of its
+	// images, their provenance or the history of its tags, read it.
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) >= 5 && parts[1] == "api" && parts[2] == "repos" && parts[3] != "" && parts[4] != "" {
+		return "repository", parts[3] + "/" + parts[4], actionPull, true
+	}
+
+	name, ok = repositoryFromPath(r.URL.Path)
+	if !ok {
+		return "", "", "", false
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		action = actionPull
+	case "DELETE":
+		action = actionDelete
+	default:
+		action = actionPush
+	}
+
+	return "repository", name, action, true
+}
+
+// adminEnabled returns true when the admin endpoints are restricted to some
+// clients, by an explicit grant of the admin action to authenticated clients
+// (an ACL or a policy plugin) or by the networks allowed to use the admin API.
+// Otherwise, they would be open to every client, or to every authenticated
+// client.
+func (p *containerProxy) adminEnabled() bool {
+	return p.adminGranted && len(p.authenticators) > 0 || len(p.ipRules[routeFamilyAdmin].allow) > 0
+}
+
+// disableAdmin is a middleware rejecting the requests of the admin endpoints
+// when they are not enabled, see adminEnabled.
+func disableAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			Veto(w, http.StatusNotFound, ERROR_UNSUPPORTED, "the admin endpoints are disabled without admin grant or ADMIN_ALLOWED_CIDRS")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizer decides whether an identity can perform an action on a
+// repository, unless the identity presented a token minted by the proxy.
+type authorizer func(identity *Identity, name, action string) bool
+
+// allowAuthenticated is the default authorizer, granting everything to
+// authenticated clients.
+func allowAuthenticated(identity *Identity, name, action string) bool {
+	return identity != nil
+}
+
+// isAllowed returns true when the identity can perform the action.
+func (p *containerProxy) isAllowed(identity *Identity, resourceType, name, action string) bool {
+	if identity.Access != nil {
+		return allows(identity.Access, resourceType, name, action)
+	}
+	if identity.Method == methodAnonymous {
+		// The catalog is filtered for anonymous clients.
+		return resourceType == "registry" || (action == actionPull && p.anonymousCanPull(name))
+	}
+	if (identity.Method == methodServiceAccount || identity.Method == methodGitHubActions) && (action != actionPull && resourceType == "repository" || resourceType == "admin") {
+		// Service account and GitHub Actions tokens are pull credentials only.
+		return false
+	}
+	if resourceType == "registry" {
+		return true
+	}
+	if identity.Method == methodAPIKey {
+		for _, rule := range identity.scopes {
+			if rule.allows(name, action) {
+				return true
+			}
+		}
+		return false
+	}
+	return p.authorize(identity, name, action)
+}
+
+// canPull returns true when the client of a request can pull a repository,
+// which filters the lists of repositories returned to the client.
+func (p *containerProxy) canPull(r *http.Request, name string) bool {
+	identity := IdentityFromContext(r.Context())
+	return identity == nil || p.isAllowed(identity, "repository", name, actionPull)
+}
+
+// identify returns the identity of the client, trying each authenticator in
+// order.
+func (p *containerProxy) identify(r *http.Request) (*Identity, error) {
+	for _, authenticator := range p.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+	return nil, nil
+}
+
+// challenge asks the client to authenticate with the token endpoint of the
+// proxy. Without token endpoint, the client is asked to send its credentials
+// (e.g. a service account token) with basic authentication.
+func (p *containerProxy) challenge(w http.ResponseWriter, r *http.Request, scope, errorCode string) {
+	if p.tokens != nil {
+		params := fmt.Sprintf(`Bearer realm="%s",service="%s"`, p.tokenRealm(r), p.tokens.service)
+		if scope != "" {
+			params += fmt.Sprintf(`,scope="%s"`, scope)
+		}
+		if errorCode != "" {
+			params += fmt.Sprintf(`,error="%s"`, errorCode)
+		}
+		w.Header().Set("WWW-Authenticate", params)
+	} else {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, defaultTokenService))
+	}
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	Veto(w, http.StatusUnauthorized, ERROR_UNAUTHORIZED, "authentication required")
+}
+
+// authenticate is a middleware enforcing authentication on the registry API
+// and the proxy API when authenticators are configured.
+func (p *containerProxy) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2") && !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		resourceType, name, action, needsAccess := requiredAccess(r)
+		scope := ""
+		if needsAccess {
+			scope = fmt.Sprintf("%s:%s:%s", resourceType, name, action)
+		}
+
+		identity, err := p.identify(r)
+		if err != nil {
+			log.Printf("WARN authentication failed for %s %s: %s", r.Method, r.URL, err)
+			p.challenge(w, r, scope, "invalid_token")
+			return
+		}
+		if identity == nil {
+			// The anonymous clients can check their identity too.
+			anonymousAllowed := r.URL.Path == whoamiPath || needsAccess && p.isAllowed(anonymousIdentity, resourceType, name, action)
+			if len(p.anonymousRead) == 0 || !anonymousAllowed {
+				p.challenge(w, r, scope, "")
+				return
+			}
+			identity = anonymousIdentity
+		}
+
+		if needsAccess && !p.isAllowed(identity, resourceType, name, action) {
+			if identity.Access != nil || identity.Method == methodAnonymous {
+				// Let the client request a token with the right scope.
+				p.challenge(w, r, scope, "insufficient_scope")
+				return
+			}
+			Veto(w, http.StatusForbidden, ERROR_DENIED, fmt.Sprintf("%s is not allowed to %s %s", identity.Subject, action, name))
+			return
+		}
+
+		if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+			// The API version check is answered by the proxy since the upstream
+			// registry does not know the clients.
+			w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
+	})
+}
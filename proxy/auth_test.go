@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+// fakeOIDCProvider is an OpenID Connect provider signing ID tokens with an RSA
+// key.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	// kid is the key ID set in the header of the tokens.
+	kid string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOIDCProvider{key: key, kid: "some-key"}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":"%s","jwks_uri":"%s/jwks"}`, p.URL, p.URL)
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{
+					{
+						"kty": "RSA",
+						"kid": "some-key",
+						"use": "sig",
+						"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+						"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+					},
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return p
+}
+
+// Sign returns an RS256 ID token with default claims for the fake provider.
+func (p *fakeOIDCProvider) Sign(t *testing.T, claims map[string]interface{}) string {
+	all := map[string]interface{}{
+		"iss": p.URL,
+		"aud": "some-audience",
+		"sub": "some-user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": p.kid})
+	payload, _ := json.Marshal(all)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func requestToken(t *testing.T, handler http.Handler, idToken string, scopes ...string) (int, string) {
+	query := url.Values{"service": {defaultTokenService}, "scope": scopes}
+	req, _ := http.NewRequest("GET", "/token?"+query.Encode(), nil)
+	req.SetBasicAuth("some-user", idToken)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	return res.Code, body.Token
+}
+
+func TestTokenAuth(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	var upstreamAuthorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuthorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		WithTokenRealm("https://proxy.example.com/token"),
+	)
+
+	// Unauthenticated clients are challenged.
+	req, _ := http.NewRequest("GET", "/v2/", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+	expectedChallenge := `Bearer realm="https://proxy.example.com/token",service="container-registry-proxy"`
+	if res.Header().Get("WWW-Authenticate") != expectedChallenge {
+		t.Fatalf("expected: %s, got: %s", expectedChallenge, res.Header().Get("WWW-Authenticate"))
+	}
+
+	// Invalid ID tokens are rejected.
+	otherProvider := newFakeOIDCProvider(t)
+	defer otherProvider.Close()
+	if code, _ := requestToken(t, proxy.Handler, otherProvider.Sign(t, nil), "repository:some-owner/some-package:pull"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code, _ := requestToken(t, proxy.Handler, provider.Sign(t, map[string]interface{}{"aud": "other"}), "repository:some-owner/some-package:pull"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+	if code, _ := requestToken(t, proxy.Handler, provider.Sign(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), "repository:some-owner/some-package:pull"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+
+	code, token := requestToken(t, proxy.Handler, provider.Sign(t, nil), "repository:some-owner/some-package:pull")
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("expected a token, got: %d", code)
+	}
+
+	// The tokens without key ID are verified with the single cached key.
+	provider.kid = ""
+	if code, _ := requestToken(t, proxy.Handler, provider.Sign(t, nil), "repository:some-owner/some-package:pull"); code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, code)
+	}
+	provider.kid = "some-key"
+
+	// The tokens are rejected when no audience is configured.
+	noAudience := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "", "")),
+	)
+	if code, _ := requestToken(t, noAudience.Handler, provider.Sign(t, nil), "repository:some-owner/some-package:pull"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+
+	// The token grants the requested scope only.
+	for _, tc := range []struct {
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{method: "GET", path: "/v2/", expectedStatusCode: 200},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/latest", expectedStatusCode: 200},
+		{method: "PUT", path: "/v2/some-owner/some-package/manifests/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/some-owner/other-package/manifests/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/v2/_catalog", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/some-package", expectedStatusCode: 200},
+		// The API routes of the other repositories are denied too.
+		{method: "GET", path: "/api/repos/some-owner/other-package", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/tags/latest", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/readme", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/latest/export", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/latest/delta", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/latest/provenance", expectedStatusCode: 401},
+		{method: "GET", path: "/api/repos/some-owner/other-package/tags/latest/history", expectedStatusCode: 401},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if res.Code == http.StatusUnauthorized && !strings.Contains(res.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+			t.Fatalf("%s %s: expected an insufficient scope error, got: %s", tc.method, tc.path, res.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// The token of the client is not sent upstream.
+	if upstreamAuthorization != "" {
+		t.Fatalf("expected no upstream credentials, got: %s", upstreamAuthorization)
+	}
+
+	// Tokens minted by the proxy cannot be exchanged.
+	if code, _ := requestToken(t, proxy.Handler, token, "repository:some-owner/some-package:push"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		"http://127.0.0.1/upstream",
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+	)
+
+	form := url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {provider.Sign(t, map[string]interface{}{"sub": "some-service"})},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:id_token"},
+		"scope":              {"repository:some-owner/some-package:pull repository:some-owner/other-package:pull"},
+	}
+	req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	json.NewDecoder(res.Body).Decode(&body)
+	if body.ExpiresIn != 60 {
+		t.Fatalf("expected: 60, got: %d", body.ExpiresIn)
+	}
+
+	claims, err := auth.UnverifiedClaims(body.AccessToken)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if claims.String("sub") != "some-service" {
+		t.Fatalf("unexpected subject: %s", claims.String("sub"))
+	}
+	if access := claims["access"].([]interface{}); len(access) != 2 {
+		t.Fatalf("unexpected access: %v", access)
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	entry, err := parseScope("repository:localhost:5000/owner/name:pull,push")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if entry.Type != "repository" || entry.Name != "localhost:5000/owner/name" || strings.Join(entry.Actions, ",") != "pull,push" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+
+	if _, err := parseScope("repository"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
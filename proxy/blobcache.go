@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+var blobCacheRequestsTotal = newCounterVec(
+	"blob_cache_requests_total",
+	"Number of blob requests by cache result (hit, miss, coalesced, bypass) and namespace.",
+	"result", "namespace",
+)
+
+// bestEffortWriter writes to w until the first error, e.g. when the disk is
+// full, without failing the copy to the client.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *bestEffortWriter) Write(b []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// WithBlobCache caches the blobs pulled from the upstream registry in dir.
+// Virtual registries use a sub-directory of dir.
+func WithBlobCache(dir string) Option {
+	return func(p *containerProxy) {
+		p.blobCache = cache.New(dir)
+	}
+}
+
+// serveCachedBlob serves a cached blob, including the Range requests used to
+// resume interrupted downloads.
+func serveCachedBlob(w http.ResponseWriter, r *http.Request, digest string, f *os.File, info os.FileInfo) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, digest))
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	// ServeContent handles HEAD, Range and If-Range (with the ETag).
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// upstreamBlobRequest returns a request for a blob to the upstream registry.
+// The credentials of the client are forwarded unless the clients authenticate
+// with the proxy, in which case the transport of blobClient uses the
+// credentials of the proxy.
+func (p *containerProxy) upstreamBlobRequest(r *http.Request, method string) (*http.Request, error) {
+	u := *p.upstreamURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(r.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.authenticators) == 0 {
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+	}
+
+	return req, nil
+}
+
+// cachedRepositoryKey returns the key under which the repository of the
+// request r is recorded for the cached blobs and manifests it can read: the
+// repository when the clients authenticate with the proxy, which authorizes
+// them, and the repository with a hash of the credentials of the client
+// otherwise, since the upstream registry authorized these credentials.
+func (p *containerProxy) cachedRepositoryKey(r *http.Request, name string) string {
+	if len(p.authenticators) > 0 {
+		return p.prefixedName(name)
+	}
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return p.prefixedName(name) + " " + hex.EncodeToString(sum[:16])
+}
+
+// recordCachedRepository records that the client of the request r read a
+// cached blob or manifest, see cachedRepositoryKey.
+func (p *containerProxy) recordCachedRepository(r *http.Request, name, digest string) {
+	if err := p.blobCache.RecordRepository(digest, p.cachedRepositoryKey(r, name)); err != nil {
+		log.Printf("WARN repository of blob %s not recorded: %s", digest, err)
+	}
+}
+
+// canReadCachedBlob returns true when the client is allowed to read a blob of
+// the repository of the request. The cache is keyed by digest, so the
+// upstream registry is asked whether the blob belongs to the repository: with
+// the credentials of the client, or with the ones of the proxy when the
+// clients authenticate with it, in which case the recorded repositories of
+// the blob are enough since the proxy already authorized the client. In
+// maintenance mode, the upstream registry is not asked and only the recorded
+// repositories are checked.
+func (p *containerProxy) canReadCachedBlob(r *http.Request) bool {
+	name, _, digest, ok := splitRegistryPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	// The upstream registry only knows the source of a derived blob.
+	if source, ok := p.blobCache.DerivedSource(digest); ok {
+		digest = source
+		r = r.Clone(r.Context())
+		r.URL.Path = "/v2/" + name + "/blobs/" + source
+	}
+	if len(p.authenticators) > 0 || p.inMaintenance() {
+		if p.blobCache.InRepository(digest, p.cachedRepositoryKey(r, name)) {
+			return true
+		}
+		if p.inMaintenance() {
+			return false
+		}
+	}
+
+	req, err := p.upstreamBlobRequest(r, "HEAD")
+	if err != nil {
+		return false
+	}
+	res, err := p.blobClient.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return false
+	}
+	p.recordCachedRepository(r, name, digest)
+	return true
+}
+
+// cacheBlobs is a middleware serving the blobs from the cache, and adding the
+// blobs pulled from the upstream registry to the cache. Range requests for
+// blobs that are not cached are passed through to the upstream registry.
+func (p *containerProxy) cacheBlobs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, digest, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "blobs" || (r.Method != "GET" && r.Method != "HEAD") || !cache.IsCacheableDigest(digest) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if f, info, err := p.blobCache.Open(digest); err == nil {
+			defer f.Close()
+			if p.canReadCachedBlob(r) {
+				blobCacheRequestsTotal.Inc("hit", p.metricNamespace(r))
+				p.publishEvent(r, Event{Type: eventCache, Repository: name, Digest: digest, Result: "hit"})
+				serveCachedBlob(w, r, digest, f, info)
+				return
+			}
+			// Let the upstream registry answer with the right error.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "HEAD" || r.Header.Get("Range") != "" || p.blobCache.UnderPressure(0) {
+			blobCacheRequestsTotal.Inc("bypass", p.metricNamespace(r))
+			p.publishEvent(r, Event{Type: eventCache, Repository: name, Digest: digest, Result: "bypass"})
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		flight, leader := p.blobCache.StartFlight(digest)
+		if !leader {
+			if p.canReadCachedBlob(r) && serveBlobFlight(w, r, digest, flight) {
+				blobCacheRequestsTotal.Inc("coalesced", p.metricNamespace(r))
+				p.publishEvent(r, Event{Type: eventCache, Repository: name, Digest: digest, Result: "coalesced"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer p.blobCache.EndFlight(digest, flight)
+
+		blobCacheRequestsTotal.Inc("miss", p.metricNamespace(r))
+		p.publishEvent(r, Event{Type: eventCache, Repository: name, Digest: digest, Result: "miss"})
+		if p.peers != nil && p.fillBlobCacheFromPeer(w, r, digest) {
+			return
+		}
+		if !p.fillBlobCache(w, p.blobClient, r, digest) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// fillBlobCache fetches a blob from the upstream registry with client and adds
+// it to the cache while streaming it to the client. It returns false when
+// nothing was sent to the client, e.g. when the upstream registry returned an
+// error. The blob is recorded in the repository of the request, which served
+// it.
+func (p *containerProxy) fillBlobCache(w http.ResponseWriter, client *http.Client, r *http.Request, digest string) (sent bool) {
+	defer func() {
+		if name, _, _, ok := splitRegistryPath(r.URL.Path); ok && sent && p.blobCache.Has(digest) {
+			p.recordCachedRepository(r, name, digest)
+		}
+	}()
+	if p.blobFetch.concurrency > 1 && p.fetchBlobInChunks(w, client, r, digest) {
+		return true
+	}
+
+	req, err := p.upstreamBlobRequest(r, "GET")
+	if err != nil {
+		return false
+	}
+	ctx, cancel := p.transferContext(r)
+	defer cancel()
+	// The client follows the redirects to the blob storage.
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Printf("WARN blob cache fill %s failed: %s", digest, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	res.Body = &activityReader{ReadCloser: res.Body, ctx: ctx}
+
+	return p.copyBlobIntoCache(w, res, digest)
+}
+
+// copyBlobIntoCache streams a blob from a successful response to the client
+// while adding it to the cache. It returns false when nothing was sent to the
+// client.
+func (p *containerProxy) copyBlobIntoCache(w http.ResponseWriter, res *http.Response, digest string) bool {
+	writer, err := p.blobCache.Create(digest, res.ContentLength)
+	if err != nil {
+		log.Printf("WARN blob cache fill %s failed: %s", digest, err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	if res.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(res.ContentLength))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	cache := &bestEffortWriter{w: writer}
+	if _, err := io.Copy(w, io.TeeReader(res.Body, cache)); err != nil {
+		log.Printf("WARN blob %s not cached: %s", digest, err)
+		writer.Abort()
+		return true
+	}
+	if cache.err != nil {
+		log.Printf("WARN blob %s not cached: %s", digest, cache.err)
+		writer.Abort()
+		return true
+	}
+	if err := writer.Commit(); err != nil {
+		log.Printf("WARN blob %s not cached: %s", digest, err)
+	}
+
+	return true
+}
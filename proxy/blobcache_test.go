@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fakeBlobRegistry is an upstream registry redirecting the blob downloads to
+// a storage, like GHCR.
+type fakeBlobRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	requests  []string
+}
+
+func newFakeBlobRegistry(blobs map[string][]byte) *fakeBlobRegistry {
+	registry := &fakeBlobRegistry{blobs: blobs}
+	registry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.mu.Lock()
+		registry.requests = append(registry.requests, r.Method+" "+r.URL.Path)
+		registry.mu.Unlock()
+
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"good"}`))
+			return
+		}
+		if digest, ok := strings.CutPrefix(r.URL.Path, "/storage/"); ok {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(registry.blobs[digest]))
+			return
+		}
+
+		_, kind, digest, ok := splitRegistryPath(r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if ok && kind == "manifests" {
+			// The manifests are served by tag and by digest.
+			for reference, body := range registry.manifests {
+				if reference == digest || digestOf(body) == digest {
+					var m manifest
+					json.Unmarshal(body, &m)
+					w.Header().Set("Content-Type", m.MediaType)
+					w.Write(body)
+					return
+				}
+			}
+		}
+		if !ok || kind != "blobs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, ok := registry.blobs[digest]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/storage/"+digest, http.StatusTemporaryRedirect)
+	}))
+
+	return registry
+}
+
+func (r *fakeBlobRegistry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+func TestBlobCache(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	digest := digestOf(content)
+	corrupted := "sha256:" + strings.Repeat("a", 64)
+	upstream := newFakeBlobRegistry(map[string][]byte{digest: content, corrupted: []byte("corrupted")})
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(dir),
+	)
+	blobPath := "/v2/some-owner/some-package/blobs/" + digest
+
+	get := func(path, authorization, rangeHeader string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	// Range requests for blobs that are not cached are passed through.
+	res := get(blobPath, "Bearer good", "bytes=10-19")
+	if res.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected: %d, got: %d", http.StatusTemporaryRedirect, res.Code)
+	}
+	if _, err := os.Stat(cache.New(dir).Path(digest)); err == nil {
+		t.Fatal("expected the blob not to be cached")
+	}
+
+	// The first download fills the cache.
+	res = get(blobPath, "Bearer good", "")
+	if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("expected the blob, got: %d", res.Code)
+	}
+	if res.Header().Get("Docker-Content-Digest") != digest {
+		t.Fatalf("expected: %s, got: %s", digest, res.Header().Get("Docker-Content-Digest"))
+	}
+	if _, err := os.Stat(cache.New(dir).Path(digest)); err != nil {
+		t.Fatalf("expected the blob to be cached, got: %s", err)
+	}
+
+	// Cached blobs are served locally, including Range requests.
+	before := len(upstream.Requests())
+	res = get(blobPath, "Bearer good", "bytes=10-19")
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("expected: %d, got: %d", http.StatusPartialContent, res.Code)
+	}
+	if res.Body.String() != "0123456789" {
+		t.Fatalf("expected: 0123456789, got: %s", res.Body.String())
+	}
+	if expected := fmt.Sprintf("bytes 10-19/%d", len(content)); res.Header().Get("Content-Range") != expected {
+		t.Fatalf("expected: %s, got: %s", expected, res.Header().Get("Content-Range"))
+	}
+	// Only the access of the client is checked upstream.
+	for _, request := range upstream.Requests()[before:] {
+		if !strings.HasPrefix(request, "HEAD ") {
+			t.Fatalf("unexpected upstream request: %s", request)
+		}
+	}
+
+	// Clients that cannot read the blob upstream cannot read it from the cache.
+	res = get(blobPath, "Bearer bad", "")
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	// Blobs not matching their digest are not cached.
+	res = get("/v2/some-owner/some-package/blobs/"+corrupted, "Bearer good", "")
+	if res.Body.String() != "corrupted" {
+		t.Fatalf("expected: corrupted, got: %s", res.Body.String())
+	}
+	if _, err := os.Stat(cache.New(dir).Path(corrupted)); err == nil {
+		t.Fatal("expected the blob not to be cached")
+	}
+
+	hit := blobCacheRequestsTotal.Value("hit", "some-owner")
+	miss := blobCacheRequestsTotal.Value("miss", "some-owner")
+	bypass := blobCacheRequestsTotal.Value("bypass", "some-owner")
+	if hit < 1 || miss < 2 || bypass < 1 {
+		t.Fatalf("unexpected metrics: hit=%g miss=%g bypass=%g", hit, miss, bypass)
+	}
+}
+
+func TestBlobCacheRepositories(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	content := []byte("some private blob")
+	digest := digestOf(content)
+	var mu sync.Mutex
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		// The blob only belongs to some-owner/a.
+		if r.URL.Path != "/v2/some-owner/a/blobs/"+digest {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		WithBlobCache(t.TempDir()),
+	)
+	token := provider.Sign(t, nil)
+
+	pull := func(name string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v2/"+name+"/blobs/"+digest, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := pull("some-owner/a"); res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("expected the blob, got: %d", res.Code)
+	}
+	// The cached blob is not served for another repository.
+	if res := pull("some-owner/b"); res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+
+	// The repository of the cached blob is known without asking upstream.
+	mu.Lock()
+	before := len(requests)
+	mu.Unlock()
+	if res := pull("some-owner/a"); res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("expected the blob, got: %d", res.Code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != before {
+		t.Fatalf("unexpected upstream requests: %v", requests[before:])
+	}
+}
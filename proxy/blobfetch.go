@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// defaultBlobFetchChunkSize is the size of the byte ranges fetched in parallel
+// when no chunk size is configured.
+const defaultBlobFetchChunkSize = 16 * 1000 * 1000
+
+// blobFetch configures the parallel fetching of the blobs added to the cache.
+type blobFetch struct {
+	chunkSize   int64
+	concurrency int
+}
+
+// WithParallelBlobFetch fetches the blobs added to the cache in byte ranges of
+// chunkSize bytes, with up to concurrency requests at once. A single stream
+// from the upstream registry is often much slower than the available
+// bandwidth.
+func WithParallelBlobFetch(chunkSize int64, concurrency int) Option {
+	return func(p *containerProxy) {
+		if chunkSize <= 0 {
+			chunkSize = defaultBlobFetchChunkSize
+		}
+		p.blobFetch = blobFetch{chunkSize: chunkSize, concurrency: concurrency}
+	}
+}
+
+// parseContentRange parses a `Content-Range` header, e.g. `bytes 0-99/1000`.
+func parseContentRange(value string) (start, end, size int64, err error) {
+	raw, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	rangeValue, sizeValue, ok := strings.Cut(raw, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	startValue, endValue, ok := strings.Cut(rangeValue, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+
+	if start, err = strconv.ParseInt(startValue, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	if end, err = strconv.ParseInt(endValue, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	if size, err = strconv.ParseInt(sizeValue, 10, 64); err != nil || size <= end {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+
+	return start, end, size, nil
+}
+
+// chunkEnd returns the last byte of the chunk starting at start.
+func chunkEnd(start, chunkSize, size int64) int64 {
+	if end := start + chunkSize - 1; end < size {
+		return end
+	}
+	return size - 1
+}
+
+// fetchBlobRange requests a byte range of a blob to the upstream registry.
+func (p *containerProxy) fetchBlobRange(ctx context.Context, client *http.Client, r *http.Request, start, end int64) (*http.Response, error) {
+	req, err := p.upstreamBlobRequest(r, "GET")
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &activityReader{ReadCloser: res.Body, ctx: ctx}
+	return res, nil
+}
+
+// fetchBlobChunk writes a byte range of a blob at its offset in the cache
+// writer.
+func (p *containerProxy) fetchBlobChunk(ctx context.Context, client *http.Client, r *http.Request, writer *cache.Writer, start, end int64) error {
+	res, err := p.fetchBlobRange(ctx, client, r, start, end)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status for bytes %d-%d: %d", start, end, res.StatusCode)
+	}
+	if actualStart, actualEnd, _, err := parseContentRange(res.Header.Get("Content-Range")); err != nil {
+		return err
+	} else if actualStart != start || actualEnd != end {
+		return fmt.Errorf("unexpected range: expected bytes %d-%d, got bytes %d-%d", start, end, actualStart, actualEnd)
+	}
+
+	return writer.WriteChunk(res.Body, start, end-start+1)
+}
+
+// fetchBlobInChunks adds a blob to the cache by fetching byte ranges in
+// parallel, and streams the chunks to the client in order as soon as they are
+// fetched. It returns false when nothing was sent to the client, e.g. because
+// the upstream registry does not support Range requests. The chunks are
+// fetched until the transfer stalls, however long the blob takes.
+func (p *containerProxy) fetchBlobInChunks(w http.ResponseWriter, client *http.Client, r *http.Request, digest string) bool {
+	ctx, cancel := p.transferContext(r)
+	defer cancel()
+
+	chunkSize := p.blobFetch.chunkSize
+	first, err := p.fetchBlobRange(ctx, client, r, 0, chunkSize-1)
+	if err != nil {
+		log.Printf("WARN blob cache fill %s failed: %s", digest, err)
+		return false
+	}
+	_, firstEnd, size, err := parseContentRange(first.Header.Get("Content-Range"))
+	if first.StatusCode != http.StatusPartialContent || err != nil || firstEnd != chunkEnd(0, chunkSize, size) {
+		first.Body.Close()
+		return false
+	}
+
+	writer, err := p.blobCache.Create(digest, size)
+	if err != nil {
+		first.Body.Close()
+		log.Printf("WARN blob cache fill %s failed: %s", digest, err)
+		return false
+	}
+
+	chunks := int((size + chunkSize - 1) / chunkSize)
+	done := make([]chan error, chunks)
+	for i := range done {
+		done[i] = make(chan error, 1)
+	}
+
+	sem := make(chan struct{}, p.blobFetch.concurrency)
+	sem <- struct{}{}
+	go func() {
+		defer func() { <-sem }()
+		defer first.Body.Close()
+		done[0] <- writer.WriteChunk(first.Body, 0, firstEnd+1)
+	}()
+	go func() {
+		for i := 1; i < chunks; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(i int) {
+				defer func() { <-sem }()
+				start := int64(i) * chunkSize
+				done[i] <- p.fetchBlobChunk(ctx, client, r, writer, start, chunkEnd(start, chunkSize, size))
+			}(i)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	w.WriteHeader(http.StatusOK)
+
+	for i := 0; i < chunks; i++ {
+		select {
+		case err = <-done[i]:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err == nil {
+			start := int64(i) * chunkSize
+			_, err = io.Copy(w, writer.Chunk(start, chunkEnd(start, chunkSize, size)-start+1))
+		}
+		if err != nil {
+			log.Printf("WARN blob %s not cached: %s", digest, err)
+			cancel()
+			writer.Abort()
+			return true
+		}
+	}
+
+	if err := writer.Commit(); err != nil {
+		log.Printf("WARN blob %s not cached: %s", digest, err)
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestParseContentRange(t *testing.T) {
+	start, end, size, err := parseContentRange("bytes 100-199/1000")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if start != 100 || end != 199 || size != 1000 {
+		t.Fatalf("unexpected range: %d-%d/%d", start, end, size)
+	}
+
+	for _, value := range []string{"", "bytes */1000", "bytes 0-99/*", "bytes 99-0/1000", "bytes 0-1000/1000", "items 0-1/2"} {
+		if _, _, _, err := parseContentRange(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestParallelBlobFetch(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1050)
+	digest := digestOf(content)
+	upstream := newFakeBlobRegistry(map[string][]byte{digest: content})
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(dir),
+		WithParallelBlobFetch(1000, 3),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+	req.Header.Set("Authorization", "Bearer good")
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	if !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatal("expected the content of the blob")
+	}
+	if res.Header().Get("Content-Length") != "10500" {
+		t.Fatalf("expected: 10500, got: %s", res.Header().Get("Content-Length"))
+	}
+	if _, err := os.Stat(cache.New(dir).Path(digest)); err != nil {
+		t.Fatalf("expected the blob to be cached, got: %s", err)
+	}
+
+	chunks := 0
+	for _, request := range upstream.Requests() {
+		if strings.HasPrefix(request, "GET /storage/") {
+			chunks++
+		}
+	}
+	if chunks != 11 {
+		t.Fatalf("expected: 11, got: %d", chunks)
+	}
+}
+
+func TestParallelBlobFetchWithoutRangeSupport(t *testing.T) {
+	content := []byte("some content")
+	digest := digestOf(content)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ignore the Range header.
+		w.Write(content)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(dir),
+		WithParallelBlobFetch(4, 2),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Body.String() != string(content) {
+		t.Fatalf("expected: %s, got: %s", content, res.Body.String())
+	}
+	if _, err := os.Stat(cache.New(dir).Path(digest)); err != nil {
+		t.Fatalf("expected the blob to be cached, got: %s", err)
+	}
+}
+
+func TestParallelBlobFetchSlowerThanTimeout(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	digest := digestOf(content)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		// Each chunk takes 200ms, longer than the timeout, while progressing.
+		for i := start; i <= end; i += 100 {
+			time.Sleep(20 * time.Millisecond)
+			w.Write(content[i : i+100])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	dir := t.TempDir()
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(dir),
+		WithParallelBlobFetch(1000, 2),
+		WithUpstreamSettings(UpstreamSettings{Upstream: host, Timeout: "100ms"}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("expected the content of the blob, got: %d bytes", res.Body.Len())
+	}
+	if _, err := os.Stat(cache.New(dir).Path(digest)); err != nil {
+		t.Fatalf("expected the blob to be cached, got: %s", err)
+	}
+}
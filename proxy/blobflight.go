@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// serveBlobFlight streams a blob to the client while it is fetched by another
+// request. It returns false when nothing was sent to the client.
+func serveBlobFlight(w http.ResponseWriter, r *http.Request, digest string, flight *cache.Flight) bool {
+	ctx := r.Context()
+	// Wake up the waits below when the client goes away.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			flight.Wake()
+		case <-stop:
+		}
+	}()
+
+	f, size := flight.Open(ctx)
+	if f == nil {
+		return false
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	if size >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var offset int64
+	for {
+		written, done, cached := flight.Wait(ctx, offset)
+		if ctx.Err() != nil {
+			return true
+		}
+		if written > offset {
+			n, err := io.Copy(w, io.NewSectionReader(f, offset, written-offset))
+			offset += n
+			if err != nil {
+				return true
+			}
+			continue
+		}
+		if done {
+			if !cached {
+				log.Printf("WARN blob %s fetched by another request failed", digest)
+			}
+			return true
+		}
+	}
+}
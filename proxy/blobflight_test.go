@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestCoalescedBlobFetches(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	digest := digestOf(content)
+
+	var downloads int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/storage/") {
+			if r.Method == "GET" {
+				atomic.AddInt32(&downloads, 1)
+				w.Header().Set("Content-Length", "100000")
+				w.Write(content[:50000])
+				w.(http.Flusher).Flush()
+				close(started)
+				<-release
+				w.Write(content[50000:])
+			}
+			return
+		}
+		http.Redirect(w, r, "/storage/"+digest, http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+
+	cache := cache.New(t.TempDir())
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(cache.Dir()),
+	)
+
+	pull := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = pull()
+	}()
+
+	<-started
+	for i := 1; i < len(responses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = pull()
+		}(i)
+	}
+	// Let the other requests join the fetch in progress.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, res := range responses {
+		if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+			t.Fatalf("request %d: expected the blob, got: %d (%d bytes)", i, res.Code, res.Body.Len())
+		}
+		if res.Header().Get("Content-Length") != "100000" {
+			t.Fatalf("request %d: expected: 100000, got: %s", i, res.Header().Get("Content-Length"))
+		}
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Fatalf("expected: 1, got: %d", n)
+	}
+	if !cache.Has(digest) {
+		t.Fatal("expected the blob to be cached")
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// CachedBlobs lists the blobs of the cache, oldest first.
+func (p *containerProxy) CachedBlobs(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CachedBlobs Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	blobs, err := p.blobCache.List()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+		return
+	}
+	var size int64
+	for _, blob := range blobs {
+		size += blob.Size
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Count int          `json:"count"`
+		Size  int64        `json:"size"`
+		Blobs []cache.Blob `json:"blobs"`
+	}{len(blobs), size, blobs})
+}
+
+// RemoveCachedBlob removes a blob from the cache, e.g. a corrupted layer, which
+// is fetched again from the upstream registry on the next pull.
+func (p *containerProxy) RemoveCachedBlob(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RemoveCachedBlob Request %s -> %s", r.Method, r.URL)
+
+	digest := chi.URLParam(r, "digest")
+	if err := p.blobCache.Remove(digest); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			Veto(w, http.StatusNotFound, ERROR_BLOB_UNKNOWN, fmt.Sprintf("blob %s not cached", digest))
+			return
+		}
+		Veto(w, http.StatusInternalServerError, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	p.audit(r, "cache-remove", digest, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CollectCachedBlobs runs the garbage collection of the blob cache with the
+// `max_age` (a duration) and `max_size` (a size, see ParseSize) parameters.
+func (p *containerProxy) CollectCachedBlobs(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CollectCachedBlobs Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	var maxAge time.Duration
+	var maxSize int64
+	var err error
+	if value := r.URL.Query().Get("max_age"); value != "" {
+		if maxAge, err = parseAge(value); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid max_age: %s", err)))
+			return
+		}
+	}
+	if value := r.URL.Query().Get("max_size"); value != "" {
+		if maxSize, err = ParseSize(value); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid max_size: %s", err)))
+			return
+		}
+	}
+
+	removed, freed, err := p.blobCache.GC(maxAge, maxSize)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+		return
+	}
+	p.audit(r, "cache-gc", "blob-cache", fmt.Sprintf("%d blobs removed (%d bytes)", removed, freed))
+
+	json.NewEncoder(w).Encode(struct {
+		Removed int   `json:"removed"`
+		Freed   int64 `json:"freed"`
+	}{removed, freed})
+}
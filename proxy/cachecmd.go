@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// cacheClient calls the admin API of the blob cache of a proxy.
+type cacheClient struct {
+	client  *http.Client
+	baseURL *url.URL
+	// token is sent as bearer token, e.g. an API key with the admin action.
+	token  string
+	out    io.Writer
+	asJSON bool
+}
+
+// do sends a request to the admin API and decodes its JSON response into v,
+// unless it is nil.
+func (c *cacheClient) do(method, path string, body interface{}, v interface{}) error {
+	u, err := c.baseURL.Parse(path)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		var errs apiErrors
+		if json.Unmarshal(data, &errs) == nil && len(errs.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s", method, path, errs.Errors[0].Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	if c.asJSON && len(data) > 0 {
+		c.out.Write(data)
+		return nil
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c *cacheClient) list() error {
+	var response struct {
+		Count int          `json:"count"`
+		Size  int64        `json:"size"`
+		Blobs []cache.Blob `json:"blobs"`
+	}
+	if err := c.do("GET", "/admin/cache/blobs", nil, &response); err != nil || c.asJSON {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tSIZE\tCACHED AT")
+	for _, blob := range response.Blobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", blob.Digest, formatSize(blob.Size), blob.CachedAt.Format(time.RFC3339))
+	}
+	w.Flush()
+	fmt.Fprintf(c.out, "%d blobs, %s\n", response.Count, formatSize(response.Size))
+	return nil
+}
+
+func (c *cacheClient) warm(images []string) error {
+	if err := c.do("POST", "/admin/prefetch", prefetchRequest{Images: images}, nil); err != nil || c.asJSON {
+		return err
+	}
+	fmt.Fprintf(c.out, "prefetching %s\n", strings.Join(images, ", "))
+	return nil
+}
+
+func (c *cacheClient) remove(digests []string) error {
+	for _, digest := range digests {
+		if err := c.do("DELETE", "/admin/cache/blobs/"+digest, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "removed %s\n", digest)
+	}
+	return nil
+}
+
+func (c *cacheClient) gc(maxAge, maxSize string) error {
+	query := url.Values{}
+	if maxAge != "" {
+		query.Set("max_age", maxAge)
+	}
+	if maxSize != "" {
+		query.Set("max_size", maxSize)
+	}
+	var response struct {
+		Removed int   `json:"removed"`
+		Freed   int64 `json:"freed"`
+	}
+	if err := c.do("POST", "/admin/cache/gc?"+query.Encode(), nil, &response); err != nil || c.asJSON {
+		return err
+	}
+	fmt.Fprintf(c.out, "removed %d blobs (%s)\n", response.Removed, formatSize(response.Freed))
+	return nil
+}
+
+// runCacheCommand manages the blob cache of a running proxy with its admin
+// API: `cache ls`, `cache warm <image>...`, `cache rm <digest>...` and `cache
+// gc`.
+func runCacheCommand(args []string, out io.Writer) error {
+	usage := "usage: container-registry-proxy cache <ls|warm|rm|gc> [-url url] [-json] [-max-age age] [-max-size size] [image|digest...]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("cache "+command, flag.ExitOnError)
+	defaultURL := os.Getenv("PROXY_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:10000"
+	}
+	proxyURL := flags.String("url", defaultURL, "URL of the proxy (PROXY_URL), the API key or token being read from PROXY_TOKEN")
+	asJSON := flags.Bool("json", false, "print the responses of the admin API")
+	maxAge := flags.String("max-age", "", "gc: remove the blobs cached for longer than `age`, e.g. 30d")
+	maxSize := flags.String("max-size", "", "gc: remove the oldest blobs until the cache is smaller than `size`, e.g. 50G")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+
+	baseURL, err := url.Parse(*proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	client := &cacheClient{client: http.DefaultClient, baseURL: baseURL, token: os.Getenv("PROXY_TOKEN"), out: out, asJSON: *asJSON}
+
+	switch {
+	case command == "ls" && flags.NArg() == 0:
+		return client.list()
+	case command == "warm" && flags.NArg() > 0:
+		return client.warm(flags.Args())
+	case command == "rm" && flags.NArg() > 0:
+		return client.remove(flags.Args())
+	case command == "gc" && flags.NArg() == 0:
+		return client.gc(*maxAge, *maxSize)
+	}
+	flags.Usage()
+	os.Exit(2)
+	return nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestCacheCommand(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobCache(dir), withTestAdmin())
+	server := httptest.NewServer(proxy.Handler)
+	defer server.Close()
+
+	cache := cache.New(dir)
+	var digests []string
+	for i, content := range []string{"old blob", "new blob"} {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		w, err := cache.Create(digest, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		cachedAt := time.Now().Add(time.Duration(i-2) * 24 * time.Hour)
+		os.Chtimes(cache.Path(digest), cachedAt, cachedAt)
+		digests = append(digests, digest)
+	}
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		if err := runCacheCommand(append([]string{args[0], "-url", server.URL}, args[1:]...), &out); err != nil {
+			t.Fatalf("%v: %s", args, err)
+		}
+		return out.String()
+	}
+
+	if out := run("ls"); !strings.Contains(out, digests[0]) || !strings.HasSuffix(out, "2 blobs, 16B\n") {
+		t.Fatalf("unexpected ls output: %q", out)
+	}
+	if out := run("gc", "-max-age", "36h"); out != "removed 1 blobs (8B)\n" {
+		t.Fatalf("unexpected gc output: %q", out)
+	}
+	if cache.Has(digests[0]) || !cache.Has(digests[1]) {
+		t.Fatal("expected the oldest blob to be removed")
+	}
+	if out := run("rm", digests[1]); out != "removed "+digests[1]+"\n" {
+		t.Fatalf("unexpected rm output: %q", out)
+	}
+	if err := runCacheCommand([]string{"rm", "-url", server.URL, digests[1]}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "not cached") {
+		t.Fatalf("expected an error, got: %v", err)
+	}
+}
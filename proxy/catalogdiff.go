@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+// catalogDiff is the response of the /api/catalog/diff endpoint.
+type catalogDiff struct {
+	Since time.Time `json:"since"`
+	// From and To are the times of the snapshots compared, i.e. the content
+	// of the catalog at Since and the last one.
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	AddedRepositories   []string  `json:"added_repositories"`
+	RemovedRepositories []string  `json:"removed_repositories"`
+	// AddedTags and RemovedTags are the tags by repository, including the
+	// tags of the added and removed repositories.
+	AddedTags   map[string][]string `json:"added_tags"`
+	RemovedTags map[string][]string `json:"removed_tags"`
+}
+
+// recordCatalogSnapshot records the tags listed by a catalog refresh, by
+// repository, in the metadata database.
+func (p *containerProxy) recordCatalogSnapshot(current map[string]map[string]bool) {
+	snapshot := metadata.CatalogSnapshot{Catalog: p.pathPrefix, Time: time.Now().UTC(), Tags: map[string][]string{}}
+	for name, tags := range current {
+		snapshot.Tags[name] = []string{}
+		for tag := range tags {
+			snapshot.Tags[name] = append(snapshot.Tags[name], tag)
+		}
+	}
+	if _, err := p.metadata.RecordCatalogSnapshot(snapshot); err != nil {
+		log.Printf("WARN catalog snapshot not saved: %s", err)
+	}
+}
+
+// parseSince parses an RFC 3339 time or a Unix timestamp in seconds.
+func parseSince(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// CatalogDiff returns the repositories and tags added or removed since a time,
+// by comparing the snapshot of the catalog at that time with the last one, so
+// that the sync tools do not have to list the whole catalog.
+func (p *containerProxy) CatalogDiff(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CatalogDiff Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, "invalid since, expected an RFC 3339 time or a Unix timestamp"))
+		return
+	}
+	from, ok := p.metadata.CatalogSnapshotAt(p.pathPrefix, since)
+	if !ok {
+		// The oldest snapshot is more recent, the catalog has to be listed.
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("no catalog snapshot at %s", since.Format(time.RFC3339))))
+		return
+	}
+	to, _ := p.metadata.CatalogSnapshotAt(p.pathPrefix, time.Time{})
+
+	diff := catalogDiff{
+		Since:               since,
+		From:                from.Time,
+		To:                  to.Time,
+		AddedRepositories:   []string{},
+		RemovedRepositories: []string{},
+		AddedTags:           map[string][]string{},
+		RemovedTags:         map[string][]string{},
+	}
+	visible := func(name string) bool {
+		if p.pathPrefix != "" {
+			name = strings.TrimPrefix(name, p.pathPrefix+"/")
+		}
+		return p.canPull(r, name)
+	}
+	compare := func(a, b metadata.CatalogSnapshot, repositories *[]string, tags map[string][]string) {
+		for name, list := range a.Tags {
+			if !visible(name) {
+				continue
+			}
+			previous, ok := b.Tags[name]
+			if !ok {
+				*repositories = append(*repositories, name)
+			}
+			known := map[string]bool{}
+			for _, tag := range previous {
+				known[tag] = true
+			}
+			for _, tag := range list {
+				if !known[tag] {
+					tags[name] = append(tags[name], tag)
+				}
+			}
+		}
+		sort.Strings(*repositories)
+	}
+	compare(to, from, &diff.AddedRepositories, diff.AddedTags)
+	compare(from, to, &diff.RemovedRepositories, diff.RemovedTags)
+
+	json.NewEncoder(w).Encode(diff)
+}
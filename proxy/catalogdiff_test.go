@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestCatalogDiff(t *testing.T) {
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("some-package"), Owner: &github.User{Login: github.String("some-org")}},
+		},
+		PackageVersions: []*github.PackageVersion{{
+			Name:     github.String("sha256:1111"),
+			Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: []string{"1.0.0"}}},
+		}},
+	}
+	p := &containerProxy{
+		backend:        ghbackend.New(client, nil),
+		catalogRefresh: &catalogRefresh{},
+		metadata:       store,
+	}
+
+	// The catalog refreshes record the snapshots.
+	if err := p.refreshCatalog(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, ok := store.CatalogSnapshotAt("", time.Time{})
+	if !ok || !reflect.DeepEqual(snapshot.Tags, map[string][]string{"some-org/some-package": {"1.0.0"}}) {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+
+	t1 := snapshot.Time.Add(time.Hour)
+	store.RecordCatalogSnapshot(metadata.CatalogSnapshot{Time: t1, Tags: map[string][]string{
+		"some-org/some-package": {"1.1.0"},
+		"some-org/other":        {"latest"},
+	}})
+
+	for _, tc := range []struct {
+		since  string
+		status int
+		diff   catalogDiff
+	}{
+		{
+			since:  snapshot.Time.Add(time.Minute).Format(time.RFC3339Nano),
+			status: http.StatusOK,
+			diff: catalogDiff{
+				AddedRepositories:   []string{"some-org/other"},
+				RemovedRepositories: []string{},
+				AddedTags:           map[string][]string{"some-org/other": {"latest"}, "some-org/some-package": {"1.1.0"}},
+				RemovedTags:         map[string][]string{"some-org/some-package": {"1.0.0"}},
+			},
+		},
+		{
+			since:  "4102444800",
+			status: http.StatusOK,
+			diff: catalogDiff{
+				AddedRepositories:   []string{},
+				RemovedRepositories: []string{},
+				AddedTags:           map[string][]string{},
+				RemovedTags:         map[string][]string{},
+			},
+		},
+		{since: "2001-01-01T00:00:00Z", status: http.StatusGone},
+		{since: "yesterday", status: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		p.CatalogDiff(w, httptest.NewRequest("GET", "/api/catalog/diff?since="+tc.since, nil))
+		if w.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got: %d", tc.since, tc.status, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var diff catalogDiff
+		json.NewDecoder(w.Body).Decode(&diff)
+		diff.Since, diff.From, diff.To = time.Time{}, time.Time{}, time.Time{}
+		if !reflect.DeepEqual(diff, tc.diff) {
+			t.Fatalf("%s: unexpected diff: %+v", tc.since, diff)
+		}
+	}
+
+	// The repositories that the client cannot pull are not listed.
+	identity := &Identity{Subject: "some-user", Access: []AccessEntry{{Type: "repository", Name: "some-org/other", Actions: []string{actionPull}}}}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/catalog/diff?since="+snapshot.Time.Add(time.Minute).Format(time.RFC3339Nano), nil)
+	p.CatalogDiff(w, req.WithContext(withIdentity(req.Context(), identity)))
+	var diff catalogDiff
+	json.NewDecoder(w.Body).Decode(&diff)
+	if !reflect.DeepEqual(diff.AddedRepositories, []string{"some-org/other"}) || len(diff.RemovedTags) != 0 || len(diff.AddedTags) != 1 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+var chaosFaultsTotal = newCounterVec(
+	"chaos_faults_total",
+	"Number of faults injected in the requests by the chaos mode, by fault (latency, status, truncate).",
+	"fault",
+)
+
+// ChaosRule injects faults in a share of the requests, to test how the clients
+// (e.g. containerd or the deployment tooling) behave when the registry
+// misbehaves. The rules only apply when the proxy runs with `CHAOS_MODE=true`.
+type ChaosRule struct {
+	// Repository is a glob pattern (see path.Match) of repository names, the
+	// rule applying to all the requests when it is empty.
+	Repository string `json:"repository,omitempty"`
+	// Route restricts the rule to a route of the metrics, e.g. `blobs` or
+	// `manifests`.
+	Route string `json:"route,omitempty"`
+	// Probability is the share of the matching requests affected, all of them
+	// when it is not set.
+	Probability float64 `json:"probability,omitempty"`
+
+	// Latency delays the requests, e.g. `2s`.
+	Latency string `json:"latency,omitempty"`
+	// Status is the status of the error returned instead of the response,
+	// e.g. 429 or 503.
+	Status int `json:"status,omitempty"`
+	// TruncateAfter aborts the blob downloads after a number of bytes, with an
+	// optional K, M or G suffix, e.g. `1M`.
+	TruncateAfter string `json:"truncate_after,omitempty"`
+
+	latency       time.Duration
+	truncateAfter int64
+}
+
+func (c ChaosRule) validate() error {
+	if _, err := path.Match(c.Repository, ""); err != nil {
+		return fmt.Errorf("invalid chaos rule: %w", err)
+	}
+	if c.Probability < 0 || c.Probability > 1 {
+		return fmt.Errorf("invalid chaos rule: invalid probability %g", c.Probability)
+	}
+	if c.Latency != "" {
+		if latency, err := time.ParseDuration(c.Latency); err != nil || latency <= 0 {
+			return fmt.Errorf("invalid chaos rule: invalid latency %q", c.Latency)
+		}
+	}
+	if c.Status != 0 && (c.Status < 400 || c.Status > 599) {
+		return fmt.Errorf("invalid chaos rule: invalid status %d", c.Status)
+	}
+	if c.TruncateAfter != "" {
+		if c.Status != 0 {
+			return fmt.Errorf("invalid chaos rule: status and truncate_after are exclusive")
+		}
+		if _, err := ParseSize(c.TruncateAfter); err != nil {
+			return fmt.Errorf("invalid chaos rule: %w", err)
+		}
+	}
+	if c.Latency == "" && c.Status == 0 && c.TruncateAfter == "" {
+		return fmt.Errorf("invalid chaos rule: no fault")
+	}
+	return nil
+}
+
+// matches returns true when the rule applies to a request.
+func (c ChaosRule) matches(r *http.Request) bool {
+	if c.Route != "" && c.Route != requestRoute(r) {
+		return false
+	}
+	if c.Repository != "" {
+		name, ok := repositoryFromPath(r.URL.Path)
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(c.Repository, name); !matched {
+			return false
+		}
+	}
+	return c.Probability == 0 || rand.Float64() < c.Probability
+}
+
+// WithChaos injects the faults described by the rules in the requests. The
+// first matching rule applies.
+func WithChaos(rules ...ChaosRule) Option {
+	return func(p *containerProxy) {
+		for _, rule := range rules {
+			if err := rule.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			if rule.Latency != "" {
+				rule.latency, _ = time.ParseDuration(rule.Latency)
+			}
+			if rule.TruncateAfter != "" {
+				rule.truncateAfter, _ = ParseSize(rule.TruncateAfter)
+			}
+			p.chaos = append(p.chaos, rule)
+		}
+	}
+}
+
+// truncatingResponseWriter stops writing the response after a number of
+// bytes.
+type truncatingResponseWriter struct {
+	http.ResponseWriter
+	remaining int64
+	truncated bool
+}
+
+func (w *truncatingResponseWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) <= w.remaining {
+		n, err := w.ResponseWriter.Write(b)
+		w.remaining -= int64(n)
+		return n, err
+	}
+	n, _ := w.ResponseWriter.Write(b[:w.remaining])
+	w.remaining -= int64(n)
+	// Send the beginning of the blob before the connection is aborted.
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	if !w.truncated {
+		w.truncated = true
+		chaosFaultsTotal.Inc("truncate")
+	}
+	return n, http.ErrAbortHandler
+}
+
+// injectChaos is a middleware injecting latency, errors and truncated blob
+// downloads in the requests matching the chaos rules.
+func (p *containerProxy) injectChaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rule *ChaosRule
+		for i := range p.chaos {
+			if p.chaos[i].matches(r) {
+				rule = &p.chaos[i]
+				break
+			}
+		}
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.latency > 0 {
+			chaosFaultsTotal.Inc("latency")
+			select {
+			case <-time.After(rule.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if rule.Status != 0 {
+			chaosFaultsTotal.Inc("status")
+			code := ERROR_UNKNOWN
+			if rule.Status == http.StatusTooManyRequests {
+				code = ERROR_TOO_MANY_REQUESTS
+				w.Header().Set("Retry-After", "1")
+			}
+			Veto(w, rule.Status, code, "fault injected by the chaos mode: "+strconv.Itoa(rule.Status))
+			return
+		}
+
+		if _, kind, _, ok := splitRegistryPath(r.URL.Path); ok && kind == "blobs" && r.Method == "GET" && rule.truncateAfter > 0 {
+			truncating := &truncatingResponseWriter{ResponseWriter: w, remaining: rule.truncateAfter}
+			next.ServeHTTP(truncating, r)
+			if truncating.truncated {
+				// Abort the connection so that the client gets a short body.
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectChaos(t *testing.T) {
+	blob := strings.Repeat("x", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(blob))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithChaos(
+			ChaosRule{Repository: "flaky/*", Status: http.StatusServiceUnavailable},
+			ChaosRule{Repository: "busy/*", Status: http.StatusTooManyRequests},
+			ChaosRule{Repository: "slow/*", Latency: "50ms"},
+			ChaosRule{Route: "blobs", TruncateAfter: "100"},
+		),
+	)
+	server := httptest.NewServer(proxy.Handler)
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string, error) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return res, string(body), err
+	}
+
+	res, _, _ := get("/v2/flaky/app/manifests/latest")
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected: %d, got: %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+	res, _, _ = get("/v2/busy/app/manifests/latest")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected: %d with Retry-After, got: %d", http.StatusTooManyRequests, res.StatusCode)
+	}
+
+	start := time.Now()
+	res, body, _ := get("/v2/slow/app/manifests/latest")
+	if res.StatusCode != http.StatusOK || body != blob || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected a delayed response, got: %d after %s", res.StatusCode, time.Since(start))
+	}
+
+	_, body, err := get("/v2/some-owner/app/blobs/sha256:" + strings.Repeat("a", 64))
+	if err == nil || len(body) != 100 {
+		t.Fatalf("expected a truncated blob, got: %d bytes (%v)", len(body), err)
+	}
+	if chaosFaultsTotal.Value("truncate") < 1 {
+		t.Fatal("expected the fault to be counted")
+	}
+
+	// The other requests are not affected.
+	if res, body, err := get("/v2/some-owner/app/manifests/latest"); err != nil || res.StatusCode != http.StatusOK || body != blob {
+		t.Fatalf("unexpected response: %d %v", res.StatusCode, err)
+	}
+}
@@ -0,0 +1,761 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/willdurand/container-registry-proxy/backend"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/backend/plugin"
+	"github.com/willdurand/container-registry-proxy/backend/snapshot"
+	"github.com/willdurand/container-registry-proxy/backend/static"
+	"github.com/willdurand/container-registry-proxy/metadata"
+	"golang.org/x/oauth2"
+)
+
+// durationFromEnv returns the duration defined in an environment variable, or
+// the default value when the variable is not set.
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// Main runs the proxy configured with the environment variables and the
+// command line flags, see the container-registry-proxy command.
+func Main() {
+	dbPath := flag.String("db", os.Getenv("METADATA_DB"), "path of the metadata database")
+	apiKey := flag.String("create-api-key", "", "create an API key (`name=pattern:actions;...`) in the metadata database and exit")
+	printVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Println(readBuildInfo())
+		return
+	}
+
+	if flag.Arg(0) == "dashboard" {
+		if err := WriteDashboard(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "alert-rules" {
+		if err := runAlertRulesCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "cache" {
+		if err := runCacheCommand(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "healthcheck" {
+		if err := runHealthcheckCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "delta" {
+		if err := runDeltaCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "conformance" {
+		if err := runConformanceCommand(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *apiKey != "" {
+		if *dbPath == "" {
+			log.Fatal("--create-api-key requires a metadata database (--db or METADATA_DB)")
+		}
+		req, err := parseAPIKeyRequest(*apiKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store, err := metadata.Open(*dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := createAPIKey(store, req, "cli")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("API key %s (%s): %s\n", key.ID, key.Name, key.Key)
+		return
+	}
+
+	log.SetOutput(newRedactingWriter(os.Stderr))
+	for _, name := range []string{"GITHUB_TOKEN", "AUTH_TOKEN_KEY", "FLUX_RECEIVER_SECRET", "GITHUB_WEBHOOK_SECRET", "SLACK_WEBHOOK_URL", "TEAMS_WEBHOOK_URL", "SMTP_PASSWORD"} {
+		registerSecret(os.Getenv(name))
+	}
+
+	secretRefreshInterval, err := durationFromEnv("SECRET_REFRESH_INTERVAL", defaultSecretRefreshInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secrets.interval = secretRefreshInterval
+	// CHAOS_MODE=true enables the chaos feature flag, which FEATURES can
+	// still disable.
+	rawFeatureFlags := os.Getenv("FEATURES")
+	if os.Getenv("CHAOS_MODE") == "true" {
+		rawFeatureFlags = featureChaos + "," + rawFeatureFlags
+	}
+	featureFlags, err := ParseFeatureFlags(rawFeatureFlags)
+	if err != nil {
+		log.Fatalf("invalid FEATURES: %s", err)
+	}
+	logFeatureFlags(featureFlags)
+	if value := os.Getenv("USER_AGENT"); value != "" {
+		userAgent = value
+	}
+	// Fail early when the GitHub token cannot be fetched from a secret manager.
+	if _, err := resolveSecret(context.Background(), os.Getenv("GITHUB_TOKEN")); err != nil {
+		log.Fatal(err)
+	}
+
+	host := os.Getenv("HOST")
+	if host == "" {
+		host = defaultHost
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	addrs, err := listenAddrs(host, port)
+	if err != nil {
+		log.Fatalf("invalid HOST: %s", err)
+	}
+	addr := addrs[0]
+
+	rawUpstreamURL := os.Getenv("UPSTREAM_URL")
+	if rawUpstreamURL == "" {
+		rawUpstreamURL = defaultUpstreamURL
+	}
+
+	// Create a GitHub client to call the REST API. The requests are part of
+	// the traces of the client requests.
+	ctx := context.Background()
+	githubTransport := &tracingTransport{}
+	var notifications *NotificationSink
+	if slackURL, teamsURL := os.Getenv("SLACK_WEBHOOK_URL"), os.Getenv("TEAMS_WEBHOOK_URL"); slackURL != "" || teamsURL != "" {
+		events, err := ParseNotificationEvents(os.Getenv("NOTIFICATION_EVENTS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifications = NewNotificationSink(slackURL, teamsURL, events...)
+	}
+	if mode := os.Getenv("GITHUB_RECORD_MODE"); mode != "" {
+		dir := os.Getenv("GITHUB_RECORD_DIR")
+		if dir == "" {
+			dir = defaultRecordDir
+		}
+		transport, err := NewRecordingTransport(mode, dir, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("GitHub API interactions: %s (%s)", mode, dir)
+		githubTransport.next = transport
+	}
+	// The oauth2 client created below uses this HTTP client as its base
+	// transport.
+	githubMonitor := &RateLimitTransport{Next: githubTransport, Sink: notifications}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: githubMonitor})
+	client := github.NewClient(newGitHubTokenClient(ctx, os.Getenv("GITHUB_TOKEN")))
+	client.UserAgent = userAgent
+
+	var packageTypes []string
+	if artifactTypes := os.Getenv("ARTIFACT_TYPES"); artifactTypes != "" {
+		packageTypes = strings.Split(artifactTypes, ",")
+	}
+
+	visibility := os.Getenv("CATALOG_VISIBILITY")
+	switch visibility {
+	case "", "all", "public", "private", "internal":
+	default:
+		log.Fatalf("invalid CATALOG_VISIBILITY: %q", visibility)
+	}
+
+	var registry backend.RegistryBackend = ghbackend.New(
+		client.Users,
+		GitHubUsers(),
+		ghbackend.WithPackageTypes(packageTypes...),
+		ghbackend.WithVisibility(visibility),
+		ghbackend.WithTopics(strings.Split(os.Getenv("CATALOG_TOPICS"), ",")...),
+		ghbackend.WithReadmes(ghbackend.NewReadmeClient(client)),
+	)
+	// The plugins are started once per executable, and exit with the proxy
+	// even when it does not return, e.g. on log.Fatal().
+	plugins := map[string]*plugin.Backend{}
+	defer func() {
+		for _, p := range plugins {
+			p.Close()
+		}
+	}()
+	openPlugin := func(path, capability string) *plugin.Backend {
+		p, ok := plugins[path]
+		if !ok {
+			var err error
+			if p, err = plugin.Open(path); err != nil {
+				log.Fatal(err)
+			}
+			plugins[path] = p
+		}
+		if !p.Supports(capability) {
+			log.Fatalf("plugin %s: no %s capability", path, capability)
+		}
+		log.Printf("using %s plugin %s", capability, path)
+		return p
+	}
+	if path := os.Getenv("BACKEND_PLUGIN"); path != "" {
+		registry = openPlugin(path, plugin.CapabilityBackend)
+	}
+	catalogFileMode := os.Getenv("CATALOG_FILE_MODE")
+	switch catalogFileMode {
+	case "":
+		catalogFileMode = "replace"
+	case "replace", "merge":
+	default:
+		log.Fatalf("invalid CATALOG_FILE_MODE: %q", catalogFileMode)
+	}
+	if path := os.Getenv("CATALOG_FILE"); path != "" && catalogFileMode == "replace" {
+		staticBackend, err := static.New(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry = staticBackend
+	}
+
+	// Detect the common misconfigurations of the token early, without
+	// preventing the proxy from starting.
+	if checker, ok := registry.(interface{ CheckCredentials(context.Context) error }); ok {
+		if err := checker.CheckCredentials(ctx); err != nil {
+			log.Printf("WARN backend credentials check failed: %s", err)
+		}
+	}
+	if path := os.Getenv("CATALOG_FILE"); path != "" && catalogFileMode == "merge" {
+		staticBackend, err := static.New(path, static.WithNext(registry))
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry = staticBackend
+	}
+	if path := os.Getenv("CATALOG_SNAPSHOT_FILE"); path != "" {
+		snapshotBackend, err := snapshot.New(registry, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry = snapshotBackend
+	}
+
+	namespaces, err := ParseUpstreamNamespaces(os.Getenv("UPSTREAM_NAMESPACES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	upstreamUsername := os.Getenv("UPSTREAM_USERNAME")
+	if upstreamUsername == "" {
+		upstreamUsername = defaultUpstreamUsername
+	}
+	opts := []Option{
+		WithUpstreamNamespaces(namespaces),
+		WithUpstreamCredentials(upstreamUsername, os.Getenv("GITHUB_TOKEN")),
+	}
+	// The options shared with the virtual registries.
+	sharedOpts := []Option{WithFeatureFlags(featureFlags), withRegisteredHooks()}
+
+	if key := os.Getenv("AUTH_TOKEN_KEY"); key != "" {
+		ttl, err := durationFromEnv("AUTH_TOKEN_TTL", defaultTokenTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var authenticators []Authenticator
+		if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+			if os.Getenv("OIDC_AUDIENCE") == "" {
+				log.Fatal("OIDC_AUDIENCE is required with OIDC_ISSUER_URL")
+			}
+			authenticators = append(authenticators, NewOIDCAuthenticator(issuer, os.Getenv("OIDC_AUDIENCE"), os.Getenv("OIDC_GROUPS_CLAIM")))
+		}
+		if owners := os.Getenv("GITHUB_ACTIONS_OWNERS"); owners != "" {
+			audience := os.Getenv("GITHUB_ACTIONS_AUDIENCE")
+			if audience == "" {
+				audience = defaultTokenService
+			}
+			authenticators = append(authenticators, NewGitHubActionsAuthenticator(os.Getenv("GITHUB_ACTIONS_ISSUER_URL"), audience, strings.Split(owners, ",")))
+		}
+		if rawACL := os.Getenv("AUTH_ACL"); rawACL != "" {
+			rules, err := ParseACL(rawACL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, WithACL(rules))
+		}
+		if path := os.Getenv("AUTH_PLUGIN"); path != "" {
+			authenticators = append(authenticators, NewPluginAuthenticator(openPlugin(path, plugin.CapabilityAuthenticator)))
+		}
+		if path := os.Getenv("POLICY_PLUGIN"); path != "" {
+			opts = append(opts, WithPolicyPlugin(openPlugin(path, plugin.CapabilityPolicy)))
+		}
+		sharedOpts = append(sharedOpts, WithTokenAuth([]byte(key), ttl, authenticators...))
+		if realm := os.Getenv("AUTH_TOKEN_REALM"); realm != "" {
+			opts = append(opts, WithTokenRealm(realm))
+		}
+	}
+
+	for _, family := range []string{routeFamilyAdmin, routeFamilyRegistry} {
+		prefix := strings.ToUpper(family)
+		allow, err := ParseCIDRs(os.Getenv(prefix + "_ALLOWED_CIDRS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		deny, err := ParseCIDRs(os.Getenv(prefix + "_DENIED_CIDRS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(allow) > 0 || len(deny) > 0 {
+			sharedOpts = append(sharedOpts, WithIPFilter(family, allow, deny))
+		}
+	}
+	if rawCIDRs := os.Getenv("TRUSTED_PROXY_CIDRS"); rawCIDRs != "" {
+		trustedProxies, err := ParseCIDRs(rawCIDRs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithTrustedProxies(trustedProxies))
+	}
+	upstreamNetworks, err := ParseCIDRs(os.Getenv("UPSTREAM_ALLOWED_CIDRS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var upstreamHosts []string
+	if hosts := os.Getenv("UPSTREAM_ALLOWED_HOSTS"); hosts != "" {
+		upstreamHosts = strings.Split(hosts, ",")
+	}
+	sharedOpts = append(sharedOpts, WithUpstreamEgress(upstreamNetworks, upstreamHosts...))
+
+	if dir := os.Getenv("BLOB_CACHE_DIR"); dir != "" {
+		sharedOpts = append(sharedOpts, WithBlobCache(dir))
+		if value := os.Getenv("BLOB_CACHE_SCRUB_SCHEDULE"); value != "" {
+			schedule, err := ParseCronSchedule(value)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sharedOpts = append(sharedOpts, WithBlobCacheScrub(schedule))
+		}
+		if value := os.Getenv("BLOB_CACHE_MIN_FREE"); value != "" {
+			watermark, err := ParseDiskWatermark(value)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sharedOpts = append(sharedOpts, WithBlobCacheMinFree(watermark))
+		}
+		if value := os.Getenv("BLOB_CACHE_ESTARGZ_REPOSITORIES"); value != "" {
+			sharedOpts = append(sharedOpts, WithEstargzConversion(strings.Split(value, ",")...))
+		}
+		if value := os.Getenv("BLOB_CACHE_ZSTD_COMMAND"); value != "" {
+			sharedOpts = append(sharedOpts, WithZstdTranscoding(strings.Fields(value)...))
+		}
+	}
+	if value := os.Getenv("BLOB_FETCH_CONCURRENCY"); value != "" && featureFlags.require(featureParallelBlobFetch, "BLOB_FETCH_CONCURRENCY") {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			log.Fatalf("invalid BLOB_FETCH_CONCURRENCY: %q", value)
+		}
+		var chunkSize int64
+		if value := os.Getenv("BLOB_FETCH_CHUNK_SIZE"); value != "" {
+			if chunkSize, err = ParseSize(value); err != nil {
+				log.Fatalf("invalid BLOB_FETCH_CHUNK_SIZE: %s", err)
+			}
+		}
+		sharedOpts = append(sharedOpts, WithParallelBlobFetch(chunkSize, concurrency))
+	}
+	if policy := os.Getenv("BLOB_REDIRECTS"); policy != "" {
+		policy, err := ParseBlobRedirectPolicy(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rewrites, err := ParseUpstreamNamespaces(os.Getenv("BLOB_REDIRECT_REWRITES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if policy == blobRedirectRewrite && len(rewrites) == 0 {
+			log.Fatal("BLOB_REDIRECTS=rewrite needs BLOB_REDIRECT_REWRITES")
+		}
+		sharedOpts = append(sharedOpts, WithBlobRedirects(policy, rewrites))
+	}
+	if policy := os.Getenv("FOREIGN_LAYERS"); policy != "" {
+		policy, err := ParseForeignLayerPolicy(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rewrites, err := ParseUpstreamNamespaces(os.Getenv("FOREIGN_LAYER_URL_REWRITES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithForeignLayers(policy, rewrites))
+	}
+	if order, created := os.Getenv("TAGS_ORDER"), os.Getenv("TAGS_CREATED") == "true"; order != "" || created {
+		order, err := ParseTagsOrder(order)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithTagsOrder(order, created))
+	}
+	if value := os.Getenv("CATALOG_REFRESH_SCHEDULE"); value != "" {
+		schedule, err := ParseCronSchedule(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithCatalogRefresh(schedule))
+	}
+	if url := os.Getenv("FLUX_RECEIVER_URL"); url != "" {
+		if os.Getenv("CATALOG_REFRESH_SCHEDULE") == "" && os.Getenv("GITHUB_WEBHOOK_SECRET") == "" {
+			log.Fatal("FLUX_RECEIVER_URL needs CATALOG_REFRESH_SCHEDULE or GITHUB_WEBHOOK_SECRET")
+		}
+		sharedOpts = append(sharedOpts, WithFluxReceiver(url, os.Getenv("FLUX_RECEIVER_SECRET")))
+	}
+	if secret := os.Getenv("GITHUB_WEBHOOK_SECRET"); secret != "" {
+		sharedOpts = append(sharedOpts, WithGitHubWebhook(secret))
+	}
+	if rawURL := os.Getenv("EVENTS_URL"); rawURL != "" {
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			secret, ok := u.User.Password()
+			if !ok {
+				secret = u.User.Username()
+			}
+			registerSecret(secret)
+		}
+		publisher, err := NewEventPublisher(rawURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		types, err := ParseEventTypes(os.Getenv("EVENTS_TYPES"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithEventBus(publisher, os.Getenv("EVENTS_TOPIC"), types...))
+	}
+	if notifications != nil {
+		sharedOpts = append(sharedOpts, WithNotifications(notifications))
+	}
+	if os.Getenv("BLOB_PREFETCH") == "true" && featureFlags.require(featureBlobPrefetch, "BLOB_PREFETCH") {
+		var concurrency int
+		if value := os.Getenv("BLOB_PREFETCH_CONCURRENCY"); value != "" {
+			if concurrency, err = strconv.Atoi(value); err != nil || concurrency < 1 {
+				log.Fatalf("invalid BLOB_PREFETCH_CONCURRENCY: %q", value)
+			}
+		}
+		sharedOpts = append(sharedOpts, WithBlobPrefetch(concurrency))
+	}
+	if os.Getenv("MIRROR_SIGNATURES") == "true" && featureFlags.require(featureMirrorSignatures, "MIRROR_SIGNATURES") {
+		sharedOpts = append(sharedOpts, WithSignatureMirroring(os.Getenv("REQUIRE_SIGNATURES") == "true"))
+	}
+	if (os.Getenv("PEERS") != "" || os.Getenv("PEERS_DNS") != "") && featureFlags.require(featureBlobCachePeers, "PEERS") {
+		secret := os.Getenv("PEER_SECRET")
+		if secret == "" {
+			log.Fatal("PEER_SECRET is required to share the blob cache with peers")
+		}
+		registerSecret(secret)
+		self := os.Getenv("PEER_SELF_URL")
+		if self == "" && os.Getenv("POD_IP") != "" {
+			self = "http://" + net.JoinHostPort(os.Getenv("POD_IP"), port)
+		}
+
+		var peers *PeerSet
+		if hostport := os.Getenv("PEERS_DNS"); hostport != "" {
+			if peers, err = NewDNSPeers(self, hostport, secret); err != nil {
+				log.Fatal(err)
+			}
+			go peers.Run(ctx)
+		} else {
+			peers = NewStaticPeers(self, strings.Split(os.Getenv("PEERS"), ","), secret)
+		}
+		sharedOpts = append(sharedOpts, WithPeers(peers))
+	}
+
+	if *dbPath != "" {
+		store, err := metadata.Open(*dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go store.Run(ctx, metadataFlushInterval)
+		sharedOpts = append(sharedOpts, WithMetadataStore(store))
+	}
+	if os.Getenv("API_KEYS") == "true" {
+		if *dbPath == "" {
+			log.Fatal("API_KEYS requires a metadata database (--db or METADATA_DB)")
+		}
+		sharedOpts = append(sharedOpts, WithAPIKeys())
+	}
+
+	var limits BandwidthLimits
+	for name, limit := range map[string]*int64{
+		"BANDWIDTH_LIMIT_CONNECTION": &limits.Connection,
+		"BANDWIDTH_LIMIT_CLIENT":     &limits.Client,
+		"BANDWIDTH_LIMIT_GLOBAL":     &limits.Global,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if *limit, err = ParseBandwidth(value); err != nil {
+				log.Fatalf("invalid %s: %s", name, err)
+			}
+		}
+	}
+	if limits != (BandwidthLimits{}) {
+		sharedOpts = append(sharedOpts, WithBandwidthLimits(limits))
+	}
+
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		if tlsCertFile == "" {
+			log.Fatal("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		clientCAs, err := LoadCertPool(caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithClientCertificates(clientCAs))
+	}
+
+	if os.Getenv("KUBERNETES_TOKEN_AUTH") == "true" {
+		var audiences []string
+		if rawAudiences := os.Getenv("KUBERNETES_TOKEN_AUDIENCES"); rawAudiences != "" {
+			audiences = strings.Split(rawAudiences, ",")
+		}
+		sharedOpts = append(sharedOpts, WithServiceAccountTokens(audiences...))
+	}
+
+	if orgs := os.Getenv("GITHUB_TEAMS_ORGS"); orgs != "" {
+		sharedOpts = append(sharedOpts, WithGitHubTeams(strings.Split(orgs, ",")...))
+	}
+
+	// The manifests are only cached for the maintenance mode when it is
+	// configured.
+	if value := os.Getenv("MAINTENANCE"); value != "" {
+		maintenance := NewMaintenanceMode()
+		if value == "true" {
+			retryAfter, err := durationFromEnv("MAINTENANCE_RETRY_AFTER", defaultMaintenanceRetryAfter)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("WARN starting in maintenance mode")
+			maintenance.Set(true, os.Getenv("MAINTENANCE_MESSAGE"), retryAfter)
+		}
+		sharedOpts = append(sharedOpts, WithMaintenanceMode(maintenance))
+	}
+	if value := os.Getenv("SLO_AVAILABILITY_OBJECTIVE"); value != "" {
+		objective, err := ParseAvailabilityObjective(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sharedOpts = append(sharedOpts, WithAvailabilityObjective(objective))
+	}
+
+	if rawPatterns := os.Getenv("ANONYMOUS_READ"); rawPatterns != "" {
+		opts = append(opts, WithAnonymousRead(strings.Split(rawPatterns, ",")...))
+	}
+
+	if os.Getenv("DELETE_DRY_RUN") == "true" {
+		opts = append(opts, WithDeleteDryRun())
+	}
+
+	if webhookURL := os.Getenv("PIN_DRIFT_WEBHOOK_URL"); webhookURL != "" {
+		sharedOpts = append(sharedOpts, WithPinDriftWebhook(webhookURL))
+	}
+	if rawPatterns := os.Getenv("IMMUTABLE_TAGS"); rawPatterns != "" {
+		patterns, err := ParseImmutableTags(rawPatterns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithImmutableTags(patterns...))
+	}
+
+	if os.Getenv("DOCKER_MIRROR") == "true" {
+		rawDockerHubURL := os.Getenv("DOCKER_HUB_URL")
+		if rawDockerHubURL == "" {
+			rawDockerHubURL = defaultDockerHubURL
+		}
+		dockerHubURL, err := url.Parse(rawDockerHubURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithDockerMirror(dockerHubURL))
+	}
+	if os.Getenv("LEADER_ELECTION") == "true" {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+		namespace := os.Getenv("LEADER_ELECTION_NAMESPACE")
+		if namespace == "" {
+			namespace = inClusterNamespace()
+		}
+		leaseName := os.Getenv("LEADER_ELECTION_LEASE_NAME")
+		if leaseName == "" {
+			leaseName = defaultLeaseName
+		}
+		elector := newLeaseElector(kube, namespace, leaseName, instanceID())
+		go elector.Run(ctx)
+		sharedOpts = append(sharedOpts, WithLeaderElector(elector))
+	}
+
+	hostRoutes, err := ParseHostRoutes(os.Getenv("HOST_ROUTES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &Config{Registries: hostRoutes}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		fileConfig, err := LoadConfig(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Registries = append(config.Registries, fileConfig.Registries...)
+		opts = append(opts, WithPrefetchSchedules(fileConfig.Prefetch...))
+		opts = append(opts, WithDigestPins(fileConfig.Pins...))
+		opts = append(opts, WithVirtualTags(fileConfig.VirtualTags...))
+		opts = append(opts, WithRepositoryAliases(fileConfig.Aliases))
+		opts = append(opts, WithDeprecations(fileConfig.Deprecations...))
+		opts = append(opts, WithQuotas(fileConfig.Quotas...))
+		opts = append(opts, WithSizeLimits(fileConfig.SizeLimits...))
+		if len(fileConfig.Provenance) > 0 {
+			var roots *x509.CertPool
+			if path := os.Getenv("PROVENANCE_TRUSTED_ROOTS"); path != "" {
+				if roots, err = LoadCertPool(path); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				log.Printf("WARN the signatures of the provenance attestations are not verified without PROVENANCE_TRUSTED_ROOTS")
+			}
+			opts = append(opts, WithProvenancePolicies(roots, fileConfig.Provenance...))
+		}
+		if len(fileConfig.LabelPolicies) > 0 {
+			opts = append(opts, WithLabelPolicies(fileConfig.LabelPolicies...))
+		}
+		if len(fileConfig.AgePolicies) > 0 {
+			opts = append(opts, WithAgePolicies(fileConfig.AgePolicies...))
+		}
+		sharedOpts = append(sharedOpts, WithScopedCredentials(fileConfig.Credentials...))
+		sharedOpts = append(sharedOpts, WithUpstreamSettings(fileConfig.Upstreams...))
+		if len(fileConfig.Chaos) > 0 {
+			if featureFlags.Enabled(featureChaos) {
+				log.Printf("WARN chaos mode enabled: injecting faults in the requests")
+				sharedOpts = append(sharedOpts, WithChaos(fileConfig.Chaos...))
+			} else {
+				log.Printf("WARN chaos rules ignored without CHAOS_MODE=true or FEATURES=chaos")
+			}
+		}
+		if len(fileConfig.Transforms) > 0 {
+			if featureFlags.Enabled(featureTransforms) {
+				sharedOpts = append(sharedOpts, WithManifestTransforms(fileConfig.Transforms...))
+			} else {
+				log.Printf("WARN manifest transforms ignored without FEATURES=%s", featureTransforms)
+			}
+		}
+	}
+
+	healthCheckInterval, err := durationFromEnv("HEALTH_CHECK_INTERVAL", defaultHealthCheckInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if healthCheckInterval > 0 {
+		var upstreamURLs []string
+		for _, registryConfig := range config.Registries {
+			if registryConfig.UpstreamURL != "" {
+				upstreamURLs = append(upstreamURLs, registryConfig.UpstreamURL)
+			}
+		}
+		opts = append(opts, WithHealthChecks(healthCheckInterval, upstreamURLs...))
+	}
+
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		alerts := &EmailAlerts{
+			Addr:             smtpAddr,
+			Username:         os.Getenv("SMTP_USERNAME"),
+			Password:         os.Getenv("SMTP_PASSWORD"),
+			From:             os.Getenv("ALERT_EMAIL_FROM"),
+			DiskUsage:        defaultAlertDiskUsage,
+			UpstreamFailures: defaultAlertUpstreamFailures,
+			TokenExpiration:  githubMonitor.TokenExpiration,
+		}
+		if to := os.Getenv("ALERT_EMAIL_TO"); to != "" {
+			alerts.To = strings.Split(to, ",")
+		}
+		if alerts.From == "" || len(alerts.To) == 0 {
+			log.Fatal("SMTP_ADDR needs ALERT_EMAIL_FROM and ALERT_EMAIL_TO")
+		}
+		if alerts.TokenExpiry, err = durationFromEnv("ALERT_TOKEN_EXPIRY", defaultAlertTokenExpiry); err != nil {
+			log.Fatal(err)
+		}
+		if value := os.Getenv("ALERT_DISK_USAGE"); value != "" {
+			// Like the availability objective, a ratio or a percentage.
+			if alerts.DiskUsage, err = ParseAvailabilityObjective(value); err != nil {
+				log.Fatalf("invalid ALERT_DISK_USAGE: %q", value)
+			}
+		}
+		if value := os.Getenv("ALERT_UPSTREAM_FAILURES"); value != "" {
+			if alerts.UpstreamFailures, err = strconv.Atoi(value); err != nil || alerts.UpstreamFailures < 1 {
+				log.Fatalf("invalid ALERT_UPSTREAM_FAILURES: %q", value)
+			}
+		}
+		opts = append(opts, WithEmailAlerts(alerts))
+	}
+
+	proxy := NewProxy(addr, registry, rawUpstreamURL, append(sharedOpts, opts...)...)
+
+	if len(config.Registries) > 0 {
+		var registries []VirtualRegistry
+		for _, registryConfig := range config.Registries {
+			registry, err := registryConfig.VirtualRegistry(ctx, addr, sharedOpts...)
+			if err != nil {
+				log.Fatal(err)
+			}
+			registries = append(registries, registry)
+		}
+		if proxy, err = NewVirtualRegistries(proxy, registries); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	proxy.Handler = withLiveness(proxy.Handler)
+
+	listeners, err := listen(addrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, listener := range listeners {
+		if tlsCertFile != "" {
+			log.Printf("starting container registry proxy on %s (TLS)", listener.Addr())
+		} else {
+			log.Printf("starting container registry proxy on %s", listener.Addr())
+		}
+	}
+	log.Fatal(serve(proxy, listeners, tlsCertFile, os.Getenv("TLS_KEY_FILE")))
+}
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// Config is the content of the configuration file (`CONFIG_FILE`), for the
+// settings that don't fit in environment variables.
+type Config struct {
+	Registries []RegistryConfig `json:"registries"`
+	// Prefetch are the images of the default registry warmed into the blob
+	// cache on a schedule.
+	Prefetch []PrefetchSchedule `json:"prefetch,omitempty"`
+	// Pins are the tags of the default registry pinned to a digest.
+	Pins []DigestPin `json:"pins,omitempty"`
+	// VirtualTags are the tags computed by the default registry.
+	VirtualTags []VirtualTag `json:"virtual_tags,omitempty"`
+	// Aliases map short names to the repositories of the default registry.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Deprecations are the deprecated repositories and tags of the default
+	// registry.
+	Deprecations []Deprecation `json:"deprecations,omitempty"`
+	// Quotas are the monthly quotas of the namespaces of the default registry.
+	Quotas []Quota `json:"quotas,omitempty"`
+	// SizeLimits are the maximum sizes of the images of the namespaces of the
+	// default registry.
+	SizeLimits []SizeLimit `json:"size_limits,omitempty"`
+	// Provenance are the provenance policies of the repositories of the
+	// default registry.
+	Provenance []ProvenancePolicy `json:"provenance,omitempty"`
+	// LabelPolicies are the label policies of the repositories of the
+	// default registry.
+	LabelPolicies []LabelPolicy `json:"label_policies,omitempty"`
+	// AgePolicies are the maximum ages of the images of the repositories of
+	// the default registry.
+	AgePolicies []AgePolicy `json:"age_policies,omitempty"`
+	// Chaos are the faults injected in the requests of all the registries
+	// when `CHAOS_MODE=true`, for development and test environments.
+	Chaos []ChaosRule `json:"chaos,omitempty"`
+	// Transforms are the manifest transforms of all the registries, applied
+	// when the `manifest-transforms` feature flag is enabled.
+	Transforms []ManifestTransform `json:"transforms,omitempty"`
+	// Credentials are the credentials used with the upstream registries by
+	// all the registries, by upstream registry and repository.
+	Credentials []UpstreamCredential `json:"credentials,omitempty"`
+	// Upstreams override the timeout, the retries and the token cache of the
+	// upstream registries of all the registries.
+	Upstreams []UpstreamSettings `json:"upstreams,omitempty"`
+}
+
+// RegistryConfig configures a virtual registry.
+type RegistryConfig struct {
+	// Name identifies the virtual registry, e.g. in the logs.
+	Name string `json:"name"`
+	// Prefix is the first component of the repository names of the virtual
+	// registry, e.g. `team-a` for `team-a/owner/name`.
+	Prefix string `json:"prefix,omitempty"`
+	// Hosts are the hostnames selecting the virtual registry.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Passthrough forwards all the requests to the upstream registry, without
+	// GitHub backend, e.g. to expose Docker Hub.
+	Passthrough bool `json:"passthrough,omitempty"`
+
+	// Users are the GitHub users and organizations whose packages are listed,
+	// the owner of the token by default.
+	Users        []string `json:"users,omitempty"`
+	PackageTypes []string `json:"package_types,omitempty"`
+	Visibility   string   `json:"visibility,omitempty"`
+	// Topics restrict the catalog to the packages whose source repository has
+	// one of the topics, like `CATALOG_TOPICS`.
+	Topics []string `json:"topics,omitempty"`
+	// TokenEnv is the name of the environment variable containing the GitHub
+	// token of the virtual registry (default: `GITHUB_TOKEN`).
+	TokenEnv string `json:"token_env,omitempty"`
+
+	UpstreamURL      string `json:"upstream_url,omitempty"`
+	UpstreamUsername string `json:"upstream_username,omitempty"`
+
+	// ACL and AnonymousRead have the same format as `AUTH_ACL` and
+	// `ANONYMOUS_READ`.
+	ACL           string   `json:"acl,omitempty"`
+	AnonymousRead []string `json:"anonymous_read,omitempty"`
+
+	// Pins are the tags of the virtual registry pinned to a digest.
+	Pins []DigestPin `json:"pins,omitempty"`
+	// VirtualTags are the tags computed by the virtual registry, which needs a
+	// GitHub backend.
+	VirtualTags []VirtualTag `json:"virtual_tags,omitempty"`
+	// Aliases map short names to the repositories of the virtual registry,
+	// without its prefix.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Deprecations are the deprecated repositories and tags of the virtual
+	// registry, with its prefix.
+	Deprecations []Deprecation `json:"deprecations,omitempty"`
+	// Quotas are the monthly quotas of the namespaces of the virtual registry,
+	// its prefix being the namespace of all its repositories.
+	Quotas []Quota `json:"quotas,omitempty"`
+	// SizeLimits are the maximum sizes of the images of the namespaces of the
+	// virtual registry, its prefix being the namespace of all its
+	// repositories.
+	SizeLimits []SizeLimit `json:"size_limits,omitempty"`
+}
+
+// LoadConfig reads and validates a JSON configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, registry := range config.Registries {
+		if registry.Name == "" {
+			return nil, fmt.Errorf("invalid configuration file %s: a virtual registry has no name", path)
+		}
+		// The name is the directory of the blobs of the registry in the cache.
+		if !cache.IsValidDir(registry.Name) {
+			return nil, fmt.Errorf("invalid configuration file %s: invalid virtual registry name: %q", path, registry.Name)
+		}
+		if names[registry.Name] {
+			return nil, fmt.Errorf("invalid configuration file %s: duplicate virtual registry %s", path, registry.Name)
+		}
+		names[registry.Name] = true
+
+		if registry.Prefix == "" && len(registry.Hosts) == 0 {
+			return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s needs a prefix or hosts", path, registry.Name)
+		}
+		if strings.Contains(registry.Prefix, "/") {
+			return nil, fmt.Errorf("invalid configuration file %s: invalid prefix for virtual registry %s: %q", path, registry.Name, registry.Prefix)
+		}
+		switch registry.Visibility {
+		case "", "all", "public", "private", "internal":
+		default:
+			return nil, fmt.Errorf("invalid configuration file %s: invalid visibility for virtual registry %s: %q", path, registry.Name, registry.Visibility)
+		}
+		if _, err := ParseACL(registry.ACL); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+		if registry.UpstreamURL != "" {
+			upstreamURL, err := url.Parse(registry.UpstreamURL)
+			if err == nil {
+				err = validateUpstreamURL(upstreamURL)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+		for _, pin := range registry.Pins {
+			if err := pin.validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+		if registry.Passthrough && len(registry.VirtualTags) > 0 {
+			return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: virtual tags need a GitHub backend", path, registry.Name)
+		}
+		for _, tag := range registry.VirtualTags {
+			if err := tag.validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+		if err := validateAliases(registry.Aliases); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+		}
+		for _, deprecation := range registry.Deprecations {
+			if err := deprecation.validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+		for _, quota := range registry.Quotas {
+			if err := quota.validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+		for _, limit := range registry.SizeLimits {
+			if err := limit.validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: virtual registry %s: %w", path, registry.Name, err)
+			}
+		}
+	}
+
+	for _, prefetch := range config.Prefetch {
+		if _, err := ParseCronSchedule(prefetch.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+		for _, ref := range prefetch.Images {
+			if _, _, err := parseImageReference(ref); err != nil {
+				return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+			}
+		}
+	}
+
+	for _, pin := range config.Pins {
+		if err := pin.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, tag := range config.VirtualTags {
+		if err := tag.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	if err := validateAliases(config.Aliases); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	for _, deprecation := range config.Deprecations {
+		if err := deprecation.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, quota := range config.Quotas {
+		if err := quota.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, limit := range config.SizeLimits {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, policy := range config.Provenance {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, policy := range config.LabelPolicies {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	for _, policy := range config.AgePolicies {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	upstreams := map[string]bool{}
+	for _, settings := range config.Upstreams {
+		if err := settings.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+		if upstreams[settings.Upstream] {
+			return nil, fmt.Errorf("invalid configuration file %s: duplicate upstream settings: %s", path, settings.Upstream)
+		}
+		upstreams[settings.Upstream] = true
+	}
+
+	for _, rule := range config.Chaos {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+	for _, transform := range config.Transforms {
+		if err := transform.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+	for _, credential := range config.Credentials {
+		if err := credential.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+
+	return &config, nil
+}
+
+// VirtualRegistry returns the virtual registry described by the configuration,
+// with a GitHub backend unless it is a passthrough registry. The options shared by all the registries (e.g. the
+// authentication) are passed in opts.
+func (c RegistryConfig) VirtualRegistry(ctx context.Context, addr string, opts ...Option) (VirtualRegistry, error) {
+	upstreamURL := c.UpstreamURL
+	if upstreamURL == "" {
+		upstreamURL = defaultUpstreamURL
+	}
+
+	registryOpts := append([]Option{}, opts...)
+	registryOpts = append(registryOpts, WithVirtualRegistry(c.Name, c.Prefix))
+	if c.ACL != "" {
+		rules, err := ParseACL(c.ACL)
+		if err != nil {
+			return VirtualRegistry{}, err
+		}
+		registryOpts = append(registryOpts, WithACL(rules))
+	}
+	if len(c.AnonymousRead) > 0 {
+		registryOpts = append(registryOpts, WithAnonymousRead(c.AnonymousRead...))
+	}
+	if len(c.Pins) > 0 {
+		registryOpts = append(registryOpts, WithDigestPins(c.Pins...))
+	}
+	if len(c.VirtualTags) > 0 {
+		registryOpts = append(registryOpts, WithVirtualTags(c.VirtualTags...))
+	}
+	if len(c.Aliases) > 0 {
+		registryOpts = append(registryOpts, WithRepositoryAliases(c.Aliases))
+	}
+	if len(c.Deprecations) > 0 {
+		registryOpts = append(registryOpts, WithDeprecations(c.Deprecations...))
+	}
+	if len(c.Quotas) > 0 {
+		registryOpts = append(registryOpts, WithQuotas(c.Quotas...))
+	}
+	if len(c.SizeLimits) > 0 {
+		registryOpts = append(registryOpts, WithSizeLimits(c.SizeLimits...))
+	}
+
+	if c.Passthrough {
+		// Credentials are optional, e.g. to raise the rate limits of Docker Hub.
+		if c.TokenEnv != "" {
+			password := os.Getenv(c.TokenEnv)
+			registerSecret(password)
+			registryOpts = append(registryOpts, WithUpstreamCredentials(c.UpstreamUsername, password))
+		}
+		server, err := newProxy(addr, nil, upstreamURL, registryOpts...)
+		if err != nil {
+			return VirtualRegistry{}, fmt.Errorf("virtual registry %s: %w", c.Name, err)
+		}
+		return VirtualRegistry{
+			Name:    c.Name,
+			Prefix:  c.Prefix,
+			Hosts:   c.Hosts,
+			Handler: server.Handler,
+		}, nil
+	}
+
+	tokenEnv := c.TokenEnv
+	if tokenEnv == "" {
+		tokenEnv = "GITHUB_TOKEN"
+	}
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return VirtualRegistry{}, fmt.Errorf("virtual registry %s: %s is not set", c.Name, tokenEnv)
+	}
+	registerSecret(token)
+
+	client := github.NewClient(newGitHubTokenClient(ctx, token))
+	client.UserAgent = userAgent
+	registry := ghbackend.New(
+		client.Users,
+		c.Users,
+		ghbackend.WithPackageTypes(c.PackageTypes...),
+		ghbackend.WithVisibility(c.Visibility),
+		ghbackend.WithTopics(c.Topics...),
+		ghbackend.WithReadmes(ghbackend.NewReadmeClient(client)),
+	)
+
+	upstreamUsername := c.UpstreamUsername
+	if upstreamUsername == "" {
+		upstreamUsername = defaultUpstreamUsername
+	}
+	registryOpts = append(registryOpts, WithUpstreamCredentials(upstreamUsername, token))
+
+	server, err := newProxy(addr, registry, upstreamURL, registryOpts...)
+	if err != nil {
+		return VirtualRegistry{}, fmt.Errorf("virtual registry %s: %w", c.Name, err)
+	}
+	return VirtualRegistry{
+		Name:    c.Name,
+		Prefix:  c.Prefix,
+		Hosts:   c.Hosts,
+		Handler: server.Handler,
+	}, nil
+}
+
+// ParseHostRoutes parses a comma-separated list of `host=URL` pairs, e.g.
+// `hub.internal.example.com=https://registry-1.docker.io`, into passthrough
+// virtual registries selected by host.
+func ParseHostRoutes(value string) ([]RegistryConfig, error) {
+	routes, err := ParseUpstreamNamespaces(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var registries []RegistryConfig
+	for host, upstreamURL := range routes {
+		registries = append(registries, RegistryConfig{
+			Name:        host,
+			Hosts:       []string{host},
+			Passthrough: true,
+			UpstreamURL: upstreamURL.String(),
+		})
+	}
+	sort.Slice(registries, func(i, j int) bool {
+		return registries[i].Name < registries[j].Name
+	})
+
+	return registries, nil
+}
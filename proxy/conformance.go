@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConformanceResult is the result of a conformance check.
+type ConformanceResult struct {
+	// Name identifies the check, e.g. `head-manifest`.
+	Name string `json:"name"`
+	// Flow is the client flow relying on the behavior checked, e.g.
+	// `skopeo inspect`.
+	Flow   string `json:"flow"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// conformanceCheck checks a behavior of the registry API.
+type conformanceCheck struct {
+	name string
+	flow string
+	run  func(c *conformanceRun) error
+}
+
+// conformanceRun is the state shared by the checks of a run.
+type conformanceRun struct {
+	ctx        context.Context
+	client     *http.Client
+	baseURL    *url.URL
+	repository string
+	tag        string
+
+	// digest and blob are set by the manifest checks.
+	digest string
+	blob   *descriptor
+}
+
+func (c *conformanceRun) do(method, path string, header http.Header) (*http.Response, []byte, error) {
+	u, err := c.baseURL.Parse(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(c.ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return res, body, err
+}
+
+func expectStatus(res *http.Response, status int) error {
+	if res.StatusCode != status {
+		return fmt.Errorf("expected status %d, got %d", status, res.StatusCode)
+	}
+	return nil
+}
+
+// expectError checks the status and the code of an error response.
+func expectError(res *http.Response, body []byte, status int, code string) error {
+	if err := expectStatus(res, status); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return fmt.Errorf("expected a JSON error, got Content-Type %q", res.Header.Get("Content-Type"))
+	}
+	var errs apiErrors
+	if err := json.Unmarshal(body, &errs); err != nil || len(errs.Errors) == 0 {
+		return fmt.Errorf("expected an error body, got %q", body)
+	}
+	if errs.Errors[0].Code != code {
+		return fmt.Errorf("expected error code %s, got %s", code, errs.Errors[0].Code)
+	}
+	return nil
+}
+
+// expectContent checks the headers describing a manifest or a blob.
+func expectContent(res *http.Response, digest string, size int64) error {
+	if value := res.Header.Get("Docker-Content-Digest"); value != digest {
+		return fmt.Errorf("expected Docker-Content-Digest %s, got %q", digest, value)
+	}
+	if value := res.Header.Get("Content-Length"); value != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("expected Content-Length %d, got %q", size, value)
+	}
+	return nil
+}
+
+var manifestAcceptHeader = http.Header{"Accept": {manifestAccept}}
+
+// conformanceChecks are the checks of the pull flows of the OCI distribution
+// specification used by skopeo, crane and the container runtimes, in order.
+var conformanceChecks = []conformanceCheck{
+	{"api-version", "docker login", func(c *conformanceRun) error {
+		res, _, err := c.do("GET", "/v2/", nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			return fmt.Errorf("expected a WWW-Authenticate challenge")
+		}
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("expected status 200 or 401, got %d", res.StatusCode)
+		}
+		if value := res.Header.Get(distributionAPIVersionHeader); value != distributionAPIVersion {
+			return fmt.Errorf("expected %s %s, got %q", distributionAPIVersionHeader, distributionAPIVersion, value)
+		}
+		return nil
+	}},
+	{"list-tags", "crane ls", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/tags/list", nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		var tags struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return fmt.Errorf("invalid tag list: %s", err)
+		}
+		if tags.Name != c.repository {
+			return fmt.Errorf("expected name %q, got %q", c.repository, tags.Name)
+		}
+		for _, tag := range tags.Tags {
+			if tag == c.tag {
+				return nil
+			}
+		}
+		return fmt.Errorf("tag %s not listed", c.tag)
+	}},
+	{"list-tags-paginated", "crane ls", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/tags/list?n=1", nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		var tags struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return fmt.Errorf("invalid tag list: %s", err)
+		}
+		if len(tags.Tags) > 1 {
+			return fmt.Errorf("expected at most 1 tag, got %d", len(tags.Tags))
+		}
+		if link := res.Header.Get("Link"); link != "" && !strings.Contains(link, `rel="next"`) {
+			return fmt.Errorf("invalid Link header: %q", link)
+		}
+		return nil
+	}},
+	{"head-manifest", "skopeo inspect", func(c *conformanceRun) error {
+		res, body, err := c.do("HEAD", "/v2/"+c.repository+"/manifests/"+c.tag, manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			return fmt.Errorf("expected no body, got %d bytes", len(body))
+		}
+		if validateDigest(res.Header.Get("Docker-Content-Digest")) != nil {
+			return fmt.Errorf("expected a Docker-Content-Digest header")
+		}
+		if res.Header.Get("Content-Type") == "" || res.Header.Get("Content-Length") == "" {
+			return fmt.Errorf("expected the Content-Type and Content-Length headers")
+		}
+		c.digest = res.Header.Get("Docker-Content-Digest")
+		return nil
+	}},
+	{"get-manifest-by-tag", "skopeo copy", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/manifests/"+c.tag, manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		if c.digest != "" && digest != c.digest {
+			return fmt.Errorf("expected the digest of the HEAD request %s, got %s", c.digest, digest)
+		}
+		if err := expectContent(res, digest, int64(len(body))); err != nil {
+			return err
+		}
+		c.digest = digest
+		if blobs := manifestBlobs(body); len(blobs) > 0 {
+			c.blob = &blobs[0]
+		}
+		return nil
+	}},
+	{"get-manifest-by-digest", "skopeo copy", func(c *conformanceRun) error {
+		if c.digest == "" {
+			return fmt.Errorf("no manifest digest")
+		}
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/manifests/"+c.digest, manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body)); digest != c.digest {
+			return fmt.Errorf("expected digest %s, got %s", c.digest, digest)
+		}
+		return expectContent(res, c.digest, int64(len(body)))
+	}},
+	{"head-blob", "skopeo copy", func(c *conformanceRun) error {
+		if c.blob == nil {
+			return fmt.Errorf("no blob in the manifest, an image manifest is expected")
+		}
+		res, body, err := c.do("HEAD", "/v2/"+c.repository+"/blobs/"+c.blob.Digest, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			return fmt.Errorf("expected no body, got %d bytes", len(body))
+		}
+		return expectContent(res, c.blob.Digest, c.blob.Size)
+	}},
+	{"get-blob", "skopeo copy", func(c *conformanceRun) error {
+		if c.blob == nil {
+			return fmt.Errorf("no blob in the manifest, an image manifest is expected")
+		}
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/blobs/"+c.blob.Digest, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body)); digest != c.blob.Digest {
+			return fmt.Errorf("expected digest %s, got %s", c.blob.Digest, digest)
+		}
+		// Harbor requires the length of the blobs it replicates.
+		if value := res.Header.Get("Content-Length"); value != strconv.FormatInt(c.blob.Size, 10) {
+			return fmt.Errorf("expected Content-Length %d, got %q", c.blob.Size, value)
+		}
+		return nil
+	}},
+	{"manifest-unknown", "skopeo inspect", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/manifests/conformance-unknown-tag", manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		return expectError(res, body, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN)
+	}},
+	{"head-manifest-unknown", "docker pull", func(c *conformanceRun) error {
+		res, body, err := c.do("HEAD", "/v2/"+c.repository+"/manifests/conformance-unknown-tag", manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusNotFound); err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			return fmt.Errorf("expected no body, got %d bytes", len(body))
+		}
+		return nil
+	}},
+	{"blob-unknown", "skopeo copy", func(c *conformanceRun) error {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("conformance-unknown-blob")))
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/blobs/"+digest, nil)
+		if err != nil {
+			return err
+		}
+		return expectError(res, body, http.StatusNotFound, ERROR_BLOB_UNKNOWN)
+	}},
+	{"digest-invalid", "crane digest", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/manifests/sha256:invalid.digest", manifestAcceptHeader)
+		if err != nil {
+			return err
+		}
+		return expectError(res, body, http.StatusBadRequest, ERROR_DIGEST_INVALID)
+	}},
+	{"name-unknown", "crane ls", func(c *conformanceRun) error {
+		res, body, err := c.do("GET", "/v2/"+c.repository+"-conformance-unknown/tags/list", nil)
+		if err != nil {
+			return err
+		}
+		return expectError(res, body, http.StatusNotFound, ERROR_NAME_UNKNOWN)
+	}},
+	{"referrers", "oras discover", func(c *conformanceRun) error {
+		if c.digest == "" {
+			return fmt.Errorf("no manifest digest")
+		}
+		res, body, err := c.do("GET", "/v2/"+c.repository+"/referrers/"+c.digest, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(res, http.StatusOK); err != nil {
+			return err
+		}
+		if contentType := res.Header.Get("Content-Type"); contentType != mediaTypeOCIIndex {
+			return fmt.Errorf("expected Content-Type %s, got %q", mediaTypeOCIIndex, contentType)
+		}
+		var index manifest
+		if err := json.Unmarshal(body, &index); err != nil || index.SchemaVersion != 2 {
+			return fmt.Errorf("invalid referrers index")
+		}
+		return nil
+	}},
+}
+
+// RunConformance checks that a registry, e.g. the proxy, behaves like the OCI
+// distribution specification expects for the pull flows of the clients, using
+// an existing image manifest of a repository.
+func RunConformance(ctx context.Context, client *http.Client, registryURL, repository, tag string) ([]ConformanceResult, error) {
+	baseURL, err := url.Parse(registryURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid registry URL: %q", registryURL)
+	}
+	if !repositoryNamePattern.MatchString(repository) || !tagNamePattern.MatchString(tag) {
+		return nil, fmt.Errorf("invalid image: %s:%s", repository, tag)
+	}
+
+	run := &conformanceRun{ctx: ctx, client: client, baseURL: baseURL, repository: repository, tag: tag}
+	var results []ConformanceResult
+	for _, check := range conformanceChecks {
+		result := ConformanceResult{Name: check.name, Flow: check.flow, Passed: true}
+		if err := check.run(run); err != nil {
+			result.Passed = false
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// runConformanceCommand runs the `conformance` subcommand, which prints the
+// results of the conformance checks and fails when a check fails.
+func runConformanceCommand(args []string) error {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	username := flags.String("username", "", "username of the registry, the password being read from REGISTRY_PASSWORD")
+	asJSON := flags.Bool("json", false, "print the results as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: container-registry-proxy conformance [-json] [-username name] <registry-url> <repository> <tag>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	transport := &tokenTransport{username: *username}
+	if *username != "" {
+		transport.password = os.Getenv("REGISTRY_PASSWORD")
+		// The credentials are sent with basic authentication to the proxy
+		// without token endpoint.
+		if u, err := url.Parse(flags.Arg(0)); err == nil {
+			transport.credentials = []UpstreamCredential{{Registry: u.Host, Username: *username, PasswordEnv: "REGISTRY_PASSWORD"}}
+		}
+	}
+	results, err := RunConformance(context.Background(), &http.Client{Transport: transport}, flags.Arg(0), flags.Arg(1), flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(struct {
+			Passed  bool                `json:"passed"`
+			Results []ConformanceResult `json:"results"`
+		}{failed == 0, results})
+	} else {
+		for _, result := range results {
+			if result.Passed {
+				fmt.Printf("PASS %-24s (%s)\n", result.Name, result.Flow)
+			} else {
+				fmt.Printf("FAIL %-24s (%s): %s\n", result.Name, result.Flow, result.Error)
+			}
+		}
+		fmt.Printf("%d/%d checks passed\n", len(results)-failed, len(results))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d conformance checks failed", failed)
+	}
+	return nil
+}
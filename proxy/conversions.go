@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// maxConversionQueue is the number of cached layers waiting to be converted,
+// the other layers being converted on a later pull.
+const maxConversionQueue = 100
+
+// conversionQueue converts the queued cached layers in the background, one at
+// a time, e.g. to transcode them to zstd.
+type conversionQueue struct {
+	name    string
+	convert func(ctx context.Context, digest string) (string, error)
+	total   *counterVec
+
+	mu      sync.Mutex
+	pending map[string]bool
+	queue   chan string
+}
+
+func newConversionQueue(name string, total *counterVec, convert func(ctx context.Context, digest string) (string, error)) *conversionQueue {
+	return &conversionQueue{
+		name:    name,
+		convert: convert,
+		total:   total,
+		pending: map[string]bool{},
+		queue:   make(chan string, maxConversionQueue),
+	}
+}
+
+// enqueue queues a cached layer to be converted, unless it already is or the
+// queue is full.
+func (q *conversionQueue) enqueue(digest string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[digest] {
+		return
+	}
+	select {
+	case q.queue <- digest:
+		q.pending[digest] = true
+	default:
+	}
+}
+
+// run converts the queued layers until ctx is done. The results are counted
+// in total, by result (converted, failed).
+func (q *conversionQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case digest := <-q.queue:
+			if converted, err := q.convert(ctx, digest); err != nil {
+				q.total.Inc("failed")
+				log.Printf("WARN layer %s not converted to %s: %s", digest, q.name, err)
+			} else {
+				q.total.Inc("converted")
+				log.Printf("layer %s converted to %s: %s", digest, q.name, converted)
+			}
+			q.mu.Lock()
+			delete(q.pending, digest)
+			q.mu.Unlock()
+		}
+	}
+}
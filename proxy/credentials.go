@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// UpstreamCredential configures the credentials used by the proxy with an
+// upstream registry, e.g. a Docker Hub account to raise the pull rate limits
+// or a personal access token of another GitHub organization. The password (or
+// token) is read from an environment variable or a file, the file being read
+// again each time a token is requested so that rotated secrets (e.g. mounted
+// from a secret manager) are picked up.
+type UpstreamCredential struct {
+	// Registry is the host of the upstream registry, e.g. `ghcr.io` or
+	// `registry-1.docker.io`.
+	Registry string `json:"registry"`
+	// Repository is a glob pattern (see path.Match) of the upstream repository
+	// names, e.g. `other-org/*`, the credentials applying to all the
+	// repositories of the registry when it is empty.
+	Repository string `json:"repository,omitempty"`
+
+	Username     string `json:"username,omitempty"`
+	PasswordEnv  string `json:"password_env,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+}
+
+func (c UpstreamCredential) validate() error {
+	if c.Registry == "" || strings.ContainsAny(c.Registry, "/ ") {
+		return fmt.Errorf("invalid upstream credential: invalid registry %q", c.Registry)
+	}
+	if _, err := path.Match(c.Repository, ""); err != nil {
+		return fmt.Errorf("invalid upstream credential for %s: %w", c.Registry, err)
+	}
+	if (c.PasswordEnv == "") == (c.PasswordFile == "") {
+		return fmt.Errorf("invalid upstream credential for %s: one of password_env and password_file is required", c.Registry)
+	}
+	return nil
+}
+
+func (c UpstreamCredential) matches(host, name string) bool {
+	if host != c.Registry {
+		return false
+	}
+	if c.Repository == "" {
+		return true
+	}
+	matched, _ := path.Match(c.Repository, name)
+	return matched
+}
+
+// password returns the password of the credentials, which may reference a
+// secret stored in a secret manager (see isSecretReference).
+func (c UpstreamCredential) password(ctx context.Context) (string, error) {
+	var password string
+	if c.PasswordEnv != "" {
+		password = os.Getenv(c.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("upstream credential for %s: %s is not set", c.Registry, c.PasswordEnv)
+		}
+	} else {
+		data, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("upstream credential for %s: %w", c.Registry, err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	registerSecret(password)
+	return resolveSecret(ctx, password)
+}
+
+// upstreamCredential returns the first credentials matching the host and the
+// repository of a request, if any.
+func upstreamCredential(credentials []UpstreamCredential, req *http.Request) (UpstreamCredential, bool) {
+	name, _ := repositoryFromPath(req.URL.Path)
+	for _, credential := range credentials {
+		if credential.matches(req.URL.Host, name) {
+			return credential, true
+		}
+	}
+	return UpstreamCredential{}, false
+}
+
+// WithScopedCredentials configures the credentials used by the proxy with the
+// upstream registries, by registry and repository, instead of the upstream
+// credentials (see WithUpstreamCredentials) or anonymously. The first
+// credentials matching a request are used.
+func WithScopedCredentials(credentials ...UpstreamCredential) Option {
+	return func(p *containerProxy) {
+		for _, credential := range credentials {
+			if err := credential.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			p.credentials = append(p.credentials, credential)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a standard 5-field cron expression (minute, hour, day of
+// month, month, day of week), evaluated in the local time zone.
+type CronSchedule struct {
+	expr string
+
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// Like cron, when both the day of month and the day of week are
+	// restricted, a day matching either of them matches.
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+var cronAliases = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// ParseCronSchedule parses a cron expression, e.g. `30 5 * * 1-5` or
+// `@daily`. Fields support `*`, lists, ranges and steps.
+func ParseCronSchedule(value string) (*CronSchedule, error) {
+	expr := strings.TrimSpace(value)
+	if alias, ok := cronAliases[expr]; ok {
+		expr = alias
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron schedule: %q", value)
+	}
+
+	schedule := CronSchedule{expr: strings.TrimSpace(value)}
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minute, 0, 59},
+		{&schedule.hour, 0, 23},
+		{&schedule.dayOfMonth, 1, 31},
+		{&schedule.month, 1, 12},
+		{&schedule.dayOfWeek, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron schedule: %q: %w", value, err)
+		}
+		*field.bits = bits
+	}
+	// Sunday is either 0 or 7.
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+	schedule.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	schedule.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+
+	return &schedule, nil
+}
+
+// parseCronField returns the values of a cron field as a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeValue, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepValue); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %q", part)
+			}
+		}
+
+		start, end := min, max
+		if rangeValue != "*" {
+			startValue, endValue, isRange := strings.Cut(rangeValue, "-")
+			var err error
+			if start, err = strconv.Atoi(startValue); err != nil {
+				return 0, fmt.Errorf("invalid value: %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endValue); err != nil {
+					return 0, fmt.Errorf("invalid value: %q", part)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("out of range: %q", part)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+
+	return bits, nil
+}
+
+// String returns the cron expression of the schedule.
+func (s *CronSchedule) String() string {
+	return s.expr
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := s.dayOfWeek&(1<<int(t.Weekday())) != 0
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// Next returns the first time matching the schedule after t, or the zero time
+// when there is none (e.g. February 30th).
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Schedules repeat at least every 4 years.
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// runCronJob calls fn at the times of the schedule until ctx is done, but only
+// when the current replica is the leader. The runs are recorded by jobs.
+func runCronJob(ctx context.Context, elector LeaderElector, jobs *jobTracker, name string, schedule *CronSchedule, fn func(ctx context.Context, run *jobRun) error) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("WARN job %s: the schedule never matches", name)
+			return
+		}
+		jobs.scheduled(name, schedule.String(), next)
+		if err := sleepContext(ctx, time.Until(next)); err != nil {
+			return
+		}
+
+		if !elector.IsLeader() {
+			continue
+		}
+		if err := jobs.run(ctx, name, fn); err != nil {
+			log.Printf("WARN job %s: %s", name, err)
+		}
+	}
+}
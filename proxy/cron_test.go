@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	now := time.Date(2024, time.March, 15, 10, 30, 45, 0, time.UTC) // Friday
+
+	for _, tc := range []struct {
+		schedule string
+		expected time.Time
+	}{
+		{schedule: "* * * * *", expected: time.Date(2024, time.March, 15, 10, 31, 0, 0, time.UTC)},
+		{schedule: "0 * * * *", expected: time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+		{schedule: "*/15 * * * *", expected: time.Date(2024, time.March, 15, 10, 45, 0, 0, time.UTC)},
+		{schedule: "30 5 * * 1-5", expected: time.Date(2024, time.March, 18, 5, 30, 0, 0, time.UTC)},
+		{schedule: "0 22 * * 7", expected: time.Date(2024, time.March, 17, 22, 0, 0, 0, time.UTC)},
+		{schedule: "0 0 1,15 * *", expected: time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{schedule: "0 0 29 2 *", expected: time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// The day of month or the day of week.
+		{schedule: "0 0 20 * 6", expected: time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{schedule: "@daily", expected: time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{schedule: "0 0 30 2 *", expected: time.Time{}},
+	} {
+		schedule, err := ParseCronSchedule(tc.schedule)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tc.schedule, err)
+		}
+		if next := schedule.Next(now); !next.Equal(tc.expected) {
+			t.Fatalf("%s: expected: %s, got: %s", tc.schedule, tc.expected, next)
+		}
+	}
+
+	for _, value := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@never"} {
+		if _, err := ParseCronSchedule(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// grafanaDashboard is the subset of the JSON model of a Grafana dashboard
+// used by the `dashboard` command.
+type grafanaDashboard struct {
+	Title         string             `json:"title"`
+	UID           string             `json:"uid"`
+	Tags          []string           `json:"tags"`
+	SchemaVersion int                `json:"schemaVersion"`
+	Refresh       string             `json:"refresh"`
+	Time          grafanaTimeRange   `json:"time"`
+	Templating    grafanaTemplating  `json:"templating"`
+	Panels        []grafanaPanel     `json:"panels"`
+	Annotations   grafanaAnnotations `json:"annotations"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaAnnotations struct {
+	List []any `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Query      string             `json:"query"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	IncludeAll bool               `json:"includeAll"`
+	AllValue   string             `json:"allValue,omitempty"`
+	Multi      bool               `json:"multi"`
+	Refresh    int                `json:"refresh"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Datasource  grafanaDatasource  `json:"datasource"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	FieldConfig grafanaFieldConfig `json:"fieldConfig"`
+	Targets     []grafanaTarget    `json:"targets"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// dashboardDatasource is the Prometheus data source selected with the
+// `datasource` variable of the dashboard.
+var dashboardDatasource = grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+
+// newDashboard returns a Grafana dashboard of the metrics exposed on
+// /metrics. The queries use the names of the registered metrics so that the
+// dashboard follows them.
+func newDashboard() grafanaDashboard {
+	// The namespace and backend variables filter the panels, `.*` matching
+	// the requests without namespace too.
+	selector := `namespace=~"$namespace",backend=~"$backend"`
+	namespace := `namespace=~"$namespace"`
+
+	panels := []struct {
+		title  string
+		unit   string
+		expr   string
+		legend string
+	}{
+		{
+			title:  "Requests by route",
+			unit:   "reqps",
+			expr:   fmt.Sprintf(`sum by (route) (rate(%s{%s}[$__rate_interval]))`, requestsTotal.name, selector),
+			legend: "{{route}}",
+		},
+		{
+			title:  "Availability by route",
+			unit:   "percentunit",
+			expr:   fmt.Sprintf(`1 - sum by (route) (rate(%[1]s{status="5xx",%[2]s}[$__rate_interval])) / sum by (route) (rate(%[1]s{%[2]s}[$__rate_interval]))`, requestsTotal.name, selector),
+			legend: "{{route}}",
+		},
+		{
+			title:  "p99 latency by route",
+			unit:   "s",
+			expr:   fmt.Sprintf(`histogram_quantile(0.99, sum by (route, le) (rate(%s_bucket[$__rate_interval])))`, requestDurationSeconds.name),
+			legend: "{{route}}",
+		},
+		{
+			title:  "Requests by namespace",
+			unit:   "reqps",
+			expr:   fmt.Sprintf(`sum by (namespace, backend) (rate(%s{%s}[$__rate_interval]))`, requestsTotal.name, selector),
+			legend: "{{namespace}} ({{backend}})",
+		},
+		{
+			title:  "Upstream error ratio",
+			unit:   "percentunit",
+			expr:   fmt.Sprintf(`sum by (host) (rate(%[1]s{result="error"}[$__rate_interval])) / sum by (host) (rate(%[1]s{result!="canceled"}[$__rate_interval]))`, upstreamRequestsTotal.name),
+			legend: "{{host}}",
+		},
+		{
+			title:  "Upstream health",
+			unit:   "short",
+			expr:   upstreamUp.name,
+			legend: "{{upstream}}",
+		},
+		{
+			title:  "Blob cache hit ratio",
+			unit:   "percentunit",
+			expr:   fmt.Sprintf(`sum by (namespace) (rate(%[1]s{result=~"hit|coalesced",%[2]s}[$__rate_interval])) / sum by (namespace) (rate(%[1]s{%[2]s}[$__rate_interval]))`, blobCacheRequestsTotal.name, namespace),
+			legend: "{{namespace}}",
+		},
+		{
+			title:  "Blob cache requests by result",
+			unit:   "reqps",
+			expr:   fmt.Sprintf(`sum by (result) (rate(%s{%s}[$__rate_interval]))`, blobCacheRequestsTotal.name, namespace),
+			legend: "{{result}}",
+		},
+		{
+			title:  "Manifests by type",
+			unit:   "reqps",
+			expr:   fmt.Sprintf(`sum by (method, type) (rate(%s{%s}[$__rate_interval]))`, manifestsTotal.name, namespace),
+			legend: "{{method}} {{type}}",
+		},
+		{
+			title:  "Quota rejections",
+			unit:   "short",
+			expr:   fmt.Sprintf(`sum by (namespace) (increase(%s{%s}[$__rate_interval]))`, quotaRejectionsTotal.name, namespace),
+			legend: "{{namespace}}",
+		},
+		{
+			title:  "Deprecated pulls",
+			unit:   "short",
+			expr:   fmt.Sprintf(`sum by (repository) (increase(%s[$__rate_interval]))`, deprecatedPullsTotal.name),
+			legend: "{{repository}}",
+		},
+		{
+			title:  "Background jobs",
+			unit:   "short",
+			expr:   fmt.Sprintf(`sum by (job, result) (increase(%s[$__rate_interval]))`, jobRunsTotal.name),
+			legend: "{{job}} {{result}}",
+		},
+	}
+
+	dashboard := grafanaDashboard{
+		Title:         "Container Registry Proxy",
+		UID:           "container-registry-proxy",
+		Tags:          []string{"container-registry-proxy"},
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				Name:       "namespace",
+				Label:      "Namespace",
+				Type:       "query",
+				Query:      fmt.Sprintf("label_values(%s, namespace)", requestsTotal.name),
+				Datasource: &dashboardDatasource,
+				IncludeAll: true,
+				AllValue:   ".*",
+				Multi:      true,
+				Refresh:    2,
+			},
+			{
+				Name:       "backend",
+				Label:      "Backend",
+				Type:       "query",
+				Query:      fmt.Sprintf("label_values(%s, backend)", requestsTotal.name),
+				Datasource: &dashboardDatasource,
+				IncludeAll: true,
+				AllValue:   ".*",
+				Multi:      true,
+				Refresh:    2,
+			},
+		}},
+		Annotations: grafanaAnnotations{List: []any{}},
+	}
+	for i, panel := range panels {
+		p := grafanaPanel{
+			ID:         i + 1,
+			Type:       "timeseries",
+			Title:      panel.title,
+			Datasource: dashboardDatasource,
+			GridPos:    grafanaGridPos{H: 8, W: 12, X: 12 * (i % 2), Y: 8 * (i / 2)},
+		}
+		p.FieldConfig.Defaults.Unit = panel.unit
+		p.Targets = []grafanaTarget{{RefID: "A", Expr: panel.expr, LegendFormat: panel.legend}}
+		dashboard.Panels = append(dashboard.Panels, p)
+	}
+
+	return dashboard
+}
+
+// WriteDashboard writes the JSON model of the Grafana dashboard, to be
+// imported in Grafana or provisioned from a file.
+func WriteDashboard(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newDashboard())
+}
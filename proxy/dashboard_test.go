@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	var b strings.Builder
+	for _, m := range allMetrics {
+		m.write(&b)
+	}
+	registered := map[string]bool{}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			registered[fields[2]] = true
+		}
+	}
+
+	var out bytes.Buffer
+	if err := WriteDashboard(&out); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	var dashboard grafanaDashboard
+	if err := json.Unmarshal(out.Bytes(), &dashboard); err != nil {
+		t.Fatalf("expected a valid JSON, got: %s", err)
+	}
+	if len(dashboard.Panels) == 0 {
+		t.Fatal("expected panels")
+	}
+
+	// The queries only use the metrics exposed by the proxy.
+	name := regexp.MustCompile(metricsNamespace + `_[a-z_]+`)
+	for _, panel := range dashboard.Panels {
+		for _, target := range panel.Targets {
+			for _, metric := range name.FindAllString(target.Expr, -1) {
+				metric = strings.TrimSuffix(metric, "_bucket")
+				if !registered[metric] {
+					t.Fatalf("%s: unknown metric %s", panel.Title, metric)
+				}
+			}
+		}
+	}
+}
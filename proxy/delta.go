@@ -0,0 +1,552 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// deltaMagic starts the layer deltas, which are sequences of copy (`C`,
+	// with an offset and a length in the base layer), literal (`L`, with a
+	// length and the data) and end (`E`) operations on the uncompressed
+	// layers, in the style of rsync. The deltas are compressed with gzip.
+	deltaMagic = "CRPDELTA1\n"
+	// deltaBlockSize is the size of the blocks of the base layer looked up in
+	// the changed layer.
+	deltaBlockSize = 4096
+	// deltaFileName is the file of the delta archives listing the layers of
+	// the image.
+	deltaFileName = "delta.json"
+)
+
+var deltaArchiveLayersTotal = newCounterVec(
+	"delta_archive_layers_total",
+	"Number of layers of the delta archives by kind (base, delta, full).",
+	"kind",
+)
+
+var errInvalidDelta = errors.New("invalid layer delta")
+
+// deltaArchive is the `delta.json` file of a delta archive.
+type deltaArchive struct {
+	// From is the digest of the manifest of the base image.
+	From string `json:"from"`
+	// Config is the path of the config of the image in the archive.
+	Config   string       `json:"config"`
+	RepoTags []string     `json:"repo_tags,omitempty"`
+	Layers   []deltaLayer `json:"layers"`
+}
+
+// deltaLayer is a layer of a delta archive, by kind: `base` for the layers of
+// the base image, `delta` for the layers encoded against a layer of the base
+// image, and `full` for the other layers, which are in the archive.
+type deltaLayer struct {
+	DiffID string `json:"diff_id"`
+	Kind   string `json:"kind"`
+	// Base is the diff ID of the layer of the base image of a delta.
+	Base string `json:"base,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// deltaBlock is a block of a base layer.
+type deltaBlock struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+// weakChecksum returns the rolling checksum of a block, as computed by rsync.
+func weakChecksum(block []byte) (a, b uint32) {
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// indexDeltaBase returns the blocks of a base layer by weak checksum.
+func indexDeltaBase(base io.Reader) (map[uint32][]deltaBlock, error) {
+	index := map[uint32][]deltaBlock{}
+	reader := bufio.NewReaderSize(base, 1<<20)
+	block := make([]byte, deltaBlockSize)
+	for offset := int64(0); ; offset += deltaBlockSize {
+		if _, err := io.ReadFull(reader, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return index, nil
+		} else if err != nil {
+			return nil, err
+		}
+		a, b := weakChecksum(block)
+		key := a | b<<16
+		strong := sha256.Sum256(block)
+		// The repeated blocks, e.g. the padding of the tar files, are
+		// indexed once.
+		if _, ok := findDeltaBlock(index[key], strong); !ok {
+			index[key] = append(index[key], deltaBlock{offset: offset, strong: strong})
+		}
+	}
+}
+
+func findDeltaBlock(blocks []deltaBlock, strong [sha256.Size]byte) (int64, bool) {
+	for _, block := range blocks {
+		if block.strong == strong {
+			return block.offset, true
+		}
+	}
+	return 0, false
+}
+
+// deltaEncoder writes the operations of a delta, merging the contiguous
+// copies.
+type deltaEncoder struct {
+	w          *bufio.Writer
+	copyOffset int64
+	copyLength int64
+}
+
+func (e *deltaEncoder) op(kind byte, values ...int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	e.w.WriteByte(kind)
+	for _, value := range values {
+		n := binary.PutUvarint(scratch[:], uint64(value))
+		e.w.Write(scratch[:n])
+	}
+}
+
+func (e *deltaEncoder) flushCopy() {
+	if e.copyLength > 0 {
+		e.op('C', e.copyOffset, e.copyLength)
+		e.copyLength = 0
+	}
+}
+
+func (e *deltaEncoder) copy(offset, length int64) {
+	if e.copyLength > 0 && e.copyOffset+e.copyLength == offset {
+		e.copyLength += length
+		return
+	}
+	e.flushCopy()
+	e.copyOffset, e.copyLength = offset, length
+}
+
+func (e *deltaEncoder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.flushCopy()
+	e.op('L', int64(len(data)))
+	e.w.Write(data)
+}
+
+// writeDelta writes the delta turning the uncompressed base layer into the
+// uncompressed target layer, the blocks of the base layer being found at any
+// offset of the target layer with a rolling checksum.
+func writeDelta(out io.Writer, base, target io.Reader) error {
+	index, err := indexDeltaBase(base)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString(deltaMagic)
+	e := &deltaEncoder{w: w}
+
+	// buf[lit:pos] is the pending literal, and buf[pos:pos+deltaBlockSize]
+	// the window of the rolling checksum.
+	buf := make([]byte, 1<<20)
+	n, pos, lit := 0, 0, 0
+	eof, rolling := false, false
+	var a, b uint32
+	for {
+		if n-pos <= deltaBlockSize && !eof {
+			e.literal(buf[lit:pos])
+			n = copy(buf, buf[pos:n])
+			pos, lit = 0, 0
+			m, err := io.ReadFull(target, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+		if n-pos < deltaBlockSize {
+			break
+		}
+
+		window := buf[pos : pos+deltaBlockSize]
+		if !rolling {
+			a, b = weakChecksum(window)
+			rolling = true
+		}
+		if blocks := index[a|b<<16]; len(blocks) > 0 {
+			if offset, ok := findDeltaBlock(blocks, sha256.Sum256(window)); ok {
+				e.literal(buf[lit:pos])
+				e.copy(offset, deltaBlockSize)
+				pos += deltaBlockSize
+				lit, rolling = pos, false
+				continue
+			}
+		}
+		if pos+deltaBlockSize == n {
+			break
+		}
+		dropped, added := uint32(buf[pos]), uint32(buf[pos+deltaBlockSize])
+		a = (a - dropped + added) & 0xffff
+		b = (b - deltaBlockSize*dropped + a) & 0xffff
+		pos++
+	}
+	e.literal(buf[lit:n])
+	e.flushCopy()
+	w.WriteByte('E')
+	return w.Flush()
+}
+
+// applyDelta writes the layer encoded by a delta against an uncompressed base
+// layer.
+func applyDelta(out io.Writer, base io.ReaderAt, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("%w: unknown format", errInvalidDelta)
+	}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidDelta, err)
+		}
+		switch kind {
+		case 'E':
+			return nil
+		case 'C':
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errInvalidDelta, err)
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errInvalidDelta, err)
+			}
+			if n, err := io.Copy(out, io.NewSectionReader(base, int64(offset), int64(length))); err != nil {
+				return err
+			} else if n != int64(length) {
+				return fmt.Errorf("%w: copy beyond the base layer", errInvalidDelta)
+			}
+		case 'L':
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errInvalidDelta, err)
+			}
+			if _, err := io.CopyN(out, r, int64(length)); err != nil {
+				return fmt.Errorf("%w: %s", errInvalidDelta, err)
+			}
+		default:
+			return fmt.Errorf("%w: unknown operation %q", errInvalidDelta, kind)
+		}
+	}
+}
+
+// isGzipLayer returns whether a layer is compressed with gzip, the deltas
+// being computed between gzip layers only.
+func isGzipLayer(mediaType string) bool {
+	return mediaType == mediaTypeOCILayerGzip || mediaType == mediaTypeDockerLayerGzip
+}
+
+// deltaMappingPath returns the path of the file mapping two cached layers to
+// their delta, or to `full` when the delta is not smaller than the layer.
+func deltaMappingPath(c *cache.Cache, base, target string) string {
+	return filepath.Join(c.Dir(), "deltas", strings.TrimPrefix(base, "sha256:")+"-"+strings.TrimPrefix(target, "sha256:"))
+}
+
+// layerDelta returns the digest of the delta between two cached gzip layers,
+// added to the cache, or "" when the delta is not smaller than the target
+// layer.
+func layerDelta(c *cache.Cache, base, target descriptor) (string, error) {
+	mappingPath := deltaMappingPath(c, base.Digest, target.Digest)
+	if data, err := os.ReadFile(mappingPath); err == nil {
+		if string(data) == "full" {
+			return "", nil
+		}
+		// The delta may have been evicted from the cache.
+		if cache.IsCacheableDigest(string(data)) && c.Has(string(data)) {
+			return string(data), nil
+		}
+	}
+
+	delta, size, err := encodeDelta(c, base.Digest, target.Digest)
+	if err != nil {
+		return "", err
+	}
+	mapping := delta
+	if size >= target.Size {
+		c.Remove(delta)
+		delta, mapping = "", "full"
+	}
+	if err := os.MkdirAll(filepath.Dir(mappingPath), 0o755); err != nil {
+		return "", err
+	}
+	return delta, os.WriteFile(mappingPath, []byte(mapping), 0o644)
+}
+
+// encodeDelta adds the delta between two cached gzip layers to the cache.
+func encodeDelta(c *cache.Cache, base, target string) (string, int64, error) {
+	open := func(digest string) (io.ReadCloser, error) {
+		f, _, err := c.Open(digest)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, f}, nil
+	}
+	baseLayer, err := open(base)
+	if err != nil {
+		return "", 0, err
+	}
+	defer baseLayer.Close()
+	targetLayer, err := open(target)
+	if err != nil {
+		return "", 0, err
+	}
+	defer targetLayer.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := writeDelta(gz, baseLayer, targetLayer)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	digest, size, err := c.Add(pr)
+	// The encoding stops when the delta cannot be added.
+	pr.Close()
+	return digest, size, err
+}
+
+// deltaImage is an image of a delta archive.
+type deltaImage struct {
+	digest   string
+	manifest manifest
+	config   []byte
+	diffIDs  []string
+}
+
+// errPlatformRequired is returned for the multi-platform images when no
+// platform is selected.
+var errPlatformRequired = errors.New("platform required for a multi-platform image")
+
+// resolveDeltaImage returns the image of a reference, selecting a platform of
+// a multi-platform image, with its config.
+func (p *containerProxy) resolveDeltaImage(r *http.Request, repository, reference string, selected *platform) (*deltaImage, error) {
+	body, contentType, digest, err := p.pullManifest(r, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	digest = manifestDigest(reference, digest, body)
+	if classifyManifest(contentType, body) == manifestTypeIndex {
+		if selected == nil {
+			return nil, errPlatformRequired
+		}
+		var index manifest
+		json.Unmarshal(body, &index)
+		body = nil
+		for _, child := range index.Manifests {
+			if selected.matches(child.Platform) {
+				if body, _, _, err = p.pullManifest(r, repository, child.Digest); err != nil {
+					return nil, err
+				}
+				digest = child.Digest
+				break
+			}
+		}
+		if body == nil {
+			return nil, fmt.Errorf("%w: no manifest for platform %s/%s", errManifestUnknown, selected.OS, selected.Architecture)
+		}
+	}
+
+	image := &deltaImage{digest: digest}
+	if err := json.Unmarshal(body, &image.manifest); err != nil || image.manifest.Config == nil {
+		return nil, fmt.Errorf("%s:%s is not an image", repository, reference)
+	}
+	config, err := p.openBlob(r.Context(), r, repository, image.manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer config.Close()
+	if image.config, err = io.ReadAll(io.LimitReader(config, maxImageConfigSize)); err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(image.config); "sha256:"+hex.EncodeToString(sum[:]) != image.manifest.Config.Digest {
+		return nil, fmt.Errorf("config %s: digest mismatch", image.manifest.Config.Digest)
+	}
+	var fields struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if json.Unmarshal(image.config, &fields) != nil || len(fields.RootFS.DiffIDs) != len(image.manifest.Layers) {
+		return nil, fmt.Errorf("invalid image config %s", image.manifest.Config.Digest)
+	}
+	image.diffIDs = fields.RootFS.DiffIDs
+	return image, nil
+}
+
+// DeltaImage streams the changes of an image since a base image, given by the
+// `from` query parameter, as a tarball for the sites with a constrained
+// bandwidth: the layers of the base image are omitted, the changed layers are
+// encoded against the layer of the base image at the same position when both
+// are cached and the delta is smaller, and the other layers are sent in full.
+// The `platform` query parameter selects the platform of the multi-platform
+// images. `container-registry-proxy delta apply` rebuilds the image from an
+// export of the base image and the delta archive.
+func (p *containerProxy) DeltaImage(w http.ResponseWriter, r *http.Request) {
+	log.Printf("DeltaImage Request %s -> %s", r.Method, r.URL)
+
+	owner, name, reference := chi.URLParam(r, "owner"), chi.URLParam(r, "name"), chi.URLParam(r, "reference")
+	repository := owner + "/" + name
+	if !repositoryNamePattern.MatchString(repository) {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, "missing from parameter")
+		return
+	}
+	var selected *platform
+	if value := r.URL.Query().Get("platform"); value != "" {
+		var err error
+		if selected, err = parsePlatform(value); err != nil {
+			Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, err.Error())
+			return
+		}
+	}
+
+	var images [2]*deltaImage
+	for i, ref := range []string{reference, from} {
+		image, err := p.resolveDeltaImage(r, repository, ref, selected)
+		var refused *pullError
+		switch {
+		case errors.As(err, &refused):
+			refused.relay(w)
+			return
+		case errors.Is(err, errManifestUnknown):
+			Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, err.Error())
+			return
+		case errors.Is(err, errPlatformRequired):
+			Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, err.Error())
+			return
+		case err != nil:
+			Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+			return
+		}
+		images[i] = image
+	}
+	target, base := images[0], images[1]
+
+	archive := deltaArchive{From: base.digest, Config: blobPath(target.manifest.Config.Digest), Layers: []deltaLayer{}}
+	if validateDigest(reference) != nil {
+		archive.RepoTags = []string{r.Host + "/" + repository + ":" + reference}
+	}
+	inBase := map[string]bool{}
+	for _, diffID := range base.diffIDs {
+		inBase[diffID] = true
+	}
+	blobs := []exportBlob{{digest: target.manifest.Config.Digest, size: int64(len(target.config)), body: target.config}}
+	seen := map[string]bool{}
+	for i, layer := range target.manifest.Layers {
+		entry := deltaLayer{DiffID: target.diffIDs[i], Kind: "base"}
+		if !inBase[entry.DiffID] {
+			entry.Kind, entry.Path = "full", blobPath(layer.Digest)
+			blob := exportBlob{digest: layer.Digest, size: layer.Size}
+			if delta, baseDiffID, size, ok := p.deltaFromBase(base, i, layer); ok {
+				entry.Kind, entry.Base, entry.Path = "delta", baseDiffID, blobPath(delta)
+				blob = exportBlob{digest: delta, size: size, cached: true}
+			}
+			if !seen[blob.digest] {
+				seen[blob.digest] = true
+				blobs = append(blobs, blob)
+			}
+		}
+		archive.Layers = append(archive.Layers, entry)
+	}
+	for _, entry := range archive.Layers {
+		deltaArchiveLayersTotal.Inc(entry.Kind)
+	}
+	index, _ := json.Marshal(archive)
+
+	filename := strings.ReplaceAll(owner+"-"+name+"-"+from+"-"+reference, ":", "-") + ".delta.tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	modTime := time.Now().UTC().Truncate(time.Second)
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: deltaFileName, Mode: 0o644, Size: int64(len(index)), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return
+	}
+	if _, err := tw.Write(index); err != nil {
+		return
+	}
+	// As for the exports, the blobs are not fetched with the context of the
+	// request.
+	for _, blob := range blobs {
+		if err := p.writeExportBlob(p.background(), r, tw, repository, blob, modTime); err != nil {
+			log.Printf("WARN delta of %s:%s from %s failed: %s", repository, reference, from, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	tw.Close()
+}
+
+// deltaFromBase returns the cached delta of the i-th layer of an image
+// against the layer of the base image at the same position (or its last
+// layer), with the diff ID of the base layer and the size of the delta.
+func (p *containerProxy) deltaFromBase(base *deltaImage, i int, layer descriptor) (string, string, int64, bool) {
+	if p.blobCache == nil || len(base.manifest.Layers) == 0 {
+		return "", "", 0, false
+	}
+	if i >= len(base.manifest.Layers) {
+		i = len(base.manifest.Layers) - 1
+	}
+	baseLayer := base.manifest.Layers[i]
+	if !isGzipLayer(layer.MediaType) || !isGzipLayer(baseLayer.MediaType) || !p.blobCache.Has(layer.Digest) || !p.blobCache.Has(baseLayer.Digest) {
+		return "", "", 0, false
+	}
+	delta, err := layerDelta(p.blobCache, baseLayer, layer)
+	if err != nil {
+		log.Printf("WARN delta of layer %s from %s failed: %s", layer.Digest, baseLayer.Digest, err)
+		return "", "", 0, false
+	}
+	if delta == "" {
+		return "", "", 0, false
+	}
+	info, err := os.Stat(p.blobCache.Path(delta))
+	if err != nil {
+		return "", "", 0, false
+	}
+	return delta, base.diffIDs[i], info.Size(), true
+}
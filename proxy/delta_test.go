@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	base := make([]byte, 200000)
+	random.Read(base)
+	tail := make([]byte, 10000)
+	random.Read(tail)
+	var target []byte
+	target = append(target, base[:50000]...)
+	target = append(target, "some inserted bytes"...)
+	target = append(target, base[50000:120000]...)
+	target = append(target, bytes.Repeat([]byte{0}, 10000)...)
+	target = append(target, base[130000:]...)
+	target = append(target, tail...)
+
+	var delta bytes.Buffer
+	if err := writeDelta(&delta, bytes.NewReader(base), bytes.NewReader(target)); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() > 30000 {
+		t.Fatalf("expected a small delta, got: %d bytes", delta.Len())
+	}
+	var applied bytes.Buffer
+	if err := applyDelta(&applied, bytes.NewReader(base), &delta); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied.Bytes(), target) {
+		t.Fatal("unexpected layer")
+	}
+
+	if err := applyDelta(io.Discard, bytes.NewReader(base), bytes.NewReader([]byte(deltaMagic+"C\x00\xff\xff\xff\x01E"))); err == nil {
+		t.Fatal("expected an error for a copy beyond the base layer")
+	}
+	if err := applyDelta(io.Discard, bytes.NewReader(base), bytes.NewReader([]byte(deltaMagic+"L\x05abc"))); err == nil {
+		t.Fatal("expected an error for a truncated delta")
+	}
+}
+
+func TestDeltaImage(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	binary := make([]byte, 300000)
+	random.Read(binary)
+	updated := append(append([]byte{}, binary[:100000]...), binary[100100:]...)
+
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+	var layers [][]byte
+	image := func(tag string, files ...map[string][]byte) {
+		var descriptors []map[string]interface{}
+		var diffIDs []string
+		for _, f := range files {
+			layer := makeLayer(t, f)
+			layers = append(layers, layer)
+			blobs[digestOf(layer)] = layer
+			gz, _ := gzip.NewReader(bytes.NewReader(layer))
+			uncompressed, _ := io.ReadAll(gz)
+			diffIDs = append(diffIDs, digestOf(uncompressed))
+			descriptors = append(descriptors, map[string]interface{}{"mediaType": mediaTypeOCILayerGzip, "digest": digestOf(layer), "size": len(layer)})
+		}
+		config, _ := json.Marshal(map[string]interface{}{
+			"architecture": "amd64",
+			"os":           "linux",
+			"config":       map[string]interface{}{"Labels": map[string]string{"version": tag}},
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		blobs[digestOf(config)] = config
+		manifests[tag], _ = json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     mediaTypeOCIManifest,
+			"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": digestOf(config), "size": len(config)},
+			"layers":        descriptors,
+		})
+	}
+	system := map[string][]byte{"etc/hostname": []byte("some-host\n"), "usr/bin/app": []byte("none")}
+	image("1.0", system, map[string][]byte{"etc/hostname": []byte("some-host\n"), "usr/bin/app": binary})
+	image("2.0", system, map[string][]byte{"etc/hostname": []byte("some-host\n"), "usr/bin/app": updated}, map[string][]byte{"etc/hostname": []byte("other-host\n")})
+	upstream := newFakeBlobRegistry(blobs)
+	upstream.manifests = manifests
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(t.TempDir()),
+	)
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer good")
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+	// The last layer of the new version is not cached.
+	for _, layer := range layers[:4] {
+		if res := get("/v2/some-owner/some-package/blobs/" + digestOf(layer)); res.Code != http.StatusOK {
+			t.Fatalf("expected the layer, got: %d", res.Code)
+		}
+	}
+
+	dir := t.TempDir()
+	res := get("/api/repos/some-owner/some-package/1.0/export")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected the export, got: %d %s", res.Code, res.Body)
+	}
+	os.WriteFile(filepath.Join(dir, "base.tar"), res.Body.Bytes(), 0o644)
+
+	if res := get("/api/repos/some-owner/some-package/2.0/delta"); res.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %d, got: %d", http.StatusBadRequest, res.Code)
+	}
+	if res := get("/api/repos/some-owner/some-package/2.0/delta?from=0.1"); res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+	res = get("/api/repos/some-owner/some-package/2.0/delta?from=1.0")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected the delta, got: %d %s", res.Code, res.Body)
+	}
+	if res.Header().Get("Docker-Content-Digest") != "" {
+		t.Fatal("expected no Docker-Content-Digest header for an archive")
+	}
+	deltaArchiveBytes := res.Body.Bytes()
+
+	// The images are pulled with the credentials of the client.
+	req, _ := http.NewRequest("GET", "/api/repos/some-owner/some-package/2.0/delta?from=1.0", nil)
+	anonymous := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(anonymous, req)
+	if anonymous.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, anonymous.Code)
+	}
+	os.WriteFile(filepath.Join(dir, "delta.tar"), deltaArchiveBytes, 0o644)
+
+	var archive deltaArchive
+	files := map[string]int{}
+	tr := tar.NewReader(bytes.NewReader(deltaArchiveBytes))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = len(content)
+		if header.Name == deltaFileName {
+			json.Unmarshal(content, &archive)
+		}
+	}
+	var kinds []string
+	for _, layer := range archive.Layers {
+		kinds = append(kinds, layer.Kind)
+	}
+	if len(kinds) != 3 || kinds[0] != "base" || kinds[1] != "delta" || kinds[2] != "full" {
+		t.Fatalf("unexpected layers: %v", kinds)
+	}
+	if size := files[archive.Layers[1].Path]; size == 0 || size > len(layers[3])/10 {
+		t.Fatalf("expected a small delta, got: %d bytes for a layer of %d bytes", size, len(layers[3]))
+	}
+	if _, ok := files[blobPath(digestOf(layers[0]))]; ok {
+		t.Fatal("expected the layer of the base image to be omitted")
+	}
+
+	// The image is rebuilt from the export of the base image.
+	output := filepath.Join(dir, "app.tar")
+	if err := applyDeltaArchive(filepath.Join(dir, "base.tar"), filepath.Join(dir, "delta.tar"), output); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.Close()
+	rebuiltFiles := map[string][]byte{}
+	tr = tar.NewReader(rebuilt)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebuiltFiles[header.Name], _ = io.ReadAll(tr)
+	}
+	var saved []dockerSaveManifest
+	if err := json.Unmarshal(rebuiltFiles["manifest.json"], &saved); err != nil || len(saved) != 1 || len(saved[0].Layers) != 3 {
+		t.Fatalf("unexpected manifest.json: %s", rebuiltFiles["manifest.json"])
+	}
+	var m manifest
+	json.Unmarshal(manifests["2.0"], &m)
+	if !bytes.Equal(rebuiltFiles[saved[0].Config], blobs[m.Config.Digest]) {
+		t.Fatal("expected the config of the new version")
+	}
+	for i, layer := range archive.Layers {
+		content := rebuiltFiles[saved[0].Layers[i]]
+		if i == 2 {
+			gz, _ := gzip.NewReader(bytes.NewReader(content))
+			content, _ = io.ReadAll(gz)
+		}
+		if digestOf(content) != layer.DiffID {
+			t.Fatalf("unexpected layer %d", i)
+		}
+	}
+
+	// The rebuilt image is the base of the next delta.
+	res = get("/api/repos/some-owner/some-package/2.0/delta?from=2.0")
+	os.WriteFile(filepath.Join(dir, "next.tar"), res.Body.Bytes(), 0o644)
+	if err := applyDeltaArchive(output, filepath.Join(dir, "next.tar"), filepath.Join(dir, "next-app.tar")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archivePath returns the path of a file of an extracted archive, which
+// cannot escape its directory.
+func archivePath(dir, name string) string {
+	return filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+name), "/")))
+}
+
+// openLayer returns the uncompressed content of a layer file, compressed with
+// gzip or not.
+func openLayer(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(f)
+	if magic, _ := buffered.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{buffered, f}, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// copyLayer returns a function writing the uncompressed content of a layer
+// file.
+func copyLayer(name string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		r, err := openLayer(name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	}
+}
+
+// readBaseLayers returns the layer files of the images of an extracted
+// `docker save` archive, e.g. an export of the proxy or a rebuilt image, by
+// diff ID.
+func readBaseLayers(dir string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("base image: %w", err)
+	}
+	var images []dockerSaveManifest
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("base image: invalid manifest.json: %w", err)
+	}
+	layers := map[string]string{}
+	for _, image := range images {
+		data, err := os.ReadFile(archivePath(dir, image.Config))
+		if err != nil {
+			return nil, fmt.Errorf("base image: %w", err)
+		}
+		var config struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		if json.Unmarshal(data, &config) != nil || len(config.RootFS.DiffIDs) != len(image.Layers) {
+			return nil, fmt.Errorf("base image: invalid config %s", image.Config)
+		}
+		for i, diffID := range config.RootFS.DiffIDs {
+			layers[diffID] = archivePath(dir, image.Layers[i])
+		}
+	}
+	return layers, nil
+}
+
+// writeLayerFile writes a layer to a file of dir, and checks that the digest
+// of its uncompressed content is diffID.
+func writeLayerFile(dir, diffID string, write func(w io.Writer) error) (string, error) {
+	f, err := os.CreateTemp(dir, "layer-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if err := write(io.MultiWriter(f, hasher)); err != nil {
+		return "", fmt.Errorf("layer %s: %w", diffID, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); digest != diffID {
+		return "", fmt.Errorf("layer %s: diff ID mismatch: %s", diffID, digest)
+	}
+	return f.Name(), f.Close()
+}
+
+// verifyLayer checks that the digest of the uncompressed content of a layer
+// file is diffID.
+func verifyLayer(name, diffID string) error {
+	hasher := sha256.New()
+	if err := copyLayer(name)(hasher); err != nil {
+		return fmt.Errorf("layer %s: %w", diffID, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); digest != diffID {
+		return fmt.Errorf("layer %s: diff ID mismatch: %s", diffID, digest)
+	}
+	return nil
+}
+
+// applyDeltaArchive rebuilds an image from a `docker save` archive of a base
+// image and a delta archive of the proxy, as a `docker save` archive which
+// `docker load` imports. The layers rebuilt from the base image are
+// uncompressed, and all the layers are checked against the diff IDs of the
+// image.
+func applyDeltaArchive(basePath, deltaPath, outputPath string) error {
+	dir, err := os.MkdirTemp("", "container-registry-proxy-delta-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	baseDir, deltaDir, layersDir := filepath.Join(dir, "base"), filepath.Join(dir, "delta"), filepath.Join(dir, "layers")
+	for archive, target := range map[string]string{basePath: baseDir, deltaPath: deltaDir} {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		err = extractTarball(f, target)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", archive, err)
+		}
+	}
+	if err := os.MkdirAll(layersDir, 0o700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(deltaDir, deltaFileName))
+	if err != nil {
+		return fmt.Errorf("%s: not a delta archive: %w", deltaPath, err)
+	}
+	var archive deltaArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return fmt.Errorf("%s: invalid %s: %w", deltaPath, deltaFileName, err)
+	}
+	baseLayers, err := readBaseLayers(baseDir)
+	if err != nil {
+		return err
+	}
+
+	// The layers are rebuilt and checked before the archive is written.
+	type file struct{ name, path string }
+	files := []file{{archive.Config, archivePath(deltaDir, archive.Config)}}
+	saved := dockerSaveManifest{Config: archive.Config, RepoTags: archive.RepoTags, Layers: []string{}}
+	written := map[string]bool{}
+	for _, layer := range archive.Layers {
+		name := blobPath(layer.DiffID)
+		if layer.Kind == "full" {
+			name = layer.Path
+		}
+		saved.Layers = append(saved.Layers, name)
+		if written[name] {
+			continue
+		}
+		written[name] = true
+
+		var layerPath string
+		switch layer.Kind {
+		case "base":
+			source, ok := baseLayers[layer.DiffID]
+			if !ok {
+				return fmt.Errorf("layer %s: not in the base image", layer.DiffID)
+			}
+			layerPath, err = writeLayerFile(layersDir, layer.DiffID, copyLayer(source))
+		case "delta":
+			source, ok := baseLayers[layer.Base]
+			if !ok {
+				return fmt.Errorf("layer %s: base layer %s not in the base image", layer.DiffID, layer.Base)
+			}
+			// The copies read the uncompressed base layer at any offset.
+			var base string
+			if base, err = writeLayerFile(layersDir, layer.Base, copyLayer(source)); err != nil {
+				return err
+			}
+			layerPath, err = writeLayerFile(layersDir, layer.DiffID, func(w io.Writer) error {
+				baseFile, err := os.Open(base)
+				if err != nil {
+					return err
+				}
+				defer baseFile.Close()
+				delta, err := openLayer(archivePath(deltaDir, layer.Path))
+				if err != nil {
+					return err
+				}
+				defer delta.Close()
+				return applyDelta(w, baseFile, delta)
+			})
+			os.Remove(base)
+		case "full":
+			layerPath = archivePath(deltaDir, layer.Path)
+			err = verifyLayer(layerPath, layer.DiffID)
+		default:
+			return fmt.Errorf("layer %s: unknown kind %q", layer.DiffID, layer.Kind)
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, file{name, layerPath})
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	modTime := time.Now().UTC().Truncate(time.Second)
+	tw := tar.NewWriter(out)
+	manifestJSON, _ := json.Marshal([]dockerSaveManifest{saved})
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0o644, Size: int64(len(manifestJSON)), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := addArchiveFile(tw, file.name, file.path, modTime); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addArchiveFile(tw *tar.Writer, name, filePath string, modTime time.Time) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: info.Size(), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// runDeltaCommand runs the `delta` subcommand, which rebuilds the images at
+// the sites downloading delta archives from the proxy.
+func runDeltaCommand(args []string) error {
+	usage := "usage: container-registry-proxy delta apply <base.tar> <delta.tar> <output.tar>"
+	if len(args) != 4 || args[0] != "apply" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return applyDeltaArchive(args[1], args[2], args[3])
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var deprecatedPullsTotal = newCounterVec(
+	"deprecated_pulls_total",
+	"Number of manifest pulls of deprecated repositories or tags by repository.",
+	"repository",
+)
+
+// Deprecation marks the repositories, or some of their tags, as deprecated.
+type Deprecation struct {
+	// Repository is a glob pattern (see path.Match) of repository names.
+	Repository string `json:"repository"`
+	// Tag is a glob pattern of the deprecated tags, the whole repository being
+	// deprecated when it is empty.
+	Tag     string `json:"tag,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Sunset is the date (`2006-01-02` or RFC 3339) after which the images
+	// may be removed.
+	Sunset string `json:"sunset,omitempty"`
+	// Replacement is the image to use instead, e.g. `my-org/new-app`.
+	Replacement string `json:"replacement,omitempty"`
+
+	sunset time.Time
+}
+
+func parseSunset(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (d Deprecation) validate() error {
+	if d.Repository == "" {
+		return fmt.Errorf("invalid deprecation: no repository")
+	}
+	for _, glob := range []string{d.Repository, d.Tag} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid deprecation of %s: %w", d.Repository, err)
+		}
+	}
+	if d.Sunset != "" {
+		if _, err := parseSunset(d.Sunset); err != nil {
+			return fmt.Errorf("invalid deprecation of %s: invalid sunset date %q", d.Repository, d.Sunset)
+		}
+	}
+	return nil
+}
+
+// matches returns true when the deprecation applies to a repository and a
+// tag, which is empty for the pulls by digest.
+func (d Deprecation) matches(name, tag string) bool {
+	if matched, _ := path.Match(d.Repository, name); !matched {
+		return false
+	}
+	if d.Tag == "" {
+		return true
+	}
+	matched, _ := path.Match(d.Tag, tag)
+	return tag != "" && matched
+}
+
+// warning returns the text of the `Warning` header of the deprecation.
+func (d Deprecation) warning(name string) string {
+	text := name + " is deprecated"
+	if d.Message != "" {
+		text += ": " + d.Message
+	}
+	if !d.sunset.IsZero() {
+		text += fmt.Sprintf(" (sunset: %s)", d.sunset.Format("2006-01-02"))
+	}
+	if d.Replacement != "" {
+		text += fmt.Sprintf(", use %s instead", d.Replacement)
+	}
+	return text
+}
+
+// deprecationStatus is the deprecation of a repository returned by the proxy
+// API.
+type deprecationStatus struct {
+	Message     string     `json:"message,omitempty"`
+	Sunset      *time.Time `json:"sunset,omitempty"`
+	Replacement string     `json:"replacement,omitempty"`
+	// Tags are the deprecated tags, when only some tags are deprecated.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// WithDeprecations marks repositories and tags as deprecated. The pulls of
+// their manifests get `Deprecation`, `Sunset` and `Warning` headers, and the
+// deprecations are returned by the proxy API.
+func WithDeprecations(deprecations ...Deprecation) Option {
+	return func(p *containerProxy) {
+		for _, d := range deprecations {
+			if err := d.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			if d.Sunset != "" {
+				d.sunset, _ = parseSunset(d.Sunset)
+			}
+			p.deprecations = append(p.deprecations, d)
+		}
+	}
+}
+
+// deprecation returns the deprecation of a repository and a tag, if any.
+func (p *containerProxy) deprecation(name, tag string) (Deprecation, bool) {
+	for _, d := range p.deprecations {
+		if d.matches(name, tag) {
+			return d, true
+		}
+	}
+	return Deprecation{}, false
+}
+
+// deprecationStatus returns the deprecation of a repository with the given
+// tags, or nil when neither the repository nor its tags are deprecated.
+func (p *containerProxy) deprecationStatus(name string, tags []string) *deprecationStatus {
+	if d, ok := p.deprecation(name, ""); ok {
+		status := &deprecationStatus{Message: d.Message, Replacement: d.Replacement}
+		if !d.sunset.IsZero() {
+			status.Sunset = &d.sunset
+		}
+		return status
+	}
+
+	var deprecated []string
+	for _, tag := range tags {
+		if _, ok := p.deprecation(name, tag); ok {
+			deprecated = append(deprecated, tag)
+		}
+	}
+	if len(deprecated) == 0 {
+		return nil
+	}
+	return &deprecationStatus{Tags: deprecated}
+}
+
+// deprecationHeaders is a middleware adding the deprecation headers to the
+// manifest pulls of deprecated repositories and tags.
+func (p *containerProxy) deprecationHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || (r.Method != "GET" && r.Method != "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tag := reference
+		if strings.Contains(reference, ":") {
+			tag = ""
+		}
+		repository := p.prefixedName(name)
+		d, ok := p.deprecation(repository, tag)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Deprecation", "true")
+		if !d.sunset.IsZero() {
+			w.Header().Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		}
+		// 299 is the code of the miscellaneous persistent warnings (RFC 7234).
+		w.Header().Set("Warning", `299 - `+strconv.Quote(d.warning(repository)))
+
+		if r.Method == "GET" {
+			client := r.RemoteAddr
+			if addr, err := p.clientAddr(r); err == nil {
+				client = addr.String()
+			}
+			deprecatedPullsTotal.Inc(repository)
+			log.Printf("WARN deprecated image %s:%s pulled by %s", repository, reference, client)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestDeprecationHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithDeprecations(
+			Deprecation{Repository: "my-org/legacy-*", Message: "no longer maintained", Sunset: "2024-06-30", Replacement: "my-org/app"},
+			Deprecation{Repository: "my-org/app", Tag: "v1.*"},
+		),
+	)
+
+	for _, tc := range []struct {
+		method          string
+		path            string
+		expectedWarning string
+		expectedSunset  string
+	}{
+		{
+			method:          "GET",
+			path:            "/v2/my-org/legacy-api/manifests/latest",
+			expectedWarning: `299 - "my-org/legacy-api is deprecated: no longer maintained (sunset: 2024-06-30), use my-org/app instead"`,
+			expectedSunset:  "Sun, 30 Jun 2024 00:00:00 GMT",
+		},
+		{
+			method:          "HEAD",
+			path:            "/v2/my-org/legacy-api/manifests/sha256:1234",
+			expectedWarning: `299 - "my-org/legacy-api is deprecated: no longer maintained (sunset: 2024-06-30), use my-org/app instead"`,
+			expectedSunset:  "Sun, 30 Jun 2024 00:00:00 GMT",
+		},
+		{method: "GET", path: "/v2/my-org/app/manifests/v1.2.0", expectedWarning: `299 - "my-org/app is deprecated"`},
+		{method: "GET", path: "/v2/my-org/app/manifests/v2.0.0"},
+		{method: "GET", path: "/v2/my-org/app/manifests/sha256:1234"},
+		{method: "PUT", path: "/v2/my-org/legacy-api/manifests/latest"},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if warning := res.Header().Get("Warning"); warning != tc.expectedWarning {
+			t.Fatalf("%s %s: expected: %s, got: %s", tc.method, tc.path, tc.expectedWarning, warning)
+		}
+		if sunset := res.Header().Get("Sunset"); sunset != tc.expectedSunset {
+			t.Fatalf("%s %s: expected: %s, got: %s", tc.method, tc.path, tc.expectedSunset, sunset)
+		}
+		if deprecated := res.Header().Get("Deprecation") == "true"; deprecated != (tc.expectedWarning != "") {
+			t.Fatalf("%s %s: expected: %t, got: %t", tc.method, tc.path, tc.expectedWarning != "", deprecated)
+		}
+	}
+}
+
+func TestDeprecationStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			{Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: []string{"v1.0.0", "v2.0.0"}}}},
+		},
+	}
+
+	for _, tc := range []struct {
+		deprecation     Deprecation
+		expectedContent string
+	}{
+		{
+			deprecation:     Deprecation{Repository: "some-owner/*", Message: "moved", Sunset: "2024-06-30"},
+			expectedContent: `{"name":"some-owner/some-package","artifactType":"unknown","tags":["v1.0.0","v2.0.0"],"deprecation":{"message":"moved","sunset":"2024-06-30T00:00:00Z"}}`,
+		},
+		{
+			deprecation:     Deprecation{Repository: "some-owner/some-package", Tag: "v1.*"},
+			expectedContent: `{"name":"some-owner/some-package","artifactType":"unknown","tags":["v1.0.0","v2.0.0"],"deprecation":{"tags":["v1.0.0"]}}`,
+		},
+		{
+			deprecation:     Deprecation{Repository: "other-owner/*"},
+			expectedContent: `{"name":"some-owner/some-package","artifactType":"unknown","tags":["v1.0.0","v2.0.0"]}`,
+		},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), upstream.URL, WithDeprecations(tc.deprecation))
+
+		req, _ := http.NewRequest("GET", "/api/repos/some-owner/some-package", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if content := strings.TrimSpace(res.Body.String()); content != tc.expectedContent {
+			t.Fatalf("expected: %s, got: %s", tc.expectedContent, content)
+		}
+	}
+}
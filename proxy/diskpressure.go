@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+// diskPressureCheckInterval is the interval between the checks of the free
+// space of the disk of the blob cache.
+const diskPressureCheckInterval = 30 * time.Second
+
+var blobCacheDiskPressure = newGaugeVec(
+	"blob_cache_disk_pressure",
+	"Whether the free space of the disk of the blob cache is below its watermark (1) or not (0).",
+)
+
+var blobCacheEvictionsTotal = newCounterVec(
+	"blob_cache_pressure_evictions_total",
+	"Number of cached blobs evicted because of the disk pressure.",
+)
+
+// DiskWatermark is the minimum free space of the disk of the blob cache, in
+// bytes or as a percentage of the disk.
+type DiskWatermark = cache.DiskWatermark
+
+// ParseDiskWatermark parses a size (see ParseSize) or a percentage, e.g. `10%`.
+func ParseDiskWatermark(value string) (*DiskWatermark, error) {
+	if raw, ok := strings.CutSuffix(strings.TrimSpace(value), "%"); ok {
+		percent, err := strconv.ParseFloat(raw, 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid free space watermark: %q", value)
+		}
+		return &DiskWatermark{Percent: percent}, nil
+	}
+	size, err := ParseSize(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid free space watermark: %w", err)
+	}
+	return &DiskWatermark{Bytes: uint64(size)}, nil
+}
+
+// WithBlobCacheMinFree stops adding blobs to the cache when the free space of
+// its disk is below the watermark, and evicts the oldest cached blobs until it
+// is above again.
+func WithBlobCacheMinFree(watermark *DiskWatermark) Option {
+	return func(p *containerProxy) {
+		p.cacheMinFree = watermark
+	}
+}
+
+// monitorDiskPressure checks the free space of the disk of the blob cache
+// until ctx is done.
+func (p *containerProxy) monitorDiskPressure(ctx context.Context) {
+	ticker := time.NewTicker(diskPressureCheckInterval)
+	defer ticker.Stop()
+
+	pressure := false
+	for {
+		removed, freed, underPressure := p.blobCache.CheckDiskPressure()
+		if removed > 0 {
+			blobCacheEvictionsTotal.Add(float64(removed))
+			log.Printf("WARN blob cache disk below its free space watermark, %d blobs evicted (%d bytes)", removed, freed)
+		}
+		if underPressure != pressure {
+			pressure = underPressure
+			if pressure {
+				blobCacheDiskPressure.Set(1)
+				log.Printf("WARN blob cache disk still below its free space watermark, new blobs are not cached")
+			} else {
+				blobCacheDiskPressure.Set(0)
+				log.Printf("blob cache disk above its free space watermark again")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
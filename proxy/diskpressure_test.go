@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestParseDiskWatermark(t *testing.T) {
+	for value, expected := range map[string]*DiskWatermark{
+		"10%":  {Percent: 10},
+		"2.5%": {Percent: 2.5},
+		"10G":  {Bytes: 10 * 1000 * 1000 * 1000},
+		"0%":   nil,
+		"100%": nil,
+		"abc":  nil,
+	} {
+		watermark, err := ParseDiskWatermark(value)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", value)
+			}
+			continue
+		}
+		if err != nil || *watermark != *expected {
+			t.Errorf("%s: expected: %+v, got: %+v (%v)", value, expected, watermark, err)
+		}
+	}
+}
+
+func TestBlobCacheDiskPressure(t *testing.T) {
+	content := []byte("some blob")
+	digest := digestOf(content)
+	upstream := newFakeBlobRegistry(map[string][]byte{digest: content})
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	if _, _, err := cache.DiskUsage(dir); err != nil {
+		t.Skip(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(dir),
+		WithBlobCacheMinFree(&DiskWatermark{Percent: 99.999}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+	req.Header.Set("Authorization", "Bearer good")
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	// The blob is passed through to the upstream registry.
+	if res.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected: %d, got: %d", http.StatusTemporaryRedirect, res.Code)
+	}
+	if cache.New(dir).Has(digest) {
+		t.Fatal("expected the blob not to be cached")
+	}
+}
+
+func TestBestEffortWriter(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Writing to a closed file fails like writing to a full disk.
+	w := &bestEffortWriter{w: f}
+	if n, err := w.Write([]byte("some data")); n != 9 || err != nil {
+		t.Fatalf("expected the write to succeed, got: %d, %v", n, err)
+	}
+	if w.err == nil {
+		t.Fatal("expected the error to be recorded")
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// WithDeleteDryRun turns all the deletions into dry runs, which report what
+// would be deleted without deleting anything, e.g. while rolling out a new
+// cleanup policy.
+func WithDeleteDryRun() Option {
+	return func(p *containerProxy) {
+		p.deleteDryRun = true
+	}
+}
+
+// isDryRun returns whether a destructive request should only report what it
+// would do.
+func (p *containerProxy) isDryRun(r *http.Request) bool {
+	return p.deleteDryRun || r.URL.Query().Get("dry_run") == "true"
+}
+
+type deletionPreview struct {
+	DryRun     bool     `json:"dry_run"`
+	Repository string   `json:"repository"`
+	Digest     string   `json:"digest"`
+	Tags       []string `json:"tags"`
+}
+
+// previewDeletion reports the version that DeleteVersion would delete.
+func (p *containerProxy) previewDeletion(w http.ResponseWriter, r *http.Request, owner, name, reference string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	version, err := backend.Version{}, backend.ErrNotSupported
+	if finder, ok := p.backend.(backend.VersionFinder); ok {
+		version, err = finder.FindVersion(r.Context(), owner, name, reference)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, backend.ErrNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_MANIFEST_UNKNOWN, "manifest unknown"))
+		case errors.Is(err, backend.ErrNotSupported):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNSUPPORTED, "dry runs are not supported by the backend"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeErrors(ERROR_UNKNOWN, err))
+		}
+		return
+	}
+
+	repository := p.prefixedName(owner + "/" + name)
+	preview := deletionPreview{
+		DryRun:     true,
+		Repository: repository,
+		Digest:     version.Digest,
+		Tags:       append([]string{}, version.Tags...),
+	}
+	log.Printf("DRY RUN would delete %s@%s (tags: %s)", repository, version.Digest, strings.Join(version.Tags, ","))
+	p.audit(r, "delete-dry-run", repository, reference)
+
+	json.NewEncoder(w).Encode(preview)
+}
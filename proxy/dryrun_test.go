@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+type deleteRecorderMock struct {
+	githubClientMock
+	deleted []int64
+}
+
+func (c *deleteRecorderMock) PackageDeleteVersion(ctx context.Context, user, packageType, packageName string, packageVersionID int64) (*github.Response, error) {
+	c.deleted = append(c.deleted, packageVersionID)
+	return nil, nil
+}
+
+func TestDeleteManifestDryRun(t *testing.T) {
+	versions := []*github.PackageVersion{
+		{
+			ID:   github.Int64(123),
+			Name: github.String("sha256:1234"),
+			Metadata: &github.PackageMetadata{
+				Container: &github.PackageContainerMetadata{Tags: []string{"1.0.0", "latest"}},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		path               string
+		opts               []Option
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			path:               "/v2/some-owner/some-package/manifests/latest?dry_run=true",
+			expectedStatusCode: 200,
+			expectedContent:    `{"dry_run":true,"repository":"some-owner/some-package","digest":"sha256:1234","tags":["1.0.0","latest"]}`,
+		},
+		{
+			path:               "/v2/some-owner/some-package/manifests/sha256:1234",
+			opts:               []Option{WithDeleteDryRun()},
+			expectedStatusCode: 200,
+			expectedContent:    `{"dry_run":true,"repository":"some-owner/some-package","digest":"sha256:1234","tags":["1.0.0","latest"]}`,
+		},
+		{
+			path:               "/v2/some-owner/some-package/manifests/unknown?dry_run=true",
+			expectedStatusCode: 404,
+			expectedContent:    `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":""}]}`,
+		},
+	} {
+		client := &deleteRecorderMock{githubClientMock: githubClientMock{PackageVersions: versions}}
+		proxy := NewProxy(
+			"127.0.0.1:10000",
+			ghbackend.New(client, nil),
+			"http://127.0.0.1/upstream",
+			tc.opts...,
+		)
+
+		req, _ := http.NewRequest("DELETE", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if body := strings.TrimSpace(res.Body.String()); body != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, body)
+		}
+		if len(client.deleted) > 0 {
+			t.Fatalf("%s: expected no deletion, got: %v", tc.path, client.deleted)
+		}
+	}
+}
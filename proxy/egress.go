@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errEgressDenied is returned when the proxy is not allowed to connect to a
+// host.
+var errEgressDenied = errors.New("egress denied")
+
+var upstreamEgressDeniedTotal = newCounterVec(
+	"upstream_egress_denied_total",
+	"Number of upstream connections denied because the host resolves to a private address, by host.",
+	"host",
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not
+// reported as private by netip.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isInternalAddr returns whether an address is not routable on the Internet,
+// e.g. a loopback, private or link-local (cloud metadata) address.
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+// egressPolicy restricts the connections of the proxy to the upstreams, so
+// that a crafted response (e.g. a redirect or the realm of an authentication
+// challenge) cannot make the proxy fetch internal URLs. The configured upstream
+// hosts are trusted, while the other hosts must resolve to public addresses,
+// or to the allowed networks. The connections are made to the addresses that
+// were checked, so that a DNS response cannot change between the check and the
+// connection.
+type egressPolicy struct {
+	mu       sync.RWMutex
+	hosts    map[string]bool
+	networks []netip.Prefix
+
+	resolver *net.Resolver
+	dialer   *net.Dialer
+}
+
+func newEgressPolicy() *egressPolicy {
+	return &egressPolicy{
+		hosts:    map[string]bool{},
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// allowHosts trusts hosts, e.g. the configured upstream registries.
+func (e *egressPolicy) allowHosts(hosts ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" {
+			e.hosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// allowNetworks allows the connections to internal addresses of networks.
+func (e *egressPolicy) allowNetworks(networks ...netip.Prefix) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.networks = append(e.networks, networks...)
+}
+
+func (e *egressPolicy) allowed(host string, addr netip.Addr) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.hosts[strings.ToLower(host)] || !isInternalAddr(addr) {
+		return true
+	}
+	for _, network := range e.networks {
+		if network.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext connects to the first allowed address of a host, see
+// net.Dialer.
+func (e *egressPolicy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = e.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("%w: %s resolves to an internal address", errEgressDenied, host)
+	for _, addr := range addrs {
+		if !e.allowed(host, addr) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = e.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	if errors.Is(err, errEgressDenied) {
+		upstreamEgressDeniedTotal.Inc(host)
+	}
+	return nil, err
+}
+
+func newUpstreamTransport(egress *egressPolicy) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = egress.DialContext
+	return transport
+}
+
+// defaultUpstreamTransport is the transport of the upstream requests whose
+// context carries none, which only connects to public addresses.
+var defaultUpstreamTransport = newUpstreamTransport(newEgressPolicy())
+
+type upstreamTransportKey struct{}
+
+// withUpstreamTransport returns a context carrying the transport of the
+// requests to the upstream registries of a proxy, which enforces its egress
+// policy.
+func withUpstreamTransport(ctx context.Context, transport *http.Transport) context.Context {
+	return context.WithValue(ctx, upstreamTransportKey{}, transport)
+}
+
+// upstreamTransportFrom returns the transport of the upstream requests carried
+// by a context, or defaultUpstreamTransport.
+func upstreamTransportFrom(ctx context.Context) *http.Transport {
+	if transport, ok := ctx.Value(upstreamTransportKey{}).(*http.Transport); ok {
+		return transport
+	}
+	return defaultUpstreamTransport
+}
+
+// WithUpstreamEgress allows the proxy to connect to internal networks and to
+// hosts resolving to internal addresses, in addition to its upstreams, e.g.
+// the token server of an internal registry.
+func WithUpstreamEgress(networks []netip.Prefix, hosts ...string) Option {
+	return func(p *containerProxy) {
+		p.upstreamEgress.allowNetworks(networks...)
+		p.upstreamEgress.allowHosts(hosts...)
+	}
+}
+
+// validateUpstreamURL returns an error when an upstream URL is not an HTTP(S)
+// URL of a host, e.g. a file URL or a URL with credentials.
+func validateUpstreamURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid upstream URL %q: expected an http or https URL", u.Redacted())
+	}
+	if u.User != nil {
+		return fmt.Errorf("invalid upstream URL %q: credentials are not allowed in the URL", u.Redacted())
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid upstream URL %q: query strings and fragments are not allowed", u.Redacted())
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+const (
+	ERROR_BLOB_UNKNOWN              = "BLOB_UNKNOWN"
+	ERROR_DENIED                    = "DENIED"
+	ERROR_DIGEST_INVALID            = "DIGEST_INVALID"
+	ERROR_MANIFEST_INVALID          = "MANIFEST_INVALID"
+	ERROR_MANIFEST_UNKNOWN          = "MANIFEST_UNKNOWN"
+	ERROR_NAME_INVALID              = "NAME_INVALID"
+	ERROR_NAME_UNKNOWN              = "NAME_UNKNOWN"
+	ERROR_PAGINATION_NUMBER_INVALID = "PAGINATION_NUMBER_INVALID"
+	ERROR_TAG_INVALID               = "TAG_INVALID"
+	ERROR_TOO_MANY_REQUESTS         = "TOOMANYREQUESTS"
+	ERROR_UNAUTHORIZED              = "UNAUTHORIZED"
+	ERROR_UNAVAILABLE               = "UNAVAILABLE"
+	ERROR_UNKNOWN                   = "UNKNOWN"
+	ERROR_UNSUPPORTED               = "UNSUPPORTED"
+
+	// Errors specific to the proxy, returned when the credentials of the
+	// backend cannot be used.
+	ERROR_UPSTREAM_BAD_CREDENTIALS = "UPSTREAM_BAD_CREDENTIALS"
+	ERROR_UPSTREAM_MISSING_SCOPE   = "UPSTREAM_MISSING_SCOPE"
+	ERROR_UPSTREAM_SSO_REQUIRED    = "UPSTREAM_SSO_REQUIRED"
+)
+
+// credentialsErrorCodes map the reasons of the backend credentials errors to
+// error codes.
+var credentialsErrorCodes = map[string]string{
+	backend.ReasonBadCredentials: ERROR_UPSTREAM_BAD_CREDENTIALS,
+	backend.ReasonMissingScope:   ERROR_UPSTREAM_MISSING_SCOPE,
+	backend.ReasonSSORequired:    ERROR_UPSTREAM_SSO_REQUIRED,
+}
+
+// errorCode returns the code of a backend error, or defaultCode.
+func errorCode(defaultCode string, err error) string {
+	var credErr *backend.CredentialsError
+	if errors.As(err, &credErr) {
+		if code, ok := credentialsErrorCodes[credErr.Reason]; ok {
+			return code
+		}
+	}
+	return defaultCode
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+type apiErrors struct {
+	Errors []apiError `json:"errors"`
+}
+
+// makeError returns a single error. Secrets are redacted from the message
+// since it is returned to the clients.
+func makeError(code, message string) apiErrors {
+	return apiErrors{
+		Errors: []apiError{
+			{Code: code, Message: redact(message)},
+		},
+	}
+}
+
+// makeErrors returns one error per error joined in err. The backend
+// credentials errors get a specific code instead of code.
+func makeErrors(code string, err error) apiErrors {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return makeError(errorCode(code, err), err.Error())
+	}
+
+	var errs apiErrors
+	for _, e := range joined.Unwrap() {
+		errs.Errors = append(errs.Errors, apiError{Code: errorCode(code, e), Message: redact(e.Error())})
+	}
+
+	return errs
+}
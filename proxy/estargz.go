@@ -0,0 +1,509 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// estargzTOCDigestAnnotation is the annotation of the eStargz layers with
+	// the digest of their table of contents, verified by the stargz
+	// snapshotter.
+	estargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+	// estargzUncompressedSizeAnnotation is the annotation of the eStargz layers
+	// with their uncompressed size.
+	estargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+	// estargzTOCName is the name of the table of contents, the last entry of
+	// the eStargz layers.
+	estargzTOCName = "stargz.index.json"
+	// estargzNoPrefetchLandmark is the first entry of the eStargz layers
+	// without files to prefetch.
+	estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+	// estargzChunkSize is the size of the chunks of the files, each chunk
+	// being a gzip member that the clients fetch with a Range request.
+	estargzChunkSize = 4 * 1024 * 1024
+)
+
+var estargzConversionsTotal = newCounterVec(
+	"blob_cache_estargz_conversions_total",
+	"Number of gzip layers converted to eStargz in the blob cache by result (converted, failed).",
+	"result",
+)
+
+// estargzTOC is the table of contents of an eStargz layer, locating the
+// files and their chunks in the layer.
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	UserName    string            `json:"userName,omitempty"`
+	GroupName   string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var estargzEntryTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// estargzWriter writes the tar stream of an eStargz layer in gzip members,
+// a new member starting where the clients need to seek.
+type estargzWriter struct {
+	out    *countingWriter
+	gz     *gzip.Writer
+	diffID hash.Hash
+	size   int64
+}
+
+func (w *estargzWriter) Write(b []byte) (int, error) {
+	if w.gz == nil {
+		gz, err := gzip.NewWriterLevel(w.out, gzip.BestCompression)
+		if err != nil {
+			return 0, err
+		}
+		w.gz = gz
+	}
+	w.diffID.Write(b)
+	w.size += int64(len(b))
+	return w.gz.Write(b)
+}
+
+// startMember closes the current gzip member, and returns the offset of the
+// next one.
+func (w *estargzWriter) startMember() (int64, error) {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return 0, err
+		}
+		w.gz = nil
+	}
+	return w.out.n, nil
+}
+
+// estargzFooter returns the 51 bytes footer of an eStargz layer, an empty
+// gzip member locating the table of contents in its extra field. It is built
+// by hand since the size of the empty deflate block written by compress/flate
+// depends on the Go version.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff}
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	// An empty final stored block, and the CRC-32 and size of the empty
+	// content.
+	return append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// estargzLayer describes a layer converted to eStargz.
+type estargzLayer struct {
+	Digest           string `json:"digest"`
+	Size             int64  `json:"size"`
+	TOCDigest        string `json:"toc_digest"`
+	UncompressedSize int64  `json:"uncompressed_size"`
+	DiffID           string `json:"diff_id"`
+	// SourceDiffID is the diff ID of the gzip layer, replaced by DiffID in the
+	// configs.
+	SourceDiffID string `json:"source_diff_id"`
+}
+
+// writeEstargz converts an uncompressed layer to eStargz. Each chunk of the
+// regular files is a gzip member, located (along with its digest) by the
+// table of contents, so that the clients can fetch and verify the files
+// lazily with Range requests. The layer is still a valid gzip layer.
+func writeEstargz(out io.Writer, uncompressed io.Reader) (*estargzLayer, error) {
+	w := &estargzWriter{out: &countingWriter{w: out}, diffID: sha256.New()}
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(uncompressed)
+	toc := estargzTOC{Version: 1}
+
+	landmark := &tar.Header{Name: estargzNoPrefetchLandmark, Typeflag: tar.TypeReg, Mode: 0o644, Size: 1}
+	if err := tw.WriteHeader(landmark); err != nil {
+		return nil, err
+	}
+	offset, err := w.startMember()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte{0xf}); err != nil {
+		return nil, err
+	}
+	toc.Entries = append(toc.Entries, estargzTOCEntry{
+		Name:        estargzNoPrefetchLandmark,
+		Type:        "reg",
+		Size:        1,
+		Mode:        0o644,
+		Offset:      offset,
+		Digest:      fmt.Sprintf("sha256:%x", sha256.Sum256([]byte{0xf})),
+		ChunkDigest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte{0xf})),
+	})
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entryType, ok := estargzEntryTypes[h.Typeflag]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tar entry %s: %c", h.Name, h.Typeflag)
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+
+		entry := estargzTOCEntry{
+			Name:      strings.TrimPrefix(path.Clean("/"+h.Name), "/"),
+			Type:      entryType,
+			LinkName:  h.Linkname,
+			Mode:      h.Mode,
+			UID:       h.Uid,
+			GID:       h.Gid,
+			UserName:  h.Uname,
+			GroupName: h.Gname,
+			DevMajor:  int(h.Devmajor),
+			DevMinor:  int(h.Devminor),
+		}
+		if entryType == "hardlink" {
+			entry.LinkName = strings.TrimPrefix(path.Clean("/"+h.Linkname), "/")
+		}
+		if !h.ModTime.IsZero() {
+			entry.ModTime = h.ModTime.UTC().Format(time.RFC3339)
+		}
+		for key, value := range h.PAXRecords {
+			if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				if entry.Xattrs == nil {
+					entry.Xattrs = map[string][]byte{}
+				}
+				entry.Xattrs[name] = []byte(value)
+			}
+		}
+		if entry.Name == "" {
+			// The root directory.
+			continue
+		}
+		if entryType != "reg" || h.Size == 0 {
+			toc.Entries = append(toc.Entries, entry)
+			continue
+		}
+
+		entry.Size = h.Size
+		file := sha256.New()
+		first := len(toc.Entries)
+		for written := int64(0); written < h.Size; {
+			chunkSize := h.Size - written
+			if chunkSize >= estargzChunkSize {
+				chunkSize = estargzChunkSize
+				entry.ChunkSize = chunkSize
+			}
+			if entry.Offset, err = w.startMember(); err != nil {
+				return nil, err
+			}
+			entry.ChunkOffset = written
+			chunk := sha256.New()
+			if _, err := io.CopyN(io.MultiWriter(tw, chunk, file), tr, chunkSize); err != nil {
+				return nil, fmt.Errorf("cannot copy %s: %w", h.Name, err)
+			}
+			entry.ChunkDigest = "sha256:" + hex.EncodeToString(chunk.Sum(nil))
+			toc.Entries = append(toc.Entries, entry)
+			written += chunkSize
+			entry = estargzTOCEntry{Name: entry.Name, Type: "chunk"}
+		}
+		toc.Entries[first].Digest = "sha256:" + hex.EncodeToString(file.Sum(nil))
+	}
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, err
+	}
+	tocOffset, err := w.startMember()
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: estargzTOCName, Typeflag: tar.TypeReg, Mode: 0o444, Size: int64(len(tocJSON))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := w.startMember(); err != nil {
+		return nil, err
+	}
+	if _, err := w.out.Write(estargzFooter(tocOffset)); err != nil {
+		return nil, err
+	}
+
+	return &estargzLayer{
+		TOCDigest:        fmt.Sprintf("sha256:%x", sha256.Sum256(tocJSON)),
+		UncompressedSize: w.size,
+		DiffID:           "sha256:" + hex.EncodeToString(w.diffID.Sum(nil)),
+	}, nil
+}
+
+// estargzConverter converts the cached gzip layers of some repositories to
+// eStargz, so that the clients using the stargz snapshotter can lazily pull
+// them.
+type estargzConverter struct {
+	repositories []string
+	cache        *cache.Cache
+	queue        *conversionQueue
+}
+
+// WithEstargzConversion converts the gzip layers of the repositories matching
+// the glob patterns to eStargz once they are cached. It requires the blob
+// cache.
+func WithEstargzConversion(repositories ...string) Option {
+	return func(p *containerProxy) {
+		if len(repositories) == 0 {
+			return
+		}
+		c := &estargzConverter{repositories: repositories}
+		c.queue = newConversionQueue("eStargz", estargzConversionsTotal, c.convert)
+		p.estargz = c
+	}
+}
+
+// mappingPath returns the path of the file describing the eStargz layer
+// converted from a gzip layer.
+func (c *estargzConverter) mappingPath(digest string) string {
+	return filepath.Join(c.cache.Dir(), "estargz", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// converted returns the cached eStargz layer converted from a gzip layer.
+func (c *estargzConverter) converted(digest string) (*estargzLayer, bool) {
+	if !cache.IsCacheableDigest(digest) {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.mappingPath(digest))
+	if err != nil {
+		return nil, false
+	}
+	var layer estargzLayer
+	if json.Unmarshal(data, &layer) != nil || !c.cache.Has(layer.Digest) {
+		return nil, false
+	}
+	return &layer, true
+}
+
+// convert adds the eStargz layer converted from a cached gzip layer to the
+// cache, and returns its digest.
+func (c *estargzConverter) convert(ctx context.Context, digest string) (string, error) {
+	f, _, err := c.cache.Open(digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	source := sha256.New()
+	uncompressed := io.TeeReader(gz, source)
+
+	pr, pw := io.Pipe()
+	var layer *estargzLayer
+	go func() {
+		var err error
+		if layer, err = writeEstargz(pw, uncompressed); err == nil {
+			// The diff ID of the source covers the end of the tar stream.
+			_, err = io.Copy(io.Discard, uncompressed)
+		}
+		pw.CloseWithError(err)
+	}()
+	converted, size, err := c.cache.Add(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", err
+	}
+	layer.Digest, layer.Size = converted, size
+	layer.SourceDiffID = "sha256:" + hex.EncodeToString(source.Sum(nil))
+
+	if err := c.cache.RecordDerived(converted, digest); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.mappingPath(digest)), 0o755); err != nil {
+		return "", err
+	}
+	return converted, os.WriteFile(c.mappingPath(digest), data, 0o644)
+}
+
+// rewriteEstargzLayers replaces the gzip layers converted to eStargz in a
+// manifest pulled by tag, including the image manifests of an index. The
+// layers that are cached but not converted yet are queued.
+func (p *containerProxy) rewriteEstargzLayers(ctx context.Context, name string, body []byte, mediaType string) ([]byte, string, error) {
+	if !matchesAny(p.estargz.repositories, name) {
+		return body, mediaType, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, mediaType, nil
+	}
+
+	changed, err := p.rewriteImageManifests(ctx, name, fields, func(fields map[string]json.RawMessage) (bool, error) {
+		return p.convertEstargzLayers(ctx, name, fields)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if !changed {
+		return body, mediaType, nil
+	}
+	body, err = json.Marshal(fields)
+	return body, mediaType, err
+}
+
+// convertEstargzLayers replaces the converted gzip layers of an image
+// manifest, along with their diff IDs in its config, and returns whether it
+// changed. The new config is added to the cache.
+func (p *containerProxy) convertEstargzLayers(ctx context.Context, name string, fields map[string]json.RawMessage) (bool, error) {
+	var layers []map[string]json.RawMessage
+	var config map[string]json.RawMessage
+	var configDigest string
+	if raw, ok := fields["layers"]; !ok || json.Unmarshal(raw, &layers) != nil || json.Unmarshal(fields["config"], &config) != nil || json.Unmarshal(config["digest"], &configDigest) != nil {
+		return false, nil
+	}
+
+	converted := map[int]*estargzLayer{}
+	for i, layer := range layers {
+		var layerMediaType, digest string
+		var annotations map[string]string
+		json.Unmarshal(layer["mediaType"], &layerMediaType)
+		json.Unmarshal(layer["digest"], &digest)
+		json.Unmarshal(layer["annotations"], &annotations)
+		if (layerMediaType != mediaTypeOCILayerGzip && layerMediaType != mediaTypeDockerLayerGzip) || annotations[estargzTOCDigestAnnotation] != "" {
+			continue
+		}
+		if estargz, ok := p.estargz.converted(digest); ok {
+			converted[i] = estargz
+		} else if p.blobCache.Has(digest) {
+			p.estargz.queue.enqueue(digest)
+		}
+	}
+	if len(converted) == 0 {
+		return false, nil
+	}
+
+	blob, _, err := p.registryClient.GetBlob(ctx, name, configDigest)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+	var configFields map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(blob, maxImageConfigSize)).Decode(&configFields); err != nil {
+		return false, fmt.Errorf("invalid image config %s: %w", configDigest, err)
+	}
+	var rootfs map[string]json.RawMessage
+	var diffIDs []string
+	if json.Unmarshal(configFields["rootfs"], &rootfs) != nil || json.Unmarshal(rootfs["diff_ids"], &diffIDs) != nil || len(diffIDs) != len(layers) {
+		return false, nil
+	}
+
+	changed := false
+	for i, estargz := range converted {
+		// The source layer is not the one of the config.
+		if diffIDs[i] != estargz.SourceDiffID {
+			continue
+		}
+		diffIDs[i] = estargz.DiffID
+		var annotations map[string]string
+		json.Unmarshal(layers[i]["annotations"], &annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[estargzTOCDigestAnnotation] = estargz.TOCDigest
+		annotations[estargzUncompressedSizeAnnotation] = strconv.FormatInt(estargz.UncompressedSize, 10)
+		layers[i]["digest"], _ = json.Marshal(estargz.Digest)
+		layers[i]["size"], _ = json.Marshal(estargz.Size)
+		layers[i]["annotations"], _ = json.Marshal(annotations)
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	rootfs["diff_ids"], _ = json.Marshal(diffIDs)
+	configFields["rootfs"], _ = json.Marshal(rootfs)
+	configBody, err := json.Marshal(configFields)
+	if err != nil {
+		return false, err
+	}
+	convertedDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(configBody))
+	if !p.blobCache.Has(convertedDigest) {
+		if _, _, err := p.blobCache.Add(bytes.NewReader(configBody)); err != nil {
+			return false, err
+		}
+	}
+	if err := p.blobCache.RecordDerived(convertedDigest, configDigest); err != nil {
+		return false, err
+	}
+
+	config["digest"], _ = json.Marshal(convertedDigest)
+	config["size"], _ = json.Marshal(len(configBody))
+	if fields["config"], err = json.Marshal(config); err != nil {
+		return false, err
+	}
+	fields["layers"], err = json.Marshal(layers)
+	return err == nil, err
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func makeLayer(t *testing.T, files map[string][]byte) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755})
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755})
+	for _, name := range []string{"etc/hostname", "usr/bin/app"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(files[name])), ModTime: time.Unix(1700000000, 0)}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(files[name])
+	}
+	tw.WriteHeader(&tar.Header{Name: "usr/bin/link", Typeflag: tar.TypeSymlink, Linkname: "app"})
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func TestWriteEstargz(t *testing.T) {
+	files := map[string][]byte{
+		"etc/hostname": []byte("some-host\n"),
+		"usr/bin/app":  bytes.Repeat([]byte("0123456789abcdef"), (estargzChunkSize+1000)/16),
+	}
+	gz, _ := gzip.NewReader(bytes.NewReader(makeLayer(t, files)))
+
+	var out bytes.Buffer
+	layer, err := writeEstargz(&out, gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := out.Bytes()
+
+	// The layer is a valid gzip layer.
+	uncompressed, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.DiffID != fmt.Sprintf("sha256:%x", sha256.Sum256(data)) || layer.UncompressedSize != int64(len(data)) {
+		t.Fatalf("unexpected diff ID or size: %+v", layer)
+	}
+
+	// The footer locates the table of contents.
+	footer := blob[len(blob)-51:]
+	footerReader, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := string(footerReader.Header.Extra)
+	if len(extra) != 26 || !strings.HasPrefix(extra, "SG") || !strings.HasSuffix(extra, "STARGZ") {
+		t.Fatalf("unexpected footer: %q", extra)
+	}
+	tocOffset, err := strconv.ParseInt(extra[4:20], 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tocReader, _ := gzip.NewReader(bytes.NewReader(blob[tocOffset:]))
+	tocReader.Multistream(false)
+	tr := tar.NewReader(tocReader)
+	if h, err := tr.Next(); err != nil || h.Name != estargzTOCName {
+		t.Fatalf("expected the table of contents, got: %v", err)
+	}
+	tocJSON, _ := io.ReadAll(tr)
+	if layer.TOCDigest != fmt.Sprintf("sha256:%x", sha256.Sum256(tocJSON)) {
+		t.Fatal("unexpected digest of the table of contents")
+	}
+	var toc estargzTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks are gzip members, fetched with Range requests by the clients.
+	var names []string
+	var content []byte
+	for _, entry := range toc.Entries {
+		names = append(names, entry.Type+":"+entry.Name)
+		if entry.Name != "usr/bin/app" {
+			continue
+		}
+		chunkReader, err := gzip.NewReader(bytes.NewReader(blob[entry.Offset:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkReader.Multistream(false)
+		size := entry.ChunkSize
+		if size == 0 {
+			size = int64(len(files["usr/bin/app"])) - entry.ChunkOffset
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(chunkReader, chunk); err != nil {
+			t.Fatal(err)
+		}
+		if entry.ChunkDigest != fmt.Sprintf("sha256:%x", sha256.Sum256(chunk)) {
+			t.Fatalf("unexpected digest of the chunk at %d", entry.ChunkOffset)
+		}
+		content = append(content, chunk...)
+	}
+	if !bytes.Equal(content, files["usr/bin/app"]) {
+		t.Fatal("unexpected content of the chunks")
+	}
+	expected := "reg:.no.prefetch.landmark dir:etc reg:etc/hostname reg:usr/bin/app chunk:usr/bin/app symlink:usr/bin/link"
+	if strings.Join(names, " ") != expected {
+		t.Fatalf("expected: %s, got: %s", expected, strings.Join(names, " "))
+	}
+}
+
+func TestEstargzConversion(t *testing.T) {
+	files := map[string][]byte{"etc/hostname": []byte("some-host\n"), "usr/bin/app": []byte("some app")}
+	layer := makeLayer(t, files)
+	layerDigest := digestOf(layer)
+	gz, _ := gzip.NewReader(bytes.NewReader(layer))
+	uncompressed, _ := io.ReadAll(gz)
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(uncompressed)}},
+	})
+	configDigest := digestOf(config)
+	imageManifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": configDigest, "size": len(config)},
+		"layers":        []map[string]interface{}{{"mediaType": mediaTypeOCILayerGzip, "digest": layerDigest, "size": len(layer)}},
+	})
+	upstream := newFakeBlobRegistry(map[string][]byte{layerDigest: layer, configDigest: config})
+	upstream.manifests = map[string][]byte{"latest": imageManifest}
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(t.TempDir()),
+		WithEstargzConversion("some-owner/*"),
+	)
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer good")
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+	manifestPath := "/v2/some-owner/some-package/manifests/latest"
+
+	if res := get("/v2/some-owner/some-package/blobs/" + layerDigest); res.Code != http.StatusOK {
+		t.Fatalf("expected the layer, got: %d", res.Code)
+	}
+	if res := get(manifestPath); !bytes.Equal(res.Body.Bytes(), imageManifest) {
+		t.Fatalf("expected the manifest to be unchanged, got: %s", res.Body)
+	}
+	var res *httptest.ResponseRecorder
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res = get(manifestPath); !bytes.Equal(res.Body.Bytes(), imageManifest) {
+			break
+		}
+	}
+	var converted manifest
+	if err := json.Unmarshal(res.Body.Bytes(), &converted); err != nil || len(converted.Layers) != 1 {
+		t.Fatalf("unexpected manifest: %s", res.Body)
+	}
+	estargzLayer := converted.Layers[0]
+	if estargzLayer.MediaType != mediaTypeOCILayerGzip || estargzLayer.Digest == layerDigest || estargzLayer.Annotations[estargzTOCDigestAnnotation] == "" {
+		t.Fatalf("expected the eStargz layer, got: %s", res.Body)
+	}
+
+	// The converted layer and config are served by digest, the config having
+	// the diff ID of the eStargz layer.
+	res = get("/v2/some-owner/some-package/blobs/" + estargzLayer.Digest)
+	if res.Code != http.StatusOK || digestOf(res.Body.Bytes()) != estargzLayer.Digest {
+		t.Fatalf("expected the eStargz layer, got: %d", res.Code)
+	}
+	gz, _ = gzip.NewReader(res.Body)
+	estargzUncompressed, _ := io.ReadAll(gz)
+	res = get("/v2/some-owner/some-package/blobs/" + converted.Config.Digest)
+	if res.Code != http.StatusOK || converted.Config.Digest == configDigest {
+		t.Fatalf("expected the converted config, got: %d", res.Code)
+	}
+	var convertedConfig struct {
+		Architecture string `json:"architecture"`
+		RootFS       struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &convertedConfig)
+	if convertedConfig.Architecture != "amd64" || len(convertedConfig.RootFS.DiffIDs) != 1 || convertedConfig.RootFS.DiffIDs[0] != digestOf(estargzUncompressed) {
+		t.Fatalf("unexpected config: %s", res.Body)
+	}
+
+	// The other repositories are not converted.
+	if res := get("/v2/other-owner/some-package/manifests/latest"); !bytes.Equal(res.Body.Bytes(), imageManifest) {
+		t.Fatalf("expected the manifest to be unchanged, got: %s", res.Body)
+	}
+}
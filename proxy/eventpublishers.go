@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNATSPort is the port of the NATS servers when the URL has none.
+const defaultNATSPort = "4222"
+
+// natsPublisher publishes the events to a NATS server with the text protocol
+// of NATS, over a connection opened on the first event and reopened after a
+// failure.
+type natsPublisher struct {
+	url *url.URL
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newNATSPublisher(u *url.URL) *natsPublisher {
+	return &natsPublisher{url: u}
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return fmt.Errorf("nats: %w", err)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		n.conn.SetWriteDeadline(deadline)
+	}
+	fmt.Fprintf(n.w, "PUB %s %d\r\n", topic, len(payload))
+	n.w.Write(payload)
+	n.w.WriteString("\r\n")
+	if err := n.w.Flush(); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return fmt.Errorf("nats: %w", err)
+	}
+	return nil
+}
+
+// connect opens a connection and authenticates with the credentials of the
+// URL, either a user and a password or a token. The lock must be held.
+func (n *natsPublisher) connect(ctx context.Context) error {
+	host := n.url.Host
+	if n.url.Port() == "" {
+		host = net.JoinHostPort(n.url.Hostname(), defaultNATSPort)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The server sends its INFO in clear text before the TLS handshake.
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting: %q", strings.TrimSpace(line))
+	}
+	if n.url.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: n.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": n.url.Scheme == "tls",
+		"name":         "container-registry-proxy",
+		"lang":         "go",
+		"version":      version,
+		"protocol":     0,
+	}
+	if user := n.url.User; user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	// The PING makes sure the server accepted the credentials.
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("connection refused: %s", line)
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	n.conn, n.w = conn, bufio.NewWriter(conn)
+	go n.read(conn, r)
+	return nil
+}
+
+// read answers the PINGs of the server until the connection is closed.
+func (n *natsPublisher) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mu.Lock()
+			if n.conn == conn {
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("WARN nats: %s", line)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == conn {
+		n.conn = nil
+	}
+	conn.Close()
+}
+
+// kafkaRESTPublisher publishes the events to Kafka through the REST proxy of
+// the cluster, e.g. the Confluent REST Proxy, with the repositories as keys so
+// that the events of a repository stay ordered.
+type kafkaRESTPublisher struct {
+	baseURL  *url.URL
+	username string
+	password string
+}
+
+func newKafkaRESTPublisher(u *url.URL) *kafkaRESTPublisher {
+	baseURL := *u
+	baseURL.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+	baseURL.User = nil
+	p := &kafkaRESTPublisher{baseURL: &baseURL}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	return p
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (k *kafkaRESTPublisher) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	body, _ := json.Marshal(struct {
+		Records []kafkaRecord `json:"records"`
+	}{[]kafkaRecord{{Key: key, Value: payload}}})
+	req, err := http.NewRequestWithContext(ctx, "POST", k.baseURL.JoinPath("topics", topic).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if k.username != "" {
+		req.SetBasicAuth(k.username, k.password)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("kafka: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka: %s", res.Status)
+	}
+	return nil
+}
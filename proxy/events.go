@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// eventQueueSize is the number of events waiting to be published, after
+	// which the new events are dropped.
+	eventQueueSize = 1000
+	// eventPublishTimeout is the maximum duration of the publication of an
+	// event.
+	eventPublishTimeout = 10 * time.Second
+	// defaultEventTopic is the topic (Kafka) or subject (NATS) of the events.
+	defaultEventTopic = "registry.{type}"
+)
+
+// The types of the registry events.
+const (
+	eventPull        = "pull"
+	eventPush        = "push"
+	eventDelete      = "delete"
+	eventCache       = "cache"
+	eventReplication = "replication"
+)
+
+var eventTypes = []string{eventPull, eventPush, eventDelete, eventCache, eventReplication}
+
+var eventsTotal = newCounterVec(
+	"events_total",
+	"Number of registry events sent to the event bus by type and result.",
+	"type", "result",
+)
+
+// Event is a registry event published on the event bus. Its JSON schema is
+// documented in the README and must stay backward compatible.
+type Event struct {
+	// ID identifies the event, e.g. to deduplicate the deliveries.
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Instance is the replica of the proxy that handled the event.
+	Instance   string `json:"instance"`
+	Repository string `json:"repository"`
+	// Reference is the tag or the digest requested by the client.
+	Reference string `json:"reference,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	// Actor is the authenticated client, if any.
+	Actor string `json:"actor,omitempty"`
+	// Result is the cache result of the cache events (`hit`, `miss`,
+	// `coalesced` or `bypass`) and the outcome of the replications
+	// (`succeeded` or `failed`).
+	Result string `json:"result,omitempty"`
+}
+
+// EventPublisher publishes the payloads of the events to a topic.
+type EventPublisher interface {
+	Publish(ctx context.Context, topic, key string, payload []byte) error
+}
+
+// NewEventPublisher returns the publisher of an event bus URL:
+// `nats://[user:password@]host:port` (or `tls://` for NATS over TLS), or
+// `kafka+http://host:port` for the REST proxy of a Kafka cluster.
+func NewEventPublisher(rawURL string) (EventPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event bus URL: %w", err)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+		return newNATSPublisher(u), nil
+	case "kafka+http", "kafka+https":
+		return newKafkaRESTPublisher(u), nil
+	}
+	// The URL is not logged as it can contain credentials.
+	return nil, fmt.Errorf("invalid event bus URL scheme %q: expected nats, tls, kafka+http or kafka+https", u.Scheme)
+}
+
+// eventBus publishes the events in the background, so that the requests are
+// not slowed down by the event bus.
+type eventBus struct {
+	publisher EventPublisher
+	topic     string
+	types     map[string]bool
+	queue     chan Event
+	instance  string
+}
+
+// WithEventBus publishes the registry events of the given types (all of them
+// when empty) with the publisher. The `{type}` placeholder of the topic is
+// replaced by the type of the events.
+func WithEventBus(publisher EventPublisher, topic string, types ...string) Option {
+	return func(p *containerProxy) {
+		if topic == "" {
+			topic = defaultEventTopic
+		}
+		if len(types) == 0 {
+			types = eventTypes
+		}
+		bus := &eventBus{publisher: publisher, topic: topic, types: map[string]bool{}, queue: make(chan Event, eventQueueSize), instance: instanceID()}
+		for _, t := range types {
+			bus.types[t] = true
+		}
+		p.events = bus
+	}
+}
+
+// ParseEventTypes parses a comma-separated list of event types.
+func ParseEventTypes(value string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		valid := false
+		for _, known := range eventTypes {
+			valid = valid || t == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid event type %q, expected one of: %s", t, strings.Join(eventTypes, ", "))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// run publishes the queued events until ctx is done.
+func (b *eventBus) run(ctx context.Context) {
+	for {
+		var event Event
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-b.queue:
+		}
+		payload, _ := json.Marshal(event)
+		topic := strings.ReplaceAll(b.topic, "{type}", event.Type)
+		publishCtx, cancel := context.WithTimeout(ctx, eventPublishTimeout)
+		err := b.publisher.Publish(publishCtx, topic, event.Repository, payload)
+		cancel()
+		if err != nil {
+			eventsTotal.Inc(event.Type, "failed")
+			log.Printf("WARN event %s not published: %s", event.ID, err)
+			continue
+		}
+		eventsTotal.Inc(event.Type, "published")
+	}
+}
+
+// publish queues an event, or drops it when the queue is full.
+func (b *eventBus) publish(event Event) {
+	if !b.types[event.Type] {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	event.ID = hex.EncodeToString(id)
+	event.Time = time.Now().UTC()
+	event.Instance = b.instance
+
+	select {
+	case b.queue <- event:
+	default:
+		eventsTotal.Inc(event.Type, "dropped")
+	}
+}
+
+// publishEvent publishes an event of a request, if the event bus is enabled.
+func (p *containerProxy) publishEvent(r *http.Request, event Event) {
+	if p.events == nil {
+		return
+	}
+	if r != nil {
+		if identity := IdentityFromContext(r.Context()); identity != nil {
+			event.Actor = identity.Method + ":" + identity.Subject
+		}
+	}
+	event.Repository = p.prefixedName(event.Repository)
+	p.events.publish(event)
+}
+
+// publishReplication publishes the outcome of the replication of an image into
+// the blob cache, e.g. by a prefetch.
+func (p *containerProxy) publishReplication(ref string, err error) {
+	name, reference, _ := parseImageReference(ref)
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	p.publishEvent(nil, Event{Type: eventReplication, Repository: name, Reference: reference, Result: result})
+}
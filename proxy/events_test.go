@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publisherMock records the published events.
+type publisherMock struct{ events chan Event }
+
+func (p publisherMock) Publish(ctx context.Context, topic, key string, payload []byte) error {
+	var event Event
+	json.Unmarshal(payload, &event)
+	if topic != "registry."+event.Type || key != event.Repository {
+		event.Type = "unexpected topic " + topic
+	}
+	p.events <- event
+	return nil
+}
+
+func TestEventBus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", "sha256:1234")
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		io.WriteString(w, `{"schemaVersion":2}`)
+	}))
+	defer upstream.Close()
+
+	publisher := publisherMock{events: make(chan Event, 10)}
+	types, err := ParseEventTypes("pull, push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithEventBus(publisher, "", types...))
+	for _, method := range []string{"GET", "PUT", "HEAD"} {
+		req := httptest.NewRequest(method, "/v2/some-org/some-image/manifests/1.0.0", strings.NewReader(`{"schemaVersion":2}`))
+		req.Header.Set("Content-Type", mediaTypeOCIManifest)
+		proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, expected := range []string{eventPull, eventPush} {
+		select {
+		case event := <-publisher.events:
+			if event.Type != expected || event.Repository != "some-org/some-image" || event.Reference != "1.0.0" || event.Digest != "sha256:1234" || event.ID == "" {
+				t.Fatalf("unexpected event: %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a %s event", expected)
+		}
+	}
+	select {
+	case event := <-publisher.events:
+		t.Fatalf("unexpected event: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := ParseEventTypes("pull,download"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := NewEventPublisher("amqp://localhost"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	published := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, `INFO {"server_id":"test","max_payload":1048576}`+"\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "CONNECT "):
+				if !strings.Contains(line, `"auth_token":"some-token"`) {
+					io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+					return
+				}
+			case line == "PING\r\n":
+				io.WriteString(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				published <- line + payload
+			}
+		}
+	}()
+
+	publisher, err := NewEventPublisher("nats://some-token@" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := publisher.Publish(ctx, "registry.pull", "some-org/some-image", []byte(`{"type":"pull"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-published:
+		if message != "PUB registry.pull 15\r\n{\"type\":\"pull\"}\r\n" {
+			t.Fatalf("unexpected message: %q", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a message")
+	}
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	var path, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		path, contentType, body = r.URL.Path, r.Header.Get("Content-Type"), string(data)
+	}))
+	defer server.Close()
+
+	publisher, err := NewEventPublisher(strings.Replace(server.URL, "http://", "kafka+http://user:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(context.Background(), "registry.push", "some-org/some-image", []byte(`{"type":"push"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/topics/registry.push" || contentType != "application/vnd.kafka.json.v2+json" || body != `{"records":[{"key":"some-org/some-image","value":{"type":"push"}}]}` {
+		t.Fatalf("unexpected request: %s %s %s", path, contentType, body)
+	}
+}
+
+func TestEventBusStopsWithTheContext(t *testing.T) {
+	p := &containerProxy{}
+	WithEventBus(publisherMock{events: make(chan Event, 10)}, "")(p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.events.run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event bus to stop")
+	}
+}
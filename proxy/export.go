@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ociRefNameAnnotation is the annotation of the OCI layout index naming the
+// exported image.
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// dockerSaveManifest is an entry of the `manifest.json` file of the `docker
+// save` archives, which `docker load` reads.
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags,omitempty"`
+	Layers   []string `json:"Layers"`
+}
+
+// exportBlob is a blob of an exported image.
+type exportBlob struct {
+	digest string
+	size   int64
+	// body is the content of the manifests, the other blobs being fetched
+	// when they are written.
+	body []byte
+	// cached is set for the blobs computed by the proxy (e.g. the deltas of
+	// the layers), which are read from the cache.
+	cached bool
+}
+
+func blobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// parsePlatform parses a platform, e.g. `linux/arm64/v8`.
+func parsePlatform(value string) (*platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform: %q", value)
+	}
+	p := &platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *platform) matches(other *platform) bool {
+	return other != nil && p.OS == other.OS && p.Architecture == other.Architecture && (p.Variant == "" || p.Variant == other.Variant)
+}
+
+// writeExportBlob writes a blob to the archive, verifying its digest.
+func (p *containerProxy) writeExportBlob(ctx context.Context, r *http.Request, tw *tar.Writer, name string, blob exportBlob, modTime time.Time) error {
+	header := &tar.Header{Name: blobPath(blob.digest), Mode: 0o644, Size: blob.size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if blob.body != nil {
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(blob.body)
+		return err
+	}
+
+	var body io.ReadCloser
+	var err error
+	if blob.cached {
+		body, _, err = p.blobCache.Open(blob.digest)
+	} else {
+		body, err = p.openBlob(ctx, r, name, blob.digest)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hasher), body); err != nil {
+		return fmt.Errorf("blob %s: %w", blob.digest, err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); digest != blob.digest {
+		return fmt.Errorf("blob %s: digest mismatch: %s", blob.digest, digest)
+	}
+	return nil
+}
+
+// ExportImage streams an image as a tarball in the OCI image layout, which
+// `docker load` (with a `manifest.json` file for the single-platform images),
+// `podman load`, `skopeo` or `crane` can import. The `platform` query
+// parameter, e.g. `linux/amd64`, selects a single platform of a
+// multi-platform image. The manifests and the blobs are pulled through the
+// proxy with the credentials of the client, so the pull policies apply.
+func (p *containerProxy) ExportImage(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ExportImage Request %s -> %s", r.Method, r.URL)
+
+	owner, name, reference := chi.URLParam(r, "owner"), chi.URLParam(r, "name"), chi.URLParam(r, "reference")
+	repository := owner + "/" + name
+	if !repositoryNamePattern.MatchString(repository) {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	var selected *platform
+	if value := r.URL.Query().Get("platform"); value != "" {
+		var err error
+		if selected, err = parsePlatform(value); err != nil {
+			Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, err.Error())
+			return
+		}
+	}
+
+	body, contentType, digest, err := p.pullManifest(r, repository, reference)
+	if err != nil {
+		relayPullError(w, err)
+		return
+	}
+	digest = manifestDigest(reference, digest, body)
+	mediaType := contentType
+	var root manifest
+	if err := json.Unmarshal(body, &root); err != nil {
+		Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, "invalid manifest")
+		return
+	}
+	if root.MediaType != "" {
+		mediaType = root.MediaType
+	}
+
+	// The manifests of an index are exported along with it, unless a
+	// platform is selected.
+	blobs := []exportBlob{{digest: digest, size: int64(len(body)), body: body}}
+	top := descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}
+	images := [][]byte{body}
+	if classifyManifest(contentType, body) == manifestTypeIndex {
+		images = nil
+		for _, child := range root.Manifests {
+			if selected != nil && !selected.matches(child.Platform) {
+				continue
+			}
+			childBody, _, _, err := p.pullManifest(r, repository, child.Digest)
+			if err != nil {
+				relayPullError(w, err)
+				return
+			}
+			if selected != nil {
+				// The selected manifest replaces the index.
+				blobs = nil
+				top = descriptor{MediaType: child.MediaType, Digest: child.Digest, Size: int64(len(childBody))}
+			}
+			blobs = append(blobs, exportBlob{digest: child.Digest, size: int64(len(childBody)), body: childBody})
+			images = append(images, childBody)
+			if selected != nil {
+				break
+			}
+		}
+		if len(images) == 0 {
+			Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, "no manifest for platform "+r.URL.Query().Get("platform"))
+			return
+		}
+	}
+
+	var dockerManifests []dockerSaveManifest
+	seen := map[string]bool{}
+	for _, image := range images {
+		var m manifest
+		json.Unmarshal(image, &m)
+		imageBlobs := manifestBlobs(image)
+		for _, blob := range imageBlobs {
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				blobs = append(blobs, exportBlob{digest: blob.Digest, size: blob.Size})
+			}
+		}
+		// `docker load` needs all the layers of a single image.
+		if len(images) == 1 && m.Config != nil && len(imageBlobs) == len(m.Layers)+1 {
+			saved := dockerSaveManifest{Config: blobPath(m.Config.Digest), Layers: []string{}}
+			for _, layer := range m.Layers {
+				saved.Layers = append(saved.Layers, blobPath(layer.Digest))
+			}
+			if validateDigest(reference) != nil {
+				saved.RepoTags = []string{r.Host + "/" + repository + ":" + reference}
+			}
+			dockerManifests = append(dockerManifests, saved)
+		}
+	}
+
+	if validateDigest(reference) != nil {
+		top.Annotations = map[string]string{ociRefNameAnnotation: reference}
+	}
+	index, _ := json.Marshal(manifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []descriptor{top}})
+
+	filename := strings.ReplaceAll(owner+"-"+name+"-"+reference, ":", "-") + ".tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	modTime := time.Now().UTC().Truncate(time.Second)
+	tw := tar.NewWriter(w)
+	files := []struct {
+		name string
+		body []byte
+	}{
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"index.json", index},
+	}
+	if len(dockerManifests) > 0 {
+		saved, _ := json.Marshal(dockerManifests)
+		files = append(files, struct {
+			name string
+			body []byte
+		}{"manifest.json", saved})
+	}
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.body)), ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+			return
+		}
+		if _, err := tw.Write(file.body); err != nil {
+			return
+		}
+	}
+
+	// The blobs are not fetched with the context of the request, whose
+	// timeout is meant for the registry requests, the export stopping when
+	// the client goes away instead.
+	for _, blob := range blobs {
+		if err := p.writeExportBlob(p.background(), r, tw, repository, blob, modTime); err != nil {
+			log.Printf("WARN export of %s:%s failed: %s", repository, reference, err)
+			// The client must not get a truncated archive looking complete.
+			panic(http.ErrAbortHandler)
+		}
+	}
+	tw.Close()
+}
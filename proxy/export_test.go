@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportImage(t *testing.T) {
+	blobs := map[string]string{}
+	addBlob := func(content string) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		blobs[digest] = content
+		return digest
+	}
+	image := func(arch string) string {
+		config, layer := fmt.Sprintf(`{"architecture":%q}`, arch), "layer-"+arch
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":%d}]}`, addBlob(config), len(config), addBlob(layer), len(layer))
+	}
+	amd64, arm64 := image("amd64"), image("arm64")
+	amd64Digest, arm64Digest := addBlob(amd64), addBlob(arm64)
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d,"platform":{"os":"linux","architecture":"amd64"}},{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d,"platform":{"os":"linux","architecture":"arm64","variant":"v8"}}]}`, amd64Digest, len(amd64), arm64Digest, len(arm64))
+	indexDigest := addBlob(index)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, kind, reference, _ := splitRegistryPath(r.URL.Path)
+		if kind == "manifests" && reference == "latest" {
+			reference = indexDigest
+		}
+		content, ok := blobs[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if kind == "manifests" {
+			var m manifest
+			json.Unmarshal([]byte(content), &m)
+			w.Header().Set("Content-Type", m.MediaType)
+		}
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL)
+	export := func(path string) (*httptest.ResponseRecorder, map[string]string) {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		files := map[string]string{}
+		if res.Code != http.StatusOK {
+			return res, files
+		}
+		tr := tar.NewReader(res.Body)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(tr)
+			files[header.Name] = string(content)
+		}
+		return res, files
+	}
+
+	res, files := export("/api/repos/my-org/my-image/latest/export")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusOK, res.Code, res.Body.String())
+	}
+	if res.Header().Get("Content-Disposition") != `attachment; filename="my-org-my-image-latest.tar"` {
+		t.Fatalf("unexpected Content-Disposition: %s", res.Header().Get("Content-Disposition"))
+	}
+	if files["oci-layout"] != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Fatalf("unexpected oci-layout: %s", files["oci-layout"])
+	}
+	for digest, content := range blobs {
+		if files[blobPath(digest)] != content {
+			t.Fatalf("expected blob %s in the archive", digest)
+		}
+	}
+	var layout manifest
+	if err := json.Unmarshal([]byte(files["index.json"]), &layout); err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Manifests) != 1 || layout.Manifests[0].Digest != indexDigest || layout.Manifests[0].Annotations[ociRefNameAnnotation] != "latest" {
+		t.Fatalf("unexpected index.json: %s", files["index.json"])
+	}
+	if _, ok := files["manifest.json"]; ok {
+		t.Fatal("expected no manifest.json for a multi-platform image")
+	}
+
+	_, files = export("/api/repos/my-org/my-image/latest/export?platform=linux/arm64")
+	if err := json.Unmarshal([]byte(files["index.json"]), &layout); err != nil {
+		t.Fatal(err)
+	}
+	if layout.Manifests[0].Digest != arm64Digest {
+		t.Fatalf("expected the arm64 manifest, got: %s", files["index.json"])
+	}
+	if _, ok := files[blobPath(amd64Digest)]; ok || len(files) != 6 {
+		t.Fatalf("expected the arm64 image only, got: %d files", len(files))
+	}
+	var saved []dockerSaveManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || len(saved[0].Layers) != 1 || saved[0].RepoTags[0] != "example.com/my-org/my-image:latest" {
+		t.Fatalf("unexpected manifest.json: %s", files["manifest.json"])
+	}
+
+	for path, status := range map[string]int{
+		"/api/repos/my-org/my-image/latest/export?platform=windows/amd64": http.StatusNotFound,
+		"/api/repos/my-org/my-image/latest/export?platform=linux":         http.StatusBadRequest,
+		"/api/repos/my-org/my-image/unknown/export":                       http.StatusNotFound,
+	} {
+		if res, _ := export(path); res.Code != status {
+			t.Fatalf("%s: expected: %d, got: %d", path, status, res.Code)
+		}
+	}
+
+	if !strings.HasPrefix(files[blobPath(arm64Digest)], `{"schemaVersion":2`) {
+		t.Fatal("expected the arm64 manifest in the archive")
+	}
+}
+
+func TestExportImagePullPolicies(t *testing.T) {
+	config, layer := `{"architecture":"amd64"}`, strings.Repeat("layer", 10)
+	configDigest, layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config))), fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(layer)))
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":%d}]}`, configDigest, len(config), layerDigest, len(layer))
+	blobs := map[string]string{configDigest: config, layerDigest: layer}
+
+	// The images are private, only the client can pull them.
+	var authorizations []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer client-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, kind, reference, _ := splitRegistryPath(r.URL.Path)
+		if kind == "manifests" {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(image))
+			return
+		}
+		w.Write([]byte(blobs[reference]))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL,
+		WithUpstreamCredentials("proxy", "proxy-token"),
+		WithSizeLimits(SizeLimit{Namespace: "limited", MaxSize: "10"}),
+	)
+
+	for _, tc := range []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/api/repos/my-org/my-image/latest/export", "", http.StatusUnauthorized},
+		{"/api/repos/my-org/my-image/latest/export", "Bearer client-token", http.StatusOK},
+		{"/api/repos/limited/my-image/latest/export", "Bearer client-token", http.StatusForbidden},
+	} {
+		authorizations = nil
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.status {
+			t.Fatalf("%s: expected: %d, got: %d %s", tc.path, tc.status, res.Code, res.Body.String())
+		}
+		if res.Header().Get("Docker-Content-Digest") != "" {
+			t.Fatalf("%s: expected no Docker-Content-Digest header for an archive", tc.path)
+		}
+		for _, authorization := range authorizations {
+			if authorization != tc.authorization {
+				t.Fatalf("%s: expected the credentials of the client, got: %q", tc.path, authorization)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// repositoryList is a list of repositories returned by the API.
+type repositoryList struct {
+	Repositories []string `json:"repositories"`
+}
+
+// favoritesUser returns the key of the favorites of the client, or false for
+// the anonymous clients.
+func favoritesUser(r *http.Request) (string, bool) {
+	identity := IdentityFromContext(r.Context())
+	if identity == nil || identity.Method == methodAnonymous {
+		return "", false
+	}
+	return identity.Method + ":" + identity.Subject, true
+}
+
+// repositoryParam returns the (prefixed) name of the repository of a request
+// to the catalog pins or the favorites, or false when it is invalid.
+func (p *containerProxy) repositoryParam(r *http.Request) (string, bool) {
+	name := chi.URLParam(r, "owner") + "/" + chi.URLParam(r, "name")
+	if !repositoryNamePattern.MatchString(name) {
+		return "", false
+	}
+	return p.prefixedName(name), true
+}
+
+// orderCatalog moves the pinned repositories to the top of a catalog, in the
+// order they were pinned, followed by the favorite repositories of the client.
+// The other repositories keep their order.
+func (p *containerProxy) orderCatalog(r *http.Request, names []string) []string {
+	if p.metadata == nil {
+		return names
+	}
+
+	ranks := map[string]int{}
+	for i, name := range p.metadata.CatalogPins() {
+		ranks[name] = i + 1
+	}
+	if user, ok := favoritesUser(r); ok {
+		offset := len(ranks)
+		for i, name := range p.metadata.Favorites(user) {
+			if _, ok := ranks[name]; !ok {
+				ranks[name] = offset + i + 1
+			}
+		}
+	}
+	if len(ranks) == 0 {
+		return names
+	}
+
+	rank := func(name string) int {
+		if r, ok := ranks[name]; ok {
+			return r
+		}
+		return len(ranks) + 1
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return rank(names[i]) < rank(names[j])
+	})
+	return names
+}
+
+// CatalogPins returns the repositories pinned to the top of the catalog.
+func (p *containerProxy) CatalogPins(w http.ResponseWriter, r *http.Request) {
+	log.Printf("CatalogPins Request %s -> %s", r.Method, r.URL)
+	writeRegistryJSON(w, r, "application/json", repositoryList{Repositories: p.metadata.CatalogPins()})
+}
+
+// SetCatalogPin pins a repository to the top of the catalog (PUT), or unpins
+// it (DELETE).
+func (p *containerProxy) SetCatalogPin(w http.ResponseWriter, r *http.Request) {
+	log.Printf("SetCatalogPin Request %s -> %s", r.Method, r.URL)
+
+	name, ok := p.repositoryParam(r)
+	if !ok {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	pinned := r.Method == "PUT"
+	changed, err := p.metadata.SetCatalogPin(name, pinned)
+	if err != nil {
+		Veto(w, http.StatusInternalServerError, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	if !pinned && !changed {
+		Veto(w, http.StatusNotFound, ERROR_NAME_UNKNOWN, fmt.Sprintf("%s is not pinned", name))
+		return
+	}
+	if changed {
+		action := "catalog-unpin"
+		if pinned {
+			action = "catalog-pin"
+		}
+		p.audit(r, action, name, "")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Favorites returns the favorite repositories of the client.
+func (p *containerProxy) Favorites(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Favorites Request %s -> %s", r.Method, r.URL)
+
+	user, ok := favoritesUser(r)
+	if !ok {
+		Veto(w, http.StatusUnauthorized, ERROR_UNAUTHORIZED, "the favorites need an authenticated client")
+		return
+	}
+	writeRegistryJSON(w, r, "application/json", repositoryList{Repositories: p.metadata.Favorites(user)})
+}
+
+// SetFavorite adds a repository to the favorites of the client (PUT), or
+// removes it (DELETE).
+func (p *containerProxy) SetFavorite(w http.ResponseWriter, r *http.Request) {
+	log.Printf("SetFavorite Request %s -> %s", r.Method, r.URL)
+
+	user, ok := favoritesUser(r)
+	if !ok {
+		Veto(w, http.StatusUnauthorized, ERROR_UNAUTHORIZED, "the favorites need an authenticated client")
+		return
+	}
+	name, ok := p.repositoryParam(r)
+	if !ok {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	favorite := r.Method == "PUT"
+	changed, err := p.metadata.SetFavorite(user, name, favorite)
+	if err != nil {
+		Veto(w, http.StatusInternalServerError, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	if !favorite && !changed {
+		Veto(w, http.StatusNotFound, ERROR_NAME_UNKNOWN, fmt.Sprintf("%s is not a favorite", name))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestCatalogPinsAndFavorites(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &github.User{Login: github.String("some-owner")}
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("a"), Owner: owner},
+			{Name: github.String("b"), Owner: owner},
+			{Name: github.String("c"), Owner: owner},
+		},
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(client, nil),
+		"http://127.0.0.1:1",
+		WithMetadataStore(store),
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		withTestAdmin(),
+	)
+
+	do := func(method, path, sub string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if sub != "" {
+			req.SetBasicAuth("user", provider.Sign(t, map[string]interface{}{"sub": sub}))
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, tc := range []struct {
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{method: "PUT", path: "/admin/catalog/pins/some-owner/c", expectedStatusCode: 204},
+		{method: "PUT", path: "/admin/catalog/pins/some-owner/Invalid", expectedStatusCode: 400},
+		{method: "DELETE", path: "/admin/catalog/pins/some-owner/b", expectedStatusCode: 404},
+		{method: "PUT", path: "/api/favorites/some-owner/b", expectedStatusCode: 204},
+		{method: "DELETE", path: "/api/favorites/some-owner/a", expectedStatusCode: 404},
+	} {
+		if res := do(tc.method, tc.path, "alice"); res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	for _, tc := range []struct {
+		path            string
+		sub             string
+		expectedContent string
+	}{
+		{path: "/v2/_catalog", sub: "alice", expectedContent: `{"repositories":["some-owner/c","some-owner/b","some-owner/a"]}`},
+		{path: "/v2/_catalog", sub: "bob", expectedContent: `{"repositories":["some-owner/c","some-owner/a","some-owner/b"]}`},
+		{path: "/api/favorites", sub: "alice", expectedContent: `{"repositories":["some-owner/b"]}`},
+		{path: "/api/favorites", sub: "bob", expectedContent: `{"repositories":[]}`},
+		{path: "/admin/catalog/pins", sub: "bob", expectedContent: `{"repositories":["some-owner/c"]}`},
+	} {
+		res := do("GET", tc.path, tc.sub)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, http.StatusOK, res.Code)
+		}
+		if content := strings.TrimSpace(res.Body.String()); content != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, content)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The feature flags of the subsystems that can be enabled or disabled per
+// environment, without a separate build.
+const (
+	featureBlobPrefetch      = "blob-prefetch"
+	featureParallelBlobFetch = "parallel-blob-fetch"
+	featureBlobCachePeers    = "blob-cache-peers"
+	featureMirrorSignatures  = "mirror-signatures"
+	featureChaos             = "chaos"
+	featureTransforms        = "manifest-transforms"
+)
+
+// featureFlag describes a feature flag.
+type featureFlag struct {
+	name        string
+	description string
+	// experimental flags are disabled by default, while the other flags are
+	// kill switches of subsystems enabled by their own settings.
+	experimental bool
+}
+
+var featureFlagDefinitions = []featureFlag{
+	{name: featureBlobPrefetch, description: "prefetch of the blobs of the pulled manifests (BLOB_PREFETCH)"},
+	{name: featureParallelBlobFetch, description: "fetch of the blobs in parallel ranges (BLOB_FETCH_CONCURRENCY)"},
+	{name: featureBlobCachePeers, description: "blob cache shared with the peers (PEERS, PEERS_DNS)"},
+	{name: featureMirrorSignatures, description: "mirroring of the signatures (MIRROR_SIGNATURES)"},
+	{name: featureChaos, description: "fault injection (chaos rules of the CONFIG_FILE)", experimental: true},
+	{name: featureTransforms, description: "manifest transforms (transforms of the CONFIG_FILE)", experimental: true},
+}
+
+var featureFlagsEnabled = newGaugeVec(
+	"feature_flags",
+	"Whether a feature flag is enabled (1) or not (0), by flag.",
+	"flag",
+)
+
+// FeatureFlags are the states of the feature flags, by name.
+type FeatureFlags map[string]bool
+
+// DefaultFeatureFlags returns the default states of the feature flags, the
+// experimental ones being disabled.
+func DefaultFeatureFlags() FeatureFlags {
+	flags := FeatureFlags{}
+	for _, definition := range featureFlagDefinitions {
+		flags[definition.name] = !definition.experimental
+	}
+	return flags
+}
+
+func isFeatureFlag(name string) bool {
+	for _, definition := range featureFlagDefinitions {
+		if definition.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFeatureFlags parses a comma-separated list of feature flags to enable,
+// or to disable when prefixed with `-`, e.g. `chaos,-blob-prefetch`, the other
+// flags having their default state.
+func ParseFeatureFlags(value string) (FeatureFlags, error) {
+	flags := DefaultFeatureFlags()
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		enabled := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if !isFeatureFlag(name) {
+			return nil, fmt.Errorf("unknown feature flag: %q", name)
+		}
+		flags[name] = enabled
+	}
+	return flags, nil
+}
+
+// Enabled returns whether a feature flag is enabled, the flags missing from f
+// having their default state.
+func (f FeatureFlags) Enabled(name string) bool {
+	if enabled, ok := f[name]; ok {
+		return enabled
+	}
+	return DefaultFeatureFlags()[name]
+}
+
+// require returns whether the feature flag of a subsystem configured by a
+// setting is enabled, and logs that the setting is ignored otherwise.
+func (f FeatureFlags) require(name, setting string) bool {
+	if f.Enabled(name) {
+		return true
+	}
+	log.Printf("WARN %s ignored: feature flag %s is disabled", setting, name)
+	return false
+}
+
+// String returns the states of the feature flags, e.g.
+// `blob-prefetch=on chaos=off`.
+func (f FeatureFlags) String() string {
+	names := make([]string, 0, len(featureFlagDefinitions))
+	for _, definition := range featureFlagDefinitions {
+		names = append(names, definition.name)
+	}
+	sort.Strings(names)
+
+	states := make([]string, 0, len(names))
+	for _, name := range names {
+		state := "off"
+		if f.Enabled(name) {
+			state = "on"
+		}
+		states = append(states, name+"="+state)
+	}
+	return strings.Join(states, " ")
+}
+
+// logFeatureFlags logs the states of the feature flags at startup, with a
+// warning for each experimental flag enabled, and exports them as metrics.
+func logFeatureFlags(flags FeatureFlags) {
+	log.Printf("feature flags: %s", flags)
+	for _, definition := range featureFlagDefinitions {
+		enabled := flags.Enabled(definition.name)
+		if enabled && definition.experimental {
+			log.Printf("WARN experimental feature enabled: %s, %s", definition.name, definition.description)
+		}
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		featureFlagsEnabled.Set(value, definition.name)
+	}
+}
+
+// WithFeatureFlags sets the feature flags reported by the proxy, the default
+// ones otherwise.
+func WithFeatureFlags(flags FeatureFlags) Option {
+	return func(p *containerProxy) {
+		p.featureFlags = flags
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestParseFeatureFlags(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected map[string]bool
+		err      bool
+	}{
+		{value: "", expected: map[string]bool{featureBlobPrefetch: true, featureChaos: false}},
+		{value: "chaos, -blob-prefetch", expected: map[string]bool{featureBlobPrefetch: false, featureChaos: true, featureBlobCachePeers: true}},
+		{value: "chaos,-chaos", expected: map[string]bool{featureChaos: false}},
+		{value: "unknown", err: true},
+		{value: "-", err: true},
+	} {
+		flags, err := ParseFeatureFlags(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tc.value, err)
+		}
+		for name, expected := range tc.expected {
+			if flags.Enabled(name) != expected {
+				t.Errorf("%q: expected %s to be %t", tc.value, name, expected)
+			}
+		}
+	}
+
+	if !(FeatureFlags{}).Enabled(featureBlobPrefetch) || (FeatureFlags{}).Enabled(featureChaos) {
+		t.Error("expected the missing flags to have their default state")
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fluxReceiverTimeout is the maximum duration of a call to a Flux receiver.
+const fluxReceiverTimeout = 10 * time.Second
+
+var (
+	detectedTagsTotal = newCounterVec(
+		"detected_tags_total",
+		"Number of new tags detected by the catalog refreshes.",
+	)
+	fluxNotificationsTotal = newCounterVec(
+		"flux_notifications_total",
+		"Number of notifications sent to the Flux receiver by result.",
+		"result",
+	)
+)
+
+// catalogRefresh lists the tags of the catalog at the times of a schedule to
+// detect the new tags.
+type catalogRefresh struct {
+	schedule *CronSchedule
+
+	mu sync.Mutex
+	// tags are the tags seen by the last refresh, by repository. It is nil
+	// until the first refresh, which detects no tags.
+	tags map[string]map[string]bool
+}
+
+// WithCatalogRefresh refreshes the tags of the catalog at the times of a cron
+// schedule, e.g. to notify a Flux receiver of the new tags.
+func WithCatalogRefresh(schedule *CronSchedule) Option {
+	return func(p *containerProxy) {
+		p.catalogRefresh = &catalogRefresh{schedule: schedule}
+	}
+}
+
+// fluxReceiver is a webhook receiver of the Flux notification controller.
+type fluxReceiver struct {
+	url string
+	// secret signs the payloads for the `generic-hmac` receivers.
+	secret string
+}
+
+// WithFluxReceiver notifies the webhook receiver of the Flux notification
+// controller at url when the catalog refresh or the GitHub webhook detects new
+// tags, so that the image repositories are scanned without waiting for their
+// interval. The payloads are signed with the secret, if any, for the
+// `generic-hmac` receivers.
+func WithFluxReceiver(url, secret string) Option {
+	return func(p *containerProxy) {
+		p.fluxReceiver = &fluxReceiver{url: url, secret: secret}
+	}
+}
+
+// see records a tag detected outside of the refreshes, e.g. by a webhook, so
+// that the next refresh does not detect it again. It returns false when the
+// tag is already known.
+func (c *catalogRefresh) see(repository, tag string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tags == nil {
+		return true
+	}
+	if c.tags[repository][tag] {
+		return false
+	}
+	if c.tags[repository] == nil {
+		c.tags[repository] = map[string]bool{}
+	}
+	c.tags[repository][tag] = true
+	return true
+}
+
+// newTagsEvent is the payload sent to the Flux receiver.
+type newTagsEvent struct {
+	// Images are the `name:tag` references of the new tags.
+	Images []string  `json:"images"`
+	Time   time.Time `json:"time"`
+}
+
+// runCatalogRefresh starts the scheduled catalog refresh.
+func (p *containerProxy) runCatalogRefresh(ctx context.Context) {
+	go runCronJob(ctx, p.leader, p.jobs, "catalog-refresh", p.catalogRefresh.schedule, p.refreshCatalog)
+}
+
+// refreshCatalog lists the tags of the repositories of the catalog, records
+// them in the metadata database for the catalog diffs, and notifies the Flux
+// receiver of the tags not seen by the previous refresh.
+func (p *containerProxy) refreshCatalog(ctx context.Context, run *jobRun) error {
+	repositories, err := p.backend.ListRepositories(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	current := map[string]map[string]bool{}
+	for _, repository := range repositories {
+		name := p.prefixedName(repository.Owner + "/" + repository.Name)
+		tags, err := p.backend.ListTags(ctx, repository.Owner, repository.Name)
+		run.outcome(name, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("list tags of %s: %w", name, err))
+			continue
+		}
+		current[name] = map[string]bool{}
+		for _, tag := range tags {
+			current[name][tag] = true
+		}
+	}
+	// The snapshot is only recorded when all the repositories were listed, so
+	// that the failures are not seen as removals.
+	if p.metadata != nil && len(errs) == 0 {
+		p.recordCatalogSnapshot(current)
+	}
+
+	refresh := p.catalogRefresh
+	refresh.mu.Lock()
+	var images []string
+	if refresh.tags != nil {
+		for name, tags := range current {
+			for tag := range tags {
+				if !refresh.tags[name][tag] {
+					images = append(images, name+":"+tag)
+				}
+			}
+		}
+	}
+	// The repositories that could not be listed keep their previous tags.
+	for name, tags := range refresh.tags {
+		if _, ok := current[name]; !ok {
+			current[name] = tags
+		}
+	}
+	refresh.tags = current
+	refresh.mu.Unlock()
+
+	if len(images) > 0 {
+		sort.Strings(images)
+		detectedTagsTotal.Add(float64(len(images)))
+		log.Printf("catalog refresh: detected %d new tags", len(images))
+		p.notifications.notifyNewTags(images)
+		if p.fluxReceiver != nil {
+			if err := p.fluxReceiver.notify(ctx, newTagsEvent{Images: images, Time: time.Now().UTC()}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// notify sends an event to the receiver, signed with the secret when it is
+// set, like the `X-Signature` header of the `generic-hmac` receivers expects.
+func (f *fluxReceiver) notify(ctx context.Context, event newTagsEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, fluxReceiverTimeout)
+	defer cancel()
+
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequestWithContext(ctx, "POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.secret != "" {
+		mac := hmac.New(sha256.New, []byte(f.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fluxNotificationsTotal.Inc("failed")
+		return fmt.Errorf("flux receiver: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		fluxNotificationsTotal.Inc("failed")
+		return fmt.Errorf("flux receiver: %s", res.Status)
+	}
+	fluxNotificationsTotal.Inc("succeeded")
+	return nil
+}
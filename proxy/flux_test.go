@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestRefreshCatalog(t *testing.T) {
+	var events []newTagsEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("some-secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event newTagsEvent
+		json.Unmarshal(body, &event)
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	version := func(digest string, tags ...string) *github.PackageVersion {
+		return &github.PackageVersion{
+			Name:     github.String(digest),
+			Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: tags}},
+		}
+	}
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("some-package"), Owner: &github.User{Login: github.String("some-org")}},
+		},
+		PackageVersions: []*github.PackageVersion{version("sha256:1111", "1.0.0")},
+	}
+	p := &containerProxy{
+		backend:        ghbackend.New(client, nil),
+		catalogRefresh: &catalogRefresh{},
+		fluxReceiver:   &fluxReceiver{url: receiver.URL, secret: "some-secret"},
+	}
+
+	// The first refresh only records the tags.
+	if err := p.refreshCatalog(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events, got: %v", events)
+	}
+
+	client.PackageVersions = append([]*github.PackageVersion{version("sha256:2222", "1.1.0", "latest")}, client.PackageVersions...)
+	if err := p.refreshCatalog(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !reflect.DeepEqual(events[0].Images, []string{"some-org/some-package:1.1.0", "some-org/some-package:latest"}) {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	// Nothing is sent when no tags are new.
+	if err := p.refreshCatalog(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected a single event, got: %v", events)
+	}
+
+	client.PackageVersions = append(client.PackageVersions, version("sha256:3333", "2.0.0"))
+	p.fluxReceiver.secret = "wrong-secret"
+	if err := p.refreshCatalog(context.Background(), nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The policies of the foreign layers, i.e. the layers that are not
+// distributable, e.g. the base layers of the Windows images, which the clients
+// download from the URLs of the manifests instead of the registry.
+const (
+	// foreignLayersPassthrough returns the manifests unchanged.
+	foreignLayersPassthrough = "passthrough"
+	// foreignLayersBlock rejects the manifests with foreign layers.
+	foreignLayersBlock = "block"
+	// foreignLayersRewrite rewrites the URLs of the foreign layers, the URLs
+	// without rewrite being removed so that the clients download the layers
+	// from the registry, e.g. in an air-gapped environment.
+	foreignLayersRewrite = "rewrite"
+)
+
+var foreignLayerManifestsTotal = newCounterVec(
+	"foreign_layer_manifests_total",
+	"Number of manifests with foreign layers blocked or rewritten, by policy (block, rewrite).",
+	"policy",
+)
+
+// foreignMediaTypes are the media types of the foreign layers.
+var foreignMediaTypes = map[string]bool{
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+}
+
+// ParseForeignLayerPolicy validates a foreign layer policy, passthrough by
+// default.
+func ParseForeignLayerPolicy(value string) (string, error) {
+	switch value {
+	case "":
+		return foreignLayersPassthrough, nil
+	case foreignLayersPassthrough, foreignLayersBlock, foreignLayersRewrite:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid foreign layer policy: %q", value)
+}
+
+// foreignLayers is the policy of the foreign layers of a proxy.
+type foreignLayers struct {
+	policy string
+	// rewrites are the URLs replacing the scheme and the host of the URLs of
+	// the foreign layers, by host, with the rewrite policy.
+	rewrites map[string]*url.URL
+}
+
+// WithForeignLayers configures the handling of the foreign layers (passthrough,
+// block or rewrite), which are passed through by default.
+func WithForeignLayers(policy string, rewrites map[string]*url.URL) Option {
+	return func(p *containerProxy) {
+		p.foreignLayers = &foreignLayers{policy: policy, rewrites: rewrites}
+	}
+}
+
+// foreignLayerURLs returns the URLs of the foreign layers of a manifest, and
+// whether it has foreign layers.
+func foreignLayerURLs(body []byte) ([]string, bool) {
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, false
+	}
+	var urls []string
+	found := false
+	for _, layer := range m.Layers {
+		if foreignMediaTypes[layer.MediaType] || len(layer.URLs) > 0 {
+			found = true
+			urls = append(urls, layer.URLs...)
+		}
+	}
+	return urls, found
+}
+
+// checkForeignLayers is a middleware rejecting the manifests with foreign
+// layers with the block policy. With the rewrite policy, the manifests pulled
+// by tag are rewritten (see rewriteForeignLayers), while the manifests with
+// foreign layers pulled by a digest of the upstream registry are rejected,
+// since they cannot be rewritten without changing their digest.
+func (p *containerProxy) checkForeignLayers(next http.Handler) http.Handler {
+	match := func(r *http.Request) bool {
+		_, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			return false
+		}
+		return p.foreignLayers.policy == foreignLayersBlock || validateDigest(reference) == nil
+	}
+	return ResponseHook(match, func(r *http.Request, res *HookResponse) error {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		urls, found := foreignLayerURLs(res.Body)
+		if !found {
+			return nil
+		}
+		foreignLayerManifestsTotal.Inc(foreignLayersBlock)
+
+		message := "the manifest has foreign layers, which are blocked by the proxy"
+		if p.foreignLayers.policy == foreignLayersRewrite {
+			message = "the manifest has foreign layers, which are only rewritten by the proxy when the image is pulled by tag"
+		}
+		if len(urls) > 0 {
+			message += fmt.Sprintf(" (%s)", strings.Join(urls, ", "))
+		}
+		body, _ := json.Marshal(makeError(ERROR_DENIED, message))
+		res.StatusCode = http.StatusForbidden
+		res.Header.Set("Content-Type", "application/json")
+		res.Header.Del("Docker-Content-Digest")
+		res.Body = body
+		return nil
+	})(next)
+}
+
+// rewriteURL returns the URL of a foreign layer with its scheme and host
+// replaced, and false when there is no rewrite for its host.
+func (f *foreignLayers) rewriteURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	target, ok := f.rewrites[u.Host]
+	if !ok {
+		return "", false
+	}
+	rewritten := *u
+	rewritten.Scheme = target.Scheme
+	rewritten.Host = target.Host
+	rewritten.Path = path.Join("/", target.Path, u.Path)
+	rewritten.RawPath = ""
+	return rewritten.String(), true
+}
+
+// rewriteLayers rewrites the URLs of the foreign layers of an image manifest,
+// and returns whether it changed. The other fields of the manifest are kept.
+func (f *foreignLayers) rewriteLayers(fields map[string]json.RawMessage) (bool, error) {
+	var layers []map[string]json.RawMessage
+	if raw, ok := fields["layers"]; !ok || json.Unmarshal(raw, &layers) != nil {
+		return false, nil
+	}
+
+	changed := false
+	for _, layer := range layers {
+		var urls []string
+		if raw, ok := layer["urls"]; !ok || json.Unmarshal(raw, &urls) != nil {
+			continue
+		}
+		var rewritten []string
+		for _, u := range urls {
+			if u, ok := f.rewriteURL(u); ok {
+				rewritten = append(rewritten, u)
+			}
+		}
+		if len(rewritten) == 0 {
+			delete(layer, "urls")
+		} else {
+			layer["urls"], _ = json.Marshal(rewritten)
+		}
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	raw, err := json.Marshal(layers)
+	if err != nil {
+		return false, err
+	}
+	fields["layers"] = raw
+	return true, nil
+}
+
+// rewriteForeignLayers rewrites the URLs of the foreign layers of a manifest
+// pulled by tag, including the image manifests of an index.
+func (p *containerProxy) rewriteForeignLayers(ctx context.Context, name string, body []byte, mediaType string) ([]byte, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, mediaType, nil
+	}
+
+	changed, err := p.rewriteImageManifests(ctx, name, fields, p.foreignLayers.rewriteLayers)
+	if err != nil {
+		return nil, "", err
+	}
+	if !changed {
+		return body, mediaType, nil
+	}
+	foreignLayerManifestsTotal.Inc(foreignLayersRewrite)
+	body, err = json.Marshal(fields)
+	return body, mediaType, err
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestForeignLayers(t *testing.T) {
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","layers":[{"mediaType":"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip","digest":"sha256:aaaa","size":10,"urls":["https://mcr.microsoft.com/blobs/sha256:aaaa","https://other.example.com/sha256:aaaa"]},{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"sha256:bbbb","size":20}]}`
+	imageDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image)))
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[{"mediaType":"application/vnd.docker.distribution.manifest.v2+json","digest":%q,"size":%d,"platform":{"os":"windows","architecture":"amd64"}}]}`, imageDigest, len(image))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/windows"), strings.HasSuffix(r.URL.Path, "/manifests/"+imageDigest):
+			w.Header().Set("Content-Type", mediaTypeDockerManifest)
+			w.Write([]byte(image))
+		case strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			w.Header().Set("Content-Type", mediaTypeDockerManifestList)
+			w.Write([]byte(index))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	get := func(proxy *http.Server, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	blocking := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithForeignLayers(foreignLayersBlock, nil))
+	res := get(blocking, "/v2/my-org/windows/manifests/windows")
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "DENIED") || !strings.Contains(res.Body.String(), "https://mcr.microsoft.com/blobs/sha256:aaaa") {
+		t.Fatalf("expected the manifest to be blocked, got: %d %s", res.Code, res.Body.String())
+	}
+	if res := get(blocking, "/v2/my-org/windows/manifests/latest"); res.Code != http.StatusOK || res.Body.String() != index {
+		t.Fatalf("expected the index to be passed through, got: %d %s", res.Code, res.Body.String())
+	}
+
+	mirror, _ := url.Parse("https://mirror.internal/microsoft")
+	rewriting := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithForeignLayers(foreignLayersRewrite, map[string]*url.URL{"mcr.microsoft.com": mirror}))
+	res = get(rewriting, "/v2/my-org/windows/manifests/latest")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	var rewrittenIndex struct {
+		Manifests []struct {
+			Digest   string                 `json:"digest"`
+			Platform map[string]interface{} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &rewrittenIndex); err != nil {
+		t.Fatal(err)
+	}
+	child := rewrittenIndex.Manifests[0]
+	if child.Digest == imageDigest || child.Platform["os"] != "windows" {
+		t.Fatalf("expected the index to reference the rewritten manifest: %s", res.Body.String())
+	}
+	if res.Header().Get("Docker-Content-Digest") != fmt.Sprintf("sha256:%x", sha256.Sum256(res.Body.Bytes())) {
+		t.Fatal("expected the digest of the rewritten index")
+	}
+
+	res = get(rewriting, "/v2/my-org/windows/manifests/"+child.Digest)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected the rewritten manifest, got: %d %s", res.Code, res.Body.String())
+	}
+	var rewrittenImage manifest
+	if err := json.Unmarshal(res.Body.Bytes(), &rewrittenImage); err != nil {
+		t.Fatal(err)
+	}
+	if urls := rewrittenImage.Layers[0].URLs; len(urls) != 1 || urls[0] != "https://mirror.internal/microsoft/blobs/sha256:aaaa" {
+		t.Fatalf("unexpected URLs: %v", urls)
+	}
+	if rewrittenImage.Layers[1].Digest != "sha256:bbbb" {
+		t.Fatalf("unexpected layers: %+v", rewrittenImage.Layers)
+	}
+
+	res = get(rewriting, "/v2/my-org/windows/manifests/"+imageDigest)
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "pulled by tag") {
+		t.Fatalf("expected the original manifest to be rejected, got: %d %s", res.Code, res.Body.String())
+	}
+}
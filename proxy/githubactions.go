@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+)
+
+const (
+	methodGitHubActions = "github-actions"
+
+	// GitHubActionsIssuer is the issuer of the OIDC tokens of the GitHub
+	// Actions jobs on github.com.
+	GitHubActionsIssuer = "https://token.actions.githubusercontent.com"
+)
+
+// githubActionsAuthenticator authenticates the GitHub Actions jobs sending
+// the OIDC ID token of the job (requested with `permissions: id-token: write`)
+// as their password, so that the workflows don't need long-lived secrets to
+// pull from the proxy.
+type githubActionsAuthenticator struct {
+	verifier *auth.Verifier
+	owners   map[string]bool
+}
+
+// NewGitHubActionsAuthenticator returns an authenticator accepting the ID
+// tokens issued by GitHub Actions to the workflows of the repositories of the
+// given owners (users or organizations). The tokens must have been requested
+// for the audience. The identities are in the groups `owner:<owner>`,
+// `repo:<owner>/<name>` and `workflow:<owner>/<name>/<path>` (from the
+// `job_workflow_ref` claim, without ref, which is the reusable workflow when
+// there is one), to be used as principals in the ACL.
+func NewGitHubActionsAuthenticator(issuer, audience string, owners []string) Authenticator {
+	if issuer == "" {
+		issuer = GitHubActionsIssuer
+	}
+	allowed := map[string]bool{}
+	for _, owner := range owners {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			allowed[strings.ToLower(owner)] = true
+		}
+	}
+	return &githubActionsAuthenticator{verifier: auth.NewVerifier(issuer, audience), owners: allowed}
+}
+
+func (a *githubActionsAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if token == "" || strings.TrimSuffix(auth.UnverifiedIssuer(token), "/") != a.verifier.Issuer() {
+		return nil, nil
+	}
+
+	claims, err := a.verifier.Verify(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any repository on GitHub can get a token from the same issuer.
+	owner := claims.String("repository_owner")
+	if !a.owners[strings.ToLower(owner)] {
+		return nil, fmt.Errorf("repository owner not allowed: %q", owner)
+	}
+
+	groups := []string{"owner:" + owner}
+	if repository := claims.String("repository"); repository != "" {
+		groups = append(groups, "repo:"+repository)
+	}
+	if workflow, _, _ := strings.Cut(claims.String("job_workflow_ref"), "@"); workflow != "" {
+		groups = append(groups, "workflow:"+workflow)
+	}
+
+	return &Identity{
+		Subject: claims.String("sub"),
+		Method:  methodGitHubActions,
+		Groups:  groups,
+		Claims:  claims,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestGitHubActionsAuth(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rules, err := ParseACL("repo:other-org/app=my-org/shared:pull,push;workflow:other-org/ci/.github/workflows/deploy.yml=my-org/*:pull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, NewGitHubActionsAuthenticator(provider.URL, "container-registry-proxy", []string{"Other-Org"})),
+		WithACL(rules),
+	)
+
+	appToken := provider.Sign(t, map[string]interface{}{
+		"aud":              "container-registry-proxy",
+		"sub":              "repo:other-org/app:ref:refs/heads/main",
+		"repository":       "other-org/app",
+		"repository_owner": "other-org",
+		"job_workflow_ref": "other-org/app/.github/workflows/build.yml@refs/heads/main",
+	})
+	deployToken := provider.Sign(t, map[string]interface{}{
+		"aud":              "container-registry-proxy",
+		"sub":              "repo:other-org/service:environment:production",
+		"repository":       "other-org/service",
+		"repository_owner": "other-org",
+		"job_workflow_ref": "other-org/ci/.github/workflows/deploy.yml@refs/tags/v1",
+	})
+	strangerToken := provider.Sign(t, map[string]interface{}{
+		"aud":              "container-registry-proxy",
+		"sub":              "repo:stranger/app:ref:refs/heads/main",
+		"repository":       "stranger/app",
+		"repository_owner": "stranger",
+	})
+	otherAudienceToken := provider.Sign(t, map[string]interface{}{
+		"aud":              "https://github.com/other-org",
+		"repository":       "other-org/app",
+		"repository_owner": "other-org",
+	})
+
+	for _, tc := range []struct {
+		name               string
+		token              string
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{name: "repository", token: appToken, method: "GET", path: "/v2/my-org/shared/manifests/latest", expectedStatusCode: 200},
+		{name: "pull only", token: appToken, method: "PUT", path: "/v2/my-org/shared/manifests/latest", expectedStatusCode: 403},
+		{name: "not granted", token: appToken, method: "GET", path: "/v2/my-org/other/manifests/latest", expectedStatusCode: 403},
+		{name: "reusable workflow", token: deployToken, method: "GET", path: "/v2/my-org/other/manifests/latest", expectedStatusCode: 200},
+		{name: "owner not allowed", token: strangerToken, method: "GET", path: "/v2/my-org/shared/manifests/latest", expectedStatusCode: 401},
+		{name: "other audience", token: otherAudienceToken, method: "GET", path: "/v2/my-org/shared/manifests/latest", expectedStatusCode: 401},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.SetBasicAuth("github-actions", tc.token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.name, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	// The ID token can be exchanged for a token of the proxy.
+	if code, token := requestToken(t, proxy.Handler, appToken, "repository:my-org/shared:pull"); code != http.StatusOK || token == "" {
+		t.Fatalf("expected a token, got: %d", code)
+	}
+}
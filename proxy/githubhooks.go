@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// maxGitHubWebhookPayloadSize is the maximum size of the payloads of the
+// GitHub webhooks.
+const maxGitHubWebhookPayloadSize = 5 << 20
+
+var githubWebhooksTotal = newCounterVec(
+	"github_webhooks_total",
+	"Number of GitHub webhook deliveries by event and result.",
+	"event", "result",
+)
+
+// WithGitHubWebhook receives the `package` and `registry_package` webhooks of
+// GitHub on `/hooks/github`, signed with the secret, to react to the new
+// versions as soon as they are published.
+func WithGitHubWebhook(secret string) Option {
+	return func(p *containerProxy) {
+		p.githubWebhookSecret = secret
+	}
+}
+
+// githubPackage is the package of the `package` and `registry_package`
+// payloads.
+type githubPackage struct {
+	Name        string `json:"name"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PackageVersion struct {
+		ContainerMetadata struct {
+			Tag struct {
+				Name   string `json:"name"`
+				Digest string `json:"digest"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+type githubPackageEvent struct {
+	Action string `json:"action"`
+	// Package is set by the `package` events, RegistryPackage by the
+	// `registry_package` ones.
+	Package         *githubPackage `json:"package"`
+	RegistryPackage *githubPackage `json:"registry_package"`
+}
+
+// validGitHubSignature returns true when the `X-Hub-Signature-256` header is
+// the HMAC of the payload with the secret.
+func validGitHubSignature(secret, header string, payload []byte) bool {
+	signature, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// GitHubWebhook handles the webhooks of GitHub. When a container version is
+// published or updated, the cached READMEs, tags and catalog of the
+// repository are invalidated and the new tag is sent to the Flux receiver,
+// without waiting for their TTL, their refresh or the next catalog refresh.
+func (p *containerProxy) GitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GitHubWebhook Request %s -> %s", r.Method, r.URL)
+
+	event := r.Header.Get("X-GitHub-Event")
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxGitHubWebhookPayloadSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !validGitHubSignature(p.githubWebhookSecret, r.Header.Get("X-Hub-Signature-256"), payload) {
+		githubWebhooksTotal.Inc(event, "rejected")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNAUTHORIZED, "invalid webhook signature"))
+		return
+	}
+	if event != "package" && event != "registry_package" {
+		githubWebhooksTotal.Inc(event, "ignored")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var body githubPackageEvent
+	if err := json.Unmarshal(payload, &body); err != nil {
+		githubWebhooksTotal.Inc(event, "rejected")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, "invalid webhook payload"))
+		return
+	}
+	pack := body.Package
+	if pack == nil {
+		pack = body.RegistryPackage
+	}
+	if pack == nil || !strings.EqualFold(pack.PackageType, "container") || (body.Action != "published" && body.Action != "updated") {
+		githubWebhooksTotal.Inc(event, "ignored")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	githubWebhooksTotal.Inc(event, "processed")
+	owner, name := strings.ToLower(pack.Owner.Login), pack.Name
+	p.readmes.invalidate(owner, name)
+	if invalidator, ok := p.backend.(backend.Invalidator); ok {
+		invalidator.Invalidate(owner, name)
+	}
+
+	tag := pack.PackageVersion.ContainerMetadata.Tag.Name
+	log.Printf("GitHub webhook: %s %s/%s:%s", body.Action, owner, name, tag)
+	p.recordTag(owner+"/"+name, tag, pack.PackageVersion.ContainerMetadata.Tag.Digest, "webhook")
+	if tag != "" {
+		repository := p.prefixedName(owner + "/" + name)
+		if p.catalogRefresh == nil || p.catalogRefresh.see(repository, tag) {
+			p.notifyNewTags([]string{repository + ":" + tag})
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyNewTags sends new tags to the notification sink and to the Flux
+// receiver in the background.
+func (p *containerProxy) notifyNewTags(images []string) {
+	p.notifications.notifyNewTags(images)
+	if p.fluxReceiver == nil {
+		return
+	}
+	go func() {
+		if err := p.fluxReceiver.notify(p.background(), newTagsEvent{Images: images, Time: time.Now().UTC()}); err != nil {
+			log.Printf("WARN %s", err)
+		}
+	}()
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+// invalidatorMock records the repositories invalidated in a backend.
+type invalidatorMock struct {
+	backend.RegistryBackend
+	invalidated []string
+}
+
+func (b *invalidatorMock) Invalidate(owner, name string) {
+	b.invalidated = append(b.invalidated, owner+"/"+name)
+}
+
+func TestGitHubWebhook(t *testing.T) {
+	events := make(chan newTagsEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event newTagsEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer receiver.Close()
+
+	registry := &invalidatorMock{RegistryBackend: ghbackend.New(&githubClientMock{}, nil)}
+	proxy := NewProxy("127.0.0.1:10000", registry, "https://ghcr.io", WithGitHubWebhook("some-secret"), WithFluxReceiver(receiver.URL, ""))
+	deliver := func(event, payload, secret string) int {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		req := httptest.NewRequest("POST", "/hooks/github", strings.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	published := `{"action":"published","package":{"name":"some-image","package_type":"container","owner":{"login":"Some-Org"},"package_version":{"container_metadata":{"tag":{"name":"1.2.3","digest":"sha256:1234"}}}}}`
+	if status := deliver("package", published, "wrong-secret"); status != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, status)
+	}
+	if status := deliver("package", published, "some-secret"); status != http.StatusNoContent {
+		t.Fatalf("expected: %d, got: %d", http.StatusNoContent, status)
+	}
+	if !reflect.DeepEqual(registry.invalidated, []string{"some-org/some-image"}) {
+		t.Fatalf("expected the repository to be invalidated, got: %v", registry.invalidated)
+	}
+	select {
+	case event := <-events:
+		if len(event.Images) != 1 || event.Images[0] != "some-org/some-image:1.2.3" {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+
+	for event, payload := range map[string]string{
+		"ping":             `{"zen":"Keep it logically awesome."}`,
+		"registry_package": `{"action":"published","registry_package":{"name":"some-gem","package_type":"RUBYGEMS","owner":{"login":"some-org"}}}`,
+		"package":          `{"action":"deleted","package":{"name":"some-image","package_type":"container","owner":{"login":"some-org"}}}`,
+	} {
+		if status := deliver(event, payload, "some-secret"); status != http.StatusNoContent {
+			t.Fatalf("%s: expected: %d, got: %d", event, http.StatusNoContent, status)
+		}
+	}
+	if status := deliver("package", "not json", "some-secret"); status != http.StatusBadRequest {
+		t.Fatalf("expected: %d, got: %d", http.StatusBadRequest, status)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %+v", event)
+	default:
+	}
+}
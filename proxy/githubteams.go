@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+const (
+	methodGitHub = "github"
+
+	// githubIdentityCacheTTL limits how long the memberships of a GitHub token
+	// are trusted without asking GitHub again.
+	githubIdentityCacheTTL = 5 * time.Minute
+)
+
+// githubTokenPrefixes are the prefixes of the GitHub tokens: personal access
+// tokens (classic and fine-grained), OAuth tokens (e.g. `gh auth token` after
+// the device flow) and GitHub App user tokens.
+var githubTokenPrefixes = []string{"ghp_", "github_pat_", "gho_", "ghu_"}
+
+func isGitHubToken(token string) bool {
+	for _, prefix := range githubTokenPrefixes {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// githubTeamsAuthenticator authenticates the users sending a GitHub token, and
+// puts them in groups matching their memberships in the organizations and
+// teams on GitHub, so that the access control stays in GitHub.
+type githubTeamsAuthenticator struct {
+	orgs    []string
+	baseURL string
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]reviewedToken
+}
+
+func newGitHubTeamsAuthenticator(orgs []string) *githubTeamsAuthenticator {
+	var trimmed []string
+	for _, org := range orgs {
+		if org = strings.TrimSpace(org); org != "" {
+			trimmed = append(trimmed, org)
+		}
+	}
+	return &githubTeamsAuthenticator{
+		orgs:  trimmed,
+		now:   time.Now,
+		cache: map[[sha256.Size]byte]reviewedToken{},
+	}
+}
+
+// Authenticate returns an identity whose subject is `github:<login>`, in the
+// groups `org:<org>` and `team:<org>/<team-slug>` of the configured
+// organizations. The users who are not members of any of them are denied.
+func (a *githubTeamsAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if token == "" || !isGitHubToken(token) {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && a.now().Before(cached.expiresAt) {
+		return cached.identity, nil
+	}
+
+	identity, err := a.introspect(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	now := a.now()
+	for k, v := range a.cache {
+		if now.After(v.expiresAt) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = reviewedToken{identity: identity, expiresAt: now.Add(githubIdentityCacheTTL)}
+	a.mu.Unlock()
+
+	return identity, nil
+}
+
+// introspect fetches the user and the memberships of a token, which needs the
+// `read:org` scope.
+func (a *githubTeamsAuthenticator) introspect(ctx context.Context, token string) (*Identity, error) {
+	client := github.NewTokenClient(ctx, token)
+	if a.baseURL != "" {
+		client.BaseURL, _ = url.Parse(strings.TrimSuffix(a.baseURL, "/") + "/")
+	}
+
+	user, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("GitHub token rejected: %w", err)
+	}
+	if user.GetLogin() == "" {
+		return nil, errors.New("GitHub user without login")
+	}
+
+	var groups []string
+	members := map[string]bool{}
+	for _, org := range a.orgs {
+		membership, res, err := client.Organizations.GetOrgMembership(ctx, "", org)
+		if res != nil && (res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusForbidden) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if membership.GetState() == "active" {
+			groups = append(groups, "org:"+org)
+			members[strings.ToLower(org)] = true
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("%s is not a member of %s", user.GetLogin(), strings.Join(a.orgs, ", "))
+	}
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		teams, res, err := client.Teams.ListUserTeams(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, team := range teams {
+			org := team.GetOrganization().GetLogin()
+			if members[strings.ToLower(org)] {
+				groups = append(groups, fmt.Sprintf("team:%s/%s", org, team.GetSlug()))
+			}
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	return &Identity{
+		Subject: "github:" + user.GetLogin(),
+		Method:  methodGitHub,
+		Groups:  groups,
+	}, nil
+}
+
+// WithGitHubTeams enables the authentication of the users sending a GitHub
+// token (e.g. `docker login -u <login> -p $(gh auth token)`), who must be
+// members of one of the organizations. Their teams in these organizations are
+// used as groups in the ACL, e.g. `team:my-org/platform=my-org/*:*`.
+func WithGitHubTeams(orgs ...string) Option {
+	return func(p *containerProxy) {
+		p.authenticators = append(p.authenticators, newGitHubTeamsAuthenticator(orgs))
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestGitHubTeamsAuth(t *testing.T) {
+	requests := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var login string
+		switch r.Header.Get("Authorization") {
+		case "Bearer ghp_alice":
+			login = "alice"
+		case "Bearer ghp_bob":
+			login = "bob"
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"Bad credentials"}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/user":
+			fmt.Fprintf(w, `{"login":%q}`, login)
+		case "/user/memberships/orgs/my-org":
+			if login != "alice" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `{"state":"active"}`)
+		case "/user/teams":
+			fmt.Fprint(w, `[{"slug":"platform","organization":{"login":"my-org"}},{"slug":"other","organization":{"login":"other-org"}}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	authenticator := newGitHubTeamsAuthenticator([]string{"my-org"})
+	authenticator.baseURL = api.URL
+	rules, err := ParseACL("team:my-org/platform=my-org/*:pull,push;team:other-org/other=*:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithTokenAuth([]byte("secret"), time.Minute, authenticator),
+		WithACL(rules),
+	)
+
+	for _, tc := range []struct {
+		name               string
+		token              string
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{name: "team member", token: "ghp_alice", method: "PUT", path: "/v2/my-org/app/manifests/latest", expectedStatusCode: 200},
+		{name: "teams of other organizations", token: "ghp_alice", method: "GET", path: "/v2/other-org/app/manifests/latest", expectedStatusCode: 403},
+		{name: "not a member", token: "ghp_bob", method: "GET", path: "/v2/my-org/app/manifests/latest", expectedStatusCode: 401},
+		{name: "invalid token", token: "ghp_invalid", method: "GET", path: "/v2/my-org/app/manifests/latest", expectedStatusCode: 401},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.SetBasicAuth("some-user", tc.token)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.name, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	// The memberships are cached.
+	before := requests
+	req, _ := http.NewRequest("GET", "/v2/my-org/app/manifests/latest", nil)
+	req.SetBasicAuth("some-user", "ghp_alice")
+	proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	if requests != before {
+		t.Fatalf("expected: %d, got: %d", before, requests)
+	}
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// writeRegistryJSON writes a JSON document synthesized by the proxy (e.g. a
+// tag list) with the headers of a registry, which some clients validate
+// strictly: the exact `Content-Length` and the API version. The body is
+// omitted for the HEAD requests.
+func writeRegistryJSON(w http.ResponseWriter, r *http.Request, contentType string, v any) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(body.Bytes())
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestRegistryHeaders(t *testing.T) {
+	client := githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("some-package"), Owner: &github.User{Login: github.String("some-owner")}},
+		},
+		PackageVersions: []*github.PackageVersion{
+			{Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: []string{"latest"}}}},
+		},
+	}
+	proxy := NewProxy("127.0.0.1:10000", ghbackend.New(&client, nil), "http://127.0.0.1/upstream")
+
+	for _, path := range []string{"/v2/_catalog", "/v2/some-owner/some-package/tags/list"} {
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", path, http.StatusOK, res.Code)
+		}
+		if res.Header().Get("Content-Length") != fmt.Sprint(res.Body.Len()) {
+			t.Fatalf("%s: expected Content-Length: %d, got: %s", path, res.Body.Len(), res.Header().Get("Content-Length"))
+		}
+		if res.Header().Get(distributionAPIVersionHeader) != distributionAPIVersion || res.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: unexpected headers: %v", path, res.Header())
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthCheckInterval is the interval between the health checks of
+	// the upstreams, unless HEALTH_CHECK_INTERVAL is set.
+	defaultHealthCheckInterval = 30 * time.Second
+	// healthCheckTimeout is the timeout of a health check.
+	healthCheckTimeout = 10 * time.Second
+)
+
+var (
+	upstreamUp = newGaugeVec(
+		"upstream_up",
+		"Whether the last health check of an upstream (registry or GitHub API) succeeded (1) or not (0), by upstream.",
+		"upstream",
+	)
+	upstreamProbeDurationSeconds = newGaugeVec(
+		"upstream_probe_duration_seconds",
+		"Duration of the last health check of an upstream, by upstream.",
+		"upstream",
+	)
+	upstreamProbesTotal = newCounterVec(
+		"upstream_probes_total",
+		"Number of health checks of the upstreams, by upstream and result (ok, error).",
+		"upstream", "result",
+	)
+)
+
+// upstreamHealth is the health of an upstream returned by the status
+// endpoint.
+type upstreamHealth struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Status is `up`, `down`, or `unknown` before the first check.
+	Status              string     `json:"status"`
+	LatencySeconds      float64    `json:"latency_seconds"`
+	LastCheckedAt       *time.Time `json:"last_checked_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// healthProbe checks an upstream periodically.
+type healthProbe struct {
+	check func(ctx context.Context) error
+
+	mu     sync.Mutex
+	health upstreamHealth
+}
+
+func (h *healthProbe) run(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.check(ctx)
+	latency := time.Since(start)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := h.health.Name
+	h.health.LastCheckedAt = &start
+	h.health.LatencySeconds = latency.Seconds()
+	upstreamProbeDurationSeconds.Set(latency.Seconds(), name)
+	if err != nil {
+		if h.health.Status != "down" {
+			log.Printf("WARN upstream %s is down: %s", name, err)
+		}
+		h.health.Status = "down"
+		h.health.LastError = redact(err.Error())
+		h.health.LastErrorAt = &start
+		h.health.ConsecutiveFailures++
+		upstreamUp.Set(0, name)
+		upstreamProbesTotal.Inc(name, "error")
+		return
+	}
+	if h.health.Status == "down" {
+		log.Printf("upstream %s is up again", name)
+	}
+	h.health.Status = "up"
+	h.health.ConsecutiveFailures = 0
+	upstreamUp.Set(1, name)
+	upstreamProbesTotal.Inc(name, "ok")
+}
+
+// healthChecker checks the upstream registries and the GitHub API on an
+// interval, on all the replicas.
+type healthChecker struct {
+	interval time.Duration
+	// upstreamURLs are the registries checked in addition to the ones of the
+	// proxy.
+	upstreamURLs []*url.URL
+	probes       []*healthProbe
+}
+
+// add adds a probe, unless the upstream is already checked.
+func (c *healthChecker) add(name, target string, check func(ctx context.Context) error) {
+	for _, probe := range c.probes {
+		if probe.health.Name == name {
+			return
+		}
+	}
+	c.probes = append(c.probes, &healthProbe{
+		check:  check,
+		health: upstreamHealth{Name: name, Target: target, Status: "unknown"},
+	})
+}
+
+// addRegistry adds a probe of the `/v2/` endpoint of a registry, which is
+// healthy unless it fails with a server error. An authentication challenge is
+// expected.
+func (c *healthChecker) addRegistry(upstreamURL *url.URL) {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	target := strings.TrimSuffix(upstreamURL.String(), "/") + "/v2/"
+	c.add(upstreamURL.Host, target, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			return fmt.Errorf("unexpected status: %s", res.Status)
+		}
+		return nil
+	})
+}
+
+// start adds the probes of the upstreams of a proxy and checks them until ctx
+// is canceled.
+func (c *healthChecker) start(ctx context.Context, p *containerProxy) {
+	c.addRegistry(p.upstreamURL)
+	namespaces := make([]string, 0, len(p.namespaces))
+	for namespace := range p.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		c.addRegistry(p.namespaces[namespace])
+	}
+	if p.dockerHubURL != nil {
+		c.addRegistry(p.dockerHubURL)
+	}
+	for _, u := range c.upstreamURLs {
+		c.addRegistry(u)
+	}
+	if checker, ok := p.backend.(interface{ CheckCredentials(context.Context) error }); ok {
+		c.add(backendName(p.backend), "GitHub API", checker.CheckCredentials)
+	}
+
+	go c.run(ctx)
+}
+
+// run checks the upstreams until ctx is canceled.
+func (c *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, probe := range c.probes {
+			wg.Add(1)
+			go func(probe *healthProbe) {
+				defer wg.Done()
+				probe.run(ctx)
+			}(probe)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithHealthChecks checks the upstreams of the proxy (the upstream registry,
+// the upstream namespaces, Docker Hub and the GitHub API) on an interval, and
+// the other upstream registries listed in upstreamURLs, e.g. the ones of the
+// virtual registries.
+func WithHealthChecks(interval time.Duration, upstreamURLs ...string) Option {
+	return func(p *containerProxy) {
+		p.health = &healthChecker{interval: interval}
+		for _, rawURL := range upstreamURLs {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				p.fail(err)
+				return
+			}
+			p.health.upstreamURLs = append(p.health.upstreamURLs, u)
+		}
+	}
+}
+
+// Status returns the health of the upstreams, the status being `degraded`
+// when one of them is down.
+func (p *containerProxy) Status(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Status Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	response := struct {
+		Status    string           `json:"status"`
+		Backend   string           `json:"backend"`
+		Upstreams []upstreamHealth `json:"upstreams"`
+	}{
+		Status:    "ok",
+		Backend:   backendName(p.backend),
+		Upstreams: []upstreamHealth{},
+	}
+	for _, probe := range p.health.probes {
+		probe.mu.Lock()
+		health := probe.health
+		probe.mu.Unlock()
+
+		if health.Status == "down" {
+			response.Status = "degraded"
+		}
+		response.Upstreams = append(response.Upstreams, health)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	other.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithHealthChecks(10*time.Millisecond, other.URL))
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	status := func() (response struct {
+		Status    string           `json:"status"`
+		Upstreams []upstreamHealth `json:"upstreams"`
+	}) {
+		req, _ := http.NewRequest("GET", "/api/status", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		json.NewDecoder(res.Body).Decode(&response)
+		return response
+	}
+	waitFor := func(expected string) {
+		for i := 0; i < 100; i++ {
+			if response := status(); len(response.Upstreams) == 2 && response.Upstreams[0].Status == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected the upstream to be %s, got: %+v", expected, status())
+	}
+
+	// An authentication challenge means that the registry is up.
+	waitFor("up")
+	response := status()
+	if response.Status != "degraded" || response.Upstreams[0].Name != host || response.Upstreams[1].Status != "down" || response.Upstreams[1].LastError == "" {
+		t.Fatalf("unexpected status: %+v", response)
+	}
+	if upstreamUp.Value(host) != 1 {
+		t.Fatalf("expected: 1, got: %g", upstreamUp.Value(host))
+	}
+
+	down.Store(true)
+	waitFor("down")
+	response = status()
+	if !strings.Contains(response.Upstreams[0].LastError, "502") || response.Upstreams[0].ConsecutiveFailures < 1 {
+		t.Fatalf("unexpected status: %+v", response.Upstreams[0])
+	}
+	if upstreamUp.Value(host) != 0 {
+		t.Fatalf("expected: 0, got: %g", upstreamUp.Value(host))
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Hook is a middleware run by the proxy on every request, before the request
+// is routed. A hook can inspect or alter the request, add response headers,
+// alter the response (see ResponseHook) or veto the request by writing a
+// response without calling the next handler (see Veto).
+type Hook struct {
+	// Name identifies the hook in the logs.
+	Name string
+	// Priority defines the order of execution: hooks with a lower priority run
+	// first (i.e. they are the outermost middlewares). Hooks with the same
+	// priority run in registration order.
+	Priority int
+	// Middleware is the function wrapping the next handler.
+	Middleware func(next http.Handler) http.Handler
+}
+
+var (
+	hooksMu         sync.Mutex
+	registeredHooks []Hook
+)
+
+// RegisterHook registers a hook for the proxies of the container-registry-proxy
+// command (see Main). It is meant to be called from an init() function in a
+// file compiled into the binary. The embedded proxies are configured with
+// WithHooks instead.
+func RegisterHook(hook Hook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	registeredHooks = append(registeredHooks, hook)
+}
+
+// withRegisteredHooks returns an option adding the hooks registered with
+// RegisterHook.
+func withRegisteredHooks() Option {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	return WithHooks(registeredHooks...)
+}
+
+// sortedHooks returns the hooks sorted by priority.
+func sortedHooks(hooks []Hook) []Hook {
+	hooks = append([]Hook{}, hooks...)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].Priority < hooks[j].Priority
+	})
+
+	return hooks
+}
+
+// HookResponse is a buffered response that can be altered by a ResponseHook.
+type HookResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+// ResponseHook returns a middleware buffering the responses of the requests
+// accepted by match, so that fn can alter them before they are sent to the
+// client. The Content-Length header is updated when the body is modified.
+// Responses are buffered in memory so match should exclude blobs.
+func ResponseHook(match func(r *http.Request) bool, fn func(r *http.Request, res *HookResponse) error) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !match(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			buffered := &bufferedResponseWriter{header: http.Header{}}
+			next.ServeHTTP(buffered, r)
+			if buffered.statusCode == 0 {
+				buffered.statusCode = http.StatusOK
+			}
+
+			res := &HookResponse{
+				StatusCode: buffered.statusCode,
+				Header:     buffered.header,
+				Body:       buffered.body.Bytes(),
+			}
+			if err := fn(r, res); err != nil {
+				Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+				return
+			}
+
+			for key, values := range res.Header {
+				w.Header()[key] = values
+			}
+			if w.Header().Get("Content-Length") != "" {
+				w.Header().Set("Content-Length", strconv.Itoa(len(res.Body)))
+			}
+			w.WriteHeader(res.StatusCode)
+			w.Write(res.Body)
+		})
+	}
+}
+
+// Veto writes a registry error response, it should be used by hooks rejecting
+// a request.
+func Veto(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(makeError(code, message))
+}
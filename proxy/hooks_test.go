@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestHooksOrder(t *testing.T) {
+	var calls []string
+	hook := func(name string, priority int) Hook {
+		return Hook{
+			Name:     name,
+			Priority: priority,
+			Middleware: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					calls = append(calls, name)
+					next.ServeHTTP(w, r)
+				})
+			},
+		}
+	}
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		"http://127.0.0.1/upstream",
+		WithHooks(hook("c", 10), hook("a", -1), hook("b", 0), hook("b2", 0)),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/_catalog", nil)
+	proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Join(calls, ",") != "a,b,b2,c" {
+		t.Fatalf("unexpected order: %v", calls)
+	}
+}
+
+func TestRegisteredHooks(t *testing.T) {
+	called := false
+	RegisterHook(Hook{Name: "registered", Middleware: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			next.ServeHTTP(w, r)
+		})
+	}})
+	defer func() {
+		hooksMu.Lock()
+		registeredHooks = registeredHooks[:len(registeredHooks)-1]
+		hooksMu.Unlock()
+	}()
+
+	// The registered hooks only apply to the proxies of the command.
+	for _, tc := range []struct {
+		opts     []Option
+		expected bool
+	}{
+		{expected: false},
+		{opts: []Option{withRegisteredHooks()}, expected: true},
+	} {
+		called = false
+		handler, err := New(Settings{UpstreamURL: "http://127.0.0.1/upstream", Options: tc.opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/version", nil))
+		if called != tc.expected {
+			t.Fatalf("expected: %t, got: %t", tc.expected, called)
+		}
+	}
+}
+
+func TestHookVeto(t *testing.T) {
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		"http://127.0.0.1/upstream",
+		WithHooks(Hook{
+			Name: "veto",
+			Middleware: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Veto(w, http.StatusForbidden, "DENIED", "vetoed")
+				})
+			},
+		}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/_catalog", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	expectedContent := `{"errors":[{"code":"DENIED","message":"vetoed","detail":""}]}`
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected: %d, got: %d", http.StatusForbidden, res.Code)
+	}
+	if strings.TrimSpace(res.Body.String()) != expectedContent {
+		t.Fatalf("expected: %s, got: %s", expectedContent, res.Body.String())
+	}
+}
+
+func TestResponseHook(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"schemaVersion":2}`)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithHooks(Hook{
+			Name: "rewrite-manifests",
+			Middleware: ResponseHook(
+				func(r *http.Request) bool {
+					return strings.Contains(r.URL.Path, "/manifests/")
+				},
+				func(r *http.Request, res *HookResponse) error {
+					res.Header.Set("X-Compliance", "checked")
+					res.Body = bytes.Replace(res.Body, []byte("2"), []byte("3"), 1)
+					return nil
+				},
+			),
+		}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/latest", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Header().Get("X-Compliance") != "checked" {
+		t.Fatalf("expected header to be set, got: %v", res.Header())
+	}
+	if res.Body.String() != `{"schemaVersion":3}` {
+		t.Fatalf("unexpected body: %s", res.Body.String())
+	}
+	if res.Header().Get("Content-Length") != "19" {
+		t.Fatalf("unexpected Content-Length: %s", res.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatchdog cancels a context when no activity was reported for a
+// timeout. Unlike a deadline, it does not bound the duration of the slow but
+// progressing transfers, e.g. the large blobs streamed to throttled clients.
+type idleWatchdog struct {
+	timeout time.Duration
+	last    atomic.Int64
+	// parent is the watchdog of the parent context, e.g. of the request of
+	// a blob fetched from the upstream registry, which is active too.
+	parent *idleWatchdog
+}
+
+type idleWatchdogKey struct{}
+
+// withIdleTimeout returns a context canceled after timeout without activity,
+// the activity being reported with reportActivity.
+func withIdleTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	watchdog := &idleWatchdog{timeout: timeout}
+	watchdog.parent, _ = parent.Value(idleWatchdogKey{}).(*idleWatchdog)
+	watchdog.touch()
+	ctx, cancel := context.WithCancel(context.WithValue(parent, idleWatchdogKey{}, watchdog))
+
+	interval := timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, watchdog.last.Load())) > timeout {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+func (w *idleWatchdog) touch() {
+	for ; w != nil; w = w.parent {
+		w.last.Store(time.Now().UnixNano())
+	}
+}
+
+// reportActivity postpones the idle timeout of a context, if any.
+func reportActivity(ctx context.Context) {
+	if watchdog, ok := ctx.Value(idleWatchdogKey{}).(*idleWatchdog); ok {
+		watchdog.touch()
+	}
+}
+
+// isStreamingRequest returns true for the requests streaming a manifest or a
+// blob to the client, whose duration depends on their size and on the
+// bandwidth of the client.
+func isStreamingRequest(r *http.Request) bool {
+	_, kind, _, ok := splitRegistryPath(r.URL.Path)
+	return ok && r.Method == "GET" && (kind == "blobs" || kind == "manifests")
+}
+
+// activityResponseWriter reports the writes of a response as activity.
+type activityResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *activityResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		reportActivity(w.ctx)
+	}
+	return n, err
+}
+
+func (w *activityResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// activityReader reports the reads of a body as activity, e.g. the blobs
+// fetched from the upstream registry before being sent to the client.
+type activityReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		reportActivity(r.ctx)
+	}
+	return n, err
+}
+
+// detachedContext keeps the values of a context without its cancellation and
+// deadline, like context.WithoutCancel.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// transferContext returns the context of a blob fetched from the upstream
+// registry, which is not bounded by the timeout of the request but is
+// canceled when the transfer stalls for this timeout.
+func (p *containerProxy) transferContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return withIdleTimeout(detachedContext{r.Context()}, p.requestTimeout(r))
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+var immutableTagDriftsTotal = newCounterVec(
+	"immutable_tag_drifts_total",
+	"Number of pulls of an immutable tag pointing to another digest than the one first seen.",
+)
+
+// TagPattern is a glob pattern (see path.Match) matched against the tags, and
+// optionally against the repository names.
+type TagPattern struct {
+	Repository string
+	Tag        string
+}
+
+func (t TagPattern) matches(name, tag string) bool {
+	if t.Repository != "" {
+		if matched, _ := path.Match(t.Repository, name); !matched {
+			return false
+		}
+	}
+	matched, _ := path.Match(t.Tag, tag)
+	return matched
+}
+
+// ParseImmutableTags parses a comma-separated list of tag patterns, either
+// `tag` or `repository:tag`, e.g. `v*,my-org/*:release-*`.
+func ParseImmutableTags(value string) ([]TagPattern, error) {
+	var patterns []TagPattern
+	for _, rawPattern := range strings.Split(value, ",") {
+		rawPattern = strings.TrimSpace(rawPattern)
+		if rawPattern == "" {
+			continue
+		}
+
+		var pattern TagPattern
+		if i := strings.LastIndex(rawPattern, ":"); i >= 0 {
+			pattern.Repository, pattern.Tag = rawPattern[:i], rawPattern[i+1:]
+		} else {
+			pattern.Tag = rawPattern
+		}
+		if pattern.Tag == "" {
+			return nil, fmt.Errorf("invalid immutable tag pattern: %q", rawPattern)
+		}
+		for _, glob := range []string{pattern.Repository, pattern.Tag} {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid immutable tag pattern: %q: %w", rawPattern, err)
+			}
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// immutableTags keeps the digests of the immutable tags when they were first
+// seen, in the metadata database when it is configured.
+type immutableTags struct {
+	patterns []TagPattern
+
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+// WithImmutableTags prevents the tags matching the patterns from being
+// repointed: pushes changing their digest and their deletions are denied, and
+// the digests of the tags pulled through the proxy are checked against the
+// digests first seen.
+func WithImmutableTags(patterns ...TagPattern) Option {
+	return func(p *containerProxy) {
+		p.immutableTags = &immutableTags{patterns: patterns, pins: map[string]string{}}
+	}
+}
+
+func (t *immutableTags) matches(name, tag string) bool {
+	for _, pattern := range t.patterns {
+		if pattern.matches(name, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// pin records the digest of an immutable tag, unless it is already pinned,
+// and returns the pinned digest.
+func (t *immutableTags) pin(store *metadata.Store, name, tag, digest string) string {
+	if store != nil {
+		pinned, err := store.PinTag(name, tag, digest)
+		if err != nil {
+			log.Printf("WARN pin of %s:%s not saved: %s", name, tag, err)
+		}
+		return pinned
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := name + ":" + tag
+	if pinned, ok := t.pins[key]; ok {
+		return pinned
+	}
+	t.pins[key] = digest
+	return digest
+}
+
+// immutableTagsDenied returns the immutable tags among the tags of the
+// version referenced by a digest, which cannot be deleted. It fails when the
+// tags of the version cannot be found, so that the deletion is denied.
+func (p *containerProxy) immutableTagsDenied(r *http.Request, name, digest string) ([]string, error) {
+	finder, ok := p.backend.(backend.VersionFinder)
+	owner, repository, found := strings.Cut(name, "/")
+	if !ok || !found {
+		return nil, nil
+	}
+	version, err := finder.FindVersion(r.Context(), owner, repository, digest)
+	if errors.Is(err, backend.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, tag := range version.Tags {
+		if p.immutableTags.matches(p.prefixedName(name), tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// enforceImmutableTags is a middleware denying the pushes and deletions that
+// would repoint an immutable tag, and alerting when an immutable tag pulled
+// through the proxy was repointed upstream, e.g. on GitHub.
+func (p *containerProxy) enforceImmutableTags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		repository := p.prefixedName(name)
+
+		if strings.Contains(reference, ":") {
+			if r.Method == "DELETE" {
+				tags, err := p.immutableTagsDenied(r, name, reference)
+				if err != nil {
+					Veto(w, http.StatusServiceUnavailable, errorCode(ERROR_UNAVAILABLE, err), fmt.Sprintf("cannot check the immutable tags of %s: %s", reference, err))
+					return
+				}
+				if len(tags) > 0 {
+					Veto(w, http.StatusForbidden, ERROR_DENIED, fmt.Sprintf("%s has immutable tags: %s", reference, strings.Join(tags, ", ")))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.immutableTags.matches(repository, reference) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case "DELETE":
+			Veto(w, http.StatusForbidden, ERROR_DENIED, fmt.Sprintf("tag %s is immutable", reference))
+
+		case "PUT":
+			if r.Body == nil {
+				r.Body = http.NoBody
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+			if err != nil {
+				Veto(w, http.StatusBadRequest, ERROR_MANIFEST_INVALID, err.Error())
+				return
+			}
+			if len(body) > maxManifestSize {
+				Veto(w, http.StatusBadRequest, ERROR_MANIFEST_INVALID, "manifest too large")
+				return
+			}
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+
+			current, err := p.registryClient.ManifestDigest(r.Context(), name, reference)
+			if err != nil && !errors.Is(err, errManifestUnknown) {
+				Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, fmt.Sprintf("cannot check the immutable tag %s: %s", reference, err))
+				return
+			}
+			if current != "" && current != digest {
+				Veto(w, http.StatusForbidden, ERROR_DENIED, fmt.Sprintf("tag %s is immutable and already points to %s", reference, current))
+				return
+			}
+
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			tee := &teeResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(tee, r)
+			if tee.statusCode/100 == 2 {
+				p.immutableTags.pin(p.metadata, repository, reference, digest)
+			}
+
+		case "GET", "HEAD":
+			// The tag is pinned to the digest of the upstream registry, not
+			// to the one of a transformed manifest.
+			ctx, upstream := withUpstreamDigest(r.Context())
+			tee := &teeResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(tee, r.WithContext(ctx))
+			digest := upstream.or(w.Header().Get("Docker-Content-Digest"))
+			if tee.statusCode != http.StatusOK || digest == "" {
+				return
+			}
+			if pinned := p.immutableTags.pin(p.metadata, repository, reference, digest); pinned != digest {
+				immutableTagDriftsTotal.Inc()
+				log.Printf("ALERT immutable tag %s:%s was repointed from %s to %s upstream", repository, reference, pinned, digest)
+				if p.metadata != nil {
+					event := metadata.AuditEvent{
+						Actor:   "proxy",
+						Action:  "immutable-tag-drift",
+						Target:  repository + ":" + reference,
+						Details: fmt.Sprintf("%s -> %s", pinned, digest),
+					}
+					if err := p.metadata.Audit(event); err != nil {
+						log.Printf("WARN audit event not saved: %s", err)
+					}
+				}
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseImmutableTags(t *testing.T) {
+	for _, tc := range []struct {
+		value            string
+		expectedPatterns []TagPattern
+		expectedErr      bool
+	}{
+		{value: "v*", expectedPatterns: []TagPattern{{Tag: "v*"}}},
+		{
+			value:            "v*, my-org/*:release-*",
+			expectedPatterns: []TagPattern{{Tag: "v*"}, {Repository: "my-org/*", Tag: "release-*"}},
+		},
+		{value: "my-org/app:", expectedErr: true},
+		{value: "[", expectedErr: true},
+	} {
+		patterns, err := ParseImmutableTags(tc.value)
+		if (err != nil) != tc.expectedErr {
+			t.Fatalf("%s: unexpected error: %v", tc.value, err)
+		}
+		if !reflect.DeepEqual(patterns, tc.expectedPatterns) {
+			t.Fatalf("%s: expected: %v, got: %v", tc.value, tc.expectedPatterns, patterns)
+		}
+	}
+}
+
+func TestImmutableTags(t *testing.T) {
+	existing := []byte(`{"schemaVersion":2}`)
+	existingDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(existing))
+
+	var pushes int32
+	var digest atomic.Value
+	digest.Store(existingDigest)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT":
+			atomic.AddInt32(&pushes, 1)
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/manifests/v1"):
+			w.Header().Set("Docker-Content-Digest", digest.Load().(string))
+			w.Write(existing)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	patterns, _ := ParseImmutableTags("v*")
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithImmutableTags(patterns...))
+
+	for _, tc := range []struct {
+		method             string
+		tag                string
+		body               string
+		expectedStatusCode int
+	}{
+		// Repointing an existing tag.
+		{method: "PUT", tag: "v1", body: `{"schemaVersion":2,"layers":[]}`, expectedStatusCode: http.StatusForbidden},
+		// Pushing the same manifest again.
+		{method: "PUT", tag: "v1", body: string(existing), expectedStatusCode: http.StatusCreated},
+		// Pushing a new tag.
+		{method: "PUT", tag: "v2", body: `{}`, expectedStatusCode: http.StatusCreated},
+		// Mutable tags are not checked.
+		{method: "PUT", tag: "latest", body: `{}`, expectedStatusCode: http.StatusCreated},
+		{method: "DELETE", tag: "v1", expectedStatusCode: http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tc.method, "/v2/some-owner/some-package/manifests/"+tc.tag, strings.NewReader(tc.body))
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.tag, tc.expectedStatusCode, res.Code)
+		}
+	}
+	if pushes != 3 {
+		t.Fatalf("expected: %d, got: %d", 3, pushes)
+	}
+
+	// The tag is repointed upstream.
+	drifts := immutableTagDriftsTotal.Value()
+	for _, d := range []string{existingDigest, "sha256:other"} {
+		digest.Store(d)
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/v1", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+		}
+	}
+	if value := immutableTagDriftsTotal.Value(); value != drifts+1 {
+		t.Fatalf("expected: %g, got: %g", drifts+1, value)
+	}
+}
+
+func TestImmutableTagsDeleteDigest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	patterns, _ := ParseImmutableTags("v*")
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{{
+			Name:     github.String("sha256:1111"),
+			Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: []string{"v1"}}},
+		}},
+	}
+	proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), upstream.URL, WithImmutableTags(patterns...))
+
+	for _, tc := range []struct {
+		digest             string
+		err                error
+		expectedStatusCode int
+	}{
+		{digest: "sha256:1111", expectedStatusCode: http.StatusForbidden},
+		// The unknown versions are left to the deletion.
+		{digest: "sha256:2222", expectedStatusCode: http.StatusNotFound},
+		// The deletion is denied when the tags cannot be checked.
+		{digest: "sha256:2222", err: errors.New("outage"), expectedStatusCode: http.StatusServiceUnavailable},
+	} {
+		client.Err = tc.err
+		req, _ := http.NewRequest("DELETE", "/v2/some-owner/some-package/manifests/"+tc.digest, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s (%v): expected: %d, got: %d", tc.digest, tc.err, tc.expectedStatusCode, res.Code)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxImportSize limits the size of the imported tarballs, which are
+	// extracted to a temporary directory.
+	maxImportSize = 10 * 1024 * 1024 * 1024
+
+	mediaTypeDockerConfig    = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+var importedImagesTotal = newCounterVec(
+	"imported_images_total",
+	"Number of images imported with the /api/import endpoint, by result (success, error).",
+	"result",
+)
+
+// errInvalidImport is returned when a tarball is not a valid image.
+var errInvalidImport = errors.New("invalid image tarball")
+
+type importResponse struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	// PushedBlobs is the number of blobs uploaded, the blobs already present
+	// upstream being skipped.
+	PushedBlobs  int `json:"pushed_blobs"`
+	SkippedBlobs int `json:"skipped_blobs"`
+}
+
+// imageImport pushes the content of an extracted tarball to a repository.
+type imageImport struct {
+	client *registryClient
+	// putManifest pushes the manifests, see containerProxy.pushManifest.
+	putManifest func(ctx context.Context, name, reference, mediaType string, body []byte) (string, error)
+	dir         string
+	name        string
+	result      importResponse
+}
+
+// extractTarball extracts the regular files of a tarball, optionally
+// compressed with gzip, to a directory.
+func extractTarball(r io.Reader, dir string) error {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidImport, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The cleaned names cannot escape the directory.
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+			return err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (i *imageImport) readFile(name string) ([]byte, error) {
+	body, err := os.ReadFile(filepath.Join(i.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s not found", errInvalidImport, name)
+	}
+	return body, err
+}
+
+// fileDigest returns the digest and the size of a file of the tarball.
+func (i *imageImport) fileDigest(name string) (string, int64, error) {
+	f, err := os.Open(filepath.Join(i.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", 0, fmt.Errorf("%w: %s not found", errInvalidImport, name)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("sha256:%x", hasher.Sum(nil)), size, nil
+}
+
+// pushBlob uploads a file of the tarball, unless the blob exists upstream.
+func (i *imageImport) pushBlob(ctx context.Context, name, digest string) error {
+	exists, err := i.client.HasBlob(ctx, i.name, digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		i.result.SkippedBlobs++
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(i.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: blob %s not found", errInvalidImport, digest)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := i.client.PushBlob(ctx, i.name, digest, info.Size(), f); err != nil {
+		return err
+	}
+	i.result.PushedBlobs++
+	return nil
+}
+
+// pushManifest pushes a manifest of an OCI layout, after its blobs or the
+// manifests of an index, and returns its digest.
+func (i *imageImport) pushManifest(ctx context.Context, desc descriptor, reference string) (string, error) {
+	if validateDigest(desc.Digest) != nil || !strings.HasPrefix(desc.Digest, "sha256:") {
+		return "", fmt.Errorf("%w: invalid digest %q", errInvalidImport, desc.Digest)
+	}
+	body, err := i.readFile(blobPath(desc.Digest))
+	if err != nil {
+		return "", err
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body)); digest != desc.Digest {
+		return "", fmt.Errorf("%w: digest mismatch for %s", errInvalidImport, desc.Digest)
+	}
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return "", fmt.Errorf("%w: invalid manifest %s", errInvalidImport, desc.Digest)
+	}
+
+	for _, child := range m.Manifests {
+		if _, err := i.pushManifest(ctx, child, child.Digest); err != nil {
+			return "", err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append([]descriptor{*m.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if !strings.HasPrefix(blob.Digest, "sha256:") {
+			return "", fmt.Errorf("%w: unsupported digest %q", errInvalidImport, blob.Digest)
+		}
+		// The foreign layers are downloaded from their URLs.
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		if err := i.pushBlob(ctx, blobPath(blob.Digest), blob.Digest); err != nil {
+			return "", err
+		}
+	}
+
+	mediaType := desc.MediaType
+	if m.MediaType != "" {
+		mediaType = m.MediaType
+	}
+	return i.putManifest(ctx, i.name, reference, mediaType, body)
+}
+
+// refNameTag returns the tag of a ref name of an OCI layout, which is a tag or
+// a full image name (e.g. with containerd).
+func refNameTag(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 && i > strings.LastIndex(name, "/") {
+		return name[i+1:]
+	}
+	if strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// importOCILayout pushes the image of an OCI layout (or of a `docker save`
+// tarball of Docker 25 and later, which are OCI layouts too). The image is
+// the one named by the tag when the layout has several images.
+func (i *imageImport) importOCILayout(ctx context.Context, tag string) error {
+	body, err := i.readFile("index.json")
+	if err != nil {
+		return err
+	}
+	var index manifest
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("%w: invalid index.json", errInvalidImport)
+	}
+
+	var selected *descriptor
+	for j, desc := range index.Manifests {
+		if len(index.Manifests) == 1 || refNameTag(desc.Annotations[ociRefNameAnnotation]) == tag || tag == "" && j == 0 {
+			selected = &index.Manifests[j]
+			break
+		}
+	}
+	if selected == nil {
+		return fmt.Errorf("%w: no image named %q", errInvalidImport, tag)
+	}
+	if tag == "" {
+		tag = refNameTag(selected.Annotations[ociRefNameAnnotation])
+		if tag == "" {
+			tag = "latest"
+		}
+	}
+
+	if !tagNamePattern.MatchString(tag) {
+		return fmt.Errorf("%w: invalid tag %q", errInvalidImport, tag)
+	}
+
+	i.result.Tag = tag
+	i.result.Digest, err = i.pushManifest(ctx, *selected, tag)
+	return err
+}
+
+// importDockerSave pushes the image of a legacy `docker save` tarball, whose
+// uncompressed layers and config are pushed with a Docker manifest.
+func (i *imageImport) importDockerSave(ctx context.Context, tag string) error {
+	body, err := i.readFile("manifest.json")
+	if err != nil {
+		return err
+	}
+	var saved []dockerSaveManifest
+	if err := json.Unmarshal(body, &saved); err != nil || len(saved) == 0 {
+		return fmt.Errorf("%w: invalid manifest.json", errInvalidImport)
+	}
+
+	var selected *dockerSaveManifest
+	for j, entry := range saved {
+		for _, repoTag := range entry.RepoTags {
+			if strings.HasSuffix(repoTag, ":"+tag) {
+				selected = &saved[j]
+			}
+		}
+		if len(saved) == 1 || tag == "" && j == 0 {
+			selected = &saved[j]
+		}
+		if selected != nil {
+			break
+		}
+	}
+	if selected == nil {
+		return fmt.Errorf("%w: no image tagged %q", errInvalidImport, tag)
+	}
+	if tag == "" {
+		tag = "latest"
+		if len(selected.RepoTags) > 0 {
+			repoTag := selected.RepoTags[0]
+			tag = repoTag[strings.LastIndex(repoTag, ":")+1:]
+		}
+	}
+	if !tagNamePattern.MatchString(tag) {
+		return fmt.Errorf("%w: invalid tag %q", errInvalidImport, tag)
+	}
+
+	push := func(name, mediaType string) (descriptor, error) {
+		digest, size, err := i.fileDigest(name)
+		if err != nil {
+			return descriptor{}, err
+		}
+		return descriptor{MediaType: mediaType, Digest: digest, Size: size}, i.pushBlob(ctx, name, digest)
+	}
+	config, err := push(selected.Config, mediaTypeDockerConfig)
+	if err != nil {
+		return err
+	}
+	m := manifest{SchemaVersion: 2, MediaType: mediaTypeDockerManifest, Config: &config, Layers: []descriptor{}}
+	for _, name := range selected.Layers {
+		mediaType := mediaTypeDockerLayer
+		if head, err := i.readHead(name); err == nil && bytes.HasPrefix(head, []byte{0x1f, 0x8b}) {
+			mediaType = mediaTypeDockerLayerGzip
+		}
+		layer, err := push(name, mediaType)
+		if err != nil {
+			return err
+		}
+		m.Layers = append(m.Layers, layer)
+	}
+
+	manifestBody, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	i.result.Tag = tag
+	i.result.Digest, err = i.putManifest(ctx, i.name, tag, mediaTypeDockerManifest, manifestBody)
+	return err
+}
+
+// readHead returns the first bytes of a file of the tarball.
+func (i *imageImport) readHead(name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(i.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 2)
+	n, err := io.ReadFull(f, head)
+	return head[:n], err
+}
+
+// pushManifest pushes a manifest of an import through the proxy, with the
+// credentials of the client of the request r, so that the immutable tags, the
+// hooks and the quotas apply as for the pushes. The blobs are pushed with the
+// credentials of the proxy.
+func (p *containerProxy) pushManifest(ctx context.Context, r *http.Request, name, reference, mediaType string, body []byte) (string, error) {
+	req := pullRequest(ctx, r, "/v2/"+name+"/manifests/"+reference)
+	req.Method = "PUT"
+	// The push is replayed once the upstream registry asks for a token.
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", mediaType)
+
+	res := &bufferedResponseWriter{header: http.Header{}}
+	p.handler.ServeHTTP(res, req)
+	if res.statusCode != http.StatusCreated {
+		return "", &pullError{statusCode: res.statusCode, header: res.header, body: res.body.Bytes()}
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+// ImportImage pushes an image tarball, i.e. an OCI layout or a `docker save`
+// archive optionally compressed with gzip, to the upstream registry with the
+// credentials of the proxy, e.g. from a host that cannot reach the upstream
+// registry. The repository is set with the `repository` query parameter, and
+// the tag with `tag`, defaulting to the tag found in the tarball.
+func (p *containerProxy) ImportImage(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ImportImage Request %s -> %s", r.Method, r.URL)
+
+	name, tag := r.URL.Query().Get("repository"), r.URL.Query().Get("tag")
+	if !repositoryNamePattern.MatchString(name) {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	if tag != "" && !tagNamePattern.MatchString(tag) {
+		Veto(w, http.StatusBadRequest, ERROR_TAG_INVALID, "invalid tag")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "container-registry-proxy-import-")
+	if err != nil {
+		Veto(w, http.StatusInternalServerError, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractTarball(http.MaxBytesReader(w, r.Body, maxImportSize), dir); err != nil {
+		importedImagesTotal.Inc("error")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			Veto(w, http.StatusRequestEntityTooLarge, ERROR_UNKNOWN, "the tarball is too large")
+			return
+		}
+		Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, err.Error())
+		return
+	}
+
+	// The upload of the tarball can exceed the timeout of the requests, the
+	// import stopping when it fails instead.
+	ctx := p.background()
+	i := &imageImport{client: p.registryClient, dir: dir, name: name, result: importResponse{Repository: name}}
+	i.putManifest = func(ctx context.Context, name, reference, mediaType string, body []byte) (string, error) {
+		return p.pushManifest(ctx, r, name, reference, mediaType, body)
+	}
+	importTarball := i.importDockerSave
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		importTarball = i.importOCILayout
+	}
+	if err := importTarball(ctx, tag); err != nil {
+		importedImagesTotal.Inc("error")
+		log.Printf("WARN import of %s failed: %s", name, err)
+		var refused *pullError
+		if errors.As(err, &refused) {
+			refused.relay(w)
+			return
+		}
+		if errors.Is(err, errInvalidImport) {
+			Veto(w, http.StatusBadRequest, ERROR_MANIFEST_INVALID, err.Error())
+			return
+		}
+		Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+		return
+	}
+	importedImagesTotal.Inc("success")
+	p.audit(r, "import", name+":"+i.result.Tag, i.result.Digest)
+	p.publishEvent(r, Event{Type: eventPush, Repository: name, Reference: i.result.Tag, Digest: i.result.Digest})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(i.result)
+}
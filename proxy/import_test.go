@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// staticAuthenticator authenticates all the clients with its identity.
+type staticAuthenticator struct{ identity *Identity }
+
+func (a staticAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.Header.Get("Authorization") == "" {
+		return nil, nil
+	}
+	return a.identity, nil
+}
+
+func makeTarball(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestImportImage(t *testing.T) {
+	var mu sync.Mutex
+	blobs, manifests := map[string]string{}, map[string]string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// The pushes are authenticated with the credentials of the proxy.
+		if r.URL.Path == "/token" {
+			if username, password, _ := r.BasicAuth(); username != "proxy" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"upstream-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer upstream-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method == "HEAD" && strings.Contains(r.URL.Path, "/blobs/"):
+			if _, ok := blobs[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/blobs/uploads/"):
+			w.Header().Set("Location", r.URL.Path+"some-uuid?state=1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/blobs/uploads/some-uuid"):
+			digest := r.URL.Query().Get("digest")
+			if r.URL.Query().Get("state") != "1" || digest != fmt.Sprintf("sha256:%x", sha256.Sum256(body)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			blobs[digest] = string(body)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/manifests/"):
+			manifests[strings.TrimPrefix(r.URL.Path, "/v2/")] = r.Header.Get("Content-Type") + " " + string(body)
+			w.WriteHeader(http.StatusCreated)
+		case strings.Contains(r.URL.Path, "/manifests/"):
+			mediaType, body, ok := strings.Cut(manifests[strings.TrimPrefix(r.URL.Path, "/v2/")], " ")
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(body))))
+			w.Write([]byte(body))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	auth := func(p *containerProxy) {
+		p.authenticators = append(p.authenticators, staticAuthenticator{&Identity{Subject: "alice", Method: "static"}})
+	}
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, auth, WithUpstreamCredentials("proxy", "secret"))
+	importImage := func(query string, tarball io.Reader, authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/import?"+query, tarball)
+		if authenticated {
+			req.Header.Set("Authorization", "Bearer some-token")
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	config, layer := `{"architecture":"amd64"}`, "some-layer"
+	configDigest, layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config))), fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(layer)))
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":%d}]}`, configDigest, len(config), layerDigest, len(layer))
+	imageDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image)))
+	layout := map[string]string{
+		"oci-layout":            `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json":            fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d,"annotations":{"org.opencontainers.image.ref.name":"1.2.3"}}]}`, imageDigest, len(image)),
+		blobPath(imageDigest):   image,
+		blobPath(configDigest):  config,
+		blobPath(layerDigest):   layer,
+		"../../../tmp/escaping": "ignored",
+	}
+
+	if res := importImage("repository=my-org/app", makeTarball(t, layout), false); res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	res := importImage("repository=my-org/app", makeTarball(t, layout), true)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusCreated, res.Code, res.Body.String())
+	}
+	var result importResponse
+	json.NewDecoder(res.Body).Decode(&result)
+	if result.Tag != "1.2.3" || result.Digest != imageDigest || result.PushedBlobs != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if blobs[configDigest] != config || blobs[layerDigest] != layer {
+		t.Fatal("expected the blobs to be pushed")
+	}
+	if manifests["my-org/app/manifests/1.2.3"] != mediaTypeOCIManifest+" "+image {
+		t.Fatalf("expected the manifest to be pushed, got: %v", manifests)
+	}
+
+	// The blobs already pushed are skipped.
+	res = importImage("repository=my-org/app&tag=latest", makeTarball(t, layout), true)
+	json.NewDecoder(res.Body).Decode(&result)
+	if res.Code != http.StatusCreated || result.Tag != "latest" || result.PushedBlobs != 0 || result.SkippedBlobs != 2 {
+		t.Fatalf("unexpected result: %d %+v", res.Code, result)
+	}
+
+	// The legacy `docker save` tarballs are pushed with a Docker manifest.
+	res = importImage("repository=my-org/legacy", makeTarball(t, map[string]string{
+		"manifest.json":  `[{"Config":"abc.json","RepoTags":["my-org/legacy:v1"],"Layers":["def/layer.tar"]}]`,
+		"abc.json":       config,
+		"def/layer.tar":  "other-layer",
+		"def/json":       "{}",
+		"repositories":   "{}",
+		"def/VERSION":    "1.0",
+		"ignored/layer2": "",
+	}), true)
+	json.NewDecoder(res.Body).Decode(&result)
+	if res.Code != http.StatusCreated || result.Tag != "v1" || result.PushedBlobs != 1 {
+		t.Fatalf("unexpected result: %d %+v", res.Code, result)
+	}
+	var pushed manifest
+	mediaType, body, _ := strings.Cut(manifests["my-org/legacy/manifests/v1"], " ")
+	json.Unmarshal([]byte(body), &pushed)
+	if mediaType != mediaTypeDockerManifest || pushed.Config.Digest != configDigest || len(pushed.Layers) != 1 || pushed.Layers[0].MediaType != mediaTypeDockerLayer {
+		t.Fatalf("unexpected manifest: %s", manifests["my-org/legacy/manifests/v1"])
+	}
+
+	for query, status := range map[string]int{
+		"repository=My-Org":                  http.StatusBadRequest,
+		"repository=my-org/app&tag=-invalid": http.StatusBadRequest,
+		"repository=my-org/app&tag=unknown":  http.StatusCreated,
+	} {
+		if res := importImage(query, makeTarball(t, layout), true); res.Code != status {
+			t.Fatalf("%s: expected: %d, got: %d %s", query, status, res.Code, res.Body.String())
+		}
+	}
+	if res := importImage("repository=my-org/app", strings.NewReader("not a tarball"), true); res.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %d, got: %d", http.StatusBadRequest, res.Code)
+	}
+
+	// The imports cannot repoint an immutable tag.
+	patterns, _ := ParseImmutableTags("1.*")
+	proxy = NewProxy("127.0.0.1:10000", nil, upstream.URL, auth, WithUpstreamCredentials("proxy", "secret"), WithImmutableTags(patterns...))
+	res = importImage("repository=my-org/app&tag=1.2.3", makeTarball(t, map[string]string{
+		"manifest.json": `[{"Config":"abc.json","Layers":["def/layer.tar"]}]`,
+		"abc.json":      config,
+		"def/layer.tar": "other-layer",
+	}), true)
+	if res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "immutable") {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusForbidden, res.Code, res.Body.String())
+	}
+	if manifests["my-org/app/manifests/1.2.3"] != mediaTypeOCIManifest+" "+image {
+		t.Fatalf("expected the immutable tag to be kept, got: %v", manifests["my-org/app/manifests/1.2.3"])
+	}
+	if res := importImage("repository=my-org/app&tag=1.2.3", makeTarball(t, layout), true); res.Code != http.StatusCreated {
+		t.Fatalf("expected: %d, got: %d %s", http.StatusCreated, res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/fakeghcr"
+)
+
+// TestIntegration pulls images through an embedded proxy, configured with the
+// GitHub backend and a blob cache, from a fake GHCR.
+func TestIntegration(t *testing.T) {
+	ghcr := fakeghcr.New()
+	defer ghcr.Close()
+	digest := ghcr.AddImage("my-org", "app", []string{"latest", "v1.0.0"}, []byte("layer 1"), []byte("layer 2"))
+	ghcr.AddImage("my-org", "app", []string{"v0.9.0"}, []byte("layer 0"))
+	ghcr.AddImage("other-org", "tool", []string{"latest"}, []byte("tool"))
+
+	handler, err := New(Settings{
+		Backend:     ghbackend.New(ghcr.GitHubClient().Users, []string{"my-org"}),
+		UpstreamURL: ghcr.Registry.URL,
+		Options:     []Option{WithBlobCache(t.TempDir())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	getJSON := func(path string, v interface{}) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected: %d, got: %d", path, http.StatusOK, res.StatusCode)
+		}
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	getJSON("/v2/_catalog", &catalog)
+	if !reflect.DeepEqual(catalog.Repositories, []string{"my-org/app"}) {
+		t.Fatalf("unexpected catalog: %v", catalog.Repositories)
+	}
+
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	getJSON("/v2/my-org/app/tags/list", &tags)
+	sort.Strings(tags.Tags)
+	if !reflect.DeepEqual(tags.Tags, []string{"latest", "v0.9.0", "v1.0.0"}) {
+		t.Fatalf("unexpected tags: %v", tags.Tags)
+	}
+
+	for _, reference := range []string{"latest", digest} {
+		image, err := fakeghcr.Pull(context.Background(), server.Client(), server.URL, "my-org/app", reference)
+		if err != nil {
+			t.Fatalf("pull %s: %s", reference, err)
+		}
+		if image.Digest != digest || len(image.Layers) != 2 || string(image.Layers[1]) != "layer 2" {
+			t.Fatalf("pull %s: unexpected image: %+v", reference, image)
+		}
+	}
+
+	// The blobs of the second pull are served from the cache.
+	var blobRequests int
+	for _, request := range ghcr.Requests() {
+		if strings.HasPrefix(request, "GET /v2/my-org/app/blobs/") {
+			blobRequests++
+		}
+	}
+	if blobRequests != 3 {
+		t.Fatalf("expected 3 upstream blob requests, got: %d (%v)", blobRequests, ghcr.Requests())
+	}
+
+	if _, err := fakeghcr.Pull(context.Background(), server.Client(), server.URL, "my-org/app", "unknown"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a 404 error, got: %v", err)
+	}
+}
+
+func TestNewInvalidUpstreamURL(t *testing.T) {
+	if _, err := New(Settings{UpstreamURL: "file:///etc/passwd"}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithHealthChecks(time.Minute, "http://%zz")},
+		// The API keys are stored in the metadata database.
+		{WithAPIKeys()},
+		{WithSizeLimits(SizeLimit{Namespace: "some-owner", MaxSize: "abc"})},
+		{WithManifestTransforms(ManifestTransform{Name: "some-transform", URL: "http://localhost", Timeout: "abc"})},
+		{WithQuotas(Quota{Namespace: "some-owner", MonthlyBytes: "abc"})},
+	} {
+		if _, err := New(Settings{Options: opts}); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+}
+
+// TestConformance runs the conformance checks against an embedded proxy.
+func TestConformance(t *testing.T) {
+	ghcr := fakeghcr.New()
+	defer ghcr.Close()
+	ghcr.AddImage("my-org", "app", []string{"latest", "v1.0.0"}, []byte("layer 1"))
+
+	handler, err := New(Settings{
+		Backend:     ghbackend.New(ghcr.GitHubClient().Users, []string{"my-org"}),
+		UpstreamURL: ghcr.Registry.URL,
+		Options:     []Option{WithBlobCache(t.TempDir())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// The blobs are fetched upstream by the first run, and served from the
+	// cache by the second one.
+	for i := 0; i < 2; i++ {
+		results, err := RunConformance(context.Background(), server.Client(), server.URL, "my-org/app", "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			if !result.Passed {
+				t.Errorf("run %d: %s (%s): %s", i+1, result.Name, result.Flow, result.Error)
+			}
+		}
+	}
+}
+
+// TestHarborReplication lists the repositories and the tags of the proxy like
+// the replication adapter of Harbor, which follows the `Link` headers of the
+// paginated lists.
+func TestHarborReplication(t *testing.T) {
+	ghcr := fakeghcr.New()
+	defer ghcr.Close()
+	ghcr.AddImage("my-org", "app", []string{"latest", "v1.0.0"}, []byte("layer 1"))
+	ghcr.AddImage("my-org", "app", []string{"v0.9.0"}, []byte("layer 0"))
+	ghcr.AddImage("my-org", "tool", []string{"latest"}, []byte("tool"))
+	ghcr.AddImage("my-org", "web", []string{"latest"}, []byte("web"))
+
+	handler, err := New(Settings{
+		Backend:     ghbackend.New(ghcr.GitHubClient().Users, []string{"my-org"}),
+		UpstreamURL: ghcr.Registry.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// crawl follows the `Link` headers from a first page.
+	crawl := func(path, field string) []string {
+		var items []string
+		for path != "" {
+			res, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page map[string]interface{}
+			json.NewDecoder(res.Body).Decode(&page)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: expected: %d, got: %d", path, http.StatusOK, res.StatusCode)
+			}
+			list, _ := page[field].([]interface{})
+			if len(list) > 1 {
+				t.Fatalf("GET %s: expected at most 1 item, got: %v", path, list)
+			}
+			for _, item := range list {
+				items = append(items, item.(string))
+			}
+
+			path = ""
+			if link := res.Header.Get("Link"); link != "" {
+				path = link[strings.Index(link, "<")+1 : strings.Index(link, ">")]
+			}
+		}
+		return items
+	}
+
+	repositories := crawl("/v2/_catalog?n=1", "repositories")
+	if !reflect.DeepEqual(repositories, []string{"my-org/app", "my-org/tool", "my-org/web"}) {
+		t.Fatalf("unexpected repositories: %v", repositories)
+	}
+	tags := crawl("/v2/my-org/app/tags/list?n=1", "tags")
+	if !reflect.DeepEqual(tags, []string{"latest", "v0.9.0", "v1.0.0"}) {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Route families restricted by the IP filters.
+const (
+	routeFamilyRegistry = "registry"
+	routeFamilyAdmin    = "admin"
+)
+
+// routeFamily returns the family of a request: the admin API (the proxy API
+// and the metrics) or the registry API (everything else).
+func routeFamily(path string) string {
+	if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/admin/") || path == "/metrics" {
+		return routeFamilyAdmin
+	}
+	return routeFamilyRegistry
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs or IP addresses.
+func ParseCIDRs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, raw := range strings.Split(value, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		if !strings.Contains(raw, "/") {
+			addr, err := netip.ParseAddr(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address: %q", raw)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %q", raw)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRules are the allowed and denied networks of a route family. Denied
+// networks take precedence, and all the addresses are allowed when there is no
+// allowed network.
+type ipRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func (r ipRules) allows(addr netip.Addr) bool {
+	if containsAddr(r.deny, addr) {
+		return false
+	}
+	return len(r.allow) == 0 || containsAddr(r.allow, addr)
+}
+
+// WithIPFilter restricts the addresses of the clients allowed to use a route
+// family ("registry" or "admin").
+func WithIPFilter(family string, allow, deny []netip.Prefix) Option {
+	return func(p *containerProxy) {
+		if p.ipRules == nil {
+			p.ipRules = map[string]ipRules{}
+		}
+		p.ipRules[family] = ipRules{allow: allow, deny: deny}
+	}
+}
+
+// WithTrustedProxies configures the reverse proxies (e.g. load balancers)
+// whose `X-Forwarded-For` header is used to find the address of the clients.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(p *containerProxy) {
+		p.trustedProxies = prefixes
+	}
+}
+
+// clientAddr returns the address of the client, which is the rightmost
+// address of `X-Forwarded-For` that is not a trusted proxy when the request
+// comes from a trusted proxy.
+func (p *containerProxy) clientAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address: %q", r.RemoteAddr)
+	}
+	addr = addr.Unmap()
+
+	if !containsAddr(p.trustedProxies, addr) {
+		return addr, nil
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedAddr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = forwardedAddr.Unmap()
+		if !containsAddr(p.trustedProxies, addr) {
+			break
+		}
+	}
+
+	return addr, nil
+}
+
+// ipFilter is a middleware rejecting the requests of the clients that are not
+// allowed to use a route family.
+func (p *containerProxy) ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules, ok := p.ipRules[routeFamily(r.URL.Path)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr, err := p.clientAddr(r)
+		if err != nil || !rules.allows(addr) {
+			log.Printf("WARN %s %s denied for %s", r.Method, r.URL.Path, addr)
+			Veto(w, http.StatusForbidden, ERROR_DENIED, "access denied from this network")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := ParseCIDRs("10.0.0.0/8, 192.168.1.10,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(prefixes) != 3 || prefixes[1].String() != "192.168.1.10/32" {
+		t.Fatalf("unexpected prefixes: %v", prefixes)
+	}
+
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseCIDRs(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	management, _ := ParseCIDRs("10.0.0.0/8")
+	denied, _ := ParseCIDRs("192.168.66.0/24")
+	trusted, _ := ParseCIDRs("172.16.0.1")
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithIPFilter(routeFamilyAdmin, management, nil),
+		WithIPFilter(routeFamilyRegistry, nil, denied),
+		WithTrustedProxies(trusted),
+	)
+
+	for _, tc := range []struct {
+		remoteAddr         string
+		forwardedFor       string
+		path               string
+		expectedStatusCode int
+	}{
+		{remoteAddr: "10.1.2.3:1234", path: "/metrics", expectedStatusCode: 200},
+		{remoteAddr: "192.168.1.1:1234", path: "/metrics", expectedStatusCode: 403},
+		{remoteAddr: "192.168.1.1:1234", path: "/api/repos/some-owner/some-package", expectedStatusCode: 403},
+		{remoteAddr: "192.168.1.1:1234", path: "/v2/_catalog", expectedStatusCode: 200},
+		{remoteAddr: "192.168.66.1:1234", path: "/v2/_catalog", expectedStatusCode: 403},
+		{remoteAddr: "[::ffff:192.168.66.1]:1234", path: "/v2/_catalog", expectedStatusCode: 403},
+		// The address of the client is read from X-Forwarded-For when the
+		// request comes from a trusted proxy only.
+		{remoteAddr: "172.16.0.1:1234", forwardedFor: "192.168.1.1, 10.1.2.3", path: "/metrics", expectedStatusCode: 200},
+		{remoteAddr: "172.16.0.1:1234", forwardedFor: "10.1.2.3, 192.168.1.1", path: "/metrics", expectedStatusCode: 403},
+		{remoteAddr: "192.168.1.1:1234", forwardedFor: "10.1.2.3", path: "/metrics", expectedStatusCode: 403},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s (%s): expected: %d, got: %d", tc.remoteAddr, tc.path, tc.forwardedFor, tc.expectedStatusCode, res.Code)
+		}
+	}
+}
+
+// withTestAdmin enables the admin endpoints for the clients of the tests, on
+// loopback addresses or with the address of the requests of httptest.
+func withTestAdmin() Option {
+	allowed, _ := ParseCIDRs("127.0.0.0/8,::1,192.0.2.0/24")
+	return WithIPFilter(routeFamilyAdmin, allowed, nil)
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+// defaultJobRunsLimit is the number of runs returned by default by the job
+// history endpoint.
+const defaultJobRunsLimit = 20
+
+var (
+	jobRunsTotal = newCounterVec(
+		"job_runs_total",
+		"Number of runs of the background jobs by job and result (succeeded, failed).",
+		"job", "result",
+	)
+	jobOutcomesTotal = newCounterVec(
+		"job_outcomes_total",
+		"Number of targets (e.g. images) processed by the background jobs by job and result (succeeded, failed).",
+		"job", "result",
+	)
+)
+
+// jobRun is a run of a background job in progress.
+type jobRun struct {
+	mu  sync.Mutex
+	run metadata.JobRun
+}
+
+// outcome records the result of the job for a target, e.g. an image. It can
+// be called on a nil run, when the caller is not a job.
+func (r *jobRun) outcome(target string, err error) {
+	if r == nil {
+		return
+	}
+
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	jobOutcomesTotal.Inc(r.run.Job, result)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.run.Outcomes == nil {
+		r.run.Outcomes = map[string]string{}
+	}
+	r.run.Outcomes[target] = "ok"
+	if err != nil {
+		r.run.Outcomes[target] = err.Error()
+	}
+}
+
+// jobStatus is the status of a background job.
+type jobStatus struct {
+	Name string `json:"name"`
+	// Schedule is the cron schedule of the job, if any.
+	Schedule  string           `json:"schedule,omitempty"`
+	NextRunAt *time.Time       `json:"next_run_at,omitempty"`
+	Running   bool             `json:"running"`
+	LastRun   *metadata.JobRun `json:"last_run,omitempty"`
+
+	running int
+}
+
+// jobTracker keeps the status of the background jobs, and their history in
+// the metadata database when it is configured.
+type jobTracker struct {
+	store *metadata.Store
+
+	mu   sync.Mutex
+	jobs map[string]*jobStatus
+}
+
+func newJobTracker(store *metadata.Store) *jobTracker {
+	return &jobTracker{store: store, jobs: map[string]*jobStatus{}}
+}
+
+// job returns the status of a job, registering it if needed. The lock must be
+// held.
+func (t *jobTracker) job(name string) *jobStatus {
+	job, ok := t.jobs[name]
+	if !ok {
+		job = &jobStatus{Name: name}
+		// The last run survives the restarts.
+		if t.store != nil {
+			if runs := t.store.JobRuns(name, 1); len(runs) > 0 {
+				job.LastRun = &runs[0]
+			}
+		}
+		t.jobs[name] = job
+	}
+	return job
+}
+
+// scheduled records the next run of a scheduled job.
+func (t *jobTracker) scheduled(name, schedule string, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	job := t.job(name)
+	job.Schedule = schedule
+	job.NextRunAt = &next
+}
+
+// run runs a job and records its outcome.
+func (t *jobTracker) run(ctx context.Context, name string, fn func(ctx context.Context, run *jobRun) error) error {
+	t.mu.Lock()
+	job := t.job(name)
+	job.running++
+	job.Running = true
+	t.mu.Unlock()
+
+	run := &jobRun{run: metadata.JobRun{Job: name, StartedAt: time.Now().UTC()}}
+	err := fn(ctx, run)
+
+	run.mu.Lock()
+	record := run.run
+	run.mu.Unlock()
+	record.FinishedAt = time.Now().UTC()
+	result := "succeeded"
+	if err != nil {
+		record.Error = err.Error()
+		result = "failed"
+	}
+	jobRunsTotal.Inc(name, result)
+
+	t.mu.Lock()
+	job.running--
+	job.Running = job.running > 0
+	job.LastRun = &record
+	t.mu.Unlock()
+
+	if t.store != nil {
+		if err := t.store.RecordJobRun(record); err != nil {
+			log.Printf("WARN run of job %s not saved: %s", name, err)
+		}
+	}
+
+	return err
+}
+
+// Status returns the status of the jobs, sorted by name.
+func (t *jobTracker) Status() []jobStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	jobs := []jobStatus{}
+	for _, job := range t.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+	return jobs
+}
+
+// Jobs returns the status of the background jobs.
+func (p *containerProxy) Jobs(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Jobs Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(struct {
+		Jobs []jobStatus `json:"jobs"`
+	}{
+		Jobs: p.jobs.Status(),
+	})
+}
+
+// JobRuns returns the most recent runs of the background jobs, optionally
+// filtered by job.
+func (p *containerProxy) JobRuns(w http.ResponseWriter, r *http.Request) {
+	log.Printf("JobRuns Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := defaultJobRunsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, "invalid limit"))
+			return
+		}
+	}
+
+	response := struct {
+		Runs []metadata.JobRun `json:"runs"`
+	}{
+		Runs: []metadata.JobRun{},
+	}
+	response.Runs = append(response.Runs, p.metadata.JobRuns(r.URL.Query().Get("job"), limit)...)
+	json.NewEncoder(w).Encode(response)
+}
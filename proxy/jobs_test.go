@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestJobTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := metadata.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := newJobTracker(store)
+
+	next := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	jobs.scheduled("prefetch-1", "@daily", next)
+	err = jobs.run(context.Background(), "prefetch-1", func(ctx context.Context, run *jobRun) error {
+		run.outcome("some-owner/some-package:1.0.0", nil)
+		run.outcome("some-owner/other-package:1.0.0", errors.New("manifest unknown"))
+		return errors.New("1 image failed")
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	status := jobs.Status()
+	if len(status) != 1 {
+		t.Fatalf("expected: %d, got: %d", 1, len(status))
+	}
+	job := status[0]
+	if job.Schedule != "@daily" || !job.NextRunAt.Equal(next) || job.Running {
+		t.Fatalf("unexpected status: %+v", job)
+	}
+	if job.LastRun == nil || job.LastRun.Error != "1 image failed" {
+		t.Fatalf("unexpected last run: %+v", job.LastRun)
+	}
+	expected := map[string]string{
+		"some-owner/some-package:1.0.0":  "ok",
+		"some-owner/other-package:1.0.0": "manifest unknown",
+	}
+	for target, outcome := range expected {
+		if job.LastRun.Outcomes[target] != outcome {
+			t.Fatalf("expected: %s, got: %s", outcome, job.LastRun.Outcomes[target])
+		}
+	}
+
+	// The last run is loaded from the metadata database after a restart.
+	store, err = metadata.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs = newJobTracker(store)
+	jobs.scheduled("prefetch-1", "@daily", next)
+	if job := jobs.Status()[0]; job.LastRun == nil || job.LastRun.Error != "1 image failed" {
+		t.Fatalf("unexpected last run: %+v", job.LastRun)
+	}
+}
+
+func TestJobsAPI(t *testing.T) {
+	upstream := newFakeBlobRegistry(map[string][]byte{})
+	defer upstream.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithBlobCache(t.TempDir()),
+		WithMetadataStore(store),
+		withTestAdmin(),
+	)
+
+	req := httptest.NewRequest("POST", "/admin/prefetch", strings.NewReader(`{"images":["some-owner/some-package:unknown"]}`))
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("expected: %d, got: %d", http.StatusAccepted, res.Code)
+	}
+
+	var status struct {
+		Jobs []jobStatus `json:"jobs"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(status.Jobs) == 0 || status.Jobs[0].LastRun == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the prefetch job to run")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		req := httptest.NewRequest("GET", "/admin/jobs", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		json.NewDecoder(res.Body).Decode(&status)
+	}
+	if job := status.Jobs[0]; job.Name != "prefetch" || job.LastRun.Error == "" {
+		t.Fatalf("unexpected status: %+v", job)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/jobs/runs?job=prefetch", nil)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	var history struct {
+		Runs []metadata.JobRun `json:"runs"`
+	}
+	json.NewDecoder(res.Body).Decode(&history)
+	if len(history.Runs) != 1 || history.Runs[0].Outcomes["some-owner/some-package:unknown"] == "ok" {
+		t.Fatalf("unexpected runs: %+v", history.Runs)
+	}
+}
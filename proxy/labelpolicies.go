@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The actions of the label policies.
+const (
+	// labelPolicyWarn logs the violations and adds a `Warning` header.
+	labelPolicyWarn = "warn"
+	// labelPolicyBlock rejects the manifests violating the policy.
+	labelPolicyBlock = "block"
+)
+
+const (
+	// licensesLabel is the label of the SPDX license expression of an image.
+	licensesLabel = "org.opencontainers.image.licenses"
+	// maxImageConfigSize is the maximum size of the image configs inspected
+	// by the label and age policies.
+	maxImageConfigSize = 1 << 20
+	// maxLabelViolations is the number of violations kept in memory for the
+	// admin API, the oldest being dropped.
+	maxLabelViolations = 1000
+	// maxCheckedLabels limits the number of digests whose checks are cached
+	// by the label and age policies.
+	maxCheckedLabels = 10000
+)
+
+var labelPolicyViolationsTotal = newCounterVec(
+	"label_policy_violations_total",
+	"Number of manifests pulled violating a label policy, by action (warn, block).",
+	"action",
+)
+
+// LabelPolicy checks the labels of the configs of the images of some
+// repositories, e.g. their license or the team owning them.
+type LabelPolicy struct {
+	// Repositories are the patterns of the repositories of the policy, e.g.
+	// `my-org/*`.
+	Repositories []string `json:"repositories"`
+	// Required are the labels that must be set, e.g. `team`.
+	Required []string `json:"required,omitempty"`
+	// Licenses are the patterns of the accepted SPDX licenses of the
+	// `org.opencontainers.image.licenses` label, which is then required.
+	Licenses []string `json:"licenses,omitempty"`
+	// DeniedLicenses are the patterns of the rejected SPDX licenses, e.g.
+	// `AGPL-*`.
+	DeniedLicenses []string `json:"denied_licenses,omitempty"`
+	// Action is taken on the violations: `warn` (default) or `block`.
+	Action string `json:"action,omitempty"`
+}
+
+func (policy LabelPolicy) validate() error {
+	if len(policy.Repositories) == 0 {
+		return fmt.Errorf("invalid label policy: no repositories")
+	}
+	switch policy.Action {
+	case "", labelPolicyWarn, labelPolicyBlock:
+	default:
+		return fmt.Errorf("invalid label policy: invalid action %q", policy.Action)
+	}
+	for _, patterns := range [][]string{policy.Repositories, policy.Licenses, policy.DeniedLicenses} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid label policy: invalid pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (policy LabelPolicy) action() string {
+	if policy.Action == "" {
+		return labelPolicyWarn
+	}
+	return policy.Action
+}
+
+// licenseAlternatives returns the alternatives of an SPDX license expression,
+// each with the licenses it requires, e.g. `[[MIT] [Apache-2.0 BSD-3-Clause]]`
+// for `MIT OR (Apache-2.0 AND BSD-3-Clause)`. The nested alternatives are
+// flattened, which is strict but enough for the expressions of the images.
+func licenseAlternatives(expression string) [][]string {
+	var alternatives [][]string
+	for _, alternative := range strings.Split(strings.NewReplacer("(", " ", ")", " ").Replace(expression), " OR ") {
+		var licenses []string
+		fields := strings.Fields(alternative)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "AND":
+			case "WITH":
+				// The exception applies to the previous license.
+				i++
+			default:
+				licenses = append(licenses, fields[i])
+			}
+		}
+		if len(licenses) > 0 {
+			alternatives = append(alternatives, licenses)
+		}
+	}
+	return alternatives
+}
+
+// violations returns the violations of the policy by the labels of an image.
+func (policy LabelPolicy) violations(labels map[string]string) []string {
+	var violations []string
+	for _, label := range policy.Required {
+		if labels[label] == "" {
+			violations = append(violations, fmt.Sprintf("missing label %s", label))
+		}
+	}
+
+	if len(policy.Licenses) == 0 && len(policy.DeniedLicenses) == 0 {
+		return violations
+	}
+	expression := labels[licensesLabel]
+	if expression == "" {
+		return append(violations, fmt.Sprintf("missing label %s", licensesLabel))
+	}
+	for _, licenses := range licenseAlternatives(expression) {
+		accepted := true
+		for _, license := range licenses {
+			if (len(policy.Licenses) > 0 && !matchesAny(policy.Licenses, license)) || (len(policy.DeniedLicenses) > 0 && matchesAny(policy.DeniedLicenses, license)) {
+				accepted = false
+			}
+		}
+		if accepted {
+			return violations
+		}
+	}
+	return append(violations, fmt.Sprintf("license %q not allowed", expression))
+}
+
+// LabelViolation is a manifest violating a label policy, returned by the
+// admin API.
+type LabelViolation struct {
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Action     string    `json:"action"`
+	Violations []string  `json:"violations"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+// labelPolicies are the label policies of a proxy, with the results of the
+// checks by digest and the last violations.
+type labelPolicies struct {
+	policies []LabelPolicy
+
+	mu         sync.Mutex
+	checked    map[string][]string
+	violations []LabelViolation
+}
+
+// WithLabelPolicies checks the labels of the images pulled from the
+// repositories of the policies, the first matching policy applying.
+func WithLabelPolicies(policies ...LabelPolicy) Option {
+	return func(p *containerProxy) {
+		for _, policy := range policies {
+			if err := policy.validate(); err != nil {
+				p.fail(err)
+			}
+		}
+		p.labelPolicies = &labelPolicies{policies: policies, checked: map[string][]string{}}
+	}
+}
+
+// policy returns the policy of a repository.
+func (l *labelPolicies) policy(name string) (LabelPolicy, bool) {
+	for _, policy := range l.policies {
+		for _, pattern := range policy.Repositories {
+			if matched, _ := path.Match(pattern, name); matched {
+				return policy, true
+			}
+		}
+	}
+	return LabelPolicy{}, false
+}
+
+func (l *labelPolicies) cached(key string) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	violations, ok := l.checked[key]
+	return violations, ok
+}
+
+// record caches the violations of a digest, which cannot change since the
+// labels are part of the image, and keeps them for the admin API.
+func (l *labelPolicies) record(key string, violation LabelViolation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.checked) >= maxCheckedLabels {
+		l.checked = map[string][]string{}
+	}
+	l.checked[key] = violation.Violations
+	if len(violation.Violations) == 0 {
+		return
+	}
+	l.violations = append(l.violations, violation)
+	if len(l.violations) > maxLabelViolations {
+		l.violations = l.violations[len(l.violations)-maxLabelViolations:]
+	}
+}
+
+// imageConfig is the subset of the config of an image checked by the
+// policies.
+type imageConfig struct {
+	Created time.Time `json:"created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// fetchImageConfig returns the config of an image manifest, and nil when the
+// manifest is not an image manifest (e.g. an index, whose platforms are
+// checked when they are pulled).
+func (p *containerProxy) fetchImageConfig(ctx context.Context, name, contentType string, body []byte) (*imageConfig, error) {
+	var m manifest
+	if classifyManifest(contentType, body) != manifestTypeImage || json.Unmarshal(body, &m) != nil || m.Config == nil {
+		return nil, nil
+	}
+	blob, _, err := p.registryClient.GetBlob(ctx, name, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	var config imageConfig
+	if err := json.NewDecoder(io.LimitReader(blob, maxImageConfigSize)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s: %w", m.Config.Digest, err)
+	}
+	return &config, nil
+}
+
+// checkLabels is a middleware checking the labels of the images pulled from
+// the repositories having a label policy. The violations are logged with a
+// `Warning` header, or rejected with the block action.
+func (p *containerProxy) checkLabels(next http.Handler) http.Handler {
+	match := func(r *http.Request) bool {
+		name, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			return false
+		}
+		_, ok = p.labelPolicies.policy(name)
+		return ok
+	}
+	return ResponseHook(match, func(r *http.Request, res *HookResponse) error {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		name, _, _, _ := splitRegistryPath(r.URL.Path)
+		policy, _ := p.labelPolicies.policy(name)
+		digest, _ := responseDigest(r.Method, res.Header, res.Body)
+
+		key := name + "@" + digest
+		violations, ok := p.labelPolicies.cached(key)
+		if !ok {
+			config, err := p.fetchImageConfig(r.Context(), name, res.Header.Get("Content-Type"), res.Body)
+			if err != nil {
+				if policy.action() == labelPolicyBlock {
+					return fmt.Errorf("cannot check the labels of %s@%s: %w", name, digest, err)
+				}
+				log.Printf("WARN labels of %s@%s not checked: %s", name, digest, err)
+				return nil
+			}
+			if config == nil {
+				return nil
+			}
+			violations = policy.violations(config.Config.Labels)
+			p.labelPolicies.record(key, LabelViolation{
+				Repository: p.prefixedName(name),
+				Digest:     digest,
+				Action:     policy.action(),
+				Violations: violations,
+				ObservedAt: time.Now().UTC(),
+			})
+		}
+		if len(violations) == 0 {
+			return nil
+		}
+
+		labelPolicyViolationsTotal.Inc(policy.action())
+		message := fmt.Sprintf("%s@%s violates the label policy: %s", name, digest, strings.Join(violations, ", "))
+		log.Printf("WARN %s", message)
+		if policy.action() == labelPolicyWarn {
+			res.Header.Add("Warning", `299 - `+strconv.Quote(message))
+			return nil
+		}
+		body, _ := json.Marshal(makeError(ERROR_DENIED, message))
+		res.StatusCode = http.StatusForbidden
+		res.Header.Set("Content-Type", "application/json")
+		res.Header.Del("Docker-Content-Digest")
+		res.Body = body
+		return nil
+	})(next)
+}
+
+// LabelViolations returns the last manifests pulled violating a label policy,
+// newest first.
+func (p *containerProxy) LabelViolations(w http.ResponseWriter, r *http.Request) {
+	log.Printf("LabelViolations Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	p.labelPolicies.mu.Lock()
+	violations := append([]LabelViolation{}, p.labelPolicies.violations...)
+	p.labelPolicies.mu.Unlock()
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].ObservedAt.After(violations[j].ObservedAt)
+	})
+
+	json.NewEncoder(w).Encode(struct {
+		Violations []LabelViolation `json:"violations"`
+	}{violations})
+}
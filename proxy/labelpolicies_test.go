@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLabelPolicyViolations(t *testing.T) {
+	policy := LabelPolicy{
+		Repositories:   []string{"*"},
+		Required:       []string{"team"},
+		Licenses:       []string{"MIT", "Apache-2.0", "BSD-*"},
+		DeniedLicenses: []string{"BSD-4-Clause"},
+	}
+	for _, tc := range []struct {
+		labels     map[string]string
+		violations int
+	}{
+		{labels: map[string]string{"team": "a", licensesLabel: "MIT"}, violations: 0},
+		{labels: map[string]string{"team": "a", licensesLabel: "GPL-3.0-only OR (Apache-2.0 AND BSD-3-Clause)"}, violations: 0},
+		{labels: map[string]string{"team": "a", licensesLabel: "Apache-2.0 WITH LLVM-exception"}, violations: 0},
+		{labels: map[string]string{"team": "a", licensesLabel: "MIT AND GPL-3.0-only"}, violations: 1},
+		{labels: map[string]string{"team": "a", licensesLabel: "BSD-4-Clause"}, violations: 1},
+		{labels: map[string]string{licensesLabel: "MIT"}, violations: 1},
+		{labels: nil, violations: 2},
+	} {
+		if violations := policy.violations(tc.labels); len(violations) != tc.violations {
+			t.Errorf("%v: expected %d violations, got: %v", tc.labels, tc.violations, violations)
+		}
+	}
+}
+
+func TestCheckLabels(t *testing.T) {
+	config := []byte(`{"config":{"Labels":{"org.opencontainers.image.licenses":"AGPL-3.0-only"}}}`)
+	image := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:c0f1","size":%d},"layers":[]}`, len(config)))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/some-owner/app/manifests/latest":
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Header().Set("Docker-Content-Digest", "sha256:1111")
+			w.Write(image)
+		case "/v2/some-owner/app/blobs/sha256:c0f1":
+			w.Write(config)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		action  string
+		status  int
+		warning bool
+	}{
+		{action: "", status: http.StatusOK, warning: true},
+		{action: labelPolicyBlock, status: http.StatusForbidden},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithLabelPolicies(
+			LabelPolicy{Repositories: []string{"other/*"}},
+			LabelPolicy{Repositories: []string{"some-owner/*"}, DeniedLicenses: []string{"AGPL-*"}, Action: tc.action},
+		), withTestAdmin())
+
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/v2/some-owner/app/manifests/latest", nil))
+		if res.Code != tc.status {
+			t.Fatalf("%q: expected status %d, got: %d", tc.action, tc.status, res.Code)
+		}
+		if warning := res.Header().Get("Warning") != ""; warning != tc.warning {
+			t.Fatalf("%q: unexpected Warning header: %q", tc.action, res.Header().Get("Warning"))
+		}
+
+		res = httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/admin/labels/violations", nil))
+		var response struct {
+			Violations []LabelViolation `json:"violations"`
+		}
+		json.NewDecoder(res.Body).Decode(&response)
+		if len(response.Violations) != 1 || response.Violations[0].Digest != "sha256:1111" || response.Violations[0].Action != (LabelPolicy{Action: tc.action}).action() {
+			t.Fatalf("%q: unexpected violations: %+v", tc.action, response.Violations)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	defaultLeaseName     = "container-registry-proxy"
+	defaultLeaseDuration = 15 * time.Second
+	defaultRetryPeriod   = 5 * time.Second
+
+	// Kubernetes MicroTime format.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	errKubeNotFound = errors.New("not found")
+	errKubeConflict = errors.New("conflict")
+)
+
+// LeaderElector tells whether the current replica should run the background
+// jobs. All the replicas serve traffic regardless of the election.
+type LeaderElector interface {
+	IsLeader() bool
+}
+
+// alwaysLeader is used when leader election is disabled, i.e. when a single
+// replica is deployed.
+type alwaysLeader struct{}
+
+func (alwaysLeader) IsLeader() bool {
+	return true
+}
+
+// kubeClient is a minimal Kubernetes API client.
+type kubeClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// newInClusterKubeClient returns a client configured with the service account
+// mounted in the pod.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &kubeClient{
+		baseURL: fmt.Sprintf("https://%s", net.JoinHostPort(host, port)),
+		token:   strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// inClusterNamespace returns the namespace of the pod.
+func inClusterNamespace() string {
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+func (c *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return errKubeNotFound
+	case res.StatusCode == http.StatusConflict:
+		return errKubeConflict
+	case res.StatusCode >= 300:
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, data)
+	}
+
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec leaseSpec `json:"spec"`
+}
+
+// leaseElector implements leader election with a coordination.k8s.io/v1 Lease,
+// like the client-go leaderelection package does.
+type leaseElector struct {
+	client        *kubeClient
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+	now           func() time.Time
+
+	leader atomic.Bool
+}
+
+func newLeaseElector(client *kubeClient, namespace, name, identity string) *leaseElector {
+	return &leaseElector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: defaultLeaseDuration,
+		retryPeriod:   defaultRetryPeriod,
+		now:           time.Now,
+	}
+}
+
+// IsLeader returns true when the current replica holds the lease.
+func (e *leaseElector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run tries to acquire or renew the lease periodically until ctx is done.
+func (e *leaseElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		leader, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			log.Printf("WARN leader election: %s", err)
+		}
+		if leader != e.leader.Swap(leader) {
+			if leader {
+				log.Printf("leader election: %s is now the leader", e.identity)
+			} else {
+				log.Printf("leader election: %s is no longer the leader", e.identity)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			e.leader.Store(false)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaseElector) leasePath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.namespace)
+}
+
+func (e *leaseElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := e.now()
+	nowStr := now.UTC().Format(microTimeFormat)
+	duration := int(e.leaseDuration.Seconds())
+
+	var current lease
+	err := e.client.do(ctx, "GET", e.leasePath()+"/"+e.name, nil, &current)
+	if errors.Is(err, errKubeNotFound) {
+		var l lease
+		l.APIVersion = "coordination.k8s.io/v1"
+		l.Kind = "Lease"
+		l.Metadata.Name = e.name
+		l.Metadata.Namespace = e.namespace
+		transitions := 0
+		l.Spec = leaseSpec{
+			HolderIdentity:       &e.identity,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &nowStr,
+			RenewTime:            &nowStr,
+			LeaseTransitions:     &transitions,
+		}
+		if err := e.client.do(ctx, "POST", e.leasePath(), &l, nil); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+
+	if holder != "" && holder != e.identity && !e.isExpired(current.Spec, now) {
+		return false, nil
+	}
+
+	if holder != e.identity {
+		transitions := 1
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions + 1
+		}
+		current.Spec.LeaseTransitions = &transitions
+		current.Spec.AcquireTime = &nowStr
+		current.Spec.HolderIdentity = &e.identity
+	}
+	current.Spec.RenewTime = &nowStr
+	current.Spec.LeaseDurationSeconds = &duration
+
+	// The resource version included in the lease makes the update fail with a
+	// conflict when another replica updated the lease in the meantime.
+	err = e.client.do(ctx, "PUT", e.leasePath()+"/"+e.name, &current, nil)
+	if errors.Is(err, errKubeConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (e *leaseElector) isExpired(spec leaseSpec, now time.Time) bool {
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	renewTime, err := time.Parse(microTimeFormat, *spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	return renewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// runLeaderJob calls fn every interval until ctx is done, but only when the
+// current replica is the leader.
+func runLeaderJob(ctx context.Context, elector LeaderElector, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !elector.IsLeader() {
+			continue
+		}
+		if err := fn(ctx); err != nil {
+			log.Printf("WARN job %s: %s", name, err)
+		}
+	}
+}
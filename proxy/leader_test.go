@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseServer stores a single lease and implements optimistic concurrency
+// with the resource version.
+func fakeLeaseServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	var stored *lease
+	version := 0
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case "GET":
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(stored)
+		case "POST", "PUT":
+			var l lease
+			json.NewDecoder(r.Body).Decode(&l)
+			if (r.Method == "POST" && stored != nil) || (r.Method == "PUT" && l.Metadata.ResourceVersion != strconv.Itoa(version)) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			version++
+			l.Metadata.ResourceVersion = strconv.Itoa(version)
+			stored = &l
+			json.NewEncoder(w).Encode(stored)
+		}
+	}))
+}
+
+func TestLeaseElector(t *testing.T) {
+	server := fakeLeaseServer(t)
+	defer server.Close()
+
+	client := &kubeClient{baseURL: server.URL, httpClient: server.Client()}
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	a := newLeaseElector(client, "default", "some-lease", "replica-a")
+	a.now = clock
+	b := newLeaseElector(client, "default", "some-lease", "replica-b")
+	b.now = clock
+
+	ctx := context.Background()
+
+	if leader, err := a.tryAcquireOrRenew(ctx); !leader || err != nil {
+		t.Fatalf("expected replica-a to acquire the lease, got: %t, %v", leader, err)
+	}
+	if leader, err := b.tryAcquireOrRenew(ctx); leader || err != nil {
+		t.Fatalf("expected replica-b not to acquire the lease, got: %t, %v", leader, err)
+	}
+	if leader, err := a.tryAcquireOrRenew(ctx); !leader || err != nil {
+		t.Fatalf("expected replica-a to renew the lease, got: %t, %v", leader, err)
+	}
+
+	// replica-a stops renewing the lease.
+	now = now.Add(2 * defaultLeaseDuration)
+
+	if leader, err := b.tryAcquireOrRenew(ctx); !leader || err != nil {
+		t.Fatalf("expected replica-b to take over the lease, got: %t, %v", leader, err)
+	}
+	if leader, err := a.tryAcquireOrRenew(ctx); leader || err != nil {
+		t.Fatalf("expected replica-a to lose the lease, got: %t, %v", leader, err)
+	}
+}
+
+type fakeElector bool
+
+func (e fakeElector) IsLeader() bool {
+	return bool(e)
+}
+
+func TestRunLeaderJob(t *testing.T) {
+	for _, leader := range []bool{true, false} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+		var mu sync.Mutex
+		runs := 0
+		runLeaderJob(ctx, fakeElector(leader), "some-job", 5*time.Millisecond, func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs++
+			return nil
+		})
+		cancel()
+
+		if leader && runs == 0 {
+			t.Fatal("expected the job to run on the leader")
+		}
+		if !leader && runs != 0 {
+			t.Fatalf("expected the job not to run, got: %d runs", runs)
+		}
+	}
+}
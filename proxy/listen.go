@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// healthcheckTimeout is the timeout of the `healthcheck` subcommand.
+	healthcheckTimeout = 5 * time.Second
+	// livenessPath is the path answered by the proxy itself while it serves,
+	// regardless of the upstream registries and of the authentication.
+	livenessPath = "/livez"
+)
+
+// listenAddrs returns the addresses the proxy listens on, given a
+// comma-separated list of hosts, e.g. `0.0.0.0,::`. The IPv6 addresses may be
+// bracketed, e.g. `[::1]`.
+func listenAddrs(hosts, port string) ([]string, error) {
+	var addrs []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if unbracketed, ok := strings.CutPrefix(host, "["); ok {
+			if host, ok = strings.CutSuffix(unbracketed, "]"); !ok {
+				return nil, fmt.Errorf("invalid host: %q", "["+unbracketed)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid host: empty host in %q", hosts)
+		}
+		if strings.Contains(host, ":") {
+			if _, err := netip.ParseAddr(host); err != nil {
+				return nil, fmt.Errorf("invalid host: %w", err)
+			}
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+// listenNetwork returns the network of a listen address. A single address
+// listens on all the address families it can, e.g. `::` accepts the IPv4
+// connections too (unless the system disables it), while each address of a
+// list only listens on its own family, so that `0.0.0.0` and `::` can be
+// listed together.
+func listenNetwork(addr string, single bool) string {
+	host, _, _ := net.SplitHostPort(addr)
+	ip, err := netip.ParseAddr(host)
+	if single || err != nil {
+		return "tcp"
+	}
+	if ip.Is4() {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// listen opens the listeners of the proxy.
+func listen(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := net.Listen(listenNetwork(addr, len(addrs) == 1), addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// serve serves the proxy on all its listeners, with TLS when certFile is set,
+// and returns the first error.
+func serve(server *http.Server, listeners []net.Listener, certFile, keyFile string) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if certFile != "" {
+				errs <- server.ServeTLS(listener, certFile, keyFile)
+				return
+			}
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+	return <-errs
+}
+
+// withLiveness answers the liveness probes before the other handlers, so that
+// they do not depend on the authentication, the IP filter or the upstream
+// registries, e.g. unreachable or answering with a server error.
+func withLiveness(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != livenessPath || (r.Method != "GET" && r.Method != "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// healthcheckURL returns the URL checking a listen address, the unspecified
+// addresses (e.g. `0.0.0.0` or `::`) being checked on the loopback address of
+// the same family.
+func healthcheckURL(addr string, useTLS bool) string {
+	host, port, _ := net.SplitHostPort(addr)
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip.Is6() {
+			host = "::1"
+		}
+	}
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + livenessPath
+}
+
+// runHealthcheckCommand runs the `healthcheck` subcommand, e.g. for the
+// `HEALTHCHECK` of a container, which checks that the proxy answers the
+// liveness probe on all the addresses of `HOST` and `PORT`.
+func runHealthcheckCommand(args []string) error {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: container-registry-proxy healthcheck")
+		os.Exit(2)
+	}
+	host := os.Getenv("HOST")
+	if host == "" {
+		host = defaultHost
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	addrs, err := listenAddrs(host, port)
+	if err != nil {
+		return err
+	}
+
+	useTLS := os.Getenv("TLS_CERT_FILE") != ""
+	client := &http.Client{Timeout: healthcheckTimeout}
+	// The certificate is issued for the public name of the proxy, not for
+	// the loopback addresses.
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok && useTLS {
+		transport = transport.Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = transport
+	}
+	for _, addr := range addrs {
+		target := healthcheckURL(addr, useTLS)
+		res, err := client.Get(target)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected status: %s", target, res.Status)
+		}
+		log.Printf("%s: %s", target, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListenAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		hosts    string
+		expected string
+		err      bool
+	}{
+		{hosts: "127.0.0.1", expected: "127.0.0.1:10000"},
+		{hosts: "::", expected: "[::]:10000"},
+		{hosts: "[::1]", expected: "[::1]:10000"},
+		{hosts: "fe80::1%eth0", expected: "[fe80::1%eth0]:10000"},
+		{hosts: "0.0.0.0, ::", expected: "0.0.0.0:10000 [::]:10000"},
+		{hosts: "localhost", expected: "localhost:10000"},
+		{hosts: "[::1", err: true},
+		{hosts: "::1::2", err: true},
+		{hosts: "0.0.0.0,", err: true},
+	} {
+		addrs, err := listenAddrs(tc.hosts, "10000")
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.hosts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.hosts, err)
+			continue
+		}
+		if actual := strings.Join(addrs, " "); actual != tc.expected {
+			t.Errorf("%s: expected: %s, got: %s", tc.hosts, tc.expected, actual)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		addr     string
+		single   bool
+		expected string
+	}{
+		{addr: "[::]:10000", single: true, expected: "tcp"},
+		{addr: "[::]:10000", expected: "tcp6"},
+		{addr: "0.0.0.0:10000", expected: "tcp4"},
+		{addr: "localhost:10000", expected: "tcp"},
+	} {
+		if actual := listenNetwork(tc.addr, tc.single); actual != tc.expected {
+			t.Errorf("%s: expected: %s, got: %s", tc.addr, tc.expected, actual)
+		}
+	}
+}
+
+func TestServeDualStack(t *testing.T) {
+	addrs, _ := listenAddrs("127.0.0.1,::1", "0")
+	listeners, err := listen(addrs)
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	// The liveness probe is answered before the authentication.
+	server := &http.Server{Handler: withLiveness(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))}
+	defer server.Close()
+	go serve(server, listeners, "", "")
+
+	for _, listener := range listeners {
+		res, err := http.Get(healthcheckURL(listener.Addr().String(), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status: %d", listener.Addr(), res.StatusCode)
+		}
+	}
+}
+
+func TestHealthcheckURL(t *testing.T) {
+	for _, tc := range []struct {
+		addr     string
+		useTLS   bool
+		expected string
+	}{
+		{addr: "0.0.0.0:10000", expected: "http://127.0.0.1:10000/livez"},
+		{addr: "[::]:10000", expected: "http://[::1]:10000/livez"},
+		{addr: "[::1]:10000", useTLS: true, expected: "https://[::1]:10000/livez"},
+		{addr: net.JoinHostPort("proxy.example.com", "443"), useTLS: true, expected: "https://proxy.example.com:443/livez"},
+	} {
+		if actual := healthcheckURL(tc.addr, tc.useTLS); actual != tc.expected {
+			t.Errorf("%s: expected: %s, got: %s", tc.addr, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaintenanceMessage is returned for the requests that cannot be
+	// served in maintenance mode when no message is configured.
+	defaultMaintenanceMessage = "the registry is in maintenance, only cached images can be pulled"
+	// defaultMaintenanceRetryAfter is the `Retry-After` of the requests
+	// rejected in maintenance mode.
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+	// maxMaintenanceRequestSize limits the size of the maintenance toggle
+	// requests.
+	maxMaintenanceRequestSize = 64 * 1024
+	// maxMaintenanceTags limits the number of tags of the cached manifests
+	// kept by a proxy without metadata database.
+	maxMaintenanceTags = 10000
+)
+
+var maintenanceRejectionsTotal = newCounterVec(
+	"maintenance_rejections_total",
+	"Number of requests rejected in maintenance mode, by route.",
+	"route",
+)
+
+// MaintenanceMode is the maintenance state of the proxy, shared by the
+// virtual registries. In maintenance, the manifests and blobs are only served
+// from the cache and the writes are rejected, e.g. during a migration of the
+// upstream registry. The proxies without maintenance state do not cache the
+// manifests and cannot be put in maintenance.
+type MaintenanceMode struct {
+	mu         sync.Mutex
+	enabled    bool
+	message    string
+	retryAfter time.Duration
+	since      time.Time
+
+	// tags are the digests of the tags whose manifests are cached, by
+	// `repository:tag`, for the proxies without metadata database.
+	tags map[string]string
+}
+
+// NewMaintenanceMode returns a maintenance state, disabled.
+func NewMaintenanceMode() *MaintenanceMode {
+	return &MaintenanceMode{tags: map[string]string{}}
+}
+
+// maintenanceStatus is the maintenance state returned by the admin API.
+type maintenanceStatus struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// RetryAfter is in seconds.
+	RetryAfter int        `json:"retry_after,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+// Set enables or disables the maintenance mode. The default message and
+// `Retry-After` are used when they are empty.
+func (m *MaintenanceMode) Set(enabled bool, message string, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enabled && !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled = enabled
+	m.message = message
+	m.retryAfter = retryAfter
+}
+
+func (m *MaintenanceMode) status() maintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.enabled {
+		return maintenanceStatus{}
+	}
+	status := maintenanceStatus{Enabled: true, Message: m.message, RetryAfter: int(m.retryAfter.Seconds())}
+	if status.Message == "" {
+		status.Message = defaultMaintenanceMessage
+	}
+	if status.RetryAfter == 0 {
+		status.RetryAfter = int(defaultMaintenanceRetryAfter.Seconds())
+	}
+	since := m.since
+	status.Since = &since
+	return status
+}
+
+func (m *MaintenanceMode) setTag(repository, tag, digest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := repository + ":" + tag
+	if _, ok := m.tags[key]; !ok && len(m.tags) >= maxMaintenanceTags {
+		// An arbitrary tag is dropped, its manifest being still served by
+		// digest.
+		for other := range m.tags {
+			delete(m.tags, other)
+			break
+		}
+	}
+	m.tags[key] = digest
+}
+
+func (m *MaintenanceMode) tag(repository, tag string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	digest, ok := m.tags[repository+":"+tag]
+	return digest, ok
+}
+
+// WithMaintenanceMode configures the maintenance state of the proxy, which is
+// toggled with the admin API.
+func WithMaintenanceMode(m *MaintenanceMode) Option {
+	return func(p *containerProxy) {
+		p.maintenance = m
+	}
+}
+
+// inMaintenance returns whether the proxy is in maintenance mode.
+func (p *containerProxy) inMaintenance() bool {
+	return p.maintenance != nil && p.maintenance.status().Enabled
+}
+
+// rejectInMaintenance returns the maintenance error, with a `Retry-After`
+// header.
+func rejectInMaintenance(w http.ResponseWriter, r *http.Request, status maintenanceStatus) {
+	maintenanceRejectionsTotal.Inc(requestRoute(r))
+	w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+	Veto(w, http.StatusServiceUnavailable, ERROR_UNAVAILABLE, status.Message)
+}
+
+// manifestDigest returns the digest of a cached manifest referenced by a tag
+// or a digest.
+func (p *containerProxy) manifestDigest(name, reference string) (string, bool) {
+	if strings.Contains(reference, ":") {
+		return reference, true
+	}
+	if digest, ok := p.maintenance.tag(p.prefixedName(name), reference); ok {
+		return digest, true
+	}
+	if p.metadata != nil {
+		if repository, ok := p.metadata.Repository(p.prefixedName(name)); ok {
+			digest, ok := repository.Tags[reference]
+			return digest, ok
+		}
+	}
+	return "", false
+}
+
+// cachedManifestMediaType returns the media type of a cached manifest, read
+// from the manifest.
+func cachedManifestMediaType(body []byte) string {
+	var manifest struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	json.Unmarshal(body, &manifest)
+	switch {
+	case manifest.MediaType != "":
+		return manifest.MediaType
+	case manifest.Manifests != nil:
+		return mediaTypeOCIIndex
+	default:
+		return mediaTypeOCIManifest
+	}
+}
+
+// serveCachedManifest serves a manifest from the blob cache, the media type
+// being read from the manifest. As for the blobs, the manifest is only served
+// to the clients that pulled it from the repository, see
+// cachedRepositoryKey, since the upstream registry cannot authorize them.
+func (p *containerProxy) serveCachedManifest(w http.ResponseWriter, r *http.Request, name, reference string) bool {
+	digest, ok := p.manifestDigest(name, reference)
+	if !ok || !p.blobCache.InRepository(digest, p.cachedRepositoryKey(r, name)) {
+		return false
+	}
+	f, info, err := p.blobCache.Open(digest)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	body, err := io.ReadAll(io.LimitReader(f, maxManifestSize))
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", cachedManifestMediaType(body))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, digest))
+	w.Header().Set(distributionAPIVersionHeader, distributionAPIVersion)
+	// ServeContent sets the `Content-Length` and handles HEAD.
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(body))
+	return true
+}
+
+// cacheManifest adds a manifest pulled from the upstream registry to the blob
+// cache, so that it can be served in maintenance mode to the client of the
+// request r.
+func (p *containerProxy) cacheManifest(r *http.Request, name, reference, contentDigest string, body []byte) {
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if (strings.Contains(reference, ":") && reference != digest) || (contentDigest != "" && contentDigest != digest) {
+		return
+	}
+
+	if !p.blobCache.Has(digest) {
+		writer, err := p.blobCache.Create(digest, int64(len(body)))
+		if err != nil {
+			log.Printf("WARN cannot cache manifest %s: %s", digest, err)
+			return
+		}
+		if _, err := writer.Write(body); err != nil {
+			writer.Abort()
+			log.Printf("WARN cannot cache manifest %s: %s", digest, err)
+			return
+		}
+		if err := writer.Commit(); err != nil {
+			log.Printf("WARN cannot cache manifest %s: %s", digest, err)
+			return
+		}
+	}
+	p.recordCachedRepository(r, name, digest)
+	if !strings.Contains(reference, ":") {
+		p.maintenance.setTag(p.prefixedName(name), reference, digest)
+	}
+}
+
+// maintenanceMode is a middleware serving the manifests and blobs from the
+// cache and rejecting the other registry requests (e.g. the pushes) with a
+// 503 in maintenance mode. Otherwise, the manifests pulled are added to the
+// blob cache, if any.
+func (p *containerProxy) maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") || r.URL.Path == "/v2/" || r.URL.Path == whoamiPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		read := r.Method == "GET" || r.Method == "HEAD"
+
+		status := p.maintenance.status()
+		if !status.Enabled {
+			if ok && kind == "manifests" && r.Method == "GET" && p.blobCache != nil {
+				tee := &teeResponseWriter{ResponseWriter: w, limit: maxManifestSize + 1}
+				next.ServeHTTP(tee, r)
+				if tee.statusCode == http.StatusOK && tee.buf.Len() <= maxManifestSize {
+					p.cacheManifest(r, name, reference, w.Header().Get("Docker-Content-Digest"), tee.buf.Bytes())
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case !read:
+			rejectInMaintenance(w, r, status)
+		case ok && kind == "manifests":
+			if p.blobCache == nil || !p.serveCachedManifest(w, r, name, reference) {
+				rejectInMaintenance(w, r, status)
+			}
+		case ok && kind == "blobs":
+			// The cached blobs are served by cacheBlobs, without asking the
+			// upstream registry.
+			if p.blobCache == nil || !p.blobCache.Has(reference) || !p.canReadCachedBlob(r) {
+				rejectInMaintenance(w, r, status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		default:
+			// The catalog and the tags are served by the backend.
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// maintenanceRequest toggles the maintenance mode.
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// RetryAfter is in seconds.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Maintenance returns the maintenance state of the proxy.
+func (p *containerProxy) Maintenance(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Maintenance Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.maintenance.status())
+}
+
+// SetMaintenance enables or disables the maintenance mode.
+func (p *containerProxy) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	log.Printf("SetMaintenance Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	var body maintenanceRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMaintenanceRequestSize)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid request: %s", err)))
+		return
+	}
+	if body.RetryAfter < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid retry_after: %d", body.RetryAfter)))
+		return
+	}
+
+	p.maintenance.Set(body.Enabled, body.Message, time.Duration(body.RetryAfter)*time.Second)
+	action := "maintenance-off"
+	if body.Enabled {
+		action = "maintenance-on"
+	}
+	log.Printf("%s: %s", action, body.Message)
+	p.audit(r, action, "proxy", body.Message)
+
+	json.NewEncoder(w).Encode(p.maintenance.status())
+}
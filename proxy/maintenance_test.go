@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	layer := []byte("some layer")
+	manifestBody := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `","layers":[]}`)
+	upstream := newFakeBlobRegistry(map[string][]byte{digestOf(layer): layer})
+	upstream.manifests = map[string][]byte{"latest": manifestBody}
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobCache(t.TempDir()), WithMaintenanceMode(NewMaintenanceMode()), withTestAdmin())
+
+	requestAs := func(authorization, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		return requestAs("Bearer good", method, path, body)
+	}
+
+	// The manifests and blobs pulled are cached.
+	if res := request("GET", "/v2/my-org/app/manifests/latest", ""); res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	if res := request("GET", "/v2/my-org/app/blobs/"+digestOf(layer), ""); res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+
+	res := request("PUT", "/admin/maintenance", `{"enabled":true,"message":"migrating to the new registry","retry_after":60}`)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"enabled":true`) {
+		t.Fatalf("unexpected response: %d %s", res.Code, res.Body.String())
+	}
+
+	before := len(upstream.Requests())
+	for _, path := range []string{"/v2/my-org/app/manifests/latest", "/v2/my-org/app/manifests/" + digestOf(manifestBody)} {
+		res = request("GET", path, "")
+		if res.Code != http.StatusOK || res.Body.String() != string(manifestBody) {
+			t.Fatalf("%s: unexpected response: %d %s", path, res.Code, res.Body.String())
+		}
+		if res.Header().Get("Content-Type") != mediaTypeOCIManifest || res.Header().Get("Docker-Content-Digest") != digestOf(manifestBody) ||
+			res.Header().Get("Content-Length") != fmt.Sprint(len(manifestBody)) || res.Header().Get("ETag") != `"`+digestOf(manifestBody)+`"` ||
+			res.Header().Get(distributionAPIVersionHeader) != distributionAPIVersion {
+			t.Fatalf("%s: unexpected headers: %v", path, res.Header())
+		}
+	}
+	if res = request("GET", "/v2/my-org/app/blobs/"+digestOf(layer), ""); res.Code != http.StatusOK || res.Body.String() != string(layer) {
+		t.Fatalf("unexpected response: %d %s", res.Code, res.Body.String())
+	}
+	// The clients that did not pull the cached manifests and blobs cannot
+	// read them, the upstream registry being unavailable.
+	for _, path := range []string{"/v2/my-org/app/manifests/latest", "/v2/my-org/app/manifests/" + digestOf(manifestBody), "/v2/my-org/app/blobs/" + digestOf(layer)} {
+		if res = requestAs("Bearer other", "GET", path, ""); res.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected: %d, got: %d", path, http.StatusServiceUnavailable, res.Code)
+		}
+	}
+	if requests := upstream.Requests()[before:]; len(requests) != 0 {
+		t.Fatalf("unexpected upstream requests: %v", requests)
+	}
+
+	// The cache misses and the writes are rejected.
+	for _, tc := range []struct{ method, path string }{
+		{method: "GET", path: "/v2/my-org/app/manifests/1.0.0"},
+		{method: "GET", path: "/v2/my-org/app/blobs/" + digestOf([]byte("other"))},
+		{method: "PUT", path: "/v2/my-org/app/manifests/latest"},
+		{method: "POST", path: "/v2/my-org/app/blobs/uploads/"},
+	} {
+		res = request(tc.method, tc.path, "")
+		if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") != "60" {
+			t.Fatalf("%s %s: unexpected response: %d", tc.method, tc.path, res.Code)
+		}
+		if !strings.Contains(res.Body.String(), `"code":"UNAVAILABLE","message":"migrating to the new registry"`) {
+			t.Fatalf("%s %s: unexpected error: %s", tc.method, tc.path, res.Body.String())
+		}
+	}
+
+	request("PUT", "/admin/maintenance", `{"enabled":false}`)
+	if res = request("GET", "/admin/maintenance", ""); strings.TrimSpace(res.Body.String()) != `{"enabled":false}` {
+		t.Fatalf("unexpected status: %s", res.Body.String())
+	}
+	if res = request("GET", "/v2/my-org/app/manifests/1.0.0", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+}
+
+func TestMaintenanceModeDisabled(t *testing.T) {
+	manifestBody := []byte(`{"schemaVersion":2,"mediaType":"` + mediaTypeOCIManifest + `","layers":[]}`)
+	upstream := newFakeBlobRegistry(map[string][]byte{})
+	upstream.manifests = map[string][]byte{"latest": manifestBody}
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobCache(dir))
+
+	req, _ := http.NewRequest("GET", "/v2/my-org/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	// The manifests are not cached without maintenance mode.
+	if cache.New(dir).Has(digestOf(manifestBody)) {
+		t.Fatal("expected the manifest not to be cached")
+	}
+
+	req = httptest.NewRequest("PUT", "/admin/maintenance", strings.NewReader(`{"enabled":true}`))
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code == http.StatusOK {
+		t.Fatal("expected no maintenance mode")
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIEmpty           = "application/vnd.oci.empty.v1+json"
+
+	mediaTypeBuildkitCacheConfig = "application/vnd.buildkit.cacheconfig.v0"
+	mediaTypeInToto              = "application/vnd.in-toto+json"
+
+	// maxManifestSize is the maximum size of the manifests inspected by the
+	// proxy, larger manifests are passed through without being inspected.
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+const (
+	manifestTypeImage         = "image"
+	manifestTypeIndex         = "index"
+	manifestTypeBuildkitCache = "buildkit-cache"
+	manifestTypeAttestation   = "attestation"
+	manifestTypeArtifact      = "artifact"
+	manifestTypeUnknown       = "unknown"
+)
+
+type descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	URLs         []string          `json:"urls,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *platform         `json:"platform,omitempty"`
+}
+
+// platform is the platform of a manifest of an index.
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// manifest contains the fields shared by image manifests and indexes.
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        *descriptor       `json:"config,omitempty"`
+	Layers        []descriptor      `json:"layers,omitempty"`
+	Manifests     []descriptor      `json:"manifests,omitempty"`
+	Subject       *descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// classifyManifest returns the type of a manifest, using the content type of
+// the request or response and the manifest itself.
+func classifyManifest(contentType string, body []byte) string {
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return manifestTypeUnknown
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+	}
+
+	switch mediaType {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		// Buildkit stores its cache in an index when `image-manifest=false`.
+		for _, layer := range m.Manifests {
+			if layer.MediaType == mediaTypeBuildkitCacheConfig {
+				return manifestTypeBuildkitCache
+			}
+		}
+		return manifestTypeIndex
+	case mediaTypeDockerManifest, mediaTypeOCIManifest:
+		if m.Config != nil && m.Config.MediaType == mediaTypeBuildkitCacheConfig {
+			return manifestTypeBuildkitCache
+		}
+		// Buildkit attestation manifests contain in-toto layers.
+		for _, layer := range m.Layers {
+			if layer.MediaType == mediaTypeInToto {
+				return manifestTypeAttestation
+			}
+		}
+		if m.ArtifactType != "" || (m.Config != nil && m.Config.MediaType != "application/vnd.docker.container.image.v1+json" && m.Config.MediaType != "application/vnd.oci.image.config.v1+json") {
+			return manifestTypeArtifact
+		}
+		return manifestTypeImage
+	}
+
+	return manifestTypeUnknown
+}
+
+var manifestsTotal = newCounterVec(
+	"manifests_total",
+	"Number of manifests pulled (GET) or pushed (PUT) through the proxy, by manifest type (image, index, buildkit-cache, attestation, artifact) and namespace.",
+	"method", "type", "namespace",
+)
+
+// teeResponseWriter keeps a copy of the first bytes written to the response.
+type teeResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	buf        bytes.Buffer
+	limit      int
+}
+
+func (w *teeResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *teeResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if remaining := w.limit - w.buf.Len(); remaining > 0 {
+		if len(b) < remaining {
+			remaining = len(b)
+		}
+		w.buf.Write(b[:remaining])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// manifestMetrics is a middleware counting the manifests pulled and pushed by
+// type and namespace. Manifests are passed through unmodified.
+func (p *containerProxy) manifestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || (r.Method != "GET" && r.Method != "PUT") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "PUT" {
+			if r.Body == nil {
+				r.Body = http.NoBody
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+			if err != nil {
+				Veto(w, http.StatusBadRequest, ERROR_MANIFEST_INVALID, err.Error())
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+			tee := &teeResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(tee, r)
+			if tee.statusCode/100 == 2 && len(body) <= maxManifestSize {
+				manifestsTotal.Inc(r.Method, classifyManifest(r.Header.Get("Content-Type"), body), p.metricNamespace(r))
+				digest, _ := responseDigest(r.Method, w.Header(), body)
+				p.publishEvent(r, Event{Type: eventPush, Repository: name, Reference: reference, Digest: digest, MediaType: r.Header.Get("Content-Type")})
+				p.recordTag(name, reference, digest, "push")
+			}
+			return
+		}
+
+		tee := &teeResponseWriter{ResponseWriter: w, limit: maxManifestSize}
+		next.ServeHTTP(tee, r)
+		if tee.statusCode == http.StatusOK {
+			manifestsTotal.Inc(r.Method, classifyManifest(w.Header().Get("Content-Type"), tee.buf.Bytes()), p.metricNamespace(r))
+			digest, _ := responseDigest(r.Method, w.Header(), tee.buf.Bytes())
+			p.publishEvent(r, Event{Type: eventPull, Repository: name, Reference: reference, Digest: digest, MediaType: w.Header().Get("Content-Type")})
+		}
+	})
+}
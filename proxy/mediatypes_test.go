@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+const (
+	buildkitCacheManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.buildkit.cacheconfig.v0","digest":"sha256:aaaa","size":123},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:bbbb","size":456}]}`
+	buildkitCacheIndex    = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:bbbb","size":456},{"mediaType":"application/vnd.buildkit.cacheconfig.v0","digest":"sha256:aaaa","size":123}]}`
+	attestationManifest   = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:cccc","size":167},"layers":[{"mediaType":"application/vnd.in-toto+json","digest":"sha256:dddd","size":1234,"annotations":{"in-toto.io/predicate-type":"https://slsa.dev/provenance/v0.2"}}]}`
+	imageManifest         = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:eeee","size":1000},"layers":[]}`
+	helmChartManifest     = `{"schemaVersion":2,"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json","digest":"sha256:ffff","size":100},"layers":[{"mediaType":"application/vnd.cncf.helm.chart.content.v1.tar+gzip","digest":"sha256:1111","size":2000}]}`
+)
+
+func TestClassifyManifest(t *testing.T) {
+	for _, tc := range []struct {
+		contentType  string
+		body         string
+		expectedType string
+	}{
+		{body: buildkitCacheManifest, expectedType: manifestTypeBuildkitCache},
+		{body: buildkitCacheIndex, expectedType: manifestTypeBuildkitCache},
+		{body: attestationManifest, expectedType: manifestTypeAttestation},
+		{body: imageManifest, expectedType: manifestTypeImage},
+		{contentType: mediaTypeOCIManifest, body: helmChartManifest, expectedType: manifestTypeArtifact},
+		{contentType: mediaTypeOCIIndex, body: `{"schemaVersion":2,"manifests":[]}`, expectedType: manifestTypeIndex},
+		{body: `not json`, expectedType: manifestTypeUnknown},
+	} {
+		if manifestType := classifyManifest(tc.contentType, []byte(tc.body)); manifestType != tc.expectedType {
+			t.Fatalf("expected: %s, got: %s for %s", tc.expectedType, manifestType, tc.body)
+		}
+	}
+}
+
+func TestBuildkitCachePassThrough(t *testing.T) {
+	var pushed []byte
+	var pushedContentType string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			pushed, _ = io.ReadAll(r.Body)
+			pushedContentType = r.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			if !strings.Contains(r.Header.Get("Accept"), mediaTypeOCIIndex) {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			w.Write([]byte(buildkitCacheIndex))
+		}
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+	)
+
+	before := manifestsTotal.Value("PUT", manifestTypeBuildkitCache, "some-owner")
+	req, _ := http.NewRequest("PUT", "/v2/some-owner/some-package/manifests/buildcache", strings.NewReader(buildkitCacheManifest))
+	req.Header.Set("Content-Type", mediaTypeOCIManifest)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected: %d, got: %d", http.StatusCreated, res.Code)
+	}
+	if !bytes.Equal(pushed, []byte(buildkitCacheManifest)) || pushedContentType != mediaTypeOCIManifest {
+		t.Fatalf("manifest altered: %s (%s)", pushed, pushedContentType)
+	}
+	if manifestsTotal.Value("PUT", manifestTypeBuildkitCache, "some-owner") != before+1 {
+		t.Fatal("expected the buildkit cache manifest to be counted")
+	}
+
+	before = manifestsTotal.Value("GET", manifestTypeBuildkitCache, "some-owner")
+	req, _ = http.NewRequest("GET", "/v2/some-owner/some-package/manifests/buildcache", nil)
+	req.Header.Set("Accept", strings.Join([]string{mediaTypeOCIManifest, mediaTypeOCIIndex}, ", "))
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	if res.Body.String() != buildkitCacheIndex || res.Header().Get("Content-Type") != mediaTypeOCIIndex {
+		t.Fatalf("manifest altered: %s (%s)", res.Body.String(), res.Header().Get("Content-Type"))
+	}
+	if manifestsTotal.Value("GET", manifestTypeBuildkitCache, "some-owner") != before+1 {
+		t.Fatal("expected the buildkit cache manifest to be counted")
+	}
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if !strings.Contains(res.Body.String(), `container_registry_proxy_manifests_total{method="GET",type="buildkit-cache",namespace="some-owner"}`) {
+		t.Fatalf("expected the metric to be exposed, got: %s", res.Body.String())
+	}
+}
+
+func TestSplitRegistryPath(t *testing.T) {
+	for _, tc := range []struct {
+		path              string
+		expectedName      string
+		expectedKind      string
+		expectedReference string
+		expectedOk        bool
+	}{
+		{path: "/v2/owner/name/manifests/latest", expectedName: "owner/name", expectedKind: "manifests", expectedReference: "latest", expectedOk: true},
+		{path: "/v2/a/b/c/blobs/sha256:1234", expectedName: "a/b/c", expectedKind: "blobs", expectedReference: "sha256:1234", expectedOk: true},
+		{path: "/v2/owner/name/blobs/uploads/1234", expectedOk: false},
+		{path: "/v2/owner/name/tags/list", expectedOk: false},
+		{path: "/v2/manifests/latest", expectedOk: false},
+	} {
+		name, kind, reference, ok := splitRegistryPath(tc.path)
+		if name != tc.expectedName || kind != tc.expectedKind || reference != tc.expectedReference || ok != tc.expectedOk {
+			t.Fatalf("%s: unexpected result: %s, %s, %s, %t", tc.path, name, kind, reference, ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+const (
+	// metadataFlushInterval is the interval between two writes of the pull
+	// statistics to the metadata database.
+	metadataFlushInterval = 10 * time.Second
+	// defaultAuditEventsLimit is the number of audit events returned by
+	// default by the /admin/audit endpoint.
+	defaultAuditEventsLimit = 100
+)
+
+// WithMetadataStore records the manifests pulled through the proxy and the
+// administrative actions in a metadata database.
+func WithMetadataStore(store *metadata.Store) Option {
+	return func(p *containerProxy) {
+		p.metadata = store
+	}
+}
+
+// recordPulls is a middleware recording the manifests pulled by the clients,
+// along with the digests of the tags.
+func (p *containerProxy) recordPulls(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tee := &teeResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(tee, r)
+		if tee.statusCode != http.StatusOK {
+			return
+		}
+
+		pull := metadata.Pull{
+			Repository: p.prefixedName(name),
+			Digest:     w.Header().Get("Docker-Content-Digest"),
+			MediaType:  w.Header().Get("Content-Type"),
+		}
+		if strings.Contains(reference, ":") {
+			pull.Digest = reference
+		} else {
+			pull.Tag = reference
+		}
+		if size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			pull.Size = size
+		}
+		p.metadata.RecordPull(pull)
+	})
+}
+
+// audit records an administrative action in the metadata database, if any.
+func (p *containerProxy) audit(r *http.Request, action, target, details string) {
+	if p.metadata == nil {
+		return
+	}
+
+	actor := "anonymous"
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		actor = identity.Method + ":" + identity.Subject
+	}
+	event := metadata.AuditEvent{
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	if err := p.metadata.Audit(event); err != nil {
+		log.Printf("WARN audit event %s %s not saved: %s", action, target, err)
+	}
+}
+
+// AuditLog returns the most recent administrative actions.
+func (p *containerProxy) AuditLog(w http.ResponseWriter, r *http.Request) {
+	log.Printf("AuditLog Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := defaultAuditEventsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, "invalid limit"))
+			return
+		}
+	}
+
+	response := struct {
+		Events []metadata.AuditEvent `json:"events"`
+	}{
+		Events: []metadata.AuditEvent{},
+	}
+	response.Events = append(response.Events, p.metadata.AuditEvents(limit)...)
+	json.NewEncoder(w).Encode(response)
+}
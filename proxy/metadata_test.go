@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestRecordPulls(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/unknown") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", "sha256:1234")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer upstream.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithMetadataStore(store), withTestAdmin())
+
+	for _, reference := range []string{"latest", "sha256:1234", "unknown"} {
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/"+reference, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+	}
+
+	repository, ok := store.Repository("some-owner/some-package")
+	if !ok {
+		t.Fatal("expected the repository to be recorded")
+	}
+	if repository.Pulls != 2 {
+		t.Fatalf("expected: %d, got: %d", 2, repository.Pulls)
+	}
+	if repository.Tags["latest"] != "sha256:1234" {
+		t.Fatalf("expected: %s, got: %s", "sha256:1234", repository.Tags["latest"])
+	}
+	if digest := repository.Digests["sha256:1234"]; digest == nil || digest.MediaType != "application/vnd.oci.image.manifest.v1+json" {
+		t.Fatalf("unexpected digest: %+v", digest)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			{ID: github.Int64(123), Name: github.String("sha256:1234")},
+		},
+	}
+	proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), "http://127.0.0.1/upstream", WithMetadataStore(store), withTestAdmin())
+
+	req, _ := http.NewRequest("DELETE", "/v2/some-owner/some-package/manifests/sha256:1234", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("expected: %d, got: %d", http.StatusAccepted, res.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/audit", nil)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	expected := `"actor":"anonymous","action":"delete","target":"some-owner/some-package","details":"sha256:1234"`
+	if !strings.Contains(res.Body.String(), expected) {
+		t.Fatalf("expected: %s, got: %s", expected, res.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/admin/audit?limit=invalid", nil)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %d, got: %d", http.StatusBadRequest, res.Code)
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsNamespace = "container_registry_proxy"
+
+// counterVec is a Prometheus counter partitioned by labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// metric is a metric exposed by the /metrics endpoint.
+type metric interface {
+	write(b *strings.Builder)
+}
+
+var (
+	metricsMu  sync.Mutex
+	allMetrics []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	allMetrics = append(allMetrics, m)
+}
+
+// newCounterVec creates and registers a counter exposed by the /metrics
+// endpoint.
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   fmt.Sprintf("%s_%s", metricsNamespace, name),
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	registerMetric(c)
+
+	return c
+}
+
+// Add increments the counter for the given label values by v.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+// Inc increments the counter for the given label values by 1.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the current value for the given label values.
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+// Each calls fn with the label values and the value of each counter.
+func (c *counterVec) Each(fn func(labelValues []string, v float64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, v := range c.values {
+		fn(strings.Split(key, "\xff"), v)
+	}
+}
+
+// formatLabels returns the `{name="value",...}` labels of a sample, extra
+// being added after the labels of the metric.
+func formatLabels(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+			}
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s%s %g\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+// gaugeVec is a Prometheus gauge partitioned by labels.
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newGaugeVec creates and registers a gauge exposed by the /metrics endpoint.
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{
+		name:   fmt.Sprintf("%s_%s", metricsNamespace, name),
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	registerMetric(g)
+
+	return g
+}
+
+// Set sets the gauge for the given label values to v.
+func (g *gaugeVec) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[strings.Join(labelValues, "\xff")] = v
+}
+
+// Value returns the current value for the given label values.
+func (g *gaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.values[strings.Join(labelValues, "\xff")]
+}
+
+func (g *gaugeVec) write(b *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(b, "# TYPE %s gauge\n", g.name)
+
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s%s %g\n", g.name, formatLabels(g.labels, key), g.values[key])
+	}
+}
+
+// histogramVec is a Prometheus histogram partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	// counts are the number of observations in each bucket, the last one
+	// being +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newHistogramVec creates and registers a histogram exposed by the /metrics
+// endpoint, buckets being the sorted upper bounds of the buckets.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    fmt.Sprintf("%s_%s", metricsNamespace, name),
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+	registerMetric(h)
+
+	return h
+}
+
+// Observe adds an observation for the given label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+// Quantile estimates the q-quantile of the observations for the given label
+// values, interpolating linearly within the buckets like the
+// histogram_quantile() function of Prometheus. It returns false without
+// observations.
+func (h *histogramVec) Quantile(q float64, labelValues ...string) (float64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[strings.Join(labelValues, "\xff")]
+	if !ok || hist.count == 0 {
+		return 0, false
+	}
+
+	rank := q * float64(hist.count)
+	var cumulative uint64
+	for i, count := range hist.counts {
+		if float64(cumulative+count) < rank || count == 0 {
+			cumulative += count
+			continue
+		}
+		if i == len(h.buckets) {
+			// The +Inf bucket: the highest finite bound is the best estimate.
+			return h.buckets[len(h.buckets)-1], true
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(count), true
+	}
+	return h.buckets[len(h.buckets)-1], true
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = fmt.Sprintf("%g", h.buckets[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", le), cumulative)
+		}
+		fmt.Fprintf(b, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key), hist.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), hist.count)
+	}
+}
+
+// Metrics exposes the metrics using the Prometheus text format.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	metrics := append([]metric{}, allMetrics...)
+	metricsMu.Unlock()
+
+	var b strings.Builder
+	for _, c := range metrics {
+		c.write(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	defaultDockerHubURL = "https://registry-1.docker.io"
+
+	distributionAPIVersionHeader = "Docker-Distribution-Api-Version"
+	distributionAPIVersion       = "registry/2.0"
+)
+
+// WithDockerMirror enables the Docker daemon registry-mirror compatibility
+// mode: the requests for official images (`library/<name>`) are sent to
+// Docker Hub, and the other requests are handled as usual.
+func WithDockerMirror(dockerHubURL *url.URL) Option {
+	return func(p *containerProxy) {
+		p.dockerHubURL = dockerHubURL
+	}
+}
+
+// dockerMirror is a middleware sending the requests for official Docker Hub
+// images to Docker Hub. dockerd normalizes the names of the official images
+// (e.g. `nginx` becomes `library/nginx`) before sending requests to a mirror.
+//
+// The proxy authenticates these requests itself because the clients get their
+// (bearer) tokens for the registry answering the `/v2/` probe, i.e. the default
+// upstream. They are anonymous unless credentials match Docker Hub.
+func dockerMirror(dockerHubURL *url.URL, credentials []UpstreamCredential) func(next http.Handler) http.Handler {
+	dockerHubProxy := newUpstreamProxy(dockerHubURL)
+	dockerHubProxy.Transport = &tokenTransport{credentials: credentials}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/v2/library/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			log.Printf("Docker Mirror %s %s -> %s", r.Method, r.URL, dockerHubURL)
+			dockerHubProxy.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiVersionCheck answers the `/v2/` probe sent by clients (and by dockerd to
+// its mirrors) with the upstream response, making sure the API version header
+// required by the specification is present.
+func apiVersionCheck(upstreamURL *url.URL) http.Handler {
+	upstreamProxy := newUpstreamProxy(upstreamURL)
+	upstreamProxy.ModifyResponse = func(res *http.Response) error {
+		if res.Header.Get(distributionAPIVersionHeader) == "" {
+			res.Header.Set(distributionAPIVersionHeader, distributionAPIVersion)
+		}
+		return nil
+	}
+
+	return upstreamProxy
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestDockerMirror(t *testing.T) {
+	ghcr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "ghcr %s", r.URL.Path)
+	}))
+	defer ghcr.Close()
+
+	var dockerHub *httptest.Server
+	dockerHub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:library/nginx:pull" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"token":"anonymous-token"}`)
+		case r.Header.Get("Authorization") != "Bearer anonymous-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.docker.io",scope="repository:library/nginx:pull"`, dockerHub.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			fmt.Fprintf(w, "docker-hub %s", r.URL.Path)
+		}
+	}))
+	defer dockerHub.Close()
+
+	dockerHubURL, _ := url.Parse(dockerHub.URL)
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		ghcr.URL,
+		WithDockerMirror(dockerHubURL),
+	)
+
+	for _, tc := range []struct {
+		path               string
+		authorization      string
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			path:               "/v2/library/nginx/manifests/latest",
+			expectedStatusCode: 200,
+			expectedContent:    "docker-hub /v2/library/nginx/manifests/latest",
+		},
+		{
+			// The client sends a token obtained from the default upstream.
+			path:               "/v2/library/nginx/manifests/latest",
+			authorization:      "Bearer ghcr-token",
+			expectedStatusCode: 200,
+			expectedContent:    "docker-hub /v2/library/nginx/manifests/latest",
+		},
+		{
+			path:               "/v2/some-owner/some-package/manifests/latest",
+			expectedStatusCode: 200,
+			expectedContent:    "ghcr /v2/some-owner/some-package/manifests/latest",
+		},
+		{
+			path:               "/v2/",
+			expectedStatusCode: 401,
+		},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, res.Body.String())
+		}
+		if tc.path == "/v2/" && res.Header().Get(distributionAPIVersionHeader) != distributionAPIVersion {
+			t.Fatalf("expected the API version header, got: %v", res.Header())
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:a/b:pull,push"`)
+
+	if scheme != "bearer" {
+		t.Fatalf("unexpected scheme: %s", scheme)
+	}
+	if params["realm"] != "https://ghcr.io/token" || params["service"] != "ghcr.io" || params["scope"] != "repository:a/b:pull,push" {
+		t.Fatalf("unexpected params: %v", params)
+	}
+}
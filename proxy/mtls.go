@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// certificateAuthenticator authenticates clients presenting a TLS certificate
+// signed by one of the client CAs.
+type certificateAuthenticator struct{}
+
+// Authenticate returns an identity whose subject is the common name of the
+// certificate (or its first SAN when it has no common name), and whose groups
+// are the organizations and organizational units of the certificate.
+func (certificateAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	// Certificates are only verified (and VerifiedChains set) when they are
+	// signed by one of the client CAs.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	subject := certificateSubject(cert)
+	if subject == "" {
+		return nil, errors.New("client certificate has no subject")
+	}
+
+	var groups []string
+	groups = append(groups, cert.Subject.Organization...)
+	groups = append(groups, cert.Subject.OrganizationalUnit...)
+
+	return &Identity{
+		Subject: subject,
+		Method:  "mtls",
+		Groups:  groups,
+	}, nil
+}
+
+func certificateSubject(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// LoadCertPool reads a PEM file containing one or more CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// WithClientCertificates enables the authentication of the clients presenting
+// a certificate signed by one of the CAs. The proxy must be served over TLS.
+// Clients without certificate can still use the other authenticators.
+func WithClientCertificates(clientCAs *x509.CertPool) Option {
+	return func(p *containerProxy) {
+		p.clientCAs = clientCAs
+		p.authenticators = append(p.authenticators, certificateAuthenticator{})
+	}
+}
+
+// tlsConfig returns the TLS configuration of the server, verifying the client
+// certificates when client CAs are configured.
+func (p *containerProxy) tlsConfig() *tls.Config {
+	if p.clientCAs == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		ClientCAs:  p.clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// clientWithCertificates returns a client trusting the test server, with its
+// own transport so that connections are not reused between certificates.
+func clientWithCertificates(server *httptest.Server, certificates []tls.Certificate) *http.Client {
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+	return &http.Client{Transport: transport}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca, caKey := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "some-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "edge-cluster", Organization: []string{"edge"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	otherCA, otherCAKey := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	otherClient, otherClientKey := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "edge-cluster", Organization: []string{"edge"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, otherCA, otherCAKey)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	rules, _ := ParseACL("edge=some-owner/*:pull")
+	settings := Settings{
+		Backend:     ghbackend.New(&githubClientMock{}, nil),
+		UpstreamURL: upstream.URL,
+		Options:     []Option{WithClientCertificates(clientCAs), WithACL(rules)},
+	}
+	// The handler alone cannot request the client certificates.
+	if _, err := New(settings); err == nil {
+		t.Fatal("expected an error")
+	}
+	proxy, err := NewServer("127.0.0.1:10000", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(proxy.Handler)
+	server.TLS = proxy.TLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name               string
+		certificates       []tls.Certificate
+		path               string
+		expectedStatusCode int
+	}{
+		{
+			name:               "no certificate",
+			path:               "/v2/some-owner/some-package/manifests/latest",
+			expectedStatusCode: 401,
+		},
+		{
+			name:               "valid certificate",
+			certificates:       []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+			path:               "/v2/some-owner/some-package/manifests/latest",
+			expectedStatusCode: 200,
+		},
+		{
+			name:               "denied repository",
+			certificates:       []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+			path:               "/v2/other-owner/some-package/manifests/latest",
+			expectedStatusCode: 403,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient := clientWithCertificates(server, tc.certificates)
+
+			res, err := httpClient.Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatalf("expected no error, got: %s", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.StatusCode)
+			}
+		})
+	}
+
+	// Certificates signed by another CA are not sent by the client, or rejected
+	// during the handshake.
+	httpClient := clientWithCertificates(server, []tls.Certificate{{Certificate: [][]byte{otherClient.Raw}, PrivateKey: otherClientKey}})
+	res, err := httpClient.Get(server.URL + "/v2/some-owner/some-package/manifests/latest")
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.StatusCode)
+		}
+	}
+}
+
+func TestCertificateSubject(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"edge.example.com"}}
+	if certificateSubject(cert) != "edge.example.com" {
+		t.Fatalf("expected: edge.example.com, got: %s", certificateSubject(cert))
+	}
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// notificationTimeout is the maximum duration of a call to a chat
+	// webhook.
+	notificationTimeout = 10 * time.Second
+	// githubRateLimitWarning is the ratio of the GitHub rate limit left under
+	// which a notification is sent.
+	githubRateLimitWarning = 0.1
+)
+
+// The events sent to the chat webhooks.
+const (
+	notifyNewTag    = "new-tag"
+	notifyDeletion  = "deletion"
+	notifyRateLimit = "rate-limit"
+)
+
+var notificationEvents = []string{notifyNewTag, notifyDeletion, notifyRateLimit}
+
+var notificationsTotal = newCounterVec(
+	"notifications_total",
+	"Number of notifications sent to the chat webhooks by sink and result.",
+	"sink", "result",
+)
+
+var (
+	githubRateLimit = newGaugeVec(
+		"github_rate_limit",
+		"Number of requests allowed per hour by the GitHub API rate limit, by resource (core, graphql, ...).",
+		"resource",
+	)
+	githubRateLimitRemaining = newGaugeVec(
+		"github_rate_limit_remaining",
+		"Number of requests left in the current window of the GitHub API rate limit, by resource.",
+		"resource",
+	)
+)
+
+// NotificationSink posts messages to the incoming webhooks of Slack and
+// Microsoft Teams for the selected events.
+type NotificationSink struct {
+	slackURL string
+	teamsURL string
+	events   map[string]bool
+}
+
+// NewNotificationSink returns a sink posting the given events (all of them
+// when empty) to the Slack and Teams webhooks, either of them being optional.
+func NewNotificationSink(slackURL, teamsURL string, events ...string) *NotificationSink {
+	if len(events) == 0 {
+		events = notificationEvents
+	}
+	s := &NotificationSink{slackURL: slackURL, teamsURL: teamsURL, events: map[string]bool{}}
+	for _, event := range events {
+		s.events[event] = true
+	}
+	return s
+}
+
+// ParseNotificationEvents parses a comma-separated list of notification
+// events.
+func ParseNotificationEvents(value string) ([]string, error) {
+	var events []string
+	for _, event := range strings.Split(value, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		valid := false
+		for _, known := range notificationEvents {
+			valid = valid || event == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid notification event %q, expected one of: %s", event, strings.Join(notificationEvents, ", "))
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// WithNotifications posts the events of the proxy with the sink.
+func WithNotifications(sink *NotificationSink) Option {
+	return func(p *containerProxy) {
+		p.notifications = sink
+	}
+}
+
+// notify posts a message in the background, if the event is selected. It can
+// be called on a nil sink.
+func (s *NotificationSink) notify(event, message string) {
+	if s == nil || !s.events[event] {
+		return
+	}
+
+	go func() {
+		if s.slackURL != "" {
+			s.post("slack", s.slackURL, map[string]string{"text": message})
+		}
+		if s.teamsURL != "" {
+			// The Adaptive Cards are accepted by the incoming webhooks and the
+			// Workflows of Teams.
+			s.post("teams", s.teamsURL, map[string]interface{}{
+				"type": "message",
+				"attachments": []map[string]interface{}{{
+					"contentType": "application/vnd.microsoft.card.adaptive",
+					"content": map[string]interface{}{
+						"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+						"type":    "AdaptiveCard",
+						"version": "1.4",
+						"body":    []map[string]interface{}{{"type": "TextBlock", "text": message, "wrap": true}},
+					},
+				}},
+			})
+		}
+	}()
+}
+
+func (s *NotificationSink) post(sink, url string, payload interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("WARN %s notification failed: %s", sink, err)
+		notificationsTotal.Inc(sink, "failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("WARN %s notification failed: %s", sink, err)
+		notificationsTotal.Inc(sink, "failed")
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("WARN %s notification failed: %s", sink, res.Status)
+		notificationsTotal.Inc(sink, "failed")
+		return
+	}
+	notificationsTotal.Inc(sink, "succeeded")
+}
+
+// notifyNewTags notifies the sink of new tags.
+func (s *NotificationSink) notifyNewTags(images []string) {
+	if len(images) == 1 {
+		s.notify(notifyNewTag, fmt.Sprintf("New tag published: %s", images[0]))
+		return
+	}
+	s.notify(notifyNewTag, fmt.Sprintf("%d new tags published: %s", len(images), strings.Join(images, ", ")))
+}
+
+// RateLimitTransport notifies a sink when the rate limit of the GitHub API is
+// nearly exhausted, once per rate limit window, based on the `X-RateLimit-*`
+// headers of the responses, which are also exposed as metrics. It records the
+// expiration of the token too.
+type RateLimitTransport struct {
+	Next http.RoundTripper
+	Sink *NotificationSink
+
+	mu sync.Mutex
+	// notifiedReset is the reset time of the window already notified.
+	notifiedReset string
+	// expiration is the expiration of the token, zero when it does not
+	// expire or is unknown.
+	expiration time.Time
+}
+
+// TokenExpiration returns the expiration of the GitHub token sent by the last
+// response, zero when it does not expire.
+func (t *RateLimitTransport) TokenExpiration() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expiration
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	res, err := next.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	// e.g. `2023-06-01 12:00:00 UTC` for the tokens having an expiration.
+	if value := res.Header.Get("GitHub-Authentication-Token-Expiration"); value != "" {
+		if expiration, err := time.Parse("2006-01-02 15:04:05 MST", value); err == nil {
+			t.mu.Lock()
+			t.expiration = expiration
+			t.mu.Unlock()
+		}
+	}
+
+	limit, err := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	if err != nil || limit <= 0 {
+		return res, nil
+	}
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return res, nil
+	}
+	resource := res.Header.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = "core"
+	}
+	githubRateLimit.Set(float64(limit), resource)
+	githubRateLimitRemaining.Set(float64(remaining), resource)
+	if float64(remaining) >= githubRateLimitWarning*float64(limit) {
+		return res, nil
+	}
+
+	reset := res.Header.Get("X-RateLimit-Reset")
+	t.mu.Lock()
+	notified := t.notifiedReset == reset
+	t.notifiedReset = reset
+	t.mu.Unlock()
+	if !notified {
+		message := fmt.Sprintf("GitHub API rate limit nearly exhausted: %d of %d requests left", remaining, limit)
+		if seconds, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			message += fmt.Sprintf(", reset at %s", time.Unix(seconds, 0).UTC().Format(time.RFC3339))
+		}
+		log.Printf("WARN %s", message)
+		t.Sink.notify(notifyRateLimit, message)
+	}
+	return res, nil
+}
+
+// imageReference returns the `name:tag` or `name@digest` reference of an
+// image.
+func imageReference(name, reference string) string {
+	if strings.Contains(reference, ":") {
+		return name + "@" + reference
+	}
+	return name + ":" + reference
+}
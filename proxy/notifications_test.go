@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationSink(t *testing.T) {
+	messages := make(chan string, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&payload)
+		messages <- "slack: " + payload.Text
+	}))
+	defer slack.Close()
+	teams := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Attachments []struct {
+				Content struct {
+					Body []struct{ Text string }
+				}
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		messages <- "teams: " + payload.Attachments[0].Content.Body[0].Text
+	}))
+	defer teams.Close()
+
+	events, err := ParseNotificationEvents("new-tag,rate-limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewNotificationSink(slack.URL, teams.URL, events...)
+	sink.notifyNewTags([]string{"some-org/some-image:1.2.3"})
+	sink.notify(notifyDeletion, "ignored")
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-messages:
+			received[message] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a message")
+		}
+	}
+	if !received["slack: New tag published: some-org/some-image:1.2.3"] || !received["teams: New tag published: some-org/some-image:1.2.3"] {
+		t.Fatalf("unexpected messages: %v", received)
+	}
+
+	// The rate limit is notified once per window.
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", r.URL.Query().Get("remaining"))
+		w.Header().Set("X-RateLimit-Reset", "1672531200")
+		w.Header().Set("GitHub-Authentication-Token-Expiration", "2023-06-01 12:00:00 UTC")
+	}))
+	defer github.Close()
+	transport := &RateLimitTransport{Sink: NewNotificationSink(slack.URL, "")}
+	client := &http.Client{Transport: transport}
+	for _, remaining := range []string{"1000", "400", "300"} {
+		res, err := client.Get(github.URL + "?remaining=" + remaining)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	select {
+	case message := <-messages:
+		if !strings.HasPrefix(message, "slack: GitHub API rate limit nearly exhausted: 400 of 5000 requests left") {
+			t.Fatalf("unexpected message: %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a message")
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected message: %s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if v := githubRateLimitRemaining.Value("core"); v != 300 {
+		t.Fatalf("expected 300 remaining requests, got: %v", v)
+	}
+	if expiration := transport.TokenExpiration(); !expiration.Equal(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected token expiration: %s", expiration)
+	}
+
+	if _, err := ParseNotificationEvents("new-tag,scan"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+)
+
+// defaultGroupsClaim is the claim used by most providers (Dex, Keycloak with a
+// group mapper, Azure AD) to list the groups of a user.
+const defaultGroupsClaim = "groups"
+
+// oidcAuthenticator authenticates clients sending an ID token issued by an
+// OpenID Connect provider, either as a bearer token or as the password of the
+// basic credentials (e.g. with `docker login`).
+type oidcAuthenticator struct {
+	verifier    *auth.Verifier
+	groupsClaim string
+}
+
+// NewOIDCAuthenticator returns an authenticator accepting the ID tokens of an
+// OpenID Connect provider, issued for audience (e.g. the client ID of the
+// proxy), which is required. The
+// groups of the clients are read from groupsClaim, which can be a dotted path
+// to a nested claim (e.g. `realm_access.roles` with Keycloak).
+func NewOIDCAuthenticator(issuer, audience, groupsClaim string) Authenticator {
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+	return &oidcAuthenticator{verifier: auth.NewVerifier(issuer, audience), groupsClaim: groupsClaim}
+}
+
+func (a *oidcAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if token == "" || strings.TrimSuffix(auth.UnverifiedIssuer(token), "/") != a.verifier.Issuer() {
+		return nil, nil
+	}
+
+	claims, err := a.verifier.Verify(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject: claims.String("sub"),
+		Method:  "oidc",
+		Groups:  claims.Lookup(a.groupsClaim),
+		Claims:  claims,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// paginate returns the page of a list of repositories or tags requested with
+// the `n` and `last` parameters of the distribution specification, and sets
+// the `Link` header pointing to the next page, e.g. for the crawlers like the
+// replication of Harbor. The paginated lists are sorted lexically, the other
+// parameters being kept in the link. It writes an error and returns false when
+// `n` is invalid.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) ([]string, bool) {
+	query := r.URL.Query()
+	if !query.Has("n") && !query.Has("last") {
+		return items, true
+	}
+
+	limit := len(items)
+	if query.Has("n") {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("n")); err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_PAGINATION_NUMBER_INVALID, "invalid number of results"))
+			return nil, false
+		}
+	}
+
+	page := append([]string{}, items...)
+	sort.Strings(page)
+	if last := query.Get("last"); last != "" {
+		page = page[sort.SearchStrings(page, last+"\x00"):]
+	}
+	if limit == 0 {
+		return []string{}, true
+	}
+	if len(page) > limit {
+		page = page[:limit]
+		query.Set("n", strconv.Itoa(limit))
+		query.Set("last", page[limit-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, query.Encode()))
+	}
+	return page, true
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// splitRegistryPath splits a `/v2/<name>/<kind>/<reference>` path, where kind
+// is either `manifests` or `blobs`. Repository names can contain slashes.
+func splitRegistryPath(path string) (name, kind, reference string, ok bool) {
+	if !strings.HasPrefix(path, "/v2/") {
+		return "", "", "", false
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+
+	for _, kind := range []string{"manifests", "blobs"} {
+		i := strings.LastIndex(path, "/"+kind+"/")
+		if i <= 0 {
+			continue
+		}
+		reference := path[i+len(kind)+2:]
+		if reference == "" || strings.Contains(reference, "/") {
+			continue
+		}
+		return path[:i], kind, reference, true
+	}
+
+	return "", "", "", false
+}
+
+// repositoryFromPath returns the name of the repository targeted by a registry
+// request, e.g. `/v2/<name>/tags/list` or `/v2/<name>/blobs/uploads/<uuid>`.
+func repositoryFromPath(path string) (string, bool) {
+	if name, _, _, ok := splitRegistryPath(path); ok {
+		return name, true
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		return "", false
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+
+	for _, suffix := range []string{"/tags/list", "/blobs/uploads/", "/referrers/"} {
+		if i := strings.Index(path, suffix); i > 0 {
+			return path[:i], true
+		}
+	}
+	if strings.HasSuffix(path, "/blobs/uploads") {
+		return strings.TrimSuffix(path, "/blobs/uploads"), true
+	}
+
+	return "", false
+}
+
+// repositoryNamePattern matches the repository names allowed by the OCI
+// distribution specification.
+var repositoryNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// peerLookupTimeout is the time given to the peers to tell whether they
+	// have a blob.
+	peerLookupTimeout = time.Second
+	// peerRefreshInterval is the interval between two resolutions of the
+	// peers discovered with DNS.
+	peerRefreshInterval = 30 * time.Second
+)
+
+var peerBlobRequestsTotal = newCounterVec(
+	"peer_blob_requests_total",
+	"Number of blob cache misses looked up on the peers by result (hit, miss, error).",
+	"result",
+)
+
+// errEmptyPeerSecret is returned when the peers are configured without
+// secret.
+var errEmptyPeerSecret = errors.New("the peers need a secret")
+
+// PeerSet is the list of the other replicas of the proxy sharing their blob
+// cache. The peers are either static or discovered with DNS, e.g. with the
+// headless service of a Kubernetes deployment.
+type PeerSet struct {
+	self   string
+	secret string
+	client *http.Client
+
+	// dnsName and port are set when the peers are discovered with DNS.
+	dnsName string
+	port    string
+	lookup  func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.RWMutex
+	peers []string
+}
+
+// NewStaticPeers returns the peers at the given URLs, e.g.
+// `http://10.0.0.2:10000`. self is the URL of the current replica, which is
+// ignored when it is listed.
+func NewStaticPeers(self string, urls []string, secret string) *PeerSet {
+	s := &PeerSet{self: strings.TrimSuffix(self, "/"), secret: secret, client: &http.Client{}}
+	for _, u := range urls {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+			s.peers = append(s.peers, u)
+		}
+	}
+	return s
+}
+
+// NewDNSPeers returns the peers whose addresses are the records of a DNS name
+// (`host:port`), resolved periodically once Run is called.
+func NewDNSPeers(self, hostport, secret string) (*PeerSet, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peers DNS name: %q", hostport)
+	}
+	if secret == "" {
+		return nil, errEmptyPeerSecret
+	}
+
+	return &PeerSet{
+		self:    strings.TrimSuffix(self, "/"),
+		secret:  secret,
+		client:  &http.Client{},
+		dnsName: host,
+		port:    port,
+		lookup:  net.DefaultResolver.LookupHost,
+	}, nil
+}
+
+// Run resolves the peers discovered with DNS until ctx is done.
+func (s *PeerSet) Run(ctx context.Context) {
+	if s.dnsName == "" {
+		return
+	}
+
+	for {
+		s.refresh(ctx)
+		if err := sleepContext(ctx, peerRefreshInterval); err != nil {
+			return
+		}
+	}
+}
+
+func (s *PeerSet) refresh(ctx context.Context) {
+	addrs, err := s.lookup(ctx, s.dnsName)
+	if err != nil {
+		log.Printf("WARN peers lookup %s failed: %s", s.dnsName, err)
+		return
+	}
+
+	var peers []string
+	for _, addr := range addrs {
+		peers = append(peers, "http://"+net.JoinHostPort(addr, s.port))
+	}
+	sort.Strings(peers)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = peers
+}
+
+// List returns the URLs of the peers, without the current replica.
+func (s *PeerSet) List() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var peers []string
+	for _, peer := range s.peers {
+		if peer != s.self {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// blobURL returns the URL of a blob cached by a peer, in the cache of a
+// virtual registry when tenant is not empty.
+func (s *PeerSet) blobURL(peer, tenant, digest string) string {
+	u := peer + "/internal/blobs/" + digest
+	if tenant != "" {
+		u += "?registry=" + url.QueryEscape(tenant)
+	}
+	return u
+}
+
+func (s *PeerSet) request(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.secret)
+	return s.client.Do(req)
+}
+
+// find returns the URL of a peer having a blob in its cache, asking all the
+// peers at once.
+func (s *PeerSet) find(ctx context.Context, tenant, digest string) (string, bool) {
+	peers := s.List()
+	if len(peers) == 0 {
+		return "", false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+	defer cancel()
+
+	found := make(chan string, len(peers))
+	for _, peer := range peers {
+		go func(u string) {
+			res, err := s.request(ctx, "HEAD", u)
+			if err != nil {
+				found <- ""
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				u = ""
+			}
+			found <- u
+		}(s.blobURL(peer, tenant, digest))
+	}
+
+	for range peers {
+		if u := <-found; u != "" {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// WithPeers shares the blob cache with the other replicas of the proxy: the
+// blobs missing in the cache are fetched from a peer having them before
+// falling back to the upstream registry. The peers need a secret.
+func WithPeers(peers *PeerSet) Option {
+	return func(p *containerProxy) {
+		if peers.secret == "" {
+			p.fail(errEmptyPeerSecret)
+			return
+		}
+		p.peers = peers
+	}
+}
+
+// fillBlobCacheFromPeer fetches a blob from a peer and adds it to the cache
+// while streaming it to the client. It returns false when nothing was sent to
+// the client, e.g. when no peer has the blob.
+func (p *containerProxy) fillBlobCacheFromPeer(w http.ResponseWriter, r *http.Request, digest string) bool {
+	u, ok := p.peers.find(r.Context(), p.tenant, digest)
+	if !ok {
+		peerBlobRequestsTotal.Inc("miss")
+		return false
+	}
+	// The peers don't know the clients.
+	if !p.canReadCachedBlob(r) {
+		return false
+	}
+
+	res, err := p.peers.request(r.Context(), "GET", u)
+	if err != nil {
+		peerBlobRequestsTotal.Inc("error")
+		log.Printf("WARN blob %s not fetched from peer: %s", digest, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		peerBlobRequestsTotal.Inc("error")
+		return false
+	}
+
+	peerBlobRequestsTotal.Inc("hit")
+	return p.copyBlobIntoCache(w, res, digest)
+}
+
+// PeerBlob serves a cached blob to a peer. The blobs that are not cached are
+// not fetched from the upstream registry. The requests are refused without
+// secret, which would let every client read the cache.
+func (p *containerProxy) PeerBlob(w http.ResponseWriter, r *http.Request) {
+	authorization := []byte(r.Header.Get("Authorization"))
+	if p.peers.secret == "" || subtle.ConstantTimeCompare(authorization, []byte("Bearer "+p.peers.secret)) != 1 {
+		Veto(w, http.StatusUnauthorized, ERROR_UNAUTHORIZED, "invalid peer secret")
+		return
+	}
+
+	blobs := p.blobCache
+	if tenant := r.URL.Query().Get("registry"); tenant != "" {
+		if !cache.IsValidDir(tenant) {
+			Veto(w, http.StatusBadRequest, ERROR_UNKNOWN, "invalid registry")
+			return
+		}
+		blobs = blobs.Sub(tenant)
+	}
+
+	digest := chi.URLParam(r, "digest")
+	f, info, err := blobs.Open(digest)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	serveCachedBlob(w, r, digest, f, info)
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestPeers(t *testing.T) {
+	content := []byte("some layer shared by the peers")
+	digest := digestOf(content)
+	upstream := newFakeBlobRegistry(map[string][]byte{digest: content})
+	defer upstream.Close()
+
+	var handlerA, handlerB http.Handler
+	serverA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerA.ServeHTTP(w, r) }))
+	defer serverA.Close()
+	serverB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerB.ServeHTTP(w, r) }))
+	defer serverB.Close()
+
+	peers := []string{serverA.URL, serverB.URL}
+	cacheA, cacheB := cache.New(t.TempDir()), cache.New(t.TempDir())
+	handlerA = NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(cacheA.Dir()),
+		WithPeers(NewStaticPeers(serverA.URL, peers, "some-secret")),
+	).Handler
+	handlerB = NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(cacheB.Dir()),
+		WithPeers(NewStaticPeers(serverB.URL, peers, "some-secret")),
+	).Handler
+
+	pull := func(handler http.Handler) {
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/"+digest, nil)
+		req.Header.Set("Authorization", "Bearer good")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+			t.Fatalf("expected the blob, got: %d", res.Code)
+		}
+	}
+
+	pull(handlerA)
+	pull(handlerB)
+
+	if !cacheB.Has(digest) {
+		t.Fatal("expected the blob to be cached by the second peer")
+	}
+	downloads := 0
+	for _, request := range upstream.Requests() {
+		if strings.HasPrefix(request, "GET /storage/") {
+			downloads++
+		}
+	}
+	if downloads != 1 {
+		t.Fatalf("expected: 1, got: %d", downloads)
+	}
+}
+
+func TestPeerBlob(t *testing.T) {
+	content := []byte("some layer")
+	digest := digestOf(content)
+	cache := cache.New(t.TempDir())
+	writer, _ := cache.Sub("team-a").Create(digest, int64(len(content)))
+	writer.Write(content)
+	writer.Commit()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		"https://ghcr.io",
+		WithBlobCache(cache.Dir()),
+		WithPeers(NewStaticPeers("", nil, "some-secret")),
+	)
+
+	for _, tc := range []struct {
+		authorization      string
+		path               string
+		expectedStatusCode int
+	}{
+		{authorization: "Bearer some-secret", path: "/internal/blobs/" + digest + "?registry=team-a", expectedStatusCode: http.StatusOK},
+		{authorization: "Bearer some-secret", path: "/internal/blobs/" + digest, expectedStatusCode: http.StatusNotFound},
+		{authorization: "Bearer some-secret", path: "/internal/blobs/" + digest + "?registry=..", expectedStatusCode: http.StatusBadRequest},
+		{authorization: "Bearer other-secret", path: "/internal/blobs/" + digest + "?registry=team-a", expectedStatusCode: http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Authorization", tc.authorization)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	// Without secret, the peers would read the cache of each other with an
+	// empty token, like every client.
+	if _, err := newProxy("127.0.0.1:10000", nil, "https://ghcr.io", WithBlobCache(cache.Dir()), WithPeers(NewStaticPeers("", nil, ""))); err == nil {
+		t.Fatal("expected an error without peer secret")
+	}
+	req, _ := http.NewRequest("GET", "/internal/blobs/"+digest, nil)
+	req.Header.Set("Authorization", "Bearer ")
+	res := httptest.NewRecorder()
+	(&containerProxy{peers: &PeerSet{}, blobCache: cache}).PeerBlob(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+}
+
+func TestDNSPeers(t *testing.T) {
+	peers, err := NewDNSPeers("http://10.0.0.1:10000", "proxy-headless.default.svc:10000", "some-secret")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	peers.lookup = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.2", "10.0.0.1"}, nil
+	}
+	peers.refresh(context.Background())
+
+	if expected := []string{"http://10.0.0.2:10000"}; !reflect.DeepEqual(peers.List(), expected) {
+		t.Fatalf("expected: %v, got: %v", expected, peers.List())
+	}
+
+	if _, err := NewDNSPeers("", "proxy-headless", "some-secret"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := NewDNSPeers("", "proxy-headless.default.svc:10000", ""); err == nil {
+		t.Fatal("expected an error without secret")
+	}
+}
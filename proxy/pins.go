@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pinDriftWebhookTimeout is the maximum duration of a call to the drift
+// webhook.
+const pinDriftWebhookTimeout = 10 * time.Second
+
+var (
+	pinnedDigestDriftsTotal = newCounterVec(
+		"pinned_digest_drifts_total",
+		"Number of manifest fetches of a pinned tag pointing to another digest upstream by image.",
+		"image",
+	)
+
+	sha256DigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// DigestPin pins a tag to the digest it is expected to point to, e.g. the
+// base images of the builds.
+type DigestPin struct {
+	// Image is the `name:tag` reference of the pinned tag.
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// Enforce serves the pinned digest when the tag points to another digest
+	// upstream, instead of only alerting.
+	Enforce bool `json:"enforce,omitempty"`
+}
+
+func (pin DigestPin) validate() error {
+	_, reference, err := parseImageReference(pin.Image)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(reference, ":") || strings.Contains(pin.Image, "@") {
+		return fmt.Errorf("invalid pin: %q is not a tag", pin.Image)
+	}
+	if !sha256DigestPattern.MatchString(pin.Digest) {
+		return fmt.Errorf("invalid pin of %s: invalid digest %q", pin.Image, pin.Digest)
+	}
+	return nil
+}
+
+// WithDigestPins verifies the digests of the pinned tags on each manifest
+// fetch.
+func WithDigestPins(pins ...DigestPin) Option {
+	return func(p *containerProxy) {
+		if p.digestPins == nil {
+			p.digestPins = map[string]DigestPin{}
+		}
+		for _, pin := range pins {
+			if err := pin.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			name, tag, _ := parseImageReference(pin.Image)
+			p.digestPins[name+":"+tag] = pin
+		}
+	}
+}
+
+// WithPinDriftWebhook notifies a URL when a pinned tag points to another
+// digest upstream.
+func WithPinDriftWebhook(url string) Option {
+	return func(p *containerProxy) {
+		p.pinDriftWebhook = url
+	}
+}
+
+// pinDrift is the payload of the drift webhook.
+type pinDrift struct {
+	Image    string    `json:"image"`
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Served   string    `json:"served"`
+	Time     time.Time `json:"time"`
+}
+
+// reportPinDrift logs, counts and notifies a drift.
+func (p *containerProxy) reportPinDrift(drift pinDrift) {
+	pinnedDigestDriftsTotal.Inc(drift.Image)
+	log.Printf("ALERT pinned tag %s points to %s upstream instead of %s (served: %s)", drift.Image, drift.Actual, drift.Expected, drift.Served)
+
+	if p.pinDriftWebhook == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(p.background(), pinDriftWebhookTimeout)
+		defer cancel()
+
+		body, _ := json.Marshal(drift)
+		req, err := http.NewRequestWithContext(ctx, "POST", p.pinDriftWebhook, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("WARN drift webhook failed: %s", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("WARN drift webhook failed: %s", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			log.Printf("WARN drift webhook failed: %s", res.Status)
+		}
+	}()
+}
+
+// sendTo sends a buffered response to the client.
+func (w *bufferedResponseWriter) sendTo(dst http.ResponseWriter) {
+	for key, values := range w.header {
+		dst.Header()[key] = values
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	dst.WriteHeader(w.statusCode)
+	dst.Write(w.body.Bytes())
+}
+
+// responseDigest returns the digest of a manifest response. It returns false
+// when the digest is unknown, i.e. for a HEAD response without digest.
+func responseDigest(method string, header http.Header, body []byte) (string, bool) {
+	if digest := header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, true
+	}
+	if method == "HEAD" {
+		return "", false
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), true
+}
+
+// checkDigestPins is a middleware verifying the digests of the pinned tags
+// when their manifests are fetched, before their transforms. When a pin is
+// enforced, the manifest of the pinned digest is served instead of the
+// upstream one.
+func (p *containerProxy) checkDigestPins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || (r.Method != "GET" && r.Method != "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pin, ok := p.digestPins[name+":"+reference]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, upstream := withUpstreamDigest(r.Context())
+		if !pin.Enforce {
+			tee := &teeResponseWriter{ResponseWriter: w, limit: maxManifestSize}
+			next.ServeHTTP(tee, r.WithContext(ctx))
+			if tee.statusCode != http.StatusOK {
+				return
+			}
+			if served, ok := responseDigest(r.Method, w.Header(), tee.buf.Bytes()); ok && upstream.or(served) != pin.Digest {
+				p.reportPinDrift(pinDrift{Image: pin.Image, Expected: pin.Digest, Actual: upstream.or(served), Served: served, Time: time.Now().UTC()})
+			}
+			return
+		}
+
+		buf := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(buf, r.WithContext(ctx))
+		if buf.statusCode != http.StatusOK {
+			buf.sendTo(w)
+			return
+		}
+		digest, ok := responseDigest(r.Method, buf.header, buf.body.Bytes())
+		digest = upstream.or(digest)
+		if !ok || digest == pin.Digest {
+			buf.sendTo(w)
+			return
+		}
+
+		p.reportPinDrift(pinDrift{Image: pin.Image, Expected: pin.Digest, Actual: digest, Served: pin.Digest, Time: time.Now().UTC()})
+		pinned := r.Clone(r.Context())
+		pinned.URL.Path = "/v2/" + name + "/manifests/" + pin.Digest
+		pinned.URL.RawPath = ""
+		pinned.RequestURI = ""
+		next.ServeHTTP(w, pinned)
+	})
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestPins(t *testing.T) {
+	pinnedManifest := []byte(`{"schemaVersion":2,"layers":[{"digest":"sha256:good"}]}`)
+	hijackedManifest := []byte(`{"schemaVersion":2,"layers":[{"digest":"sha256:evil"}]}`)
+	pinnedDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(pinnedManifest))
+	hijackedDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(hijackedManifest))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manifest := hijackedManifest
+		if strings.HasSuffix(r.URL.Path, "/manifests/"+pinnedDigest) {
+			manifest = pinnedManifest
+		}
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)))
+		w.Write(manifest)
+	}))
+	defer upstream.Close()
+
+	drifts := make(chan pinDrift, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var drift pinDrift
+		json.NewDecoder(r.Body).Decode(&drift)
+		drifts <- drift
+	}))
+	defer webhook.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithDigestPins(
+			DigestPin{Image: "library/alpine:3.18", Digest: pinnedDigest},
+			DigestPin{Image: "library/debian:12", Digest: pinnedDigest, Enforce: true},
+		),
+		WithPinDriftWebhook(webhook.URL),
+	)
+
+	for _, tc := range []struct {
+		image          string
+		expectedDigest string
+	}{
+		// The drift is only reported.
+		{image: "library/alpine:3.18", expectedDigest: hijackedDigest},
+		// The pinned digest is served.
+		{image: "library/debian:12", expectedDigest: pinnedDigest},
+	} {
+		name, tag, _ := parseImageReference(tc.image)
+		before := pinnedDigestDriftsTotal.Value(tc.image)
+
+		req, _ := http.NewRequest("GET", "/v2/"+name+"/manifests/"+tag, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.image, http.StatusOK, res.Code)
+		}
+		if digest := res.Header().Get("Docker-Content-Digest"); digest != tc.expectedDigest {
+			t.Fatalf("%s: expected: %s, got: %s", tc.image, tc.expectedDigest, digest)
+		}
+		if value := pinnedDigestDriftsTotal.Value(tc.image); value != before+1 {
+			t.Fatalf("%s: expected: %g, got: %g", tc.image, before+1, value)
+		}
+
+		select {
+		case drift := <-drifts:
+			if drift.Image != tc.image || drift.Expected != pinnedDigest || drift.Actual != hijackedDigest || drift.Served != tc.expectedDigest {
+				t.Fatalf("%s: unexpected drift: %+v", tc.image, drift)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected the webhook to be called", tc.image)
+		}
+	}
+
+	// The tags that are not pinned are not checked.
+	req, _ := http.NewRequest("GET", "/v2/library/alpine/manifests/latest", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	select {
+	case drift := <-drifts:
+		t.Fatalf("unexpected drift: %+v", drift)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDigestPinsTransformed(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(manifest)
+	}))
+	defer upstream.Close()
+
+	transformed := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"transformed":"true"}}`)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(transformed)
+	}))
+	defer service.Close()
+
+	patterns, _ := ParseImmutableTags("v*")
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithManifestTransforms(ManifestTransform{Name: "annotate", URL: service.URL}),
+		WithDigestPins(DigestPin{Image: "library/debian:v12", Digest: digest, Enforce: true}),
+		WithImmutableTags(patterns...),
+	)
+
+	// The upstream digest is checked, the clients getting the transformed
+	// manifest.
+	before, drifts := pinnedDigestDriftsTotal.Value("library/debian:v12"), immutableTagDriftsTotal.Value()
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/v2/library/debian/manifests/v12", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		if res.Code != http.StatusOK || res.Body.String() != string(transformed) {
+			t.Fatalf("unexpected response: %d %s", res.Code, res.Body.String())
+		}
+	}
+	if value := pinnedDigestDriftsTotal.Value("library/debian:v12"); value != before {
+		t.Fatalf("expected no pin drift, got: %g", value-before)
+	}
+	if value := immutableTagDriftsTotal.Value(); value != drifts {
+		t.Fatalf("expected no immutable tag drift, got: %g", value-drifts)
+	}
+}
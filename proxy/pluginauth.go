@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend/plugin"
+)
+
+const (
+	methodPlugin = "plugin"
+
+	// pluginPolicyTimeout is the timeout of the authorizations of a policy
+	// plugin.
+	pluginPolicyTimeout = 5 * time.Second
+)
+
+// pluginAuthenticator authenticates the clients with an auth plugin.
+type pluginAuthenticator struct {
+	plugin *plugin.Backend
+}
+
+// NewPluginAuthenticator returns an authenticator asking an auth plugin for
+// the identity of the clients.
+func NewPluginAuthenticator(p *plugin.Backend) Authenticator {
+	return &pluginAuthenticator{plugin: p}
+}
+
+func (a *pluginAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	identity, err := a.plugin.Authenticate(r.Context(), plugin.AuthRequest{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Header:     r.Header.Clone(),
+		RemoteAddr: r.RemoteAddr,
+	})
+	if err != nil || identity == nil {
+		return nil, err
+	}
+	return &Identity{Subject: identity.Subject, Method: methodPlugin, Groups: identity.Groups}, nil
+}
+
+// WithPolicyPlugin authorizes the actions of the authenticated clients with a
+// policy plugin, instead of the ACL. The actions are denied when the plugin
+// fails.
+func WithPolicyPlugin(p *plugin.Backend) Option {
+	return func(proxy *containerProxy) {
+		// The plugin decides which clients are admins.
+		proxy.adminGranted = true
+		proxy.authorize = func(identity *Identity, name, action string) bool {
+			if identity == nil {
+				return false
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pluginPolicyTimeout)
+			defer cancel()
+			allowed, err := p.Authorize(ctx, plugin.Identity{Subject: identity.Subject, Groups: identity.Groups}, name, action)
+			if err != nil {
+				log.Printf("WARN policy plugin: %s", err)
+				return false
+			}
+			return allowed
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// defaultBlobPrefetchConcurrency is the number of blobs prefetched at once.
+	defaultBlobPrefetchConcurrency = 4
+	// blobPrefetchTimeout is the maximum duration of the prefetch of a blob.
+	blobPrefetchTimeout = 30 * time.Minute
+)
+
+var blobPrefetchesTotal = newCounterVec(
+	"blob_prefetches_total",
+	"Number of blobs prefetched into the cache by result (fetched, failed).",
+	"result",
+)
+
+// blobPrefetcher limits the number of blobs prefetched at once, and makes
+// sure that a blob is not prefetched twice at the same time. It is shared by
+// the virtual registries.
+type blobPrefetcher struct {
+	sem chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newBlobPrefetcher(concurrency int) *blobPrefetcher {
+	if concurrency <= 0 {
+		concurrency = defaultBlobPrefetchConcurrency
+	}
+	return &blobPrefetcher{
+		sem:      make(chan struct{}, concurrency),
+		inflight: map[string]bool{},
+	}
+}
+
+// start returns false when the blob identified by key is already prefetched.
+func (b *blobPrefetcher) start(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inflight[key] {
+		return false
+	}
+	b.inflight[key] = true
+	return true
+}
+
+func (b *blobPrefetcher) done(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.inflight, key)
+}
+
+// WithBlobPrefetch prefetches the blobs of the image manifests pulled through
+// the proxy into the blob cache, with up to concurrency blobs fetched at once.
+func WithBlobPrefetch(concurrency int) Option {
+	prefetcher := newBlobPrefetcher(concurrency)
+	return func(p *containerProxy) {
+		p.prefetcher = prefetcher
+	}
+}
+
+// discardResponseWriter is the response writer of the background requests.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
+
+// prefetchBlob adds a blob of a repository to the cache in the background,
+// with the credentials of the request r.
+func (p *containerProxy) prefetchBlob(r *http.Request, name, digest string) {
+	key := p.blobCache.Path(digest)
+	if p.blobCache.Has(digest) || !p.prefetcher.start(key) {
+		return
+	}
+
+	// The prefetch outlives the request of the client.
+	ctx, cancel := context.WithTimeout(p.background(), blobPrefetchTimeout)
+	req := r.Clone(ctx)
+	req.Method = "GET"
+	req.URL.Path = "/v2/" + name + "/blobs/" + digest
+	req.URL.RawPath = ""
+	req.Header.Del("Range")
+
+	go func() {
+		defer cancel()
+		defer p.prefetcher.done(key)
+
+		select {
+		case p.prefetcher.sem <- struct{}{}:
+			defer func() { <-p.prefetcher.sem }()
+		case <-ctx.Done():
+			blobPrefetchesTotal.Inc("failed")
+			return
+		}
+
+		// The client may have pulled the blob in the meantime.
+		flight, leader := p.blobCache.StartFlight(digest)
+		if !leader {
+			return
+		}
+		defer p.blobCache.EndFlight(digest, flight)
+		if p.blobCache.Has(digest) {
+			return
+		}
+		p.fillBlobCache(&discardResponseWriter{header: http.Header{}}, p.blobClient, req, digest)
+		if p.blobCache.Has(digest) {
+			blobPrefetchesTotal.Inc("fetched")
+		} else {
+			blobPrefetchesTotal.Inc("failed")
+		}
+	}()
+}
+
+// prefetchBlobs is a middleware prefetching the config and layers of the image
+// manifests pulled by the clients, which request them right after the
+// manifest.
+func (p *containerProxy) prefetchBlobs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tee := &teeResponseWriter{ResponseWriter: w, limit: maxManifestSize}
+		next.ServeHTTP(tee, r)
+		if tee.statusCode != http.StatusOK {
+			return
+		}
+
+		for _, blob := range manifestBlobs(tee.buf.Bytes()) {
+			p.prefetchBlob(r, name, blob.Digest)
+		}
+		if p.mirrorSignatures {
+			p.prefetchSignatures(name, manifestDigest(reference, w.Header().Get("Docker-Content-Digest"), tee.buf.Bytes()))
+		}
+	})
+}
+
+// manifestBlobs returns the config and layers of an image manifest that can be
+// cached. Foreign layers are not served by the registry, and the manifests of
+// an index are pulled (and prefetched) separately.
+func manifestBlobs(body []byte) []descriptor {
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil
+	}
+
+	candidates := m.Layers
+	if m.Config != nil {
+		candidates = append([]descriptor{*m.Config}, candidates...)
+	}
+	var blobs []descriptor
+	for _, blob := range candidates {
+		if len(blob.URLs) == 0 && cache.IsCacheableDigest(blob.Digest) {
+			blobs = append(blobs, blob)
+		}
+	}
+
+	return blobs
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestPrefetchBlobs(t *testing.T) {
+	config := []byte(`{"architecture":"amd64"}`)
+	layer := []byte("some layer")
+	foreignLayer := []byte("some foreign layer")
+	upstream := newFakeBlobRegistry(map[string][]byte{
+		digestOf(config):       config,
+		digestOf(layer):        layer,
+		digestOf(foreignLayer): foreignLayer,
+	})
+	upstream.manifests = map[string][]byte{
+		"latest": []byte(fmt.Sprintf(`{
+			"schemaVersion": 2,
+			"mediaType": %q,
+			"config": {"mediaType": %q, "digest": %q},
+			"layers": [
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": %q},
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": %q, "urls": ["https://example.com/layer"]}
+			]
+		}`, mediaTypeOCIManifest, mediaTypeOCIImageConfig, digestOf(config), digestOf(layer), digestOf(foreignLayer))),
+	}
+	defer upstream.Close()
+
+	cache := cache.New(t.TempDir())
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(cache.Dir()),
+		WithBlobPrefetch(2),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cache.Has(digestOf(config)) || !cache.Has(digestOf(layer)) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the config and the layer to be prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.Has(digestOf(foreignLayer)) {
+		t.Fatal("expected the foreign layer not to be prefetched")
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxPrefetchRequestSize is the maximum size of the body of a prefetch request.
+const maxPrefetchRequestSize = 1024 * 1024
+
+// PrefetchSchedule is a list of images warmed into the blob cache at the times
+// of a cron schedule, e.g. ahead of a deployment window.
+type PrefetchSchedule struct {
+	Schedule string   `json:"schedule"`
+	Images   []string `json:"images"`
+}
+
+// WithPrefetchSchedules warms the images of the schedules into the blob cache.
+func WithPrefetchSchedules(schedules ...PrefetchSchedule) Option {
+	return func(p *containerProxy) {
+		p.prefetchSchedules = append(p.prefetchSchedules, schedules...)
+	}
+}
+
+// parseImageReference splits a `name:tag` or `name@digest` reference. The tag
+// defaults to `latest`.
+func parseImageReference(ref string) (name, reference string, err error) {
+	if name, digest, ok := strings.Cut(ref, "@"); ok {
+		if name == "" || !strings.Contains(digest, ":") {
+			return "", "", fmt.Errorf("invalid image reference: %q", ref)
+		}
+		return name, digest, nil
+	}
+
+	name, reference = ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, reference = ref[:i], ref[i+1:]
+	}
+	if name == "" || reference == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return "", "", fmt.Errorf("invalid image reference: %q", ref)
+	}
+
+	return name, reference, nil
+}
+
+// preloadImage adds the blobs of an image (of all its platforms) to the cache,
+// with the credentials of the proxy. Manifests are not cached by the proxy and
+// are only fetched to find the blobs. It returns the number of blobs fetched.
+func (p *containerProxy) preloadImage(ctx context.Context, ref string) (int, error) {
+	name, reference, err := parseImageReference(ref)
+	if err != nil {
+		return 0, err
+	}
+
+	body, contentType, digest, err := p.registryClient.GetManifest(ctx, name, reference)
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	if p.mirrorSignatures {
+		// Unsigned images are not prefetched when signatures are required.
+		if fetched, err = p.preloadSignatures(ctx, name, manifestDigest(reference, digest, body)); err != nil {
+			return fetched, err
+		}
+	}
+
+	manifests := [][]byte{body}
+	if classifyManifest(contentType, body) == manifestTypeIndex {
+		var index manifest
+		if err := json.Unmarshal(body, &index); err != nil {
+			return 0, err
+		}
+		manifests = nil
+		for _, child := range index.Manifests {
+			body, _, _, err := p.registryClient.GetManifest(ctx, name, child.Digest)
+			if err != nil {
+				return 0, err
+			}
+			manifests = append(manifests, body)
+		}
+	}
+
+	var errs []error
+	for _, body := range manifests {
+		for _, blob := range manifestBlobs(body) {
+			if p.blobCache.Has(blob.Digest) {
+				continue
+			}
+			if err := p.preloadBlob(ctx, name, blob.Digest); err != nil {
+				return fetched, err
+			}
+			if !p.blobCache.Has(blob.Digest) {
+				errs = append(errs, fmt.Errorf("blob %s of %s not cached", blob.Digest, ref))
+				continue
+			}
+			fetched++
+		}
+	}
+
+	return fetched, errors.Join(errs...)
+}
+
+// preloadBlob adds a blob to the cache with the credentials of the proxy,
+// unless it is already fetched by another request.
+func (p *containerProxy) preloadBlob(ctx context.Context, name, digest string) error {
+	flight, leader := p.blobCache.StartFlight(digest)
+	if !leader {
+		// Wait for the other request.
+		flight.WaitDone()
+		return nil
+	}
+	defer p.blobCache.EndFlight(digest, flight)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "/v2/"+name+"/blobs/"+digest, nil)
+	if err != nil {
+		return err
+	}
+	p.fillBlobCache(&discardResponseWriter{header: http.Header{}}, p.registryClient.httpClient, req, digest)
+	return nil
+}
+
+// preloadImages warms a list of images into the cache. The outcome of each
+// image is recorded in run, if any.
+func (p *containerProxy) preloadImages(ctx context.Context, refs []string, run *jobRun) error {
+	var errs []error
+	for _, ref := range refs {
+		fetched, err := p.preloadImage(ctx, ref)
+		run.outcome(ref, err)
+		p.publishReplication(ref, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("prefetch %s: %w", ref, err))
+		}
+		log.Printf("prefetched %d blobs of %s", fetched, ref)
+	}
+
+	return errors.Join(errs...)
+}
+
+// runPrefetchSchedules starts the scheduled prefetches.
+func (p *containerProxy) runPrefetchSchedules(ctx context.Context) {
+	for i, prefetch := range p.prefetchSchedules {
+		schedule, err := ParseCronSchedule(prefetch.Schedule)
+		if err != nil {
+			log.Printf("WARN prefetch schedule ignored: %s", err)
+			continue
+		}
+		images := prefetch.Images
+		name := fmt.Sprintf("prefetch-%d", i+1)
+		go runCronJob(ctx, p.leader, p.jobs, name, schedule, func(ctx context.Context, run *jobRun) error {
+			return p.preloadImages(ctx, images, run)
+		})
+	}
+}
+
+type prefetchRequest struct {
+	Images []string `json:"images"`
+}
+
+// Prefetch warms a list of images into the blob cache in the background.
+func (p *containerProxy) Prefetch(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Prefetch Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	var body prefetchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPrefetchRequestSize)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, fmt.Sprintf("invalid request: %s", err)))
+		return
+	}
+	if len(body.Images) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, "no images to prefetch"))
+		return
+	}
+	for _, ref := range body.Images {
+		if _, _, err := parseImageReference(ref); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNKNOWN, err.Error()))
+			return
+		}
+	}
+
+	p.audit(r, "prefetch", strings.Join(body.Images, ","), "")
+
+	// The prefetch outlives the request.
+	go func() {
+		err := p.jobs.run(p.background(), "prefetch", func(ctx context.Context, run *jobRun) error {
+			return p.preloadImages(ctx, body.Images, run)
+		})
+		if err != nil {
+			log.Printf("WARN %s", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(body)
+}
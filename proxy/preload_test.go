@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestParseImageReference(t *testing.T) {
+	for _, tc := range []struct {
+		ref               string
+		expectedName      string
+		expectedReference string
+	}{
+		{ref: "owner/name", expectedName: "owner/name", expectedReference: "latest"},
+		{ref: "owner/name:1.2.3", expectedName: "owner/name", expectedReference: "1.2.3"},
+		{ref: "owner/name@sha256:abc", expectedName: "owner/name", expectedReference: "sha256:abc"},
+	} {
+		name, reference, err := parseImageReference(tc.ref)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tc.ref, err)
+		}
+		if name != tc.expectedName || reference != tc.expectedReference {
+			t.Fatalf("%s: expected: %s %s, got: %s %s", tc.ref, tc.expectedName, tc.expectedReference, name, reference)
+		}
+	}
+
+	for _, ref := range []string{"", ":latest", "owner/name:", "owner/name@", "/name"} {
+		if _, _, err := parseImageReference(ref); err == nil {
+			t.Fatalf("expected an error for %q", ref)
+		}
+	}
+}
+
+func TestPrefetchAPI(t *testing.T) {
+	amd64Layer := []byte("some amd64 layer")
+	arm64Layer := []byte("some arm64 layer")
+	upstream := newFakeBlobRegistry(map[string][]byte{
+		digestOf(amd64Layer): amd64Layer,
+		digestOf(arm64Layer): arm64Layer,
+	})
+	defer upstream.Close()
+
+	imageManifest := func(layer []byte) []byte {
+		return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"layers":[{"digest":%q}]}`, mediaTypeOCIManifest, digestOf(layer)))
+	}
+	amd64Manifest, arm64Manifest := imageManifest(amd64Layer), imageManifest(arm64Layer)
+	upstream.manifests = map[string][]byte{
+		"1.0.0": []byte(fmt.Sprintf(
+			`{"schemaVersion":2,"mediaType":%q,"manifests":[{"digest":%q},{"digest":%q}]}`,
+			mediaTypeOCIIndex, digestOf(amd64Manifest), digestOf(arm64Manifest),
+		)),
+		digestOf(amd64Manifest): amd64Manifest,
+		digestOf(arm64Manifest): arm64Manifest,
+	}
+
+	cache := cache.New(t.TempDir())
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithBlobCache(cache.Dir()),
+		WithUpstreamCredentials("some-user", "some-token"),
+		withTestAdmin(),
+	)
+
+	for _, tc := range []struct {
+		body         string
+		expectedCode int
+	}{
+		{body: `{`, expectedCode: http.StatusBadRequest},
+		{body: `{"images":[]}`, expectedCode: http.StatusBadRequest},
+		{body: `{"images":["owner/name:"]}`, expectedCode: http.StatusBadRequest},
+		{body: `{"images":["some-owner/some-package:1.0.0"]}`, expectedCode: http.StatusAccepted},
+	} {
+		req := httptest.NewRequest("POST", "/admin/prefetch", strings.NewReader(tc.body))
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		if res.Code != tc.expectedCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.body, tc.expectedCode, res.Code)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cache.Has(digestOf(amd64Layer)) || !cache.Has(digestOf(arm64Layer)) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the layers of all the platforms to be prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f, _, err := cache.Open(digestOf(arm64Layer))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer f.Close()
+	var content bytes.Buffer
+	content.ReadFrom(f)
+	if content.String() != string(arm64Layer) {
+		t.Fatalf("expected: %s, got: %s", arm64Layer, content.String())
+	}
+}
+
+func TestPrefetchAPIRequiresAdminAccess(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	rules, _ := ParseACL("ops=*:admin;developers=*:pull")
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		"https://ghcr.io",
+		WithBlobCache(t.TempDir()),
+		WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", "")),
+		WithACL(rules),
+	)
+
+	for _, tc := range []struct {
+		groups             []string
+		expectedStatusCode int
+	}{
+		{groups: []string{"developers"}, expectedStatusCode: http.StatusForbidden},
+		// The request is authorized, but invalid.
+		{groups: []string{"ops"}, expectedStatusCode: http.StatusBadRequest},
+	} {
+		idToken := provider.Sign(t, map[string]interface{}{"groups": tc.groups})
+		req := httptest.NewRequest("POST", "/admin/prefetch", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+idToken)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%v: expected: %d, got: %d", tc.groups, tc.expectedStatusCode, res.Code)
+		}
+	}
+
+	// Anonymous clients are asked to authenticate.
+	req := httptest.NewRequest("POST", "/admin/prefetch", strings.NewReader(`{}`))
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+}
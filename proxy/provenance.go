@@ -0,0 +1,643 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+const (
+	// provenanceCacheTTL is how long the provenance verifications are cached
+	// by digest.
+	provenanceCacheTTL = time.Hour
+	// provenanceFailureTTL is how long the failed verifications are cached,
+	// in case the attestations are pushed after the image.
+	provenanceFailureTTL = time.Minute
+	// maxCachedProvenance limits the number of verifications cached by a
+	// proxy.
+	maxCachedProvenance = 10000
+	// maxAttestationSize is the maximum size of an attestation blob.
+	maxAttestationSize = 4 << 20
+
+	mediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+	// mediaTypeSigstoreBundle is the prefix of the media types of the
+	// Sigstore bundles, e.g. `application/vnd.dev.sigstore.bundle.v0.3+json`
+	// for the attestations of GitHub Actions.
+	mediaTypeSigstoreBundle = "application/vnd.dev.sigstore.bundle"
+
+	// slsaProvenancePrefix is the prefix of the predicate types of the SLSA
+	// provenances, e.g. `https://slsa.dev/provenance/v1`.
+	slsaProvenancePrefix = "https://slsa.dev/provenance/"
+)
+
+// The statuses of the provenance verifications.
+const (
+	provenanceVerified = "verified"
+	provenanceFailed   = "failed"
+	provenanceMissing  = "missing"
+)
+
+var provenanceVerificationsTotal = newCounterVec(
+	"provenance_verifications_total",
+	"Number of provenance verifications of the manifests pulled by result (verified, failed, missing, error).",
+	"result",
+)
+
+// ProvenancePolicy requires the images of some repositories to have a SLSA
+// provenance attestation from the given builders and source repositories.
+type ProvenancePolicy struct {
+	// Repositories are the patterns of the repositories of the policy, e.g.
+	// `my-org/*`.
+	Repositories []string `json:"repositories"`
+	// Builders are the patterns of the accepted builder IDs, any builder
+	// when empty.
+	Builders []string `json:"builders,omitempty"`
+	// SourceRepositories are the patterns of the accepted source
+	// repositories, e.g. `https://github.com/my-org/*`, any repository when
+	// empty.
+	SourceRepositories []string `json:"source_repositories,omitempty"`
+	// Enforce denies the pulls of the manifests failing the verification,
+	// which are only logged otherwise.
+	Enforce bool `json:"enforce,omitempty"`
+}
+
+func (policy ProvenancePolicy) validate() error {
+	if len(policy.Repositories) == 0 {
+		return fmt.Errorf("invalid provenance policy: no repositories")
+	}
+	for _, patterns := range [][]string{policy.Repositories, policy.Builders, policy.SourceRepositories} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid provenance policy: invalid pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAny returns true when a value matches one of the patterns, or when
+// there are no patterns.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return len(patterns) == 0
+}
+
+type cachedProvenance struct {
+	result    metadata.ProvenanceResult
+	expiresAt time.Time
+}
+
+// provenanceVerifier verifies the provenance attestations of the manifests
+// against the policies, and caches the results by digest.
+type provenanceVerifier struct {
+	policies []ProvenancePolicy
+	// roots verify the certificates of the signatures of the attestations,
+	// which are not verified when nil.
+	roots *x509.CertPool
+
+	mu      sync.Mutex
+	results map[string]cachedProvenance
+}
+
+// WithProvenancePolicies verifies the SLSA provenance attestations of the
+// manifests pulled from the repositories of the policies, the first matching
+// policy applying. The signatures of the attestations are verified against
+// the root certificates, if any, e.g. the roots of Sigstore.
+func WithProvenancePolicies(roots *x509.CertPool, policies ...ProvenancePolicy) Option {
+	return func(p *containerProxy) {
+		for _, policy := range policies {
+			if err := policy.validate(); err != nil {
+				p.fail(err)
+			}
+		}
+		p.provenance = &provenanceVerifier{policies: policies, roots: roots, results: map[string]cachedProvenance{}}
+	}
+}
+
+// policy returns the policy of a repository.
+func (v *provenanceVerifier) policy(name string) (ProvenancePolicy, bool) {
+	for _, policy := range v.policies {
+		for _, pattern := range policy.Repositories {
+			if matched, _ := path.Match(pattern, name); matched {
+				return policy, true
+			}
+		}
+	}
+	return ProvenancePolicy{}, false
+}
+
+func (v *provenanceVerifier) cached(key string) (metadata.ProvenanceResult, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	cached, ok := v.results[key]
+	if !ok || time.Now().After(cached.expiresAt) {
+		return metadata.ProvenanceResult{}, false
+	}
+	return cached.result, true
+}
+
+func (v *provenanceVerifier) store(key string, result metadata.ProvenanceResult) {
+	ttl := provenanceCacheTTL
+	if result.Status != provenanceVerified {
+		ttl = provenanceFailureTTL
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if len(v.results) >= maxCachedProvenance {
+		for k, cached := range v.results {
+			if now.After(cached.expiresAt) {
+				delete(v.results, k)
+			}
+		}
+	}
+	if len(v.results) < maxCachedProvenance {
+		v.results[key] = cachedProvenance{result: result, expiresAt: now.Add(ttl)}
+	}
+}
+
+// inherit caches the verification of an index for the manifests of its
+// platforms, which are pulled by digest afterwards and whose attestations are
+// usually attached to the index.
+func (v *provenanceVerifier) inherit(name, digest string, body []byte, result metadata.ProvenanceResult) {
+	var index manifest
+	if json.Unmarshal(body, &index) != nil {
+		return
+	}
+	result.Index = digest
+	for _, m := range index.Manifests {
+		v.store(name+"@"+m.Digest, result)
+	}
+}
+
+// dsseEnvelope is a DSSE envelope, whose payload is an in-toto statement.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     []byte `json:"payload"`
+	Signatures  []struct {
+		Sig []byte `json:"sig"`
+	} `json:"signatures"`
+}
+
+// sigstoreBundle is the subset of a Sigstore bundle containing an
+// attestation.
+type sigstoreBundle struct {
+	VerificationMaterial struct {
+		Certificate *struct {
+			RawBytes []byte `json:"rawBytes"`
+		} `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []struct {
+				RawBytes []byte `json:"rawBytes"`
+			} `json:"certificates"`
+		} `json:"x509CertificateChain"`
+	} `json:"verificationMaterial"`
+	DSSEEnvelope *dsseEnvelope `json:"dsseEnvelope"`
+}
+
+// inTotoStatement is an in-toto statement.
+type inTotoStatement struct {
+	Subject []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// slsaProvenance has the fields of the v0.2 and v1 SLSA provenances checked by
+// the policies.
+type slsaProvenance struct {
+	// v1
+	BuildDefinition struct {
+		ExternalParameters struct {
+			Workflow struct {
+				Repository string `json:"repository"`
+			} `json:"workflow"`
+		} `json:"externalParameters"`
+		ResolvedDependencies []struct {
+			URI string `json:"uri"`
+		} `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+
+	// v0.2
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	Invocation struct {
+		ConfigSource struct {
+			URI string `json:"uri"`
+		} `json:"configSource"`
+	} `json:"invocation"`
+}
+
+func (s slsaProvenance) builderID() string {
+	if s.RunDetails.Builder.ID != "" {
+		return s.RunDetails.Builder.ID
+	}
+	return s.Builder.ID
+}
+
+// sourceRepository returns the URL of the source repository, e.g.
+// `https://github.com/my-org/app` for `git+https://github.com/my-org/app@refs/heads/main`.
+func (s slsaProvenance) sourceRepository() string {
+	uri := s.BuildDefinition.ExternalParameters.Workflow.Repository
+	if uri == "" && len(s.BuildDefinition.ResolvedDependencies) > 0 {
+		uri = s.BuildDefinition.ResolvedDependencies[0].URI
+	}
+	if uri == "" {
+		uri = s.Invocation.ConfigSource.URI
+	}
+	uri, _, _ = strings.Cut(strings.TrimPrefix(uri, "git+"), "@")
+	return strings.TrimSuffix(uri, ".git")
+}
+
+// attestation is a DSSE envelope with the certificates of its signature, the
+// leaf first.
+type attestation struct {
+	envelope     dsseEnvelope
+	certificates []*x509.Certificate
+}
+
+func isAttestationType(artifactType string) bool {
+	return artifactType == "" || artifactType == mediaTypeInToto || artifactType == mediaTypeDSSE || strings.HasPrefix(artifactType, mediaTypeSigstoreBundle)
+}
+
+// attestations returns the attestations of a digest: the Sigstore bundles and
+// DSSE envelopes of its referrers, read from the referrers tag schema when the
+// registry has no referrers API (e.g. GHCR), and of its cosign attestations
+// (the `.att` tag).
+func (p *containerProxy) attestations(ctx context.Context, name, digest string) ([]attestation, error) {
+	referrers, err := p.registryClient.Referrers(ctx, name, digest)
+	if errors.Is(err, errManifestUnknown) {
+		var body []byte
+		body, _, _, err = p.registryClient.GetManifest(ctx, name, strings.Replace(digest, ":", "-", 1))
+		if err == nil {
+			var index manifest
+			json.Unmarshal(body, &index)
+			referrers = index.Manifests
+		}
+	}
+	if err != nil && !errors.Is(err, errManifestUnknown) {
+		return nil, err
+	}
+
+	var manifests [][]byte
+	for _, referrer := range referrers {
+		if !isAttestationType(referrer.ArtifactType) {
+			continue
+		}
+		body, _, _, err := p.registryClient.GetManifest(ctx, name, referrer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, body)
+	}
+	body, _, _, err := p.registryClient.GetManifest(ctx, name, signatureTag(digest, ".att"))
+	if err != nil && !errors.Is(err, errManifestUnknown) {
+		return nil, err
+	}
+	if err == nil {
+		manifests = append(manifests, body)
+	}
+
+	var attestations []attestation
+	for _, body := range manifests {
+		var m manifest
+		if json.Unmarshal(body, &m) != nil {
+			continue
+		}
+		for _, layer := range m.Layers {
+			if layer.MediaType != mediaTypeDSSE && !strings.HasPrefix(layer.MediaType, mediaTypeSigstoreBundle) {
+				continue
+			}
+			data, err := p.fetchAttestation(ctx, name, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			a, err := parseAttestation(layer, data)
+			if err != nil {
+				log.Printf("WARN invalid attestation %s of %s@%s: %s", layer.Digest, name, digest, err)
+				continue
+			}
+			attestations = append(attestations, a)
+		}
+	}
+	return attestations, nil
+}
+
+// fetchAttestation returns the content of an attestation blob, after checking
+// its digest.
+func (p *containerProxy) fetchAttestation(ctx context.Context, name, digest string) ([]byte, error) {
+	body, _, err := p.registryClient.GetBlob(ctx, name, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxAttestationSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAttestationSize {
+		return nil, fmt.Errorf("attestation %s too large", digest)
+	}
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); actual != digest {
+		return nil, fmt.Errorf("attestation %s: digest mismatch (%s)", digest, actual)
+	}
+	return data, nil
+}
+
+// parseAttestation parses a Sigstore bundle or a DSSE envelope, whose
+// certificates are then read from the annotations of cosign.
+func parseAttestation(layer descriptor, data []byte) (attestation, error) {
+	var a attestation
+	var raw [][]byte
+	if strings.HasPrefix(layer.MediaType, mediaTypeSigstoreBundle) {
+		var bundle sigstoreBundle
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			return a, err
+		}
+		if bundle.DSSEEnvelope == nil {
+			return a, errors.New("the bundle has no DSSE envelope")
+		}
+		a.envelope = *bundle.DSSEEnvelope
+		if c := bundle.VerificationMaterial.Certificate; c != nil {
+			raw = append(raw, c.RawBytes)
+		} else if chain := bundle.VerificationMaterial.X509CertificateChain; chain != nil {
+			for _, c := range chain.Certificates {
+				raw = append(raw, c.RawBytes)
+			}
+		}
+	} else {
+		if err := json.Unmarshal(data, &a.envelope); err != nil {
+			return a, err
+		}
+		rest := []byte(layer.Annotations["dev.sigstore.cosign/certificate"] + "\n" + layer.Annotations["dev.sigstore.cosign/chain"])
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			raw = append(raw, block.Bytes)
+		}
+	}
+
+	for _, der := range raw {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return a, err
+		}
+		a.certificates = append(a.certificates, certificate)
+	}
+	return a, nil
+}
+
+// dssePAE returns the pre-authentication encoding of a DSSE payload, which is
+// what is signed.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))), payload...)
+}
+
+// verifyDSSESignature verifies the signature of a DSSE envelope.
+func verifyDSSESignature(key crypto.PublicKey, message, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 384:
+			digest := sha512.Sum384(message)
+			return ecdsa.VerifyASN1(key, digest[:], signature)
+		case 521:
+			digest := sha512.Sum512(message)
+			return ecdsa.VerifyASN1(key, digest[:], signature)
+		}
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil || rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	}
+	return false
+}
+
+// verifyAttestation verifies the certificate and the signature of an
+// attestation.
+func (v *provenanceVerifier) verifyAttestation(a attestation) error {
+	if len(a.certificates) == 0 {
+		return errors.New("the attestation has no signing certificate")
+	}
+	leaf := a.certificates[0]
+	intermediates := x509.NewCertPool()
+	for _, certificate := range a.certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	// The Sigstore certificates are only valid for a few minutes, so the
+	// signature is assumed to be made when the certificate was issued: the
+	// timestamps of the transparency log are not verified.
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted signing certificate: %w", err)
+	}
+
+	message := dssePAE(a.envelope.PayloadType, a.envelope.Payload)
+	for _, signature := range a.envelope.Signatures {
+		if verifyDSSESignature(leaf.PublicKey, message, signature.Sig) {
+			return nil
+		}
+	}
+	return errors.New("invalid attestation signature")
+}
+
+// check verifies that an attestation is a SLSA provenance of the digest
+// satisfying the policy, signed when root certificates are set, and returns
+// its builder ID and source repository.
+func (v *provenanceVerifier) check(a attestation, digest string, policy ProvenancePolicy) (string, string, error) {
+	if a.envelope.PayloadType != mediaTypeInToto {
+		return "", "", fmt.Errorf("unexpected payload type %q", a.envelope.PayloadType)
+	}
+	if v.roots != nil {
+		if err := v.verifyAttestation(a); err != nil {
+			return "", "", err
+		}
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(a.envelope.Payload, &statement); err != nil {
+		return "", "", fmt.Errorf("invalid in-toto statement: %w", err)
+	}
+	if !strings.HasPrefix(statement.PredicateType, slsaProvenancePrefix) {
+		return "", "", fmt.Errorf("not a SLSA provenance: %s", statement.PredicateType)
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	found := false
+	for _, subject := range statement.Subject {
+		found = found || subject.Digest[algorithm] == hex
+	}
+	if !found {
+		return "", "", fmt.Errorf("the provenance is not about %s", digest)
+	}
+
+	var provenance slsaProvenance
+	if err := json.Unmarshal(statement.Predicate, &provenance); err != nil {
+		return "", "", fmt.Errorf("invalid SLSA provenance: %w", err)
+	}
+	builder, source := provenance.builderID(), provenance.sourceRepository()
+	if !matchesAny(policy.Builders, builder) {
+		return "", "", fmt.Errorf("builder %q is not allowed", builder)
+	}
+	if !matchesAny(policy.SourceRepositories, source) {
+		return "", "", fmt.Errorf("source repository %q is not allowed", source)
+	}
+	return builder, source, nil
+}
+
+// verifyProvenance verifies the provenance attestations of a digest against a
+// policy, and records the result in the metadata database, if any. An error is
+// returned when the attestations cannot be fetched.
+func (p *containerProxy) verifyProvenance(ctx context.Context, name, digest string, policy ProvenancePolicy) (metadata.ProvenanceResult, error) {
+	key := name + "@" + digest
+	if result, ok := p.provenance.cached(key); ok {
+		return result, nil
+	}
+
+	attestations, err := p.attestations(ctx, name, digest)
+	if err != nil {
+		return metadata.ProvenanceResult{}, err
+	}
+	result := metadata.ProvenanceResult{Status: provenanceMissing, Error: "no provenance attestation"}
+	for _, a := range attestations {
+		builder, source, err := p.provenance.check(a, digest, policy)
+		if err != nil {
+			result = metadata.ProvenanceResult{Status: provenanceFailed, Error: err.Error()}
+			continue
+		}
+		result = metadata.ProvenanceResult{Status: provenanceVerified, Builder: builder, SourceRepository: source, Signed: p.provenance.roots != nil}
+		break
+	}
+	result.VerifiedAt = time.Now().UTC()
+
+	p.provenance.store(key, result)
+	if p.metadata != nil {
+		p.metadata.RecordProvenance(p.prefixedName(name), digest, result)
+	}
+	return result, nil
+}
+
+// checkProvenance is a middleware verifying the provenance of the manifests
+// pulled from the repositories having a policy, and denying the pulls failing
+// the verification when the policy is enforced.
+func (p *containerProxy) checkProvenance(next http.Handler) http.Handler {
+	match := func(r *http.Request) bool {
+		name, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			return false
+		}
+		_, ok = p.provenance.policy(name)
+		return ok
+	}
+	return ResponseHook(match, func(r *http.Request, res *HookResponse) error {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		name, _, _, _ := splitRegistryPath(r.URL.Path)
+		policy, _ := p.provenance.policy(name)
+		digest, _ := responseDigest(r.Method, res.Header, res.Body)
+
+		result, err := p.verifyProvenance(r.Context(), name, digest, policy)
+		if err != nil {
+			provenanceVerificationsTotal.Inc("error")
+			if !policy.Enforce {
+				log.Printf("WARN provenance of %s@%s not verified: %s", name, digest, err)
+				return nil
+			}
+			return fmt.Errorf("cannot verify the provenance of %s@%s: %w", name, digest, err)
+		}
+		provenanceVerificationsTotal.Inc(result.Status)
+		if result.Status == provenanceVerified {
+			p.provenance.inherit(name, digest, res.Body, result)
+			return nil
+		}
+
+		log.Printf("WARN provenance of %s@%s %s: %s", name, digest, result.Status, result.Error)
+		if !policy.Enforce {
+			return nil
+		}
+		body, _ := json.Marshal(makeError(ERROR_DENIED, fmt.Sprintf("provenance verification of %s@%s failed: %s", name, digest, result.Error)))
+		res.StatusCode = http.StatusForbidden
+		res.Header.Set("Content-Type", "application/json")
+		res.Header.Del("Docker-Content-Digest")
+		res.Body = body
+		return nil
+	})(next)
+}
+
+// Provenance returns the provenance verification of a manifest, by tag or
+// digest, against the policy of its repository.
+func (p *containerProxy) Provenance(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Provenance Request %s -> %s", r.Method, r.URL)
+
+	name := chi.URLParam(r, "owner") + "/" + chi.URLParam(r, "name")
+	policy, ok := p.provenance.policy(name)
+	if !ok {
+		Veto(w, http.StatusNotFound, ERROR_NAME_UNKNOWN, fmt.Sprintf("no provenance policy for %s", name))
+		return
+	}
+
+	digest := chi.URLParam(r, "reference")
+	if !strings.Contains(digest, ":") {
+		var err error
+		if digest, err = p.registryClient.ManifestDigest(r.Context(), name, digest); err != nil {
+			if errors.Is(err, errManifestUnknown) {
+				Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, "manifest unknown")
+				return
+			}
+			Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+			return
+		}
+	}
+	result, err := p.verifyProvenance(r.Context(), name, digest, policy)
+	if err != nil {
+		Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+		return
+	}
+
+	writeRegistryJSON(w, r, "application/json", struct {
+		Name   string `json:"name"`
+		Digest string `json:"digest"`
+		metadata.ProvenanceResult
+	}{p.prefixedName(name), digest, result})
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+// signingCertificate returns a root certificate and a code signing
+// certificate issued by it, with its key.
+func signingCertificate(t *testing.T) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(der)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(-time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, root, &key.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return root, leaf, key
+}
+
+func TestProvenance(t *testing.T) {
+	root, leaf, key := signingCertificate(t)
+
+	image := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(image))
+	statement, _ := json.Marshal(map[string]interface{}{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"subject":       []interface{}{map[string]interface{}{"name": "ghcr.io/some-owner/app", "digest": map[string]string{"sha256": digest[7:]}}},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]interface{}{
+			"buildDefinition": map[string]interface{}{
+				"externalParameters": map[string]interface{}{
+					"workflow": map[string]interface{}{"repository": "https://github.com/some-owner/app"},
+				},
+			},
+			"runDetails": map[string]interface{}{
+				"builder": map[string]interface{}{"id": "https://github.com/actions/runner/github-hosted"},
+			},
+		},
+	})
+	hash := sha256.Sum256(dssePAE(mediaTypeInToto, statement))
+	signature, _ := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	bundle, _ := json.Marshal(map[string]interface{}{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"verificationMaterial": map[string]interface{}{
+			"certificate": map[string]interface{}{"rawBytes": leaf.Raw},
+		},
+		"dsseEnvelope": map[string]interface{}{
+			"payloadType": mediaTypeInToto,
+			"payload":     statement,
+			"signatures":  []interface{}{map[string]interface{}{"sig": signature}},
+		},
+	})
+	bundleDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(bundle))
+	attestationManifest, _ := json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		ArtifactType:  "application/vnd.dev.sigstore.bundle.v0.3+json",
+		Layers:        []descriptor{{MediaType: "application/vnd.dev.sigstore.bundle.v0.3+json", Digest: bundleDigest, Size: int64(len(bundle))}},
+	})
+	attestationDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(attestationManifest))
+	referrersIndex, _ := json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIIndex,
+		Manifests:     []descriptor{{MediaType: mediaTypeOCIManifest, Digest: attestationDigest, ArtifactType: "application/vnd.dev.sigstore.bundle.v0.3+json"}},
+	})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/some-owner/app/manifests/latest", "/v2/some-owner/unsigned/manifests/latest":
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write(image)
+		// The referrers tag schema, like on GHCR.
+		case "/v2/some-owner/app/manifests/sha256-" + digest[7:]:
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+			w.Write(referrersIndex)
+		case "/v2/some-owner/app/manifests/" + attestationDigest:
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Write(attestationManifest)
+		case "/v2/some-owner/app/blobs/" + bundleDigest:
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	policy := ProvenancePolicy{
+		Repositories:       []string{"some-owner/*"},
+		SourceRepositories: []string{"https://github.com/some-owner/*"},
+		Enforce:            true,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		roots  *x509.CertPool
+		policy ProvenancePolicy
+		status int
+		result string
+	}{
+		{name: "some-owner/app", roots: roots, policy: policy, status: http.StatusOK, result: provenanceVerified},
+		{name: "some-owner/unsigned", roots: roots, policy: policy, status: http.StatusForbidden, result: provenanceMissing},
+		// Untrusted signature.
+		{name: "some-owner/app", roots: x509.NewCertPool(), policy: policy, status: http.StatusForbidden, result: provenanceFailed},
+		// Unexpected builder.
+		{
+			name:   "some-owner/app",
+			policy: ProvenancePolicy{Repositories: []string{"some-owner/*"}, Builders: []string{"https://example.com/*"}, Enforce: true},
+			status: http.StatusForbidden,
+			result: provenanceFailed,
+		},
+		// Not enforced.
+		{
+			name:   "some-owner/unsigned",
+			policy: ProvenancePolicy{Repositories: []string{"some-owner/*"}},
+			status: http.StatusOK,
+			result: provenanceMissing,
+		},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithProvenancePolicies(tc.roots, tc.policy))
+
+		before := provenanceVerificationsTotal.Value(tc.result)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/v2/"+tc.name+"/manifests/latest", nil))
+		if res.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got: %d", tc.name, tc.status, res.Code)
+		}
+		if provenanceVerificationsTotal.Value(tc.result) != before+1 {
+			t.Fatalf("%s: expected a %s verification", tc.name, tc.result)
+		}
+	}
+}
+
+func TestProvenanceEndpoint(t *testing.T) {
+	image := []byte(`{}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(image))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/some-owner/app/manifests/latest" {
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write(image)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithProvenancePolicies(nil, ProvenancePolicy{Repositories: []string{"some-owner/app"}}))
+
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/repos/some-owner/app/latest/provenance", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got: %d", res.Code)
+	}
+	var response struct {
+		Digest string `json:"digest"`
+		metadata.ProvenanceResult
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	if response.Digest != digest || response.Status != provenanceMissing {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/api/repos/other-owner/app/latest/provenance", nil))
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got: %d", res.Code)
+	}
+}
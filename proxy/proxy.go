@@ -0,0 +1,746 @@
+// Package proxy implements the container registry proxy: a Docker Registry
+// HTTP API V2 server listing the repositories and the tags of a registry
+// backend, e.g. the GitHub packages, and forwarding the other requests to an
+// upstream registry. The proxy can be embedded in another Go service with New,
+// while Main runs the container-registry-proxy command.
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/backend"
+	"github.com/willdurand/container-registry-proxy/cache"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+const (
+	defaultHost        = "127.0.0.1"
+	defaultPort        = "10000"
+	defaultUpstreamURL = "https://ghcr.io"
+	defaultRecordDir   = "cassettes"
+
+	// GHCR accepts any username along with a personal access token.
+	defaultUpstreamUsername = "container-registry-proxy"
+)
+
+type containerProxy struct {
+	// ctx stops the background jobs of the proxy when done.
+	ctx context.Context
+	// err is the first error of the options, returned by New.
+	err error
+	// handler serves the requests, including the pulls of the exports.
+	handler http.Handler
+
+	backend backend.RegistryBackend
+	hooks   []Hook
+	leader  LeaderElector
+
+	namespaces   map[string]*url.URL
+	dockerHubURL *url.URL
+
+	upstreamUsername string
+	upstreamPassword string
+	credentials      []UpstreamCredential
+	registryClient   *registryClient
+
+	tokens         *tokenIssuer
+	realm          string
+	authenticators []Authenticator
+	authorize      authorizer
+	// adminGranted is set when the authorizer grants the admin action
+	// explicitly, see adminEnabled.
+	adminGranted  bool
+	anonymousRead []string
+	clientCAs     *x509.CertPool
+	// handlerOnly is set by New, whose caller configures the server.
+	handlerOnly bool
+
+	tenant     string
+	pathPrefix string
+
+	ipRules        map[string]ipRules
+	trustedProxies []netip.Prefix
+	throttler      *bandwidthThrottler
+
+	upstreamURL *url.URL
+	blobCache   *cache.Cache
+	blobClient  *http.Client
+	blobFetch   blobFetch
+	prefetcher  *blobPrefetcher
+	peers       *PeerSet
+	// blobRedirects is the policy of the redirects of the upstream blob
+	// responses.
+	blobRedirects *blobRedirects
+
+	prefetchSchedules []PrefetchSchedule
+
+	metadata *metadata.Store
+	jobs     *jobTracker
+
+	deleteDryRun  bool
+	immutableTags *immutableTags
+
+	digestPins      map[string]DigestPin
+	pinDriftWebhook string
+
+	mirrorSignatures  bool
+	requireSignatures bool
+
+	virtualTags []VirtualTag
+	aliases     map[string]string
+
+	deprecations []Deprecation
+
+	quotas []Quota
+	usage  *quotaUsage
+
+	apiKeys *apiKeyLimiters
+
+	availabilityObjective float64
+
+	chaos        []ChaosRule
+	featureFlags FeatureFlags
+
+	transforms    *manifestTransforms
+	foreignLayers *foreignLayers
+
+	maintenance *MaintenanceMode
+
+	health *healthChecker
+
+	readmes *readmeCache
+
+	tagsList *tagsListOptions
+
+	catalogRefresh *catalogRefresh
+	fluxReceiver   *fluxReceiver
+
+	events        *eventBus
+	notifications *NotificationSink
+
+	alerts *EmailAlerts
+
+	githubWebhookSecret string
+
+	provenance *provenanceVerifier
+
+	labelPolicies *labelPolicies
+	agePolicies   *agePolicies
+
+	sizeLimits []SizeLimit
+
+	cacheScrub   *CronSchedule
+	cacheMinFree *DiskWatermark
+	zstd         *zstdTranscoder
+	estargz      *estargzConverter
+
+	upstreamSettings []UpstreamSettings
+	settings         *upstreamSettingsRegistry
+
+	// upstreamEgress restricts the connections of upstreamTransport, the
+	// transport of the requests to the upstream registries.
+	upstreamEgress    *egressPolicy
+	upstreamTransport *http.Transport
+}
+
+// Option configures a container proxy.
+type Option func(p *containerProxy)
+
+// fail records an error of an option, unless there is already one.
+func (p *containerProxy) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// background returns the context of the background jobs of the proxy, e.g.
+// the requests outliving the request of a client.
+func (p *containerProxy) background() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// WithContext configures the context of the background jobs of the proxy
+// (e.g. the health checks, the prefetch schedules and the catalog refresh),
+// which stop when it is done.
+func WithContext(ctx context.Context) Option {
+	return func(p *containerProxy) {
+		p.ctx = ctx
+	}
+}
+
+// WithHooks adds hooks to the proxy.
+func WithHooks(hooks ...Hook) Option {
+	return func(p *containerProxy) {
+		p.hooks = append(p.hooks, hooks...)
+	}
+}
+
+// WithLeaderElector configures the elector deciding whether the background
+// jobs run on the current replica.
+func WithLeaderElector(elector LeaderElector) Option {
+	return func(p *containerProxy) {
+		p.leader = elector
+	}
+}
+
+// WithUpstreamCredentials configures the credentials used by the proxy to
+// inspect the upstream registry, e.g. to detect the type of the artifacts.
+func WithUpstreamCredentials(username, password string) Option {
+	return func(p *containerProxy) {
+		p.upstreamUsername = username
+		p.upstreamPassword = password
+	}
+}
+
+// NewProxy returns an instance of container proxy, which implements the Docker
+// Registry HTTP API V2. Without registry backend, all the registry requests
+// are forwarded to the upstream registry. It exits when the configuration is
+// invalid, see New.
+func NewProxy(addr string, registry backend.RegistryBackend, rawUpstreamURL string, opts ...Option) *http.Server {
+	server, err := newProxy(addr, registry, rawUpstreamURL, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return server
+}
+
+func newProxy(addr string, registry backend.RegistryBackend, rawUpstreamURL string, opts ...Option) (*http.Server, error) {
+	proxy := containerProxy{
+		ctx:            context.Background(),
+		upstreamEgress: newEgressPolicy(),
+		backend:        registry,
+		leader:         alwaysLeader{},
+		authorize:      allowAuthenticated,
+		readmes:        newReadmeCache(),
+	}
+	for _, opt := range opts {
+		opt(&proxy)
+	}
+	if proxy.err != nil {
+		return nil, proxy.err
+	}
+	if proxy.handlerOnly && proxy.clientCAs != nil {
+		return nil, errors.New("client certificates need the TLS configuration of the server, see NewServer")
+	}
+	if proxy.apiKeys != nil {
+		if proxy.metadata == nil {
+			return nil, errors.New("API keys need a metadata database")
+		}
+		proxy.authenticators = append([]Authenticator{&apiKeyAuthenticator{store: proxy.metadata}}, proxy.authenticators...)
+	}
+	if proxy.tokens != nil {
+		// The tokens of a virtual registry are not valid in the other ones.
+		if proxy.tenant != "" {
+			proxy.tokens.service = defaultTokenService + "/" + proxy.tenant
+		}
+		proxy.authenticators = append([]Authenticator{proxy.tokens}, proxy.authenticators...)
+	}
+	proxy.jobs = newJobTracker(proxy.metadata)
+	if len(proxy.quotas) > 0 {
+		proxy.usage = newQuotaUsage(proxy.metadata)
+	}
+	if proxy.foreignLayers != nil && proxy.foreignLayers.policy == foreignLayersRewrite {
+		// The foreign layers are rewritten before the other transforms.
+		proxy.initTransforms()
+		proxy.transforms.transforms = append([]ManifestTransform{{
+			Name:    "foreign-layers",
+			rewrite: proxy.rewriteForeignLayers,
+		}}, proxy.transforms.transforms...)
+	}
+
+	// Create an upstream (reverse) proxy to handle the requests not supported by
+	// the container proxy.
+	upstreamURL, err := url.Parse(rawUpstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateUpstreamURL(upstreamURL); err != nil {
+		return nil, err
+	}
+	proxy.upstreamURL = upstreamURL
+	// The configured upstreams may be internal registries.
+	proxy.upstreamEgress.allowHosts(upstreamURL.Hostname())
+	for _, namespaceURL := range proxy.namespaces {
+		proxy.upstreamEgress.allowHosts(namespaceURL.Hostname())
+	}
+	if proxy.dockerHubURL != nil {
+		proxy.upstreamEgress.allowHosts(proxy.dockerHubURL.Hostname())
+	}
+	proxy.upstreamTransport = newUpstreamTransport(proxy.upstreamEgress)
+	proxy.registerUpstreamSettings()
+	// The background jobs send their requests like the ones of the clients.
+	proxy.ctx = proxy.withUpstream(proxy.ctx)
+	upstreamProxy := newUpstreamProxy(upstreamURL)
+	proxy.registryClient = newRegistryClient(upstreamURL, &tokenTransport{
+		username:    proxy.upstreamUsername,
+		password:    proxy.upstreamPassword,
+		credentials: proxy.credentials,
+		settings:    proxy.settings,
+	})
+	if proxy.health != nil {
+		proxy.health.start(proxy.ctx, &proxy)
+	}
+
+	// When the clients authenticate with the proxy, their credentials are not
+	// valid upstream and the proxy uses its own credentials instead.
+	var namespacesTransport http.RoundTripper
+	if len(proxy.authenticators) > 0 {
+		upstreamProxy.Transport = &tokenTransport{username: proxy.upstreamUsername, password: proxy.upstreamPassword, credentials: proxy.credentials, settings: proxy.settings}
+		namespacesTransport = &tokenTransport{credentials: proxy.credentials, settings: proxy.settings}
+	}
+	if proxy.blobCache != nil {
+		proxy.blobCache.MinFree = proxy.cacheMinFree
+		if proxy.tenant != "" {
+			proxy.blobCache = proxy.blobCache.Sub(proxy.tenant)
+		}
+		proxy.blobClient = &http.Client{Transport: upstreamProxy.Transport, CheckRedirect: countBlobRedirects}
+	}
+	if proxy.zstd != nil && proxy.blobCache == nil {
+		log.Printf("WARN zstd transcoding disabled: it requires the blob cache")
+		proxy.zstd = nil
+	}
+	if proxy.estargz != nil && proxy.blobCache == nil {
+		log.Printf("WARN eStargz conversion disabled: it requires the blob cache")
+		proxy.estargz = nil
+	}
+	if proxy.estargz != nil {
+		proxy.estargz.cache = proxy.blobCache
+		proxy.initTransforms()
+		proxy.transforms.transforms = append(proxy.transforms.transforms, ManifestTransform{
+			Name:    "estargz",
+			rewrite: proxy.rewriteEstargzLayers,
+		})
+		go proxy.estargz.queue.run(proxy.ctx)
+	}
+	if proxy.zstd != nil {
+		// The layers are transcoded after the other transforms, except the
+		// eStargz layers.
+		proxy.zstd.cache = proxy.blobCache
+		proxy.initTransforms()
+		proxy.transforms.transforms = append(proxy.transforms.transforms, ManifestTransform{
+			Name:    "zstd",
+			rewrite: proxy.rewriteZstdLayers,
+		})
+		go proxy.zstd.queue.run(proxy.ctx)
+	}
+	if proxy.blobRedirects == nil {
+		proxy.blobRedirects = &blobRedirects{policy: blobRedirectPassthrough}
+	}
+	proxy.blobRedirects.client = &http.Client{Transport: &instrumentedTransport{}, CheckRedirect: countBlobRedirects}
+	upstreamProxy.ModifyResponse = proxy.blobRedirects.modifyResponse
+	if proxy.alerts != nil {
+		go proxy.alerts.run(proxy.ctx, &proxy)
+	}
+	if proxy.events != nil {
+		go proxy.events.run(proxy.ctx)
+	}
+
+	router := chi.NewRouter()
+	router.Use(propagateTrace)
+	router.Use(proxy.sloMetrics)
+	if len(proxy.chaos) > 0 {
+		router.Use(proxy.injectChaos)
+	}
+	// Set a timeout value on the request context (ctx), depending on the
+	// upstream registry.
+	router.Use(proxy.upstreamTimeout)
+	if len(proxy.ipRules) > 0 {
+		router.Use(proxy.ipFilter)
+	}
+	if !proxy.adminEnabled() {
+		router.Use(disableAdmin)
+	}
+	if proxy.throttler != nil {
+		router.Use(proxy.throttle)
+	}
+	router.Use(validateReferences)
+	if len(proxy.aliases) > 0 {
+		router.Use(proxy.rewriteAliases)
+	}
+	if len(proxy.authenticators) > 0 {
+		router.Use(proxy.authenticate)
+	}
+	if proxy.apiKeys != nil {
+		router.Use(proxy.limitAPIKeys)
+	}
+	for _, hook := range sortedHooks(proxy.hooks) {
+		log.Printf("registering hook %q", hook.Name)
+		router.Use(hook.Middleware)
+	}
+	if len(proxy.quotas) > 0 {
+		router.Use(proxy.enforceQuotas)
+	}
+	if len(proxy.sizeLimits) > 0 {
+		router.Use(proxy.enforceSizeLimits)
+	}
+	if len(proxy.virtualTags) > 0 && proxy.backend != nil {
+		router.Use(proxy.resolveVirtualTags)
+	}
+	if proxy.immutableTags != nil {
+		router.Use(proxy.enforceImmutableTags)
+	}
+	if len(proxy.digestPins) > 0 {
+		router.Use(proxy.checkDigestPins)
+	}
+	if len(proxy.deprecations) > 0 {
+		router.Use(proxy.deprecationHeaders)
+	}
+	if proxy.zstd != nil {
+		router.Use(proxy.detectZstdClients)
+	}
+	if proxy.transforms != nil {
+		proxy.transforms.cache = proxy.blobCache
+		router.Use(proxy.transformManifests)
+	}
+	if proxy.foreignLayers != nil && proxy.foreignLayers.policy != foreignLayersPassthrough {
+		router.Use(proxy.checkForeignLayers)
+	}
+	if proxy.provenance != nil {
+		router.Use(proxy.checkProvenance)
+	}
+	if proxy.labelPolicies != nil {
+		router.Use(proxy.checkLabels)
+	}
+	if proxy.agePolicies != nil {
+		router.Use(proxy.checkImageAge)
+	}
+	router.Use(proxy.manifestMetrics)
+	if proxy.metadata != nil {
+		router.Use(proxy.recordPulls)
+	}
+	if proxy.maintenance != nil {
+		router.Use(proxy.maintenanceMode)
+	}
+	router.Use(namespaceRouting(upstreamURL, proxy.namespaces, namespacesTransport))
+	if proxy.dockerHubURL != nil {
+		router.Use(dockerMirror(proxy.dockerHubURL, proxy.credentials))
+	}
+	router.Use(referrers)
+	if proxy.blobCache != nil {
+		router.Use(proxy.cacheBlobs)
+		if proxy.prefetcher != nil {
+			router.Use(proxy.prefetchBlobs)
+		}
+	}
+
+	router.Method("GET", "/v2/", apiVersionCheck(upstreamURL))
+	router.Method("HEAD", "/v2/", apiVersionCheck(upstreamURL))
+
+	router.Get("/metrics", Metrics)
+	router.Get("/api/slo", proxy.SLO)
+	router.Get("/api/version", proxy.Version)
+	if proxy.health != nil {
+		router.Get("/api/status", proxy.Status)
+	}
+	router.Get("/admin/jobs", proxy.Jobs)
+	if proxy.labelPolicies != nil {
+		router.Get("/admin/labels/violations", proxy.LabelViolations)
+	}
+	if proxy.maintenance != nil {
+		router.Get("/admin/maintenance", proxy.Maintenance)
+		router.Put("/admin/maintenance", proxy.SetMaintenance)
+	}
+	if len(proxy.quotas) > 0 {
+		router.Get("/admin/quotas", proxy.Quotas)
+	}
+	if proxy.metadata != nil {
+		router.Get("/admin/audit", proxy.AuditLog)
+		router.Get("/admin/jobs/runs", proxy.JobRuns)
+		router.Get("/admin/catalog/pins", proxy.CatalogPins)
+		router.Put("/admin/catalog/pins/{owner}/{name}", proxy.SetCatalogPin)
+		router.Delete("/admin/catalog/pins/{owner}/{name}", proxy.SetCatalogPin)
+		router.Get("/api/repos/{owner}/{name}/tags/{tag}/history", proxy.TagHistory)
+		router.Get("/api/favorites", proxy.Favorites)
+		router.Put("/api/favorites/{owner}/{name}", proxy.SetFavorite)
+		router.Delete("/api/favorites/{owner}/{name}", proxy.SetFavorite)
+	}
+	if proxy.apiKeys != nil {
+		router.Get("/admin/apikeys", proxy.APIKeys)
+		router.Post("/admin/apikeys", proxy.CreateAPIKey)
+		router.Delete("/admin/apikeys/{id}", proxy.RevokeAPIKey)
+	}
+	if proxy.blobCache != nil {
+		router.Post("/admin/prefetch", proxy.Prefetch)
+		router.Get("/admin/cache/blobs", proxy.CachedBlobs)
+		router.Delete("/admin/cache/blobs/{digest}", proxy.RemoveCachedBlob)
+		router.Post("/admin/cache/gc", proxy.CollectCachedBlobs)
+		if proxy.peers != nil {
+			router.Get("/internal/blobs/{digest}", proxy.PeerBlob)
+			router.Head("/internal/blobs/{digest}", proxy.PeerBlob)
+		}
+		proxy.runPrefetchSchedules(proxy.ctx)
+		if proxy.cacheScrub != nil {
+			proxy.runCacheScrub(proxy.ctx)
+		}
+		// The virtual registries share the disk of the main registry, which
+		// evicts their blobs too.
+		if proxy.cacheMinFree != nil && proxy.tenant == "" {
+			go proxy.monitorDiskPressure(proxy.ctx)
+		}
+	}
+	router.Get("/api/repos/{owner}/{name}/{reference}/export", proxy.ExportImage)
+	router.Get("/api/repos/{owner}/{name}/{reference}/delta", proxy.DeltaImage)
+	if proxy.provenance != nil {
+		router.Get("/api/repos/{owner}/{name}/{reference}/provenance", proxy.Provenance)
+	}
+	if proxy.githubWebhookSecret != "" {
+		router.Post("/hooks/github", proxy.GitHubWebhook)
+	}
+	if len(proxy.authenticators) > 0 {
+		router.Get(whoamiPath, proxy.Whoami)
+		// The imports are pushed with the credentials of the proxy, on behalf
+		// of the authenticated clients only.
+		router.Post("/api/import", proxy.ImportImage)
+	}
+	if proxy.tokens != nil {
+		router.Get("/token", proxy.Token)
+		router.Post("/token", proxy.Token)
+	}
+	if proxy.backend != nil {
+		router.Get("/api/repos/{owner}/{name}", proxy.RepositoryMetadata)
+		router.Get("/api/repos/{owner}/{name}/tags/latest", proxy.LatestTag)
+		router.Get("/api/repos/{owner}/{name}/readme", proxy.RepositoryReadme)
+		router.Get("/api/owners", proxy.Owners)
+		router.Get("/api/owners/{owner}/repos", proxy.OwnerRepositories)
+		router.Get("/v2/_catalog", proxy.Catalog)
+		router.Get("/v2/{owner}/{name}/tags/list", proxy.TagsList)
+		router.Delete("/v2/{owner}/{name}/manifests/{reference}", proxy.DeleteManifest)
+		if proxy.catalogRefresh != nil {
+			if proxy.metadata != nil {
+				router.Get("/api/catalog/diff", proxy.CatalogDiff)
+			}
+			proxy.runCatalogRefresh(proxy.ctx)
+		}
+	}
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Not Found %s %s -> %s", r.Method, r.URL, upstreamURL)
+		upstreamProxy.ServeHTTP(w, r)
+	})
+	// Requests matching a route with another method (e.g. GET on a manifest)
+	// are handled by the upstream registry too.
+	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Not Found %s %s -> %s", r.Method, r.URL, upstreamURL)
+		upstreamProxy.ServeHTTP(w, r)
+	})
+
+	proxy.handler = router
+	return &http.Server{
+		Addr:      addr,
+		Handler:   router,
+		TLSConfig: proxy.tlsConfig(),
+	}, nil
+}
+
+// Settings configures a proxy embedded in another Go service, see New.
+type Settings struct {
+	// Backend lists the repositories and their tags, e.g. a GitHub backend
+	// (see backend/github), or nil to forward all the requests upstream.
+	Backend backend.RegistryBackend
+	// UpstreamURL is the URL of the upstream registry (default:
+	// https://ghcr.io).
+	UpstreamURL string
+	// Options configure the optional features, e.g. WithBlobCache.
+	Options []Option
+}
+
+// New returns the handler of a proxy, to embed it in another Go service
+// instead of running the container-registry-proxy command. The handler serves
+// the registry API on `/v2/` and the other endpoints of the proxy, e.g.
+// `/api/` and `/metrics`, so it is usually mounted at the root of a host.
+// Unlike NewProxy, it returns an error when the configuration is invalid. The
+// background jobs of the proxy run until the context of WithContext is done.
+// The client certificates (see WithClientCertificates) are requested by the
+// server, so they need NewServer.
+func New(settings Settings) (http.Handler, error) {
+	opts := append(settings.Options[:len(settings.Options):len(settings.Options)], func(p *containerProxy) {
+		p.handlerOnly = true
+	})
+	server, err := NewServer("", Settings{Backend: settings.Backend, UpstreamURL: settings.UpstreamURL, Options: opts})
+	if err != nil {
+		return nil, err
+	}
+	return server.Handler, nil
+}
+
+// NewServer returns the server of a proxy listening on addr, like New, with
+// the TLS configuration requesting the client certificates when they are
+// enabled. The server is started with ListenAndServeTLS.
+func NewServer(addr string, settings Settings) (*http.Server, error) {
+	rawUpstreamURL := settings.UpstreamURL
+	if rawUpstreamURL == "" {
+		rawUpstreamURL = defaultUpstreamURL
+	}
+	return newProxy(addr, settings.Backend, rawUpstreamURL, settings.Options...)
+}
+
+func GitHubUsers() []string {
+	users := strings.Split(os.Getenv("GITHUB_USERS"), ",")
+	if os.Getenv("GITHUB_USERS") != "" {
+		defaultUser := []string{""}
+		users = append(defaultUser, users...)
+	}
+	log.Printf("GitHub Users %s", strings.Join(users, ","))
+
+	return users
+}
+
+// Catalog returns the list of repositories available in the Container Registry.
+func (p *containerProxy) Catalog(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Catalog Request %s -> %s", r.Method, r.URL)
+	p.writeCatalog(w, r, r.URL.Query().Get("namespace"))
+}
+
+// OwnerRepositories returns the repositories of an owner, like the catalog
+// with the `namespace` parameter.
+func (p *containerProxy) OwnerRepositories(w http.ResponseWriter, r *http.Request) {
+	log.Printf("OwnerRepositories Request %s -> %s", r.Method, r.URL)
+	p.writeCatalog(w, r, chi.URLParam(r, "owner"))
+}
+
+// writeCatalog writes the list of repositories, or the list of the
+// repositories of an owner, in which case only the packages of the owner are
+// fetched when possible and the aliases are not listed.
+func (p *containerProxy) writeCatalog(w http.ResponseWriter, r *http.Request, owner string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var repositories []backend.Repository
+	var err error
+	if owner == "" {
+		repositories, err = p.backend.ListRepositories(r.Context())
+	} else {
+		repositories, err = backend.ListOwnerRepositories(r.Context(), p.backend, owner)
+	}
+	if err != nil && len(repositories) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		errors := makeErrors(ERROR_UNKNOWN, err)
+		json.NewEncoder(w).Encode(&errors)
+		return
+	}
+	if err != nil {
+		// e.g. the catalog file merged with an unreachable backend.
+		log.Printf("WARN catalog partially listed: %s", err)
+	}
+
+	catalog := struct {
+		Repositories []string `json:"repositories"`
+	}{
+		Repositories: []string{},
+	}
+	var names []string
+	for _, repository := range repositories {
+		name := fmt.Sprintf("%s/%s", repository.Owner, repository.Name)
+		if !p.canPull(r, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if owner == "" {
+		names = append(names, p.catalogAliases(names)...)
+	}
+	for _, name := range names {
+		catalog.Repositories = append(catalog.Repositories, p.prefixedName(name))
+	}
+	catalog.Repositories = p.orderCatalog(r, catalog.Repositories)
+	var ok bool
+	if catalog.Repositories, ok = paginate(w, r, catalog.Repositories); !ok {
+		return
+	}
+	writeRegistryJSON(w, r, "application/json", catalog)
+}
+
+// TagsList returns the list of tags for a given repository.
+func (p *containerProxy) TagsList(w http.ResponseWriter, r *http.Request) {
+	log.Printf("TagList Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	owner := chi.URLParam(r, "owner")
+	name := chi.URLParam(r, "name")
+
+	tags, created, err := p.listTags(r.Context(), owner, name)
+	if err != nil {
+		if errors.Is(err, backend.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_NAME_UNKNOWN, "repository name not known to registry"))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		errors := makeErrors(ERROR_UNKNOWN, err)
+		json.NewEncoder(w).Encode(errors)
+		return
+	}
+
+	list := struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+		// Created is an extension of the tag list, see WithTagsOrder.
+		Created map[string]time.Time `json:"created,omitempty"`
+	}{
+		Name: p.prefixedName(fmt.Sprintf("%s/%s", owner, name)),
+		Tags: []string{},
+	}
+	list.Tags = append(list.Tags, tags...)
+
+	var ok bool
+	if list.Tags, ok = paginate(w, r, list.Tags); !ok {
+		return
+	}
+	if created != nil {
+		list.Created = map[string]time.Time{}
+		for _, tag := range list.Tags {
+			if date, ok := created[tag]; ok {
+				list.Created[tag] = date
+			}
+		}
+	}
+	writeRegistryJSON(w, r, "application/json", list)
+}
+
+// DeleteManifest deletes the version referenced by a tag or a digest.
+func (p *containerProxy) DeleteManifest(w http.ResponseWriter, r *http.Request) {
+	log.Printf("DeleteManifest Request %s -> %s", r.Method, r.URL)
+
+	owner := chi.URLParam(r, "owner")
+	name := chi.URLParam(r, "name")
+	reference := chi.URLParam(r, "reference")
+
+	if p.isDryRun(r) {
+		p.previewDeletion(w, r, owner, name, reference)
+		return
+	}
+
+	if err := p.backend.DeleteVersion(r.Context(), owner, name, reference); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, backend.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_MANIFEST_UNKNOWN, "manifest unknown"))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeErrors(ERROR_UNKNOWN, err))
+		return
+	}
+	repository := p.prefixedName(owner + "/" + name)
+	p.audit(r, "delete", repository, reference)
+	p.publishEvent(r, Event{Type: eventDelete, Repository: owner + "/" + name, Reference: reference})
+	p.notifications.notify(notifyDeletion, fmt.Sprintf("Version deleted: %s", imageReference(repository, reference)))
+	if p.metadata != nil {
+		p.metadata.DeleteTag(repository, reference)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+type githubClientMock struct {
+	Packages        []*github.Package
+	PackageVersions []*github.PackageVersion
+	Err             error
+}
+
+func (c *githubClientMock) ListPackages(ctx context.Context, user string, opts *github.PackageListOptions) ([]*github.Package, *github.Response, error) {
+	return c.Packages, nil, c.Err
+}
+
+func (c *githubClientMock) GetPackage(ctx context.Context, user, packageType, packageName string) (*github.Package, *github.Response, error) {
+	for _, pack := range c.Packages {
+		if pack.GetName() == packageName {
+			return pack, nil, c.Err
+		}
+	}
+	return nil, nil, c.Err
+}
+
+func (c *githubClientMock) PackageGetAllVersions(ctx context.Context, user, packageType, packageName string, opts *github.PackageListOptions) ([]*github.PackageVersion, *github.Response, error) {
+	return c.PackageVersions, nil, c.Err
+}
+
+func (c *githubClientMock) PackageDeleteVersion(ctx context.Context, user, packageType, packageName string, packageVersionID int64) (*github.Response, error) {
+	return nil, c.Err
+}
+
+func TestCatalog(t *testing.T) {
+	owner := &github.User{Login: github.String("some-user")}
+
+	for _, tc := range []struct {
+		client             githubClientMock
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			client:             githubClientMock{},
+			expectedStatusCode: 200,
+			expectedContent:    `{"repositories":[]}`,
+		},
+		{
+			client: githubClientMock{
+				Packages: []*github.Package{
+					{
+						Name:  github.String("some-package"),
+						Owner: owner,
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"repositories":["some-user/some-package"]}`,
+		},
+		{
+			client: githubClientMock{
+				Packages: []*github.Package{
+					{
+						Name:  github.String("package-1"),
+						Owner: owner,
+					},
+					{
+						Name:  github.String("package-2"),
+						Owner: owner,
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"repositories":["some-user/package-1","some-user/package-2"]}`,
+		},
+		{
+			client: githubClientMock{
+				Packages: []*github.Package{
+					{
+						// No Name here
+						Owner: owner,
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"repositories":[]}`,
+		},
+		{
+			client: githubClientMock{
+				Packages: []*github.Package{
+					{
+						Name:  github.String("some-package"),
+						Owner: &github.User{},
+					},
+				},
+			},
+			expectedStatusCode: 200,
+			expectedContent:    `{"repositories":[]}`,
+		},
+		{
+			client: githubClientMock{
+				Err: fmt.Errorf("an error"),
+			},
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"UNKNOWN","message":"ListPackages: an error","detail":""}]}`,
+		},
+		{
+			client: githubClientMock{
+				Err: &github.ErrorResponse{
+					Response: &http.Response{StatusCode: 401, Request: &http.Request{Method: "GET"}},
+				},
+			},
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"UPSTREAM_BAD_CREDENTIALS","message":"ListPackages: the GitHub token is invalid or expired, check GITHUB_TOKEN","detail":""}]}`,
+		},
+	} {
+		proxy := NewProxy(
+			"127.0.0.1:10000",
+			ghbackend.New(&tc.client, nil),
+			"http://127.0.0.1/upstream",
+		)
+
+		req, _ := http.NewRequest("GET", "/v2/_catalog", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("expected: %s, got: %s", tc.expectedContent, res.Body.String())
+		}
+	}
+}
+
+func TestCatalogNamespace(t *testing.T) {
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("package-1"), Owner: &github.User{Login: github.String("some-org")}},
+			{Name: github.String("package-2"), Owner: &github.User{Login: github.String("other-org")}},
+		},
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(client, nil),
+		"http://127.0.0.1/upstream",
+		WithRepositoryAliases(map[string]string{"alias": "some-org/package-1"}),
+	)
+
+	for _, tc := range []struct {
+		path            string
+		expectedContent string
+	}{
+		{path: "/v2/_catalog", expectedContent: `{"repositories":["some-org/package-1","other-org/package-2","alias"]}`},
+		{path: "/v2/_catalog?namespace=some-org", expectedContent: `{"repositories":["some-org/package-1"]}`},
+		{path: "/api/owners/other-org/repos", expectedContent: `{"repositories":["other-org/package-2"]}`},
+		{path: "/api/owners/unknown/repos", expectedContent: `{"repositories":[]}`},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, http.StatusOK, res.Code)
+		}
+		if content := strings.TrimSpace(res.Body.String()); content != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, content)
+		}
+	}
+}
+
+func TestOwners(t *testing.T) {
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("package-1"), Owner: &github.User{Login: github.String("some-org")}},
+		},
+	}
+	proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, []string{"some-org"}), "http://127.0.0.1/upstream")
+
+	req, _ := http.NewRequest("GET", "/api/owners", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	expected := `{"owners":[{"name":"some-org","packages":1,"refreshed_at":"`
+	if !strings.HasPrefix(res.Body.String(), expected) {
+		t.Fatalf("expected: %s, got: %s", expected, res.Body.String())
+	}
+}
+
+func TestTagsList(t *testing.T) {
+	for _, tc := range []struct {
+		client             githubClientMock
+		owner              string
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			client:             githubClientMock{},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":[]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{
+							Container: &github.PackageContainerMetadata{
+								Tags: []string{"tag-1", "tag-2"},
+							},
+						},
+					},
+				},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":["tag-1","tag-2"]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":[]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{},
+				},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":[]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{},
+					},
+				},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":[]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{
+							Container: &github.PackageContainerMetadata{
+								Tags: []string{"tag-3", "tag-1", "tag-2"},
+							},
+						},
+					},
+				},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			query:              "?n=2",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":["tag-1","tag-2"]}`,
+		},
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						Metadata: &github.PackageMetadata{
+							Container: &github.PackageContainerMetadata{
+								Tags: []string{"tag-3", "tag-1", "tag-2"},
+							},
+						},
+					},
+				},
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			query:              "?n=2&last=tag-2",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tags":["tag-3"]}`,
+		},
+		{
+			client:             githubClientMock{},
+			owner:              "some-owner",
+			name:               "some-package",
+			query:              "?n=-1",
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"PAGINATION_NUMBER_INVALID","message":"invalid number of results","detail":""}]}`,
+		},
+		{
+			client: githubClientMock{
+				Err: fmt.Errorf("an error"),
+			},
+			owner:              "some-owner",
+			name:               "some-package",
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"UNKNOWN","message":"PackageGetAllVersions: an error","detail":""}]}`,
+		},
+	} {
+		proxy := NewProxy(
+			"127.0.0.1:10000",
+			ghbackend.New(&tc.client, nil),
+			"http://127.0.0.1/upstream",
+		)
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/v2/%s/%s/tags/list%s", tc.owner, tc.name, tc.query), nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("expected: %s, got: %s", tc.expectedContent, res.Body.String())
+		}
+	}
+}
+
+func TestDeleteManifest(t *testing.T) {
+	for _, tc := range []struct {
+		client             githubClientMock
+		reference          string
+		expectedStatusCode int
+	}{
+		{
+			client: githubClientMock{
+				PackageVersions: []*github.PackageVersion{
+					{
+						ID:   github.Int64(123),
+						Name: github.String("sha256:1234"),
+					},
+				},
+			},
+			reference:          "sha256:1234",
+			expectedStatusCode: 202,
+		},
+		{
+			client:             githubClientMock{},
+			reference:          "unknown",
+			expectedStatusCode: 404,
+		},
+		{
+			client: githubClientMock{
+				Err: fmt.Errorf("an error"),
+			},
+			reference:          "latest",
+			expectedStatusCode: 400,
+		},
+	} {
+		proxy := NewProxy(
+			"127.0.0.1:10000",
+			ghbackend.New(&tc.client, nil),
+			"http://127.0.0.1/upstream",
+		)
+
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/v2/some-owner/some-package/manifests/%s", tc.reference), nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.Code)
+		}
+	}
+}
+
+func TestCallUpstreamServer(t *testing.T) {
+	upstreamResponse := "upstream server called"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, upstreamResponse)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+	)
+
+	req, _ := http.NewRequest("GET", "/some/other/path", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != 200 {
+		t.Fatalf("expected: %d, got: %d", 200, res.Code)
+	}
+	if strings.TrimSpace(res.Body.String()) != upstreamResponse {
+		t.Fatalf("expected: %s, got: %s", upstreamResponse, res.Body.String())
+	}
+}
+
+func TestCallUpstreamServerForManifests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+	)
+
+	for _, method := range []string{"GET", "HEAD", "PUT"} {
+		req, _ := http.NewRequest(method, "/v2/some-owner/some-package/manifests/latest", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != 200 {
+			t.Fatalf("%s: expected: %d, got: %d", method, 200, res.Code)
+		}
+	}
+}
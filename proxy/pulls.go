@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pullError is the response of a pull (or of a push of an import) refused by
+// the proxy, e.g. by the authentication or a policy, or by the upstream
+// registry, which is relayed to the client.
+type pullError struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+func (e *pullError) Error() string {
+	return fmt.Sprintf("pull failed: %d %s", e.statusCode, bytes.TrimSpace(e.body))
+}
+
+// relay writes the refused response.
+func (e *pullError) relay(w http.ResponseWriter) {
+	for _, key := range []string{"Content-Type", "WWW-Authenticate", distributionAPIVersionHeader} {
+		if value := e.header.Get(key); value != "" {
+			w.Header().Set(key, value)
+		}
+	}
+	w.WriteHeader(e.statusCode)
+	w.Write(e.body)
+}
+
+// pullRequest returns a pull of the registry API of the proxy, with the
+// credentials and the address of the client of the request r, so that the
+// images exported by the proxy get the same authorization and pull policies
+// as the images pulled through it.
+func pullRequest(ctx context.Context, r *http.Request, path string) *http.Request {
+	// The pull is routed again, not as a subrequest of the route of r.
+	req := r.Clone(context.WithValue(ctx, chi.RouteCtxKey, nil))
+	req.Method = "GET"
+	req.URL = &url.URL{Path: path}
+	req.RequestURI = path
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.TransferEncoding = nil
+	// The bodies are verified against their digests, so they are neither
+	// compressed nor partial.
+	for _, name := range []string{"Accept", "Accept-Encoding", "Range", "If-Range", "If-None-Match", "If-Modified-Since", "Content-Type", "Content-Length", "Content-Encoding"} {
+		req.Header.Del(name)
+	}
+	return req
+}
+
+// pullManifest pulls a manifest through the proxy, see pullRequest.
+func (p *containerProxy) pullManifest(r *http.Request, name, reference string) ([]byte, string, string, error) {
+	req := pullRequest(r.Context(), r, "/v2/"+name+"/manifests/"+reference)
+	req.Header.Set("Accept", manifestAccept)
+
+	res := &bufferedResponseWriter{header: http.Header{}}
+	p.handler.ServeHTTP(res, req)
+	if res.statusCode != 0 && res.statusCode != http.StatusOK {
+		return nil, "", "", &pullError{statusCode: res.statusCode, header: res.header, body: res.body.Bytes()}
+	}
+	return res.body.Bytes(), res.header.Get("Content-Type"), res.header.Get("Docker-Content-Digest"), nil
+}
+
+// pipeResponseWriter streams the body of a pull to a reader.
+type pipeResponseWriter struct {
+	header http.Header
+	pipe   *io.PipeWriter
+	once   sync.Once
+	// response receives the status and the headers of the response.
+	response chan *http.Response
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pipe.Write(b)
+}
+
+func (w *pipeResponseWriter) WriteHeader(statusCode int) {
+	w.once.Do(func() {
+		w.response <- &http.Response{StatusCode: statusCode, Header: w.header.Clone()}
+	})
+}
+
+// openBlob pulls a blob through the proxy, see pullRequest, following the
+// redirects to the storage of the upstream registry.
+func (p *containerProxy) openBlob(ctx context.Context, r *http.Request, name, digest string) (io.ReadCloser, error) {
+	req := pullRequest(ctx, r, "/v2/"+name+"/blobs/"+digest)
+	reader, writer := io.Pipe()
+	w := &pipeResponseWriter{header: http.Header{}, pipe: writer, response: make(chan *http.Response, 1)}
+	go func() {
+		defer func() {
+			// The handlers abort the response when the reader is closed
+			// before the end of the blob.
+			if err := recover(); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				writer.CloseWithError(fmt.Errorf("blob %s: %v", digest, err))
+			}
+		}()
+		p.handler.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+		writer.Close()
+	}()
+
+	res := <-w.response
+	switch res.StatusCode {
+	case http.StatusOK:
+		return reader, nil
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		reader.Close()
+		location, err := url.Parse(res.Header.Get("Location"))
+		if err != nil || res.Header.Get("Location") == "" {
+			return nil, fmt.Errorf("blob %s: invalid redirect location", digest)
+		}
+		// The credentials of the registry are not sent to the storage, the
+		// redirect URLs being signed.
+		redirect, err := http.NewRequestWithContext(ctx, "GET", p.upstreamURL.ResolveReference(location).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		followed, err := p.blobRedirects.client.Do(redirect)
+		if err != nil {
+			return nil, err
+		}
+		if followed.StatusCode != http.StatusOK {
+			followed.Body.Close()
+			return nil, fmt.Errorf("blob %s: %s", digest, followed.Status)
+		}
+		return followed.Body, nil
+	default:
+		body, _ := io.ReadAll(io.LimitReader(reader, maxManifestSize))
+		reader.Close()
+		return nil, &pullError{statusCode: res.StatusCode, header: res.Header, body: body}
+	}
+}
+
+// relayPullError relays the response of a refused pull to the client.
+func relayPullError(w http.ResponseWriter, err error) {
+	var refused *pullError
+	if errors.As(err, &refused) {
+		refused.relay(w)
+		return
+	}
+	Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, err.Error())
+}
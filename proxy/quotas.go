@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+var quotaRejectionsTotal = newCounterVec(
+	"quota_rejections_total",
+	"Number of requests rejected because the monthly quota of their namespace is exceeded, by namespace.",
+	"namespace",
+)
+
+// Quota limits the bytes served and the manifests pulled by the namespaces
+// (the first component of the repository names) each month.
+type Quota struct {
+	// Namespace is a glob pattern (see path.Match) of namespaces, each of them
+	// having its own usage.
+	Namespace string `json:"namespace"`
+	// MonthlyBytes is a size with an optional K, M or G suffix, e.g. `500G`.
+	MonthlyBytes string `json:"monthly_bytes,omitempty"`
+	MonthlyPulls int64  `json:"monthly_pulls,omitempty"`
+	// Enforce rejects the requests once the quota is exceeded (429), a warning
+	// being added to the responses otherwise.
+	Enforce bool `json:"enforce,omitempty"`
+
+	bytes int64
+}
+
+func (q Quota) validate() error {
+	if q.Namespace == "" {
+		return fmt.Errorf("invalid quota: no namespace")
+	}
+	if _, err := path.Match(q.Namespace, ""); err != nil {
+		return fmt.Errorf("invalid quota of %s: %w", q.Namespace, err)
+	}
+	if q.MonthlyBytes == "" && q.MonthlyPulls == 0 {
+		return fmt.Errorf("invalid quota of %s: no limit", q.Namespace)
+	}
+	if q.MonthlyBytes != "" {
+		if _, err := ParseSize(q.MonthlyBytes); err != nil {
+			return fmt.Errorf("invalid quota of %s: %w", q.Namespace, err)
+		}
+	}
+	if q.MonthlyPulls < 0 {
+		return fmt.Errorf("invalid quota of %s: invalid number of pulls %d", q.Namespace, q.MonthlyPulls)
+	}
+	return nil
+}
+
+// exceeded returns the reason why a usage exceeds the quota, if it does.
+func (q Quota) exceeded(usage metadata.Usage) (string, bool) {
+	if q.bytes > 0 && usage.Bytes >= q.bytes {
+		return fmt.Sprintf("%d bytes served", usage.Bytes), true
+	}
+	if q.MonthlyPulls > 0 && usage.Pulls >= q.MonthlyPulls {
+		return fmt.Sprintf("%d pulls", usage.Pulls), true
+	}
+	return "", false
+}
+
+// quotaUsage tracks the usage of the namespaces during the current month, in
+// the metadata database when there is one so that it survives the restarts
+// and is shared with the virtual registries.
+type quotaUsage struct {
+	store *metadata.Store
+	now   func() time.Time
+
+	mu    sync.Mutex
+	month string
+	usage map[string]metadata.Usage
+}
+
+func newQuotaUsage(store *metadata.Store) *quotaUsage {
+	return &quotaUsage{store: store, now: time.Now}
+}
+
+func (u *quotaUsage) currentMonth() string {
+	return u.now().UTC().Format("2006-01")
+}
+
+// get returns the usage of the namespaces during the current month.
+func (u *quotaUsage) get() (string, map[string]metadata.Usage) {
+	month := u.currentMonth()
+	if u.store != nil {
+		return month, u.store.Usage(month)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage := map[string]metadata.Usage{}
+	if u.month == month {
+		for namespace, nu := range u.usage {
+			usage[namespace] = nu
+		}
+	}
+	return month, usage
+}
+
+// record adds bytes and pulls to the usage of a namespace.
+func (u *quotaUsage) record(namespace string, bytes, pulls int64) metadata.Usage {
+	month := u.currentMonth()
+	if u.store != nil {
+		return u.store.RecordUsage(month, namespace, bytes, pulls)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.month != month {
+		u.month, u.usage = month, map[string]metadata.Usage{}
+	}
+	nu := u.usage[namespace]
+	nu.Bytes += bytes
+	nu.Pulls += pulls
+	u.usage[namespace] = nu
+	return nu
+}
+
+// untilNextMonth returns the time until the usage is reset.
+func (u *quotaUsage) untilNextMonth() time.Duration {
+	now := u.now().UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return next.Sub(now)
+}
+
+// WithQuotas enforces monthly quotas on the namespaces. The first quota
+// matching a namespace applies.
+func WithQuotas(quotas ...Quota) Option {
+	return func(p *containerProxy) {
+		for _, q := range quotas {
+			if err := q.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			if q.MonthlyBytes != "" {
+				q.bytes, _ = ParseSize(q.MonthlyBytes)
+			}
+			p.quotas = append(p.quotas, q)
+		}
+	}
+}
+
+// quota returns the quota of a namespace, if any.
+func (p *containerProxy) quota(namespace string) (Quota, bool) {
+	for _, q := range p.quotas {
+		if matched, _ := path.Match(q.Namespace, namespace); matched {
+			return q, true
+		}
+	}
+	return Quota{}, false
+}
+
+// countingResponseWriter counts the bytes written to the response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+func (w *countingResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// enforceQuotas is a middleware counting the bytes served and the manifests
+// pulled by namespace, and rejecting the downloads of the namespaces
+// exceeding an enforced quota until the end of the month.
+func (p *containerProxy) enforceQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || (kind != "manifests" && kind != "blobs") || r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		namespace, _, _ := strings.Cut(p.prefixedName(name), "/")
+		quota, ok := p.quota(namespace)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, usage := p.usage.get()
+		if reason, exceeded := quota.exceeded(usage[namespace]); exceeded {
+			message := fmt.Sprintf("monthly quota of namespace %s exceeded: %s", namespace, reason)
+			if quota.Enforce {
+				quotaRejectionsTotal.Inc(namespace)
+				w.Header().Set("Retry-After", strconv.Itoa(int(p.usage.untilNextMonth().Seconds())))
+				Veto(w, http.StatusTooManyRequests, ERROR_TOO_MANY_REQUESTS, message)
+				return
+			}
+			w.Header().Set("Warning", `299 - `+strconv.Quote(message))
+		}
+
+		counter := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(counter, r)
+
+		var pulls int64
+		if kind == "manifests" && counter.statusCode == http.StatusOK {
+			pulls = 1
+		}
+		updated := p.usage.record(namespace, counter.written, pulls)
+		if _, wasExceeded := quota.exceeded(usage[namespace]); !wasExceeded {
+			if reason, exceeded := quota.exceeded(updated); exceeded {
+				log.Printf("WARN monthly quota of namespace %s exceeded: %s", namespace, reason)
+			}
+		}
+	})
+}
+
+// namespaceQuota is the usage of a namespace returned by the admin API.
+type namespaceQuota struct {
+	Namespace    string `json:"namespace"`
+	Bytes        int64  `json:"bytes"`
+	Pulls        int64  `json:"pulls"`
+	MonthlyBytes int64  `json:"monthly_bytes,omitempty"`
+	MonthlyPulls int64  `json:"monthly_pulls,omitempty"`
+	Enforce      bool   `json:"enforce"`
+	Exceeded     bool   `json:"exceeded"`
+}
+
+// Quotas returns the usage of the namespaces having a quota during the
+// current month.
+func (p *containerProxy) Quotas(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Quotas Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	month, usage := p.usage.get()
+	response := struct {
+		Month      string           `json:"month"`
+		Namespaces []namespaceQuota `json:"namespaces"`
+	}{
+		Month:      month,
+		Namespaces: []namespaceQuota{},
+	}
+	for namespace, nu := range usage {
+		quota, ok := p.quota(namespace)
+		if !ok {
+			continue
+		}
+		_, exceeded := quota.exceeded(nu)
+		response.Namespaces = append(response.Namespaces, namespaceQuota{
+			Namespace:    namespace,
+			Bytes:        nu.Bytes,
+			Pulls:        nu.Pulls,
+			MonthlyBytes: quota.bytes,
+			MonthlyPulls: quota.MonthlyPulls,
+			Enforce:      quota.Enforce,
+			Exceeded:     exceeded,
+		})
+	}
+	sort.Slice(response.Namespaces, func(i, j int) bool {
+		return response.Namespaces[i].Namespace < response.Namespaces[j].Namespace
+	})
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithQuotas(
+			Quota{Namespace: "team-a", MonthlyPulls: 2, Enforce: true},
+			Quota{Namespace: "team-*", MonthlyBytes: "15"},
+		),
+		withTestAdmin(),
+	)
+
+	for _, tc := range []struct {
+		path            string
+		expectedStatus  int
+		expectedWarning bool
+	}{
+		{path: "/v2/team-a/app/manifests/latest", expectedStatus: http.StatusOK},
+		{path: "/v2/team-a/app/blobs/sha256:1234", expectedStatus: http.StatusOK},
+		{path: "/v2/team-a/app/manifests/latest", expectedStatus: http.StatusOK},
+		{path: "/v2/team-a/app/manifests/latest", expectedStatus: http.StatusTooManyRequests},
+		{path: "/v2/team-a/app/blobs/sha256:1234", expectedStatus: http.StatusTooManyRequests},
+		{path: "/v2/team-b/app/blobs/sha256:1234", expectedStatus: http.StatusOK},
+		{path: "/v2/team-b/app/blobs/sha256:1234", expectedStatus: http.StatusOK},
+		{path: "/v2/team-b/app/blobs/sha256:1234", expectedStatus: http.StatusOK, expectedWarning: true},
+		{path: "/v2/other/app/manifests/latest", expectedStatus: http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatus {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, tc.expectedStatus, res.Code)
+		}
+		if warning := res.Header().Get("Warning") != ""; warning != tc.expectedWarning {
+			t.Fatalf("%s: expected warning: %t, got: %q", tc.path, tc.expectedWarning, res.Header().Get("Warning"))
+		}
+		if res.Code == http.StatusTooManyRequests {
+			if !strings.Contains(res.Body.String(), ERROR_TOO_MANY_REQUESTS) {
+				t.Fatalf("expected: %s, got: %s", ERROR_TOO_MANY_REQUESTS, res.Body.String())
+			}
+			if res.Header().Get("Retry-After") == "" {
+				t.Fatal("expected a Retry-After header")
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/admin/quotas", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	var response struct {
+		Namespaces []namespaceQuota `json:"namespaces"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := []namespaceQuota{
+		{Namespace: "team-a", Bytes: 30, Pulls: 2, MonthlyPulls: 2, Enforce: true, Exceeded: true},
+		{Namespace: "team-b", Bytes: 30, MonthlyBytes: 15, Exceeded: true},
+	}
+	if len(response.Namespaces) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, response.Namespaces)
+	}
+	for i := range expected {
+		if response.Namespaces[i] != expected[i] {
+			t.Fatalf("expected: %v, got: %v", expected[i], response.Namespaces[i])
+		}
+	}
+}
+
+func TestQuotaUsageResetsEachMonth(t *testing.T) {
+	now := time.Date(2023, 1, 31, 23, 0, 0, 0, time.UTC)
+	usage := newQuotaUsage(nil)
+	usage.now = func() time.Time { return now }
+
+	usage.record("team-a", 10, 1)
+	if d := usage.untilNextMonth(); d != time.Hour {
+		t.Fatalf("expected: %s, got: %s", time.Hour, d)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if month, u := usage.get(); month != "2023-02" || len(u) != 0 {
+		t.Fatalf("expected no usage in 2023-02, got: %s %v", month, u)
+	}
+	if u := usage.record("team-a", 5, 0); u.Bytes != 5 {
+		t.Fatalf("expected: %d, got: %d", 5, u.Bytes)
+	}
+}
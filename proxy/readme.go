@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+const (
+	// readmeCacheTTL is how long the READMEs of the repositories are cached,
+	// including the repositories without README.
+	readmeCacheTTL = 15 * time.Minute
+	// maxCachedReadmes limits the number of READMEs cached by a proxy.
+	maxCachedReadmes = 1000
+)
+
+type cachedReadme struct {
+	readme    string
+	err       error
+	fetchedAt time.Time
+}
+
+// readmeCache keeps the READMEs returned by the backend, so that displaying a
+// repository in a web UI does not call the GitHub API each time.
+type readmeCache struct {
+	mu      sync.Mutex
+	readmes map[string]cachedReadme
+}
+
+func newReadmeCache() *readmeCache {
+	return &readmeCache{readmes: map[string]cachedReadme{}}
+}
+
+// get returns the README of a repository in a format, fetched with finder when
+// it is not cached. Only the missing READMEs are cached among the errors.
+func (c *readmeCache) get(ctx context.Context, finder backend.ReadmeFinder, owner, name, format string) (string, error) {
+	key := fmt.Sprintf("%s/%s %s", owner, name, format)
+
+	c.mu.Lock()
+	cached, ok := c.readmes[key]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < readmeCacheTTL {
+		return cached.readme, cached.err
+	}
+
+	readme, err := finder.FindReadme(ctx, owner, name, format)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.readmes) >= maxCachedReadmes {
+		for k, cached := range c.readmes {
+			if now.Sub(cached.fetchedAt) >= readmeCacheTTL {
+				delete(c.readmes, k)
+			}
+		}
+	}
+	if len(c.readmes) < maxCachedReadmes {
+		c.readmes[key] = cachedReadme{readme: readme, err: err, fetchedAt: now}
+	}
+	return readme, err
+}
+
+// invalidate removes the READMEs of a repository from the cache, e.g. when a
+// new version is published.
+func (c *readmeCache) invalidate(owner, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, format := range []string{backend.ReadmeFormatMarkdown, backend.ReadmeFormatHTML} {
+		delete(c.readmes, fmt.Sprintf("%s/%s %s", owner, name, format))
+	}
+}
+
+// RepositoryReadme returns the README of the source repository of a
+// repository, as Markdown or rendered to HTML with `?format=html`, e.g. to
+// describe the repository in a web UI.
+func (p *containerProxy) RepositoryReadme(w http.ResponseWriter, r *http.Request) {
+	log.Printf("RepositoryReadme Request %s -> %s", r.Method, r.URL)
+
+	owner := chi.URLParam(r, "owner")
+	name := chi.URLParam(r, "name")
+
+	format := r.URL.Query().Get("format")
+	contentType := "text/markdown; charset=utf-8"
+	switch format {
+	case "", backend.ReadmeFormatMarkdown:
+		format = backend.ReadmeFormatMarkdown
+	case backend.ReadmeFormatHTML:
+		contentType = "text/html; charset=utf-8"
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(ERROR_UNSUPPORTED, fmt.Sprintf("invalid README format %q, expected markdown or html", format)))
+		return
+	}
+
+	content, err := "", backend.ErrNotSupported
+	if finder, ok := p.backend.(backend.ReadmeFinder); ok {
+		content, err = p.readmes.get(r.Context(), finder, owner, name, format)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, backend.ErrNotFound) || errors.Is(err, backend.ErrNotSupported) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(makeError(ERROR_NAME_UNKNOWN, "no README found for the repository"))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(makeError(errorCode(ERROR_UNKNOWN, err), err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	// The HTML rendered by GitHub is sanitized, but it should not run in the
+	// origin of the proxy when opened directly.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src https: data:; style-src 'unsafe-inline'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.WriteString(w, content)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+type readmeBackendMock struct {
+	backend.RegistryBackend
+	readme string
+	err    error
+	calls  int
+}
+
+func (b *readmeBackendMock) FindReadme(ctx context.Context, owner, name, format string) (string, error) {
+	b.calls++
+	if b.err != nil {
+		return "", b.err
+	}
+	return format + ":" + b.readme, nil
+}
+
+func TestRepositoryReadme(t *testing.T) {
+	for _, tc := range []struct {
+		query               string
+		err                 error
+		expectedStatusCode  int
+		expectedContentType string
+		expectedContent     string
+	}{
+		{
+			expectedStatusCode:  200,
+			expectedContentType: "text/markdown; charset=utf-8",
+			expectedContent:     "markdown:# Hello",
+		},
+		{
+			query:               "?format=html",
+			expectedStatusCode:  200,
+			expectedContentType: "text/html; charset=utf-8",
+			expectedContent:     "html:# Hello",
+		},
+		{
+			query:               "?format=pdf",
+			expectedStatusCode:  400,
+			expectedContentType: "application/json",
+			expectedContent:     `{"errors":[{"code":"UNSUPPORTED","message":"invalid README format \"pdf\", expected markdown or html","detail":""}]}`,
+		},
+		{
+			err:                 backend.ErrNotFound,
+			expectedStatusCode:  404,
+			expectedContentType: "application/json",
+			expectedContent:     `{"errors":[{"code":"NAME_UNKNOWN","message":"no README found for the repository","detail":""}]}`,
+		},
+	} {
+		registry := &readmeBackendMock{readme: "# Hello", err: tc.err}
+		proxy := NewProxy("127.0.0.1:10000", registry, "http://127.0.0.1:1")
+
+		// The second request is served from the cache.
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "/api/repos/some-owner/some-package/readme"+tc.query, nil)
+			res := httptest.NewRecorder()
+			proxy.Handler.ServeHTTP(res, req)
+
+			if res.Code != tc.expectedStatusCode {
+				t.Fatalf("expected: %d, got: %d", tc.expectedStatusCode, res.Code)
+			}
+			if contentType := res.Header().Get("Content-Type"); contentType != tc.expectedContentType {
+				t.Fatalf("expected content type: %s, got: %s", tc.expectedContentType, contentType)
+			}
+			if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+				t.Fatalf("expected: %s, got: %s", tc.expectedContent, res.Body.String())
+			}
+		}
+		if tc.expectedStatusCode != 400 && registry.calls != 1 {
+			t.Fatalf("expected 1 call to the backend, got: %d", registry.calls)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	recordModeRecord = "record"
+	recordModeReplay = "replay"
+)
+
+// interaction is a single HTTP request/response pair stored on disk.
+type interaction struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		Body       string      `json:"body"`
+	} `json:"response"`
+}
+
+// recordingTransport is an http.RoundTripper that either records the responses
+// returned by the next transport to disk or replays previously recorded
+// responses without doing any network call.
+type recordingTransport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+// NewRecordingTransport returns a transport in the given mode ("record" or
+// "replay") that stores interactions in dir.
+func NewRecordingTransport(mode, dir string, next http.RoundTripper) (http.RoundTripper, error) {
+	if mode != recordModeRecord && mode != recordModeReplay {
+		return nil, fmt.Errorf("invalid record mode: %q", mode)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if mode == recordModeRecord {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &recordingTransport{mode: mode, dir: dir, next: next}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only the method, the URL and a hash of the body are used to identify a
+	// request so that no credentials end up on disk.
+	key := req.Method + " " + req.URL.String()
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			bodySum := sha256.Sum256(body)
+			key += " " + hex.EncodeToString(bodySum[:])
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(t.dir, hex.EncodeToString(sum[:8])+".json")
+
+	if t.mode == recordModeReplay {
+		return t.replay(req, path)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var i interaction
+	i.Request.Method = req.Method
+	i.Request.URL = req.URL.String()
+	i.Response.StatusCode = res.StatusCode
+	i.Response.Header = res.Header.Clone()
+	i.Response.Header.Del("Set-Cookie")
+	i.Response.Body = string(body)
+
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return nil, err
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+func (t *recordingTransport) replay(req *http.Request, path string) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, req.URL)
+	}
+
+	var i interaction
+	if err := json.Unmarshal(data, &i); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Response.StatusCode, http.StatusText(i.Response.StatusCode)),
+		StatusCode:    i.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Response.Header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(i.Response.Body))),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func newRecordedGitHubClient(t *testing.T, mode, dir, baseURL string) *github.Client {
+	transport, err := NewRecordingTransport(mode, dir, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	client := github.NewClient(&http.Client{Transport: transport})
+	client.BaseURL, _ = url.Parse(baseURL + "/")
+
+	return client
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name":"some-package","owner":{"login":"some-user"}}]`)
+	}))
+	baseURL := api.URL
+
+	for _, mode := range []string{recordModeRecord, recordModeReplay} {
+		client := newRecordedGitHubClient(t, mode, dir, baseURL)
+		proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client.Users, nil), "http://127.0.0.1/upstream")
+
+		req, _ := http.NewRequest("GET", "/v2/_catalog", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		expectedContent := `{"repositories":["some-user/some-package"]}`
+		if res.Code != 200 {
+			t.Fatalf("%s: expected: %d, got: %d", mode, 200, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", mode, expectedContent, res.Body.String())
+		}
+
+		// Make sure replay does not hit the network.
+		if mode == recordModeRecord {
+			api.Close()
+		}
+	}
+}
+
+func TestRecordRequestBodies(t *testing.T) {
+	dir := t.TempDir()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "response to %s", body)
+	}))
+
+	for _, mode := range []string{recordModeRecord, recordModeReplay} {
+		transport, _ := NewRecordingTransport(mode, dir, nil)
+		client := &http.Client{Transport: transport}
+		for _, body := range []string{"a", "b"} {
+			res, err := client.Post(api.URL+"/graphql", "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("%s: expected no error, got: %s", mode, err)
+			}
+			content, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if expected := "response to " + body; string(content) != expected {
+				t.Fatalf("%s: expected: %s, got: %s", mode, expected, content)
+			}
+		}
+
+		if mode == recordModeRecord {
+			api.Close()
+		}
+	}
+}
+
+func TestReplayMissingInteraction(t *testing.T) {
+	client := newRecordedGitHubClient(t, recordModeReplay, t.TempDir(), "http://127.0.0.1:1")
+
+	_, _, err := client.Users.ListPackages(context.Background(), "", nil)
+	if err == nil || !strings.Contains(err.Error(), "no recorded interaction") {
+		t.Fatalf("expected a missing interaction error, got: %v", err)
+	}
+}
+
+func TestInvalidRecordMode(t *testing.T) {
+	if _, err := NewRecordingTransport("invalid", t.TempDir(), nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The policies of the redirects of the upstream blob responses, e.g. ghcr.io
+// redirecting the blob downloads to its storage.
+const (
+	// blobRedirectPassthrough returns the redirects to the clients, which
+	// download the blobs from the storage.
+	blobRedirectPassthrough = "passthrough"
+	// blobRedirectFollow follows the redirects, the proxy streaming the blobs
+	// to the clients, e.g. when the clients cannot reach the storage.
+	blobRedirectFollow = "follow"
+	// blobRedirectRewrite returns the redirects to the clients, with the host
+	// of the storage replaced, e.g. by an internal HTTP cache.
+	blobRedirectRewrite = "rewrite"
+)
+
+var blobRedirectsTotal = newCounterVec(
+	"blob_redirects_total",
+	"Number of redirects of the upstream blob responses, by target host and policy (passthrough, follow, rewrite).",
+	"host", "policy",
+)
+
+// blobRedirects is the redirect policy of the upstream blob responses.
+type blobRedirects struct {
+	policy string
+	// rewrites are the URLs replacing the scheme and the host of the redirect
+	// targets, by host, with the rewrite policy.
+	rewrites map[string]*url.URL
+	client   *http.Client
+}
+
+// WithBlobRedirects configures the handling of the redirects of the upstream
+// blob responses (passthrough, follow or rewrite), which are passed through by
+// default. The blobs added to the cache are always fetched by following the
+// redirects, since the proxy verifies their digest.
+func WithBlobRedirects(policy string, rewrites map[string]*url.URL) Option {
+	return func(p *containerProxy) {
+		p.blobRedirects = &blobRedirects{policy: policy, rewrites: rewrites}
+	}
+}
+
+// ParseBlobRedirectPolicy validates a redirect policy, passthrough by default.
+func ParseBlobRedirectPolicy(value string) (string, error) {
+	switch value {
+	case "":
+		return blobRedirectPassthrough, nil
+	case blobRedirectPassthrough, blobRedirectFollow, blobRedirectRewrite:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid blob redirect policy: %q", value)
+}
+
+// isBlobRedirect returns whether a response is a redirect of a blob request.
+func isBlobRedirect(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return false
+	}
+	_, kind, _, ok := splitRegistryPath(res.Request.URL.Path)
+	return ok && kind == "blobs"
+}
+
+// modifyResponse applies the redirect policy to an upstream response, see
+// httputil.ReverseProxy.
+func (b *blobRedirects) modifyResponse(res *http.Response) error {
+	if !isBlobRedirect(res) {
+		return nil
+	}
+	location, err := res.Location()
+	if err != nil {
+		return nil
+	}
+	blobRedirectsTotal.Inc(location.Host, b.policy)
+
+	switch b.policy {
+	case blobRedirectRewrite:
+		target, ok := b.rewrites[location.Host]
+		if !ok {
+			return nil
+		}
+		rewritten := *location
+		rewritten.Scheme = target.Scheme
+		rewritten.Host = target.Host
+		rewritten.Path = path.Join("/", target.Path, location.Path)
+		rewritten.RawPath = ""
+		res.Header.Set("Location", rewritten.String())
+
+	case blobRedirectFollow:
+		req, err := http.NewRequestWithContext(res.Request.Context(), res.Request.Method, location.String(), nil)
+		if err != nil {
+			return err
+		}
+		// The credentials of the registry are not sent to the storage, the
+		// redirect URLs being signed.
+		for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+			if value := res.Request.Header.Get(name); value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+		followed, err := b.client.Do(req)
+		if err != nil {
+			log.Printf("WARN cannot follow blob redirect to %s: %s", location.Host, err)
+			return err
+		}
+		res.Body.Close()
+
+		digest := res.Header.Get("Docker-Content-Digest")
+		res.Status = followed.Status
+		res.StatusCode = followed.StatusCode
+		res.Header = followed.Header
+		res.Body = followed.Body
+		res.ContentLength = followed.ContentLength
+		if digest != "" {
+			res.Header.Set("Docker-Content-Digest", digest)
+		}
+	}
+	return nil
+}
+
+// countBlobRedirects counts the redirects followed by the proxy for the blob
+// requests, see http.Client.
+func countBlobRedirects(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if _, kind, _, ok := splitRegistryPath(via[0].URL.Path); ok && kind == "blobs" && !strings.EqualFold(req.URL.Host, via[len(via)-1].URL.Host) {
+		blobRedirectsTotal.Inc(req.URL.Host, blobRedirectFollow)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBlobRedirects(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("blob from " + r.URL.Path))
+	}))
+	defer storage.Close()
+	storageURL, _ := url.Parse(storage.URL)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:1234")
+		http.Redirect(w, r, storage.URL+"/container/sha256:1234?sig=signed", http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+
+	mirror, _ := url.Parse("https://blobs.internal.example.com/mirror")
+	for _, tc := range []struct {
+		policy           string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{policy: blobRedirectPassthrough, expectedStatus: http.StatusTemporaryRedirect, expectedLocation: storage.URL + "/container/sha256:1234?sig=signed"},
+		{policy: blobRedirectRewrite, expectedStatus: http.StatusTemporaryRedirect, expectedLocation: "https://blobs.internal.example.com/mirror/container/sha256:1234?sig=signed"},
+		{policy: blobRedirectFollow, expectedStatus: http.StatusOK, expectedBody: "blob from /container/sha256:1234"},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobRedirects(tc.policy, map[string]*url.URL{storageURL.Host: mirror}))
+		before := blobRedirectsTotal.Value(storageURL.Host, tc.policy)
+
+		req := httptest.NewRequest("GET", "/v2/my-org/app/blobs/sha256:1234", nil)
+		req.Header.Set("Authorization", "Bearer client-token")
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatus {
+			t.Fatalf("%s: expected: %d, got: %d", tc.policy, tc.expectedStatus, res.Code)
+		}
+		if location := res.Header().Get("Location"); location != tc.expectedLocation {
+			t.Fatalf("%s: expected location: %q, got: %q", tc.policy, tc.expectedLocation, location)
+		}
+		if !strings.HasPrefix(res.Body.String(), tc.expectedBody) {
+			t.Fatalf("%s: expected body: %q, got: %q", tc.policy, tc.expectedBody, res.Body.String())
+		}
+		if tc.policy == blobRedirectFollow && res.Header().Get("Docker-Content-Digest") != "sha256:1234" {
+			t.Fatalf("%s: expected the digest header to be kept", tc.policy)
+		}
+		if blobRedirectsTotal.Value(storageURL.Host, tc.policy) != before+1 {
+			t.Fatalf("%s: expected the redirect to be counted", tc.policy)
+		}
+	}
+
+	// The redirects of the other requests are not handled.
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobRedirects(blobRedirectFollow, nil))
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/v2/my-org/app/manifests/latest", nil))
+	if res.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected: %d, got: %d", http.StatusTemporaryRedirect, res.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// referrersIndex is the response of the referrers API. The descriptors are
+// kept as is, with the fields unknown to the proxy.
+type referrersIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []json.RawMessage `json:"manifests"`
+}
+
+// splitReferrersPath splits a `/v2/<name>/referrers/<digest>` path.
+func splitReferrersPath(path string) (name, digest string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, "/referrers/")
+	if i <= 0 {
+		return "", "", false
+	}
+	name, digest = rest[:i], rest[i+len("/referrers/"):]
+	if !sha256DigestPattern.MatchString(digest) {
+		return "", "", false
+	}
+	return name, digest, true
+}
+
+// filterReferrers returns the descriptors of an index whose artifact type is
+// artifactType.
+func filterReferrers(manifests []json.RawMessage, artifactType string) []json.RawMessage {
+	filtered := []json.RawMessage{}
+	for _, raw := range manifests {
+		var d descriptor
+		if err := json.Unmarshal(raw, &d); err == nil && d.ArtifactType == artifactType {
+			filtered = append(filtered, raw)
+		}
+	}
+	return filtered
+}
+
+// referrers is a middleware implementing the referrers API of the OCI
+// distribution specification, used by Notation and cosign, on top of upstream
+// registries that don't support it (e.g. GHCR). The referrers are then read
+// from the referrers tag schema (`sha256-<hex>` index), which these clients
+// maintain when the registry does not return an `OCI-Subject` header on
+// manifest pushes. The artifactType filter is applied when the upstream
+// registry did not apply it.
+func referrers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, digest, ok := splitReferrersPath(r.URL.Path)
+		if !ok || r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		artifactType := r.URL.Query().Get("artifactType")
+
+		upstream := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(upstream, r)
+		switch upstream.statusCode {
+		case http.StatusOK:
+			if artifactType == "" || strings.Contains(upstream.header.Get("OCI-Filters-Applied"), "artifactType") {
+				upstream.sendTo(w)
+				return
+			}
+			var index referrersIndex
+			if err := json.Unmarshal(upstream.body.Bytes(), &index); err != nil {
+				upstream.sendTo(w)
+				return
+			}
+			writeReferrers(w, r, filterReferrers(index.Manifests, artifactType), artifactType)
+			return
+		case http.StatusNotFound, http.StatusMethodNotAllowed:
+			// The registry does not support the referrers API.
+		default:
+			upstream.sendTo(w)
+			return
+		}
+
+		tagRequest := r.Clone(r.Context())
+		tagRequest.URL.Path = "/v2/" + name + "/manifests/" + strings.Replace(digest, ":", "-", 1)
+		tagRequest.URL.RawPath = ""
+		tagRequest.URL.RawQuery = ""
+		tagRequest.RequestURI = ""
+		tagRequest.Header.Set("Accept", mediaTypeOCIIndex)
+
+		tag := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(tag, tagRequest)
+		var index referrersIndex
+		switch tag.statusCode {
+		case http.StatusOK:
+			if err := json.Unmarshal(tag.body.Bytes(), &index); err != nil {
+				log.Printf("WARN invalid referrers tag of %s@%s: %s", name, digest, err)
+			}
+		case http.StatusNotFound:
+			// No referrers.
+		default:
+			tag.sendTo(w)
+			return
+		}
+
+		manifests := index.Manifests
+		if manifests == nil {
+			manifests = []json.RawMessage{}
+		}
+		if artifactType != "" {
+			manifests = filterReferrers(manifests, artifactType)
+		}
+		writeReferrers(w, r, manifests, artifactType)
+	})
+}
+
+func writeReferrers(w http.ResponseWriter, r *http.Request, manifests []json.RawMessage, artifactType string) {
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	writeRegistryJSON(w, r, mediaTypeOCIIndex, referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIIndex,
+		Manifests:     manifests,
+	})
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReferrers(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	index := fmt.Sprintf(
+		`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":"sha256:1111","artifactType":"application/vnd.cncf.notary.signature","annotations":{"a":"b"}},{"mediaType":%q,"digest":"sha256:2222","artifactType":"application/spdx+json"}]}`,
+		mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeOCIManifest,
+	)
+
+	for _, tc := range []struct {
+		name              string
+		referrersAPI      bool
+		referrersTag      bool
+		query             string
+		expectedDigests   []string
+		expectedFiltering bool
+	}{
+		{name: "tag schema", referrersTag: true, expectedDigests: []string{"sha256:1111", "sha256:2222"}},
+		{
+			name:              "tag schema with filter",
+			referrersTag:      true,
+			query:             "?artifactType=application/vnd.cncf.notary.signature",
+			expectedDigests:   []string{"sha256:1111"},
+			expectedFiltering: true,
+		},
+		{name: "no referrers", expectedDigests: []string{}},
+		{
+			name:              "referrers API without filtering",
+			referrersAPI:      true,
+			query:             "?artifactType=application/spdx%2Bjson",
+			expectedDigests:   []string{"sha256:2222"},
+			expectedFiltering: true,
+		},
+	} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v2/some-owner/some-package/referrers/" + digest:
+				if !tc.referrersAPI {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", mediaTypeOCIIndex)
+				fmt.Fprint(w, index)
+			case "/v2/some-owner/some-package/manifests/" + strings.Replace(digest, ":", "-", 1):
+				if !tc.referrersTag {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", mediaTypeOCIIndex)
+				fmt.Fprint(w, index)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL)
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/referrers/"+digest+tc.query, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		upstream.Close()
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.name, http.StatusOK, res.Code)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != mediaTypeOCIIndex {
+			t.Fatalf("%s: expected: %s, got: %s", tc.name, mediaTypeOCIIndex, contentType)
+		}
+		if filtered := res.Header().Get("OCI-Filters-Applied") == "artifactType"; filtered != tc.expectedFiltering {
+			t.Fatalf("%s: expected: %t, got: %t", tc.name, tc.expectedFiltering, filtered)
+		}
+
+		var m manifest
+		if err := json.Unmarshal(res.Body.Bytes(), &m); err != nil {
+			t.Fatalf("%s: invalid index: %s", tc.name, err)
+		}
+		digests := []string{}
+		for _, d := range m.Manifests {
+			digests = append(digests, d.Digest)
+		}
+		if fmt.Sprint(digests) != fmt.Sprint(tc.expectedDigests) {
+			t.Fatalf("%s: expected: %v, got: %v", tc.name, tc.expectedDigests, digests)
+		}
+		// The descriptors are not altered.
+		if len(m.Manifests) > 0 && m.Manifests[0].Digest == "sha256:1111" && m.Manifests[0].Annotations["a"] != "b" {
+			t.Fatalf("%s: expected the annotations to be kept", tc.name)
+		}
+	}
+}
+
+func TestOCISubjectPassThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("OCI-Subject", "sha256:1234")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL)
+	req, _ := http.NewRequest("PUT", "/v2/some-owner/some-package/manifests/sha256:5678", strings.NewReader(`{}`))
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if subject := res.Header().Get("OCI-Subject"); subject != "sha256:1234" {
+		t.Fatalf("expected: %s, got: %s", "sha256:1234", subject)
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUpstreamTokenLifetime is the lifetime of the upstream tokens
+	// returned without `expires_in`, as defined by the token authentication
+	// specification.
+	defaultUpstreamTokenLifetime = 60 * time.Second
+	// upstreamTokenRefreshMargin is the remaining lifetime below which a cached
+	// upstream token is refreshed.
+	upstreamTokenRefreshMargin = 10 * time.Second
+	// maxCachedUpstreamTokens limits the number of upstream tokens cached by a
+	// transport.
+	maxCachedUpstreamTokens = 10000
+)
+
+var upstreamTokenCacheRequestsTotal = newCounterVec(
+	"upstream_token_cache_requests_total",
+	"Number of lookups of the cached upstream tokens by result (hit, miss, refresh).",
+	"result",
+)
+
+// parseChallenge parses a `WWW-Authenticate` header value, e.g.
+// `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="..."`.
+func parseChallenge(value string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	for rest != "" {
+		var key, val string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			val, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = val
+		}
+	}
+
+	return strings.ToLower(scheme), params
+}
+
+// fetchToken requests a bearer token to the realm of a challenge, optionally
+// authenticated with basic credentials. It returns the token and its lifetime.
+func fetchToken(ctx context.Context, client *http.Client, params map[string]string, username, password string) (string, time.Duration, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", 0, fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return "", 0, fmt.Errorf("token request to %s failed: %s", realm.Host, res.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	// The tokens are valid for 60 seconds when the lifetime is not returned.
+	lifetime := defaultUpstreamTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if body.Token != "" {
+		return body.Token, lifetime, nil
+	}
+	return body.AccessToken, lifetime, nil
+}
+
+// cachedToken is a token of an upstream registry, along with the challenge
+// used to refresh it.
+type cachedToken struct {
+	token   string
+	params  map[string]string
+	expires time.Time
+}
+
+// tokenCacheKey returns the key of the token of a request, i.e. its host, its
+// repository and whether it reads or writes, the scope of the token depending
+// on them.
+func tokenCacheKey(req *http.Request) string {
+	name, _ := repositoryFromPath(req.URL.Path)
+	access := "pull"
+	if req.Method != "GET" && req.Method != "HEAD" {
+		access = "push"
+	}
+	return req.URL.Host + " " + name + " " + access
+}
+
+// tokenTransport is an http.RoundTripper authenticating requests to an upstream
+// registry on behalf of the clients, i.e. the credentials sent by the clients
+// are replaced by a token obtained by the proxy. The tokens are cached by
+// scope, and refreshed shortly before they expire, so that the token exchange
+// is not done for each request.
+type tokenTransport struct {
+	next     http.RoundTripper
+	username string
+	password string
+	// credentials replace username and password for the registries and
+	// repositories they match.
+	credentials []UpstreamCredential
+	// settings are the settings of the upstream registries, for the requests
+	// whose context carries none (e.g. the background requests).
+	settings *upstreamSettingsRegistry
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+// credentialsFor returns the credentials used for a request.
+func (t *tokenTransport) credentialsFor(req *http.Request) (string, string, error) {
+	if credential, ok := upstreamCredential(t.credentials, req); ok {
+		password, err := credential.password(req.Context())
+		return credential.Username, password, err
+	}
+	password, err := resolveSecret(req.Context(), t.password)
+	return t.username, password, err
+}
+
+// token returns the cached token of a request, refreshed when it is about to
+// expire.
+func (t *tokenTransport) token(next http.RoundTripper, req *http.Request, key string) (string, bool) {
+	t.mu.Lock()
+	cached, ok := t.tokens[key]
+	t.mu.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		upstreamTokenCacheRequestsTotal.Inc("miss")
+		return "", false
+	}
+	if time.Until(cached.expires) > upstreamTokenRefreshMargin {
+		upstreamTokenCacheRequestsTotal.Inc("hit")
+		return cached.token, true
+	}
+
+	upstreamTokenCacheRequestsTotal.Inc("refresh")
+	token, err := t.fetch(next, req, key, cached.params)
+	if err != nil {
+		// The current token is still valid.
+		return cached.token, true
+	}
+	return token, true
+}
+
+// fetch requests a token for a challenge and caches it.
+func (t *tokenTransport) fetch(next http.RoundTripper, req *http.Request, key string, params map[string]string) (string, error) {
+	username, password, err := t.credentialsFor(req)
+	if err != nil {
+		return "", err
+	}
+	token, lifetime, err := fetchToken(req.Context(), &http.Client{Transport: next}, params, username, password)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = map[string]cachedToken{}
+	}
+	now := time.Now()
+	if len(t.tokens) >= maxCachedUpstreamTokens {
+		for k, cached := range t.tokens {
+			if now.After(cached.expires) {
+				delete(t.tokens, k)
+			}
+		}
+	}
+	if len(t.tokens) < maxCachedUpstreamTokens {
+		t.tokens[key] = cachedToken{token: token, params: params, expires: now.Add(upstreamSettingsFrom(req.Context()).tokenLifetime(req.URL.Host, lifetime))}
+	}
+	return token, nil
+}
+
+func (t *tokenTransport) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, key)
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = &tracingTransport{}
+	}
+
+	ctx := req.Context()
+	if t.settings != nil && upstreamSettingsFrom(ctx) == nil {
+		ctx = withUpstreamSettings(ctx, t.settings)
+	}
+	req = req.Clone(ctx)
+	req.Header.Del("Authorization")
+	// The requests with a body are replayed when it can be read again, e.g.
+	// the manifest pushes.
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	key := tokenCacheKey(req)
+	if token, ok := t.token(next, req, key); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := next.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusUnauthorized || !replayable {
+			return res, err
+		}
+		// The token has been revoked or does not grant the access anymore.
+		t.forget(key)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		req.Header.Del("Authorization")
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized || !replayable {
+		return res, err
+	}
+
+	scheme, params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "bearer":
+		token, err := t.fetch(next, req, key, params)
+		if err != nil {
+			log.Printf("WARN cannot authenticate with %s: %s", req.URL.Host, redact(err.Error()))
+			return res, nil
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		// Only the scoped credentials are sent to the registries using basic
+		// authentication, e.g. a self-hosted registry.
+		credential, ok := upstreamCredential(t.credentials, req)
+		if !ok {
+			return res, nil
+		}
+		password, err := credential.password(req.Context())
+		if err != nil {
+			log.Printf("WARN cannot authenticate with %s: %s", req.URL.Host, redact(err.Error()))
+			return res, nil
+		}
+		req.SetBasicAuth(credential.Username, password)
+	default:
+		return res, nil
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err := rewindBody(req); err != nil {
+		return nil, err
+	}
+
+	return next.RoundTrip(req)
+}
+
+// rewindBody resets the body of a request to replay it.
+func rewindBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
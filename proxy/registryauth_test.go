@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTokenTransportCachesTokens(t *testing.T) {
+	var mu sync.Mutex
+	issued := 0
+	scopes := []string{}
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/token" {
+			issued++
+			scopes = append(scopes, r.URL.Query().Get("scope"))
+			// A short lifetime so that the tokens are refreshed.
+			expiresIn := 3600
+			if strings.Contains(r.URL.Query().Get("scope"), "short") {
+				expiresIn = 5
+			}
+			fmt.Fprintf(w, `{"token":"token-%d","expires_in":%d}`, issued, expiresIn)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+			name, _ := repositoryFromPath(r.URL.Path)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, upstream.URL, name))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer token-revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+
+	transport := &tokenTransport{next: http.DefaultTransport}
+	client := &http.Client{Transport: transport}
+	get := func(path string) int {
+		res, err := client.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := get("/v2/owner/image/manifests/latest"); status != http.StatusOK {
+			t.Fatalf("expected: %d, got: %d", http.StatusOK, status)
+		}
+		get("/v2/owner/image/blobs/sha256:1234")
+	}
+	if issued != 1 {
+		t.Fatalf("expected a single token exchange, got: %d", issued)
+	}
+
+	// The tokens are cached by scope.
+	get("/v2/owner/other/manifests/latest")
+	if issued != 2 || scopes[1] != "repository:owner/other:pull" {
+		t.Fatalf("expected a token for the other repository, got: %v", scopes)
+	}
+
+	// The tokens about to expire are refreshed with the cached challenge.
+	get("/v2/owner/short/manifests/latest")
+	get("/v2/owner/short/manifests/latest")
+	if issued != 4 {
+		t.Fatalf("expected the token to be refreshed, got: %d token exchanges", issued)
+	}
+
+	// The tokens rejected by the upstream registry are exchanged again.
+	key := tokenCacheKey(httptest.NewRequest("GET", upstream.URL+"/v2/owner/image/manifests/latest", nil))
+	transport.mu.Lock()
+	cached := transport.tokens[key]
+	cached.token = "revoked"
+	transport.tokens[key] = cached
+	transport.mu.Unlock()
+	if status := get("/v2/owner/image/manifests/latest"); status != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, status)
+	}
+	if issued != 5 {
+		t.Fatalf("expected a new token exchange, got: %d", issued)
+	}
+}
+
+func TestTokenTransportScopedCredentials(t *testing.T) {
+	var mu sync.Mutex
+	users := []string{}
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/token" {
+			username, password, _ := r.BasicAuth()
+			users = append(users, username+":"+password)
+			fmt.Fprint(w, `{"token":"token"}`)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v2/basic/") {
+			if username, password, ok := r.BasicAuth(); !ok || username != "basic-user" || password != "from-file" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	passwordFile := t.TempDir() + "/password"
+	os.WriteFile(passwordFile, []byte("from-file\n"), 0o600)
+	t.Setenv("OTHER_ORG_TOKEN", "from-env")
+
+	client := &http.Client{Transport: &tokenTransport{
+		next:     http.DefaultTransport,
+		username: "default",
+		password: "default-password",
+		credentials: []UpstreamCredential{
+			{Registry: host, Repository: "other-org/*", Username: "other", PasswordEnv: "OTHER_ORG_TOKEN"},
+			{Registry: host, Repository: "basic/*", Username: "basic-user", PasswordFile: passwordFile},
+			{Registry: "elsewhere.example.com", Username: "elsewhere", PasswordEnv: "OTHER_ORG_TOKEN"},
+		},
+	}}
+	for _, tc := range []struct {
+		path         string
+		expectedUser string
+	}{
+		{path: "/v2/my-org/image/manifests/latest", expectedUser: "default:default-password"},
+		{path: "/v2/other-org/image/manifests/latest", expectedUser: "other:from-env"},
+		{path: "/v2/basic/image/manifests/latest"},
+	} {
+		users = nil
+		res, err := client.Get(upstream.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, http.StatusOK, res.StatusCode)
+		}
+		if tc.expectedUser != "" && (len(users) != 1 || users[0] != tc.expectedUser) {
+			t.Fatalf("%s: expected: %s, got: %v", tc.path, tc.expectedUser, users)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// manifestAccept is the list of manifest media types accepted by the proxy when
+// it fetches manifests from an upstream registry.
+var manifestAccept = strings.Join([]string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}, ", ")
+
+// errManifestUnknown is returned when a manifest does not exist upstream.
+var errManifestUnknown = errors.New("manifest unknown")
+
+// registryClient is a minimal client of the Docker Registry HTTP API V2 used by
+// the proxy to inspect the content of an upstream registry with its own
+// credentials.
+type registryClient struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+func newRegistryClient(baseURL *url.URL, transport *tokenTransport) *registryClient {
+	return &registryClient{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+// GetManifest returns a manifest along with its media type and digest.
+func (c *registryClient) GetManifest(ctx context.Context, name, reference string) ([]byte, string, string, error) {
+	u := c.baseURL.JoinPath("v2", name, "manifests", reference)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, "", "", fmt.Errorf("GetManifest %s:%s: %w", name, reference, errManifestUnknown)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("GetManifest %s:%s: %s", name, reference, res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return body, res.Header.Get("Content-Type"), res.Header.Get("Docker-Content-Digest"), nil
+}
+
+// ManifestDigest returns the digest of a manifest, without fetching it.
+func (c *registryClient) ManifestDigest(ctx context.Context, name, reference string) (string, error) {
+	u := c.baseURL.JoinPath("v2", name, "manifests", reference)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", fmt.Errorf("ManifestDigest %s:%s: %w", name, reference, errManifestUnknown)
+	default:
+		return "", fmt.Errorf("ManifestDigest %s:%s: %s", name, reference, res.Status)
+	}
+}
+
+// GetBlob returns the content of a blob and its size, which the caller must
+// close.
+func (c *registryClient) GetBlob(ctx context.Context, name, digest string) (io.ReadCloser, int64, error) {
+	u := c.baseURL.JoinPath("v2", name, "blobs", digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("GetBlob %s@%s: %s", name, digest, res.Status)
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// Referrers returns the manifests referring to a digest, e.g. its signatures,
+// using the referrers API of the OCI distribution specification. It returns
+// errManifestUnknown when the registry does not support the API.
+func (c *registryClient) Referrers(ctx context.Context, name, digest string) ([]descriptor, error) {
+	u := c.baseURL.JoinPath("v2", name, "referrers", digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mediaTypeOCIIndex)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Referrers %s@%s: %w", name, digest, errManifestUnknown)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Referrers %s@%s: %s", name, digest, res.Status)
+	}
+
+	var index manifest
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxManifestSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("Referrers %s@%s: %w", name, digest, err)
+	}
+	return index.Manifests, nil
+}
+
+// HasBlob returns true when a blob exists in a repository.
+func (c *registryClient) HasBlob(ctx context.Context, name, digest string) (bool, error) {
+	u := c.baseURL.JoinPath("v2", name, "blobs", digest)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("HasBlob %s@%s: %s", name, digest, res.Status)
+	}
+}
+
+// PushBlob uploads a blob to a repository, in a single request after the
+// upload is started (monolithic upload).
+func (c *registryClient) PushBlob(ctx context.Context, name, digest string, size int64, body io.Reader) error {
+	// The uploads are started at `/v2/<name>/blobs/uploads/`, with the
+	// trailing slash.
+	u := c.baseURL.JoinPath("v2", name, "blobs", "uploads/")
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("PushBlob %s@%s: %s", name, digest, res.Status)
+	}
+
+	location, err := u.Parse(res.Header.Get("Location"))
+	if err != nil || res.Header.Get("Location") == "" {
+		return fmt.Errorf("PushBlob %s@%s: invalid upload location", name, digest)
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	req, err = http.NewRequestWithContext(ctx, "PUT", location.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err = c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("PushBlob %s@%s: %s", name, digest, res.Status)
+	}
+	return nil
+}
+
+// PutManifest pushes a manifest to a repository, and returns its digest.
+func (c *registryClient) PutManifest(ctx context.Context, name, reference, mediaType string, body []byte) (string, error) {
+	u := c.baseURL.JoinPath("v2", name, "manifests", reference)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("PutManifest %s:%s: %s", name, reference, res.Status)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
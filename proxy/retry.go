@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxUpstreamRetries is the number of retries of a failed upstream
+	// request.
+	maxUpstreamRetries = 2
+	// upstreamRetryBackoff is the maximum delay before the first retry, doubled
+	// for each retry, the actual delay being random (full jitter).
+	upstreamRetryBackoff = 100 * time.Millisecond
+	// maxUpstreamRetryDelay caps the maximum delay before a retry.
+	maxUpstreamRetryDelay = time.Minute
+)
+
+var (
+	upstreamRetriesTotal = newCounterVec(
+		"upstream_retries_total",
+		"Number of upstream requests retried, by host and reason (error, 502, 503).",
+		"host", "reason",
+	)
+	upstreamRetriesSkippedTotal = newCounterVec(
+		"upstream_retries_skipped_total",
+		"Number of failed upstream requests not retried because the retry budget is exhausted, by host.",
+		"host",
+	)
+)
+
+// retryBudget limits the share of the upstream requests that are retries, so
+// that the retries do not overload a degraded upstream registry. Each request
+// deposits ratio tokens, and each retry withdraws one.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+func newRetryBudget(ratio, max float64) *retryBudget {
+	return &retryBudget{tokens: max, max: max, ratio: ratio}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// upstreamRetryBudget allows bursts of 10 retries and 10% of retries over
+// time, for all the upstreams.
+var upstreamRetryBudget = newRetryBudget(0.1, 10)
+
+// retryTransport is an http.RoundTripper retrying the idempotent requests for
+// manifests and blobs (GET and HEAD) failing with a network error (e.g. a
+// connection reset) or a 502 or 503 status, with a jittered exponential
+// backoff.
+type retryTransport struct {
+	next   http.RoundTripper
+	budget *retryBudget
+}
+
+// retryReason returns why a request should be retried, if it should.
+func retryReason(res *http.Response, err error) (string, bool) {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return "", false
+		}
+		return "error", true
+	}
+	if res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable {
+		return strconv.Itoa(res.StatusCode), true
+	}
+	return "", false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = &instrumentedTransport{}
+	}
+	budget := t.budget
+	if budget == nil {
+		budget = upstreamRetryBudget
+	}
+
+	_, kind, _, ok := splitRegistryPath(req.URL.Path)
+	idempotent := (req.Method == "GET" || req.Method == "HEAD") && (req.Body == nil || req.Body == http.NoBody)
+	if !ok || (kind != "manifests" && kind != "blobs") || !idempotent {
+		return next.RoundTrip(req)
+	}
+
+	retries, backoff := upstreamSettingsFrom(req.Context()).retries(req.URL.Host)
+	budget.deposit()
+	for attempt := 0; ; attempt++ {
+		res, err := next.RoundTrip(req.Clone(req.Context()))
+		reason, retry := retryReason(res, err)
+		if !retry || attempt >= retries {
+			return res, err
+		}
+		if !budget.withdraw() {
+			upstreamRetriesSkippedTotal.Inc(req.URL.Host)
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		upstreamRetriesTotal.Inc(req.URL.Host, reason)
+
+		delay := time.Duration(rand.Int63n(int64(retryDelay(backoff, attempt))))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryDelay returns the maximum delay before a retry: the backoff doubled for
+// each previous retry, capped so that it cannot overflow.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	delay := backoff
+	for i := 0; i < attempt && delay < maxUpstreamRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxUpstreamRetryDelay {
+		delay = maxUpstreamRetryDelay
+	}
+	return delay
+}
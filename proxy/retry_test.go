@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetryTransport(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.Method+" "+r.URL.Path]++
+		n := attempts[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+
+		switch {
+		case strings.Contains(r.URL.Path, "reset") && n == 1:
+			// Close the connection without response.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case strings.Contains(r.URL.Path, "flaky") && n == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case strings.Contains(r.URL.Path, "down"):
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	client := &http.Client{Transport: &retryTransport{budget: newRetryBudget(0.1, 10)}}
+	do := func(method, path string) int {
+		req, _ := http.NewRequestWithContext(withTestEgress(context.Background()), method, upstream.URL+path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	before := upstreamRetriesTotal.Value(host, "503")
+	for _, tc := range []struct {
+		method           string
+		path             string
+		expectedStatus   int
+		expectedAttempts int
+	}{
+		{method: "GET", path: "/v2/owner/flaky/manifests/latest", expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{method: "HEAD", path: "/v2/owner/reset/blobs/sha256:1234", expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{method: "GET", path: "/v2/owner/down/blobs/sha256:1234", expectedStatus: http.StatusBadGateway, expectedAttempts: 1 + maxUpstreamRetries},
+		// Only the idempotent requests for manifests and blobs are retried.
+		{method: "PUT", path: "/v2/owner/flaky/manifests/latest", expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 1},
+		{method: "GET", path: "/v2/owner/flaky/tags/list", expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 1},
+	} {
+		if status := do(tc.method, tc.path); status != tc.expectedStatus {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatus, status)
+		}
+		if n := attempts[tc.method+" "+tc.path]; n != tc.expectedAttempts {
+			t.Fatalf("%s %s: expected %d attempts, got: %d", tc.method, tc.path, tc.expectedAttempts, n)
+		}
+	}
+	if upstreamRetriesTotal.Value(host, "503") != before+1 {
+		t.Fatal("expected the retry to be counted")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	budget := newRetryBudget(0.5, 1)
+	client := &http.Client{Transport: &retryTransport{budget: budget}}
+	before := upstreamRetriesSkippedTotal.Value(host)
+
+	// The first request uses the whole budget.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(withTestEgress(context.Background()), "GET", upstream.URL+"/v2/owner/app/manifests/latest", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if skipped := upstreamRetriesSkippedTotal.Value(host) - before; skipped != 2 {
+		t.Fatalf("expected: 2, got: %g", skipped)
+	}
+}
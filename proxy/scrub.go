@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+var blobCacheScrubbedTotal = newCounterVec(
+	"blob_cache_scrubbed_blobs_total",
+	"Number of cached blobs verified by the scrubber by result (ok, corrupted, refetched, error).",
+	"result",
+)
+
+// WithBlobCacheScrub verifies the digests of the cached blobs at the times of
+// the schedule. The corrupted blobs are moved to the quarantine directory of
+// the cache and fetched again.
+func WithBlobCacheScrub(schedule *CronSchedule) Option {
+	return func(p *containerProxy) {
+		p.cacheScrub = schedule
+	}
+}
+
+// runCacheScrub starts the scrubber of the blob cache. It runs on all the
+// replicas, whose caches are on their own disks.
+func (p *containerProxy) runCacheScrub(ctx context.Context) {
+	go runCronJob(ctx, alwaysLeader{}, p.jobs, "cache-scrub", p.cacheScrub, p.scrubBlobCache)
+}
+
+// scrubBlobCache verifies the digests of the cached blobs, quarantines the
+// corrupted ones and fetches them again from the peers, if any. Otherwise,
+// they are fetched from the upstream registry on the next pull, since the
+// cache does not know the repositories of the blobs.
+func (p *containerProxy) scrubBlobCache(ctx context.Context, run *jobRun) error {
+	blobs, err := p.blobCache.List()
+	if err != nil {
+		return err
+	}
+
+	corrupted := 0
+	for _, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := p.blobCache.Verify(blob.Digest)
+		switch {
+		case err == nil:
+			blobCacheScrubbedTotal.Inc("ok")
+			continue
+		case errors.Is(err, os.ErrNotExist):
+			// Removed since the listing, e.g. by the garbage collection.
+			continue
+		case !errors.Is(err, cache.ErrInvalidDigest):
+			blobCacheScrubbedTotal.Inc("error")
+			log.Printf("WARN cached blob %s not verified: %s", blob.Digest, err)
+			run.outcome(blob.Digest, err)
+			continue
+		}
+
+		corrupted++
+		blobCacheScrubbedTotal.Inc("corrupted")
+		path, qerr := p.blobCache.Quarantine(blob.Digest)
+		if qerr != nil {
+			log.Printf("WARN corrupted blob %s not quarantined: %s", blob.Digest, qerr)
+			os.Remove(p.blobCache.Path(blob.Digest))
+		} else {
+			log.Printf("WARN cached blob %s is corrupted, quarantined in %s: %s", blob.Digest, path, err)
+		}
+		if p.refetchFromPeer(ctx, blob.Digest) {
+			blobCacheScrubbedTotal.Inc("refetched")
+		}
+		run.outcome(blob.Digest, err)
+	}
+
+	if corrupted > 0 {
+		return fmt.Errorf("%d corrupted blobs quarantined", corrupted)
+	}
+	return nil
+}
+
+// refetchFromPeer adds a blob to the cache from a peer having it, and returns
+// whether it did.
+func (p *containerProxy) refetchFromPeer(ctx context.Context, digest string) bool {
+	if p.peers == nil {
+		return false
+	}
+	u, ok := p.peers.find(ctx, p.tenant, digest)
+	if !ok {
+		return false
+	}
+	res, err := p.peers.request(ctx, "GET", u)
+	if err != nil {
+		log.Printf("WARN blob %s not fetched from peer: %s", digest, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+
+	w, err := p.blobCache.Create(digest, res.ContentLength)
+	if err != nil {
+		return false
+	}
+	if _, err := io.Copy(w, res.Body); err != nil {
+		w.Abort()
+		return false
+	}
+	if err := w.Commit(); err != nil {
+		log.Printf("WARN blob %s not fetched from peer: %s", digest, err)
+		return false
+	}
+	return true
+}
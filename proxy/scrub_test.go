@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestScrubBlobCache(t *testing.T) {
+	content := []byte("some blob")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	healthy := []byte("healthy blob")
+	healthyDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(healthy))
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/blobs/"+digest {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		peers     *PeerSet
+		refetched bool
+	}{
+		{peers: nil},
+		{peers: NewStaticPeers("", []string{peer.URL}, "some-secret"), refetched: true},
+	} {
+		dir := t.TempDir()
+		p := &containerProxy{blobCache: cache.New(dir), peers: tc.peers}
+		for _, blob := range [][]byte{content, healthy} {
+			w, err := p.blobCache.Create(fmt.Sprintf("sha256:%x", sha256.Sum256(blob)), int64(len(blob)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(blob)
+			if err := w.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The disk lies.
+		os.WriteFile(p.blobCache.Path(digest), []byte("some blub"), 0o644)
+
+		before := blobCacheScrubbedTotal.Value("corrupted")
+		if err := p.scrubBlobCache(context.Background(), nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		if blobCacheScrubbedTotal.Value("corrupted") != before+1 {
+			t.Fatal("expected a corrupted blob")
+		}
+		if p.blobCache.Has(digest) != tc.refetched {
+			t.Fatalf("expected the blob to be refetched: %t", tc.refetched)
+		}
+		if tc.refetched && p.blobCache.Verify(digest) != nil {
+			t.Fatal("expected the refetched blob to be valid")
+		}
+		if !p.blobCache.Has(healthyDigest) {
+			t.Fatal("expected the healthy blob to be kept")
+		}
+		if entries, _ := os.ReadDir(filepath.Join(dir, "quarantine")); len(entries) != 1 {
+			t.Fatalf("expected a quarantined blob, got: %d", len(entries))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// defaultSecretRefreshInterval is the interval between the fetches of a
+	// secret stored in a secret manager, unless SECRET_REFRESH_INTERVAL is set.
+	defaultSecretRefreshInterval = 5 * time.Minute
+	// secretFetchTimeout is the timeout of a secret fetch.
+	secretFetchTimeout = 10 * time.Second
+	// maxSecretResponseSize limits the size of the secret manager responses.
+	maxSecretResponseSize = 1024 * 1024
+)
+
+var secretFetchesTotal = newCounterVec(
+	"secret_fetches_total",
+	"Number of fetches of the secrets stored in secret managers, by provider (vault, aws-sm) and result (ok, error).",
+	"provider", "result",
+)
+
+// secretProviders fetch the secrets referenced by `<provider>:<reference>`.
+var secretProviders = map[string]func(ctx context.Context, reference string) (string, error){
+	"vault":  fetchVaultSecret,
+	"aws-sm": fetchAWSSecret,
+}
+
+// isSecretReference returns whether a value references a secret stored in a
+// secret manager, e.g. `vault:secret/data/proxy#github_token` or
+// `aws-sm:proxy/github-token`, instead of being the secret itself.
+func isSecretReference(value string) bool {
+	provider, _, ok := strings.Cut(value, ":")
+	_, known := secretProviders[provider]
+	return ok && known
+}
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// secretCache keeps the secrets fetched from the secret managers, which are
+// fetched again after an interval so that the rotated secrets are used
+// without restarting the proxy.
+type secretCache struct {
+	mu       sync.Mutex
+	interval time.Duration
+	secrets  map[string]cachedSecret
+}
+
+var secrets = &secretCache{interval: defaultSecretRefreshInterval, secrets: map[string]cachedSecret{}}
+
+// resolve returns the secret referenced by a value, or the value itself when
+// it is not a reference. A secret that cannot be fetched again is used until
+// it can.
+func (c *secretCache) resolve(ctx context.Context, value string) (string, error) {
+	if !isSecretReference(value) {
+		return value, nil
+	}
+
+	c.mu.Lock()
+	cached, ok := c.secrets[value]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < c.interval {
+		return cached.value, nil
+	}
+
+	provider, reference, _ := strings.Cut(value, ":")
+	ctx, cancel := context.WithTimeout(ctx, secretFetchTimeout)
+	defer cancel()
+	secret, err := secretProviders[provider](ctx, reference)
+	if err != nil {
+		secretFetchesTotal.Inc(provider, "error")
+		err = fmt.Errorf("cannot fetch secret %s: %w", value, err)
+		if ok {
+			log.Printf("WARN %s, using the previous value", err)
+			return cached.value, nil
+		}
+		return "", err
+	}
+	secretFetchesTotal.Inc(provider, "ok")
+	registerSecret(secret)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secrets[value] = cachedSecret{value: secret, fetchedAt: time.Now()}
+	return secret, nil
+}
+
+// resolveSecret returns the secret referenced by a value (see
+// isSecretReference), or the value itself.
+func resolveSecret(ctx context.Context, value string) (string, error) {
+	return secrets.resolve(ctx, value)
+}
+
+// secretTokenSource is an oauth2.TokenSource returning a token that may be
+// stored in a secret manager, e.g. for the GitHub client.
+type secretTokenSource string
+
+func (s secretTokenSource) Token() (*oauth2.Token, error) {
+	token, err := resolveSecret(context.Background(), string(s))
+	if err != nil {
+		return nil, err
+	}
+	// The token is resolved again once the cached secret has to be refreshed.
+	return &oauth2.Token{AccessToken: token, Expiry: time.Now().Add(secrets.interval)}, nil
+}
+
+// newGitHubTokenClient returns an HTTP client authenticated with a GitHub token
+// that may be stored in a secret manager. The base HTTP client is read from
+// ctx (see oauth2.HTTPClient).
+func newGitHubTokenClient(ctx context.Context, token string) *http.Client {
+	return oauth2.NewClient(ctx, secretTokenSource(token))
+}
+
+// fetchVaultSecret reads a key of a secret stored in Vault, e.g.
+// `secret/data/proxy#github_token` with the KV secrets engine (version 1 or
+// 2), using VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE.
+func fetchVaultSecret(ctx context.Context, reference string) (string, error) {
+	secretPath, key, ok := strings.Cut(reference, "#")
+	if !ok || secretPath == "" || key == "" {
+		return "", fmt.Errorf("invalid Vault reference %q, expected `path#key`", reference)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return "", fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxSecretResponseSize)).Decode(&body); err != nil {
+		return "", err
+	}
+	// The KV secrets engine version 2 nests the secret in `data.data`.
+	data := body.Data
+	var nested map[string]json.RawMessage
+	if raw, ok := data["data"]; ok && json.Unmarshal(raw, &nested) == nil {
+		if _, ok := data[key]; !ok {
+			data = nested
+		}
+	}
+	return secretKey(data, key)
+}
+
+// secretKey returns the string value of a key of a JSON secret.
+func secretKey(data map[string]json.RawMessage, key string) (string, error) {
+	raw, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found", key)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("key %s is not a string", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveSecretFromVault(t *testing.T) {
+	fetches := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fetches++
+		switch r.URL.Path {
+		case "/v1/secret/data/proxy":
+			w.Write([]byte(`{"data":{"data":{"github_token":"ghp_from_vault_v2"},"metadata":{"version":3}}}`))
+		case "/v1/kv/proxy":
+			w.Write([]byte(`{"data":{"github_token":"ghp_from_vault_v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	cache := &secretCache{interval: time.Hour, secrets: map[string]cachedSecret{}}
+	for _, tc := range []struct {
+		value         string
+		expected      string
+		expectedError string
+	}{
+		{value: "plain-token", expected: "plain-token"},
+		{value: "vault:secret/data/proxy#github_token", expected: "ghp_from_vault_v2"},
+		{value: "vault:kv/proxy#github_token", expected: "ghp_from_vault_v1"},
+		{value: "vault:kv/proxy#unknown", expectedError: "key unknown not found"},
+		{value: "vault:kv/missing#github_token", expectedError: "404"},
+		{value: "vault:kv/proxy", expectedError: "invalid Vault reference"},
+	} {
+		secret, err := cache.resolve(context.Background(), tc.value)
+		if tc.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("%s: expected error %q, got: %v", tc.value, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || secret != tc.expected {
+			t.Fatalf("%s: expected: %s, got: %s (%v)", tc.value, tc.expected, secret, err)
+		}
+	}
+
+	// The secrets are cached until they are refreshed.
+	before := fetches
+	cache.resolve(context.Background(), "vault:secret/data/proxy#github_token")
+	if fetches != before {
+		t.Fatal("expected the secret to be cached")
+	}
+
+	// The previous value is used when the secret cannot be fetched again.
+	cache.interval = 0
+	t.Setenv("VAULT_TOKEN", "revoked")
+	if secret, err := cache.resolve(context.Background(), "vault:secret/data/proxy#github_token"); err != nil || secret != "ghp_from_vault_v2" {
+		t.Fatalf("expected the previous value, got: %s (%v)", secret, err)
+	}
+}
+
+func TestResolveSecretFromAWSSecretsManager(t *testing.T) {
+	secretsManager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body struct {
+			SecretId string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.SecretId {
+		case "proxy/github-token":
+			w.Write([]byte(`{"Name":"proxy/github-token","SecretString":"ghp_from_aws"}`))
+		case "proxy/credentials":
+			w.Write([]byte(`{"Name":"proxy/credentials","SecretString":"{\"docker_hub\":\"dckr_from_aws\"}"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer secretsManager.Close()
+	t.Setenv("AWS_ENDPOINT_URL_SECRETS_MANAGER", secretsManager.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	cache := &secretCache{interval: time.Hour, secrets: map[string]cachedSecret{}}
+	for value, expected := range map[string]string{
+		"aws-sm:proxy/github-token":           "ghp_from_aws",
+		"aws-sm:proxy/credentials#docker_hub": "dckr_from_aws",
+	} {
+		if secret, err := cache.resolve(context.Background(), value); err != nil || secret != expected {
+			t.Fatalf("%s: expected: %s, got: %s (%v)", value, expected, secret, err)
+		}
+	}
+	if _, err := cache.resolve(context.Background(), "aws-sm:unknown"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// The example of the AWS Signature Version 4 documentation.
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	credentials := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, credentials, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if authorization := req.Header.Get("Authorization"); authorization != expected {
+		t.Fatalf("expected: %s, got: %s", expected, authorization)
+	}
+}
@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semVersion is a semantic version parsed from a tag, e.g. `v1.2.3-rc.1`.
+// Tags with less than three numbers (e.g. `1.2`) are accepted as well, the
+// missing numbers being zero.
+type semVersion struct {
+	Major, Minor, Patch int
+	Pre                 []string
+	// parts is the number of numbers in the tag.
+	parts int
+}
+
+// parseSemVersion parses a tag, returning false when it is not a version.
+func parseSemVersion(tag string) (semVersion, bool) {
+	s := strings.TrimPrefix(tag, "v")
+	s, _, _ = strings.Cut(s, "+")
+
+	var v semVersion
+	s, pre, hasPre := strings.Cut(s, "-")
+	if hasPre {
+		if pre == "" {
+			return semVersion{}, false
+		}
+		v.Pre = strings.Split(pre, ".")
+	}
+
+	numbers := strings.Split(s, ".")
+	if len(numbers) > 3 {
+		return semVersion{}, false
+	}
+	for i, number := range numbers {
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 0 || number[0] == '+' {
+			return semVersion{}, false
+		}
+		switch i {
+		case 0:
+			v.Major = n
+		case 1:
+			v.Minor = n
+		case 2:
+			v.Patch = n
+		}
+	}
+	v.parts = len(numbers)
+
+	return v, true
+}
+
+func (v semVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Pre) > 0 {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	return s
+}
+
+// compare returns -1, 0 or 1 when v is lower, equal or greater than o, using
+// the precedence rules of Semantic Versioning.
+func (v semVersion) compare(o semVersion) int {
+	for _, d := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A pre-release has a lower precedence than the release.
+	switch {
+	case len(v.Pre) == 0 && len(o.Pre) == 0:
+		return 0
+	case len(v.Pre) == 0:
+		return 1
+	case len(o.Pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		if c := comparePreRelease(v.Pre[i], o.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.Pre) < len(o.Pre):
+		return -1
+	case len(v.Pre) > len(o.Pre):
+		return 1
+	}
+	return 0
+}
+
+// comparePreRelease compares two pre-release identifiers: numbers are
+// compared numerically and are lower than the other identifiers.
+func comparePreRelease(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		if na == nb {
+			return 0
+		}
+		if na < nb {
+			return -1
+		}
+		return 1
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// semComparator compares a version with a bound.
+type semComparator struct {
+	op    string
+	bound semVersion
+}
+
+func (c semComparator) matches(v semVersion) bool {
+	cmp := v.compare(c.bound)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+// semConstraint is a list of alternatives, a version matching the constraint
+// when it matches all the comparators of one of them.
+type semConstraint [][]semComparator
+
+// parseSemConstraint parses a constraint using the syntax of npm, Renovate
+// and Composer: `^1.2`, `~1.2.3`, `>=1.0 <2`, `1.x`, `1.2.*` or `1.2.3`, with
+// `||` between alternatives and spaces or commas between the comparators. An
+// empty constraint matches any version.
+func parseSemConstraint(constraint string) (semConstraint, error) {
+	var c semConstraint
+	for _, rawAlternative := range strings.Split(constraint, "||") {
+		comparators := []semComparator{}
+		for _, rawComparator := range strings.FieldsFunc(rawAlternative, func(r rune) bool { return r == ' ' || r == ',' }) {
+			expanded, err := parseSemComparator(rawComparator)
+			if err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, expanded...)
+		}
+		c = append(c, comparators)
+	}
+	return c, nil
+}
+
+// parseSemComparator expands a comparator with a partial version (e.g. `^1.2`
+// or `1.x`) into comparators with complete versions.
+func parseSemComparator(raw string) ([]semComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(raw, prefix) {
+			op = prefix
+			break
+		}
+	}
+	rawVersion := strings.TrimSpace(strings.TrimPrefix(raw, op))
+
+	// The wildcards are removed, the numbers after a wildcard are ignored.
+	var numbers []string
+	rest, _, _ := strings.Cut(strings.TrimPrefix(rawVersion, "v"), "+")
+	rest, pre, _ := strings.Cut(rest, "-")
+	for _, number := range strings.Split(rest, ".") {
+		if number == "x" || number == "X" || number == "*" {
+			break
+		}
+		numbers = append(numbers, number)
+	}
+	if len(numbers) == 0 {
+		if op == "<" || op == ">" {
+			// Nothing is lower or greater than any version.
+			return []semComparator{{op: "<", bound: semVersion{Pre: []string{"0"}}}}, nil
+		}
+		return nil, nil
+	}
+	partial := strings.Join(numbers, ".")
+	if pre != "" {
+		partial += "-" + pre
+	}
+	lower, ok := parseSemVersion(partial)
+	if !ok || (pre != "" && lower.parts < 3) {
+		return nil, fmt.Errorf("invalid version constraint: %q", raw)
+	}
+
+	// next returns the lowest version after the versions matching the partial
+	// version, excluding its pre-releases, e.g. `<2.0.0-0` for `1`.
+	next := func(parts int) semVersion {
+		v := semVersion{Major: lower.Major, Minor: lower.Minor, Pre: []string{"0"}}
+		switch parts {
+		case 1:
+			v.Major, v.Minor = v.Major+1, 0
+		case 2:
+			v.Minor++
+		default:
+			v.Patch = lower.Patch + 1
+		}
+		return v
+	}
+
+	switch op {
+	case "^":
+		// The leftmost non-zero number cannot change.
+		parts := 1
+		if lower.Major == 0 && len(numbers) > 1 {
+			parts = 2
+			if lower.Minor == 0 && len(numbers) > 2 {
+				parts = 3
+			}
+		}
+		return []semComparator{{">=", lower}, {"<", next(parts)}}, nil
+	case "~":
+		parts := 2
+		if len(numbers) == 1 {
+			parts = 1
+		}
+		return []semComparator{{">=", lower}, {"<", next(parts)}}, nil
+	case ">=", "<":
+		return []semComparator{{op, lower}}, nil
+	case ">":
+		if len(numbers) < 3 {
+			return []semComparator{{">=", next(len(numbers))}}, nil
+		}
+		return []semComparator{{op, lower}}, nil
+	case "<=":
+		if len(numbers) < 3 {
+			return []semComparator{{"<", next(len(numbers))}}, nil
+		}
+		return []semComparator{{op, lower}}, nil
+	}
+	if len(numbers) < 3 {
+		return []semComparator{{">=", lower}, {"<", next(len(numbers))}}, nil
+	}
+	return []semComparator{{"=", lower}}, nil
+}
+
+func (c semConstraint) matches(v semVersion) bool {
+	for _, comparators := range c {
+		matched := true
+		for _, comparator := range comparators {
+			if !comparator.matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// latestTag returns the tag of the highest version matching a constraint. The
+// pre-releases are ignored unless prerelease is true. When several tags have
+// the same version (e.g. `1.2` and `1.2.0`), the most precise one wins.
+func latestTag(tags []string, constraint semConstraint, prerelease bool) (string, semVersion, bool) {
+	var (
+		latest  string
+		version semVersion
+		found   bool
+	)
+	for _, tag := range tags {
+		v, ok := parseSemVersion(tag)
+		if !ok || (len(v.Pre) > 0 && !prerelease) || !constraint.matches(v) {
+			continue
+		}
+		cmp := v.compare(version)
+		if !found || cmp > 0 || (cmp == 0 && (v.parts > version.parts || v.parts == version.parts && tag < latest)) {
+			latest, version, found = tag, v, true
+		}
+	}
+	return latest, version, found
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestLatestTag(t *testing.T) {
+	tags := []string{"latest", "0.0.3", "0.1.0", "0.1.5", "v1.0.0", "1.2", "1.2.0", "1.2.9", "1.10.1", "1.11.0-rc.1", "2.0.0-beta.2", "2.0.0-beta.10", "sha256-1234.sig"}
+
+	for _, tc := range []struct {
+		constraint  string
+		prerelease  bool
+		expectedTag string
+	}{
+		{constraint: "", expectedTag: "1.10.1"},
+		{constraint: "*", expectedTag: "1.10.1"},
+		{constraint: "^1.2", expectedTag: "1.10.1"},
+		{constraint: "~1.2", expectedTag: "1.2.9"},
+		{constraint: "~1.2.3", expectedTag: "1.2.9"},
+		{constraint: "1.2.x", expectedTag: "1.2.9"},
+		{constraint: "1.2.0", expectedTag: "1.2.0"},
+		{constraint: "^0.1", expectedTag: "0.1.5"},
+		{constraint: "^0.0.3", expectedTag: "0.0.3"},
+		{constraint: "<1.2", expectedTag: "v1.0.0"},
+		{constraint: "<=1.2", expectedTag: "1.2.9"},
+		{constraint: ">1.2 <1.10", expectedTag: ""},
+		{constraint: ">=1.0.0, <1.2.5", expectedTag: "1.2.0"},
+		{constraint: "^0.1 || ^1.0 <1.1", expectedTag: "v1.0.0"},
+		{constraint: "^0.1 || ~1.2", expectedTag: "1.2.9"},
+		{constraint: "^3", expectedTag: ""},
+		{constraint: "", prerelease: true, expectedTag: "2.0.0-beta.10"},
+		{constraint: "^1.2", prerelease: true, expectedTag: "1.11.0-rc.1"},
+	} {
+		constraint, err := parseSemConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.constraint, err)
+		}
+		tag, _, _ := latestTag(tags, constraint, tc.prerelease)
+		if tag != tc.expectedTag {
+			t.Fatalf("%s: expected: %s, got: %s", tc.constraint, tc.expectedTag, tag)
+		}
+	}
+
+	if _, err := parseSemConstraint("^latest"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestLatestTagAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/v2/some-owner/some-package/manifests/1.3.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", "sha256:1234")
+	}))
+	defer upstream.Close()
+
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			{
+				Metadata: &github.PackageMetadata{
+					Container: &github.PackageContainerMetadata{Tags: []string{"1.3.0", "latest"}},
+				},
+			},
+			{
+				Metadata: &github.PackageMetadata{
+					Container: &github.PackageContainerMetadata{Tags: []string{"1.2.0", "2.0.0"}},
+				},
+			},
+		},
+	}
+	proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), upstream.URL)
+
+	for _, tc := range []struct {
+		query              string
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			query:              "?constraint=%5E1.2",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tag":"1.3.0","version":"1.3.0","digest":"sha256:1234"}`,
+		},
+		{
+			query:              "",
+			expectedStatusCode: 200,
+			expectedContent:    `{"name":"some-owner/some-package","tag":"2.0.0","version":"2.0.0"}`,
+		},
+		{
+			query:              "?constraint=%5E3",
+			expectedStatusCode: 404,
+			expectedContent:    `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"no tag matches \"^3\"","detail":""}]}`,
+		},
+		{
+			query:              "?constraint=foo",
+			expectedStatusCode: 400,
+			expectedContent:    `{"errors":[{"code":"UNSUPPORTED","message":"invalid version constraint: \"foo\"","detail":""}]}`,
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/api/repos/some-owner/some-package/tags/latest"+tc.query, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.query, tc.expectedStatusCode, res.Code)
+		}
+		if content := strings.TrimSpace(res.Body.String()); content != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.query, tc.expectedContent, content)
+		}
+	}
+}
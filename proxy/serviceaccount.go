@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+)
+
+const (
+	methodServiceAccount = "kubernetes"
+
+	// legacyServiceAccountIssuer is the issuer of the (non-projected) tokens of
+	// the service account secrets.
+	legacyServiceAccountIssuer = "kubernetes/serviceaccount"
+
+	// tokenReviewCacheTTL limits how long a reviewed token is trusted without
+	// asking the API server again.
+	tokenReviewCacheTTL = time.Minute
+)
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string   `json:"username"`
+		Groups   []string `json:"groups"`
+	} `json:"user"`
+	Error string `json:"error,omitempty"`
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status,omitempty"`
+}
+
+type reviewedToken struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// serviceAccountAuthenticator authenticates the pods sending the token of
+// their Kubernetes service account, which is validated by the API server with
+// a TokenReview.
+type serviceAccountAuthenticator struct {
+	kube      *kubeClient
+	audiences []string
+	now       func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]reviewedToken
+}
+
+func newServiceAccountAuthenticator(kube *kubeClient, audiences []string) *serviceAccountAuthenticator {
+	return &serviceAccountAuthenticator{
+		kube:      kube,
+		audiences: audiences,
+		now:       time.Now,
+		cache:     map[[sha256.Size]byte]reviewedToken{},
+	}
+}
+
+// isServiceAccountToken returns true when the (unverified) claims of a token
+// look like the ones of a service account token.
+func isServiceAccountToken(token string) bool {
+	claims, err := auth.UnverifiedClaims(token)
+	if err != nil {
+		return false
+	}
+	if claims.String("iss") == legacyServiceAccountIssuer {
+		return true
+	}
+	_, ok := claims["kubernetes.io"]
+	return ok
+}
+
+// Authenticate returns an identity whose subject is the service account
+// (`system:serviceaccount:<namespace>:<name>`), with the groups set by the API
+// server, e.g. `system:serviceaccounts:<namespace>`.
+func (a *serviceAccountAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if token == "" || !isServiceAccountToken(token) {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && a.now().Before(cached.expiresAt) {
+		return cached.identity, nil
+	}
+
+	review := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: a.audiences},
+	}
+	if err := a.kube.do(r.Context(), "POST", "/apis/authentication.k8s.io/v1/tokenreviews", review, &review); err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, errors.New(review.Status.Error)
+		}
+		return nil, errors.New("service account token is not authenticated")
+	}
+	if !strings.HasPrefix(review.Status.User.Username, "system:serviceaccount:") {
+		return nil, errors.New("token is not a service account token")
+	}
+
+	identity := &Identity{
+		Subject: review.Status.User.Username,
+		Method:  methodServiceAccount,
+		Groups:  review.Status.User.Groups,
+	}
+
+	a.mu.Lock()
+	now := a.now()
+	for k, v := range a.cache {
+		if now.After(v.expiresAt) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = reviewedToken{identity: identity, expiresAt: now.Add(tokenReviewCacheTTL)}
+	a.mu.Unlock()
+
+	return identity, nil
+}
+
+// WithServiceAccountTokens enables the authentication of the pods sending the
+// token of their Kubernetes service account. These tokens only allow pulling
+// images. When audiences are set, the tokens must be issued for one of them.
+// The tokens are reviewed by the API server of the cluster the proxy runs in.
+func WithServiceAccountTokens(audiences ...string) Option {
+	return func(p *containerProxy) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		withServiceAccountTokens(kube, audiences...)(p)
+	}
+}
+
+// withServiceAccountTokens reviews the service account tokens with kube.
+func withServiceAccountTokens(kube *kubeClient, audiences ...string) Option {
+	return func(p *containerProxy) {
+		p.authenticators = append(p.authenticators, newServiceAccountAuthenticator(kube, audiences))
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestServiceAccountTokens(t *testing.T) {
+	validToken, _ := auth.SignHS256(map[string]interface{}{
+		"iss":           "https://kubernetes.default.svc.cluster.local",
+		"sub":           "system:serviceaccount:team-a:default",
+		"kubernetes.io": map[string]interface{}{"namespace": "team-a"},
+	}, []byte("cluster key"))
+	invalidToken, _ := auth.SignHS256(map[string]interface{}{
+		"iss": legacyServiceAccountIssuer,
+		"sub": "system:serviceaccount:team-a:default",
+	}, []byte("other key"))
+
+	reviews := 0
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reviews++
+
+		var review tokenReview
+		json.NewDecoder(r.Body).Decode(&review)
+		if len(review.Spec.Audiences) != 1 || review.Spec.Audiences[0] != "container-registry-proxy" {
+			t.Errorf("unexpected audiences: %v", review.Spec.Audiences)
+		}
+		if review.Spec.Token == validToken {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:team-a:default"
+			review.Status.User.Groups = []string{"system:serviceaccounts", "system:serviceaccounts:team-a"}
+		} else {
+			review.Status.Error = "invalid bearer token"
+		}
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer kube.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	rules, _ := ParseACL("system:serviceaccounts:team-a=team-a/*:*")
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		withServiceAccountTokens(&kubeClient{baseURL: kube.URL, httpClient: kube.Client()}, "container-registry-proxy"),
+		WithACL(rules),
+	)
+
+	for _, tc := range []struct {
+		token              string
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{token: "", method: "GET", path: "/v2/team-a/app/manifests/latest", expectedStatusCode: 401},
+		{token: invalidToken, method: "GET", path: "/v2/team-a/app/manifests/latest", expectedStatusCode: 401},
+		{token: validToken, method: "GET", path: "/v2/team-a/app/manifests/latest", expectedStatusCode: 200},
+		{token: validToken, method: "GET", path: "/v2/team-a/app/blobs/sha256:123", expectedStatusCode: 200},
+		{token: validToken, method: "PUT", path: "/v2/team-a/app/manifests/latest", expectedStatusCode: 403},
+		{token: validToken, method: "GET", path: "/v2/team-b/app/manifests/latest", expectedStatusCode: 403},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.SetBasicAuth("kubernetes", tc.token)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if res.Code == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") != `Basic realm="container-registry-proxy"` {
+			t.Fatalf("unexpected challenge: %s", res.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// The reviews of valid tokens are cached.
+	if reviews != 2 {
+		t.Fatalf("expected: 2, got: %d", reviews)
+	}
+}
+
+func TestServiceAccountTokensCacheExpiration(t *testing.T) {
+	token, _ := auth.SignHS256(map[string]interface{}{"iss": legacyServiceAccountIssuer}, []byte("key"))
+
+	reviews := 0
+	kube := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews++
+		var review tokenReview
+		json.NewDecoder(r.Body).Decode(&review)
+		review.Status.Authenticated = true
+		review.Status.User.Username = "system:serviceaccount:default:default"
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer kube.Close()
+
+	now := time.Now()
+	authenticator := newServiceAccountAuthenticator(&kubeClient{baseURL: kube.URL, httpClient: kube.Client()}, nil)
+	authenticator.now = func() time.Time { return now }
+
+	req, _ := http.NewRequest("GET", "/v2/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 2 * time.Minute} {
+		now = now.Add(elapsed)
+		if identity, err := authenticator.Authenticate(req); err != nil || identity == nil {
+			t.Fatalf("expected an identity, got: %v", err)
+		}
+	}
+
+	if reviews != 2 {
+		t.Fatalf("expected: 2, got: %d", reviews)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// signatureArtifactTypes are the artifact types of the referrers that are
+// signatures, as opposed to e.g. SBOMs.
+var signatureArtifactTypes = []string{
+	"application/vnd.dev.cosign.artifact.sig.v1+json",
+	"application/vnd.cncf.notary.signature",
+}
+
+// errSignatureMissing is returned when an image that must be signed has no
+// signature.
+var errSignatureMissing = errors.New("no signature")
+
+// WithSignatureMirroring adds the cosign signatures and attestations (the
+// `sha256-<hex>.sig` and `.att` tags) and the referrers of the images
+// prefetched into the blob cache to the cache as well, so that the signatures
+// can be verified against the proxy. When require is true, the images without
+// signature are not prefetched.
+func WithSignatureMirroring(require bool) Option {
+	return func(p *containerProxy) {
+		p.mirrorSignatures = true
+		p.requireSignatures = require
+	}
+}
+
+// signatureTag returns the tag of the cosign signatures (suffix `.sig`) or
+// attestations (suffix `.att`) of a digest.
+func signatureTag(digest, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + suffix
+}
+
+func isSignatureArtifact(artifactType string) bool {
+	for _, t := range signatureArtifactTypes {
+		if artifactType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// preloadSignatures adds the blobs of the signatures, attestations and other
+// referrers of a manifest to the cache, with the credentials of the proxy. It
+// returns the number of blobs fetched, or errSignatureMissing when signatures
+// are required and the manifest has none.
+func (p *containerProxy) preloadSignatures(ctx context.Context, name, digest string) (int, error) {
+	var manifests [][]byte
+	signed := false
+
+	for _, suffix := range []string{".sig", ".att"} {
+		body, _, _, err := p.registryClient.GetManifest(ctx, name, signatureTag(digest, suffix))
+		if errors.Is(err, errManifestUnknown) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		manifests = append(manifests, body)
+		signed = signed || suffix == ".sig"
+	}
+
+	// Registries without referrers API are common, e.g. GHCR.
+	referrers, err := p.registryClient.Referrers(ctx, name, digest)
+	if err != nil && !errors.Is(err, errManifestUnknown) {
+		return 0, err
+	}
+	for _, referrer := range referrers {
+		body, _, _, err := p.registryClient.GetManifest(ctx, name, referrer.Digest)
+		if err != nil {
+			return 0, err
+		}
+		manifests = append(manifests, body)
+		signed = signed || isSignatureArtifact(referrer.ArtifactType)
+	}
+
+	if p.requireSignatures && !signed {
+		return 0, fmt.Errorf("%s@%s: %w", name, digest, errSignatureMissing)
+	}
+
+	fetched := 0
+	for _, body := range manifests {
+		for _, blob := range manifestBlobs(body) {
+			if p.blobCache.Has(blob.Digest) {
+				continue
+			}
+			if err := p.preloadBlob(ctx, name, blob.Digest); err != nil {
+				return fetched, err
+			}
+			if p.blobCache.Has(blob.Digest) {
+				fetched++
+			}
+		}
+	}
+
+	return fetched, nil
+}
+
+// prefetchSignatures adds the signatures of a manifest pulled by a client to
+// the cache in the background.
+func (p *containerProxy) prefetchSignatures(name, digest string) {
+	key := "signatures " + p.blobCache.Path(digest)
+	if !p.prefetcher.start(key) {
+		return
+	}
+
+	go func() {
+		defer p.prefetcher.done(key)
+
+		ctx, cancel := context.WithTimeout(p.background(), blobPrefetchTimeout)
+		defer cancel()
+		if _, err := p.preloadSignatures(ctx, name, digest); err != nil {
+			log.Printf("WARN signatures of %s@%s not prefetched: %s", name, digest, err)
+		}
+	}()
+}
+
+// manifestDigest returns the digest of a manifest fetched by reference.
+func manifestDigest(reference, digest string, body []byte) string {
+	if digest != "" {
+		return digest
+	}
+	if strings.Contains(reference, ":") {
+		return reference
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+}
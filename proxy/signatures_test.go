@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestSignatureMirroring(t *testing.T) {
+	layer := []byte("some layer")
+	unsignedLayer := []byte("some unsigned layer")
+	signature := []byte("some signature")
+	upstream := newFakeBlobRegistry(map[string][]byte{
+		digestOf(layer):         layer,
+		digestOf(unsignedLayer): unsignedLayer,
+		digestOf(signature):     signature,
+	})
+	defer upstream.Close()
+
+	imageManifest := func(layer []byte) []byte {
+		return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"layers":[{"digest":%q}]}`, mediaTypeOCIManifest, digestOf(layer)))
+	}
+	signed := imageManifest(layer)
+	upstream.manifests = map[string][]byte{
+		"signed":   signed,
+		"unsigned": imageManifest(unsignedLayer),
+		signatureTag(digestOf(signed), ".sig"): []byte(fmt.Sprintf(
+			`{"schemaVersion":2,"mediaType":%q,"layers":[{"mediaType":%q,"digest":%q}]}`,
+			mediaTypeOCIManifest, mediaTypeCosignSimpleSigning, digestOf(signature),
+		)),
+	}
+
+	cache := cache.New(t.TempDir())
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithBlobCache(cache.Dir()),
+		WithUpstreamCredentials("some-user", "some-token"),
+		WithSignatureMirroring(true),
+		withTestAdmin(),
+	)
+
+	for _, image := range []string{"some-owner/some-package:signed", "some-owner/some-package:unsigned"} {
+		req := httptest.NewRequest("POST", "/admin/prefetch", strings.NewReader(fmt.Sprintf(`{"images":[%q]}`, image)))
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		if res.Code != http.StatusAccepted {
+			t.Fatalf("expected: %d, got: %d", http.StatusAccepted, res.Code)
+		}
+	}
+
+	// Wait for both prefetches.
+	var status struct {
+		Jobs []jobStatus `json:"jobs"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(status.Jobs) == 0 || status.Jobs[0].LastRun == nil || status.Jobs[0].Running {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the prefetches to run")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		req := httptest.NewRequest("GET", "/admin/jobs", nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		json.NewDecoder(res.Body).Decode(&status)
+	}
+
+	if !cache.Has(digestOf(layer)) || !cache.Has(digestOf(signature)) {
+		t.Fatal("expected the signed image and its signature to be cached")
+	}
+	if cache.Has(digestOf(unsignedLayer)) {
+		t.Fatal("expected the unsigned image not to be cached")
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var sizeLimitRejectionsTotal = newCounterVec(
+	"size_limit_rejections_total",
+	"Number of image manifests rejected because the image exceeds the size limit of their namespace, by namespace.",
+	"namespace",
+)
+
+// SizeLimit limits the compressed size of the images pulled from the
+// namespaces (the first component of the repository names), e.g. to protect
+// the small edge devices.
+type SizeLimit struct {
+	// Namespace is a glob pattern (see path.Match) of namespaces.
+	Namespace string `json:"namespace"`
+	// MaxSize is a size with an optional K, M or G suffix, e.g. `500M`.
+	MaxSize string `json:"max_size"`
+
+	bytes int64
+}
+
+func (l SizeLimit) validate() error {
+	if l.Namespace == "" {
+		return fmt.Errorf("invalid size limit: no namespace")
+	}
+	if _, err := path.Match(l.Namespace, ""); err != nil {
+		return fmt.Errorf("invalid size limit of %s: %w", l.Namespace, err)
+	}
+	if _, err := ParseSize(l.MaxSize); err != nil {
+		return fmt.Errorf("invalid size limit of %s: %w", l.Namespace, err)
+	}
+	return nil
+}
+
+// WithSizeLimits rejects the pulls of the images exceeding the size limit of
+// their namespace. The first limit matching a namespace applies.
+func WithSizeLimits(limits ...SizeLimit) Option {
+	return func(p *containerProxy) {
+		for _, l := range limits {
+			if err := l.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			l.bytes, _ = ParseSize(l.MaxSize)
+			p.sizeLimits = append(p.sizeLimits, l)
+		}
+	}
+}
+
+// sizeLimit returns the size limit of a namespace, if any.
+func (p *containerProxy) sizeLimit(namespace string) (SizeLimit, bool) {
+	for _, l := range p.sizeLimits {
+		if matched, _ := path.Match(l.Namespace, namespace); matched {
+			return l, true
+		}
+	}
+	return SizeLimit{}, false
+}
+
+// imageSize returns the compressed size of an image manifest, i.e. the sizes
+// of its config and layers, and false when the manifest is not an image
+// manifest.
+func imageSize(contentType string, body []byte) (int64, bool) {
+	var m manifest
+	if classifyManifest(contentType, body) != manifestTypeImage || json.Unmarshal(body, &m) != nil {
+		return 0, false
+	}
+	var size int64
+	if m.Config != nil {
+		size += m.Config.Size
+	}
+	for _, layer := range m.Layers {
+		size += layer.Size
+	}
+	return size, true
+}
+
+// formatSize returns a size in the units of ParseSize, e.g. `1.2G`.
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1000*1000*1000:
+		return fmt.Sprintf("%.1fG", float64(bytes)/(1000*1000*1000))
+	case bytes >= 1000*1000:
+		return fmt.Sprintf("%.1fM", float64(bytes)/(1000*1000))
+	case bytes >= 1000:
+		return fmt.Sprintf("%.1fK", float64(bytes)/1000)
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// enforceSizeLimits is a middleware rejecting the image manifests whose
+// images exceed the size limit of their namespace, before the clients
+// download the layers. The indexes are not checked, the manifests of their
+// platforms are when they are pulled.
+func (p *containerProxy) enforceSizeLimits(next http.Handler) http.Handler {
+	match := func(r *http.Request) bool {
+		name, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || r.Method != "GET" {
+			return false
+		}
+		namespace, _, _ := strings.Cut(p.prefixedName(name), "/")
+		_, ok = p.sizeLimit(namespace)
+		return ok
+	}
+	return ResponseHook(match, func(r *http.Request, res *HookResponse) error {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		size, ok := imageSize(res.Header.Get("Content-Type"), res.Body)
+		if !ok {
+			return nil
+		}
+		name, _, reference, _ := splitRegistryPath(r.URL.Path)
+		namespace, _, _ := strings.Cut(p.prefixedName(name), "/")
+		limit, _ := p.sizeLimit(namespace)
+		if size <= limit.bytes {
+			return nil
+		}
+
+		image := name + ":" + reference
+		if validateDigest(reference) == nil {
+			image = name + "@" + reference
+		}
+		sizeLimitRejectionsTotal.Inc(namespace)
+		message := fmt.Sprintf("the image %s is %s (compressed), exceeding the size limit of namespace %s (%s)", image, formatSize(size), namespace, formatSize(limit.bytes))
+		body, _ := json.Marshal(makeError(ERROR_DENIED, message))
+		res.StatusCode = http.StatusForbidden
+		res.Header.Set("Content-Type", "application/json")
+		res.Header.Del("Docker-Content-Digest")
+		res.Body = body
+		return nil
+	})(next)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnforceSizeLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", "sha256:1111")
+		w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":1000},"layers":[{"size":300000000},{"size":250000000}]}`))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithSizeLimits(
+		SizeLimit{Namespace: "edge-*", MaxSize: "500M"},
+		SizeLimit{Namespace: "*", MaxSize: "1G"},
+	))
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{path: "/v2/edge-devices/app/manifests/latest", status: http.StatusForbidden},
+		{path: "/v2/some-owner/app/manifests/latest", status: http.StatusOK},
+	} {
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, httptest.NewRequest("GET", tc.path, nil))
+		if res.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got: %d", tc.path, tc.status, res.Code)
+		}
+		if res.Code != http.StatusForbidden {
+			continue
+		}
+		var errs apiErrors
+		json.NewDecoder(res.Body).Decode(&errs)
+		if len(errs.Errors) != 1 || !strings.Contains(errs.Errors[0].Message, "is 550.0M (compressed), exceeding the size limit of namespace edge-devices (500.0M)") {
+			t.Fatalf("%s: unexpected errors: %+v", tc.path, errs)
+		}
+	}
+}
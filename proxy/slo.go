@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/backend/plugin"
+	"github.com/willdurand/container-registry-proxy/backend/snapshot"
+	"github.com/willdurand/container-registry-proxy/backend/static"
+)
+
+// defaultAvailabilityObjective is the share of the requests that must not fail
+// with a server error, unless SLO_AVAILABILITY_OBJECTIVE is set.
+const defaultAvailabilityObjective = 0.999
+
+var (
+	requestsTotal = newCounterVec(
+		"requests_total",
+		"Number of requests handled by the proxy, by route, status class (2xx, 3xx, 4xx, 5xx), namespace and backend.",
+		"route", "status", "namespace", "backend",
+	)
+	requestDurationSeconds = newHistogramVec(
+		"request_duration_seconds",
+		"Duration of the requests handled by the proxy, by route.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		"route",
+	)
+	upstreamRequestsTotal = newCounterVec(
+		"upstream_requests_total",
+		"Number of requests sent by the proxy to the upstream registries and the GitHub API, by host and result (ok, error, canceled).",
+		"host", "result",
+	)
+)
+
+// requestRoute returns the route of a request used as label of the SLO
+// metrics, e.g. `manifests` or `blobs`.
+func requestRoute(r *http.Request) string {
+	path := r.URL.Path
+	if _, kind, _, ok := splitRegistryPath(path); ok {
+		return kind
+	}
+	switch {
+	case path == "/v2/" || path == "/v2":
+		return "version"
+	case path == "/v2/_catalog":
+		return "catalog"
+	case path == whoamiPath:
+		return "whoami"
+	case strings.Contains(path, "/blobs/uploads"):
+		return "uploads"
+	case strings.HasSuffix(path, "/tags/list"):
+		return "tags"
+	case strings.Contains(path, "/referrers/"):
+		return "referrers"
+	case path == "/token":
+		return "token"
+	case path == "/metrics":
+		return "metrics"
+	case strings.HasPrefix(path, "/api/"):
+		return "api"
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin"
+	}
+	return "other"
+}
+
+// backendName returns the backend label of the metrics.
+func backendName(registry backend.RegistryBackend) string {
+	switch registry.(type) {
+	case nil:
+		return "passthrough"
+	case *ghbackend.Backend:
+		return "github"
+	case *plugin.Backend:
+		return "plugin"
+	case *snapshot.Backend:
+		return "snapshot"
+	case *static.Backend:
+		return "static"
+	}
+	return "custom"
+}
+
+// metricNamespace returns the namespace label of the metrics of a request,
+// i.e. the first component of the repository name, or an empty string for the
+// requests that are not about a repository.
+func (p *containerProxy) metricNamespace(r *http.Request) string {
+	name, ok := repositoryFromPath(r.URL.Path)
+	if !ok {
+		return ""
+	}
+	namespace, _, _ := strings.Cut(p.prefixedName(name), "/")
+	return namespace
+}
+
+// sloMetrics is a middleware counting the requests by route, status,
+// namespace and backend, and observing their durations. The namespace of the
+// requests rejected with 401, 403 or 404 is not recorded so that clients
+// cannot create arbitrary series.
+func (p *containerProxy) sloMetrics(next http.Handler) http.Handler {
+	backendLabel := backendName(p.backend)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		counter := &countingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(counter, r)
+
+		status := counter.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		namespace := ""
+		switch status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		default:
+			namespace = p.metricNamespace(r)
+		}
+		route := requestRoute(r)
+		requestsTotal.Inc(route, fmt.Sprintf("%dxx", status/100), namespace, backendLabel)
+		requestDurationSeconds.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// instrumentedTransport is an http.RoundTripper counting the requests sent
+// upstream by result. The server errors are failures of the upstream.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = upstreamTransportFrom(req.Context())
+	}
+
+	res, err := next.RoundTrip(withUserAgent(req))
+	result := "ok"
+	switch {
+	case errors.Is(err, context.Canceled):
+		result = "canceled"
+	case err != nil || res.StatusCode >= 500:
+		result = "error"
+	}
+	upstreamRequestsTotal.Inc(req.URL.Host, result)
+
+	return res, err
+}
+
+type routeSLO struct {
+	Route        string  `json:"route"`
+	Requests     float64 `json:"requests"`
+	Errors       float64 `json:"errors"`
+	Availability float64 `json:"availability"`
+	// ErrorBudgetRemaining is the share of the errors allowed by the objective
+	// that remains, negative when the budget is exhausted.
+	ErrorBudgetRemaining float64  `json:"error_budget_remaining"`
+	P99Seconds           *float64 `json:"p99_seconds,omitempty"`
+}
+
+type upstreamSLO struct {
+	Host       string  `json:"host"`
+	Requests   float64 `json:"requests"`
+	Errors     float64 `json:"errors"`
+	ErrorRatio float64 `json:"error_ratio"`
+}
+
+// WithAvailabilityObjective sets the availability objective of the SLO summary
+// (e.g. 0.999), the default being 99.9%.
+func WithAvailabilityObjective(objective float64) Option {
+	return func(p *containerProxy) {
+		p.availabilityObjective = objective
+	}
+}
+
+// ParseAvailabilityObjective parses an objective given as a ratio (`0.999`)
+// or a percentage (`99.9%`).
+func ParseAvailabilityObjective(value string) (float64, error) {
+	raw := strings.TrimSpace(value)
+	divisor := 1.0
+	if strings.HasSuffix(raw, "%") {
+		raw, divisor = strings.TrimSuffix(raw, "%"), 100
+	}
+	objective, err := strconv.ParseFloat(raw, 64)
+	if err != nil || objective/divisor <= 0 || objective/divisor >= 1 {
+		return 0, fmt.Errorf("invalid availability objective: %q", value)
+	}
+	return objective / divisor, nil
+}
+
+// SLO returns the availability, the error budget and the p99 latency of each
+// route, and the error ratio of the upstream requests, since the proxy
+// started.
+func (p *containerProxy) SLO(w http.ResponseWriter, r *http.Request) {
+	log.Printf("SLO Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	objective := p.availabilityObjective
+	if objective == 0 {
+		objective = defaultAvailabilityObjective
+	}
+
+	routes := map[string]*routeSLO{}
+	requestsTotal.Each(func(labelValues []string, v float64) {
+		route, ok := routes[labelValues[0]]
+		if !ok {
+			route = &routeSLO{Route: labelValues[0]}
+			routes[labelValues[0]] = route
+		}
+		route.Requests += v
+		if labelValues[1] == "5xx" {
+			route.Errors += v
+		}
+	})
+	upstreams := map[string]*upstreamSLO{}
+	upstreamRequestsTotal.Each(func(labelValues []string, v float64) {
+		upstream, ok := upstreams[labelValues[0]]
+		if !ok {
+			upstream = &upstreamSLO{Host: labelValues[0]}
+			upstreams[labelValues[0]] = upstream
+		}
+		if labelValues[1] == "canceled" {
+			return
+		}
+		upstream.Requests += v
+		if labelValues[1] == "error" {
+			upstream.Errors += v
+		}
+	})
+
+	response := struct {
+		Objective float64       `json:"objective"`
+		Routes    []routeSLO    `json:"routes"`
+		Upstreams []upstreamSLO `json:"upstreams"`
+	}{
+		Objective: objective,
+		Routes:    []routeSLO{},
+		Upstreams: []upstreamSLO{},
+	}
+	for _, route := range routes {
+		route.Availability = 1 - route.Errors/route.Requests
+		route.ErrorBudgetRemaining = 1 - (route.Errors/route.Requests)/(1-objective)
+		if p99, ok := requestDurationSeconds.Quantile(0.99, route.Route); ok {
+			route.P99Seconds = &p99
+		}
+		response.Routes = append(response.Routes, *route)
+	}
+	for _, upstream := range upstreams {
+		if upstream.Requests > 0 {
+			upstream.ErrorRatio = upstream.Errors / upstream.Requests
+		}
+		response.Upstreams = append(response.Upstreams, *upstream)
+	}
+	sort.Slice(response.Routes, func(i, j int) bool { return response.Routes[i].Route < response.Routes[j].Route })
+	sort.Slice(response.Upstreams, func(i, j int) bool { return response.Upstreams[i].Host < response.Upstreams[j].Host })
+
+	json.NewEncoder(w).Encode(response)
+}
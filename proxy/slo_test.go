@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	h := &histogramVec{name: "test", buckets: []float64{0.1, 0.5, 1}, values: map[string]*histogram{}}
+
+	if _, ok := h.Quantile(0.99, "manifests"); ok {
+		t.Fatal("expected no quantile without observations")
+	}
+	for i := 0; i < 90; i++ {
+		h.Observe(0.05, "manifests")
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(0.3, "manifests")
+	}
+
+	for _, tc := range []struct {
+		q        float64
+		expected float64
+	}{
+		{q: 0.5, expected: 0.1 * 50 / 90},
+		{q: 0.99, expected: 0.1 + 0.4*9/10},
+	} {
+		if q, _ := h.Quantile(tc.q, "manifests"); q < tc.expected-1e-9 || q > tc.expected+1e-9 {
+			t.Fatalf("q%g: expected: %g, got: %g", tc.q, tc.expected, q)
+		}
+	}
+
+	h.Observe(60, "blobs")
+	if q, _ := h.Quantile(0.99, "blobs"); q != 1 {
+		t.Fatalf("expected: %g, got: %g", 1.0, q)
+	}
+
+	var b strings.Builder
+	h.write(&b)
+	for _, line := range []string{`test_bucket{le="0.1"} 90`, `test_bucket{le="+Inf"} 100`, `test_count 100`} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("expected %s in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestSLO(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "broken") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithAvailabilityObjective(0.9))
+	for _, path := range []string{"/v2/slo/app/manifests/latest", "/v2/slo/broken/manifests/latest"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if requestsTotal.Value("manifests", "5xx", "slo", "passthrough") < 1 {
+		t.Fatal("expected the request to be counted with its namespace and backend")
+	}
+
+	req, _ := http.NewRequest("GET", "/api/slo", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	var response struct {
+		Objective float64       `json:"objective"`
+		Routes    []routeSLO    `json:"routes"`
+		Upstreams []upstreamSLO `json:"upstreams"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if response.Objective != 0.9 {
+		t.Fatalf("expected: %g, got: %g", 0.9, response.Objective)
+	}
+
+	var manifests *routeSLO
+	for i := range response.Routes {
+		if response.Routes[i].Route == "manifests" {
+			manifests = &response.Routes[i]
+		}
+	}
+	if manifests == nil || manifests.Errors < 1 || manifests.Availability >= 1 || manifests.P99Seconds == nil {
+		t.Fatalf("unexpected SLO of the manifests: %+v", manifests)
+	}
+	expectedBudget := 1 - (manifests.Errors/manifests.Requests)/0.1
+	if diff := manifests.ErrorBudgetRemaining - expectedBudget; diff > 1e-9 || diff < -1e-9 {
+		t.Fatalf("expected: %g, got: %g", expectedBudget, manifests.ErrorBudgetRemaining)
+	}
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	for _, u := range response.Upstreams {
+		if u.Host == host {
+			if u.Requests != 2 || u.Errors != 1 || u.ErrorRatio != 0.5 {
+				t.Fatalf("unexpected SLO of the upstream: %+v", u)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected the upstream %s in: %+v", host, response.Upstreams)
+}
+
+func TestParseAvailabilityObjective(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected float64
+	}{
+		{value: "0.999", expected: 0.999},
+		{value: "99.5%", expected: 0.995},
+		{value: "100%"},
+		{value: "1.5"},
+		{value: "high"},
+	} {
+		objective, err := ParseAvailabilityObjective(tc.value)
+		if (err != nil) != (tc.expected == 0) {
+			t.Fatalf("%s: unexpected error: %v", tc.value, err)
+		}
+		if diff := objective - tc.expected; diff > 1e-9 || diff < -1e-9 {
+			t.Fatalf("%s: expected: %g, got: %g", tc.value, tc.expected, objective)
+		}
+	}
+}
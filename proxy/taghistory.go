@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+// recordTag records the digest of a tag observed outside of the pulls in the
+// metadata database, if any.
+func (p *containerProxy) recordTag(name, tag, digest, source string) {
+	if p.metadata == nil || tag == "" || digest == "" || strings.Contains(tag, ":") {
+		return
+	}
+	p.metadata.RecordTag(p.prefixedName(name), tag, metadata.TagChange{Digest: digest, Source: source})
+}
+
+// TagHistory returns the digests a tag pointed to over time, newest first, as
+// observed by the proxy, e.g. to find out when `latest` was repointed during
+// an incident.
+func (p *containerProxy) TagHistory(w http.ResponseWriter, r *http.Request) {
+	log.Printf("TagHistory Request %s -> %s", r.Method, r.URL)
+
+	name, ok := p.repositoryParam(r)
+	if !ok {
+		Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+		return
+	}
+	tag := chi.URLParam(r, "tag")
+	history := p.metadata.TagHistory(name, tag)
+	if len(history) == 0 {
+		Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, fmt.Sprintf("no history for %s:%s", name, tag))
+		return
+	}
+
+	writeRegistryJSON(w, r, "application/json", struct {
+		Name    string               `json:"name"`
+		Tag     string               `json:"tag"`
+		History []metadata.TagChange `json:"history"`
+	}{name, tag, history})
+}
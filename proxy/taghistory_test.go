@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestTagHistory(t *testing.T) {
+	digest := "sha256:1111"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest)
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer upstream.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL, WithMetadataStore(store))
+
+	pull := func() {
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/latest", nil)
+		proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	pull()
+	pull()
+	digest = "sha256:2222"
+	req, _ := http.NewRequest("PUT", "/v2/some-owner/some-package/manifests/latest", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	proxy.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	pull()
+
+	req, _ = http.NewRequest("GET", "/api/repos/some-owner/some-package/tags/latest/history", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got: %d", res.Code)
+	}
+	var response struct {
+		History []metadata.TagChange `json:"history"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	var changes []string
+	for _, change := range response.History {
+		changes = append(changes, change.Source+":"+change.Digest)
+	}
+	if fmt.Sprint(changes) != "[push:sha256:2222 pull:sha256:1111]" {
+		t.Fatalf("unexpected history: %v", changes)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/repos/some-owner/some-package/tags/unknown/history", nil)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got: %d", res.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// The orders of the tag lists.
+const (
+	// tagsOrderBackend keeps the order of the backend, e.g. the newest
+	// versions first with GitHub.
+	tagsOrderBackend = "backend"
+	// tagsOrderOldestFirst lists the tags of the oldest versions first, so
+	// that the clients keeping the last listed tag get the newest one.
+	tagsOrderOldestFirst = "oldest-first"
+	// tagsOrderNewestFirst lists the tags of the newest versions first.
+	tagsOrderNewestFirst = "newest-first"
+	// tagsOrderLexical sorts the tags lexically, like most registries.
+	tagsOrderLexical = "lexical"
+)
+
+// ParseTagsOrder validates the order of the tag lists, the order of the
+// backend by default.
+func ParseTagsOrder(value string) (string, error) {
+	switch value {
+	case "":
+		return tagsOrderBackend, nil
+	case tagsOrderBackend, tagsOrderOldestFirst, tagsOrderNewestFirst, tagsOrderLexical:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid tags order: %q", value)
+}
+
+// tagsListOptions configure the tag lists of a proxy.
+type tagsListOptions struct {
+	order string
+	// created adds the creation date of the versions of the tags to the tag
+	// lists.
+	created bool
+}
+
+// WithTagsOrder sets the order of the tag lists and whether they include the
+// creation date of the tags, e.g. for the clients picking the most recent tag
+// like ArgoCD Image Updater. The dates require a backend able to list the
+// versions of a repository.
+func WithTagsOrder(order string, created bool) Option {
+	return func(p *containerProxy) {
+		p.tagsList = &tagsListOptions{order: order, created: created}
+	}
+}
+
+// listTags returns the tags of a repository in the configured order, along
+// with their creation date when it is enabled.
+func (p *containerProxy) listTags(ctx context.Context, owner, name string) ([]string, map[string]time.Time, error) {
+	options := p.tagsList
+	if options == nil {
+		options = &tagsListOptions{order: tagsOrderBackend}
+	}
+	lister, ok := p.backend.(backend.VersionLister)
+	byDate := options.order == tagsOrderOldestFirst || options.order == tagsOrderNewestFirst
+	if !ok || !byDate && !options.created {
+		return p.listBackendTags(ctx, owner, name, options)
+	}
+
+	versions, err := lister.ListVersions(ctx, owner, name)
+	if errors.Is(err, backend.ErrNotSupported) {
+		// e.g. the repositories of a static catalog, which have no dates.
+		return p.listBackendTags(ctx, owner, name, options)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch options.order {
+	case tagsOrderOldestFirst:
+		sort.SliceStable(versions, func(i, j int) bool { return versions[i].CreatedAt.Before(versions[j].CreatedAt) })
+	case tagsOrderNewestFirst:
+		sort.SliceStable(versions, func(i, j int) bool { return versions[i].CreatedAt.After(versions[j].CreatedAt) })
+	}
+
+	tags := []string{}
+	var created map[string]time.Time
+	if options.created {
+		created = map[string]time.Time{}
+	}
+	for _, version := range versions {
+		tags = append(tags, version.Tags...)
+		for _, tag := range version.Tags {
+			if created != nil && !version.CreatedAt.IsZero() {
+				created[tag] = version.CreatedAt.UTC()
+			}
+		}
+	}
+	if options.order == tagsOrderLexical {
+		sort.Strings(tags)
+	}
+	return tags, created, nil
+}
+
+// listBackendTags returns the tags of a repository in the order of the
+// backend, or in the lexical order.
+func (p *containerProxy) listBackendTags(ctx context.Context, owner, name string, options *tagsListOptions) ([]string, map[string]time.Time, error) {
+	tags, err := p.backend.ListTags(ctx, owner, name)
+	if options.order == tagsOrderLexical {
+		sort.Strings(tags)
+	}
+	return tags, nil, err
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestTagsOrder(t *testing.T) {
+	day := func(d int) *github.Timestamp {
+		return &github.Timestamp{Time: time.Date(2023, 1, d, 0, 0, 0, 0, time.UTC)}
+	}
+	version := func(digest string, createdAt *github.Timestamp, tags ...string) *github.PackageVersion {
+		return &github.PackageVersion{
+			Name:      github.String(digest),
+			CreatedAt: createdAt,
+			Metadata:  &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: tags}},
+		}
+	}
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			version("sha256:3333", day(3), "1.10.0", "latest"),
+			version("sha256:2222", day(2), "1.9.0"),
+			version("sha256:1111", day(1), "1.0.0"),
+		},
+	}
+
+	for _, tc := range []struct {
+		order           string
+		created         bool
+		query           string
+		expectedTags    []string
+		expectedCreated map[string]time.Time
+	}{
+		{order: tagsOrderBackend, expectedTags: []string{"1.10.0", "latest", "1.9.0", "1.0.0"}},
+		{order: tagsOrderOldestFirst, expectedTags: []string{"1.0.0", "1.9.0", "1.10.0", "latest"}},
+		{order: tagsOrderNewestFirst, expectedTags: []string{"1.10.0", "latest", "1.9.0", "1.0.0"}},
+		{order: tagsOrderLexical, expectedTags: []string{"1.0.0", "1.10.0", "1.9.0", "latest"}},
+		{
+			order:        tagsOrderOldestFirst,
+			created:      true,
+			expectedTags: []string{"1.0.0", "1.9.0", "1.10.0", "latest"},
+			expectedCreated: map[string]time.Time{
+				"1.0.0":  day(1).Time,
+				"1.9.0":  day(2).Time,
+				"1.10.0": day(3).Time,
+				"latest": day(3).Time,
+			},
+		},
+		{
+			// The dates are limited to the tags of the page.
+			order:           tagsOrderBackend,
+			created:         true,
+			query:           "?n=1&last=1.0.0",
+			expectedTags:    []string{"1.10.0"},
+			expectedCreated: map[string]time.Time{"1.10.0": day(3).Time},
+		},
+	} {
+		proxy := NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), "https://ghcr.io", WithTagsOrder(tc.order, tc.created))
+		req := httptest.NewRequest("GET", "/v2/some-owner/some-package/tags/list"+tc.query, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", tc.order, http.StatusOK, res.Code)
+		}
+
+		var list struct {
+			Tags    []string             `json:"tags"`
+			Created map[string]time.Time `json:"created"`
+		}
+		json.NewDecoder(res.Body).Decode(&list)
+		if !reflect.DeepEqual(list.Tags, tc.expectedTags) {
+			t.Fatalf("%s: expected: %v, got: %v", tc.order, tc.expectedTags, list.Tags)
+		}
+		if !reflect.DeepEqual(list.Created, tc.expectedCreated) {
+			t.Fatalf("%s: expected: %v, got: %v", tc.order, tc.expectedCreated, list.Created)
+		}
+	}
+
+	if _, err := ParseTagsOrder("random"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
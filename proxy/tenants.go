@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// VirtualRegistry is an isolated registry served by the proxy, selected by the
+// host of the requests or by a prefix in the repository names (e.g.
+// `/v2/<prefix>/owner/name/manifests/latest`).
+type VirtualRegistry struct {
+	Name    string
+	Prefix  string
+	Hosts   []string
+	Handler http.Handler
+}
+
+// WithVirtualRegistry configures the proxy as the virtual registry name. When
+// prefix is not empty, the repository names returned to the clients start with
+// it, and the token endpoint is `/<prefix>/token`.
+func WithVirtualRegistry(name, prefix string) Option {
+	return func(p *containerProxy) {
+		p.tenant = name
+		p.pathPrefix = prefix
+	}
+}
+
+// prefixedName returns the name of a repository as seen by the clients.
+func (p *containerProxy) prefixedName(name string) string {
+	if p.pathPrefix == "" {
+		return name
+	}
+	return p.pathPrefix + "/" + name
+}
+
+// stripPrefix returns the path of a request without the prefix of a virtual
+// registry, or false when the path does not start with the prefix.
+func stripPrefix(path, prefix string) (string, bool) {
+	if rest, ok := strings.CutPrefix(path, "/v2/"+prefix); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+		return "/v2/" + strings.TrimPrefix(rest, "/"), true
+	}
+	if rest, ok := strings.CutPrefix(path, "/"+prefix+"/"); ok {
+		return "/" + rest, true
+	}
+	return "", false
+}
+
+// prefixLocationWriter adds the prefix of a virtual registry to the relative
+// `Location` headers, e.g. the URL of a blob upload.
+type prefixLocationWriter struct {
+	http.ResponseWriter
+	prefix string
+}
+
+func (w *prefixLocationWriter) WriteHeader(statusCode int) {
+	if location := w.Header().Get("Location"); strings.HasPrefix(location, "/v2/") {
+		w.Header().Set("Location", "/v2/"+w.prefix+"/"+strings.TrimPrefix(location, "/v2/"))
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *prefixLocationWriter) Write(b []byte) (int, error) {
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *prefixLocationWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// NewVirtualRegistries returns a server sending the requests to the virtual
+// registries, matched by host first and then by prefix. Other requests are
+// handled by the handler of server.
+func NewVirtualRegistries(server *http.Server, registries []VirtualRegistry) (*http.Server, error) {
+	byHost := map[string]VirtualRegistry{}
+	var byPrefix []VirtualRegistry
+	for _, registry := range registries {
+		for _, host := range registry.Hosts {
+			host = strings.ToLower(host)
+			if _, ok := byHost[host]; ok {
+				return nil, fmt.Errorf("duplicate host for virtual registry %s: %s", registry.Name, host)
+			}
+			byHost[host] = registry
+		}
+		if registry.Prefix != "" {
+			for _, other := range byPrefix {
+				if other.Prefix == registry.Prefix {
+					return nil, fmt.Errorf("duplicate prefix for virtual registry %s: %s", registry.Name, registry.Prefix)
+				}
+			}
+			byPrefix = append(byPrefix, registry)
+		}
+		log.Printf("registering virtual registry %q (prefix: %q, hosts: %v)", registry.Name, registry.Prefix, registry.Hosts)
+	}
+
+	fallback := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if registry, ok := byHost[strings.ToLower(host)]; ok {
+			registry.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		for _, registry := range byPrefix {
+			if path, ok := stripPrefix(r.URL.Path, registry.Prefix); ok {
+				r.URL.Path = path
+				r.URL.RawPath = ""
+				registry.Handler.ServeHTTP(&prefixLocationWriter{ResponseWriter: w, prefix: registry.Prefix}, r)
+				return
+			}
+		}
+
+		fallback.ServeHTTP(w, r)
+	})
+
+	return server, nil
+}
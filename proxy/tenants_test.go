@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestStripPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path         string
+		expectedPath string
+		expectedOk   bool
+	}{
+		{path: "/v2/team-a/owner/name/manifests/latest", expectedPath: "/v2/owner/name/manifests/latest", expectedOk: true},
+		{path: "/v2/team-a/_catalog", expectedPath: "/v2/_catalog", expectedOk: true},
+		{path: "/v2/team-a/", expectedPath: "/v2/", expectedOk: true},
+		{path: "/v2/team-a", expectedPath: "/v2/", expectedOk: true},
+		{path: "/team-a/token", expectedPath: "/token", expectedOk: true},
+		{path: "/v2/team-ab/owner/name/manifests/latest", expectedOk: false},
+		{path: "/v2/owner/team-a/manifests/latest", expectedOk: false},
+	} {
+		path, ok := stripPrefix(tc.path, "team-a")
+		if ok != tc.expectedOk || path != tc.expectedPath {
+			t.Fatalf("%s: expected: %s (%t), got: %s (%t)", tc.path, tc.expectedPath, tc.expectedOk, path, ok)
+		}
+	}
+}
+
+func newTenantProxy(owner, upstreamURL string, opts ...Option) *http.Server {
+	client := &githubClientMock{
+		Packages: []*github.Package{
+			{Name: github.String("app"), Owner: &github.User{Login: github.String(owner)}},
+		},
+		PackageVersions: []*github.PackageVersion{
+			{
+				Name:     github.String("sha256:123"),
+				Metadata: &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: []string{"latest"}}},
+			},
+		},
+	}
+	return NewProxy("127.0.0.1:10000", ghbackend.New(client, nil), upstreamURL, opts...)
+}
+
+func TestVirtualRegistries(t *testing.T) {
+	var upstreamPaths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPaths = append(upstreamPaths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+			w.Header().Set("Location", "/v2/org-a/app/blobs/uploads/some-uuid")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewVirtualRegistries(newTenantProxy("default-org", upstream.URL), []VirtualRegistry{
+		{
+			Name:    "team-a",
+			Prefix:  "team-a",
+			Handler: newTenantProxy("org-a", upstream.URL, WithVirtualRegistry("team-a", "team-a")).Handler,
+		},
+		{
+			Name:    "team-b",
+			Hosts:   []string{"team-b.registry.example.com"},
+			Handler: newTenantProxy("org-b", upstream.URL, WithVirtualRegistry("team-b", "")).Handler,
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	for _, tc := range []struct {
+		host             string
+		method           string
+		path             string
+		expectedContent  string
+		expectedLocation string
+	}{
+		{path: "/v2/_catalog", expectedContent: `{"repositories":["default-org/app"]}`},
+		{path: "/v2/team-a/_catalog", expectedContent: `{"repositories":["team-a/org-a/app"]}`},
+		{path: "/v2/team-a/org-a/app/tags/list", expectedContent: `{"name":"team-a/org-a/app","tags":["latest"]}`},
+		{host: "team-b.registry.example.com:443", path: "/v2/_catalog", expectedContent: `{"repositories":["org-b/app"]}`},
+		{method: "POST", path: "/v2/team-a/org-a/app/blobs/uploads/", expectedLocation: "/v2/team-a/org-a/app/blobs/uploads/some-uuid"},
+	} {
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		req, _ := http.NewRequest(method, tc.path, nil)
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if tc.expectedContent != "" && strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, res.Body.String())
+		}
+		if res.Header().Get("Location") != tc.expectedLocation {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedLocation, res.Header().Get("Location"))
+		}
+	}
+
+	if expected := "/v2/org-a/app/blobs/uploads/"; len(upstreamPaths) != 1 || upstreamPaths[0] != expected {
+		t.Fatalf("expected: [%s], got: %v", expected, upstreamPaths)
+	}
+}
+
+func TestVirtualRegistriesTokens(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	auth := WithTokenAuth([]byte("secret"), time.Minute, NewOIDCAuthenticator(provider.URL, "some-audience", ""))
+	proxy, _ := NewVirtualRegistries(newTenantProxy("default-org", upstream.URL, auth), []VirtualRegistry{
+		{
+			Name:    "team-a",
+			Prefix:  "team-a",
+			Handler: newTenantProxy("org-a", upstream.URL, auth, WithVirtualRegistry("team-a", "team-a")).Handler,
+		},
+	})
+
+	// The challenge points to the token endpoint of the virtual registry.
+	req, _ := http.NewRequest("GET", "/v2/team-a/org-a/app/manifests/latest", nil)
+	req.Host = "registry.example.com"
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	expectedChallenge := `Bearer realm="http://registry.example.com/team-a/token",service="container-registry-proxy/team-a",scope="repository:org-a/app:pull"`
+	if res.Header().Get("WWW-Authenticate") != expectedChallenge {
+		t.Fatalf("expected: %s, got: %s", expectedChallenge, res.Header().Get("WWW-Authenticate"))
+	}
+
+	// Tokens of the default registry are not valid for the virtual registry.
+	_, token := requestToken(t, proxy.Handler, provider.Sign(t, nil), "repository:org-a/app:pull")
+	req, _ = http.NewRequest("GET", "/v2/team-a/org-a/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, res.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/team-a/token?scope=repository:org-a/app:pull", nil)
+	req.SetBasicAuth("user", provider.Sign(t, nil))
+	res = httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		content       string
+		expectedError string
+	}{
+		{content: `{"registries":[{"name":"team-a","prefix":"team-a","users":["org-a"],"acl":"*=org-a/*:pull"}]}`},
+		{content: `{"registries":[{"prefix":"team-a"}]}`, expectedError: "has no name"},
+		{content: `{"registries":[{"name":"team-a"}]}`, expectedError: "needs a prefix or hosts"},
+		{content: `{"registries":[{"name":"team-a","prefix":"a/b"}]}`, expectedError: "invalid prefix"},
+		{content: `{"registries":[{"name":"a","prefix":"a"},{"name":"a","prefix":"b"}]}`, expectedError: "duplicate virtual registry"},
+		{content: `{"registries":[{"name":"a","prefix":"a","acl":"invalid"}]}`, expectedError: "invalid ACL rule"},
+		{content: `{`, expectedError: "invalid configuration file"},
+		{content: `{"prefetch":[{"schedule":"0 5 * * 1-5","images":["owner/app:1.0.0"]}]}`},
+		{content: `{"prefetch":[{"schedule":"0 5 * *","images":["owner/app:1.0.0"]}]}`, expectedError: "invalid cron schedule"},
+		{content: `{"prefetch":[{"schedule":"@daily","images":["owner/app:"]}]}`, expectedError: "invalid image reference"},
+		{content: `{"pins":[{"image":"library/alpine:3.18","digest":"sha256:` + strings.Repeat("a", 64) + `","enforce":true}]}`},
+		{content: `{"pins":[{"image":"library/alpine:3.18","digest":"sha256:1234"}]}`, expectedError: "invalid digest"},
+		{content: `{"pins":[{"image":"library/alpine@sha256:1234","digest":"sha256:` + strings.Repeat("a", 64) + `"}]}`, expectedError: "is not a tag"},
+		{content: `{"registries":[{"name":"hub","prefix":"hub","passthrough":true,"pins":[{"image":"library/alpine","digest":"latest"}]}]}`, expectedError: "virtual registry hub: invalid pin"},
+		{content: `{"virtual_tags":[{"tag":"stable","strategy":"semver","constraint":"^1"},{"tag":"nightly","strategy":"newest","match":"nightly-*"}]}`},
+		{content: `{"virtual_tags":[{"tag":"stable","strategy":"highest"}]}`, expectedError: "unknown strategy"},
+		{content: `{"virtual_tags":[{"tag":"stable","strategy":"semver","constraint":"^latest"}]}`, expectedError: "invalid version constraint"},
+		{content: `{"registries":[{"name":"hub","prefix":"hub","passthrough":true,"virtual_tags":[{"tag":"stable","strategy":"newest"}]}]}`, expectedError: "virtual tags need a GitHub backend"},
+		{content: `{"aliases":{"nginx":"my-org/base-nginx"}}`},
+		{content: `{"deprecations":[{"repository":"my-org/legacy-*","sunset":"2024-06-30","replacement":"my-org/app"}]}`},
+		{content: `{"deprecations":[{"repository":"my-org/app","sunset":"next year"}]}`, expectedError: "invalid sunset date"},
+		{content: `{"deprecations":[{"tag":"v1*"}]}`, expectedError: "no repository"},
+		{content: `{"quotas":[{"namespace":"team-*","monthly_bytes":"500G","monthly_pulls":10000,"enforce":true}]}`},
+		{content: `{"quotas":[{"namespace":"team-a"}]}`, expectedError: "no limit"},
+		{content: `{"registries":[{"name":"hub","prefix":"hub","passthrough":true,"quotas":[{"namespace":"hub","monthly_bytes":"lots"}]}]}`, expectedError: "virtual registry hub: invalid quota"},
+		{content: `{"chaos":[{"route":"blobs","probability":0.1,"latency":"2s","truncate_after":"1M"}]}`},
+		{content: `{"chaos":[{"repository":"my-org/*","status":200}]}`, expectedError: "invalid status"},
+		{content: `{"chaos":[{"probability":0.5}]}`, expectedError: "no fault"},
+		{content: `{"registries":[{"name":"../escape","prefix":"team-a"}]}`, expectedError: "invalid virtual registry name"},
+		{content: `{"credentials":[{"registry":"registry-1.docker.io","username":"me","password_env":"DOCKER_HUB_TOKEN"}]}`},
+		{content: `{"credentials":[{"registry":"https://ghcr.io","password_env":"TOKEN"}]}`, expectedError: "invalid registry"},
+		{content: `{"credentials":[{"registry":"ghcr.io","repository":"other-org/*"}]}`, expectedError: "password_env and password_file"},
+		{content: `{"aliases":{"Nginx":"my-org/base-nginx"}}`, expectedError: "invalid repository name"},
+		{content: `{"aliases":{"nginx":"web","web":"my-org/web"}}`, expectedError: "is an alias too"},
+		{content: `{"registries":[{"name":"hub","prefix":"hub","passthrough":true,"aliases":{"nginx":"library/nginx:latest"}}]}`, expectedError: "virtual registry hub: invalid alias"},
+	} {
+		path := filepath.Join(dir, "config.json")
+		os.WriteFile(path, []byte(tc.content), 0o644)
+
+		_, err := LoadConfig(path)
+		if tc.expectedError == "" && err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if tc.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedError)) {
+			t.Fatalf("expected: %s, got: %v", tc.expectedError, err)
+		}
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	var hubPaths []string
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hubPaths = append(hubPaths, r.URL.Path)
+	}))
+	defer hub.Close()
+
+	ghcr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the default upstream: %s", r.URL.Path)
+	}))
+	defer ghcr.Close()
+
+	routes, err := ParseHostRoutes("hub.internal.example.com=" + hub.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(routes) != 1 || !routes[0].Passthrough || routes[0].Hosts[0] != "hub.internal.example.com" {
+		t.Fatalf("unexpected routes: %v", routes)
+	}
+
+	registry, err := routes[0].VirtualRegistry(context.Background(), "127.0.0.1:10000")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	proxy, _ := NewVirtualRegistries(newTenantProxy("default-org", ghcr.URL), []VirtualRegistry{registry})
+
+	for _, path := range []string{"/v2/", "/v2/_catalog", "/v2/library/nginx/tags/list", "/v2/library/nginx/manifests/latest"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = "hub.internal.example.com"
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %d, got: %d", path, http.StatusOK, res.Code)
+		}
+	}
+
+	if len(hubPaths) != 4 {
+		t.Fatalf("expected 4 requests, got: %v", hubPaths)
+	}
+
+	if _, err := ParseHostRoutes("hub.internal.example.com"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleChunkSize is the largest write done at once by a throttled
+	// response, so that the rate stays smooth.
+	throttleChunkSize = 32 * 1024
+	// clientLimiterIdleTimeout is the time after which the limiter of an idle
+	// client is forgotten.
+	clientLimiterIdleTimeout = 10 * time.Minute
+)
+
+// rateLimiter is a token bucket limiting a number of bytes per second. Writes
+// larger than the available tokens are delayed until the bucket refills.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		now:    time.Now,
+		sleep:  sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// refill adds the tokens accumulated since the last use. The lock must be
+// held.
+func (l *rateLimiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// using them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes n tokens when they are available, or returns how long the
+// caller must wait for them otherwise.
+func (l *rateLimiter) allow(n int) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < float64(n) {
+		return time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second)), false
+	}
+	l.tokens -= float64(n)
+	return 0, true
+}
+
+// available returns the number of tokens currently available.
+func (l *rateLimiter) available() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	return l.tokens
+}
+
+// wait blocks until n bytes can be sent.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if delay := l.reserve(n); delay > 0 {
+		return l.sleep(ctx, delay)
+	}
+	return nil
+}
+
+// lastUsed returns the last time the limiter was used.
+func (l *rateLimiter) lastUsed() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// ParseBandwidth parses a number of bytes per second with an optional K, M or
+// G suffix (powers of 1000), e.g. `10M` or `500KB`.
+func ParseBandwidth(value string) (int64, error) {
+	raw := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S")
+	n, err := ParseSize(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth: %q", value)
+	}
+	return n, nil
+}
+
+// ParseSize parses a number of bytes with an optional K, M or G suffix (powers
+// of 1000), e.g. `16M` or `500KB`.
+func ParseSize(value string) (int64, error) {
+	raw := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(raw, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(raw, "M"):
+		multiplier = 1000 * 1000
+	case strings.HasSuffix(raw, "G"):
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier > 1 {
+		raw = raw[:len(raw)-1]
+	}
+
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+
+	return n * multiplier, nil
+}
+
+// BandwidthLimits are the limits (in bytes per second) applied to the blobs
+// sent to the clients. A zero limit disables the corresponding limiter.
+type BandwidthLimits struct {
+	Connection int64
+	Client     int64
+	Global     int64
+}
+
+// bandwidthThrottler enforces the bandwidth limits. It is shared by the
+// virtual registries so that the global and client limits apply to all of
+// them.
+type bandwidthThrottler struct {
+	limits BandwidthLimits
+	global *rateLimiter
+	now    func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*rateLimiter
+}
+
+func newBandwidthThrottler(limits BandwidthLimits) *bandwidthThrottler {
+	t := &bandwidthThrottler{
+		limits:  limits,
+		now:     time.Now,
+		clients: map[string]*rateLimiter{},
+	}
+	if limits.Global > 0 {
+		t.global = newRateLimiter(limits.Global)
+	}
+	return t
+}
+
+// clientLimiter returns the limiter of a client, and forgets the idle clients.
+func (t *bandwidthThrottler) clientLimiter(client string) *rateLimiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for key, limiter := range t.clients {
+		if now.Sub(limiter.lastUsed()) > clientLimiterIdleTimeout {
+			delete(t.clients, key)
+		}
+	}
+
+	limiter, ok := t.clients[client]
+	if !ok {
+		limiter = newRateLimiter(t.limits.Client)
+		limiter.now = t.now
+		t.clients[client] = limiter
+	}
+	return limiter
+}
+
+// throttledResponseWriter delays the writes to respect a set of limiters.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rateLimiter
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		for _, limiter := range w.limiters {
+			if err := limiter.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WithBandwidthLimits limits the bandwidth used to send blobs to the clients,
+// per connection, per client and globally.
+func WithBandwidthLimits(limits BandwidthLimits) Option {
+	throttler := newBandwidthThrottler(limits)
+	return func(p *containerProxy) {
+		p.throttler = throttler
+	}
+}
+
+// throttle is a middleware limiting the bandwidth of the blob downloads.
+func (p *containerProxy) throttle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, kind, _, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "blobs" || r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var limiters []*rateLimiter
+		if p.throttler.limits.Connection > 0 {
+			limiters = append(limiters, newRateLimiter(p.throttler.limits.Connection))
+		}
+		if p.throttler.limits.Client > 0 {
+			client := r.RemoteAddr
+			if addr, err := p.clientAddr(r); err == nil {
+				client = addr.String()
+			}
+			limiters = append(limiters, p.throttler.clientLimiter(client))
+		}
+		if p.throttler.global != nil {
+			limiters = append(limiters, p.throttler.global)
+		}
+
+		next.ServeHTTP(&throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}, r)
+	})
+}
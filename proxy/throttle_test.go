@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected int64
+	}{
+		{value: "1024", expected: 1024},
+		{value: "500K", expected: 500 * 1000},
+		{value: "10MB", expected: 10 * 1000 * 1000},
+		{value: "1gb/s", expected: 1000 * 1000 * 1000},
+	} {
+		n, err := ParseBandwidth(tc.value)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", tc.value, err)
+		}
+		if n != tc.expected {
+			t.Fatalf("%s: expected: %d, got: %d", tc.value, tc.expected, n)
+		}
+	}
+
+	for _, value := range []string{"", "fast", "-1M", "0"} {
+		if _, err := ParseBandwidth(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(1000)
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available immediately.
+	if delay := limiter.reserve(1000); delay != 0 {
+		t.Fatalf("expected no delay, got: %s", delay)
+	}
+	if delay := limiter.reserve(500); delay != 500*time.Millisecond {
+		t.Fatalf("expected: 500ms, got: %s", delay)
+	}
+
+	now = now.Add(2 * time.Second)
+	if delay := limiter.reserve(1000); delay != 0 {
+		t.Fatalf("expected no delay, got: %s", delay)
+	}
+}
+
+func TestBandwidthThrottlerForgetsIdleClients(t *testing.T) {
+	now := time.Now()
+	throttler := newBandwidthThrottler(BandwidthLimits{Client: 1000})
+	throttler.now = func() time.Time { return now }
+
+	throttler.clientLimiter("10.0.0.1").reserve(1)
+	throttler.clientLimiter("10.0.0.2").reserve(1)
+	now = now.Add(clientLimiterIdleTimeout + time.Second)
+	throttler.clientLimiter("10.0.0.2").reserve(1)
+
+	if len(throttler.clients) != 1 {
+		t.Fatalf("expected: 1, got: %d", len(throttler.clients))
+	}
+}
+
+func TestThrottleBlobs(t *testing.T) {
+	blob := bytes.Repeat([]byte("x"), 96*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBandwidthLimits(BandwidthLimits{Global: 64 * 1024}),
+	)
+
+	for _, tc := range []struct {
+		path        string
+		minDuration time.Duration
+	}{
+		// The first 64KB are sent immediately, the remaining 32KB take 500ms.
+		{path: "/v2/some-owner/some-package/blobs/sha256:123", minDuration: 400 * time.Millisecond},
+		// Manifests are not throttled.
+		{path: "/v2/some-owner/some-package/manifests/latest"},
+	} {
+		start := time.Now()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		elapsed := time.Since(start)
+
+		if res.Body.Len() != len(blob) {
+			t.Fatalf("%s: expected: %d bytes, got: %d", tc.path, len(blob), res.Body.Len())
+		}
+		if elapsed < tc.minDuration {
+			t.Fatalf("%s: expected at least %s, got: %s", tc.path, tc.minDuration, elapsed)
+		}
+		if tc.minDuration == 0 && elapsed > 200*time.Millisecond {
+			t.Fatalf("%s: expected no throttling, got: %s", tc.path, elapsed)
+		}
+	}
+}
+
+func TestThrottleLargeBlobs(t *testing.T) {
+	blob := bytes.Repeat([]byte("x"), 96*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBandwidthLimits(BandwidthLimits{Global: 32 * 1024}),
+		WithUpstreamSettings(UpstreamSettings{Upstream: host, Timeout: "1s"}),
+	)
+
+	// The blob takes 2s, longer than the timeout of the requests, but is
+	// still sent entirely.
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/blobs/sha256:123", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || res.Body.Len() != len(blob) {
+		t.Fatalf("expected: %d bytes, got: %d (%d)", len(blob), res.Body.Len(), res.Code)
+	}
+}
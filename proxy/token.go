@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/auth"
+)
+
+const (
+	defaultTokenService = "container-registry-proxy"
+	defaultTokenTTL     = 5 * time.Minute
+
+	tokenIssuerName = "container-registry-proxy"
+)
+
+// tokenIssuer mints the short-lived tokens returned by the token endpoint, and
+// authenticates the clients presenting them.
+type tokenIssuer struct {
+	key     []byte
+	ttl     time.Duration
+	service string
+	now     func() time.Time
+}
+
+// Issue returns a token granting access to the given resources.
+func (i *tokenIssuer) Issue(identity *Identity, access []AccessEntry) (string, time.Time, error) {
+	now := i.now()
+	expiresAt := now.Add(i.ttl)
+
+	token, err := auth.SignHS256(map[string]interface{}{
+		"iss":    tokenIssuerName,
+		"sub":    identity.Subject,
+		"aud":    i.service,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    expiresAt.Unix(),
+		"method": identity.Method,
+		"access": access,
+	}, i.key)
+
+	return token, expiresAt, err
+}
+
+// Authenticate implements Authenticator for the tokens minted by the proxy.
+func (i *tokenIssuer) Authenticate(r *http.Request) (*Identity, error) {
+	token := credentialsToken(r)
+	if token == "" || auth.UnverifiedIssuer(token) != tokenIssuerName {
+		return nil, nil
+	}
+
+	claims, err := auth.VerifyHS256(token, i.key, i.now())
+	if err != nil {
+		return nil, err
+	}
+	if !claims.HasAudience(i.service) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims.Strings("aud"))
+	}
+
+	// Round-trip the access claim to decode it.
+	access := []AccessEntry{}
+	data, _ := json.Marshal(claims["access"])
+	json.Unmarshal(data, &access)
+
+	return &Identity{
+		Subject: claims.String("sub"),
+		Method:  claims.String("method"),
+		Access:  access,
+		Claims:  claims,
+	}, nil
+}
+
+// WithTokenAuth enables the token endpoint (`/token`) and requires the clients
+// to authenticate. Tokens are signed with key and are valid for ttl. The
+// identity of the clients requesting tokens is established by the
+// authenticators.
+func WithTokenAuth(key []byte, ttl time.Duration, authenticators ...Authenticator) Option {
+	return func(p *containerProxy) {
+		if ttl <= 0 {
+			ttl = defaultTokenTTL
+		}
+		p.tokens = &tokenIssuer{key: key, ttl: ttl, service: defaultTokenService, now: time.Now}
+		p.authenticators = append(p.authenticators, authenticators...)
+	}
+}
+
+// WithTokenRealm configures the public URL of the token endpoint, which is
+// otherwise derived from the requests.
+func WithTokenRealm(realm string) Option {
+	return func(p *containerProxy) {
+		p.realm = realm
+	}
+}
+
+func (p *containerProxy) tokenRealm(r *http.Request) string {
+	if p.realm != "" {
+		return p.realm
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	if p.pathPrefix != "" {
+		return fmt.Sprintf("%s://%s/%s/token", scheme, r.Host, p.pathPrefix)
+	}
+	return fmt.Sprintf("%s://%s/token", scheme, r.Host)
+}
+
+// Token implements the token endpoint of the Docker Registry token
+// authentication specification, as well as the OAuth2 token exchange grant
+// (RFC 8693) for services sending their identity token as `subject_token`.
+// The returned token only grants the requested actions the client is allowed
+// to perform.
+func (p *containerProxy) Token(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Token Request %s -> %s", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	authReq := r
+	if subjectToken := r.Form.Get("subject_token"); subjectToken != "" {
+		authReq = r.Clone(r.Context())
+		authReq.Header.Set("Authorization", "Bearer "+subjectToken)
+	}
+
+	identity, err := p.identify(authReq)
+	if err != nil {
+		log.Printf("WARN token request denied: %s", err)
+	} else if identity == nil && len(p.anonymousRead) > 0 && authReq.Header.Get("Authorization") == "" {
+		identity = anonymousIdentity
+	}
+	if identity == nil || identity.Access != nil {
+		// Tokens minted by the proxy cannot be exchanged for other tokens.
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, p.tokens.service))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	granted := []AccessEntry{}
+	for _, scope := range r.Form["scope"] {
+		// Scopes can also be space-separated (OAuth2).
+		for _, s := range strings.Fields(scope) {
+			entry, err := parseScope(s)
+			if err != nil {
+				continue
+			}
+			if entry.Type == "repository" {
+				// The requests for aliases are authorized with the names of their
+				// repositories.
+				entry.Name = p.resolveAlias(entry.Name)
+			}
+
+			var actions []string
+			for _, action := range entry.Actions {
+				if p.isAllowed(identity, entry.Type, entry.Name, action) {
+					actions = append(actions, action)
+				}
+			}
+			if len(actions) > 0 {
+				entry.Actions = actions
+				granted = append(granted, entry)
+			}
+		}
+	}
+
+	token, expiresAt, err := p.tokens.Issue(identity, granted)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server_error"})
+		return
+	}
+	log.Printf("Token issued to %s (%s) for %v", identity.Subject, identity.Method, granted)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":             token,
+		"access_token":      token,
+		"token_type":        "Bearer",
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"expires_in":        int(p.tokens.ttl.Seconds()),
+		"issued_at":         expiresAt.Add(-p.tokens.ttl).UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+	b3Header          = "b3"
+)
+
+// traceContext is the position of a request in a distributed trace, i.e. the
+// W3C Trace Context (`traceparent`) or the B3 propagation headers of Zipkin.
+type traceContext struct {
+	TraceID string
+	// SpanID is the span of the proxy, the child of ParentID.
+	SpanID   string
+	ParentID string
+	Sampled  bool
+	// State is the vendor-specific `tracestate` header, passed through.
+	State string
+}
+
+// isTraceID returns true when s is a non-zero lowercase hex ID of n bytes.
+func isTraceID(s string, n int) bool {
+	if len(s) != 2*n || strings.Trim(s, "0") == "" || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomTraceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent parses a `traceparent` header, e.g.
+// `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`.
+func parseTraceparent(value string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	if !isTraceID(parts[1], 16) || !isTraceID(parts[2], 8) || len(parts[3]) != 2 {
+		return traceContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceContext{}, false
+	}
+	return traceContext{TraceID: parts[1], ParentID: parts[2], Sampled: flags[0]&1 == 1}, true
+}
+
+// parseB3 parses the single `b3` header (`{trace}-{span}-{sampled}`) or the
+// `X-B3-*` headers. The 64-bit trace IDs are left-padded with zeros.
+func parseB3(header http.Header) (traceContext, bool) {
+	var traceID, spanID, sampled string
+	if value := header.Get(b3Header); value != "" {
+		parts := strings.Split(value, "-")
+		if len(parts) < 2 {
+			return traceContext{}, false
+		}
+		traceID, spanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceID, spanID, sampled = header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"), header.Get("X-B3-Sampled")
+		if header.Get("X-B3-Flags") == "1" {
+			sampled = "d"
+		}
+	}
+
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isTraceID(traceID, 16) || !isTraceID(spanID, 8) {
+		return traceContext{}, false
+	}
+	return traceContext{TraceID: traceID, ParentID: spanID, Sampled: sampled == "1" || sampled == "d" || sampled == "true"}, true
+}
+
+// traceparent returns the `traceparent` header of the span of the proxy.
+func (tc traceContext) traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + flags
+}
+
+type traceKey struct{}
+
+// traceFromContext returns the trace context of a request, if any.
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	return tc, ok
+}
+
+// propagateTrace is a middleware continuing the trace of the requests sent
+// with a `traceparent` or B3 headers, or starting a new trace otherwise. The
+// headers of the request are replaced with the span of the proxy, so that the
+// requests forwarded upstream are its children, and the trace context is
+// added to the context of the request for the other outgoing requests (see
+// tracingTransport).
+func propagateTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+		if ok {
+			tc.State = r.Header.Get(tracestateHeader)
+		} else if tc, ok = parseB3(r.Header); !ok {
+			tc = traceContext{TraceID: randomTraceID(16), Sampled: true}
+		}
+		tc.SpanID = randomTraceID(8)
+
+		r = r.WithContext(context.WithValue(r.Context(), traceKey{}, tc))
+		r.Header.Set(traceparentHeader, tc.traceparent())
+		switch {
+		case r.Header.Get(b3Header) != "":
+			sampled := "0"
+			if tc.Sampled {
+				sampled = "1"
+			}
+			r.Header.Set(b3Header, tc.TraceID+"-"+tc.SpanID+"-"+sampled+"-"+tc.ParentID)
+		case r.Header.Get("X-B3-TraceId") != "":
+			r.Header.Set("X-B3-SpanId", tc.SpanID)
+			r.Header.Set("X-B3-ParentSpanId", tc.ParentID)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tracingTransport is an http.RoundTripper adding the `traceparent` header of
+// the span of the proxy to the requests sent on behalf of the clients, e.g. to
+// the GitHub API.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = &retryTransport{}
+	}
+
+	tc, ok := traceFromContext(req.Context())
+	if !ok || req.Header.Get(traceparentHeader) != "" {
+		return next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(traceparentHeader, tc.traceparent())
+	if tc.State != "" {
+		req.Header.Set(tracestateHeader, tc.State)
+	}
+	return next.RoundTrip(req)
+}
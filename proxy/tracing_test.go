@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		value           string
+		expectedTraceID string
+		expectedSampled bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectedTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", expectedSampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", expectedTraceID: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		// Future versions can have more fields.
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectedTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", expectedSampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{value: "invalid"},
+	} {
+		trace, ok := parseTraceparent(tc.value)
+		if ok != (tc.expectedTraceID != "") {
+			t.Fatalf("%s: expected valid: %t, got: %t", tc.value, tc.expectedTraceID != "", ok)
+		}
+		if trace.TraceID != tc.expectedTraceID || trace.Sampled != tc.expectedSampled {
+			t.Fatalf("%s: unexpected trace: %+v", tc.value, trace)
+		}
+	}
+}
+
+func TestParseB3(t *testing.T) {
+	for _, tc := range []struct {
+		header          http.Header
+		expectedTraceID string
+		expectedSampled bool
+	}{
+		{
+			header:          http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"}},
+			expectedTraceID: "80f198ee56343ba864fe8b2a57d3eff7",
+			expectedSampled: true,
+		},
+		{
+			header: http.Header{
+				"X-B3-Traceid": {"64fe8b2a57d3eff7"},
+				"X-B3-Spanid":  {"e457b5a2e4d86bd1"},
+				"X-B3-Sampled": {"0"},
+			},
+			expectedTraceID: "000000000000000064fe8b2a57d3eff7",
+		},
+		{header: http.Header{"B3": {"0"}}},
+		{header: http.Header{}},
+	} {
+		trace, ok := parseB3(tc.header)
+		if ok != (tc.expectedTraceID != "") {
+			t.Fatalf("%v: expected valid: %t, got: %t", tc.header, tc.expectedTraceID != "", ok)
+		}
+		if trace.TraceID != tc.expectedTraceID || trace.Sampled != tc.expectedSampled {
+			t.Fatalf("%v: unexpected trace: %+v", tc.header, trace)
+		}
+	}
+}
+
+func TestPropagateTrace(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL)
+
+	for _, tc := range []struct {
+		header          http.Header
+		expectedTraceID string
+		expectedParent  string
+	}{
+		{
+			header: http.Header{
+				"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				"Tracestate":  {"vendor=value"},
+			},
+			expectedTraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			expectedParent:  "00f067aa0ba902b7",
+		},
+		{
+			header:          http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"}},
+			expectedTraceID: "80f198ee56343ba864fe8b2a57d3eff7",
+			expectedParent:  "e457b5a2e4d86bd1",
+		},
+		{header: http.Header{}},
+	} {
+		req, _ := http.NewRequest("GET", "/v2/some-owner/some-image/manifests/latest", nil)
+		req.Header = tc.header
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		trace, ok := parseTraceparent(upstreamHeader.Get("traceparent"))
+		if !ok {
+			t.Fatalf("expected a valid traceparent, got: %q", upstreamHeader.Get("traceparent"))
+		}
+		if tc.expectedTraceID != "" && trace.TraceID != tc.expectedTraceID {
+			t.Fatalf("expected: %s, got: %s", tc.expectedTraceID, trace.TraceID)
+		}
+		// The upstream request is a child of the span of the proxy.
+		if trace.ParentID == tc.expectedParent {
+			t.Fatalf("expected a new span, got: %s", trace.ParentID)
+		}
+		if tc.header.Get("Tracestate") != upstreamHeader.Get("tracestate") {
+			t.Fatalf("expected: %s, got: %s", tc.header.Get("Tracestate"), upstreamHeader.Get("tracestate"))
+		}
+		if tc.header.Get("B3") != "" {
+			expectedB3 := trace.TraceID + "-" + trace.ParentID + "-1-" + tc.expectedParent
+			if b3 := upstreamHeader.Get("b3"); b3 != expectedB3 {
+				t.Fatalf("expected: %s, got: %s", expectedB3, b3)
+			}
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	trace := traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+	ctx := context.WithValue(withTestEgress(context.Background()), traceKey{}, trace)
+	client := newRegistryClient(&url.URL{Scheme: "http", Host: strings.TrimPrefix(server.URL, "http://")}, &tokenTransport{})
+	client.GetManifest(ctx, "some-owner/some-image", "latest")
+
+	if traceparent != trace.traceparent() {
+		t.Fatalf("expected: %s, got: %s", trace.traceparent(), traceparent)
+	}
+}
@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	// defaultTransformTimeout is the maximum duration of a call to a transform
+	// service, unless its timeout is set.
+	defaultTransformTimeout = 2 * time.Second
+	// maxTransformTimeout is the maximum timeout of a transform, the manifests
+	// being transformed while the clients wait.
+	maxTransformTimeout = 10 * time.Second
+	// maxTransformedManifests limits the number of transformed manifests kept
+	// in memory by the proxies without blob cache.
+	maxTransformedManifests = 10000
+)
+
+var manifestTransformsTotal = newCounterVec(
+	"manifest_transforms_total",
+	"Number of manifests sent to the transform services, by transform and result (changed, unchanged, error).",
+	"transform", "result",
+)
+
+// ManifestTransform sends the manifests pulled by tag to an HTTP service,
+// which can rewrite them before they are returned to the clients, e.g. to
+// rewrite the references to a base image or to strip the foreign layers.
+//
+// The service receives a `POST` request with the manifest as body, its media
+// type as Content-Type and the `X-Registry-Repository`, `X-Registry-Reference`
+// and `X-Registry-Digest` headers. It returns the transformed manifest with a
+// `200`, or a `204` to keep the manifest unchanged.
+type ManifestTransform struct {
+	// Name identifies the transform in the logs and the metrics.
+	Name string `json:"name"`
+	// URL is the URL of the transform service.
+	URL string `json:"url"`
+	// Repository is a glob pattern (see path.Match) of repository names, the
+	// transform applying to all the repositories when it is empty.
+	Repository string `json:"repository,omitempty"`
+	// Timeout is the maximum duration of a call to the service, e.g. `500ms`
+	// (default: 2s, at most 10s).
+	Timeout string `json:"timeout,omitempty"`
+	// Optional transforms are skipped when the service fails, while the pulls
+	// fail with a `502` otherwise.
+	Optional bool `json:"optional,omitempty"`
+
+	timeout time.Duration
+	// rewrite replaces the call to the service for the transforms of the
+	// proxy itself, e.g. the rewrite of the foreign layers.
+	rewrite func(ctx context.Context, name string, manifest []byte, mediaType string) ([]byte, string, error)
+}
+
+func (t ManifestTransform) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("invalid manifest transform: no name")
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid manifest transform %s: invalid URL %q", t.Name, t.URL)
+	}
+	if _, err := path.Match(t.Repository, ""); err != nil {
+		return fmt.Errorf("invalid manifest transform %s: %w", t.Name, err)
+	}
+	if t.Timeout != "" {
+		timeout, err := time.ParseDuration(t.Timeout)
+		if err != nil || timeout <= 0 || timeout > maxTransformTimeout {
+			return fmt.Errorf("invalid manifest transform %s: invalid timeout %q", t.Name, t.Timeout)
+		}
+	}
+	return nil
+}
+
+func (t ManifestTransform) matches(name string) bool {
+	matched, _ := path.Match(t.Repository, name)
+	return t.Repository == "" || matched
+}
+
+// apply sends a manifest to the transform service, and returns the
+// transformed manifest and its media type.
+func (t ManifestTransform) apply(ctx context.Context, client *http.Client, name, reference, digest string, manifest []byte, mediaType string) ([]byte, string, error) {
+	if t.rewrite != nil {
+		return t.rewrite(ctx, name, manifest, mediaType)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, bytes.NewReader(manifest))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("X-Registry-Repository", name)
+	req.Header.Set("X-Registry-Reference", reference)
+	req.Header.Set("X-Registry-Digest", digest)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return manifest, mediaType, nil
+	case http.StatusOK:
+	default:
+		io.Copy(io.Discard, res.Body)
+		return nil, "", fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", fmt.Errorf("transformed manifest too large")
+	}
+	var parsed struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		MediaType     string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.SchemaVersion != 2 {
+		return nil, "", fmt.Errorf("invalid transformed manifest")
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "" && contentType != "application/json" {
+		mediaType = contentType
+	} else if parsed.MediaType != "" {
+		mediaType = parsed.MediaType
+	}
+	return body, mediaType, nil
+}
+
+type transformedManifest struct {
+	body      []byte
+	mediaType string
+	// source is the digest of the upstream manifest.
+	source string
+}
+
+// manifestTransforms are the transforms of a proxy, along with the manifests
+// they produced, which the clients pull by digest after resolving a tag but
+// which the upstream registry does not know. The manifests are kept in the
+// blob cache, as blobs derived from the upstream manifests, so that they can
+// be pulled after a restart or from another replica, or in memory without
+// blob cache.
+type manifestTransforms struct {
+	transforms []ManifestTransform
+	client     *http.Client
+	cache      *cache.Cache
+
+	mu        sync.Mutex
+	manifests map[string]transformedManifest
+	// digests are the keys of manifests, oldest first.
+	digests []string
+}
+
+// WithManifestTransforms sends the manifests pulled by tag to the transform
+// services, in order.
+func WithManifestTransforms(transforms ...ManifestTransform) Option {
+	return func(p *containerProxy) {
+		if len(transforms) == 0 {
+			return
+		}
+		p.initTransforms()
+		for _, transform := range transforms {
+			if err := transform.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			transform.timeout = defaultTransformTimeout
+			if transform.Timeout != "" {
+				transform.timeout, _ = time.ParseDuration(transform.Timeout)
+			}
+			p.transforms.transforms = append(p.transforms.transforms, transform)
+		}
+	}
+}
+
+func (p *containerProxy) initTransforms() {
+	if p.transforms == nil {
+		p.transforms = &manifestTransforms{
+			client:    &http.Client{Transport: &tracingTransport{}},
+			manifests: map[string]transformedManifest{},
+		}
+	}
+}
+
+func (m *manifestTransforms) store(digest string, manifest transformedManifest) {
+	if m.cache != nil {
+		if !m.cache.Has(digest) {
+			if _, _, err := m.cache.Add(bytes.NewReader(manifest.body)); err != nil {
+				log.Printf("WARN cannot cache transformed manifest %s: %s", digest, err)
+				return
+			}
+		}
+		if err := m.cache.RecordDerived(digest, manifest.source); err != nil {
+			log.Printf("WARN cannot cache transformed manifest %s: %s", digest, err)
+		}
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.manifests[digest]; ok {
+		return
+	}
+	if len(m.digests) >= maxTransformedManifests {
+		delete(m.manifests, m.digests[0])
+		m.digests = m.digests[1:]
+	}
+	m.manifests[digest] = manifest
+	m.digests = append(m.digests, digest)
+}
+
+func (m *manifestTransforms) load(digest string) (transformedManifest, bool) {
+	if m.cache != nil {
+		source, ok := m.cache.DerivedSource(digest)
+		if !ok {
+			return transformedManifest{}, false
+		}
+		f, _, err := m.cache.Open(digest)
+		if err != nil {
+			return transformedManifest{}, false
+		}
+		defer f.Close()
+		body, err := io.ReadAll(io.LimitReader(f, maxManifestSize))
+		if err != nil {
+			return transformedManifest{}, false
+		}
+		return transformedManifest{body: body, mediaType: cachedManifestMediaType(body), source: source}, true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	manifest, ok := m.manifests[digest]
+	return manifest, ok
+}
+
+func (m *manifestTransforms) matching(name string) []ManifestTransform {
+	var transforms []ManifestTransform
+	for _, transform := range m.transforms {
+		if transform.matches(name) {
+			transforms = append(transforms, transform)
+		}
+	}
+	return transforms
+}
+
+// rewriteImageManifests rewrites the fields of an image manifest with rewrite,
+// or the image manifests of an index, the index then referencing the digests
+// of the rewritten manifests, which are kept with the transformed manifests.
+// It returns whether the manifest changed.
+func (p *containerProxy) rewriteImageManifests(ctx context.Context, name string, fields map[string]json.RawMessage, rewrite func(fields map[string]json.RawMessage) (bool, error)) (bool, error) {
+	changed, err := rewrite(fields)
+	if err != nil {
+		return false, err
+	}
+
+	var manifests []map[string]json.RawMessage
+	if raw, ok := fields["manifests"]; ok && json.Unmarshal(raw, &manifests) == nil {
+		indexChanged := false
+		for _, child := range manifests {
+			var childMediaType, childDigest string
+			json.Unmarshal(child["mediaType"], &childMediaType)
+			json.Unmarshal(child["digest"], &childDigest)
+			if childMediaType != mediaTypeOCIManifest && childMediaType != mediaTypeDockerManifest {
+				continue
+			}
+
+			childBody, _, _, err := p.registryClient.GetManifest(ctx, name, childDigest)
+			if err != nil {
+				return false, err
+			}
+			var childFields map[string]json.RawMessage
+			if err := json.Unmarshal(childBody, &childFields); err != nil {
+				continue
+			}
+			childChanged, err := rewrite(childFields)
+			if err != nil {
+				return false, err
+			}
+			if !childChanged {
+				continue
+			}
+			if childBody, err = json.Marshal(childFields); err != nil {
+				return false, err
+			}
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(childBody))
+			p.transforms.store(digest, transformedManifest{body: childBody, mediaType: childMediaType, source: childDigest})
+			child["digest"], _ = json.Marshal(digest)
+			child["size"], _ = json.Marshal(len(childBody))
+			indexChanged = true
+		}
+		if indexChanged {
+			if fields["manifests"], err = json.Marshal(manifests); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+type upstreamDigestKey struct{}
+
+// upstreamDigest is the digest of a manifest before its transforms, which the
+// middlewares comparing the digests of the upstream registry (e.g. the
+// immutable tags and the digest pins) check instead of the digest served.
+type upstreamDigest struct {
+	digest string
+}
+
+// withUpstreamDigest returns a context in which transformManifests records
+// the digest of the manifests it transforms.
+func withUpstreamDigest(parent context.Context) (context.Context, *upstreamDigest) {
+	recorded := &upstreamDigest{}
+	return context.WithValue(parent, upstreamDigestKey{}, recorded), recorded
+}
+
+// or returns the digest of the upstream registry, or served when the
+// manifest was not transformed.
+func (d *upstreamDigest) or(served string) string {
+	if d.digest != "" {
+		return d.digest
+	}
+	return served
+}
+
+func writeManifest(w http.ResponseWriter, r *http.Request, header http.Header, body []byte, mediaType, digest string) {
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.Header().Del("Etag")
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		w.Write(body)
+	}
+}
+
+// canReadManifest returns true when the upstream registry serves a manifest of
+// a repository to the client of the request r, with a HEAD request sent to
+// next.
+func canReadManifest(next http.Handler, r *http.Request, name, digest string) bool {
+	head := r.Clone(r.Context())
+	head.Method = "HEAD"
+	head.URL.Path = "/v2/" + name + "/manifests/" + digest
+	head.URL.RawPath = ""
+	head.RequestURI = ""
+	res := &bufferedResponseWriter{header: http.Header{}}
+	next.ServeHTTP(res, head)
+	return res.statusCode == 0 || res.statusCode == http.StatusOK
+}
+
+// transformManifests is a middleware applying the transforms to the manifests
+// pulled by tag, the digest of the transformed manifests being recomputed. The
+// manifests pulled by a digest of the upstream registry are not transformed,
+// so that their digest still matches.
+func (p *containerProxy) transformManifests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || (r.Method != "GET" && r.Method != "HEAD") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if validateDigest(reference) == nil {
+			// The transformed manifests are served to the clients that can
+			// read their upstream manifest in the repository.
+			if manifest, ok := p.transforms.load(reference); ok && canReadManifest(next, r, name, manifest.source) {
+				writeManifest(w, r, http.Header{}, manifest.body, manifest.mediaType, reference)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		transforms := p.transforms.matching(name)
+		if len(transforms) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The manifest is fetched for the HEAD requests too, since its digest
+		// depends on the transforms.
+		get := r.Clone(r.Context())
+		get.Method = "GET"
+		buffered := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(buffered, get)
+		if buffered.statusCode == 0 {
+			buffered.statusCode = http.StatusOK
+		}
+		if buffered.statusCode != http.StatusOK {
+			for key, values := range buffered.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(buffered.statusCode)
+			if r.Method == "GET" {
+				w.Write(buffered.body.Bytes())
+			}
+			return
+		}
+
+		body, mediaType := buffered.body.Bytes(), buffered.header.Get("Content-Type")
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		for _, transform := range transforms {
+			transformed, transformedType, err := transform.apply(r.Context(), p.transforms.client, name, reference, digest, body, mediaType)
+			if err != nil {
+				manifestTransformsTotal.Inc(transform.Name, "error")
+				log.Printf("WARN manifest transform %s failed for %s:%s: %s", transform.Name, name, reference, err)
+				if transform.Optional {
+					continue
+				}
+				Veto(w, http.StatusBadGateway, ERROR_UNKNOWN, fmt.Sprintf("manifest transform %s failed", transform.Name))
+				return
+			}
+			if bytes.Equal(transformed, body) && transformedType == mediaType {
+				manifestTransformsTotal.Inc(transform.Name, "unchanged")
+				continue
+			}
+			manifestTransformsTotal.Inc(transform.Name, "changed")
+			body, mediaType = transformed, transformedType
+		}
+
+		transformedDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+		if transformedDigest != digest {
+			p.transforms.store(transformedDigest, transformedManifest{body: body, mediaType: mediaType, source: digest})
+			if recorded, ok := r.Context().Value(upstreamDigestKey{}).(*upstreamDigest); ok {
+				recorded.digest = digest
+			}
+		}
+		writeManifest(w, r, buffered.header, body, mediaType, transformedDigest)
+	})
+}
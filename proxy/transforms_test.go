@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransformManifests(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"mediaType":"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"}]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+		w.Write([]byte(manifest))
+	}))
+	defer upstream.Close()
+
+	var headers []http.Header
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/strip":
+			w.Write([]byte(strings.Replace(string(body), `{"mediaType":"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"}`, "", 1)))
+		case "/noop":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer service.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithManifestTransforms(
+			ManifestTransform{Name: "strip", URL: service.URL + "/strip", Repository: "my-org/*"},
+			ManifestTransform{Name: "noop", URL: service.URL + "/noop", Repository: "my-org/*"},
+			ManifestTransform{Name: "broken", URL: service.URL + "/broken", Repository: "my-org/*", Optional: true},
+			ManifestTransform{Name: "required", URL: service.URL + "/broken", Repository: "broken/*"},
+		),
+	)
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	transformed := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(transformed)))
+	for _, method := range []string{"GET", "HEAD"} {
+		res := get(method, "/v2/my-org/app/manifests/latest")
+		if res.Code != http.StatusOK || res.Header().Get("Docker-Content-Digest") != digest {
+			t.Fatalf("%s: expected the transformed manifest, got: %d %s", method, res.Code, res.Header().Get("Docker-Content-Digest"))
+		}
+		if method == "GET" && res.Body.String() != transformed {
+			t.Fatalf("unexpected manifest: %s", res.Body.String())
+		}
+	}
+	if headers[0].Get("X-Registry-Repository") != "my-org/app" || headers[0].Get("X-Registry-Reference") != "latest" {
+		t.Fatalf("unexpected transform request headers: %v", headers[0])
+	}
+
+	// The transformed manifest can be pulled by digest, while the original
+	// one is not transformed.
+	res := get("GET", "/v2/my-org/app/manifests/"+digest)
+	if res.Code != http.StatusOK || res.Body.String() != transformed {
+		t.Fatalf("expected the transformed manifest, got: %d %s", res.Code, res.Body.String())
+	}
+	res = get("GET", fmt.Sprintf("/v2/my-org/app/manifests/sha256:%x", sha256.Sum256([]byte(manifest))))
+	if res.Code != http.StatusOK || res.Body.String() != manifest {
+		t.Fatalf("expected the original manifest, got: %d %s", res.Code, res.Body.String())
+	}
+
+	res = get("GET", "/v2/other/app/manifests/latest")
+	if res.Body.String() != manifest {
+		t.Fatalf("expected the original manifest, got: %s", res.Body.String())
+	}
+
+	res = get("GET", "/v2/broken/app/manifests/latest")
+	if res.Code != http.StatusBadGateway {
+		t.Fatalf("expected: %d, got: %d", http.StatusBadGateway, res.Code)
+	}
+	if manifestTransformsTotal.Value("required", "error") == 0 || manifestTransformsTotal.Value("broken", "error") == 0 {
+		t.Fatal("expected the failures to be counted")
+	}
+}
+
+func TestTransformedManifestsCache(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/my-org/app/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Write([]byte(manifest))
+	}))
+	defer upstream.Close()
+
+	transformed := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[],"annotations":{"transformed":"true"}}`
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(transformed))
+	}))
+	defer service.Close()
+
+	dir := t.TempDir()
+	newProxy := func() *http.Server {
+		return NewProxy("127.0.0.1:10000", nil, upstream.URL, WithBlobCache(dir), WithManifestTransforms(ManifestTransform{Name: "annotate", URL: service.URL}))
+	}
+	get := func(proxy *http.Server, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get(newProxy(), "/v2/my-org/app/manifests/latest")
+	digest := res.Header().Get("Docker-Content-Digest")
+	if res.Code != http.StatusOK || digest != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(transformed))) {
+		t.Fatalf("expected the transformed manifest, got: %d %s", res.Code, digest)
+	}
+
+	// Another proxy sharing the blob cache, e.g. after a restart, serves the
+	// transformed manifest by digest for the repositories of the upstream
+	// manifest only.
+	proxy := newProxy()
+	res = get(proxy, "/v2/my-org/app/manifests/"+digest)
+	if res.Code != http.StatusOK || res.Body.String() != transformed || res.Header().Get("Content-Type") != mediaTypeOCIManifest {
+		t.Fatalf("expected the transformed manifest, got: %d %s", res.Code, res.Body.String())
+	}
+	if res = get(proxy, "/v2/other/app/manifests/"+digest); res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// newUpstreamProxy returns a reverse proxy forwarding requests to an upstream
+// registry.
+func newUpstreamProxy(upstreamURL *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstreamURL)
+		},
+		Transport: &tracingTransport{},
+	}
+}
+
+// ParseUpstreamNamespaces parses a comma-separated list of `namespace=URL`
+// pairs, e.g. `docker.io=https://registry-1.docker.io`.
+func ParseUpstreamNamespaces(value string) (map[string]*url.URL, error) {
+	namespaces := map[string]*url.URL{}
+	if value == "" {
+		return namespaces, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		namespace, rawURL, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf("invalid upstream namespace: %q", pair)
+		}
+		upstreamURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateUpstreamURL(upstreamURL); err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", namespace, err)
+		}
+		namespaces[namespace] = upstreamURL
+	}
+
+	return namespaces, nil
+}
+
+// WithUpstreamNamespaces configures the upstream registries selected with the
+// `ns` query parameter, which containerd adds to the requests sent to a
+// registry mirror (see hosts.toml).
+func WithUpstreamNamespaces(namespaces map[string]*url.URL) Option {
+	return func(p *containerProxy) {
+		p.namespaces = namespaces
+	}
+}
+
+// namespaceRouting is a middleware sending the requests with a `ns` query
+// parameter to the upstream registry configured for this namespace. Requests
+// for the namespace of the default upstream are handled as usual.
+func namespaceRouting(defaultUpstreamURL *url.URL, namespaces map[string]*url.URL, transport http.RoundTripper) func(next http.Handler) http.Handler {
+	proxies := map[string]*httputil.ReverseProxy{}
+	for namespace, upstreamURL := range namespaces {
+		proxies[namespace] = newUpstreamProxy(upstreamURL)
+		// Without authentication, the requests keep the tracing and retrying
+		// transport of newUpstreamProxy.
+		if transport != nil {
+			proxies[namespace].Transport = transport
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			ns := query.Get("ns")
+			if ns == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The parameter is meant for the mirror only.
+			query.Del("ns")
+			r.URL.RawQuery = query.Encode()
+
+			if upstreamProxy, ok := proxies[ns]; ok {
+				log.Printf("Namespace %s %s %s -> %s", ns, r.Method, r.URL, namespaces[ns])
+				upstreamProxy.ServeHTTP(w, r)
+				return
+			}
+			if ns == defaultUpstreamURL.Host {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Let containerd fall back to the next host instead of serving an
+			// image from the wrong registry.
+			Veto(w, http.StatusNotFound, ERROR_NAME_UNKNOWN, fmt.Sprintf("unknown namespace: %s", ns))
+		})
+	}
+}
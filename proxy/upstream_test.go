@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+)
+
+func TestParseUpstreamNamespaces(t *testing.T) {
+	namespaces, err := ParseUpstreamNamespaces("docker.io=https://registry-1.docker.io, quay.io=https://quay.io")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(namespaces) != 2 || namespaces["docker.io"].Host != "registry-1.docker.io" || namespaces["quay.io"].Host != "quay.io" {
+		t.Fatalf("unexpected namespaces: %v", namespaces)
+	}
+
+	for _, value := range []string{"docker.io", "=https://quay.io", "docker.io=registry-1.docker.io"} {
+		if _, err := ParseUpstreamNamespaces(value); err == nil {
+			t.Fatalf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestNamespaceRouting(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL)
+		}))
+	}
+	ghcr := newUpstream("ghcr")
+	defer ghcr.Close()
+	dockerHub := newUpstream("docker-hub")
+	defer dockerHub.Close()
+
+	ghcrURL, _ := url.Parse(ghcr.URL)
+	dockerHubURL, _ := url.Parse(dockerHub.URL)
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		ghcr.URL,
+		WithUpstreamNamespaces(map[string]*url.URL{"docker.io": dockerHubURL}),
+	)
+
+	for _, tc := range []struct {
+		path               string
+		expectedStatusCode int
+		expectedContent    string
+	}{
+		{
+			path:               "/v2/library/nginx/manifests/latest?ns=docker.io",
+			expectedStatusCode: 200,
+			expectedContent:    "docker-hub /v2/library/nginx/manifests/latest",
+		},
+		{
+			// The tags of a Docker Hub image must not be listed with GitHub.
+			path:               "/v2/library/nginx/tags/list?ns=docker.io",
+			expectedStatusCode: 200,
+			expectedContent:    "docker-hub /v2/library/nginx/tags/list",
+		},
+		{
+			path:               fmt.Sprintf("/v2/some-owner/some-package/manifests/latest?ns=%s", ghcrURL.Host),
+			expectedStatusCode: 200,
+			expectedContent:    "ghcr /v2/some-owner/some-package/manifests/latest",
+		},
+		{
+			path:               "/v2/some-owner/some-package/manifests/latest",
+			expectedStatusCode: 200,
+			expectedContent:    "ghcr /v2/some-owner/some-package/manifests/latest",
+		},
+		{
+			path:               "/v2/some-owner/some-package/manifests/latest?ns=quay.io",
+			expectedStatusCode: 404,
+			expectedContent:    `{"errors":[{"code":"NAME_UNKNOWN","message":"unknown namespace: quay.io","detail":""}]}`,
+		},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s: expected: %d, got: %d", tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if strings.TrimSpace(res.Body.String()) != tc.expectedContent {
+			t.Fatalf("%s: expected: %s, got: %s", tc.path, tc.expectedContent, res.Body.String())
+		}
+	}
+}
+
+func TestNamespaceRoutingRetries(t *testing.T) {
+	attempts := 0
+	dockerHub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "docker-hub")
+	}))
+	defer dockerHub.Close()
+	dockerHubURL, _ := url.Parse(dockerHub.URL)
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		"https://ghcr.io",
+		WithUpstreamNamespaces(map[string]*url.URL{"docker.io": dockerHubURL}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/library/nginx/manifests/latest?ns=docker.io", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK || res.Body.String() != "docker-hub" {
+		t.Fatalf("expected the request to be retried, got: %d %s", res.Code, res.Body.String())
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got: %d", attempts)
+	}
+}
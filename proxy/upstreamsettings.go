@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// defaultRequestTimeout is the timeout of the client requests, unless
+	// their upstream registry has another timeout.
+	defaultRequestTimeout = 30 * time.Second
+	// maxUpstreamSettingsRetries is the maximum number of retries of an
+	// upstream registry.
+	maxUpstreamSettingsRetries = 10
+)
+
+// UpstreamSettings overrides the timeout, the retries and the token cache of
+// an upstream registry, e.g. for a slow self-hosted registry next to ghcr.io.
+type UpstreamSettings struct {
+	// Upstream is the host of the upstream registry, e.g.
+	// `gitlab.example.com:5050`, a namespace of `UPSTREAM_NAMESPACES` or a
+	// host of `HOST_ROUTES`.
+	Upstream string `json:"upstream"`
+	// Timeout is the timeout of the client requests served by the upstream
+	// registry, e.g. `2m` (default: `30s`).
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is the number of retries of the failed requests for manifests
+	// and blobs (default: 2).
+	Retries *int `json:"retries,omitempty"`
+	// RetryBackoff is the maximum delay before the first retry, doubled for
+	// each retry (default: `100ms`).
+	RetryBackoff string `json:"retry_backoff,omitempty"`
+	// TokenTTL is how long the tokens of the upstream registry are cached at
+	// most, when it is shorter than their lifetime, e.g. `5m`.
+	TokenTTL string `json:"token_ttl,omitempty"`
+
+	timeout      time.Duration
+	retryBackoff time.Duration
+	tokenTTL     time.Duration
+}
+
+func (s *UpstreamSettings) validate() error {
+	if s.Upstream == "" {
+		return fmt.Errorf("upstream settings without upstream")
+	}
+	for _, value := range []struct {
+		name, raw string
+		target    *time.Duration
+	}{
+		{"timeout", s.Timeout, &s.timeout},
+		{"retry_backoff", s.RetryBackoff, &s.retryBackoff},
+		{"token_ttl", s.TokenTTL, &s.tokenTTL},
+	} {
+		if value.raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value.raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("upstream %s: invalid %s: %q", s.Upstream, value.name, value.raw)
+		}
+		*value.target = d
+	}
+	if s.Retries != nil && (*s.Retries < 0 || *s.Retries > maxUpstreamSettingsRetries) {
+		return fmt.Errorf("upstream %s: invalid retries: %d (0 to %d)", s.Upstream, *s.Retries, maxUpstreamSettingsRetries)
+	}
+	return nil
+}
+
+// upstreamSettingsRegistry holds the settings of the upstream registries of a
+// proxy by host. A nil registry has the default settings.
+type upstreamSettingsRegistry struct {
+	mu     sync.RWMutex
+	byHost map[string]UpstreamSettings
+}
+
+func newUpstreamSettingsRegistry() *upstreamSettingsRegistry {
+	return &upstreamSettingsRegistry{byHost: map[string]UpstreamSettings{}}
+}
+
+type upstreamSettingsKey struct{}
+
+// withUpstreamSettings returns a context carrying the settings of the upstream
+// registries, for the transports of the requests sent upstream with it.
+func withUpstreamSettings(ctx context.Context, r *upstreamSettingsRegistry) context.Context {
+	return context.WithValue(ctx, upstreamSettingsKey{}, r)
+}
+
+// upstreamSettingsFrom returns the settings of the upstream registries carried
+// by a context, if any.
+func upstreamSettingsFrom(ctx context.Context) *upstreamSettingsRegistry {
+	r, _ := ctx.Value(upstreamSettingsKey{}).(*upstreamSettingsRegistry)
+	return r
+}
+
+func (r *upstreamSettingsRegistry) set(host string, settings UpstreamSettings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byHost[host] = settings
+}
+
+func (r *upstreamSettingsRegistry) get(host string) (UpstreamSettings, bool) {
+	if r == nil {
+		return UpstreamSettings{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	settings, ok := r.byHost[host]
+	return settings, ok
+}
+
+// retries returns the number of retries and the backoff of an upstream host.
+func (r *upstreamSettingsRegistry) retries(host string) (int, time.Duration) {
+	retries, backoff := maxUpstreamRetries, upstreamRetryBackoff
+	if settings, ok := r.get(host); ok {
+		if settings.Retries != nil {
+			retries = *settings.Retries
+		}
+		if settings.retryBackoff > 0 {
+			backoff = settings.retryBackoff
+		}
+	}
+	return retries, backoff
+}
+
+// tokenLifetime returns how long a token of an upstream host is cached: its
+// lifetime, capped by the token TTL of the host. A token is never cached
+// after it expires.
+func (r *upstreamSettingsRegistry) tokenLifetime(host string, lifetime time.Duration) time.Duration {
+	if settings, ok := r.get(host); ok && settings.tokenTTL > 0 && settings.tokenTTL < lifetime {
+		return settings.tokenTTL
+	}
+	return lifetime
+}
+
+// WithUpstreamSettings overrides the timeout, the retries and the token cache
+// of upstream registries. The proxy fails to start with invalid settings.
+func WithUpstreamSettings(settings ...UpstreamSettings) Option {
+	return func(p *containerProxy) {
+		for _, s := range settings {
+			if err := s.validate(); err != nil {
+				p.fail(err)
+				return
+			}
+			p.upstreamSettings = append(p.upstreamSettings, s)
+		}
+	}
+}
+
+// registerUpstreamSettings registers the settings of the upstream registries
+// of a proxy, the namespaces being resolved to the hosts of their registries.
+func (p *containerProxy) registerUpstreamSettings() {
+	p.settings = newUpstreamSettingsRegistry()
+	for _, settings := range p.upstreamSettings {
+		host := settings.Upstream
+		if namespaceURL, ok := p.namespaces[host]; ok {
+			host = namespaceURL.Host
+		}
+		p.settings.set(host, settings)
+	}
+}
+
+// upstreamHost returns the host of the upstream registry serving a client
+// request: the registry of its namespace, Docker Hub for the official images
+// in the registry-mirror mode, or the upstream of the proxy.
+func (p *containerProxy) upstreamHost(r *http.Request) string {
+	if ns := r.URL.Query().Get("ns"); ns != "" {
+		if namespaceURL, ok := p.namespaces[ns]; ok {
+			return namespaceURL.Host
+		}
+	}
+	if p.dockerHubURL != nil && strings.HasPrefix(r.URL.Path, "/v2/library/") {
+		return p.dockerHubURL.Host
+	}
+	return p.upstreamURL.Host
+}
+
+// requestTimeout returns the timeout of a client request, given by the
+// upstream registry serving it. The settings of a host of `HOST_ROUTES` apply
+// to the requests sent to this host too.
+func (p *containerProxy) requestTimeout(r *http.Request) time.Duration {
+	routedHost := r.Host
+	if h, _, err := net.SplitHostPort(routedHost); err == nil {
+		routedHost = h
+	}
+	for _, host := range []string{p.upstreamHost(r), strings.ToLower(routedHost)} {
+		if settings, ok := p.settings.get(host); ok && settings.timeout > 0 {
+			return settings.timeout
+		}
+	}
+	return defaultRequestTimeout
+}
+
+// withUpstream returns a context carrying the settings of the upstream
+// registries of the proxy and the transport of the requests sent to them.
+func (p *containerProxy) withUpstream(ctx context.Context) context.Context {
+	ctx = withUpstreamSettings(ctx, p.settings)
+	if p.upstreamTransport != nil {
+		ctx = withUpstreamTransport(ctx, p.upstreamTransport)
+	}
+	return ctx
+}
+
+// upstreamTimeout is a middleware setting a timeout on the context of the
+// requests, which signals through ctx.Done() that the request has timed out
+// and further processing should be stopped. The manifests and blobs streamed
+// to the clients only time out when nothing was sent for the timeout, so that
+// the large blobs are not cut off.
+func (p *containerProxy) upstreamTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(p.withUpstream(r.Context()))
+		timeout := p.requestTimeout(r)
+		if !isStreamingRequest(r) {
+			middleware.Timeout(timeout)(next).ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := withIdleTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(&activityResponseWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
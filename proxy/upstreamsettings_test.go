@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamSettingsValidate(t *testing.T) {
+	retries := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		settings UpstreamSettings
+		valid    bool
+	}{
+		{settings: UpstreamSettings{Upstream: "gitlab.example.com", Timeout: "2m", Retries: retries(5), RetryBackoff: "1s", TokenTTL: "5m"}, valid: true},
+		{settings: UpstreamSettings{Upstream: "gitlab.example.com", Retries: retries(0)}, valid: true},
+		{settings: UpstreamSettings{Timeout: "2m"}},
+		{settings: UpstreamSettings{Upstream: "gitlab.example.com", Timeout: "2 minutes"}},
+		{settings: UpstreamSettings{Upstream: "gitlab.example.com", TokenTTL: "-1m"}},
+		{settings: UpstreamSettings{Upstream: "gitlab.example.com", Retries: retries(11)}},
+	} {
+		if err := tc.settings.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: expected valid: %t, got: %v", tc.settings, tc.valid, err)
+		}
+		p := &containerProxy{}
+		WithUpstreamSettings(tc.settings)(p)
+		if (p.err == nil) != tc.valid {
+			t.Errorf("%+v: expected the option to fail: %t, got: %v", tc.settings, !tc.valid, p.err)
+		}
+	}
+}
+
+func TestUpstreamSettingsRetries(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, budget: newRetryBudget(1, 100)}}
+	for _, retries := range []int{0, 4} {
+		n := retries
+		settings := newUpstreamSettingsRegistry()
+		settings.set(host, UpstreamSettings{Upstream: host, Retries: &n, retryBackoff: time.Millisecond})
+		req, _ := http.NewRequestWithContext(withUpstreamSettings(context.Background(), settings), "GET", upstream.URL+"/v2/owner/down/blobs/sha256:1234", nil)
+		attempts = 0
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if attempts != retries+1 {
+			t.Fatalf("expected %d attempts, got: %d", retries+1, attempts)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		backoff  time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{backoff: 100 * time.Millisecond, attempt: 0, expected: 100 * time.Millisecond},
+		{backoff: 100 * time.Millisecond, attempt: 2, expected: 400 * time.Millisecond},
+		{backoff: 10 * time.Second, attempt: 10, expected: maxUpstreamRetryDelay},
+		{backoff: time.Hour, attempt: 100, expected: maxUpstreamRetryDelay},
+	} {
+		if actual := retryDelay(tc.backoff, tc.attempt); actual != tc.expected {
+			t.Errorf("%s, %d: expected: %s, got: %s", tc.backoff, tc.attempt, tc.expected, actual)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	gitlab, _ := url.Parse("https://gitlab.example.com:5050")
+	upstreamURL, _ := url.Parse("https://ghcr.io")
+	dockerHubURL, _ := url.Parse(defaultDockerHubURL)
+	p := &containerProxy{upstreamURL: upstreamURL, dockerHubURL: dockerHubURL, namespaces: map[string]*url.URL{"gitlab.example.com": gitlab}}
+	WithUpstreamSettings(
+		UpstreamSettings{Upstream: "gitlab.example.com", Timeout: "2m", TokenTTL: "5m"},
+		UpstreamSettings{Upstream: dockerHubURL.Host, Timeout: "3m"},
+		UpstreamSettings{Upstream: "hub.internal.example.com", Timeout: "4m"},
+	)(p)
+	p.registerUpstreamSettings()
+
+	for _, tc := range []struct {
+		host     string
+		path     string
+		expected time.Duration
+	}{
+		{path: "/v2/owner/name/manifests/latest", expected: defaultRequestTimeout},
+		{path: "/v2/owner/name/manifests/latest?ns=gitlab.example.com", expected: 2 * time.Minute},
+		{path: "/v2/owner/name/manifests/latest?ns=docker.io", expected: defaultRequestTimeout},
+		// The official images are served by Docker Hub in the mirror mode.
+		{path: "/v2/library/nginx/manifests/latest", expected: 3 * time.Minute},
+		// The settings of a routed host apply to its requests.
+		{host: "Hub.Internal.Example.com:443", path: "/v2/owner/name/manifests/latest", expected: 4 * time.Minute},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.host != "" {
+			req.Host = tc.host
+		}
+		if actual := p.requestTimeout(req); actual != tc.expected {
+			t.Errorf("%s%s: expected: %s, got: %s", tc.host, tc.path, tc.expected, actual)
+		}
+	}
+
+	// The token TTL caps the lifetime of the tokens.
+	if lifetime := p.settings.tokenLifetime(gitlab.Host, time.Hour); lifetime != 5*time.Minute {
+		t.Errorf("expected the token TTL of the upstream, got: %s", lifetime)
+	}
+	if lifetime := p.settings.tokenLifetime(gitlab.Host, time.Minute); lifetime != time.Minute {
+		t.Errorf("expected the lifetime of the token, shorter than the TTL, got: %s", lifetime)
+	}
+	if lifetime := p.settings.tokenLifetime("ghcr.io", time.Minute); lifetime != time.Minute {
+		t.Errorf("expected the lifetime of the token, got: %s", lifetime)
+	}
+
+	// The settings of a proxy do not apply to the other proxies.
+	other := &containerProxy{upstreamURL: upstreamURL, namespaces: p.namespaces}
+	other.registerUpstreamSettings()
+	if actual := other.requestTimeout(httptest.NewRequest("GET", "/v2/owner/name/manifests/latest?ns=gitlab.example.com", nil)); actual != defaultRequestTimeout {
+		t.Errorf("expected the default timeout, got: %s", actual)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxRepositoryNameLength is the maximum length of the repository names, the
+// limit of most registries.
+const maxRepositoryNameLength = 255
+
+var (
+	// tagNamePattern matches the tags allowed by the OCI distribution
+	// specification.
+	tagNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// digestPattern matches the digests allowed by the OCI image
+	// specification, i.e. `algorithm:encoded`.
+	digestPattern = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+	invalidReferencesTotal = newCounterVec(
+		"invalid_references_total",
+		"Number of registry requests rejected because of an invalid repository name, tag or digest, by error code.",
+		"code",
+	)
+)
+
+// validateDigest returns an error when a digest does not match the grammar of
+// the OCI image specification. The length of the encoded part is checked by
+// the upstream registry, which knows the algorithms it supports.
+func validateDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return fmt.Errorf("invalid digest: %q", digest)
+	}
+	return nil
+}
+
+// validateReference returns the error code and message of an invalid
+// repository name, tag or digest of a registry path, if any.
+func validateReference(path string) (string, string, bool) {
+	name, ok := repositoryFromPath(path)
+	if !ok {
+		return "", "", true
+	}
+	if len(name) > maxRepositoryNameLength || !repositoryNamePattern.MatchString(name) {
+		return ERROR_NAME_INVALID, fmt.Sprintf("invalid repository name: %q", name), false
+	}
+
+	reference := ""
+	if _, kind, ref, ok := splitRegistryPath(path); ok {
+		reference = ref
+		if kind == "manifests" && !strings.Contains(ref, ":") {
+			if !tagNamePattern.MatchString(ref) {
+				return ERROR_TAG_INVALID, fmt.Sprintf("invalid tag: %q", ref), false
+			}
+			return "", "", true
+		}
+	} else if i := strings.LastIndex(path, "/referrers/"); i > 0 {
+		reference = path[i+len("/referrers/"):]
+	}
+	if reference != "" {
+		if err := validateDigest(reference); err != nil {
+			return ERROR_DIGEST_INVALID, err.Error(), false
+		}
+	}
+	return "", "", true
+}
+
+// validateReferences is a middleware rejecting the registry requests whose
+// repository name, tag or digest does not match the grammar of the OCI
+// distribution specification, before they reach the backend, the caches or
+// the upstream registry.
+func validateReferences(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The encoded slashes and dot segments are not valid in a name, and
+		// would be interpreted differently by the upstream registry.
+		if strings.Contains(strings.ToLower(r.URL.RawPath), "%2f") || hasDotSegment(r.URL.Path) {
+			invalidReferencesTotal.Inc(ERROR_NAME_INVALID)
+			Veto(w, http.StatusBadRequest, ERROR_NAME_INVALID, "invalid repository name")
+			return
+		}
+		if code, message, ok := validateReference(r.URL.Path); !ok {
+			invalidReferencesTotal.Inc(code)
+			Veto(w, http.StatusBadRequest, code, message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasDotSegment returns whether a path contains a `.` or `..` segment.
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateReferences(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	proxy := NewProxy("127.0.0.1:10000", nil, upstream.URL)
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		path         string
+		expectedCode string
+	}{
+		{path: "/v2/my-org/app/manifests/latest"},
+		{path: "/v2/my-org/app/manifests/v1.2.3_build-4"},
+		{path: "/v2/my-org/app/manifests/" + digest},
+		{path: "/v2/my-org/sub/app/blobs/" + digest},
+		{path: "/v2/my-org/app/tags/list"},
+		{path: "/v2/my-org/app/referrers/" + digest},
+		{path: "/v2/_catalog"},
+		{path: "/v2/my-org/App/manifests/latest", expectedCode: ERROR_NAME_INVALID},
+		{path: "/v2/my-org/-app/tags/list", expectedCode: ERROR_NAME_INVALID},
+		{path: "/v2/my-org/../app/manifests/latest", expectedCode: ERROR_NAME_INVALID},
+		{path: "/v2/my-org/app%2F..%2Fother/manifests/latest", expectedCode: ERROR_NAME_INVALID},
+		{path: "/v2/" + strings.Repeat("a/", 128) + "app/manifests/latest", expectedCode: ERROR_NAME_INVALID},
+		{path: "/v2/my-org/app/manifests/.latest", expectedCode: ERROR_TAG_INVALID},
+		{path: "/v2/my-org/app/manifests/" + strings.Repeat("a", 129), expectedCode: ERROR_TAG_INVALID},
+		{path: "/v2/my-org/app/manifests/sha256:abc.def", expectedCode: ERROR_DIGEST_INVALID},
+		{path: "/v2/my-org/app/blobs/latest", expectedCode: ERROR_DIGEST_INVALID},
+		{path: "/v2/my-org/app/referrers/SHA256:1234", expectedCode: ERROR_DIGEST_INVALID},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if tc.expectedCode == "" {
+			if res.Code == http.StatusBadRequest {
+				t.Fatalf("%s: unexpected error: %s", tc.path, res.Body.String())
+			}
+			continue
+		}
+		if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), `"code":"`+tc.expectedCode+`"`) {
+			t.Fatalf("%s: expected: 400 %s, got: %d %s", tc.path, tc.expectedCode, res.Code, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// The build information of the proxy, set when building it with e.g.
+// `-ldflags "-X $PKG.version=v1.2.3 -X $PKG.commit=abc123"`, where $PKG is
+// `github.com/willdurand/container-registry-proxy/proxy`. The commit and
+// the build date are read from the VCS information embedded by the Go
+// toolchain otherwise.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is the build information of the proxy.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if debugInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range debugInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// String returns the build information printed by `--version`.
+func (info buildInfo) String() string {
+	s := "container-registry-proxy " + info.Version
+	var details []string
+	if info.Commit != "" {
+		details = append(details, "commit "+info.Commit)
+	}
+	if info.BuildDate != "" {
+		details = append(details, "built "+info.BuildDate)
+	}
+	details = append(details, info.GoVersion)
+	return s + " (" + strings.Join(details, ", ") + ")"
+}
+
+// instanceID identifies the replica of the proxy, i.e. its pod name or its
+// hostname.
+func instanceID() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// userAgent is the User-Agent of the requests sent to GitHub and to the
+// upstream registries, so that their operators can identify the proxy. It is
+// replaced by `USER_AGENT` if set.
+var userAgent = fmt.Sprintf("container-registry-proxy/%s (instance %s)", version, instanceID())
+
+// withUserAgent returns a copy of a request identifying the proxy in its
+// User-Agent header, after the products of the client of a forwarded request,
+// e.g. `docker/24.0.0 ... container-registry-proxy/v1.2.3 (instance proxy-0)`.
+func withUserAgent(req *http.Request) *http.Request {
+	clientUserAgent := req.Header.Get("User-Agent")
+	if clientUserAgent == userAgent || strings.HasSuffix(clientUserAgent, " "+userAgent) {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	if clientUserAgent == "" {
+		req.Header.Set("User-Agent", userAgent)
+	} else {
+		req.Header.Set("User-Agent", clientUserAgent+" "+userAgent)
+	}
+	return req
+}
+
+// versionResponse is the build information and the configuration of a proxy.
+type versionResponse struct {
+	buildInfo
+	Instance string `json:"instance"`
+	// Backend is the registry backend, see backendName.
+	Backend string `json:"backend"`
+	// Cache is the blob cache: disk or none.
+	Cache string `json:"cache"`
+	// Auth are the authentication methods of the clients, none when the
+	// clients are not authenticated.
+	Auth     []string `json:"auth"`
+	Features []string `json:"features"`
+	// FeatureFlags are the states of the feature flags, see FeatureFlags.
+	FeatureFlags FeatureFlags `json:"feature_flags"`
+}
+
+// authMethods returns the authentication methods of the clients.
+func (p *containerProxy) authMethods() []string {
+	methods := []string{}
+	if p.tokens != nil {
+		methods = append(methods, "token")
+	}
+	for _, authenticator := range p.authenticators {
+		switch authenticator.(type) {
+		case *oidcAuthenticator:
+			methods = append(methods, "oidc")
+		case *githubActionsAuthenticator:
+			methods = append(methods, methodGitHubActions)
+		case *githubTeamsAuthenticator:
+			methods = append(methods, methodGitHub)
+		case *serviceAccountAuthenticator:
+			methods = append(methods, methodServiceAccount)
+		case *apiKeyAuthenticator:
+			methods = append(methods, methodAPIKey)
+		case certificateAuthenticator:
+			methods = append(methods, "mtls")
+		}
+	}
+	if len(methods) == 0 {
+		methods = append(methods, "none")
+	}
+	return methods
+}
+
+// features returns the optional features enabled on the proxy.
+func (p *containerProxy) features() []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"metadata-db", p.metadata != nil},
+		{"api-keys", p.apiKeys != nil},
+		{"blob-prefetch", p.prefetcher != nil},
+		{"blob-cache-peers", p.peers != nil},
+		{"docker-mirror", p.dockerHubURL != nil},
+		{"immutable-tags", p.immutableTags != nil},
+		{"digest-pins", len(p.digestPins) > 0},
+		{"virtual-tags", len(p.virtualTags) > 0},
+		{"aliases", len(p.aliases) > 0},
+		{"deprecations", len(p.deprecations) > 0},
+		{"quotas", len(p.quotas) > 0},
+		{"mirror-signatures", p.mirrorSignatures},
+		{"require-signatures", p.requireSignatures},
+		{"delete-dry-run", p.deleteDryRun},
+		{"chaos", len(p.chaos) > 0},
+		{"manifest-transforms", p.transforms != nil},
+		{"foreign-layers-" + foreignLayersBlock, p.foreignLayers != nil && p.foreignLayers.policy == foreignLayersBlock},
+		{"foreign-layers-" + foreignLayersRewrite, p.foreignLayers != nil && p.foreignLayers.policy == foreignLayersRewrite},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
+
+// Version returns the build information of the proxy and the features it
+// enables, to make the bug reports and the audits of the replicas easier.
+func (p *containerProxy) Version(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Version Request %s -> %s", r.Method, r.URL)
+
+	response := versionResponse{
+		buildInfo: readBuildInfo(),
+		Instance:  instanceID(),
+		Backend:   backendName(p.backend),
+		Cache:     "none",
+		Auth:      p.authMethods(),
+		Features:  p.features(),
+	}
+	response.FeatureFlags = DefaultFeatureFlags()
+	for name, enabled := range p.featureFlags {
+		response.FeatureFlags[name] = enabled
+	}
+	if p.blobCache != nil {
+		response.Cache = "disk"
+	}
+	writeRegistryJSON(w, r, "application/json", response)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestUpstreamUserAgent(t *testing.T) {
+	var userAgents []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		clientUserAgent   string
+		expectedUserAgent string
+	}{
+		{clientUserAgent: "", expectedUserAgent: userAgent},
+		{clientUserAgent: "docker/24.0.0", expectedUserAgent: "docker/24.0.0 " + userAgent},
+	} {
+		userAgents = nil
+		req, _ := http.NewRequestWithContext(withTestEgress(context.Background()), "GET", upstream.URL+"/v2/", nil)
+		if tc.clientUserAgent != "" {
+			req.Header.Set("User-Agent", tc.clientUserAgent)
+		}
+		res, err := (&instrumentedTransport{}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if len(userAgents) != 1 || userAgents[0] != tc.expectedUserAgent {
+			t.Fatalf("expected: %q, got: %q", tc.expectedUserAgent, userAgents)
+		}
+		if req.Header.Get("User-Agent") != tc.clientUserAgent {
+			t.Fatal("expected the request not to be modified")
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		"http://127.0.0.1/upstream",
+		WithDeleteDryRun(),
+		WithFeatureFlags(FeatureFlags{featureChaos: true}),
+	)
+
+	req, _ := http.NewRequest("GET", "/api/version", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, res.Code)
+	}
+	var response versionResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Version != version || response.GoVersion != runtime.Version() {
+		t.Fatalf("unexpected build information: %+v", response.buildInfo)
+	}
+	if response.Backend != "passthrough" || response.Cache != "none" {
+		t.Fatalf("unexpected backend and cache: %s, %s", response.Backend, response.Cache)
+	}
+	if !reflect.DeepEqual(response.Auth, []string{"none"}) || !reflect.DeepEqual(response.Features, []string{"delete-dry-run"}) {
+		t.Fatalf("unexpected auth methods and features: %v, %v", response.Auth, response.Features)
+	}
+	if !response.FeatureFlags[featureChaos] || !response.FeatureFlags[featureBlobPrefetch] {
+		t.Fatalf("unexpected feature flags: %v", response.FeatureFlags)
+	}
+}
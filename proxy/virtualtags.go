@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/backend"
+)
+
+// Strategies of the virtual tags.
+const (
+	// virtualTagSemver resolves to the highest version matching a constraint.
+	virtualTagSemver = "semver"
+	// virtualTagNewest resolves to the most recently pushed version.
+	virtualTagNewest = "newest"
+)
+
+// VirtualTag is a tag computed by the proxy from the versions of a
+// repository, e.g. `stable` for the highest version, resolved when its
+// manifest is fetched. Nothing is changed upstream.
+type VirtualTag struct {
+	Tag string `json:"tag"`
+	// Repository is a glob pattern (see path.Match) of the repositories having
+	// the virtual tag, all the repositories by default.
+	Repository string `json:"repository,omitempty"`
+	// Strategy is either `semver` or `newest`.
+	Strategy string `json:"strategy"`
+	// Constraint and Prerelease select the versions of the `semver` strategy
+	// (see parseSemConstraint).
+	Constraint string `json:"constraint,omitempty"`
+	Prerelease bool   `json:"prerelease,omitempty"`
+	// Match is a glob pattern of the tags of the versions considered by the
+	// `newest` strategy, e.g. `nightly-*`, all the tagged versions by default.
+	Match string `json:"match,omitempty"`
+}
+
+func (v VirtualTag) validate() error {
+	if v.Tag == "" || strings.ContainsAny(v.Tag, ":@/") {
+		return fmt.Errorf("invalid virtual tag: %q", v.Tag)
+	}
+	for _, glob := range []string{v.Repository, v.Match} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid virtual tag %s: %w", v.Tag, err)
+		}
+	}
+	switch v.Strategy {
+	case virtualTagSemver:
+		if _, err := parseSemConstraint(v.Constraint); err != nil {
+			return fmt.Errorf("invalid virtual tag %s: %w", v.Tag, err)
+		}
+	case virtualTagNewest:
+	default:
+		return fmt.Errorf("invalid virtual tag %s: unknown strategy %q", v.Tag, v.Strategy)
+	}
+	return nil
+}
+
+func (v VirtualTag) matches(name, tag string) bool {
+	if tag != v.Tag {
+		return false
+	}
+	if v.Repository == "" {
+		return true
+	}
+	matched, _ := path.Match(v.Repository, name)
+	return matched
+}
+
+// resolve returns the version the virtual tag points to.
+func (v VirtualTag) resolve(versions []backend.Version) (backend.Version, bool) {
+	if v.Strategy == virtualTagSemver {
+		var tags []string
+		for _, version := range versions {
+			tags = append(tags, version.Tags...)
+		}
+		constraint, _ := parseSemConstraint(v.Constraint)
+		tag, _, ok := latestTag(tags, constraint, v.Prerelease)
+		if !ok {
+			return backend.Version{}, false
+		}
+		for _, version := range versions {
+			for _, t := range version.Tags {
+				if t == tag {
+					return version, true
+				}
+			}
+		}
+		return backend.Version{}, false
+	}
+
+	var newest backend.Version
+	found := false
+	for _, version := range versions {
+		if !v.matchesVersion(version) {
+			continue
+		}
+		if !found || version.CreatedAt.After(newest.CreatedAt) {
+			newest, found = version, true
+		}
+	}
+	return newest, found
+}
+
+// matchesVersion returns true when a version has a tag matching the pattern
+// of the `newest` strategy. The untagged versions (e.g. the platform
+// manifests of an index) and the cosign signatures are ignored.
+func (v VirtualTag) matchesVersion(version backend.Version) bool {
+	for _, tag := range version.Tags {
+		if strings.HasPrefix(tag, "sha256-") || tag == v.Tag {
+			continue
+		}
+		if v.Match == "" {
+			return true
+		}
+		if matched, _ := path.Match(v.Match, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// WithVirtualTags adds virtual tags to the repositories. They take precedence
+// over the tags of the upstream registry.
+func WithVirtualTags(tags ...VirtualTag) Option {
+	return func(p *containerProxy) {
+		for _, tag := range tags {
+			if err := tag.validate(); err != nil {
+				p.fail(err)
+				continue
+			}
+			p.virtualTags = append(p.virtualTags, tag)
+		}
+	}
+}
+
+// resolveVirtualTags is a middleware replacing the virtual tags with the
+// digests they resolve to in the manifest requests, with the versions listed
+// by the backend. Pushing or deleting a virtual tag is denied.
+func (p *containerProxy) resolveVirtualTags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, reference, ok := splitRegistryPath(r.URL.Path)
+		if !ok || kind != "manifests" || strings.Contains(reference, ":") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var virtualTag *VirtualTag
+		for i := range p.virtualTags {
+			if p.virtualTags[i].matches(p.prefixedName(name), reference) {
+				virtualTag = &p.virtualTags[i]
+				break
+			}
+		}
+		if virtualTag == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			Veto(w, http.StatusForbidden, ERROR_DENIED, fmt.Sprintf("tag %s is virtual", reference))
+			return
+		}
+
+		lister, ok := p.backend.(backend.VersionLister)
+		owner, repository, found := strings.Cut(name, "/")
+		if !ok || !found {
+			Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, fmt.Sprintf("virtual tag %s cannot be resolved", reference))
+			return
+		}
+		versions, err := lister.ListVersions(r.Context(), owner, repository)
+		if err != nil {
+			if errors.Is(err, backend.ErrNotFound) {
+				Veto(w, http.StatusNotFound, ERROR_NAME_UNKNOWN, "repository name not known to registry")
+				return
+			}
+			// e.g. a repository whose tags are listed by the catalog file.
+			if errors.Is(err, backend.ErrNotSupported) {
+				Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, fmt.Sprintf("virtual tag %s cannot be resolved", reference))
+				return
+			}
+			Veto(w, http.StatusBadGateway, errorCode(ERROR_UNKNOWN, err), fmt.Sprintf("cannot resolve the virtual tag %s: %s", reference, err))
+			return
+		}
+		version, ok := virtualTag.resolve(versions)
+		if !ok {
+			Veto(w, http.StatusNotFound, ERROR_MANIFEST_UNKNOWN, fmt.Sprintf("virtual tag %s matches no version", reference))
+			return
+		}
+		log.Printf("virtual tag %s:%s resolved to %s", p.prefixedName(name), reference, version.Digest)
+
+		resolved := r.Clone(r.Context())
+		resolved.URL.Path = "/v2/" + name + "/manifests/" + version.Digest
+		resolved.URL.RawPath = ""
+		resolved.RequestURI = ""
+		next.ServeHTTP(w, resolved)
+	})
+}
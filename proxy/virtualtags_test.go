@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/backend/static"
+)
+
+func TestVirtualTags(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	day := func(d int) *github.Timestamp {
+		return &github.Timestamp{Time: time.Date(2023, 1, d, 0, 0, 0, 0, time.UTC)}
+	}
+	version := func(digest string, createdAt *github.Timestamp, tags ...string) *github.PackageVersion {
+		return &github.PackageVersion{
+			Name:      github.String(digest),
+			CreatedAt: createdAt,
+			Metadata:  &github.PackageMetadata{Container: &github.PackageContainerMetadata{Tags: tags}},
+		}
+	}
+	client := &githubClientMock{
+		PackageVersions: []*github.PackageVersion{
+			version("sha256:1111", day(1), "1.0.0"),
+			version("sha256:2222", day(2), "1.1.0", "nightly-20230102"),
+			version("sha256:3333", day(3), "2.0.0-rc.1"),
+			version("sha256:4444", day(4), "nightly-20230104"),
+			version("sha256:5555", day(5), "sha256-4444.sig"),
+			version("sha256:6666", day(6)),
+		},
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(client, nil),
+		upstream.URL,
+		WithVirtualTags(
+			VirtualTag{Tag: "stable", Strategy: virtualTagSemver},
+			VirtualTag{Tag: "next", Strategy: virtualTagSemver, Prerelease: true},
+			VirtualTag{Tag: "v1", Repository: "some-owner/*", Strategy: virtualTagSemver, Constraint: "^1"},
+			VirtualTag{Tag: "nightly", Strategy: virtualTagNewest, Match: "nightly-*"},
+			VirtualTag{Tag: "edge", Strategy: virtualTagNewest},
+			VirtualTag{Tag: "v3", Strategy: virtualTagSemver, Constraint: "^3"},
+		),
+	)
+
+	for _, tc := range []struct {
+		method             string
+		path               string
+		expectedStatusCode int
+		expectedPath       string
+	}{
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/stable", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/sha256:2222"},
+		{method: "HEAD", path: "/v2/some-owner/some-package/manifests/next", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/sha256:3333"},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/v1", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/sha256:2222"},
+		{method: "GET", path: "/v2/other-owner/some-package/manifests/v1", expectedStatusCode: 200, expectedPath: "/v2/other-owner/some-package/manifests/v1"},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/nightly", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/sha256:4444"},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/edge", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/sha256:4444"},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/1.0.0", expectedStatusCode: 200, expectedPath: "/v2/some-owner/some-package/manifests/1.0.0"},
+		{method: "GET", path: "/v2/some-owner/some-package/manifests/v3", expectedStatusCode: 404},
+		{method: "PUT", path: "/v2/some-owner/some-package/manifests/stable", expectedStatusCode: 403},
+	} {
+		upstreamPath = ""
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		if res.Code != tc.expectedStatusCode {
+			t.Fatalf("%s %s: expected: %d, got: %d", tc.method, tc.path, tc.expectedStatusCode, res.Code)
+		}
+		if upstreamPath != tc.expectedPath {
+			t.Fatalf("%s %s: expected: %s, got: %s", tc.method, tc.path, tc.expectedPath, upstreamPath)
+		}
+	}
+}
+
+func TestVirtualTagsStaticCatalog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	// The versions of the repositories whose tags are listed by the catalog
+	// file are not listed.
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`{"repositories": [{"owner": "some-owner", "name": "some-package", "tags": ["1.0.0"]}]}`), 0o644)
+	registry, err := static.New(path, static.WithNext(ghbackend.New(&githubClientMock{}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		registry,
+		upstream.URL,
+		WithVirtualTags(VirtualTag{Tag: "stable", Strategy: virtualTagSemver}),
+	)
+
+	req, _ := http.NewRequest("GET", "/v2/some-owner/some-package/manifests/stable", nil)
+	res := httptest.NewRecorder()
+	proxy.Handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusNotFound, res.Code)
+	}
+}
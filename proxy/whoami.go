@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// whoamiPath is the path of the endpoint returning the identity of the
+// clients, under `/v2/` so that it gets the registry credentials.
+const whoamiPath = "/v2/_auth/whoami"
+
+// rateLimitStatus is the rate limit of an API key returned by the whoami
+// endpoint.
+type rateLimitStatus struct {
+	// Limit is the number of requests allowed per minute.
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+}
+
+type whoamiResponse struct {
+	Subject string   `json:"subject"`
+	Method  string   `json:"method"`
+	Groups  []string `json:"groups,omitempty"`
+	// Access are the scopes of the token minted by the proxy, if any.
+	Access []AccessEntry `json:"access,omitempty"`
+	// Scopes are the scopes of the API key, if any.
+	Scopes    []string         `json:"scopes,omitempty"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	RateLimit *rateLimitStatus `json:"rate_limit,omitempty"`
+	// Allowed are the actions of the requested scopes the client can perform.
+	Allowed []AccessEntry `json:"allowed,omitempty"`
+}
+
+// Whoami returns the identity of the client, so that the users can debug why
+// a request is denied. With `scope` parameters (e.g.
+// `repository:my-org/app:pull,push`), the actions the client is allowed to
+// perform are returned as well.
+func (p *containerProxy) Whoami(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Whoami Request %s -> %s", r.Method, r.URL)
+	w.Header().Set("Content-Type", "application/json")
+
+	identity := IdentityFromContext(r.Context())
+
+	response := whoamiResponse{
+		Subject: identity.Subject,
+		Method:  identity.Method,
+		Groups:  identity.Groups,
+		Access:  identity.Access,
+	}
+	for _, rule := range identity.scopes {
+		response.Scopes = append(response.Scopes, rule.Pattern+":"+strings.Join(rule.Actions, ","))
+	}
+	if exp, ok := identity.Claims.Time("exp"); ok {
+		response.ExpiresAt = &exp
+	}
+	if identity.Method == methodAPIKey && p.metadata != nil {
+		if key, ok := p.metadata.APIKey(identity.Subject); ok {
+			response.Scopes = key.Scopes
+			if key.RateLimit > 0 && p.apiKeys != nil {
+				remaining := int(p.apiKeys.get(key).available())
+				if remaining < 0 {
+					remaining = 0
+				}
+				response.RateLimit = &rateLimitStatus{Limit: key.RateLimit, Remaining: remaining}
+			}
+		}
+	}
+
+	for _, scope := range r.URL.Query()["scope"] {
+		entry, err := parseScope(scope)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(makeError(ERROR_UNSUPPORTED, err.Error()))
+			return
+		}
+		if entry.Type == "repository" {
+			entry.Name = p.resolveAlias(entry.Name)
+		}
+		var actions []string
+		for _, action := range entry.Actions {
+			if p.isAllowed(identity, entry.Type, entry.Name, action) {
+				actions = append(actions, action)
+			}
+		}
+		entry.Actions = actions
+		if entry.Actions == nil {
+			entry.Actions = []string{}
+		}
+		response.Allowed = append(response.Allowed, entry)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
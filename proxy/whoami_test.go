@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willdurand/container-registry-proxy/metadata"
+)
+
+func TestWhoami(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	store, err := metadata.Open(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := createAPIKey(store, apiKeyRequest{Name: "ci", Scopes: []string{"my-org/*:pull"}, RateLimit: 60}, "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		nil,
+		upstream.URL,
+		WithMetadataStore(store),
+		WithAPIKeys(),
+		WithTokenAuth([]byte("some-key"), time.Minute),
+		WithAnonymousRead("public/*"),
+	)
+	_, token := requestToken(t, proxy.Handler, key.Key, "repository:my-org/app:pull")
+
+	whoami := func(authorization string, scopes ...string) (int, whoamiResponse) {
+		req, _ := http.NewRequest("GET", whoamiPath+"?"+url.Values{"scope": scopes}.Encode(), nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+
+		var response whoamiResponse
+		json.NewDecoder(res.Body).Decode(&response)
+		return res.Code, response
+	}
+
+	code, response := whoami("Bearer "+key.Key, "repository:my-org/app:pull,push", "repository:other/app:pull")
+	if code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, code)
+	}
+	if response.Subject != key.ID || response.Method != methodAPIKey || !reflect.DeepEqual(response.Scopes, []string{"my-org/*:pull"}) {
+		t.Fatalf("unexpected identity: %+v", response)
+	}
+	// The whoami request itself is counted.
+	if response.RateLimit == nil || response.RateLimit.Limit != 60 || response.RateLimit.Remaining != 59 {
+		t.Fatalf("unexpected rate limit: %+v", response.RateLimit)
+	}
+	expectedAllowed := []AccessEntry{
+		{Type: "repository", Name: "my-org/app", Actions: []string{"pull"}},
+		{Type: "repository", Name: "other/app", Actions: []string{}},
+	}
+	if !reflect.DeepEqual(response.Allowed, expectedAllowed) {
+		t.Fatalf("expected: %v, got: %v", expectedAllowed, response.Allowed)
+	}
+
+	code, response = whoami("Bearer " + token)
+	if code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, code)
+	}
+	expectedAccess := []AccessEntry{{Type: "repository", Name: "my-org/app", Actions: []string{"pull"}}}
+	if response.Subject != key.ID || !reflect.DeepEqual(response.Access, expectedAccess) || response.ExpiresAt == nil {
+		t.Fatalf("unexpected identity: %+v", response)
+	}
+
+	code, response = whoami("", "repository:public/app:pull")
+	if code != http.StatusOK || response.Method != methodAnonymous || len(response.Allowed[0].Actions) != 1 {
+		t.Fatalf("unexpected response: %d %+v", code, response)
+	}
+
+	if code, _ := whoami("Bearer crp_unknown"); code != http.StatusUnauthorized {
+		t.Fatalf("expected: %d, got: %d", http.StatusUnauthorized, code)
+	}
+}
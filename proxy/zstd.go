@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+const (
+	mediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+var zstdTranscodingsTotal = newCounterVec(
+	"blob_cache_zstd_transcodings_total",
+	"Number of gzip layers transcoded to zstd in the blob cache by result (converted, failed).",
+	"result",
+)
+
+// containerdUserAgent matches the User-Agent of containerd, which supports the
+// zstd layers since 1.5, and by default since 1.6.
+var containerdUserAgent = regexp.MustCompile(`containerd/v?(\d+)\.(\d+)`)
+
+// zstdClientKey is the context key of the manifest requests of the clients
+// supporting the zstd layers.
+type zstdClientKey struct{}
+
+// zstdTranscoder recompresses the cached gzip layers to zstd with an external
+// command, since the standard library has no zstd encoder. The command reads
+// the uncompressed layer on its standard input and writes the compressed layer
+// on its standard output, e.g. `zstd -q -c -T0`.
+type zstdTranscoder struct {
+	command []string
+	cache   *cache.Cache
+	queue   *conversionQueue
+}
+
+// WithZstdTranscoding recompresses the gzip layers added to the blob cache to
+// zstd with command, and serves the zstd layers to the clients supporting
+// them. It requires the blob cache.
+func WithZstdTranscoding(command ...string) Option {
+	return func(p *containerProxy) {
+		if len(command) == 0 {
+			return
+		}
+		t := &zstdTranscoder{command: command}
+		t.queue = newConversionQueue("zstd", zstdTranscodingsTotal, t.transcode)
+		p.zstd = t
+	}
+}
+
+// supportsZstd returns whether the client of a request supports the zstd
+// layers: containerd since 1.6, or the clients listing the zstd layers in
+// their Accept header.
+func supportsZstd(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, mediaTypeOCILayerZstd) {
+			return true
+		}
+	}
+	match := containerdUserAgent.FindStringSubmatch(r.Header.Get("User-Agent"))
+	if match == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return major > 1 || (major == 1 && minor >= 6)
+}
+
+// detectZstdClients is a middleware marking the manifest requests of the
+// clients supporting the zstd layers.
+func (p *containerProxy) detectZstdClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, kind, _, ok := splitRegistryPath(r.URL.Path); ok && kind == "manifests" && supportsZstd(r) {
+			r = r.WithContext(context.WithValue(r.Context(), zstdClientKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rewriteZstdLayers replaces the gzip layers transcoded to zstd in a manifest
+// pulled by tag by a client supporting them, including the image manifests of
+// an index. The layers that are cached but not transcoded yet are queued.
+func (p *containerProxy) rewriteZstdLayers(ctx context.Context, name string, body []byte, mediaType string) ([]byte, string, error) {
+	if supported, _ := ctx.Value(zstdClientKey{}).(bool); !supported {
+		return body, mediaType, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, mediaType, nil
+	}
+
+	changed, err := p.rewriteImageManifests(ctx, name, fields, p.zstd.rewriteLayers)
+	if err != nil {
+		return nil, "", err
+	}
+	if !changed {
+		return body, mediaType, nil
+	}
+	body, err = json.Marshal(fields)
+	return body, mediaType, err
+}
+
+// rewriteLayers replaces the transcoded gzip layers of an OCI image manifest,
+// and returns whether it changed. The config is unchanged since the diff IDs
+// are the digests of the uncompressed layers.
+func (t *zstdTranscoder) rewriteLayers(fields map[string]json.RawMessage) (bool, error) {
+	var layers []map[string]json.RawMessage
+	if raw, ok := fields["layers"]; !ok || json.Unmarshal(raw, &layers) != nil {
+		return false, nil
+	}
+
+	changed := false
+	for _, layer := range layers {
+		var layerMediaType, digest string
+		var annotations map[string]string
+		json.Unmarshal(layer["mediaType"], &layerMediaType)
+		json.Unmarshal(layer["digest"], &digest)
+		json.Unmarshal(layer["annotations"], &annotations)
+		// The eStargz layers are kept for the lazy pulls.
+		if layerMediaType != mediaTypeOCILayerGzip || annotations[estargzTOCDigestAnnotation] != "" {
+			continue
+		}
+		transcoded, size, ok := t.variant(digest)
+		if !ok {
+			if t.cache.Has(digest) {
+				t.queue.enqueue(digest)
+			}
+			continue
+		}
+		layer["mediaType"], _ = json.Marshal(mediaTypeOCILayerZstd)
+		layer["digest"], _ = json.Marshal(transcoded)
+		layer["size"], _ = json.Marshal(size)
+		// The annotations may describe the gzip layer.
+		delete(layer, "annotations")
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	raw, err := json.Marshal(layers)
+	if err != nil {
+		return false, err
+	}
+	fields["layers"] = raw
+	return true, nil
+}
+
+// mappingPath returns the path of the file mapping a gzip layer to its zstd
+// variant.
+func (t *zstdTranscoder) mappingPath(digest string) string {
+	return filepath.Join(t.cache.Dir(), "zstd", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// variant returns the digest and size of the cached zstd variant of a gzip
+// layer.
+func (t *zstdTranscoder) variant(digest string) (string, int64, bool) {
+	if !cache.IsCacheableDigest(digest) {
+		return "", 0, false
+	}
+	data, err := os.ReadFile(t.mappingPath(digest))
+	if err != nil {
+		return "", 0, false
+	}
+	transcoded := string(data)
+	if !cache.IsCacheableDigest(transcoded) {
+		return "", 0, false
+	}
+	// The variant may have been evicted from the cache.
+	info, err := os.Stat(t.cache.Path(transcoded))
+	if err != nil {
+		return "", 0, false
+	}
+	return transcoded, info.Size(), true
+}
+
+// transcode adds the zstd variant of a cached gzip layer to the cache, and
+// returns its digest.
+func (t *zstdTranscoder) transcode(ctx context.Context, digest string) (string, error) {
+	f, _, err := t.cache.Open(digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	uncompressed, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.command[0], t.command[1:]...)
+	cmd.Stdin = uncompressed
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	transcoded, _, addErr := t.cache.Add(stdout)
+	if addErr != nil {
+		// The command exits once its output is read.
+		io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		if transcoded != "" {
+			t.cache.Remove(transcoded)
+		}
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if addErr != nil {
+		return "", addErr
+	}
+
+	if err := t.cache.RecordDerived(transcoded, digest); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.mappingPath(digest)), 0o755); err != nil {
+		return "", err
+	}
+	return transcoded, os.WriteFile(t.mappingPath(digest), []byte(transcoded), 0o644)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	ghbackend "github.com/willdurand/container-registry-proxy/backend/github"
+	"github.com/willdurand/container-registry-proxy/cache"
+)
+
+func TestSupportsZstd(t *testing.T) {
+	for _, tc := range []struct {
+		userAgent string
+		accept    string
+		expected  bool
+	}{
+		{userAgent: "containerd/v1.7.2", expected: true},
+		{userAgent: "containerd/1.6.0", expected: true},
+		{userAgent: "containerd/v2.0.0", expected: true},
+		{userAgent: "containerd/v1.5.9", expected: false},
+		{userAgent: "docker/24.0.7 go/go1.20.10", expected: false},
+		{userAgent: "skopeo/1.14", accept: mediaTypeOCIManifest + ", " + mediaTypeOCILayerZstd, expected: true},
+	} {
+		req := httptest.NewRequest("GET", "/v2/some-owner/some-package/manifests/latest", nil)
+		req.Header.Set("User-Agent", tc.userAgent)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		if actual := supportsZstd(req); actual != tc.expected {
+			t.Errorf("%s: expected: %t, got: %t", tc.userAgent, tc.expected, actual)
+		}
+	}
+}
+
+func TestZstdTranscoding(t *testing.T) {
+	// The command is a stand-in for zstd, the transcoded layer being the
+	// uncompressed layer.
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip(err)
+	}
+
+	uncompressed := bytes.Repeat([]byte("some layer "), 100)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(uncompressed)
+	gz.Close()
+	layer := compressed.Bytes()
+	layerDigest := digestOf(layer)
+	transcodedDigest := digestOf(uncompressed)
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:" + strings.Repeat("c", 64), "size": 2},
+		"layers": []map[string]interface{}{
+			{"mediaType": mediaTypeOCILayerGzip, "digest": layerDigest, "size": len(layer), "annotations": map[string]string{"some": "annotation"}},
+		},
+	})
+	upstream := newFakeBlobRegistry(map[string][]byte{layerDigest: layer})
+	upstream.manifests = map[string][]byte{"latest": manifest}
+	defer upstream.Close()
+
+	proxy := NewProxy(
+		"127.0.0.1:10000",
+		ghbackend.New(&githubClientMock{}, nil),
+		upstream.URL,
+		WithBlobCache(t.TempDir()),
+		WithZstdTranscoding("cat"),
+	)
+	get := func(path, userAgent string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer good")
+		req.Header.Set("User-Agent", userAgent)
+		res := httptest.NewRecorder()
+		proxy.Handler.ServeHTTP(res, req)
+		return res
+	}
+	manifestPath := "/v2/some-owner/some-package/manifests/latest"
+
+	// The layer is cached, and then transcoded on the next pull of a client
+	// supporting the zstd layers.
+	if res := get("/v2/some-owner/some-package/blobs/"+layerDigest, "containerd/v1.7.2"); res.Code != http.StatusOK {
+		t.Fatalf("expected the layer, got: %d", res.Code)
+	}
+	if res := get(manifestPath, "containerd/v1.7.2"); !bytes.Equal(res.Body.Bytes(), manifest) {
+		t.Fatalf("expected the manifest to be unchanged, got: %s", res.Body)
+	}
+	var res *httptest.ResponseRecorder
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res = get(manifestPath, "containerd/v1.7.2"); !bytes.Equal(res.Body.Bytes(), manifest) {
+			break
+		}
+	}
+	var transcoded manifestWithLayers
+	json.Unmarshal(res.Body.Bytes(), &transcoded)
+	if len(transcoded.Layers) != 1 || transcoded.Layers[0].MediaType != mediaTypeOCILayerZstd || transcoded.Layers[0].Digest != transcodedDigest || transcoded.Layers[0].Size != int64(len(uncompressed)) {
+		t.Fatalf("expected the zstd layer, got: %s", res.Body)
+	}
+	if strings.Contains(res.Body.String(), "annotation") {
+		t.Fatal("expected the annotations of the layer to be removed")
+	}
+
+	// The transcoded manifest and layer are served by digest.
+	digest := res.Header().Get("Docker-Content-Digest")
+	if res := get("/v2/some-owner/some-package/manifests/"+digest, "containerd/v1.7.2"); res.Body.String() != transcoded.raw {
+		t.Fatalf("expected the transcoded manifest, got: %d", res.Code)
+	}
+	if res := get("/v2/some-owner/some-package/blobs/"+transcodedDigest, "containerd/v1.7.2"); res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), uncompressed) {
+		t.Fatalf("expected the zstd layer, got: %d", res.Code)
+	}
+
+	// The other clients pull the gzip layers.
+	if res := get(manifestPath, "docker/24.0.7"); !bytes.Equal(res.Body.Bytes(), manifest) {
+		t.Fatalf("expected the manifest to be unchanged, got: %s", res.Body)
+	}
+}
+
+type manifestWithLayers struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	} `json:"layers"`
+
+	raw string
+}
+
+func (m *manifestWithLayers) UnmarshalJSON(data []byte) error {
+	type plain manifestWithLayers
+	m.raw = string(data)
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+func TestZstdSkipsEstargzLayers(t *testing.T) {
+	cache := cache.New(t.TempDir())
+	transcoder := &zstdTranscoder{cache: cache}
+	transcoder.queue = newConversionQueue("zstd", zstdTranscodingsTotal, transcoder.transcode)
+	layer := []byte("some layer")
+	w, _ := cache.Create(digestOf(layer), int64(len(layer)))
+	w.Write(layer)
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	json.Unmarshal([]byte(`{"layers":[{"mediaType":"`+mediaTypeOCILayerGzip+`","digest":"`+digestOf(layer)+`","size":10,"annotations":{"`+estargzTOCDigestAnnotation+`":"sha256:abc"}}]}`), &fields)
+	if changed, err := transcoder.rewriteLayers(fields); changed || err != nil {
+		t.Fatalf("expected the eStargz layer to be kept, got: %t, %v", changed, err)
+	}
+	if len(transcoder.queue.pending) != 0 {
+		t.Fatal("expected the eStargz layer not to be queued")
+	}
+}